@@ -11,7 +11,6 @@ require (
 	github.com/hashicorp/go-hclog v1.6.2
 	github.com/hashicorp/go-retryablehttp v0.7.5
 	github.com/klauspost/compress v1.17.7
-	github.com/psanford/memfs v0.0.0-20230130182539-4dbf7e3e865e
 	github.com/stretchr/testify v1.8.4
 	go.lsp.dev/uri v0.3.0
 	go.opentelemetry.io/otel v1.24.0
@@ -19,7 +18,6 @@ require (
 	golang.org/x/exp v0.0.0-20230817173708-d852ddb80c63
 	golang.org/x/sync v0.6.0
 	golang.org/x/sys v0.17.0
-	gopkg.in/ini.v1 v1.67.0
 )
 
 require (
@@ -0,0 +1,512 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"golang.org/x/exp/maps"
+
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+// The APKv3 database format of apk-tools 3, in which it writes indexes, see
+// https://gitlab.alpinelinux.org/alpine/apk-tools/-/blob/master/doc/apk-v3.5.scd
+//
+// A file is a header followed by blocks. The first block is the database itself: a tree of
+// values, each a uint32 with its type in the top 4 bits and either the value itself or the
+// offset in the block of where the value is in the rest.
+const (
+	adbMagic        = "ADB."
+	adbMagicDeflate = "ADBd"
+	adbMagicComp    = "ADBc"
+	adbSchemaIndex  = "indx"
+
+	adbBlockADB = 0
+	adbBlockSig = 1
+	adbBlockExt = 3
+
+	adbTypeSpecial = 0x00000000
+	adbTypeInt     = 0x10000000
+	adbTypeInt32   = 0x20000000
+	adbTypeInt64   = 0x30000000
+	adbTypeBlob8   = 0x80000000
+	adbTypeBlob16  = 0x90000000
+	adbTypeBlob32  = 0xa0000000
+	adbTypeArray   = 0xd0000000
+	adbTypeObject  = 0xe0000000
+	adbTypeMask    = 0xf0000000
+
+	adbCompNone    = 0
+	adbCompDeflate = 1
+)
+
+// Fields of the objects in an index.
+const (
+	adbIndexDescription = 1
+	adbIndexPackages    = 2
+
+	adbPkgName             = 1
+	adbPkgVersion          = 2
+	adbPkgHashes           = 3
+	adbPkgDescription      = 4
+	adbPkgArch             = 5
+	adbPkgLicense          = 6
+	adbPkgOrigin           = 7
+	adbPkgMaintainer       = 8
+	adbPkgURL              = 9
+	adbPkgRepoCommit       = 10
+	adbPkgBuildTime        = 11
+	adbPkgInstalledSize    = 12
+	adbPkgFileSize         = 13
+	adbPkgProviderPriority = 14
+	adbPkgDepends          = 15
+	adbPkgProvides         = 16
+	adbPkgReplaces         = 17
+	adbPkgInstallIf        = 18
+
+	adbDepName    = 1
+	adbDepVersion = 2
+	adbDepMatch   = 3
+)
+
+// The bits of the match of a dependency.
+const (
+	adbMatchEqual    = 1
+	adbMatchLess     = 2
+	adbMatchGreater  = 4
+	adbMatchFuzzy    = 8
+	adbMatchConflict = 16
+)
+
+// A signature block: its version, the digest algorithm, the first 16 bytes of the sha512 of
+// the public key that signed it, and the signature itself, see adb_sign_v0 in apk-tools.
+const (
+	adbSignHeaderSize = 18
+	adbDigestSHA512   = 4
+)
+
+// isADB returns whether b is in the APKv3 format, compressed or not, rather than a gzipped tar.
+func isADB(b []byte) bool {
+	if len(b) < 4 {
+		return false
+	}
+	switch string(b[:4]) {
+	case adbMagic, adbMagicDeflate, adbMagicComp:
+		return true
+	}
+	return false
+}
+
+// ParseADBIndex parses an index in the APKv3 format of apk-tools 3. Only the fields that an
+// APKINDEX also has are read. The signature is not verified, and Checksum is set to the
+// hash that identifies each package in the index, which for packages in the APKv3 format is
+// not the sha1 of a control section.
+func ParseADBIndex(b []byte) (*APKIndex, error) {
+	b, err := decompressADB(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 8 || string(b[:4]) != adbMagic {
+		return nil, errors.New("not an APKv3 database")
+	}
+	if schema := string(b[4:8]); schema != adbSchemaIndex {
+		return nil, fmt.Errorf("APKv3 database has schema %q, not an index", schema)
+	}
+
+	db, sigs, err := adbBlocks(b[8:])
+	if err != nil {
+		return nil, err
+	}
+	if len(db) < 8 {
+		return nil, errors.New("APKv3 database is too short")
+	}
+	a := adb(db)
+	root, err := a.object(binary.LittleEndian.Uint32(db[4:8]))
+	if err != nil {
+		return nil, fmt.Errorf("reading index: %w", err)
+	}
+
+	index := &APKIndex{}
+	if len(sigs) != 0 {
+		index.Signature = sigs[0]
+	}
+	if index.Description, err = a.string(root.field(adbIndexDescription)); err != nil {
+		return nil, fmt.Errorf("reading description: %w", err)
+	}
+	pkgs, err := a.object(root.field(adbIndexPackages))
+	if err != nil {
+		return nil, fmt.Errorf("reading packages: %w", err)
+	}
+	for i := 1; i < len(pkgs); i++ {
+		pkg, err := a.pkg(pkgs[i])
+		if err != nil {
+			return nil, fmt.Errorf("reading package %d: %w", i-1, err)
+		}
+		index.Packages = append(index.Packages, pkg)
+	}
+	return index, nil
+}
+
+// verifyADBSignature verifies the signature blocks of the APKv3 database b against keys,
+// returning the name of the key that verified it and its signature. A signature is over the
+// file header, the header of the signature block, and the sha512 of the database block.
+func verifyADBSignature(b []byte, keys map[string][]byte) (string, []byte, error) {
+	b, err := decompressADB(b)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(b) < 8 || string(b[:4]) != adbMagic {
+		return "", nil, errors.New("not an APKv3 database")
+	}
+	db, sigs, err := adbBlocks(b[8:])
+	if err != nil {
+		return "", nil, err
+	}
+	if len(sigs) == 0 {
+		return "", nil, fmt.Errorf("%w: APKv3 database is not signed", ErrMalformedSignature)
+	}
+	if len(keys) == 0 {
+		return "", nil, fmt.Errorf("%w to verify signature of APKv3 database", ErrNoTrustedKeys)
+	}
+	dbDigest := sha512.Sum512(db)
+	names := maps.Keys(keys)
+	sort.Strings(names)
+	var described []string
+	for _, sig := range sigs {
+		if len(sig) <= adbSignHeaderSize {
+			described = append(described, "malformed")
+			continue
+		}
+		described = append(described, fmt.Sprintf("key id %x", sig[2:adbSignHeaderSize]))
+		if version, alg := sig[0], sig[1]; version != 0 || alg != adbDigestSHA512 {
+			continue
+		}
+		h := sha512.New()
+		h.Write(b[:8])
+		h.Write(sig[:adbSignHeaderSize])
+		h.Write(dbDigest[:])
+		digest := h.Sum(nil)
+		for _, name := range names {
+			if err := sign.VerifyDigest(digest, crypto.SHA512, sig[adbSignHeaderSize:], keys[name]); err == nil {
+				return name, sig[adbSignHeaderSize:], nil
+			}
+		}
+	}
+	return "", nil, &SignatureMismatchError{Signatures: described, KeyNamesTried: names}
+}
+
+// decompressADB returns b uncompressed, if it is compressed.
+func decompressADB(b []byte) ([]byte, error) {
+	var r io.Reader
+	switch {
+	case bytes.HasPrefix(b, []byte(adbMagicDeflate)):
+		r = flate.NewReader(bytes.NewReader(b[4:]))
+	case bytes.HasPrefix(b, []byte(adbMagicComp)):
+		if len(b) < 6 {
+			return nil, errors.New("APKv3 compression header is too short")
+		}
+		switch alg := b[4]; alg {
+		case adbCompNone:
+			r = bytes.NewReader(b[6:])
+		case adbCompDeflate:
+			r = flate.NewReader(bytes.NewReader(b[6:]))
+		default:
+			return nil, fmt.Errorf("APKv3 compression %d is not supported", alg)
+		}
+	default:
+		return b, nil
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing APKv3 database: %w", err)
+	}
+	return out, nil
+}
+
+// adbBlocks returns the database block and the signature blocks in b.
+func adbBlocks(b []byte) (db []byte, sigs [][]byte, err error) {
+	for len(b) != 0 {
+		if len(b) < 4 {
+			return nil, nil, errors.New("truncated APKv3 block header")
+		}
+		typeSize := binary.LittleEndian.Uint32(b)
+		typ, size, header := typeSize>>30, uint64(typeSize&0x3fffffff), uint64(4)
+		if typ == adbBlockExt {
+			if len(b) < 16 {
+				return nil, nil, errors.New("truncated APKv3 block header")
+			}
+			typ, size, header = typeSize&0x3fffffff, binary.LittleEndian.Uint64(b[8:]), 16
+		}
+		if size < header || size > uint64(len(b)) {
+			return nil, nil, fmt.Errorf("APKv3 block of %d bytes does not fit in %d", size, len(b))
+		}
+		payload := b[header:size]
+		switch {
+		case typ == adbBlockADB && db == nil:
+			db = payload
+		case typ == adbBlockSig:
+			sigs = append(sigs, payload)
+		}
+		// Blocks are aligned to 8 bytes.
+		next := (size + 7) &^ 7
+		if next > uint64(len(b)) {
+			next = uint64(len(b))
+		}
+		b = b[next:]
+	}
+	if db == nil {
+		return nil, nil, errors.New("APKv3 database has no database block")
+	}
+	return db, sigs, nil
+}
+
+// adb is the database block of an APKv3 database, which values point into.
+type adb []byte
+
+// adbObject is an array or object: its values, of which the first is the number of values
+// including itself, so that field i is at index i.
+type adbObject []uint32
+
+// field returns field i of o, or 0, which is null, if it has no such field.
+func (o adbObject) field(i int) uint32 {
+	if i >= len(o) {
+		return 0
+	}
+	return o[i]
+}
+
+func (a adb) deref(v uint32, size uint64) ([]byte, error) {
+	off := uint64(v &^ adbTypeMask)
+	if off+size > uint64(len(a)) {
+		return nil, fmt.Errorf("value at %d is outside of the database", off)
+	}
+	return a[off : off+size], nil
+}
+
+func (a adb) object(v uint32) (adbObject, error) {
+	if v == 0 {
+		return nil, nil
+	}
+	if typ := v & adbTypeMask; typ != adbTypeArray && typ != adbTypeObject {
+		return nil, fmt.Errorf("value %#x is not an object", v)
+	}
+	b, err := a.deref(v, 4)
+	if err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(b)
+	if n == 0 {
+		return nil, nil
+	}
+	if b, err = a.deref(v, uint64(n)*4); err != nil {
+		return nil, err
+	}
+	o := make(adbObject, n)
+	for i := range o {
+		o[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+	return o, nil
+}
+
+func (a adb) blob(v uint32) ([]byte, error) {
+	var lenSize uint64
+	switch v & adbTypeMask {
+	case adbTypeSpecial:
+		return nil, nil
+	case adbTypeBlob8:
+		lenSize = 1
+	case adbTypeBlob16:
+		lenSize = 2
+	case adbTypeBlob32:
+		lenSize = 4
+	default:
+		return nil, fmt.Errorf("value %#x is not a blob", v)
+	}
+	b, err := a.deref(v, lenSize)
+	if err != nil {
+		return nil, err
+	}
+	var n uint64
+	switch lenSize {
+	case 1:
+		n = uint64(b[0])
+	case 2:
+		n = uint64(binary.LittleEndian.Uint16(b))
+	case 4:
+		n = uint64(binary.LittleEndian.Uint32(b))
+	}
+	b, err = a.deref(v, lenSize+n)
+	if err != nil {
+		return nil, err
+	}
+	return b[lenSize:], nil
+}
+
+func (a adb) string(v uint32) (string, error) {
+	b, err := a.blob(v)
+	return string(b), err
+}
+
+func (a adb) int(v uint32) (uint64, error) {
+	switch v & adbTypeMask {
+	case adbTypeSpecial:
+		return 0, nil
+	case adbTypeInt:
+		return uint64(v &^ adbTypeMask), nil
+	case adbTypeInt32:
+		b, err := a.deref(v, 4)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(binary.LittleEndian.Uint32(b)), nil
+	case adbTypeInt64:
+		b, err := a.deref(v, 8)
+		if err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint64(b), nil
+	}
+	return 0, fmt.Errorf("value %#x is not an integer", v)
+}
+
+// pkg returns the package info object v as a Package.
+func (a adb) pkg(v uint32) (*Package, error) {
+	o, err := a.object(v)
+	if err != nil {
+		return nil, err
+	}
+	pkg := &Package{}
+	for _, f := range []struct {
+		field int
+		dst   *string
+	}{
+		{adbPkgName, &pkg.Name},
+		{adbPkgVersion, &pkg.Version},
+		{adbPkgDescription, &pkg.Description},
+		{adbPkgArch, &pkg.Arch},
+		{adbPkgLicense, &pkg.License},
+		{adbPkgOrigin, &pkg.Origin},
+		{adbPkgMaintainer, &pkg.Maintainer},
+		{adbPkgURL, &pkg.URL},
+		{adbPkgRepoCommit, &pkg.RepoCommit},
+	} {
+		if *f.dst, err = a.string(o.field(f.field)); err != nil {
+			return nil, fmt.Errorf("field %d: %w", f.field, err)
+		}
+	}
+	if pkg.Checksum, err = a.blob(o.field(adbPkgHashes)); err != nil {
+		return nil, fmt.Errorf("hashes: %w", err)
+	}
+
+	for _, f := range []struct {
+		field int
+		dst   *uint64
+	}{
+		{adbPkgInstalledSize, &pkg.InstalledSize},
+		{adbPkgFileSize, &pkg.Size},
+		{adbPkgProviderPriority, &pkg.ProviderPriority},
+	} {
+		if *f.dst, err = a.int(o.field(f.field)); err != nil {
+			return nil, fmt.Errorf("field %d: %w", f.field, err)
+		}
+	}
+	buildTime, err := a.int(o.field(adbPkgBuildTime))
+	if err != nil {
+		return nil, fmt.Errorf("build time: %w", err)
+	}
+	pkg.BuildDate = int64(buildTime)
+	pkg.BuildTime = time.Unix(pkg.BuildDate, 0).UTC()
+
+	for _, f := range []struct {
+		field int
+		dst   *[]string
+	}{
+		{adbPkgDepends, &pkg.Dependencies},
+		{adbPkgProvides, &pkg.Provides},
+		{adbPkgReplaces, &pkg.Replaces},
+		{adbPkgInstallIf, &pkg.InstallIf},
+	} {
+		if *f.dst, err = a.dependencies(o.field(f.field)); err != nil {
+			return nil, fmt.Errorf("field %d: %w", f.field, err)
+		}
+	}
+	return pkg, nil
+}
+
+// dependencies returns the array of dependency objects v in the form of an APKINDEX.
+func (a adb) dependencies(v uint32) ([]string, error) {
+	deps, err := a.object(v)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for i := 1; i < len(deps); i++ {
+		dep, err := a.object(deps[i])
+		if err != nil {
+			return nil, err
+		}
+		name, err := a.string(dep.field(adbDepName))
+		if err != nil {
+			return nil, err
+		}
+		version, err := a.string(dep.field(adbDepVersion))
+		if err != nil {
+			return nil, err
+		}
+		match, err := a.int(dep.field(adbDepMatch))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, adbDependencyString(name, version, match))
+	}
+	return out, nil
+}
+
+func adbDependencyString(name, version string, match uint64) string {
+	s := name
+	if match&adbMatchConflict != 0 {
+		s = "!" + s
+	}
+	if version == "" {
+		return s
+	}
+	var op string
+	switch match &^ adbMatchConflict {
+	case adbMatchLess:
+		op = "<"
+	case adbMatchLess | adbMatchEqual:
+		op = "<="
+	case adbMatchGreater:
+		op = ">"
+	case adbMatchGreater | adbMatchEqual:
+		op = ">="
+	case adbMatchFuzzy, adbMatchFuzzy | adbMatchEqual:
+		op = "~"
+	default:
+		// A version without a match is an exact one.
+		op = "="
+	}
+	return s + op + version
+}
@@ -0,0 +1,343 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// adbWriter builds the database block of an APKv3 database, for tests.
+type adbWriter struct {
+	b []byte
+}
+
+func newADBWriter() *adbWriter {
+	// The header, with the root filled in by file.
+	return &adbWriter{b: []byte{0, 0, 0, 0, 0, 0, 0, 0}}
+}
+
+func (w *adbWriter) align(n int) {
+	for len(w.b)%n != 0 {
+		w.b = append(w.b, 0)
+	}
+}
+
+func (w *adbWriter) blob(s string) uint32 {
+	off := uint32(len(w.b))
+	if len(s) < 256 {
+		w.b = append(w.b, byte(len(s)))
+		w.b = append(w.b, s...)
+		return adbTypeBlob8 | off
+	}
+	w.b = binary.LittleEndian.AppendUint16(w.b, uint16(len(s)))
+	w.b = append(w.b, s...)
+	return adbTypeBlob16 | off
+}
+
+func (w *adbWriter) int(v uint64) uint32 {
+	if v < 1<<28 {
+		return adbTypeInt | uint32(v)
+	}
+	w.align(8)
+	off := uint32(len(w.b))
+	w.b = binary.LittleEndian.AppendUint64(w.b, v)
+	return adbTypeInt64 | off
+}
+
+func (w *adbWriter) object(typ uint32, fields ...uint32) uint32 {
+	w.align(4)
+	off := uint32(len(w.b))
+	w.b = binary.LittleEndian.AppendUint32(w.b, uint32(len(fields)+1))
+	for _, f := range fields {
+		w.b = binary.LittleEndian.AppendUint32(w.b, f)
+	}
+	return typ | off
+}
+
+func (w *adbWriter) dep(name, version string, match uint64) uint32 {
+	fields := []uint32{w.blob(name), 0, 0}
+	if version != "" {
+		fields[1] = w.blob(version)
+	}
+	if match != 0 {
+		fields[2] = w.int(match)
+	}
+	return w.object(adbTypeObject, fields...)
+}
+
+// file returns an APKv3 index file with root as its root and a signature block.
+func (w *adbWriter) file(root uint32) []byte {
+	binary.LittleEndian.PutUint32(w.b[4:], root)
+	out := []byte(adbMagic + adbSchemaIndex)
+	block := func(typ uint32, payload []byte) {
+		out = binary.LittleEndian.AppendUint32(out, typ<<30|uint32(4+len(payload)))
+		out = append(out, payload...)
+		for len(out)%8 != 0 {
+			out = append(out, 0)
+		}
+	}
+	block(adbBlockADB, w.b)
+	block(adbBlockSig, []byte("signature"))
+	return out
+}
+
+// signADB appends a signature block by key to the APKv3 database b, as apk mkndx does.
+func signADB(t *testing.T, b []byte, key *rsa.PrivateKey) []byte {
+	db, _, err := adbBlocks(b[8:])
+	require.NoError(t, err)
+	id := sha512.Sum512(x509.MarshalPKCS1PublicKey(&key.PublicKey))
+	header := append([]byte{0, adbDigestSHA512}, id[:16]...)
+	dbDigest := sha512.Sum512(db)
+	h := sha512.New()
+	h.Write(b[:8])
+	h.Write(header)
+	h.Write(dbDigest[:])
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA512, h.Sum(nil))
+	require.NoError(t, err)
+
+	payload := append(header, sig...)
+	out := binary.LittleEndian.AppendUint32(append([]byte{}, b...), adbBlockSig<<30|uint32(4+len(payload)))
+	out = append(out, payload...)
+	for len(out)%8 != 0 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+func testADBKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func testADBIndex() []byte {
+	w := newADBWriter()
+	busybox := w.object(adbTypeObject,
+		w.blob("busybox"),                // name
+		w.blob("1.36.1-r5"),              // version
+		w.blob("\x01\x02\x03"),           // hashes
+		w.blob("size optimized toolbox"), // description
+		w.blob("x86_64"),                 // arch
+		w.blob("GPL-2.0-only"),           // license
+		w.blob("busybox"),                // origin
+		w.blob("Natanael Copa"),          // maintainer
+		w.blob("https://busybox.net/"),   // url
+		w.blob("commit"),                 // repo-commit
+		w.int(1701954729),                // build-time
+		w.int(1032192),                   // installed-size
+		w.int(5<<30),                     // file-size
+		w.int(100),                       // provider-priority
+		w.object(adbTypeArray, w.dep("so:libc.musl-x86_64.so.1", "", 0)), // depends
+		w.object(adbTypeArray, w.dep("cmd:sh", "1.36.1-r5", 0)),          // provides
+		w.object(adbTypeArray, w.dep("busybox-static", "", 0)),           // replaces
+	)
+	doc := w.object(adbTypeObject,
+		w.blob("busybox-doc"),
+		w.blob("1.36.1-r5"),
+		w.blob("\x04\x05\x06"),
+		0, // no description
+		w.blob("x86_64"),
+		0, 0, 0, 0, 0, 0, 0,
+		w.int(1234),
+		0,
+		w.object(adbTypeArray,
+			w.dep("busybox", "1.36", adbMatchGreater|adbMatchEqual),
+			w.dep("busybox-tiny", "", adbMatchConflict),
+		),
+		0, 0,
+		w.object(adbTypeArray, w.dep("busybox", "1.36.1-r5", adbMatchEqual), w.dep("docs", "", 0)), // install-if
+	)
+	root := w.object(adbTypeObject, w.blob("v3.19.0"), w.object(adbTypeArray, busybox, doc))
+	return w.file(root)
+}
+
+func TestParseADBIndex(t *testing.T) {
+	b := testADBIndex()
+	want := &APKIndex{
+		Description: "v3.19.0",
+		Signature:   []byte("signature"),
+		Packages: []*Package{{
+			Name:             "busybox",
+			Version:          "1.36.1-r5",
+			Checksum:         []byte{1, 2, 3},
+			Description:      "size optimized toolbox",
+			Arch:             "x86_64",
+			License:          "GPL-2.0-only",
+			Origin:           "busybox",
+			Maintainer:       "Natanael Copa",
+			URL:              "https://busybox.net/",
+			RepoCommit:       "commit",
+			BuildDate:        1701954729,
+			BuildTime:        time.Unix(1701954729, 0).UTC(),
+			InstalledSize:    1032192,
+			Size:             5 << 30,
+			ProviderPriority: 100,
+			Dependencies:     []string{"so:libc.musl-x86_64.so.1"},
+			Provides:         []string{"cmd:sh=1.36.1-r5"},
+			Replaces:         []string{"busybox-static"},
+		}, {
+			Name:         "busybox-doc",
+			Version:      "1.36.1-r5",
+			Checksum:     []byte{4, 5, 6},
+			Arch:         "x86_64",
+			BuildTime:    time.Unix(0, 0).UTC(),
+			Size:         1234,
+			Dependencies: []string{"busybox>=1.36", "!busybox-tiny"},
+			InstallIf:    []string{"busybox=1.36.1-r5", "docs"},
+		}},
+	}
+
+	t.Run("uncompressed", func(t *testing.T) {
+		require.True(t, isADB(b))
+		index, err := ParseADBIndex(b)
+		require.NoError(t, err)
+		require.Equal(t, want, index)
+	})
+
+	t.Run("deflate", func(t *testing.T) {
+		var compressed bytes.Buffer
+		compressed.WriteString(adbMagicComp)
+		compressed.Write([]byte{adbCompDeflate, 9})
+		fw, err := flate.NewWriter(&compressed, flate.BestCompression)
+		require.NoError(t, err)
+		_, err = fw.Write(b)
+		require.NoError(t, err)
+		require.NoError(t, fw.Close())
+
+		index, err := ParseADBIndex(compressed.Bytes())
+		require.NoError(t, err)
+		require.Equal(t, want, index)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		for _, n := range []int{4, 12, 40, len(b) / 2} {
+			_, err := ParseADBIndex(b[:n])
+			require.Error(t, err, "truncated to %d bytes", n)
+		}
+	})
+
+	t.Run("not an index", func(t *testing.T) {
+		pkg := append([]byte(adbMagic+"pckg"), b[8:]...)
+		_, err := ParseADBIndex(pkg)
+		require.ErrorContains(t, err, `schema "pckg"`)
+	})
+}
+
+func TestVerifyADBSignature(t *testing.T) {
+	key, pub := testADBKey(t)
+	_, otherPub := testADBKey(t)
+	b := signADB(t, testADBIndex(), key)
+
+	t.Run("verified", func(t *testing.T) {
+		name, sig, err := verifyADBSignature(b, map[string][]byte{"other.rsa.pub": otherPub, "key.rsa.pub": pub})
+		require.NoError(t, err)
+		require.Equal(t, "key.rsa.pub", name)
+		require.Len(t, sig, 256)
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		var compressed bytes.Buffer
+		compressed.WriteString(adbMagicDeflate)
+		fw, err := flate.NewWriter(&compressed, flate.BestCompression)
+		require.NoError(t, err)
+		_, err = fw.Write(b)
+		require.NoError(t, err)
+		require.NoError(t, fw.Close())
+
+		name, _, err := verifyADBSignature(compressed.Bytes(), map[string][]byte{"key.rsa.pub": pub})
+		require.NoError(t, err)
+		require.Equal(t, "key.rsa.pub", name)
+	})
+
+	t.Run("untrusted key", func(t *testing.T) {
+		_, _, err := verifyADBSignature(b, map[string][]byte{"other.rsa.pub": otherPub})
+		require.ErrorIs(t, err, ErrSignatureMismatch)
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		tampered := bytes.Replace(b, []byte("busybox-doc"), []byte("busybox-dop"), 1)
+		_, _, err := verifyADBSignature(tampered, map[string][]byte{"key.rsa.pub": pub})
+		require.ErrorIs(t, err, ErrSignatureMismatch)
+	})
+
+	t.Run("no keys", func(t *testing.T) {
+		_, _, err := verifyADBSignature(b, nil)
+		require.ErrorIs(t, err, ErrNoTrustedKeys)
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		// without the placeholder signature block that testADBIndex ends with
+		unsigned := testADBIndex()
+		unsigned = unsigned[:len(unsigned)-16]
+		_, _, err := verifyADBSignature(unsigned, map[string][]byte{"key.rsa.pub": pub})
+		require.ErrorIs(t, err, ErrMalformedSignature)
+	})
+}
+
+func TestGetADBRepositoryIndex(t *testing.T) {
+	key, pub := testADBKey(t)
+	_, otherPub := testADBKey(t)
+
+	t.Run("ignoring signatures", func(t *testing.T) {
+		repo := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(repo, testArch), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(repo, testArch, indexFilename), testADBIndex(), 0o644))
+
+		indexes, err := GetRepositoryIndexes(context.Background(), []string{repo}, nil, testArch,
+			withIndexCache(NewIndexCache()), WithIgnoreSignatures(true))
+		require.NoError(t, err)
+		require.Len(t, indexes, 1)
+		require.Equal(t, 2, indexes[0].Count())
+		require.Equal(t, "busybox", indexes[0].Packages()[0].Name)
+
+		_, err = GetRepositoryIndexes(context.Background(), []string{repo}, map[string][]byte{"key.rsa.pub": pub}, testArch,
+			withIndexCache(NewIndexCache()))
+		require.ErrorIs(t, err, ErrSignatureMismatch)
+	})
+
+	t.Run("only Packages.adb", func(t *testing.T) {
+		repo := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(repo, testArch), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(repo, testArch, adbIndexFilename), signADB(t, testADBIndex(), key), 0o644))
+
+		indexes, err := GetRepositoryIndexes(context.Background(), []string{repo}, map[string][]byte{"key.rsa.pub": pub}, testArch,
+			withIndexCache(NewIndexCache()))
+		require.NoError(t, err)
+		require.Len(t, indexes, 1)
+		require.Equal(t, 2, indexes[0].Count())
+		require.Equal(t, "key.rsa.pub", indexes[0].(VerifiedNamedIndex).SigningKeyName())
+
+		_, err = GetRepositoryIndexes(context.Background(), []string{repo}, map[string][]byte{"other.rsa.pub": otherPub}, testArch,
+			withIndexCache(NewIndexCache()))
+		require.ErrorIs(t, err, ErrSignatureMismatch)
+	})
+}
@@ -5,12 +5,12 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
-	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -20,7 +20,8 @@ import (
 const apkIndexFilename = "APKINDEX"
 const descriptionFilename = "DESCRIPTION"
 
-// Go template for generating the APKINDEX file from an ApkIndex struct
+// Go template for generating the APKINDEX file from an ApkIndex struct, with the fields in
+// the order apk index writes them
 var apkIndexTemplate = template.Must(template.New(apkIndexFilename).Funcs(
 	template.FuncMap{
 		// Helper function to join slice of string by space
@@ -58,30 +59,62 @@ var apkIndexTemplate = template.Must(template.New(apkIndexFilename).Funcs(
 		{{- if .RepoCommit}}
 		c:{{.RepoCommit}}
 		{{- end}}
+		{{- if .ProviderPriority}}
+		k:{{.ProviderPriority}}
+		{{- end}}
 		{{- if .Dependencies}}
 		D:{{join .Dependencies}}
 		{{- end}}
-		{{- if .InstallIf}}
-		i:{{.InstallIf}}
-		{{- end}}
 		{{- if .Provides}}
 		p:{{join .Provides}}
 		{{- end}}
-		{{- if .ProviderPriority}}
-		k:{{.ProviderPriority}}
+		{{- if .InstallIf}}
+		i:{{join .InstallIf}}
+		{{- end}}
+		{{- range .ExtraFields}}
+		{{.Key}}:{{.Value}}
 		{{- end}}
 
 	`)))
 
 type APKIndex struct { //nolint:revive
-	Signature   []byte
-	Description string
-	Packages    []*Package
+	Signature []byte
+	// SigningKeyName is the name of the key that verified Signature, if it was verified.
+	SigningKeyName string
+	Description    string
+	Packages       []*Package
+	// Checksum is the sha256 of the archive the index was read from, if it was fetched
+	// from a repository.
+	Checksum []byte
+
+	// queries are the maps for ByName and the other queries, built when first needed.
+	// queriesMu is a pointer so that APKIndex can be copied, and is set by queriesLock.
+	queriesMu *sync.Mutex
+	queries   *indexQueries
 }
 
+// ErrStopParsing can be returned by the function passed to ParsePackageIndexFunc to stop
+// parsing without an error.
+var ErrStopParsing = errors.New("stop parsing")
+
 // ParsePackageIndex parses a plain (uncompressed) APKINDEX file. It returns an
 // ApkIndex struct
 func ParsePackageIndex(apkIndexUnpacked io.Reader) ([]*Package, error) {
+	packages := []*Package{}
+	err := ParsePackageIndexFunc(apkIndexUnpacked, func(pkg *Package) error {
+		packages = append(packages, pkg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return packages, nil
+}
+
+// ParsePackageIndexFunc parses a plain (uncompressed) APKINDEX file like ParsePackageIndex,
+// but calls fn with each package as soon as it is parsed instead of returning them all.
+// If fn returns ErrStopParsing, it stops and returns nil; any other error is returned.
+func ParsePackageIndexFunc(apkIndexUnpacked io.Reader, fn func(*Package) error) error {
 	if closer, ok := apkIndexUnpacked.(io.Closer); ok {
 		defer closer.Close()
 	}
@@ -91,19 +124,25 @@ func ParsePackageIndex(apkIndexUnpacked io.Reader) ([]*Package, error) {
 	pkg := &Package{}
 	linenr := 1
 
-	packages := []*Package{}
+	emit := func() error {
+		if pkg.Name == "" {
+			return nil
+		}
+		return fn(pkg)
+	}
 	for indexScanner.Scan() {
 		line := indexScanner.Text()
 		if len(line) == 0 {
-			if pkg.Name != "" {
-				packages = append(packages, pkg)
+			if err := emit(); err != nil {
+				return stopParsing(err)
 			}
 			pkg = &Package{}
+			linenr++
 			continue
 		}
 
 		if len(line) > 1 && line[1:2] != ":" {
-			return nil, fmt.Errorf("cannot parse line %d: expected \":\" in not found", linenr)
+			return fmt.Errorf("cannot parse line %d: expected \":\" in not found", linenr)
 		}
 
 		token := line[:1]
@@ -135,7 +174,7 @@ func ParsePackageIndex(apkIndexUnpacked io.Reader) ([]*Package, error) {
 		case "t":
 			i, err := strconv.ParseInt(val, 10, 64)
 			if err != nil {
-				return nil, fmt.Errorf("cannot parse build time %s: %w", val, err)
+				return fmt.Errorf("cannot parse build time %s: %w", val, err)
 			}
 			pkg.BuildDate = i
 			pkg.BuildTime = time.Unix(i, 0).UTC()
@@ -144,36 +183,47 @@ func ParsePackageIndex(apkIndexUnpacked io.Reader) ([]*Package, error) {
 		case "S":
 			size, err := strconv.ParseUint(val, 10, 64)
 			if err != nil {
-				return nil, fmt.Errorf("cannot parse size field %s: %w", val, err)
+				return fmt.Errorf("cannot parse size field %s: %w", val, err)
 			}
 			pkg.Size = size
 		case "I":
 			installedSize, err := strconv.ParseUint(val, 10, 64)
 			if err != nil {
-				return nil, fmt.Errorf("cannot parse installed size field %s: %w", val, err)
+				return fmt.Errorf("cannot parse installed size field %s: %w", val, err)
 			}
 			pkg.InstalledSize = installedSize
 		case "k":
 			priority, err := strconv.ParseUint(val, 10, 64)
 			if err != nil {
-				return nil, fmt.Errorf("cannot parse provider priority field %s: %w", val, err)
+				return fmt.Errorf("cannot parse provider priority field %s: %w", val, err)
 			}
 			pkg.ProviderPriority = priority
 		case "C":
-			// Handle SHA1 checksums:
-			if strings.HasPrefix(val, "Q1") {
-				checksum, err := base64.StdEncoding.DecodeString(val[2:])
-				if err != nil {
-					return nil, err
-				}
-				pkg.Checksum = checksum
+			checksum, err := ParseChecksum(val)
+			if err != nil {
+				return err
 			}
+			pkg.Checksum = checksum
+		default:
+			pkg.ExtraFields = append(pkg.ExtraFields, IndexField{Key: token, Value: val})
 		}
 
 		linenr++
 	}
+	if err := indexScanner.Err(); err != nil {
+		return fmt.Errorf("reading index at line %d: %w", linenr, err)
+	}
 
-	return packages, nil
+	// The last package, if the index does not end with an empty line.
+	return stopParsing(emit())
+}
+
+// stopParsing returns err, or nil if it is ErrStopParsing.
+func stopParsing(err error) error {
+	if errors.Is(err, ErrStopParsing) {
+		return nil
+	}
+	return err
 }
 
 func IndexFromArchive(archive io.ReadCloser) (*APKIndex, error) {
@@ -224,7 +274,31 @@ func IndexFromArchive(archive io.ReadCloser) (*APKIndex, error) {
 	return apkindex, nil
 }
 
-func ArchiveFromIndex(apkindex *APKIndex) (archive io.Reader, err error) {
+type archiveOpts struct {
+	modTime time.Time
+}
+
+// ArchiveOption configures ArchiveFromIndex.
+type ArchiveOption func(*archiveOpts)
+
+// WithArchiveModTime sets the modification time of the files in the archive, which
+// apk index sets to the build time. Default is the Unix epoch, for reproducible output.
+func WithArchiveModTime(t time.Time) ArchiveOption {
+	return func(o *archiveOpts) {
+		o.modTime = t
+	}
+}
+
+// ArchiveFromIndex returns an unsigned APKINDEX.tar.gz for apkindex, laid out the way
+// apk index writes it: a DESCRIPTION and an APKINDEX file with the fields of each package
+// in apk-tools order, in a tar stream with the same headers. The output only depends on
+// apkindex and the options.
+func ArchiveFromIndex(apkindex *APKIndex, opts ...ArchiveOption) (archive io.Reader, err error) {
+	o := &archiveOpts{modTime: time.Unix(0, 0)}
+	for _, opt := range opts {
+		opt(o)
+	}
+
 	// Execute the template and append output for each package in the index
 	var apkindexContents bytes.Buffer
 	for _, pkg := range apkindex.Packages {
@@ -237,51 +311,103 @@ func ArchiveFromIndex(apkindex *APKIndex) (archive io.Reader, err error) {
 		}
 	}
 
-	// Create the tarball
+	// Create the tarball. Like apk-tools, this has no mtime or name in the gzip header.
 	var tarballContents bytes.Buffer
-	gw := gzip.NewWriter(&tarballContents)
-	defer gw.Close()
-	tw := tar.NewWriter(gw)
-	defer tw.Close()
+	gw, err := gzip.NewWriterLevel(&tarballContents, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	gw.OS = 3 // Unix
 
-	// Add APKINDEX and DESCRIPTION files to the tarball
+	// Add DESCRIPTION and APKINDEX files to the tarball
 	for _, item := range []struct {
 		filename string
 		contents []byte
 	}{
-		{apkIndexFilename, apkindexContents.Bytes()},
 		{descriptionFilename, []byte(apkindex.Description)},
+		{apkIndexFilename, apkindexContents.Bytes()},
 	} {
-		var info os.FileInfo = &tarballItemFileInfo{item.filename, int64(len(item.contents))}
-		header, err := tar.FileInfoHeader(info, item.filename)
-		if err != nil {
-			return nil, fmt.Errorf("creating tar header for %s: %w", item.filename, err)
-		}
-		header.Name = item.filename
-		if err := tw.WriteHeader(header); err != nil {
-			return nil, fmt.Errorf("writing tar header for %s: %w", item.filename, err)
-		}
-		if _, err = io.Copy(tw, bytes.NewReader(item.contents)); err != nil {
-			return nil, fmt.Errorf("copying tar contents for %s: %w", item.filename, err)
+		if err := writeAPKTarEntry(gw, item.filename, item.contents, 0o644, o.modTime.Unix()); err != nil {
+			return nil, fmt.Errorf("writing %s: %w", item.filename, err)
 		}
 	}
+	// The end of the archive, which apk-tools does not pad to a full record.
+	if _, err := gw.Write(make([]byte, 2*tarBlockSize)); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
 
 	// Return io.ReadCloser representing the tarball
 	return &tarballContents, nil
 }
 
-// This type implements os.FileInfo, allowing us to construct
-// a tar header without needing to run os.Stat on a file
-type tarballItemFileInfo struct {
-	name string
-	size int64
+// WriteArchiveToFile writes the archive of apkindex returned by ArchiveFromIndex to path,
+// replacing any file that is there.
+func WriteArchiveToFile(apkindex *APKIndex, path string, opts ...ArchiveOption) error {
+	archive, err := ArchiveFromIndex(apkindex, opts...)
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(archive)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, b); err != nil {
+		return fmt.Errorf("writing index archive %s: %w", path, err)
+	}
+	return nil
 }
 
-func (info *tarballItemFileInfo) Name() string       { return info.name }
-func (info *tarballItemFileInfo) Size() int64        { return info.size }
-func (info *tarballItemFileInfo) Mode() os.FileMode  { return 0644 }
-func (info *tarballItemFileInfo) ModTime() time.Time { return time.Time{} }
-func (info *tarballItemFileInfo) IsDir() bool        { return false }
-func (info *tarballItemFileInfo) Sys() interface{}   { return nil }
+const tarBlockSize = 512
+
+// writeAPKTarEntry writes a regular file owned by root to w, with a header formatted like
+// the ones apk-tools writes, which archive/tar does not reproduce: size and mtime fill their
+// fields without a terminating NUL, and the magic is that of GNU tar.
+func writeAPKTarEntry(w io.Writer, name string, contents []byte, mode, mtime int64) error {
+	var hdr [tarBlockSize]byte
+	if len(name) > 100 {
+		return fmt.Errorf("name %q is too long", name)
+	}
+	copy(hdr[0:100], name)
+	putTarOctal(hdr[100:107], mode)
+	putTarOctal(hdr[108:115], 0) // uid
+	putTarOctal(hdr[116:123], 0) // gid
+	putTarOctal(hdr[124:136], int64(len(contents)))
+	putTarOctal(hdr[136:148], mtime)
+	hdr[156] = tar.TypeReg
+	copy(hdr[257:265], "ustar  \x00")
+	copy(hdr[265:297], "root")
+	copy(hdr[297:329], "root")
+
+	// The checksum is computed with its own field as spaces.
+	copy(hdr[148:156], "        ")
+	var sum int64
+	for _, b := range hdr {
+		sum += int64(b)
+	}
+	putTarOctal(hdr[148:154], sum)
+	hdr[154] = 0
 
-var _ os.FileInfo = (*tarballItemFileInfo)(nil)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(contents); err != nil {
+		return err
+	}
+	if pad := len(contents) % tarBlockSize; pad != 0 {
+		if _, err := w.Write(make([]byte, tarBlockSize-pad)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putTarOctal writes v to field as zero-padded octal digits filling it.
+func putTarOctal(field []byte, v int64) {
+	for i := len(field) - 1; i >= 0; i-- {
+		field[i] = byte('0' + v%8)
+		v /= 8
+	}
+}
@@ -2,12 +2,17 @@ package apk
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/MakeNowJust/heredoc/v2"
 	"github.com/stretchr/testify/assert"
@@ -59,7 +64,7 @@ func TestSinglePackage(t *testing.T) {
 	assert.EqualValues(9180, pkg.Size)
 	assert.EqualValues(40960, pkg.InstalledSize)
 	assert.EqualValues(9001, pkg.ProviderPriority)
-	require.Equal(t, []byte{
+	require.Equal(t, Checksum{
 		0xd, 0xe6, 0xf4, 0x8c, 0xdc, 0xad, 0x92, 0xb8, 0xcf, 0x5b,
 		0x83, 0x7f, 0x78, 0xa2, 0xd9, 0xe3, 0x70, 0x70, 0x3a, 0x5c,
 	}, pkg.Checksum)
@@ -210,3 +215,222 @@ func TestArchiveFromIndex(t *testing.T) {
 	require.Truef(t, foundApkIndex, "Could not locate file %s in archive", apkIndexFilename)
 	require.Truef(t, foundDescription, "Could not locate file %s in archive", descriptionFilename)
 }
+
+func TestIndexFields(t *testing.T) {
+	// An index written by apk index, with all of o:, m:, c:, i: and k:.
+	b := apkIndexFromArchive(t, "testdata/alpine-317/APKINDEX.tar.gz")
+	packages, err := ParsePackageIndex(bytes.NewReader(b))
+	require.NoError(t, err)
+	byName := map[string]*Package{}
+	for _, pkg := range packages {
+		byName[pkg.Name] = pkg
+	}
+
+	binsh := byName["busybox-binsh"]
+	require.NotNil(t, binsh)
+	require.Equal(t, "busybox", binsh.Origin)
+	require.Equal(t, "Sören Tempel <soeren+alpine@soeren-tempel.net>", binsh.Maintainer)
+	require.Equal(t, "1dbf7a793afae640ea643a055b6dd4f430ac116b", binsh.RepoCommit)
+	require.Equal(t, uint64(100), binsh.ProviderPriority)
+	require.Empty(t, binsh.InstallIf)
+
+	completion := byName["kmod-bash-completion"]
+	require.NotNil(t, completion)
+	require.Equal(t, "kmod", completion.Origin)
+	require.Equal(t, []string{"kmod=30-r1", "bash-completion"}, completion.InstallIf)
+	require.Zero(t, completion.ProviderPriority)
+
+	// Writing the index back out must not lose or change any of them.
+	archive, err := ArchiveFromIndex(&APKIndex{Packages: packages})
+	require.NoError(t, err)
+	index, err := IndexFromArchive(io.NopCloser(archive))
+	require.NoError(t, err)
+	require.Equal(t, packages, index.Packages)
+
+	archive, err = ArchiveFromIndex(&APKIndex{Packages: packages})
+	require.NoError(t, err)
+	gzipReader, err := gzip.NewReader(archive)
+	require.NoError(t, err)
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		hdr, err := tarReader.Next()
+		require.NoError(t, err)
+		if hdr.Name == apkIndexFilename {
+			break
+		}
+	}
+	written, err := io.ReadAll(tarReader)
+	require.NoError(t, err)
+	require.Equal(t, string(b), string(written))
+}
+
+func TestArchiveFromIndexMatchesApkIndex(t *testing.T) {
+	// The index of the test repository was written and signed by apk index, with the build
+	// time as the modification time of its files.
+	b, err := os.ReadFile("testdata/alpine-316/APKINDEX.tar.gz")
+	require.NoError(t, err)
+	members := gzipMembers(t, b)
+	require.Len(t, members, 2, "expected a signature and an index")
+
+	index, err := IndexFromArchive(io.NopCloser(bytes.NewReader(b)))
+	require.NoError(t, err)
+	archive, err := ArchiveFromIndex(index, WithArchiveModTime(time.Unix(1669068262, 0)))
+	require.NoError(t, err)
+	written, err := io.ReadAll(archive)
+	require.NoError(t, err)
+	got := gzipMembers(t, written)
+	require.Len(t, got, 1)
+	require.True(t, bytes.Equal(members[1], got[0]), "the tar stream differs from the one written by apk index")
+
+	// It reads back as the same index, less the signature.
+	parsed, err := IndexFromArchive(io.NopCloser(bytes.NewReader(written)))
+	require.NoError(t, err)
+	index.Signature = nil
+	require.Equal(t, index, parsed)
+
+	// And the output is reproducible.
+	again, err := ArchiveFromIndex(index, WithArchiveModTime(time.Unix(1669068262, 0)))
+	require.NoError(t, err)
+	againBytes, err := io.ReadAll(again)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(written, againBytes))
+}
+
+func TestWriteArchiveToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "APKINDEX.tar.gz")
+	index := &APKIndex{Description: "test", Packages: []*Package{{Name: "foo", Version: "1.0-r0"}}}
+	require.NoError(t, WriteArchiveToFile(index, path))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	parsed, err := IndexFromArchive(f)
+	require.NoError(t, err)
+	require.Equal(t, "test", parsed.Description)
+	require.Len(t, parsed.Packages, 1)
+	require.Equal(t, "foo", parsed.Packages[0].Name)
+}
+
+// gzipMembers returns the decompressed contents of each gzip stream concatenated in b.
+func gzipMembers(t *testing.T, b []byte) [][]byte {
+	r := bufio.NewReader(bytes.NewReader(b))
+	z, err := gzip.NewReader(r)
+	require.NoError(t, err)
+	z.Multistream(false)
+	var members [][]byte
+	for {
+		member, err := io.ReadAll(z)
+		require.NoError(t, err)
+		members = append(members, member)
+		err = z.Reset(r)
+		if err == io.EOF {
+			return members
+		}
+		require.NoError(t, err)
+	}
+}
+
+func TestParsePackageIndexFunc(t *testing.T) {
+	b := apkIndexFromArchive(t, "testdata/alpine-317/APKINDEX.tar.gz")
+
+	var names []string
+	require.NoError(t, ParsePackageIndexFunc(bytes.NewReader(b), func(pkg *Package) error {
+		names = append(names, pkg.Name)
+		if pkg.Name == "mariadb-plugin-rocksdb" {
+			return ErrStopParsing
+		}
+		return nil
+	}))
+	require.Equal(t, []string{"nasm-doc", "mariadb-plugin-rocksdb"}, names)
+
+	errBoom := errors.New("boom")
+	err := ParsePackageIndexFunc(bytes.NewReader(b), func(*Package) error { return errBoom })
+	require.ErrorIs(t, err, errBoom)
+
+	// The last package is parsed even if the index does not end with an empty line.
+	packages, err := ParsePackageIndex(bytes.NewReader(b))
+	require.NoError(t, err)
+	trimmed, err := ParsePackageIndex(bytes.NewReader(bytes.TrimRight(b, "\n")))
+	require.NoError(t, err)
+	require.Equal(t, packages, trimmed)
+}
+
+func BenchmarkParsePackageIndex(b *testing.B) {
+	index := apkIndexFromArchive(b, "testdata/alpine-316/APKINDEX.tar.gz")
+
+	b.Run("slice", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			packages, err := ParsePackageIndex(bytes.NewReader(index))
+			require.NoError(b, err)
+			for _, pkg := range packages {
+				if pkg.Name == "busybox" {
+					break
+				}
+			}
+		}
+	})
+
+	b.Run("func", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			require.NoError(b, ParsePackageIndexFunc(bytes.NewReader(index), func(pkg *Package) error {
+				if pkg.Name == "busybox" {
+					return ErrStopParsing
+				}
+				return nil
+			}))
+		}
+	})
+}
+
+// apkIndexFromArchive returns the uncompressed APKINDEX file of the index archive at path.
+func apkIndexFromArchive(tb testing.TB, path string) []byte {
+	f, err := os.Open(path)
+	require.NoError(tb, err)
+	defer f.Close()
+	gzipReader, err := gzip.NewReader(f)
+	require.NoError(tb, err)
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		hdr, err := tarReader.Next()
+		require.NoError(tb, err)
+		if hdr.Name == apkIndexFilename {
+			b, err := io.ReadAll(tarReader)
+			require.NoError(tb, err)
+			return b
+		}
+	}
+}
+
+func TestIndexExtraFields(t *testing.T) {
+	stanza := heredoc.Doc(`
+		C:Q1Pi7+Lp0TdU9DNxeZKvFbOSjmncw=
+		P:a-pkg
+		V:1.2.3-r1
+		A:x86_64
+		T:A sample package
+		D:so:libc.musl-x86_64.so.1
+		x:first extension
+		r:b-pkg
+		x:second extension
+
+	`)
+	packages, err := ParsePackageIndex(strings.NewReader(stanza))
+	require.NoError(t, err)
+	require.Len(t, packages, 1)
+	require.Equal(t, []IndexField{
+		{Key: "x", Value: "first extension"},
+		{Key: "r", Value: "b-pkg"},
+		{Key: "x", Value: "second extension"},
+	}, packages[0].ExtraFields)
+
+	var written bytes.Buffer
+	require.NoError(t, apkIndexTemplate.Execute(&written, packages[0]))
+	require.Equal(t, stanza, written.String())
+
+	// Changing a known field leaves them as they were.
+	packages[0].Version = "1.2.3-r2"
+	written.Reset()
+	require.NoError(t, apkIndexTemplate.Execute(&written, packages[0]))
+	require.Equal(t, strings.Replace(stanza, "V:1.2.3-r1", "V:1.2.3-r2", 1), written.String())
+}
@@ -0,0 +1,239 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	"go.opentelemetry.io/otel"
+)
+
+// AuditCategory is the kind of difference an AuditFinding is about.
+type AuditCategory string
+
+const (
+	// AuditMissing is for an entry of the installed database that is not on the filesystem.
+	AuditMissing AuditCategory = "missing"
+	// AuditType is for an entry that is a directory in the installed database and not on the
+	// filesystem, or the other way around.
+	AuditType AuditCategory = "type"
+	// AuditChecksum is for a file whose contents, or a symlink whose target, are not those that
+	// were installed.
+	AuditChecksum AuditCategory = "checksum"
+	// AuditMode is for an entry whose permissions, including the setuid, setgid and sticky
+	// bits, are not those that were installed.
+	AuditMode AuditCategory = "mode"
+	// AuditOwner is for an entry whose owner or group are not those that were installed.
+	AuditOwner AuditCategory = "owner"
+	// AuditExtra is for an entry in a directory of an installed package that no installed
+	// package has.
+	AuditExtra AuditCategory = "extra"
+)
+
+// AuditFinding is a difference between the installed database and the filesystem, see Audit.
+type AuditFinding struct {
+	Category AuditCategory
+	// Package is the installed package that has Path or, for AuditExtra, its directory.
+	Package string
+	// Path is relative to the root of the filesystem.
+	Path string
+	// Expected is what the installed database has, and Actual what is on the filesystem: "file"
+	// or "directory" for AuditType, Q1 checksums, octal modes and uid:gid owners. They are empty
+	// for AuditMissing and AuditExtra.
+	Expected string
+	Actual   string
+}
+
+func (f AuditFinding) String() string {
+	switch f.Category {
+	case AuditMissing, AuditExtra:
+		return fmt.Sprintf("%s: %s (%s)", f.Category, f.Path, f.Package)
+	}
+	return fmt.Sprintf("%s: %s (%s): expected %s, got %s", f.Category, f.Path, f.Package, f.Expected, f.Actual)
+}
+
+// databaseFiles returns the files of apk itself, which are not extra in a directory of a
+// package.
+func (a *APK) databaseFiles() map[string]bool {
+	return map[string]bool{
+		worldFilePath:         true,
+		reposFilePath:         true,
+		archFilePath:          true,
+		a.installedFilePath(): true,
+		a.scriptsFilePath():   true,
+		a.triggersFilePath():  true,
+		a.lockFilePath():      true,
+	}
+}
+
+// Audit checks the filesystem against the installed database, like apk audit: that each file,
+// symlink and directory of an installed package is there, with the checksum, mode and owner
+// that were installed, and that the directories of the packages have nothing else in them,
+// other than the files of apk itself and the keys. The findings are in installed database
+// order, followed by the extra entries. Audit does not change anything.
+func (a *APK) Audit(ctx context.Context) ([]AuditFinding, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Audit")
+	defer span.End()
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read installed packages: %w", err)
+	}
+	var (
+		// the package that owns each path that is not a directory, the last one like apk
+		owners = map[string]*InstalledPackage{}
+		// the first package with each directory, and the directories in that order
+		dirOwners = map[string]string{}
+		dirs      []string
+	)
+	for _, pkg := range installed {
+		for _, f := range pkg.Files {
+			name := filepath.Clean(f.Name)
+			if f.Typeflag != tar.TypeDir {
+				owners[name] = pkg
+				continue
+			}
+			if _, ok := dirOwners[name]; !ok {
+				dirOwners[name] = pkg.Name
+				dirs = append(dirs, name)
+			}
+		}
+	}
+
+	var findings []AuditFinding
+	audited := map[string]bool{}
+	for _, pkg := range installed {
+		for _, f := range pkg.Files {
+			name := filepath.Clean(f.Name)
+			// a directory is audited once, and a file for the package that has it now
+			if f.Typeflag == tar.TypeDir && audited[name] || f.Typeflag != tar.TypeDir && owners[name] != pkg {
+				continue
+			}
+			audited[name] = true
+			entryFindings, err := a.auditEntry(pkg.Name, name, f)
+			if err != nil {
+				return nil, err
+			}
+			findings = append(findings, entryFindings...)
+		}
+	}
+	for _, dir := range dirs {
+		extra, err := a.auditExtraEntries(dirOwners[dir], dir, owners, dirOwners)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, extra...)
+	}
+	clog.FromContext(ctx).Debugf("audited %d installed packages: %d findings", len(installed), len(findings))
+	return findings, nil
+}
+
+// auditEntry returns the findings for the entry at name of the installed package pkg, whose
+// installed database entry is expected.
+func (a *APK) auditEntry(pkg, name string, expected *tar.Header) ([]AuditFinding, error) {
+	finding := func(category AuditCategory, expected, actual string) AuditFinding {
+		return AuditFinding{Category: category, Package: pkg, Path: name, Expected: expected, Actual: actual}
+	}
+	isDir := expected.Typeflag == tar.TypeDir
+	var (
+		fi  fs.FileInfo
+		err error
+	)
+	if isDir {
+		// a directory may be a symlink to one, as with a merged /usr
+		fi, err = a.fs.Stat(name)
+	} else {
+		fi, err = a.fs.Lstat(name)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return []AuditFinding{finding(AuditMissing, "", "")}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to stat %s: %w", name, err)
+	}
+	if isDir != fi.IsDir() {
+		if isDir {
+			return []AuditFinding{finding(AuditType, "directory", "file")}, nil
+		}
+		return []AuditFinding{finding(AuditType, "file", "directory")}, nil
+	}
+	actual, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read metadata of %s: %w", name, err)
+	}
+
+	var findings []AuditFinding
+	if want, err := ParseChecksum(expected.PAXRecords[paxRecordsChecksumKey]); err == nil && want != nil {
+		var got Checksum
+		switch {
+		case fi.Mode()&fs.ModeSymlink != 0:
+			target, err := a.fs.Readlink(name)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read symlink %s: %w", name, err)
+			}
+			got = linkChecksum(target)
+		case fi.Mode().IsRegular():
+			if got, err = a.fileChecksum(name); err != nil {
+				return nil, err
+			}
+		}
+		if got != nil && !bytes.Equal(got, want) {
+			findings = append(findings, finding(AuditChecksum, want.String(), got.String()))
+		}
+	}
+	// symlinks have no mode of their own
+	if fi.Mode()&fs.ModeSymlink == 0 && actual.Mode&0o7777 != expected.Mode&0o7777 {
+		findings = append(findings, finding(AuditMode, fmt.Sprintf("%o", expected.Mode&0o7777), fmt.Sprintf("%o", actual.Mode&0o7777)))
+	}
+	if actual.Uid != expected.Uid || actual.Gid != expected.Gid {
+		findings = append(findings, finding(AuditOwner, fmt.Sprintf("%d:%d", expected.Uid, expected.Gid), fmt.Sprintf("%d:%d", actual.Uid, actual.Gid)))
+	}
+	return findings, nil
+}
+
+// auditExtraEntries returns an AuditExtra finding for each entry in dir, a directory of the
+// installed package pkg, that is neither in owners nor in dirs.
+func (a *APK) auditExtraEntries(pkg, dir string, owners map[string]*InstalledPackage, dirs map[string]string) ([]AuditFinding, error) {
+	// the entries of a symlink to a directory are audited in that directory, if it is a
+	// package's, and a missing directory is already a finding
+	if fi, err := a.fs.Lstat(dir); err != nil || !fi.IsDir() {
+		return nil, nil
+	}
+	entries, err := a.fs.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read directory %s: %w", dir, err)
+	}
+	databaseFiles := a.databaseFiles()
+	var findings []AuditFinding
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+		if _, ok := owners[name]; ok {
+			continue
+		}
+		if _, ok := dirs[name]; ok || databaseFiles[name] || strings.HasPrefix(name, keysDirPath+"/") {
+			continue
+		}
+		findings = append(findings, AuditFinding{Category: AuditExtra, Package: pkg, Path: name})
+	}
+	return findings, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestAudit(t *testing.T) {
+	ctx := context.Background()
+	a, err := New(WithFS(apkfs.NewMemFS()), WithIgnoreMknodErrors(true), WithIgnoreSignatureVerification(true))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+
+	pkg := triggerPackage(t,
+		&PkgInfo{Name: "audited", Version: "1.0-r0", Arch: "x86_64"},
+		fstest.MapFS{
+			"opt":                 {Mode: 0o755 | fs.ModeDir},
+			"opt/audited":         {Mode: 0o755 | fs.ModeDir},
+			"opt/audited/bin":     {Mode: 0o755, Data: []byte("bin")},
+			"opt/audited/conf":    {Mode: 0o644, Data: []byte("conf")},
+			"opt/audited/data":    {Mode: 0o644, Data: []byte("data")},
+			"opt/audited/missing": {Mode: 0o644, Data: []byte("missing")},
+		}, nil)
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{pkg}))
+
+	// a symlink is listed with the checksum of its target
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "opt/audited/link", Linkname: "bin", Mode: 0o777}))
+	require.NoError(t, tw.Close())
+	links := &Package{Name: "audited-links", Version: "1.0-r0"}
+	headers, err := a.installAPKFiles(ctx, &buf, links)
+	require.NoError(t, err)
+	require.Equal(t, linkChecksum("bin").String(), headers[0].PAXRecords[paxRecordsChecksumKey])
+	require.NoError(t, a.addInstalledPackage(links, headers))
+
+	findings, err := a.Audit(ctx)
+	require.NoError(t, err)
+	require.Empty(t, findings, "nothing should differ after installing")
+
+	require.NoError(t, a.fs.Remove("opt/audited/missing"))
+	require.NoError(t, a.fs.WriteFile("opt/audited/data", []byte("changed"), 0o644))
+	require.NoError(t, a.fs.Chmod("opt/audited/bin", 0o755|fs.ModeSetuid))
+	require.NoError(t, a.fs.Chown("opt/audited/conf", 1000, 1000))
+	require.NoError(t, a.fs.Remove("opt/audited/link"))
+	require.NoError(t, a.fs.Symlink("conf", "opt/audited/link"))
+	require.NoError(t, a.fs.WriteFile("opt/audited/extra", []byte("extra"), 0o644))
+
+	findings, err = a.Audit(ctx)
+	require.NoError(t, err)
+	want, got := sha1.Sum([]byte("data")), sha1.Sum([]byte("changed")) //nolint:gosec
+	require.Equal(t, []AuditFinding{
+		{Category: AuditMode, Package: "audited", Path: "opt/audited/bin", Expected: "755", Actual: "4755"},
+		{Category: AuditOwner, Package: "audited", Path: "opt/audited/conf", Expected: "0:0", Actual: "1000:1000"},
+		{Category: AuditChecksum, Package: "audited", Path: "opt/audited/data", Expected: Checksum(want[:]).String(), Actual: Checksum(got[:]).String()},
+		{Category: AuditMissing, Package: "audited", Path: "opt/audited/missing"},
+		{Category: AuditChecksum, Package: "audited-links", Path: "opt/audited/link", Expected: linkChecksum("bin").String(), Actual: linkChecksum("conf").String()},
+		{Category: AuditExtra, Package: "audited", Path: "opt/audited/extra"},
+	}, findings)
+	require.Equal(t, "missing: opt/audited/missing (audited)", findings[3].String())
+	require.Equal(t, "mode: opt/audited/bin (audited): expected 755, got 4755", findings[0].String())
+
+	require.NoError(t, a.fs.Remove("opt/audited/conf"))
+	require.NoError(t, a.fs.Mkdir("opt/audited/conf", 0o755))
+	findings, err = a.Audit(ctx)
+	require.NoError(t, err)
+	require.Contains(t, findings, AuditFinding{Category: AuditType, Package: "audited", Path: "opt/audited/conf", Expected: "file", Actual: "directory"})
+}
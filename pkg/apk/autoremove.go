@@ -0,0 +1,160 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	"go.opentelemetry.io/otel"
+)
+
+// Orphans returns the installed packages that are not in world, and that no package in it
+// depends on, directly or through other packages, in installed database order. Packages
+// installed with AddPackages are added to world, as apk add does, and so are kept; those
+// installed with InstallPackages are not. An install_if package is only kept while all of its
+// install_if dependencies are. These are what Autoremove removes; Orphans does not change anything.
+func (a *APK) Orphans(ctx context.Context) ([]*InstalledPackage, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "Orphans")
+	defer span.End()
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read installed packages: %w", err)
+	}
+	world, err := a.GetWorld()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return orphanedPackages(installed, world), nil
+}
+
+// orphanedPackages returns the packages of installed that are not needed by world, see Orphans.
+func orphanedPackages(installed []*InstalledPackage, world []string) []*InstalledPackage {
+	// the installed packages that provide a name
+	providers := map[string][]*InstalledPackage{}
+	for _, pkg := range installed {
+		providers[pkg.Name] = append(providers[pkg.Name], pkg)
+		for _, p := range pkg.Provides {
+			if dep, err := ParseDependency(p); err == nil {
+				providers[dep.Name] = append(providers[dep.Name], pkg)
+			}
+		}
+	}
+
+	kept := map[string]bool{}
+	var queue []*InstalledPackage
+	keep := func(pkg *InstalledPackage) {
+		if !kept[pkg.Name] {
+			kept[pkg.Name] = true
+			queue = append(queue, pkg)
+		}
+	}
+	// keepDependency keeps all of the installed packages that provide d, as any of them may be
+	// what satisfies it.
+	keepDependency := func(d string) {
+		dep, err := ParseDependency(d)
+		if err != nil || dep.Conflict {
+			return
+		}
+		for _, pkg := range providers[dep.Name] {
+			keep(pkg)
+		}
+	}
+	// satisfied returns whether a kept package provides d.
+	satisfied := func(d string) bool {
+		dep, err := ParseDependency(d)
+		if err != nil {
+			return false
+		}
+		for _, pkg := range providers[dep.Name] {
+			if kept[pkg.Name] {
+				return !dep.Conflict
+			}
+		}
+		return dep.Conflict
+	}
+
+	for _, entry := range world {
+		keepDependency(entry)
+	}
+	for len(queue) != 0 {
+		for len(queue) != 0 {
+			pkg := queue[0]
+			queue = queue[1:]
+			for _, d := range pkg.Dependencies {
+				keepDependency(d)
+			}
+		}
+		// install_if packages whose conditions are met by what is kept, which may keep more
+		for _, pkg := range installed {
+			if kept[pkg.Name] || len(pkg.InstallIf) == 0 {
+				continue
+			}
+			all := true
+			for _, d := range pkg.InstallIf {
+				if !satisfied(d) {
+					all = false
+					break
+				}
+			}
+			if all {
+				keep(pkg)
+			}
+		}
+	}
+
+	var orphans []*InstalledPackage
+	for _, pkg := range installed {
+		if !kept[pkg.Name] {
+			orphans = append(orphans, pkg)
+		}
+	}
+	return orphans
+}
+
+// Autoremove removes the Orphans, like DeletePackages, and returns them. This is what is left
+// after entries are removed from world, of the packages that FixateWorld installed for them.
+func (a *APK) Autoremove(ctx context.Context) ([]*InstalledPackage, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Autoremove")
+	defer span.End()
+
+	unlock, err := a.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	orphans, err := a.Orphans(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(orphans) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(orphans))
+	for _, pkg := range orphans {
+		names = append(names, pkg.Name)
+	}
+	clog.FromContext(ctx).Debugf("removing orphaned packages %s", strings.Join(names, ", "))
+	if err := a.deletePackages(ctx, false, names); err != nil {
+		return nil, err
+	}
+	return orphans, nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAutoremove(t *testing.T) {
+	ctx := context.Background()
+	pkg := func(info *PkgInfo) InstallablePackage {
+		info.Version, info.Arch = "1.0-r0", "x86_64"
+		return triggerPackage(t, info, fstest.MapFS{
+			"opt":                     {Mode: 0o755 | fs.ModeDir},
+			"opt/" + info.Name:        {Mode: 0o755 | fs.ModeDir},
+			"opt/" + info.Name + "/f": {Mode: 0o644, Data: []byte(info.Name)},
+		}, nil)
+	}
+	app := pkg(&PkgInfo{Name: "app", Depends: []string{"so:libapp.so.1"}})
+	libapp := pkg(&PkgInfo{Name: "libapp", Provides: []string{"so:libapp.so.1=1"}})
+	bash := pkg(&PkgInfo{Name: "bash"})
+	completion := pkg(&PkgInfo{Name: "app-bash-completion", InstallIf: []string{"app", "bash"}})
+	tool := pkg(&PkgInfo{Name: "tool"})
+
+	ours := func(t *testing.T, pkgs []*InstalledPackage) []string {
+		var names []string
+		for _, pkg := range pkgs {
+			switch pkg.Name {
+			case "app", "libapp", "bash", "app-bash-completion", "tool":
+				names = append(names, pkg.Name)
+			}
+		}
+		return names
+	}
+
+	a, _, err := testGetTestAPK()
+	require.NoError(t, err)
+	require.NoError(t, a.fs.MkdirAll("etc/apk", 0o755))
+	require.NoError(t, a.SetWorld(ctx, []string{"app", "bash"}))
+	// as FixateWorld installs them
+	require.NoError(t, a.installPackages(ctx, nil, []InstallablePackage{libapp, app, bash, completion}, false, nil))
+	require.NoError(t, a.AddPackages(ctx, nil, []InstallablePackage{tool}))
+
+	orphans, err := a.Orphans(ctx)
+	require.NoError(t, err)
+	require.Empty(t, ours(t, orphans))
+
+	// tool is in world, as apk add adds what it installs
+	world, err := a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, []string{"app", "bash", "tool"}, world)
+
+	require.NoError(t, a.RemoveFromWorld(ctx, "app"))
+	orphans, err = a.Orphans(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"libapp", "app", "app-bash-completion"}, ours(t, orphans))
+	// nothing was removed
+	require.Len(t, ours(t, installedOf(t, a)), 5)
+
+	removed, err := a.Autoremove(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"libapp", "app", "app-bash-completion"}, ours(t, removed))
+	require.Equal(t, []string{"bash", "tool"}, ours(t, installedOf(t, a)))
+	_, err = a.fs.Stat("opt/app/f")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = a.fs.Stat("opt/tool/f")
+	require.NoError(t, err)
+
+	// a deleted package is no longer in world
+	require.NoError(t, a.DeletePackages(ctx, "tool"))
+	world, err = a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, []string{"bash"}, world)
+}
+
+func installedOf(t *testing.T, a *APK) []*InstalledPackage {
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	return installed
+}
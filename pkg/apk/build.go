@@ -0,0 +1,219 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"go.opentelemetry.io/otel"
+
+	"github.com/chainguard-dev/go-apk/pkg/tarball"
+)
+
+// APKBuilder builds a v2 .apk package: a signature section if it has a Signer, a control
+// section with the .PKGINFO and install scripts, and a data section from Source. Each is
+// its own gzip stream. The same builder always builds the same bytes, except for the
+// signature of keys whose signatures are not deterministic.
+type APKBuilder struct {
+	// Info is the .PKGINFO of the package. Build writes it with the datahash of the data
+	// section, and with its installed size if it is 0, but does not change it.
+	Info *PkgInfo
+	// Source is the filesystem of the data section.
+	Source fs.FS
+	// Scripts are the install scripts of the package by name, like ".post-install".
+	Scripts map[string][]byte
+	// Signer signs the package as the key KeyName, like "packager.rsa.pub". The package
+	// is not signed if it is nil.
+	Signer  crypto.Signer
+	KeyName string
+	// SourceDateEpoch is the modification time of every file of the package, the Unix epoch
+	// if it is not set.
+	SourceDateEpoch time.Time
+	// DataOptions are applied to the tarball.Context of the data section, after those of
+	// the builder, for example to set the owners and modes of files with
+	// tarball.WithOverridePerms. Its files are owned by root otherwise.
+	DataOptions []tarball.Option
+}
+
+// Build writes the package to w, returning it as it would be in an index.
+func (b *APKBuilder) Build(ctx context.Context, w io.Writer) (*Package, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "APKBuilder.Build")
+	defer span.End()
+
+	if b.Info == nil {
+		return nil, errors.New("unable to build package: no package info")
+	}
+	if b.Source == nil {
+		return nil, errors.New("unable to build package: no source filesystem")
+	}
+	if b.Signer != nil && b.KeyName == "" {
+		return nil, errors.New("unable to build package: signer has no key name")
+	}
+
+	info := *b.Info
+	if info.Size == 0 {
+		size, err := installedSize(b.Source)
+		if err != nil {
+			return nil, fmt.Errorf("unable to build package: %w", err)
+		}
+		info.Size = size
+	}
+
+	data, err := b.dataSection(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to build data section: %w", err)
+	}
+	datahash := sha256.Sum256(data)
+	info.DataHash = hex.EncodeToString(datahash[:])
+
+	control, err := b.controlSection(&info)
+	if err != nil {
+		return nil, fmt.Errorf("unable to build control section: %w", err)
+	}
+
+	var signature []byte
+	if b.Signer != nil {
+		if signature, err = signatureSection(control, b.KeyName, b.Signer); err != nil {
+			return nil, fmt.Errorf("unable to sign package: %w", err)
+		}
+	}
+
+	for _, section := range [][]byte{signature, control, data} {
+		if _, err := w.Write(section); err != nil {
+			return nil, fmt.Errorf("unable to write package: %w", err)
+		}
+	}
+
+	controlHash := sha1.Sum(control) //nolint:gosec // this is what apk tools is using
+	pkg := PackageFromPkgInfo(&info)
+	pkg.Checksum = controlHash[:]
+	pkg.Size = uint64(len(signature) + len(control) + len(data))
+	return pkg, nil
+}
+
+// dataSection returns the data section of the package, a terminated tar stream of Source
+// with the checksum of each file.
+func (b *APKBuilder) dataSection(ctx context.Context) ([]byte, error) {
+	opts := append([]tarball.Option{
+		tarball.WithSourceDateEpoch(b.modTime()),
+		tarball.WithUseChecksums(true),
+		tarball.WithOverrideUIDGID(0, 0),
+		tarball.WithOverrideUname("root"),
+		tarball.WithOverrideGname("root"),
+	}, b.DataOptions...)
+	tctx, err := tarball.NewContext(opts...)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tctx.WriteTargz(ctx, &buf, b.Source, b.Source); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// controlSection returns the control section of the package: info as its .PKGINFO, then the
+// scripts sorted by name. It is not terminated, so that apk-tools reads it and the data
+// section as one archive.
+func (b *APKBuilder) controlSection(info *PkgInfo) ([]byte, error) {
+	var pkginfo bytes.Buffer
+	if err := WritePkgInfo(&pkginfo, info); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(b.Scripts))
+	for name := range b.Scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&out, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(zw)
+	write := func(name string, mode int64, content []byte) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     mode,
+			Size:     int64(len(content)),
+			ModTime:  b.modTime(),
+			Uname:    "root",
+			Gname:    "root",
+			Format:   tar.FormatUSTAR,
+		}); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+	if err := write(".PKGINFO", 0o644, pkginfo.Bytes()); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if err := write(name, 0o755, b.Scripts[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (b *APKBuilder) modTime() time.Time {
+	if b.SourceDateEpoch.IsZero() {
+		return time.Unix(0, 0)
+	}
+	return b.SourceDateEpoch
+}
+
+// installedSize returns the size of the regular files of fsys.
+func installedSize(fsys fs.FS) (uint64, error) {
+	var size uint64
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += uint64(info.Size())
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,175 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+func testAPKBuilder(t *testing.T) (*APKBuilder, map[string][]byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	keys := map[string][]byte{"packager.rsa.pub": pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})}
+
+	return &APKBuilder{
+		Info: &PkgInfo{
+			Name:    "hello",
+			Version: "1.0-r0",
+			Arch:    "x86_64",
+			License: "MIT",
+			Depends: []string{"so:libc.so.6"},
+		},
+		Source: fstest.MapFS{
+			"usr":           {Mode: 0o755 | fs.ModeDir},
+			"usr/bin":       {Mode: 0o755 | fs.ModeDir},
+			"usr/bin/hello": {Mode: 0o755, Data: []byte("#!/bin/sh\necho hello\n")},
+		},
+		Scripts:         map[string][]byte{".post-install": []byte("#!/bin/sh\ntrue\n")},
+		Signer:          key,
+		KeyName:         "packager.rsa.pub",
+		SourceDateEpoch: time.Unix(1700000000, 0),
+	}, keys
+}
+
+func TestAPKBuilder(t *testing.T) {
+	builder, keys := testAPKBuilder(t)
+	var apk bytes.Buffer
+	pkg, err := builder.Build(context.Background(), &apk)
+	require.NoError(t, err)
+	require.Equal(t, uint64(apk.Len()), pkg.Size)
+	require.Equal(t, uint64(len("#!/bin/sh\necho hello\n")), pkg.InstalledSize)
+	require.NotEmpty(t, pkg.DataHash)
+
+	exp, err := expandapk.ExpandApk(context.Background(), bytes.NewReader(apk.Bytes()), t.TempDir())
+	require.NoError(t, err)
+	defer exp.Close()
+	require.True(t, exp.Signed)
+	require.Equal(t, pkg.Checksum, exp.ControlHash)
+	require.Equal(t, pkg.DataHash, exp.PackageHash.Hex())
+
+	signer, err := verifyPackageSignature(exp, keys)
+	require.NoError(t, err)
+	require.Equal(t, "packager.rsa.pub", signer)
+
+	control, err := exp.ControlData()
+	require.NoError(t, err)
+	defer control.Close()
+	var names []string
+	tr := tar.NewReader(control)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	require.Equal(t, []string{".PKGINFO", ".post-install"}, names)
+
+	data, err := exp.PackageData()
+	require.NoError(t, err)
+	defer data.Close()
+	tr = tar.NewReader(data)
+	checksums := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		require.Equal(t, "root", hdr.Uname)
+		require.Equal(t, builder.SourceDateEpoch, hdr.ModTime)
+		checksums[hdr.Name] = hdr.PAXRecords["APK-TOOLS.checksum.SHA1"]
+	}
+	require.Equal(t, map[string]string{
+		"usr":           "",
+		"usr/bin":       "",
+		"usr/bin/hello": "9db6f074fca0a903137b91c7c866b21d4e7205a7",
+	}, checksums)
+
+	read, err := PackageFromAPK(bytes.NewReader(apk.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, pkg, read)
+
+	stream, err := expandapk.ExpandApkStreaming(context.Background(), bytes.NewReader(apk.Bytes()), t.TempDir())
+	require.NoError(t, err)
+	defer stream.Close()
+	_, err = io.Copy(io.Discard, stream.Data())
+	require.NoError(t, err)
+	require.Equal(t, exp.PackageHash, stream.PackageHash)
+}
+
+func TestAPKBuilderReproducible(t *testing.T) {
+	builder, _ := testAPKBuilder(t)
+	info := *builder.Info
+	var first, second bytes.Buffer
+	_, err := builder.Build(context.Background(), &first)
+	require.NoError(t, err)
+	require.Equal(t, info, *builder.Info, "Build should not change Info")
+	_, err = builder.Build(context.Background(), &second)
+	require.NoError(t, err)
+	require.Equal(t, first.Bytes(), second.Bytes())
+
+	builder.SourceDateEpoch = builder.SourceDateEpoch.Add(time.Second)
+	var third bytes.Buffer
+	_, err = builder.Build(context.Background(), &third)
+	require.NoError(t, err)
+	require.NotEqual(t, first.Bytes(), third.Bytes())
+}
+
+func TestAPKBuilderUnsigned(t *testing.T) {
+	builder, _ := testAPKBuilder(t)
+	builder.Signer = nil
+	var apk bytes.Buffer
+	pkg, err := builder.Build(context.Background(), &apk)
+	require.NoError(t, err)
+
+	exp, err := expandapk.ExpandApk(context.Background(), bytes.NewReader(apk.Bytes()), t.TempDir())
+	require.NoError(t, err)
+	defer exp.Close()
+	require.False(t, exp.Signed)
+	require.Equal(t, pkg.Checksum, exp.ControlHash)
+}
+
+func TestAPKBuilderGolden(t *testing.T) {
+	builder, _ := testAPKBuilder(t)
+	builder.Signer = nil
+	var apk bytes.Buffer
+	_, err := builder.Build(context.Background(), &apk)
+	require.NoError(t, err)
+
+	golden, err := os.ReadFile("testdata/build/hello-1.0-r0.apk")
+	require.NoError(t, err)
+	require.Equal(t, golden, apk.Bytes(), "the package should be built as it was")
+}
@@ -0,0 +1,36 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import "github.com/chainguard-dev/go-apk/pkg/expandapk"
+
+// Checksum is a checksum as apk uses them, of the control section of a package or of a file.
+// Its algorithm is known from its length: SHA1 for the Q1 checksums of APKv2, SHA256 for the
+// Q2 checksums of APKv3.
+type Checksum = expandapk.Checksum
+
+// ChecksumAlgorithm is the hash algorithm of a Checksum.
+type ChecksumAlgorithm = expandapk.ChecksumAlgorithm
+
+const (
+	ChecksumMD5    = expandapk.ChecksumMD5
+	ChecksumSHA1   = expandapk.ChecksumSHA1
+	ChecksumSHA256 = expandapk.ChecksumSHA256
+)
+
+// ParseChecksum parses a checksum in the Q1 or Q2 form of an index, or in hex.
+func ParseChecksum(s string) (Checksum, error) {
+	return expandapk.ParseChecksum(s)
+}
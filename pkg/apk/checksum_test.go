@@ -0,0 +1,80 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseChecksum(t *testing.T) {
+	sha1sum := sha1.Sum([]byte("control")) //nolint:gosec // this is what apk tools is using
+	sha256sum := sha256.Sum256([]byte("control"))
+
+	for _, tt := range []struct {
+		in        string
+		want      Checksum
+		algorithm ChecksumAlgorithm
+		str       string
+	}{
+		{in: "Q1" + Checksum(sha1sum[:]).Base64(), want: sha1sum[:], algorithm: ChecksumSHA1},
+		{in: "Q2" + Checksum(sha256sum[:]).Base64(), want: sha256sum[:], algorithm: ChecksumSHA256},
+		{in: Checksum(sha1sum[:]).Hex(), want: sha1sum[:], algorithm: ChecksumSHA1, str: "Q1" + Checksum(sha1sum[:]).Base64()},
+		{in: "", want: nil},
+		{in: "Q1", want: nil},
+	} {
+		got, err := ParseChecksum(tt.in)
+		require.NoError(t, err, tt.in)
+		require.True(t, tt.want.Equal(got), tt.in)
+		require.Equal(t, tt.algorithm, got.Algorithm(), tt.in)
+		if tt.str == "" {
+			tt.str = tt.in
+		}
+		if tt.want == nil {
+			tt.str = ""
+		}
+		require.Equal(t, tt.str, got.String(), tt.in)
+		require.Equal(t, tt.str, fmt.Sprint(got), tt.in)
+		require.Equal(t, got.Hex(), fmt.Sprintf("%x", got), tt.in)
+	}
+
+	for _, in := range []string{
+		"Q3" + Checksum(sha1sum[:]).Base64(),
+		"Q1not base64",
+		"not hex",
+	} {
+		_, err := ParseChecksum(in)
+		require.Error(t, err, in)
+	}
+}
+
+func TestPackageChecksum(t *testing.T) {
+	sha256sum := sha256.Sum256([]byte("control"))
+	q2 := "Q2" + Checksum(sha256sum[:]).Base64()
+
+	pkgs, err := ParsePackageIndex(strings.NewReader("C:" + q2 + "\nP:app\nV:1.0-r0\n\n"))
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+	require.Equal(t, ChecksumSHA256, pkgs[0].Checksum.Algorithm())
+	require.Equal(t, q2, pkgs[0].ChecksumString())
+	require.Contains(t, PackageToInstalled(pkgs[0]), "C:"+q2)
+
+	require.Equal(t, "Q1", (&Package{Name: "app"}).ChecksumString())
+}
@@ -15,11 +15,14 @@ package apk
 
 import (
 	"bytes"
+	"errors"
 	"io"
-	"io/fs"
 	"net/http"
 	"os"
 	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
 
 	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
 )
@@ -72,34 +75,49 @@ func (t *testLocalTransport) RoundTrip(request *http.Request) (*http.Response, e
 
 func testGetTestAPK() (*APK, apkfs.FullFS, error) {
 	// load it all into memory so that we don't change any of our test data
-	src := apkfs.NewMemFS()
-	filesystem := os.DirFS("testdata/root")
-	if walkErr := fs.WalkDir(filesystem, ".", func(path string, d fs.DirEntry, err error) error {
-		if path == "." {
-			return nil
-		}
-		if err != nil {
-			return nil
-		}
-		if d.IsDir() {
-			return src.MkdirAll(path, d.Type())
-		}
-		r, err := filesystem.Open(path)
-		if err != nil {
-			return err
-		}
-		w, err := src.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, d.Type())
-		if err != nil {
-			return err
-		}
-		_, err = io.Copy(w, r)
-		return err
-	}); walkErr != nil {
-		return nil, nil, walkErr
+	return testGetTestAPKWithFS(apkfs.NewMemFS())
+}
+
+// testGetTestAPKWithFS is testGetTestAPK with src, which the test data is copied into.
+func testGetTestAPKWithFS(src apkfs.FullFS) (*APK, apkfs.FullFS, error) {
+	if err := apkfs.CopyTree(src, os.DirFS("testdata/root"), "."); err != nil {
+		return nil, nil, err
 	}
-	apk, err := New(WithFS(src), WithIgnoreMknodErrors(ignoreMknodErrors))
+	// the packages the tests create are local and unsigned
+	apk, err := New(WithFS(src), WithIgnoreMknodErrors(ignoreMknodErrors), WithAllowUnsignedLocalPackages())
 	if err != nil {
 		return nil, nil, err
 	}
 	return apk, src, err
 }
+
+// testBackend is a filesystem that the installer tests run against.
+type testBackend struct {
+	name  string
+	newFS func(t *testing.T) apkfs.FullFS
+}
+
+var testBackends = []testBackend{
+	{"memfs", func(*testing.T) apkfs.FullFS { return apkfs.NewMemFS() }},
+	{"rootfs", func(t *testing.T) apkfs.FullFS {
+		rfs, err := apkfs.RootFS(t.TempDir())
+		if errors.Is(err, errors.ErrUnsupported) {
+			t.Skip(err)
+		}
+		require.NoError(t, err)
+		return rfs
+	}},
+}
+
+// testEachBackend runs test against each of the testBackends. newAPK is like testGetTestAPK,
+// with the filesystem of the backend.
+func testEachBackend(t *testing.T, test func(t *testing.T, newAPK func() (*APK, apkfs.FullFS, error))) {
+	for _, backend := range testBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			test(t, func() (*APK, apkfs.FullFS, error) {
+				return testGetTestAPKWithFS(backend.newFS(t))
+			})
+		})
+	}
+}
@@ -12,8 +12,8 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:build windows || darwin || js || wasm
-// +build windows darwin js wasm
+//go:build !linux
+// +build !linux
 
 package apk
 
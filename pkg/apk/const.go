@@ -18,15 +18,21 @@ const (
 	DefaultKeyRingPath       = "/etc/apk/keys"
 	DefaultSystemKeyRingPath = "/usr/share/apk/keys/"
 	indexFilename            = "APKINDEX.tar.gz"
+	// the index of repositories of apk-tools 3, which may have no APKINDEX.tar.gz
+	adbIndexFilename = "Packages.adb"
 	// we are using these for fs.FS so should omit the leading /
-	reposFilePath     = "etc/apk/repositories"
-	archFilePath      = "etc/apk/arch"
-	keysDirPath       = "etc/apk/keys"
-	worldFilePath     = "etc/apk/world"
-	installedFilePath = "lib/apk/db/installed"
-	scriptsFilePath   = "lib/apk/db/scripts.tar"
+	reposFilePath = "etc/apk/repositories"
+	archFilePath  = "etc/apk/arch"
+	keysDirPath   = "etc/apk/keys"
+	worldFilePath = "etc/apk/world"
+	// the directory of the database, unless it is set with WithDatabaseDir
+	defaultDatabaseDir = "lib/apk/db"
+	// the files of the database, in its directory
+	installedFileName = "installed"
+	scriptsFileName   = "scripts.tar"
 	scriptsTarPerms   = 0o644
-	triggersFilePath  = "lib/apk/db/triggers"
+	triggersFileName  = "triggers"
+	lockFileName      = "lock"
 	// which PAX record we use in the tar header
 	paxRecordsChecksumKey = "APK-TOOLS.checksum.SHA1"
 
@@ -34,4 +40,12 @@ const (
 	alpineReleasesURL = "https://alpinelinux.org/releases.json"
 
 	xattrTarPAXRecordsPrefix = "SCHILY.xattr."
+
+	// how many packages are fetched at the same time when installing, by default
+	defaultMaxPackageConcurrency = 4
+
+	// where locally modified files are kept on upgrade, by default, like apk
+	defaultProtectedPath = "etc"
+	// what is added to the name of the new version of a locally modified file
+	apkNewSuffix = ".apk-new"
 )
@@ -0,0 +1,141 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// installedFilePath returns the path of the installed database, in the directory of the
+// database, see WithDatabaseDir. So do the other paths of its files below.
+func (a *APK) installedFilePath() string {
+	return filepath.Join(a.databaseDir, installedFileName)
+}
+
+func (a *APK) scriptsFilePath() string {
+	return filepath.Join(a.databaseDir, scriptsFileName)
+}
+
+func (a *APK) triggersFilePath() string {
+	return filepath.Join(a.databaseDir, triggersFileName)
+}
+
+func (a *APK) lockFilePath() string {
+	return filepath.Join(a.databaseDir, lockFileName)
+}
+
+// lockRetryInterval is how often the lock file is tried again while it is waited for.
+const lockRetryInterval = 100 * time.Millisecond
+
+// lock takes the lock of the database for a change to it or to world, and returns the func
+// that releases it. It is the mutex of a, so that the changes of several goroutines do not
+// interleave, and, if the filesystem is on disk, lib/apk/db/lock, which apk also takes, so
+// that neither do those of other processes. That is waited for up to the lock timeout.
+func (a *APK) lock(ctx context.Context) (func(), error) {
+	a.dbMu.Lock()
+	lfs, ok := a.fs.(apkfs.LockFS)
+	if !ok {
+		return a.dbMu.Unlock, nil
+	}
+	// there is nothing to lock until the database is initialized
+	if _, err := a.fs.Stat(filepath.Dir(a.lockFilePath())); err != nil {
+		return a.dbMu.Unlock, nil
+	}
+
+	deadline := time.Now().Add(a.lockTimeout)
+	for waited := false; ; waited = true {
+		unlock, err := lfs.TryLock(a.lockFilePath())
+		if err == nil {
+			return func() {
+				_ = unlock()
+				a.dbMu.Unlock()
+			}, nil
+		}
+		if !errors.Is(err, apkfs.ErrLocked) || !time.Now().Before(deadline) {
+			a.dbMu.Unlock()
+			return nil, fmt.Errorf("unable to lock database at %s: %w", a.lockFilePath(), err)
+		}
+		if !waited {
+			clog.FromContext(ctx).Infof("waiting for the lock of the database at %s", a.lockFilePath())
+		}
+		select {
+		case <-ctx.Done():
+			a.dbMu.Unlock()
+			return nil, fmt.Errorf("waiting for the lock of the database at %s: %w", a.lockFilePath(), ctx.Err())
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// replaceFile writes b to the file at name, like WriteFile, but if the filesystem can rename,
+// to a temporary file next to it that is synced and renamed over it, so that name is never
+// half written, even after a crash. Writing the installed database drops what the queries
+// have read of it.
+func (a *APK) replaceFile(name string, b []byte, perm fs.FileMode) error {
+	if name == a.installedFilePath() {
+		defer a.invalidateInstalled()
+	}
+	rfs, ok := a.fs.(apkfs.RenameFS)
+	if !ok {
+		return a.fs.WriteFile(name, b, perm)
+	}
+	tmp := name + ".tmp"
+	if err := a.writeSyncedFile(tmp, b, perm); err != nil {
+		_ = a.fs.Remove(tmp)
+		return err
+	}
+	if err := rfs.Rename(tmp, name); err != nil {
+		_ = a.fs.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// writeSyncedFile writes b to the file at name, and syncs it if the filesystem can, as files
+// on disk can, before it is closed.
+func (a *APK) writeSyncedFile(name string, b []byte, perm fs.FileMode) error {
+	f, err := a.fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := syncFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncFile commits what was written to f to storage, if the filesystem can, as files on
+// disk can.
+func syncFile(f apkfs.File) error {
+	if s, ok := f.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
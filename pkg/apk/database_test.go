@@ -0,0 +1,152 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestLockDatabase(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "lib", "apk", "db"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "etc", "apk"), 0o755))
+
+	// another process, as far as the lock is concerned
+	other, err := apkfs.RootFS(dir)
+	require.NoError(t, err)
+	unlock, err := other.(apkfs.LockFS).TryLock(filepath.Join(defaultDatabaseDir, lockFileName))
+	require.NoError(t, err)
+
+	rfs, err := apkfs.RootFS(dir)
+	require.NoError(t, err)
+	a, err := New(WithFS(rfs))
+	require.NoError(t, err)
+	require.ErrorIs(t, a.SetWorld(ctx, []string{"busybox"}), apkfs.ErrLocked, "the lock should not be waited for by default")
+	_, err = os.Stat(filepath.Join(dir, worldFilePath))
+	require.ErrorIs(t, err, os.ErrNotExist, "world should not be written without the lock")
+
+	a, err = New(WithFS(rfs), WithLockTimeout(10*time.Second))
+	require.NoError(t, err)
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(2 * lockRetryInterval)
+		require.NoError(t, unlock())
+		close(released)
+	}()
+	require.NoError(t, a.SetWorld(ctx, []string{"busybox"}))
+	<-released
+	b, err := os.ReadFile(filepath.Join(dir, worldFilePath))
+	require.NoError(t, err)
+	require.Equal(t, "busybox\n", string(b))
+
+	ctx, cancel := context.WithCancel(ctx)
+	unlock, err = other.(apkfs.LockFS).TryLock(filepath.Join(defaultDatabaseDir, lockFileName))
+	require.NoError(t, err)
+	defer unlock()
+	cancel()
+	require.ErrorIs(t, a.SetWorld(ctx, nil), context.Canceled, "waiting should stop with the context")
+}
+
+func TestConcurrentInstalls(t *testing.T) {
+	a, _, err := testGetTestAPK()
+	require.NoError(t, err)
+	before, err := a.GetInstalled()
+	require.NoError(t, err)
+
+	var g errgroup.Group
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("pkg%d", i)
+		pkg := triggerPackage(t,
+			&PkgInfo{Name: name, Version: "1.0-r0", Arch: "x86_64"},
+			fstest.MapFS{
+				"opt":                   {Mode: 0o755 | fs.ModeDir},
+				"opt/" + name:           {Mode: 0o755 | fs.ModeDir},
+				"opt/" + name + "/file": {Mode: 0o644, Data: []byte(name)},
+			},
+			map[string][]byte{".post-install": []byte("#!/bin/sh\n")})
+		g.Go(func() error {
+			return a.InstallPackages(context.Background(), nil, []InstallablePackage{pkg})
+		})
+	}
+	require.NoError(t, g.Wait())
+
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Len(t, installed, len(before)+8, "every install should be in the installed database")
+	for _, pkg := range installed[len(before):] {
+		require.Len(t, pkg.Files, 3, "%s should have all of its files", pkg.Name)
+	}
+	scripts, err := a.fs.ReadFile(a.scriptsFilePath())
+	require.NoError(t, err)
+	for i := 0; i < 8; i++ {
+		require.Contains(t, string(scripts), fmt.Sprintf("pkg%d-1.0-r0.", i))
+	}
+	for _, name := range []string{a.installedFilePath(), a.scriptsFilePath()} {
+		_, err := a.fs.Stat(name + ".tmp")
+		require.ErrorIs(t, err, os.ErrNotExist, "the temporary file of %s should be renamed", name)
+	}
+}
+
+// renameCountFS counts the files renamed over each path.
+type renameCountFS struct {
+	apkfs.FullFS
+	renames map[string]int
+}
+
+func (r *renameCountFS) Rename(oldpath, newpath string) error {
+	r.renames[newpath]++
+	return r.FullFS.(apkfs.RenameFS).Rename(oldpath, newpath)
+}
+
+func TestInstallWritesInstalledOnce(t *testing.T) {
+	ctx := context.Background()
+	rfs := &renameCountFS{FullFS: apkfs.NewMemFS(), renames: map[string]int{}}
+	a, err := New(WithFS(rfs), WithIgnoreMknodErrors(ignoreMknodErrors), WithIgnoreSignatureVerification(true))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+
+	var pkgs []InstallablePackage
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("pkg%d", i)
+		pkgs = append(pkgs, triggerPackage(t,
+			&PkgInfo{Name: name, Version: "1.0-r0", Arch: "x86_64"},
+			fstest.MapFS{
+				"opt":         {Mode: 0o755 | fs.ModeDir},
+				"opt/" + name: {Mode: 0o644, Data: []byte(name)},
+			}, nil))
+	}
+	rfs.renames = map[string]int{}
+	require.NoError(t, a.InstallPackages(ctx, nil, pkgs))
+	require.Equal(t, 1, rfs.renames[a.installedFilePath()])
+
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Len(t, installed, 3)
+	b, err := a.fs.ReadFile(a.installedFilePath() + ".tmp")
+	require.ErrorIs(t, err, os.ErrNotExist, "the temporary file should be renamed: %q", b)
+}
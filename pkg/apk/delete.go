@@ -0,0 +1,319 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	"go.opentelemetry.io/otel"
+)
+
+// DeletePackages removes the installed packages with names: their files, except those which
+// other packages also have, their directories once they are empty, and their entries in the
+// installed database, scripts.tar, triggers and world. It fails with a PackageInUseError if
+// other installed packages depend on them, see DeletePackagesRecursive.
+func (a *APK) DeletePackages(ctx context.Context, names ...string) error {
+	unlock, err := a.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return a.deletePackages(ctx, false, names)
+}
+
+// DeletePackagesRecursive is DeletePackages, also removing the installed packages that depend
+// on the packages with names, like apk del --rdepends.
+func (a *APK) DeletePackagesRecursive(ctx context.Context, names ...string) error {
+	unlock, err := a.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return a.deletePackages(ctx, true, names)
+}
+
+func (a *APK) deletePackages(ctx context.Context, recursive bool, names []string) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "DeletePackages")
+	defer span.End()
+	log := clog.FromContext(ctx)
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return fmt.Errorf("unable to read installed packages: %w", err)
+	}
+	byName := map[string]*InstalledPackage{}
+	for _, pkg := range installed {
+		byName[pkg.Name] = pkg
+	}
+	deleting := map[string]bool{}
+	for _, name := range names {
+		if _, ok := byName[name]; !ok {
+			return fmt.Errorf("unable to delete %s: %w", name, ErrNotInstalled)
+		}
+		deleting[name] = true
+	}
+
+	for {
+		dependents := packageDependents(installed, deleting)
+		if len(dependents) == 0 {
+			break
+		}
+		if !recursive {
+			for _, name := range names {
+				if deps := dependents[name]; len(deps) != 0 {
+					return &PackageInUseError{Package: name, Dependents: deps}
+				}
+			}
+			// only dependents of packages that were not asked for, which cannot happen
+			// without recursion
+			break
+		}
+		for _, deps := range dependents {
+			for _, dep := range deps {
+				deleting[dep] = true
+			}
+		}
+	}
+
+	var deleted, kept []*InstalledPackage
+	for _, pkg := range installed {
+		if deleting[pkg.Name] {
+			deleted = append(deleted, pkg)
+		} else {
+			kept = append(kept, pkg)
+		}
+	}
+
+	// the paths that the packages which are kept have
+	keptPaths := map[string]bool{}
+	for _, pkg := range kept {
+		for _, f := range pkg.Files {
+			keptPaths[f.Name] = true
+		}
+	}
+	for _, pkg := range deleted {
+		log.Debugf("deleting %s (%s)", pkg.Name, pkg.Version)
+		if err := a.deletePackageFiles(pkg, keptPaths); err != nil {
+			return fmt.Errorf("unable to delete files of %s: %w", pkg.Name, err)
+		}
+	}
+
+	if err := a.deleteInstalledEntries(deleting); err != nil {
+		return err
+	}
+	if err := a.deleteScripts(deleted); err != nil {
+		return err
+	}
+	if err := a.deleteTriggers(deleted); err != nil {
+		return err
+	}
+	for path, owner := range a.installedFiles {
+		if deleting[owner.Name] {
+			delete(a.installedFiles, path)
+		}
+	}
+	world, err := a.GetWorld()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	world = slices.DeleteFunc(world, func(entry string) bool {
+		dep, err := ParseDependency(entry)
+		return err == nil && !dep.Conflict && deleting[dep.Name]
+	})
+	return a.setWorld(ctx, world)
+}
+
+// packageDependents returns the installed packages that are not being deleted and depend on
+// one that is, by the name of the package that is being deleted. A dependency is only on the
+// deleted package if no package that is kept provides it too.
+func packageDependents(installed []*InstalledPackage, deleting map[string]bool) map[string][]string {
+	// the packages that provide a name
+	providers := map[string][]string{}
+	for _, pkg := range installed {
+		providers[pkg.Name] = append(providers[pkg.Name], pkg.Name)
+		for _, p := range pkg.Provides {
+			if dep, err := ParseDependency(p); err == nil {
+				providers[dep.Name] = append(providers[dep.Name], pkg.Name)
+			}
+		}
+	}
+
+	dependents := map[string][]string{}
+	for _, pkg := range installed {
+		if deleting[pkg.Name] {
+			continue
+		}
+		for _, d := range pkg.Dependencies {
+			dep, err := ParseDependency(d)
+			if err != nil || dep.Conflict {
+				continue
+			}
+			var deleted []string
+			kept := false
+			for _, provider := range providers[dep.Name] {
+				if deleting[provider] {
+					deleted = append(deleted, provider)
+				} else {
+					kept = true
+				}
+			}
+			if kept {
+				continue
+			}
+			for _, provider := range deleted {
+				if !slices.Contains(dependents[provider], pkg.Name) {
+					dependents[provider] = append(dependents[provider], pkg.Name)
+				}
+			}
+		}
+	}
+	return dependents
+}
+
+// deletePackageFiles removes the files of pkg that are not in keptPaths, then its directories
+// that are not in keptPaths, deepest first, if they are empty.
+func (a *APK) deletePackageFiles(pkg *InstalledPackage, keptPaths map[string]bool) error {
+	var dirs []string
+	for _, f := range pkg.Files {
+		if keptPaths[f.Name] {
+			continue
+		}
+		if f.Typeflag == tar.TypeDir {
+			dirs = append(dirs, f.Name)
+			continue
+		}
+		if err := a.fs.Remove(f.Name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("unable to remove %s: %w", f.Name, err)
+		}
+	}
+
+	sort.Slice(dirs, func(i, j int) bool { return strings.Count(dirs[i], "/") > strings.Count(dirs[j], "/") })
+	for _, dir := range dirs {
+		entries, err := a.fs.ReadDir(dir)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return fmt.Errorf("unable to read directory %s: %w", dir, err)
+		}
+		if len(entries) != 0 {
+			continue
+		}
+		if err := a.fs.Remove(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("unable to remove directory %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// deleteInstalledEntries removes the entries of the packages being deleted from the installed
+// database.
+func (a *APK) deleteInstalledEntries(deleting map[string]bool) error {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return fmt.Errorf("could not read installed file at %s: %w", a.installedFilePath(), err)
+	}
+	installed = slices.DeleteFunc(installed, func(pkg *InstalledPackage) bool { return deleting[pkg.Name] })
+	return a.writeInstalledFile(installed)
+}
+
+// deleteScripts rewrites scripts.tar without the scripts of the deleted packages.
+func (a *APK) deleteScripts(deleted []*InstalledPackage) error {
+	var prefixes []string
+	for _, pkg := range deleted {
+		prefixes = append(prefixes, fmt.Sprintf("%s-%s.%s.", pkg.Name, pkg.Version, pkg.ChecksumString()))
+	}
+
+	f, err := a.readScriptsTar()
+	if err != nil {
+		return fmt.Errorf("unable to open scripts file %s: %w", a.scriptsFilePath(), err)
+	}
+	defer f.Close()
+	// the scripts that are kept are written as apk writes them, like updateScriptsTar
+	var buf bytes.Buffer
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read scripts file %s: %w", a.scriptsFilePath(), err)
+		}
+		if hasAnyPrefix(header.Name, prefixes) {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("unable to read content for %s: %w", header.Name, err)
+		}
+		if err := writeAPKTarEntry(&buf, header.Name, data, 0o755, header.ModTime.Unix()); err != nil {
+			return fmt.Errorf("unable to write content for %s: %w", header.Name, err)
+		}
+	}
+	buf.Write(make([]byte, scriptsTarTrailerSize))
+	if err := a.replaceFile(a.scriptsFilePath(), buf.Bytes(), scriptsTarPerms); err != nil {
+		return fmt.Errorf("unable to write scripts file %s: %w", a.scriptsFilePath(), err)
+	}
+	return nil
+}
+
+// deleteTriggers removes the triggers of the deleted packages from the triggers file.
+func (a *APK) deleteTriggers(deleted []*InstalledPackage) error {
+	checksums := map[string]bool{}
+	for _, pkg := range deleted {
+		checksums[pkg.Checksum.Base64()] = true
+	}
+	b, err := a.fs.ReadFile(a.triggersFilePath())
+	if err != nil {
+		return fmt.Errorf("unable to read triggers file %s: %w", a.triggersFilePath(), err)
+	}
+	var buf bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if checksum, _, _ := strings.Cut(line, " "); checksums[checksum] {
+			continue
+		}
+		buf.WriteString(line + "\n")
+	}
+	if err := a.replaceFile(a.triggersFilePath(), buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("unable to write triggers file %s: %w", a.triggersFilePath(), err)
+	}
+	return nil
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testDeleteAPK(t *testing.T) *APK {
+	libfoo := triggerPackage(t,
+		&PkgInfo{Name: "libfoo", Version: "1.0-r0", Arch: "x86_64", Provides: []string{"so:libfoo.so.1=1"}, Triggers: []string{"/usr/lib/*"}},
+		fstest.MapFS{
+			"usr":                 {Mode: 0o755 | fs.ModeDir},
+			"usr/lib":             {Mode: 0o755 | fs.ModeDir},
+			"usr/lib/libfoo.so.1": {Mode: 0o755, Data: []byte("libfoo")},
+		},
+		map[string][]byte{".post-install": []byte("#!/bin/sh\n"), ".trigger": []byte("#!/bin/sh\n")})
+	foo := triggerPackage(t,
+		&PkgInfo{Name: "foo", Version: "1.0-r0", Arch: "x86_64", Depends: []string{"so:libfoo.so.1"}},
+		fstest.MapFS{
+			"opt":             {Mode: 0o755 | fs.ModeDir},
+			"opt/foo":         {Mode: 0o755 | fs.ModeDir},
+			"opt/foo/bin":     {Mode: 0o755 | fs.ModeDir},
+			"opt/foo/bin/foo": {Mode: 0o755, Data: []byte("foo")},
+		},
+		map[string][]byte{".post-install": []byte("#!/bin/sh\n")})
+	other := triggerPackage(t,
+		&PkgInfo{Name: "other", Version: "1.0-r0", Arch: "x86_64"},
+		fstest.MapFS{
+			"usr":           {Mode: 0o755 | fs.ModeDir},
+			"usr/lib":       {Mode: 0o755 | fs.ModeDir},
+			"usr/lib/other": {Mode: 0o644, Data: []byte("other")},
+		}, nil)
+
+	a, _, err := testGetTestAPK()
+	require.NoError(t, err)
+	require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{libfoo, foo, other}))
+	require.NoError(t, a.fs.MkdirAll("etc/apk", 0o755))
+	require.NoError(t, a.SetWorld(context.Background(), []string{"foo", "libfoo>=1", "other"}))
+	return a
+}
+
+func installedNames(t *testing.T, a *APK) []string {
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	var names []string
+	for _, pkg := range installed {
+		names = append(names, pkg.Name)
+	}
+	return names
+}
+
+func scriptNames(t *testing.T, a *APK) []string {
+	f, err := a.readScriptsTar()
+	require.NoError(t, err)
+	defer f.Close()
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		// only those of the test packages
+		if name := strings.SplitN(header.Name, "-", 2)[0]; name == "foo" || name == "libfoo" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func TestDeletePackages(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("in use", func(t *testing.T) {
+		a := testDeleteAPK(t)
+		err := a.DeletePackages(ctx, "libfoo")
+		var inUse *PackageInUseError
+		require.ErrorAs(t, err, &inUse)
+		require.Equal(t, &PackageInUseError{Package: "libfoo", Dependents: []string{"foo"}}, inUse)
+		_, err = a.fs.Stat("usr/lib/libfoo.so.1")
+		require.NoError(t, err)
+	})
+
+	t.Run("not installed", func(t *testing.T) {
+		a := testDeleteAPK(t)
+		require.ErrorContains(t, a.DeletePackages(ctx, "missing"), "not installed")
+	})
+
+	t.Run("deletes a package", func(t *testing.T) {
+		a := testDeleteAPK(t)
+		before := installedNames(t, a)
+		require.NoError(t, a.DeletePackages(ctx, "foo"))
+
+		// the directories too, as they are empty and only foo had them
+		for _, name := range []string{"opt/foo/bin/foo", "opt/foo/bin", "opt/foo"} {
+			_, err := a.fs.Stat(name)
+			require.ErrorIs(t, err, os.ErrNotExist, name)
+		}
+		_, err := a.fs.Stat("usr/lib/libfoo.so.1")
+		require.NoError(t, err)
+
+		require.Equal(t, len(before)-1, len(installedNames(t, a)))
+		require.NotContains(t, installedNames(t, a), "foo")
+		require.Equal(t, []string{"libfoo", "libfoo"}, scriptNames(t, a))
+		world, err := a.GetWorld()
+		require.NoError(t, err)
+		require.Equal(t, []string{"libfoo>=1", "other"}, world)
+		_, ok := a.installedFiles["opt/foo/bin/foo"]
+		require.False(t, ok)
+	})
+
+	t.Run("recursive", func(t *testing.T) {
+		a := testDeleteAPK(t)
+		require.NoError(t, a.fs.WriteFile("opt/foo/stray", []byte("stray"), 0o644))
+		require.NoError(t, a.DeletePackagesRecursive(ctx, "libfoo"))
+
+		for _, name := range []string{"opt/foo/bin/foo", "opt/foo/bin", "usr/lib/libfoo.so.1"} {
+			_, err := a.fs.Stat(name)
+			require.ErrorIs(t, err, os.ErrNotExist, name)
+		}
+		// not empty
+		_, err := a.fs.Stat("opt/foo")
+		require.NoError(t, err)
+		// other has it
+		_, err = a.fs.Stat("usr/lib/other")
+		require.NoError(t, err)
+
+		names := installedNames(t, a)
+		require.NotContains(t, names, "foo")
+		require.NotContains(t, names, "libfoo")
+		require.Contains(t, names, "other")
+		require.Empty(t, scriptNames(t, a))
+		world, err := a.GetWorld()
+		require.NoError(t, err)
+		require.Equal(t, []string{"other"}, world)
+		b, err := a.fs.ReadFile(a.triggersFilePath())
+		require.NoError(t, err)
+		require.NotContains(t, string(b), "/usr/lib/*")
+
+		// the database is still valid
+		checkDuplicateIDBEntries(t, a)
+	})
+}
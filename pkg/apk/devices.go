@@ -0,0 +1,118 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/chainguard-dev/clog"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// DeviceNodePolicy is what installing a package does with the character and block devices
+// and FIFOs in it. There are no sockets in packages, as tar has no type for them.
+type DeviceNodePolicy int
+
+const (
+	// DeviceNodeError fails to install a package with a device node. This is the default.
+	DeviceNodeError DeviceNodePolicy = iota
+	// DeviceNodeSkip leaves device nodes out, logging each one.
+	DeviceNodeSkip
+	// DeviceNodePlaceholder creates device nodes with Mknod, or as empty files if the
+	// filesystem does not support them, and keeps their headers, see DeviceNodes.
+	DeviceNodePlaceholder
+)
+
+// isDeviceNode returns true if header is for a character or block device, or a FIFO.
+func isDeviceNode(header *tar.Header) bool {
+	switch header.Typeflag {
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return true
+	}
+	return false
+}
+
+// DeviceNodes returns the headers of the device nodes installed with DeviceNodePlaceholder,
+// sorted by name, so that they can be written as what they are, such as to an OCI layer,
+// whatever the filesystem made of them.
+func (a *APK) DeviceNodes() []tar.Header {
+	headers := make([]tar.Header, 0, len(a.deviceNodes))
+	for _, header := range a.deviceNodes {
+		headers = append(headers, header)
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+	return headers
+}
+
+// deviceNodeResult is what installDeviceNode did with a device node.
+type deviceNodeResult int
+
+const (
+	// deviceNodeSkipped is a node left out, with DeviceNodeSkip or for a package that may
+	// not replace what is there.
+	deviceNodeSkipped deviceNodeResult = iota
+	// deviceNodeInstalled is a node that was created.
+	deviceNodeInstalled
+	// deviceNodeKept is the same node that was there already, which is the package's too.
+	deviceNodeKept
+)
+
+// installDeviceNode installs the device node of header as the device node policy says.
+func (a *APK) installDeviceNode(ctx context.Context, header *tar.Header, pkg *Package) (deviceNodeResult, error) {
+	log := clog.FromContext(ctx)
+	switch a.deviceNodePolicy {
+	case DeviceNodeSkip:
+		log.Warnf("skipping device node %s in package %s", header.Name, pkg.Name)
+		return deviceNodeSkipped, nil
+	case DeviceNodePlaceholder:
+	default:
+		return deviceNodeSkipped, fmt.Errorf("unable to install device node %s in package %s, see WithDeviceNodePolicy", header.Name, pkg.Name)
+	}
+
+	mode := deviceNodeMode(header)
+	dev := apkfs.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+	if fi, err := a.fs.Lstat(header.Name); err == nil {
+		// The same node, such as one from InitDB, is kept.
+		if existing, err := a.fs.Readnod(header.Name); err == nil && existing == dev && fi.Mode().Type() == header.FileInfo().Mode().Type() {
+			a.deviceNodes[header.Name] = *header
+			return deviceNodeKept, nil
+		}
+		overwrite, err := a.overwriteExistingFile(ctx, pkg, FileExistsError{Path: header.Name}, nil)
+		if err != nil || !overwrite {
+			return deviceNodeSkipped, err
+		}
+		if err := a.fs.Remove(header.Name); err != nil {
+			return deviceNodeSkipped, fmt.Errorf("unable to remove existing file %s: %w", header.Name, err)
+		}
+	}
+
+	if err := a.fs.Mknod(header.Name, mode, dev); err != nil {
+		log.Debugf("unable to create device node %s, creating an empty file instead: %v", header.Name, err)
+		if err := a.fs.WriteFile(header.Name, nil, header.FileInfo().Mode().Perm()); err != nil {
+			return deviceNodeSkipped, fmt.Errorf("unable to create placeholder for device node %s: %w", header.Name, err)
+		}
+	}
+	a.deviceNodes[header.Name] = *header
+	return deviceNodeInstalled, nil
+}
+
+// deviceNodeMode returns the mode to pass to Mknod for the device node of header.
+func deviceNodeMode(header *tar.Header) uint32 {
+	return apkfs.MknodMode(header.FileInfo().Mode())
+}
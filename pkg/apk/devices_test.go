@@ -0,0 +1,180 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// testDevicePackage returns the data section of a package with a character device, a block
+// device, a FIFO and a socket, which is left out as tar has no type for it.
+func testDevicePackage(t *testing.T) []byte {
+	src := apkfs.NewMemFS()
+	require.NoError(t, src.MkdirAll("dev", 0o755))
+	require.NoError(t, src.MkdirAll("run", 0o755))
+	require.NoError(t, src.Mknod("dev/null", apkfs.MknodMode(fs.ModeDevice|fs.ModeCharDevice|0o666), apkfs.Mkdev(1, 3)))
+	require.NoError(t, src.Mknod("dev/sda", apkfs.MknodMode(fs.ModeDevice|0o660), apkfs.Mkdev(8, 0)))
+	require.NoError(t, src.Mknod("run/initctl", apkfs.MknodMode(fs.ModeNamedPipe|0o600), 0))
+	require.NoError(t, src.Mknod("run/socket", apkfs.MknodMode(fs.ModeSocket|0o600), 0))
+
+	builder := &APKBuilder{
+		Info:   &PkgInfo{Name: "openrc", Version: "1.0-r0", Arch: "x86_64"},
+		Source: src,
+	}
+	var buf bytes.Buffer
+	_, err := builder.Build(context.Background(), &buf)
+	require.NoError(t, err)
+
+	exp, err := expandapk.ExpandApk(context.Background(), bytes.NewReader(buf.Bytes()), t.TempDir())
+	require.NoError(t, err)
+	defer exp.Close()
+	data, err := exp.PackageData()
+	require.NoError(t, err)
+	defer data.Close()
+	b, err := io.ReadAll(data)
+	require.NoError(t, err)
+	return b
+}
+
+func TestInstallDeviceNodes(t *testing.T) {
+	data := testDevicePackage(t)
+	devices := []struct {
+		name         string
+		typeflag     byte
+		mode         os.FileMode
+		major, minor int64
+	}{
+		{"dev/null", tar.TypeChar, os.ModeDevice | os.ModeCharDevice | 0o666, 1, 3},
+		{"dev/sda", tar.TypeBlock, os.ModeDevice | 0o660, 8, 0},
+		{"run/initctl", tar.TypeFifo, os.ModeNamedPipe | 0o600, 0, 0},
+	}
+
+	install := func(t *testing.T, policy DeviceNodePolicy) (*APK, []tar.Header, error) {
+		a, err := New(WithFS(apkfs.NewMemFS()), WithDeviceNodePolicy(policy))
+		require.NoError(t, err)
+		headers, err := a.installAPKFiles(context.Background(), bytes.NewReader(data), &Package{Name: "openrc"})
+		return a, headers, err
+	}
+
+	t.Run("error", func(t *testing.T) {
+		_, _, err := install(t, DeviceNodeError)
+		require.ErrorContains(t, err, "unable to install device node dev/null in package openrc")
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		a, headers, err := install(t, DeviceNodeSkip)
+		require.NoError(t, err)
+		var names []string
+		for _, h := range headers {
+			names = append(names, h.Name)
+		}
+		require.Equal(t, []string{"dev", "run"}, names)
+		for _, d := range devices {
+			_, err := a.fs.Lstat(d.name)
+			require.ErrorIs(t, err, os.ErrNotExist)
+		}
+		require.Empty(t, a.DeviceNodes())
+	})
+
+	t.Run("placeholder", func(t *testing.T) {
+		a, headers, err := install(t, DeviceNodePlaceholder)
+		require.NoError(t, err)
+		require.Len(t, headers, 2+len(devices))
+
+		nodes := a.DeviceNodes()
+		require.Len(t, nodes, len(devices))
+		for i, d := range devices {
+			require.Equal(t, d.name, nodes[i].Name)
+			require.Equal(t, d.typeflag, nodes[i].Typeflag, d.name)
+			require.Equal(t, d.major, nodes[i].Devmajor, d.name)
+			require.Equal(t, d.minor, nodes[i].Devminor, d.name)
+
+			fi, err := a.fs.Lstat(d.name)
+			require.NoError(t, err)
+			require.Equal(t, d.mode, fi.Mode(), d.name)
+			dev, err := a.fs.Readnod(d.name)
+			require.NoError(t, err)
+			require.Equal(t, apkfs.Mkdev(uint32(d.major), uint32(d.minor)), dev, d.name)
+			require.Equal(t, "openrc", a.installedFiles[d.name].Name)
+		}
+
+		// Installing the same nodes again keeps them.
+		_, err = a.installAPKFiles(context.Background(), bytes.NewReader(data), &Package{Name: "openrc"})
+		require.NoError(t, err)
+	})
+
+	t.Run("placeholder without mknod", func(t *testing.T) {
+		a, err := New(WithFS(noMknodFS{apkfs.NewMemFS()}), WithDeviceNodePolicy(DeviceNodePlaceholder))
+		require.NoError(t, err)
+		_, err = a.installAPKFiles(context.Background(), bytes.NewReader(data), &Package{Name: "openrc"})
+		require.NoError(t, err)
+		require.Len(t, a.DeviceNodes(), len(devices))
+		for _, d := range devices {
+			fi, err := a.fs.Lstat(d.name)
+			require.NoError(t, err)
+			require.True(t, fi.Mode().IsRegular(), d.name)
+			require.Zero(t, fi.Size(), d.name)
+		}
+	})
+
+	_, err := New(WithDeviceNodePolicy(DeviceNodePolicy(42)))
+	require.Error(t, err)
+}
+
+// noMknodFS is a filesystem that does not support device nodes.
+type noMknodFS struct {
+	apkfs.FullFS
+}
+
+func (noMknodFS) Mknod(string, uint32, int) error {
+	return syscall.EPERM
+}
+
+func TestUpgradeKeepsUnchangedDeviceNode(t *testing.T) {
+	ctx := context.Background()
+	foo := func(version string) InstallablePackage {
+		src := apkfs.NewMemFS()
+		require.NoError(t, src.MkdirAll("dev", 0o755))
+		require.NoError(t, src.Mknod("dev/fuse", apkfs.MknodMode(fs.ModeDevice|fs.ModeCharDevice|0o666), apkfs.Mkdev(10, 229)))
+		require.NoError(t, src.MkdirAll("usr/bin", 0o755))
+		require.NoError(t, src.WriteFile("usr/bin/foo", []byte("foo "+version), 0o755))
+		return triggerPackage(t, &PkgInfo{Name: "foo", Version: version, Arch: "x86_64"}, src, nil)
+	}
+	a, err := New(WithFS(apkfs.NewMemFS()), WithIgnoreSignatureVerification(true), WithDeviceNodePolicy(DeviceNodePlaceholder))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{foo("1.0-r0")}))
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{foo("2.0-r0")}))
+
+	dev, err := a.fs.Readnod("dev/fuse")
+	require.NoError(t, err, "the unchanged device node should be kept")
+	require.Equal(t, apkfs.Mkdev(10, 229), dev)
+	owner, err := a.WhoOwnsFile("dev/fuse")
+	require.NoError(t, err)
+	require.Equal(t, "2.0-r0", owner.Version)
+	require.Len(t, a.DeviceNodes(), 1)
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/otel"
+)
+
+// apkDirModTime returns the latest modification time of dir and the .apk files in it,
+// and whether it contains any .apk files at all.
+func apkDirModTime(dir string) (time.Time, bool) {
+	stat, err := os.Stat(dir)
+	if err != nil || !stat.IsDir() {
+		return time.Time{}, false
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.apk"))
+	if err != nil || len(files) == 0 {
+		return time.Time{}, false
+	}
+	mod := stat.ModTime()
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(mod) {
+			mod = fi.ModTime()
+		}
+	}
+	return mod, true
+}
+
+// indexFromDirectory builds the index for a local directory of .apk files that has none,
+// the same way `apk index` would.
+func indexFromDirectory(ctx context.Context, dir string) (*APKIndex, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "indexFromDirectory")
+	defer span.End()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.apk"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	index := &APKIndex{}
+	for _, file := range files {
+		pkg, err := parsePackageFile(ctx, file)
+		if err != nil {
+			return nil, err
+		}
+		index.Packages = append(index.Packages, pkg)
+	}
+	return index, nil
+}
+
+func parsePackageFile(ctx context.Context, file string) (*Package, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pkg, err := ParsePackage(ctx, f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	return pkg, nil
+}
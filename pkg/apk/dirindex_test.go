@@ -0,0 +1,69 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexFromDirectory(t *testing.T) {
+	repo := t.TempDir()
+	archDir := filepath.Join(repo, testArch)
+	require.NoError(t, os.MkdirAll(archDir, 0o755))
+	copyFile := func(src string) {
+		b, err := os.ReadFile(src)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(archDir, filepath.Base(src)), b, 0o644))
+	}
+	copyFile("testdata/hello-0.1.0-r0.apk")
+
+	cache := NewIndexCache()
+	indexes, err := GetRepositoryIndexes(context.Background(), []string{repo}, nil, testArch, withIndexCache(cache))
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+	pkgs := indexes[0].Packages()
+	require.Len(t, pkgs, 1)
+	require.Equal(t, "hello", pkgs[0].Name)
+	require.Equal(t, "0.1.0-r0", pkgs[0].Version)
+	require.NotEmpty(t, pkgs[0].Checksum)
+	require.Equal(t, filepath.Join(archDir, "hello-0.1.0-r0.apk"), pkgs[0].URL())
+
+	f, err := os.Open(pkgs[0].URL())
+	require.NoError(t, err)
+	defer f.Close()
+	parsed, err := ParsePackage(context.Background(), f)
+	require.NoError(t, err)
+	require.Equal(t, parsed, pkgs[0].Package)
+
+	// New packages are picked up.
+	copyFile("testdata/replaces/replaces-0.0.1-r0.apk")
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(archDir, "replaces-0.0.1-r0.apk"), later, later))
+	indexes, err = GetRepositoryIndexes(context.Background(), []string{repo}, nil, testArch, withIndexCache(cache))
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+	require.Equal(t, 2, indexes[0].Count())
+
+	// An empty directory is still skipped.
+	indexes, err = GetRepositoryIndexes(context.Background(), []string{t.TempDir()}, nil, testArch, withIndexCache(cache))
+	require.NoError(t, err)
+	require.Empty(t, indexes)
+}
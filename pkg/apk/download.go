@@ -0,0 +1,386 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	"go.opentelemetry.io/otel"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// DownloadProgress is the progress of a package download, as reported to the function set
+// with WithDownloadProgress. It has the fields of the download ProgressEvents.
+type DownloadProgress struct {
+	// Package is the name of the package being downloaded.
+	Package string
+	URL     string
+	// Done is how many bytes of the package have been downloaded, including those of an
+	// earlier download that was resumed.
+	Done int64
+	// Total is the size of the package, or 0 if it is not known.
+	Total int64
+	// Resumed is set if the download continues an earlier one.
+	Resumed bool
+}
+
+const (
+	// partialSuffix is added to the cache path of a package for its partial download.
+	partialSuffix = ".part"
+	// partialStateSuffix is added to the path of a partial download for its downloadState.
+	partialStateSuffix = ".json"
+	// saveStateEvery is how many bytes are downloaded between saves of the downloadState.
+	saveStateEvery = 1 << 20
+	// downloadAttempts is how many requests a download makes before giving up and leaving
+	// the partial download for the next time.
+	downloadAttempts = 3
+)
+
+// downloadState is what is known of a partial download, saved next to it so that it can
+// be resumed. What is downloaded is not hashed, as the index has no checksum of the whole
+// file; the package is verified against the index when it is expanded, before it is added
+// to the cache.
+type downloadState struct {
+	URL string `json:"url"`
+	// ETag and LastModified identify the version of the file that was being downloaded.
+	// A download is only resumed if it has one of them.
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Offset       int64  `json:"offset"`
+	Total        int64  `json:"total,omitempty"`
+}
+
+// validator returns what to send in If-Range to only resume the same version of the file,
+// the ETag unless it is weak, which If-Range does not allow.
+func (s *downloadState) validator() string {
+	if s.ETag != "" && !strings.HasPrefix(s.ETag, "W/") {
+		return s.ETag
+	}
+	return s.LastModified
+}
+
+// downloader downloads a package to a partial file in the cache, continuing an earlier
+// download of it if there is one.
+type downloader struct {
+	client   *http.Client
+	url      string
+	path     string
+	progress ProgressReporter
+	// event is the last ProgressEvent of the download, reported is its Done when it was
+	// reported, and started is set once ProgressDownloadStarted is reported.
+	event    ProgressEvent
+	reported int64
+	started  bool
+
+	f       *os.File
+	state   downloadState
+	resumed bool
+	saved   int64
+	// private is set for a download to a temporary file of its own, because another one
+	// holds the lock of the partial download. It is neither resumed nor saved.
+	private bool
+}
+
+// downloadPackage downloads pkg from u to a partial file next to cacheFile, and returns it
+// to be read from the start. The partial file is removed when it is closed. If the download
+// fails, what was downloaded is kept, and the next download of the same package continues
+// from there with a Range request. The partial file is locked while it is used, and a
+// concurrent download of the same package, by this process or another, goes to a temporary
+// file of its own instead.
+func (a *APK) downloadPackage(ctx context.Context, client *http.Client, pkg InstallablePackage, u, cacheFile string) (io.ReadCloser, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "downloadPackage")
+	defer span.End()
+
+	d := &downloader{
+		client:   client,
+		url:      u,
+		path:     cacheFile + partialSuffix,
+		progress: a.progress,
+		event:    packageProgressEvent(ProgressDownloadStarted, pkg),
+	}
+	d.event.URL = u
+	d.event.Total = packageSize(pkg)
+	if err := os.MkdirAll(filepath.Dir(d.path), 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create cache directory: %w", err)
+	}
+	if err := d.open(ctx); err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for attempt := 0; attempt < downloadAttempts; attempt++ {
+		done, err := d.fetch(ctx)
+		if done {
+			break
+		}
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		errs = append(errs, err)
+		// Save what we have, so that this can be resumed even if the context is done.
+		if serr := d.save(); serr != nil {
+			errs = append(errs, serr)
+		}
+		if ctx.Err() != nil || attempt == downloadAttempts-1 {
+			d.close()
+			return nil, fmt.Errorf("unable to download %s: %w", u, errors.Join(errs...))
+		}
+		clog.FromContext(ctx).Debugf("retrying download of %s from byte %d: %v", u, d.state.Offset, err)
+	}
+
+	if _, err := d.f.Seek(0, io.SeekStart); err != nil {
+		d.close()
+		return nil, err
+	}
+	// The download is complete, so there is nothing to resume.
+	if !d.private {
+		_ = os.Remove(d.path + partialStateSuffix)
+	}
+	d.report(ProgressDownloadFinished)
+	clog.FromContext(ctx).Debugf("downloaded %s (%d bytes)", u, d.state.Offset)
+	return &removeOnCloseFile{File: d.f}, nil
+}
+
+// open opens and locks the partial download, and loads its state if it can be resumed.
+func (d *downloader) open(ctx context.Context) error {
+	f, err := os.OpenFile(d.path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to open partial download: %w", err)
+	}
+	d.state = downloadState{URL: d.url}
+	if err := apkfs.TryLockFile(f); errors.Is(err, apkfs.ErrLocked) {
+		f.Close()
+		clog.FromContext(ctx).Debugf("%s is being downloaded already, downloading it to a temporary file", d.url)
+		if f, err = os.CreateTemp(filepath.Dir(d.path), filepath.Base(d.path)+".*"); err != nil {
+			return fmt.Errorf("unable to create temporary download: %w", err)
+		}
+		d.f, d.path, d.private = f, f.Name(), true
+		return nil
+	} else if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		f.Close()
+		return fmt.Errorf("unable to lock partial download: %w", err)
+	}
+	d.f = f
+
+	b, err := os.ReadFile(d.path + partialStateSuffix)
+	if err != nil {
+		return d.restart()
+	}
+	var state downloadState
+	if err := json.Unmarshal(b, &state); err != nil || state.URL != d.url || state.validator() == "" {
+		return d.restart()
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.Size() < state.Offset {
+		return d.restart()
+	}
+	// Anything written after the state was saved is downloaded again.
+	if err := f.Truncate(state.Offset); err != nil {
+		return d.restart()
+	}
+	if _, err := f.Seek(state.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	clog.FromContext(ctx).Debugf("resuming download of %s from byte %d", d.url, state.Offset)
+	d.state, d.resumed, d.saved = state, true, state.Offset
+	return nil
+}
+
+// close closes a download that failed, keeping it to be resumed unless it is private.
+func (d *downloader) close() {
+	d.f.Close()
+	if d.private {
+		_ = os.Remove(d.path)
+	}
+}
+
+// restart discards what was downloaded.
+func (d *downloader) restart() error {
+	if err := d.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := d.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	d.state = downloadState{URL: d.url}
+	d.resumed, d.saved = false, 0
+	return nil
+}
+
+// fetch requests the rest of the file and writes it, returning true if it has all of it.
+func (d *downloader) fetch(ctx context.Context) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return false, err
+	}
+	if d.state.Offset > 0 && d.state.validator() == "" {
+		// Without a validator, the rest could be of a different file.
+		if err := d.restart(); err != nil {
+			return false, err
+		}
+	}
+	if d.state.Offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.state.Offset))
+		// The server sends all of the file instead if it has changed.
+		req.Header.Set("If-Range", d.state.validator())
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != d.state.Offset || (d.state.ETag != "" && resp.Header.Get("ETag") != d.state.ETag) {
+			// This is not the rest of what we have, so start over with the next request.
+			return false, errors.Join(fmt.Errorf("unexpected partial response %q", resp.Header.Get("Content-Range")), d.restart())
+		}
+		d.state.Total = total
+	case http.StatusOK:
+		// The server ignored the Range, or the file changed, so this is all of it.
+		if d.state.Offset > 0 {
+			clog.FromContext(ctx).Debugf("server sent all of %s instead of resuming from byte %d", d.url, d.state.Offset)
+			if err := d.restart(); err != nil {
+				return false, err
+			}
+		}
+		d.state.Total = resp.ContentLength
+		if d.state.Total < 0 {
+			d.state.Total = 0
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		return false, errors.Join(errors.New("range not satisfiable"), d.restart())
+	default:
+		return false, fmt.Errorf("GET %s: unexpected status code: %d", d.url, resp.StatusCode)
+	}
+	d.state.ETag = resp.Header.Get("ETag")
+	d.state.LastModified = resp.Header.Get("Last-Modified")
+	if !d.started {
+		// Only now is it known whether the download is resumed.
+		d.started = true
+		d.report(ProgressDownloadStarted)
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := d.f.Write(buf[:n]); err != nil {
+				return false, fmt.Errorf("unable to write partial download: %w", err)
+			}
+			d.state.Offset += int64(n)
+			if d.state.Offset-d.reported >= progressEventEvery {
+				d.report(ProgressDownloadBytes)
+			}
+			if d.state.Offset-d.saved >= saveStateEvery {
+				if err := d.save(); err != nil {
+					return false, err
+				}
+			}
+		}
+		if errors.Is(rerr, io.EOF) {
+			return d.state.Total == 0 || d.state.Offset == d.state.Total, nil
+		}
+		if rerr != nil {
+			return false, rerr
+		}
+	}
+}
+
+// report reports a ProgressEvent of kind with what has been downloaded so far.
+func (d *downloader) report(kind ProgressKind) {
+	d.event.Kind = kind
+	d.event.Done = d.state.Offset
+	if d.state.Total > 0 {
+		d.event.Total = d.state.Total
+	}
+	d.event.Resumed = d.resumed
+	d.reported = d.state.Offset
+	d.progress.Report(d.event)
+}
+
+// save writes the state of the download next to it, if it can be resumed.
+func (d *downloader) save() error {
+	if d.private || d.state.validator() == "" || d.state.Offset == 0 {
+		return nil
+	}
+	b, err := json.Marshal(d.state)
+	if err != nil {
+		return err
+	}
+	// Write the state after the data it describes, and atomically, so that it is never
+	// for more than has been written.
+	if err := d.f.Sync(); err != nil {
+		return fmt.Errorf("unable to save partial download: %w", err)
+	}
+	tmp := d.path + partialStateSuffix + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return fmt.Errorf("unable to save partial download: %w", err)
+	}
+	if err := os.Rename(tmp, d.path+partialStateSuffix); err != nil {
+		return fmt.Errorf("unable to save partial download: %w", err)
+	}
+	d.saved = d.state.Offset
+	return nil
+}
+
+// removeOnCloseFile is a temporary file that is removed when it is closed.
+type removeOnCloseFile struct {
+	*os.File
+}
+
+func (f *removeOnCloseFile) Close() error {
+	return errors.Join(f.File.Close(), os.Remove(f.Name()))
+}
+
+// parseContentRange parses a Content-Range header like "bytes 100-199/200", returning the
+// first byte and the size of the whole file, or 0 if it is not known.
+func parseContentRange(s string) (start, total int64, ok bool) {
+	s, ok = strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return 0, 0, false
+	}
+	rng, size, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, 0, false
+	}
+	first, _, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	return start, total, true
+}
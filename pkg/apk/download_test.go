@@ -0,0 +1,272 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// flakyServer serves content, cutting off its first failures responses after cutAt bytes.
+type flakyServer struct {
+	mu          sync.Mutex
+	content     []byte
+	etag        string
+	failures    int
+	cutAt       int
+	ignoreRange bool
+	ranges      []string
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	content, fail := s.content, s.failures > 0
+	if fail {
+		s.failures--
+	}
+	s.mu.Unlock()
+
+	if s.ignoreRange {
+		r.Header.Del("Range")
+	}
+	w.Header().Set("ETag", s.etag)
+	if fail {
+		w = &cutWriter{ResponseWriter: w, left: s.cutAt}
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+type cutWriter struct {
+	http.ResponseWriter
+	left int
+}
+
+func (w *cutWriter) Write(p []byte) (int, error) {
+	if len(p) > w.left {
+		w.ResponseWriter.Write(p[:w.left]) //nolint:errcheck
+		w.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	w.left -= len(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func testDownload(t *testing.T, srv *flakyServer) (fetch func() ([]byte, error), progress func() []DownloadProgress, cacheDir string) {
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+
+	var (
+		mu      sync.Mutex
+		updates []DownloadProgress
+	)
+	cacheDir = t.TempDir()
+	a, err := New(WithFS(apkfs.NewMemFS()), WithCache(cacheDir, false), WithAllowInsecureHTTP(),
+		WithDownloadProgress(func(p DownloadProgress) {
+			mu.Lock()
+			defer mu.Unlock()
+			updates = append(updates, p)
+		}))
+	require.NoError(t, err)
+	a.SetClient(ts.Client())
+
+	repo := Repository{URI: ts.URL + "/main/" + testArch}
+	pkg := NewRepositoryPackage(&Package{Name: "big", Version: "1.0-r0"}, repo.WithIndex(&APKIndex{}))
+	fetch = func() ([]byte, error) {
+		rc, err := a.FetchPackage(context.Background(), pkg)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+	progress = func() []DownloadProgress {
+		mu.Lock()
+		defer mu.Unlock()
+		defer func() { updates = nil }()
+		return updates
+	}
+	return fetch, progress, cacheDir
+}
+
+func testContent(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	require.NoError(t, err)
+	return b
+}
+
+// partialFiles returns the partial downloads and their state in dir.
+func partialFiles(t *testing.T, dir string) []string {
+	var files []string
+	require.NoError(t, filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, filepath.Base(path))
+		}
+		return err
+	}))
+	return files
+}
+
+func TestDownloadPackage(t *testing.T) {
+	content := testContent(t, 3<<20)
+
+	t.Run("retries with range", func(t *testing.T) {
+		srv := &flakyServer{content: content, etag: `"v1"`, failures: 1, cutAt: 3 << 19}
+		fetch, progress, cacheDir := testDownload(t, srv)
+
+		got, err := fetch()
+		require.NoError(t, err)
+		require.Equal(t, content, got)
+		require.Len(t, srv.ranges, 2)
+		require.Empty(t, srv.ranges[0])
+		require.NotEmpty(t, srv.ranges[1])
+
+		updates := progress()
+		last := updates[len(updates)-1]
+		require.Equal(t, "big", last.Package)
+		require.Equal(t, int64(len(content)), last.Done)
+		require.Equal(t, int64(len(content)), last.Total)
+		require.False(t, last.Resumed)
+		require.Empty(t, partialFiles(t, cacheDir), "partial download is removed when closed")
+	})
+
+	t.Run("resumes an earlier download", func(t *testing.T) {
+		srv := &flakyServer{content: content, etag: `"v1"`, failures: downloadAttempts, cutAt: 1 << 19}
+		fetch, progress, cacheDir := testDownload(t, srv)
+
+		_, err := fetch()
+		require.Error(t, err)
+		require.ElementsMatch(t, []string{"big-1.0-r0.apk.part", "big-1.0-r0.apk.part.json"}, partialFiles(t, cacheDir))
+		progress()
+
+		srv.ranges = nil
+		got, err := fetch()
+		require.NoError(t, err)
+		require.Equal(t, content, got)
+		require.Len(t, srv.ranges, 1)
+		require.Regexp(t, `^bytes=[1-9][0-9]*-$`, srv.ranges[0])
+		updates := progress()
+		require.True(t, updates[0].Resumed)
+		require.Greater(t, updates[0].Done, int64(1<<20))
+		require.Empty(t, partialFiles(t, cacheDir))
+	})
+
+	t.Run("restarts when the file changed", func(t *testing.T) {
+		srv := &flakyServer{content: content, etag: `"v1"`, failures: downloadAttempts, cutAt: 1 << 19}
+		fetch, progress, _ := testDownload(t, srv)
+
+		_, err := fetch()
+		require.Error(t, err)
+		progress()
+
+		changed := testContent(t, 2<<20)
+		srv.content, srv.etag = changed, `"v2"`
+		got, err := fetch()
+		require.NoError(t, err)
+		require.Equal(t, changed, got)
+		require.False(t, progress()[0].Resumed)
+	})
+
+	t.Run("restarts when the server ignores range", func(t *testing.T) {
+		srv := &flakyServer{content: content, etag: `"v1"`, failures: 1, cutAt: 3 << 19, ignoreRange: true}
+		fetch, _, _ := testDownload(t, srv)
+
+		got, err := fetch()
+		require.NoError(t, err)
+		require.Equal(t, content, got)
+		require.Len(t, srv.ranges, 2)
+		require.NotEmpty(t, srv.ranges[1])
+	})
+
+	t.Run("restarts without a validator", func(t *testing.T) {
+		srv := &flakyServer{content: content, failures: 1, cutAt: 3 << 19}
+		fetch, _, _ := testDownload(t, srv)
+
+		got, err := fetch()
+		require.NoError(t, err)
+		require.Equal(t, content, got)
+		require.Equal(t, []string{"", ""}, srv.ranges)
+	})
+
+	t.Run("downloads to its own file while another holds the lock", func(t *testing.T) {
+		srv := &flakyServer{content: content, etag: `"v1"`, failures: downloadAttempts, cutAt: 1 << 19}
+		fetch, _, cacheDir := testDownload(t, srv)
+
+		_, err := fetch()
+		require.Error(t, err)
+		var partial string
+		require.NoError(t, filepath.Walk(cacheDir, func(path string, _ os.FileInfo, err error) error {
+			if err == nil && filepath.Base(path) == "big-1.0-r0.apk.part" {
+				partial = path
+			}
+			return err
+		}))
+		before, err := os.ReadFile(partial)
+		require.NoError(t, err)
+
+		f, err := os.OpenFile(partial, os.O_RDWR, 0)
+		require.NoError(t, err)
+		defer f.Close()
+		if err := apkfs.TryLockFile(f); errors.Is(err, errors.ErrUnsupported) {
+			t.Skip(err)
+		} else {
+			require.NoError(t, err)
+		}
+
+		srv.ranges = nil
+		got, err := fetch()
+		require.NoError(t, err)
+		require.Equal(t, content, got)
+		require.Equal(t, []string{""}, srv.ranges, "the locked download is not resumed")
+		after, err := os.ReadFile(partial)
+		require.NoError(t, err)
+		require.Equal(t, before, after, "the locked download is left alone")
+		require.ElementsMatch(t, []string{"big-1.0-r0.apk.part", "big-1.0-r0.apk.part.json"}, partialFiles(t, cacheDir))
+	})
+}
+
+func TestParseContentRange(t *testing.T) {
+	for _, tt := range []struct {
+		in           string
+		start, total int64
+		ok           bool
+	}{
+		{"bytes 100-199/200", 100, 200, true},
+		{"bytes 0-99/*", 0, 0, true},
+		{"bytes */200", 0, 0, false},
+		{"items 0-1/2", 0, 0, false},
+		{"", 0, 0, false},
+	} {
+		start, total, ok := parseContentRange(tt.in)
+		require.Equal(t, tt.ok, ok, tt.in)
+		require.Equal(t, tt.start, start, tt.in)
+		require.Equal(t, tt.total, total, tt.in)
+	}
+}
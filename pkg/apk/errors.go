@@ -17,8 +17,147 @@ package apk
 import (
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 )
 
+// ErrStaleIndex is matched by errors for repository indexes that could not be
+// refreshed, when the previously fetched index is returned instead.
+var ErrStaleIndex = errors.New("repository index is stale")
+
+// StaleIndexError is returned when the index at URL could not be refreshed,
+// and the copy fetched at FetchedAt is used instead. URL is that of the architecture of the
+// index, which is one of WithArchFallback for a repository that has none for the requested one.
+type StaleIndexError struct {
+	URL       string
+	FetchedAt time.Time
+	Err       error
+}
+
+func (e *StaleIndexError) Error() string {
+	return fmt.Sprintf("%v: unable to refresh %s: %v", ErrStaleIndex, e.URL, e.Err)
+}
+
+func (e *StaleIndexError) Is(target error) bool {
+	return target == ErrStaleIndex
+}
+
+func (e *StaleIndexError) Unwrap() error {
+	return e.Err
+}
+
+// IndexFetchError is returned when the index of Repo for Arch could not be fetched. Arch is
+// the architecture that was tried, which is one of WithArchFallback when Repo has no index
+// for the requested one.
+type IndexFetchError struct {
+	Repo string
+	Arch string
+	Err  error
+}
+
+func (e *IndexFetchError) Error() string {
+	return fmt.Sprintf("unable to get index of repository %s for %s: %v", e.Repo, e.Arch, e.Err)
+}
+
+func (e *IndexFetchError) Unwrap() error {
+	return e.Err
+}
+
+// ErrNotInstalled is matched by errors for packages that are not installed.
+var ErrNotInstalled = errors.New("package is not installed")
+
+// ErrNotOwned is matched by errors for files that no installed package owns.
+var ErrNotOwned = errors.New("file is not owned by any installed package")
+
+// ErrNoTrustedKeys is matched by errors for signatures that could not be verified
+// because no keys are trusted.
+var ErrNoTrustedKeys = errors.New("no trusted keys")
+
+// ErrMalformedSignature is matched by errors for signatures that could not be read.
+var ErrMalformedSignature = errors.New("malformed signature")
+
+// ErrSignatureMismatch is matched by errors for signatures that none of the trusted
+// keys verify.
+var ErrSignatureMismatch = errors.New("signature does not match any trusted key")
+
+// SignatureMismatchError is returned when none of KeyNamesTried verify any of the
+// Signatures, named by key and algorithm, of an index or package.
+type SignatureMismatchError struct {
+	Signatures    []string
+	KeyNamesTried []string
+}
+
+func (e *SignatureMismatchError) Error() string {
+	return fmt.Sprintf("no key found to verify signature for keyfile %s; tried keys: %s", strings.Join(e.Signatures, ", "), strings.Join(e.KeyNamesTried, ", "))
+}
+
+func (e *SignatureMismatchError) Is(target error) bool {
+	return target == ErrSignatureMismatch
+}
+
+// ErrUnsignedPackage is returned for packages without a signature.
+var ErrUnsignedPackage = errors.New("package is not signed")
+
+// PackageSignatureError is returned when the signature of Package could not be verified.
+type PackageSignatureError struct {
+	Package string
+	Err     error
+}
+
+func (e *PackageSignatureError) Error() string {
+	return fmt.Sprintf("unable to verify signature of package %s: %v", e.Package, e.Err)
+}
+
+func (e *PackageSignatureError) Unwrap() error {
+	return e.Err
+}
+
+// PackageIntegrityError is returned when a downloaded package does not match the
+// Field, its checksum or size, recorded in the index of Repository.
+type PackageIntegrityError struct {
+	Package    string
+	Repository string
+	Field      string
+	Expected   string
+	Actual     string
+}
+
+func (e *PackageIntegrityError) Error() string {
+	return fmt.Sprintf("package %s from %s does not match its index: expected %s %s, got %s", e.Package, e.Repository, e.Field, e.Expected, e.Actual)
+}
+
+// FileChecksumError is returned when the contents of Path in Package do not
+// match the checksum recorded for it in the package.
+type FileChecksumError struct {
+	Path     string
+	Package  string
+	Expected []byte
+	Actual   []byte
+}
+
+func (e *FileChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch for %s in package %s: expected %x, got %x", e.Path, e.Package, e.Expected, e.Actual)
+}
+
+// FileConflictError is returned when Package has different contents for Path than Owner,
+// the package that installed it, and neither replaces the other. A checksum is nil for a
+// device node.
+type FileConflictError struct {
+	Path          string
+	Owner         string
+	OwnerChecksum Checksum
+	Package       string
+	Checksum      Checksum
+}
+
+func (e *FileConflictError) Error() string {
+	msg := fmt.Sprintf("unable to install file over existing one, different contents: %s (owned by %s)", e.Path, e.Owner)
+	if e.OwnerChecksum != nil && e.Checksum != nil {
+		msg += fmt.Sprintf(": %s in %s, %s in %s", e.OwnerChecksum, e.Owner, e.Checksum, e.Package)
+	}
+	return msg
+}
+
 type FileExistsError struct {
 	Path string
 	Sha1 []byte
@@ -32,3 +171,58 @@ func (f FileExistsError) Is(target error) bool {
 	var targetError FileExistsError
 	return errors.As(target, &targetError)
 }
+
+// ScriptError is returned when Script of Package, such as .post-install, fails.
+type ScriptError struct {
+	Package string
+	Script  string
+	Err     error
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("%s script of package %s failed: %v", e.Script, e.Package, e.Err)
+}
+
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+// PackageInUseError is returned when deleting Package, which the installed Dependents
+// depend on.
+type PackageInUseError struct {
+	Package    string
+	Dependents []string
+}
+
+func (e *PackageInUseError) Error() string {
+	return fmt.Sprintf("unable to delete %s: required by %s", e.Package, strings.Join(e.Dependents, ", "))
+}
+
+// StalePlanError is returned by FixateWorld with WithPlan if the repository indexes or the
+// installed packages are not those the plan was made from.
+type StalePlanError struct {
+	Reason string
+}
+
+func (e *StalePlanError) Error() string {
+	return fmt.Sprintf("plan is out of date: %s", e.Reason)
+}
+
+// SystemConfigError is returned by LoadSystemConfig if the file at Path of the root is missing,
+// invalid or does not agree with the options of the APK.
+type SystemConfigError struct {
+	Path   string
+	Reason string
+	Err    error
+}
+
+func (e *SystemConfigError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Path, e.Reason, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Reason)
+}
+
+func (e *SystemConfigError) Unwrap() error {
+	return e.Err
+}
@@ -14,8 +14,18 @@
 
 package apk
 
+import "context"
+
 // Executor provider of interface to execute commands, if used.
 // Will be used primarily to execute scripts.
 type Executor interface {
 	Execute(name string, arg ...string) error
 }
+
+// ScriptRunner runs the install scripts and triggers of packages, see WithScripts. It decides
+// how, for example in a chroot of the root filesystem, in a container, or not at all.
+type ScriptRunner interface {
+	// Run runs script, the contents of a script such as .post-install, with env added to
+	// its environment.
+	Run(ctx context.Context, script []byte, env map[string]string) error
+}
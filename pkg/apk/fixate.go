@@ -0,0 +1,133 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// FixateWorldSummary is what FixateWorldWithSummary did, by package name.
+type FixateWorldSummary struct {
+	// Installed are the packages that were installed, upgraded or installed again, in the
+	// order they were.
+	Installed []string
+	// Skipped are the packages that were already installed in the resolved version.
+	Skipped []string
+	// Removed are the packages that were installed, but that nothing needs anymore.
+	Removed []string
+}
+
+// skipInstalledPackages returns the packages of pkgs that need to be installed, because they
+// are not installed in the same version, and those of them that are, but are installed again
+// anyway because their files changed, see WithVerifyInstalledFiles. The others are Skipped in
+// summary, and those returned are Installed.
+func (a *APK) skipInstalledPackages(ctx context.Context, pkgs []*RepositoryPackage, summary *FixateWorldSummary) ([]InstallablePackage, map[string]bool, error) {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read installed packages: %w", err)
+	}
+	byName := map[string]*InstalledPackage{}
+	for _, pkg := range installed {
+		byName[pkg.Name] = pkg
+	}
+
+	var toInstall []InstallablePackage
+	reinstall := map[string]bool{}
+	for _, pkg := range pkgs {
+		if old := byName[pkg.Name]; old != nil && !a.forceReinstall && !isUpgrade(old, pkg.Package) {
+			unchanged, err := a.installedFilesUnchanged(ctx, old)
+			if err != nil {
+				return nil, nil, err
+			}
+			if unchanged {
+				summary.Skipped = append(summary.Skipped, pkg.Name)
+				continue
+			}
+			reinstall[pkg.Name] = true
+		}
+		toInstall = append(toInstall, pkg)
+		summary.Installed = append(summary.Installed, pkg.Name)
+	}
+	return toInstall, reinstall, nil
+}
+
+// installedFilesUnchanged checks a sample of the files of pkg, evenly spread over them, and
+// returns whether they are all there with the checksum and type they were installed with.
+func (a *APK) installedFilesUnchanged(ctx context.Context, pkg *InstalledPackage) (bool, error) {
+	if a.verifyInstalledFiles == 0 {
+		return true, nil
+	}
+	var files []*tar.Header
+	for _, f := range pkg.Files {
+		if f.Typeflag != tar.TypeDir && !a.isProtectedPath(f.Name) {
+			files = append(files, f)
+		}
+	}
+	n := min(a.verifyInstalledFiles, len(files))
+	for i := 0; i < n; i++ {
+		f := files[i*len(files)/n]
+		findings, err := a.auditEntry(pkg.Name, filepath.Clean(f.Name), f)
+		if err != nil {
+			return false, err
+		}
+		for _, finding := range findings {
+			switch finding.Category {
+			case AuditMissing, AuditType, AuditChecksum:
+				clog.FromContext(ctx).Infof("installing %s again: %s", pkg.Name, finding)
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// removeUnresolvedPackages removes the installed packages that fell out of the resolution:
+// those that neither resolved nor world need, like Orphans, and adds them to the Removed of
+// summary.
+func (a *APK) removeUnresolvedPackages(ctx context.Context, resolved []*RepositoryPackage, summary *FixateWorldSummary) error {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return fmt.Errorf("unable to read installed packages: %w", err)
+	}
+	world, err := a.GetWorld()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, pkg := range resolved {
+		world = append(world, pkg.Name)
+	}
+	orphans := orphanedPackages(installed, world)
+	if len(orphans) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(orphans))
+	for _, pkg := range orphans {
+		names = append(names, pkg.Name)
+	}
+	clog.FromContext(ctx).Debugf("removing packages that are no longer needed: %s", strings.Join(names, ", "))
+	if err := a.deletePackages(ctx, false, names); err != nil {
+		return fmt.Errorf("unable to remove packages that are no longer needed: %w", err)
+	}
+	summary.Removed = append(summary.Removed, names...)
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestFixateWorldSkipsInstalledPackages(t *testing.T) {
+	ctx := context.Background()
+	src := apkfs.NewMemFS()
+	var (
+		local []*RepositoryPackage
+		files = map[string]string{}
+	)
+	for _, pkg := range []*Package{
+		{Name: "app", Version: "1.0-r0", Dependencies: []string{"lib"}},
+		{Name: "lib", Version: "1.0-r0"},
+		{Name: "tool", Version: "1.0-r0"},
+	} {
+		f := fakePackage(t, pkg, []testDirEntry{
+			{"opt", 0o755, true, nil, nil},
+			{"opt/" + pkg.Name, 0o644, false, []byte(pkg.Name), nil},
+		})
+		rp, err := parseLocalPackage(ctx, f.URL())
+		require.NoError(t, err)
+		local = append(local, rp)
+		files[pkg.Name] = f.URL()
+	}
+	newAPK := func(t *testing.T, opts ...Option) *APK {
+		a, err := New(append([]Option{WithFS(src), WithIgnoreMknodErrors(true), WithIgnoreSignatureVerification(true)}, opts...)...)
+		require.NoError(t, err)
+		a.localPackages = local
+		return a
+	}
+	a := newAPK(t)
+	require.NoError(t, a.InitDB(ctx))
+	require.NoError(t, a.SetWorld(ctx, []string{"app", "tool"}))
+
+	summary, err := a.FixateWorldWithSummary(ctx, nil)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"app", "lib", "tool"}, summary.Installed)
+	require.Empty(t, summary.Skipped)
+
+	t.Run("skipped without being fetched", func(t *testing.T) {
+		require.NoError(t, os.Remove(files["tool"]))
+		summary, err := newAPK(t).FixateWorldWithSummary(ctx, nil)
+		require.NoError(t, err)
+		require.Empty(t, summary.Installed)
+		require.ElementsMatch(t, []string{"app", "lib", "tool"}, summary.Skipped)
+		require.Empty(t, summary.Removed)
+	})
+
+	t.Run("changed files", func(t *testing.T) {
+		require.NoError(t, src.WriteFile("opt/lib", []byte("changed"), 0o644))
+		summary, err := newAPK(t).FixateWorldWithSummary(ctx, nil)
+		require.NoError(t, err)
+		require.Empty(t, summary.Installed, "files should only be checked with WithVerifyInstalledFiles")
+
+		summary, err = newAPK(t, WithVerifyInstalledFiles(10)).FixateWorldWithSummary(ctx, nil)
+		require.NoError(t, err)
+		require.Equal(t, []string{"lib"}, summary.Installed)
+		require.ElementsMatch(t, []string{"app", "tool"}, summary.Skipped)
+		b, err := src.ReadFile("opt/lib")
+		require.NoError(t, err)
+		require.Equal(t, "lib", string(b), "lib should be installed again")
+	})
+
+	t.Run("force reinstall", func(t *testing.T) {
+		require.NoError(t, a.SetWorld(ctx, []string{"app"}))
+		summary, err := newAPK(t, WithForceReinstall(true)).FixateWorldWithSummary(ctx, nil)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"app", "lib"}, summary.Installed)
+		require.Empty(t, summary.Skipped)
+		require.Equal(t, []string{"tool"}, summary.Removed, "tool fell out of the resolution")
+
+		installed, err := a.GetInstalled()
+		require.NoError(t, err)
+		require.Len(t, installed, 2)
+		_, err = src.Stat("opt/tool")
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
@@ -17,7 +17,8 @@ package apk
 import (
 	"archive/tar"
 	"context"
-	"encoding/base64"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -27,23 +28,24 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
-	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/chainguard-dev/clog"
 	"github.com/chainguard-dev/go-apk/pkg/expandapk"
-	"gopkg.in/ini.v1"
 
 	"go.lsp.dev/uri"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 	"golang.org/x/sync/errgroup"
-	"golang.org/x/sys/unix"
 
 	"github.com/chainguard-dev/go-apk/internal/tarfs"
 	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
@@ -57,17 +59,76 @@ import (
 var globalApkCache = &apkCache{}
 
 type APK struct {
-	arch              string
-	version           string
-	fs                apkfs.FullFS
-	executor          Executor
-	ignoreMknodErrors bool
-	client            *http.Client
-	cache             *cache
-	ignoreSignatures  bool
+	arch                  string
+	archSet               bool
+	version               string
+	fs                    apkfs.FullFS
+	executor              Executor
+	scriptRunner          ScriptRunner
+	ignoreMknodErrors     bool
+	client                *http.Client
+	cache                 *cache
+	indexCache            *IndexCache
+	ignoreSignatures      bool
+	allowUnsignedLocal    bool
+	allowMissingChecksums bool
+	allowInsecureHTTP     bool
+	oci                   *OCIFetcher
+	// keyPins maps key locations to the sha256 digests they must have.
+	keyPins         map[string]string
+	ignoreInstallIf bool
+	lockfile        *Lockfile
+	resolverOptions []ResolverOption
+	// localPackages are the package files added with AddLocalPackages
+	localPackages []*RepositoryPackage
+	// resolutionCache, if set, holds earlier resolutions, see WithResolutionCache
+	resolutionCache ResolutionCache
+	resolutionStats resolutionCounters
+	// maxPackageConcurrency is how many packages are fetched at the same time
+	maxPackageConcurrency int
+	// packageCache, if set, keeps fetched .apk files, see WithPackageCacheDir
+	packageCache *packageCache
+	// deviceNodePolicy is what to do with device nodes in packages, see WithDeviceNodePolicy
+	deviceNodePolicy DeviceNodePolicy
+	// continueOnScriptError logs failed scripts instead of failing, see WithContinueOnScriptError
+	continueOnScriptError bool
+	// warnOnFileConflicts logs file conflicts instead of failing, see WithWarnOnFileConflicts
+	warnOnFileConflicts bool
+	// protectedPaths are where locally modified files are kept on upgrade, see WithProtectedPaths
+	protectedPaths []string
+	// plan, if set, is what FixateWorld does, see WithPlan
+	plan *Plan
+	// progress receives the ProgressEvents, see WithProgress
+	progress ProgressReporter
+	// lockTimeout is how long to wait for the lock file of another process, see WithLockTimeout
+	lockTimeout time.Duration
+	// databaseDir is the directory of the installed database and its files, see WithDatabaseDir
+	databaseDir string
+	// forceReinstall installs packages that are already installed again, see WithForceReinstall
+	forceReinstall bool
+	// verifyInstalledFiles is how many files of a package FixateWorld skips are checked, see
+	// WithVerifyInstalledFiles
+	verifyInstalledFiles int
+	// dbMu is held while the database or world are changed, see lock
+	dbMu sync.Mutex
+	// installedQueries, if set, is what the queries like WhoOwnsFile read of the installed
+	// database, see lookupInstalled
+	installedQueries   *installedQueries
+	installedQueriesMu sync.Mutex
 
 	// filename to owning package, last write wins
 	installedFiles map[string]*Package
+	// deviceNodes are the headers of the device nodes installed with DeviceNodePlaceholder
+	deviceNodes map[string]tar.Header
+	// triggeredFiles are the installed files whose triggers were already run, so that they do
+	// not fire again at the next install, see runTriggers
+	triggeredFiles map[string]*Package
+	// owners of files in the installed database, loaded at the first file conflict with a
+	// package that was not installed by this APK
+	previousOwners map[string]*Package
+	// preservedFiles are the locally modified files of the package being upgraded, which its
+	// new version does not overwrite
+	preservedFiles map[string]bool
 }
 
 func New(options ...Option) (*APK, error) {
@@ -79,16 +140,53 @@ func New(options ...Option) (*APK, error) {
 	}
 	rhttp := retryablehttp.NewClient()
 	rhttp.Logger = hclog.Default()
+	client := rhttp.StandardClient()
+
+	var pc *packageCache
+	if opt.packageCacheDir != "" {
+		pc = &packageCache{dir: opt.packageCacheDir, rehash: opt.packageCacheRehash}
+	}
+
+	progress := opt.progress
+	if opt.downloadProgress != nil {
+		progress = &downloadProgressReporter{ProgressReporter: progress, fn: opt.downloadProgress}
+	}
 
 	return &APK{
-		client:            rhttp.StandardClient(),
-		fs:                opt.fs,
-		arch:              opt.arch,
-		executor:          opt.executor,
-		ignoreMknodErrors: opt.ignoreMknodErrors,
-		version:           opt.version,
-		cache:             opt.cache,
-		installedFiles:    map[string]*Package{},
+		client:                client,
+		oci:                   NewOCIFetcher(client, opt.ociKeychain),
+		fs:                    opt.fs,
+		arch:                  opt.arch,
+		archSet:               opt.archSet,
+		executor:              opt.executor,
+		scriptRunner:          opt.scriptRunner,
+		continueOnScriptError: opt.continueOnScriptError,
+		warnOnFileConflicts:   opt.warnOnFileConflicts,
+		protectedPaths:        opt.protectedPaths,
+		plan:                  opt.plan,
+		progress:              progress,
+		lockTimeout:           opt.lockTimeout,
+		databaseDir:           opt.databaseDir,
+		forceReinstall:        opt.forceReinstall,
+		verifyInstalledFiles:  opt.verifyInstalledFiles,
+		ignoreMknodErrors:     opt.ignoreMknodErrors,
+		version:               opt.version,
+		cache:                 opt.cache,
+		indexCache:            opt.indexCache,
+		ignoreSignatures:      opt.ignoreSignatures,
+		allowUnsignedLocal:    opt.allowUnsignedLocal,
+		allowMissingChecksums: opt.allowMissingChecksums,
+		keyPins:               opt.keyPins,
+		allowInsecureHTTP:     opt.allowInsecureHTTP,
+		ignoreInstallIf:       opt.ignoreInstallIf,
+		lockfile:              opt.lockfile,
+		resolverOptions:       opt.resolverOptions,
+		resolutionCache:       opt.resolutionCache,
+		maxPackageConcurrency: opt.maxPackageConcurrency,
+		packageCache:          pc,
+		deviceNodePolicy:      opt.deviceNodePolicy,
+		installedFiles:        map[string]*Package{},
+		deviceNodes:           map[string]tar.Header{},
 	}, nil
 }
 
@@ -131,8 +229,6 @@ var baseDirectories = []directory{
 var initDirectories = []directory{
 	{"/etc/apk", 0o755},
 	{"/etc/apk/keys", 0o755},
-	{"/lib/apk", 0o755},
-	{"/lib/apk/db", 0o755},
 	{"/var/cache", 0o755},
 	{"/var/cache/apk", 0o755},
 	{"/var/cache/misc", 0o755},
@@ -143,9 +239,6 @@ var initDirectories = []directory{
 var initFiles = []file{
 	{"/etc/apk/world", 0o644, []byte("\n")},
 	{"/etc/apk/repositories", 0o644, []byte("\n")},
-	{"/lib/apk/db/lock", 0o600, nil},
-	{"/lib/apk/db/triggers", 0o644, nil},
-	{"/lib/apk/db/installed", 0o644, nil},
 }
 
 // deviceFiles is a list of files to create relative to the root.
@@ -157,25 +250,49 @@ var initDeviceFiles = []deviceFile{
 	{"/dev/console", 5, 1, 0o620},
 }
 
+// initDirectories returns initDirectories with the directory of the database, and those of
+// its parents that are not base directories, after /etc/apk.
+func (a *APK) initDirectories() []directory {
+	base := map[string]bool{}
+	for _, e := range baseDirectories {
+		base[e.path] = true
+	}
+	var dbDirs []directory
+	for dir := "/" + a.databaseDir; dir != "/"; dir = path.Dir(dir) {
+		if !base[dir] {
+			dbDirs = append([]directory{{dir, 0o755}}, dbDirs...)
+		}
+	}
+	dirs := slices.Clone(initDirectories[:2])
+	dirs = append(dirs, dbDirs...)
+	return append(dirs, initDirectories[2:]...)
+}
+
+// initFiles returns initFiles with the files of the database and those that can only be
+// resolved by a, e.g. we need the architecture.
+func (a *APK) initFiles() []file {
+	return append(slices.Clone(initFiles),
+		file{"/" + a.lockFilePath(), 0o600, nil},
+		file{"/" + a.triggersFilePath(), 0o644, nil},
+		file{"/" + a.installedFilePath(), 0o644, nil},
+		file{"/etc/apk/arch", 0o644, []byte(a.arch + "\n")},
+	)
+}
+
 // SetClient set the http client to use for downloading packages.
 // In general, you can leave this unset, and it will use the default http.Client.
 // It is useful for fine-grained control, for proxying, or for setting alternate
 // paths.
 func (a *APK) SetClient(client *http.Client) {
 	a.client = client
+	a.oci = NewOCIFetcher(client, a.oci.keychain)
 }
 
 // ListInitFiles list the files that are installed during the InitDB phase.
 func (a *APK) ListInitFiles() []tar.Header {
 	headers := make([]tar.Header, 0, 20)
 
-	// additionalFiles are files we need but can only be resolved in the context of
-	// this func, e.g. we need the architecture
-	additionalFiles := []file{
-		{"/etc/apk/arch", 0o644, []byte(a.arch + "\n")},
-	}
-
-	for _, e := range initDirectories {
+	for _, e := range a.initDirectories() {
 		headers = append(headers, tar.Header{
 			Name:     e.path,
 			Mode:     int64(e.perms),
@@ -184,7 +301,7 @@ func (a *APK) ListInitFiles() []tar.Header {
 			Gid:      0,
 		})
 	}
-	for _, e := range append(initFiles, additionalFiles...) {
+	for _, e := range a.initFiles() {
 		headers = append(headers, tar.Header{
 			Name:     e.path,
 			Mode:     int64(e.perms),
@@ -205,7 +322,7 @@ func (a *APK) ListInitFiles() []tar.Header {
 
 	// add scripts.tar with nothing in it
 	headers = append(headers, tar.Header{
-		Name:     scriptsFilePath,
+		Name:     a.scriptsFilePath(),
 		Mode:     int64(scriptsTarPerms),
 		Typeflag: tar.TypeReg,
 		Uid:      0,
@@ -214,93 +331,149 @@ func (a *APK) ListInitFiles() []tar.Header {
 	return headers
 }
 
+// InitDBSummary is what InitDBWithSummary did to the root. The paths have a leading /.
+type InitDBSummary struct {
+	// Created are the directories, files and device nodes that were created, in that order.
+	Created []string
+	// Existing are those that were already there, and were left as they were.
+	Existing []string
+}
+
 // Initialize the APK database for a given build context.
 // Assumes base directories are in place and checks them.
 // Returns the list of files and directories and files installed and permissions,
 // unless those files will be included in the installed database, in which case they can
 // be retrieved via GetInstalled().
+// It can be run on a root that was already initialized, see InitDBWithSummary.
 func (a *APK) InitDB(ctx context.Context, alpineVersions ...string) error {
+	_, err := a.InitDBWithSummary(ctx, alpineVersions...)
+	return err
+}
+
+// InitDBWithSummary is InitDB, and returns what it created. Only what is missing is created:
+// the files of an existing root, such as its world and installed database, are left as they
+// are, so that it can be run on a root that was already initialized.
+func (a *APK) InitDBWithSummary(ctx context.Context, alpineVersions ...string) (*InitDBSummary, error) {
 	log := clog.FromContext(ctx)
 	/*
 		equivalent of: "apk add --initdb --arch arch --root root"
 	*/
 	log.Debug("initializing apk database")
 
-	// additionalFiles are files we need but can only be resolved in the context of
-	// this func, e.g. we need the architecture
-	additionalFiles := []file{
-		{"/etc/apk/arch", 0o644, []byte(a.arch + "\n")},
+	unlock, err := a.lock(ctx)
+	if err != nil {
+		return nil, err
 	}
+	defer unlock()
 
+	summary := &InitDBSummary{}
 	for _, e := range baseDirectories {
 		stat, err := a.fs.Stat(e.path)
 		switch {
 		case err != nil && errors.Is(err, fs.ErrNotExist):
 			err := a.fs.Mkdir(e.path, e.perms)
 			if err != nil {
-				return fmt.Errorf("failed to create base directory %s: %w", e.path, err)
+				return nil, fmt.Errorf("failed to create base directory %s: %w", e.path, err)
 			}
+			summary.Created = append(summary.Created, e.path)
 		case err != nil:
-			return fmt.Errorf("error opening base directory %s: %w", e.path, err)
+			return nil, fmt.Errorf("error opening base directory %s: %w", e.path, err)
 		case !stat.IsDir():
-			return fmt.Errorf("base directory %s is not a directory", e.path)
-		case stat.Mode().Perm() != e.perms:
-			return fmt.Errorf("base directory %s has incorrect permissions: %o", e.path, stat.Mode().Perm())
+			return nil, fmt.Errorf("base directory %s is not a directory", e.path)
+		default:
+			if perms := stat.Mode() & (fs.ModePerm | fs.ModeSticky); perms != e.perms {
+				log.Warnf("base directory %s has permissions %s, not %s, leaving it as it is", e.path, perms, e.perms)
+			}
+			summary.Existing = append(summary.Existing, e.path)
 		}
 	}
-	for _, e := range initDirectories {
+	for _, e := range a.initDirectories() {
 		err := a.fs.Mkdir(e.path, e.perms)
 		switch {
 		case err != nil && !errors.Is(err, fs.ErrExist):
-			return fmt.Errorf("failed to create directory %s: %w", e.path, err)
+			return nil, fmt.Errorf("failed to create directory %s: %w", e.path, err)
 		case err != nil && errors.Is(err, fs.ErrExist):
 			stat, err := a.fs.Stat(e.path)
 			if err != nil {
-				return fmt.Errorf("failed to stat directory %s: %w", e.path, err)
+				return nil, fmt.Errorf("failed to stat directory %s: %w", e.path, err)
 			}
 			if !stat.IsDir() {
-				return fmt.Errorf("failed to create directory %s: already exists as file", e.path)
+				return nil, fmt.Errorf("failed to create directory %s: already exists as file", e.path)
 			}
+			summary.Existing = append(summary.Existing, e.path)
+		default:
+			summary.Created = append(summary.Created, e.path)
 		}
 	}
-	for _, e := range append(initFiles, additionalFiles...) {
-		if err := a.fs.WriteFile(e.path, e.contents, e.perms); err != nil {
-			return fmt.Errorf("failed to create file %s: %w", e.path, err)
+	for _, e := range a.initFiles() {
+		stat, err := a.fs.Stat(e.path)
+		switch {
+		case err != nil && errors.Is(err, fs.ErrNotExist):
+			if err := a.fs.WriteFile(e.path, e.contents, e.perms); err != nil {
+				return nil, fmt.Errorf("failed to create file %s: %w", e.path, err)
+			}
+			summary.Created = append(summary.Created, e.path)
+		case err != nil:
+			return nil, fmt.Errorf("failed to stat file %s: %w", e.path, err)
+		case !stat.Mode().IsRegular():
+			return nil, fmt.Errorf("failed to create file %s: already exists and is not a regular file", e.path)
+		default:
+			summary.Existing = append(summary.Existing, e.path)
 		}
 	}
+	a.invalidateInstalled()
+	if arch, err := a.fs.ReadFile(archFilePath); err == nil && strings.TrimSpace(string(arch)) != a.arch {
+		log.Warnf("%s is %s, not %s, leaving it as it is", archFilePath, strings.TrimSpace(string(arch)), a.arch)
+	}
 	for _, e := range initDeviceFiles {
-		perms := uint32(e.perms.Perm())
-		err := a.fs.Mknod(e.path, unix.S_IFCHR|perms, int(unix.Mkdev(e.major, e.minor)))
+		if _, err := a.fs.Lstat(e.path); err == nil {
+			summary.Existing = append(summary.Existing, e.path)
+			continue
+		}
+		err := a.fs.Mknod(e.path, apkfs.MknodMode(os.ModeDevice|os.ModeCharDevice|e.perms.Perm()), apkfs.Mkdev(e.major, e.minor))
 		if !a.ignoreMknodErrors && err != nil {
-			return fmt.Errorf("failed to create char device %s: %w", e.path, err)
+			return nil, fmt.Errorf("failed to create char device %s: %w", e.path, err)
+		}
+		if err == nil {
+			summary.Created = append(summary.Created, e.path)
 		}
 	}
 
-	// add scripts.tar with nothing in it
-	scriptsTarPerms := 0o644
-	TarFile, err := a.fs.OpenFile(scriptsFilePath, os.O_CREATE|os.O_WRONLY, fs.FileMode(scriptsTarPerms))
-	if err != nil {
-		return fmt.Errorf("could not create tarball file '%s', got error '%w'", scriptsFilePath, err)
+	// add scripts.tar with nothing in it, unless there is one
+	scriptsPath := a.scriptsFilePath()
+	if _, err := a.fs.Stat(scriptsPath); err == nil {
+		summary.Existing = append(summary.Existing, "/"+scriptsPath)
+	} else {
+		if err := a.createScriptsTar(); err != nil {
+			return nil, err
+		}
+		summary.Created = append(summary.Created, "/"+scriptsPath)
 	}
-	defer TarFile.Close()
-	tarWriter := tar.NewWriter(TarFile)
-	defer tarWriter.Close()
-
-	// nothing to add to it; scripts.tar should be empty
 
 	// get the alpine-keys base keys for our usage
 	if len(alpineVersions) > 0 {
 		if err := a.fetchAlpineKeys(ctx, alpineVersions); err != nil {
 			var nokeysErr *NoKeysFoundError
 			if !errors.As(err, &nokeysErr) {
-				return fmt.Errorf("failed to fetch alpine-keys: %w", err)
+				return nil, fmt.Errorf("failed to fetch alpine-keys: %w", err)
 			}
 			log.Warnf("ignoring missing keys: %v", err)
 		}
 	}
 
-	log.Debug("finished initializing apk database")
-	return nil
+	log.Debugf("finished initializing apk database, created %d and kept %d existing paths", len(summary.Created), len(summary.Existing))
+	return summary, nil
+}
+
+// createScriptsTar creates scripts.tar with nothing in it.
+func (a *APK) createScriptsTar() error {
+	tarFile, err := a.fs.OpenFile(a.scriptsFilePath(), os.O_CREATE|os.O_WRONLY, scriptsTarPerms)
+	if err != nil {
+		return fmt.Errorf("could not create tarball file '%s', got error '%w'", a.scriptsFilePath(), err)
+	}
+	defer tarFile.Close()
+	// nothing to add to it; scripts.tar should be empty
+	return tar.NewWriter(tarFile).Close()
 }
 
 // loadSystemKeyring returns the keys found in the system keyring
@@ -330,7 +503,7 @@ func (a *APK) loadSystemKeyring(ctx context.Context, locations ...string) ([]str
 			ext := filepath.Ext(f.Name())
 			p := filepath.Join(d, f.Name())
 
-			if ext == ".pub" {
+			if isKeyFile(f.Name()) {
 				ring = append(ring, p)
 			} else {
 				log.Warnf("%s has invalid extension (%s), skipping...", p, ext)
@@ -361,6 +534,15 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 		keyFiles = append(keyFiles, extraKeyFiles...)
 	}
 
+	// Pinned keys are installed too, even if they were not asked for.
+	pinned := maps.Keys(a.keyPins)
+	sort.Strings(pinned)
+	for _, element := range pinned {
+		if !slices.Contains(keyFiles, element) {
+			keyFiles = append(keyFiles, element)
+		}
+	}
+
 	var eg errgroup.Group
 
 	for _, element := range keyFiles {
@@ -370,7 +552,7 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 
 			var asURL *url.URL
 			var err error
-			if strings.HasPrefix(element, "https://") {
+			if isRemoteURL(element) {
 				asURL, err = url.Parse(element)
 			} else {
 				// Attempt to parse non-https elements into URI's so they are translated into
@@ -380,15 +562,31 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 			if err != nil {
 				return fmt.Errorf("failed to parse key as URI: %w", err)
 			}
+			if asURL.Scheme == "http" && !a.allowInsecureHTTP {
+				return fmt.Errorf("scheme %s not supported", asURL.Scheme)
+			}
 
 			var data []byte
 			switch asURL.Scheme {
 			case "file": //nolint:goconst
+				// A directory of keys is trusted like /etc/apk/keys would be.
+				if info, err := os.Stat(element); err == nil && info.IsDir() {
+					keys, err := KeysFromFS(os.DirFS(element), ".")
+					if err != nil {
+						return fmt.Errorf("failed to read apk keys: %w", err)
+					}
+					for name, data := range keys {
+						if err := a.writeKey(name, data); err != nil {
+							return err
+						}
+					}
+					return nil
+				}
 				data, err = os.ReadFile(element)
 				if err != nil {
 					return fmt.Errorf("failed to read apk key: %w", err)
 				}
-			case "https": //nolint:goconst
+			case "https", "http": //nolint:goconst
 				client := a.client
 				if client == nil {
 					client = retryablehttp.NewClient().StandardClient()
@@ -407,7 +605,8 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 					req.SetBasicAuth(user, pass)
 				}
 
-				resp, err := client.Do(req)
+				// Fetch keys like indexes, retrying interrupted reads with Range requests.
+				resp, err := newRangeRetryTransport(ctx, client).RoundTrip(req)
 				if err != nil {
 					return fmt.Errorf("failed to fetch apk key: %w", err)
 				}
@@ -425,19 +624,36 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 				return fmt.Errorf("scheme %s not supported", asURL.Scheme)
 			}
 
-			// #nosec G306 -- apk keyring must be publicly readable
-			if err := a.fs.WriteFile(filepath.Join("etc", "apk", "keys", filepath.Base(element)), data,
-				0o644); err != nil {
-				return fmt.Errorf("failed to write apk key: %w", err)
+			if want, ok := a.keyPins[element]; ok {
+				sum := sha256.Sum256(data)
+				if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, want) {
+					return fmt.Errorf("apk key %s has sha256 digest %s, expected %s", element, got, want)
+				}
 			}
 
-			return nil
+			return a.writeKey(keyName(asURL), data)
 		})
 	}
 
 	return eg.Wait()
 }
 
+// keyName returns the name in the keyring of the key at u: the unescaped base name of
+// its path, which signatures made with it refer to.
+func keyName(u *url.URL) string {
+	return path.Base(u.Path)
+}
+
+// writeKey installs the key named name into the APK keyring.
+func (a *APK) writeKey(name string, data []byte) error {
+	// #nosec G306 -- apk keyring must be publicly readable
+	if err := a.fs.WriteFile(filepath.Join("etc", "apk", "keys", name), data,
+		0o644); err != nil {
+		return fmt.Errorf("failed to write apk key: %w", err)
+	}
+	return nil
+}
+
 // ResolveWorld determine the target state for the requested dependencies in /etc/apk/world. Does not install anything.
 func (a *APK) ResolveWorld(ctx context.Context) (toInstall []*RepositoryPackage, conflicts []string, err error) {
 	log := clog.FromContext(ctx)
@@ -446,11 +662,41 @@ func (a *APK) ResolveWorld(ctx context.Context) (toInstall []*RepositoryPackage,
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "ResolveWorld")
 	defer span.End()
 
+	a.progress.Report(ProgressEvent{Kind: ProgressResolveStarted})
+	toInstall, conflicts, _, err = a.resolveWorld(ctx)
+	if err == nil {
+		a.progress.Report(ProgressEvent{Kind: ProgressResolveFinished, Packages: len(toInstall)})
+	}
+	return
+}
+
+// resolveWorld is ResolveWorld, also returning the repository indexes it resolved from, none
+// for a lockfile.
+func (a *APK) resolveWorld(ctx context.Context) (toInstall []*RepositoryPackage, conflicts []string, indexes []NamedIndex, err error) {
+	log := clog.FromContext(ctx)
+	if a.lockfile != nil {
+		log.Debugf("using %d packages from lockfile", len(a.lockfile.Packages))
+		toInstall, err = a.lockfile.repositoryPackages()
+		return toInstall, nil, nil, err
+	}
+
 	// to fix the world, we need to:
 	// 1. Get the apkIndexes for each repository for the target arch
-	indexes, err := a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
+	indexes, err = a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
 	if err != nil {
-		return toInstall, conflicts, fmt.Errorf("error getting repository indexes: %w", err)
+		return toInstall, conflicts, nil, fmt.Errorf("error getting repository indexes: %w", err)
+	}
+	// local packages come first, so that they are preferred over the same version in a repository
+	if len(a.localPackages) != 0 {
+		indexes = append([]NamedIndex{&localPackagesIndex{pkgs: a.localPackages}}, indexes...)
+	}
+	// world may have installed virtual packages, which are only in the installed database
+	virtual, err := a.installedVirtualPackages()
+	if err != nil {
+		return toInstall, conflicts, nil, err
+	}
+	if len(virtual) != 0 {
+		indexes = append([]NamedIndex{&localPackagesIndex{pkgs: virtual}}, indexes...)
 	}
 	// debugging info, if requested
 	log.Debugf("got %d indexes:\n%s", len(indexes), strings.Join(indexNames(indexes), "\n"))
@@ -458,17 +704,24 @@ func (a *APK) ResolveWorld(ctx context.Context) (toInstall []*RepositoryPackage,
 	// 2. Get the dependency tree for each package from the world file
 	directPkgs, err := a.GetWorld()
 	if err != nil {
-		return toInstall, conflicts, fmt.Errorf("error getting world packages: %w", err)
+		return toInstall, conflicts, indexes, fmt.Errorf("error getting world packages: %w", err)
 	}
-	resolver := NewPkgResolver(ctx, indexes)
-	toInstall, conflicts, err = resolver.GetPackagesWithDependencies(ctx, directPkgs)
+	toInstall, conflicts, err = a.resolve(ctx, indexes, directPkgs)
 	if err != nil {
 		return
 	}
+	// virtual packages are already installed, and have nothing to fetch
+	toInstall = slices.DeleteFunc(toInstall, func(pkg *RepositoryPackage) bool { return pkg.virtual })
 	log.Debugf("got %d packages to install:\n%s", len(toInstall), strings.Join(packageRefs(toInstall), "\n"))
 	return
 }
 
+// newResolver returns a resolver for indexes with the options a was created with.
+func (a *APK) newResolver(ctx context.Context, indexes []NamedIndex) *PkgResolver {
+	opts := append([]ResolverOption{WithResolverIgnoreInstallIf(a.ignoreInstallIf)}, a.resolverOptions...)
+	return NewPkgResolver(ctx, indexes, opts...)
+}
+
 func (a *APK) ResolveAndCalculateWorld(ctx context.Context) ([]*APKResolved, error) {
 	log := clog.FromContext(ctx)
 	log.Debug("resolving and calculating 'world' (packages to install)")
@@ -481,11 +734,8 @@ func (a *APK) ResolveAndCalculateWorld(ctx context.Context) ([]*APKResolved, err
 		return nil, fmt.Errorf("error getting package dependencies: %w", err)
 	}
 
-	// TODO: Consider making this configurable option.
-	jobs := runtime.GOMAXPROCS(0)
-
 	g, gctx := errgroup.WithContext(ctx)
-	g.SetLimit(jobs + 1)
+	g.SetLimit(a.packageConcurrency())
 
 	resolved := make([]*APKResolved, len(allpkgs))
 
@@ -528,6 +778,16 @@ func (a *APK) ResolveAndCalculateWorld(ctx context.Context) ([]*APKResolved, err
 
 // FixateWorld force apk's resolver to re-resolve the requested dependencies in /etc/apk/world.
 func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error {
+	_, err := a.FixateWorldWithSummary(ctx, sourceDateEpoch)
+	return err
+}
+
+// FixateWorldWithSummary is FixateWorld, and returns what it did. The packages that are already
+// installed in the resolved version, with the same control checksum, are skipped without
+// being fetched, unless WithForceReinstall is set or WithVerifyInstalledFiles finds that
+// their files changed. The installed packages that fell out of the resolution, and that world
+// does not need, are removed.
+func (a *APK) FixateWorldWithSummary(ctx context.Context, sourceDateEpoch *time.Time) (*FixateWorldSummary, error) {
 	log := clog.FromContext(ctx)
 	/*
 		equivalent of: "apk fix --arch arch --root root"
@@ -540,11 +800,21 @@ func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "FixateWorld")
 	defer span.End()
 
+	unlock, err := a.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if a.plan != nil {
+		return a.executePlan(ctx, sourceDateEpoch, a.plan)
+	}
+
 	// to fix the world, we need to:
 	// 1. Get the apkIndexes for each repository for the target arch
 	allpkgs, conflicts, err := a.ResolveWorld(ctx)
 	if err != nil {
-		return fmt.Errorf("error getting package dependencies: %w", err)
+		return nil, fmt.Errorf("error getting package dependencies: %w", err)
 	}
 
 	// 3. For each name on the list:
@@ -557,27 +827,66 @@ func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error
 	for _, pkg := range conflicts {
 		isInstalled, err := a.isInstalledPackage(pkg)
 		if err != nil {
-			return fmt.Errorf("error checking if package %s is installed: %w", pkg, err)
+			return nil, fmt.Errorf("error checking if package %s is installed: %w", pkg, err)
 		}
 		if isInstalled {
-			return fmt.Errorf("cannot install due to conflict with %s", pkg)
+			return nil, fmt.Errorf("cannot install due to conflict with %s", pkg)
 		}
 	}
-	// Cast []*RepositoryPackage into []InstallablePackage.
-	allInstPkgs := make([]InstallablePackage, len(allpkgs))
-	for i, pkg := range allpkgs {
-		allInstPkgs[i] = pkg
+
+	summary := &FixateWorldSummary{}
+	toInstall, reinstall, err := a.skipInstalledPackages(ctx, allpkgs, summary)
+	if err != nil {
+		return nil, err
+	}
+
+	// These are all for world, so Autoremove removes them once nothing in world needs them.
+	if err := a.installPackages(ctx, sourceDateEpoch, toInstall, false, reinstall); err != nil {
+		return nil, err
+	}
+	if err := a.removeUnresolvedPackages(ctx, allpkgs, summary); err != nil {
+		return nil, err
 	}
+	log.Debugf("installed %d packages, skipped %d already installed and removed %d", len(summary.Installed), len(summary.Skipped), len(summary.Removed))
+	return summary, nil
+}
 
-	return a.InstallPackages(ctx, sourceDateEpoch, allInstPkgs)
+// packageConcurrency returns how many packages to fetch at the same time.
+func (a *APK) packageConcurrency() int {
+	if a.maxPackageConcurrency < 1 {
+		return defaultMaxPackageConcurrency
+	}
+	return a.maxPackageConcurrency
 }
 
+// InstallPackages installs allpkgs, in order. It does not change world, so Autoremove removes
+// those that world does not need: see AddPackages to keep them.
 func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, allpkgs []InstallablePackage) error {
-	// TODO: Consider making this configurable option.
-	jobs := runtime.GOMAXPROCS(0)
+	unlock, err := a.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return a.installPackages(ctx, sourceDateEpoch, allpkgs, false, nil)
+}
+
+// AddPackages is InstallPackages, and adds those of allpkgs that are not in world to it, like
+// apk add, so that Autoremove keeps them.
+func (a *APK) AddPackages(ctx context.Context, sourceDateEpoch *time.Time, allpkgs []InstallablePackage) error {
+	unlock, err := a.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return a.installPackages(ctx, sourceDateEpoch, allpkgs, true, nil)
+}
 
+// installPackages installs allpkgs, in order. Those that are already installed in the same
+// version are skipped, unless they are in reinstall or WithForceReinstall is set.
+func (a *APK) installPackages(ctx context.Context, sourceDateEpoch *time.Time, allpkgs []InstallablePackage, explicit bool, reinstall map[string]bool) error {
 	g, gctx := errgroup.WithContext(ctx)
-	g.SetLimit(jobs + 1)
+	// One more for the goroutine installing the packages.
+	g.SetLimit(a.packageConcurrency() + 1)
 
 	expanded := make([]*expandapk.APKExpanded, len(allpkgs))
 
@@ -605,26 +914,30 @@ func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, a
 				exp := expanded[i]
 				pkg := allpkgs[i]
 
-				isInstalled, err := a.isInstalledPackage(pkg.PackageName())
+				old, err := a.installedPackage(pkg.PackageName())
 				if err != nil {
 					return fmt.Errorf("error checking if package %s is installed: %w", pkg, err)
 				}
 
-				if isInstalled {
-					continue
-				}
-
 				// The data in .PKGINFO is more complete than what is in APKINDEX.
 				pkgInfo, err := packageInfo(exp)
 				if err != nil {
 					return fmt.Errorf("failed to read .PKGINFO for %s: %w", pkg, err)
 				}
+
+				if old != nil && !isUpgrade(old, pkgInfo) && !a.forceReinstall && !reinstall[pkg.PackageName()] {
+					continue
+				}
 				infos[i] = pkgInfo
 
-				installedFiles, err := a.installPackage(gctx, pkgInfo, exp, sourceDateEpoch)
+				a.progress.Report(packageProgressEvent(ProgressInstallStarted, pkg))
+				installedFiles, err := a.installPackage(gctx, pkgInfo, exp, sourceDateEpoch, old)
 				if err != nil {
 					return fmt.Errorf("installing %s: %w", pkg, err)
 				}
+				event := packageProgressEvent(ProgressInstallFinished, pkg)
+				event.Files = len(installedFiles)
+				a.progress.Report(event)
 
 				allFiles[i] = installedFiles
 			}
@@ -655,14 +968,13 @@ func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, a
 		return fmt.Errorf("installing packages: %w", err)
 	}
 
-	// update the installed file
+	// update the installed file, where previously installed packages may have had files
+	// taken over by the new ones too
+	var entries []*InstalledPackage
 	for i, files := range allFiles {
 		pkg := infos[i]
 
-		// TODO: We currently skip over packages that are already installed.
-		// I'm ignoring this for now because that isn't really a thing that can happen,
-		// but if there are overlapping files from an already installed package, we should
-		// modify those in the idb file.
+		// Packages that are already installed, in the same version, are skipped.
 		if pkg == nil {
 			continue
 		}
@@ -677,12 +989,27 @@ func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, a
 
 			return owner != pkg
 		})
+		entries = append(entries, newInstalledPackage(pkg, files))
+	}
+	if err := a.addInstalledPackages(entries); err != nil {
+		return fmt.Errorf("unable to update installed file: %w", err)
+	}
 
-		if err := a.addInstalledPackage(pkg, files); err != nil {
-			return fmt.Errorf("unable to update installed file for pkg %s: %w", pkg.Name, err)
+	if explicit {
+		names := make([]string, 0, len(allpkgs))
+		for _, pkg := range allpkgs {
+			names = append(names, pkg.PackageName())
+		}
+		if err := a.addWorldNames(ctx, names); err != nil {
+			return err
 		}
 	}
 
+	if err := a.runTriggers(ctx); err != nil {
+		return fmt.Errorf("running triggers: %w", err)
+	}
+
+	a.progress.Report(ProgressEvent{Kind: ProgressDone, Packages: len(allpkgs)})
 	return nil
 }
 
@@ -772,7 +1099,7 @@ func (a *APK) cachePackage(ctx context.Context, pkg InstallablePackage, exp *exp
 
 	// Rename exp's temp files to content-addressable identifiers in the cache.
 
-	ctlHex := hex.EncodeToString(exp.ControlHash)
+	ctlHex := exp.ControlHash.Hex()
 	ctlDst := filepath.Join(cacheDir, ctlHex+".ctl.tar.gz")
 
 	if err := os.Rename(exp.ControlFile, ctlDst); err != nil {
@@ -791,7 +1118,7 @@ func (a *APK) cachePackage(ctx context.Context, pkg InstallablePackage, exp *exp
 		exp.SignatureFile = sigDst
 	}
 
-	datHex := hex.EncodeToString(exp.PackageHash)
+	datHex := exp.PackageHash.Hex()
 	datDst := filepath.Join(cacheDir, datHex+".dat.tar.gz")
 
 	if err := os.Rename(exp.PackageFile, datDst); err != nil {
@@ -818,12 +1145,12 @@ func (a *APK) cachedPackage(ctx context.Context, pkg InstallablePackage, cacheDi
 		return nil, fmt.Errorf("unexpected checksum: %q", chk)
 	}
 
-	checksum, err := base64.StdEncoding.DecodeString(chk[2:])
+	checksum, err := ParseChecksum(chk)
 	if err != nil {
 		return nil, err
 	}
 
-	pkgHexSum := hex.EncodeToString(checksum)
+	pkgHexSum := checksum.Hex()
 
 	exp := expandapk.APKExpanded{}
 
@@ -833,7 +1160,6 @@ func (a *APK) cachedPackage(ctx context.Context, pkg InstallablePackage, cacheDi
 		return nil, err
 	}
 	exp.ControlFile = ctl
-	exp.ControlHash = checksum
 
 	exp.ControlFS, err = tarfs.New(exp.ControlData)
 	if err != nil {
@@ -856,6 +1182,16 @@ func (a *APK) cachedPackage(ctx context.Context, pkg InstallablePackage, cacheDi
 	}
 	defer f.Close()
 
+	// Hash what is in the cache rather than trusting its name, for verifyPackageIntegrity.
+	h := sha1.New() //nolint:gosec // this is what apk tools is using
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("hashing %s: %w", ctl, err)
+	}
+	exp.ControlHash = h.Sum(nil)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
 	datahash, err := a.datahash(f)
 	if err != nil {
 		return nil, fmt.Errorf("datahash for %s: %w", pkg, err)
@@ -869,7 +1205,7 @@ func (a *APK) cachedPackage(ctx context.Context, pkg InstallablePackage, cacheDi
 	exp.PackageFile = dat
 	exp.Size += df.Size()
 
-	exp.PackageHash, err = hex.DecodeString(datahash)
+	exp.PackageHash, err = ParseChecksum(datahash)
 	if err != nil {
 		return nil, err
 	}
@@ -914,6 +1250,11 @@ func (c *apkCache) get(ctx context.Context, a *APK, pkg InstallablePackage) (*ex
 	}
 
 	result := v.(apkResult)
+	if result.err != nil {
+		// Don't keep failures, which may only be because ctx was cancelled when another
+		// package failed, so that the package is fetched again the next time.
+		c.onces.CompareAndDelete(u, once)
+	}
 	return result.exp, result.err
 }
 
@@ -943,8 +1284,18 @@ func expandPackage(ctx context.Context, a *APK, pkg InstallablePackage) (*expand
 		}
 
 		exp, err := a.cachedPackage(ctx, pkg, cacheDir)
+		if err == nil {
+			// A cached package that no longer matches the index is fetched again.
+			err = a.verifyPackageIntegrity(pkg, exp, packageSize(pkg))
+			if err != nil {
+				log.Warnf("cached package %s is corrupt: %v", pkg.PackageName(), err)
+			}
+		}
 		if err == nil {
 			log.Debugf("cache hit (%s)", pkg.PackageName())
+			if err := a.verifyPackage(pkg, exp); err != nil {
+				return nil, err
+			}
 			return exp, nil
 		}
 
@@ -955,16 +1306,39 @@ func expandPackage(ctx context.Context, a *APK, pkg InstallablePackage) (*expand
 		}
 	}
 
-	rc, err := a.FetchPackage(ctx, pkg)
+	rc, cached, err := a.fetchPackageCached(ctx, pkg)
 	if err != nil {
 		return nil, fmt.Errorf("fetching package %q: %w", pkg.PackageName(), err)
 	}
 	defer rc.Close()
 
-	exp, err := expandapk.ExpandApk(ctx, rc, cacheDir)
+	var r io.Reader = rc
+	// The package is only added to the package cache once it is verified.
+	verified := false
+	if cached != nil {
+		defer func() { cached.done(ctx, verified) }()
+		r = io.TeeReader(r, cached)
+	}
+	size := packageSize(pkg)
+	if size != 0 {
+		// Catch truncated downloads before they fail obscurely in ExpandApk.
+		r = &sizeCheckingReader{r: r, size: size}
+	}
+	exp, err := expandapk.ExpandApk(ctx, r, cacheDir)
 	if err != nil {
 		return nil, fmt.Errorf("expanding %s: %w", pkg.PackageName(), err)
 	}
+	if err := a.verifyPackageIntegrity(pkg, exp, size); err != nil {
+		_ = exp.Close()
+		return nil, err
+	}
+
+	// Don't let packages we can't verify into the cache.
+	if err := a.verifyPackage(pkg, exp); err != nil {
+		_ = exp.Close()
+		return nil, err
+	}
+	verified = true
 
 	// If we don't have a cache, we're done.
 	if a.cache == nil {
@@ -974,10 +1348,95 @@ func expandPackage(ctx context.Context, a *APK, pkg InstallablePackage) (*expand
 	return a.cachePackage(ctx, pkg, exp, cacheDir)
 }
 
+// packageSize returns the size of pkg according to its index, or 0 if unknown.
+func packageSize(pkg InstallablePackage) int64 {
+	if rp, ok := pkg.(*RepositoryPackage); ok && rp.Package != nil {
+		return int64(rp.Size)
+	}
+	return 0
+}
+
+// verifyPackageIntegrity checks that the expanded pkg matches the checksum of its
+// control section and its size in the index that resolved it.
+func (a *APK) verifyPackageIntegrity(pkg InstallablePackage, exp *expandapk.APKExpanded, size int64) error {
+	return a.verifyIntegrity(pkg, exp.ControlHash, exp.Size, size)
+}
+
+// verifyIntegrity is verifyPackageIntegrity for a package with controlHash that is actual
+// bytes, or of unknown size if actual is 0.
+func (a *APK) verifyIntegrity(pkg InstallablePackage, controlHash expandapk.Checksum, actual, size int64) error {
+	repo := pkg.URL()
+	if rp, ok := pkg.(*RepositoryPackage); ok && rp.Repository() != nil {
+		repo = rp.Repository().URI
+	}
+
+	if chk := pkg.ChecksumString(); chk == "Q1" || chk == "" {
+		if !a.allowMissingChecksums {
+			return &PackageIntegrityError{Package: pkg.PackageName(), Repository: repo, Field: "checksum", Expected: "none", Actual: controlHash.String()}
+		}
+	} else if got := controlHash.String(); chk != got {
+		return &PackageIntegrityError{Package: pkg.PackageName(), Repository: repo, Field: "checksum", Expected: chk, Actual: got}
+	}
+
+	if size != 0 && actual != 0 && actual != size {
+		return &PackageIntegrityError{Package: pkg.PackageName(), Repository: repo, Field: "size", Expected: strconv.FormatInt(size, 10), Actual: strconv.FormatInt(actual, 10)}
+	}
+	return nil
+}
+
+// sizeCheckingReader fails reads of more or fewer than size bytes.
+type sizeCheckingReader struct {
+	r    io.Reader
+	size int64
+	read int64
+}
+
+func (s *sizeCheckingReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.read += int64(n)
+	if s.read > s.size {
+		return n, fmt.Errorf("read %d bytes, more than the expected %d", s.read, s.size)
+	}
+	if errors.Is(err, io.EOF) && s.read < s.size {
+		return n, fmt.Errorf("truncated: read %d of %d bytes: %w", s.read, s.size, io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
+
+// verifyPackage verifies the signature of the expanded pkg against the keys in
+// /etc/apk/keys, unless signatures are ignored.
+func (a *APK) verifyPackage(pkg InstallablePackage, exp *expandapk.APKExpanded) error {
+	return a.verifySignature(pkg, exp.Signed, func(keys map[string][]byte) (string, error) {
+		return verifyPackageSignature(exp, keys)
+	})
+}
+
+// verifySignature is verifyPackage for a package that is signed or not, whose signature
+// verify verifies against keys.
+func (a *APK) verifySignature(pkg InstallablePackage, signed bool, verify func(keys map[string][]byte) (string, error)) error {
+	if a.ignoreSignatures {
+		return nil
+	}
+	if !signed {
+		if u := pkg.URL(); a.allowUnsignedLocal && !isRemoteURL(u) && !strings.HasPrefix(u, ociScheme+"://") {
+			return nil
+		}
+		return &PackageSignatureError{Package: pkg.PackageName(), Err: ErrUnsignedPackage}
+	}
+	keys, err := a.keyring()
+	if err != nil {
+		return &PackageSignatureError{Package: pkg.PackageName(), Err: err}
+	}
+	if _, err := verify(keys); err != nil {
+		return &PackageSignatureError{Package: pkg.PackageName(), Err: err}
+	}
+	return nil
+}
+
 func packageAsURI(pkg InstallablePackage) (uri.URI, error) {
 	u := pkg.URL()
 
-	if strings.HasPrefix(u, "https://") {
+	if isRemoteURL(u) || strings.HasPrefix(u, "file://") {
 		return uri.Parse(u)
 	}
 
@@ -985,6 +1444,10 @@ func packageAsURI(pkg InstallablePackage) (uri.URI, error) {
 }
 
 func packageAsURL(pkg InstallablePackage) (*url.URL, error) {
+	if u := pkg.URL(); strings.HasPrefix(u, ociScheme+"://") {
+		return url.Parse(u)
+	}
+
 	asURI, err := packageAsURI(pkg)
 	if err != nil {
 		return nil, err
@@ -993,6 +1456,71 @@ func packageAsURL(pkg InstallablePackage) (*url.URL, error) {
 	return url.Parse(string(asURI))
 }
 
+// FetchVerifiedPackage fetches the .apk file of pkg like FetchPackage, and returns it once
+// it has been verified the way packages are before they are installed: against the checksum
+// and size of pkg, and its signature against the keyring unless signatures are ignored. It
+// is kept in a temporary file rather than in memory, which is removed when it is closed.
+func (a *APK) FetchVerifiedPackage(ctx context.Context, pkg InstallablePackage) (io.ReadCloser, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "FetchVerifiedPackage", trace.WithAttributes(attribute.String("package", pkg.PackageName())))
+	defer span.End()
+
+	rc, cached, err := a.fetchPackageCached(ctx, pkg)
+	if err != nil {
+		return nil, fmt.Errorf("fetching package %q: %w", pkg.PackageName(), err)
+	}
+	defer rc.Close()
+
+	tmp, err := os.CreateTemp("", "fetch-apk-*.apk")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary file: %w", err)
+	}
+	f := &removeOnCloseFile{File: tmp}
+
+	verified := false
+	defer func() {
+		if cached != nil {
+			cached.done(ctx, verified)
+		}
+		if !verified {
+			f.Close()
+		}
+	}()
+
+	var w io.Writer = tmp
+	if cached != nil {
+		w = io.MultiWriter(tmp, cached)
+	}
+	var r io.Reader = io.TeeReader(rc, w)
+	size := packageSize(pkg)
+	if size != 0 {
+		r = &sizeCheckingReader{r: r, size: size}
+	}
+	exp, err := expandapk.ExpandApk(ctx, r, "")
+	if err != nil {
+		return nil, fmt.Errorf("expanding %s: %w", pkg.PackageName(), err)
+	}
+	defer exp.Close()
+	// Keep anything after the data section too, so that the file is returned as it is.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", pkg.PackageName(), err)
+	}
+
+	if err := a.verifyPackageIntegrity(pkg, exp, size); err != nil {
+		return nil, err
+	}
+	if err := a.verifyPackage(pkg, exp); err != nil {
+		return nil, err
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	verified = true
+	return f, nil
+}
+
+// FetchPackage returns the .apk file of pkg as it is fetched, without verifying it. See
+// FetchVerifiedPackage to verify it first.
 func (a *APK) FetchPackage(ctx context.Context, pkg InstallablePackage) (io.ReadCloser, error) {
 	log := clog.FromContext(ctx)
 	log.Debugf("fetching %s", pkg)
@@ -1009,19 +1537,34 @@ func (a *APK) FetchPackage(ctx context.Context, pkg InstallablePackage) (io.Read
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse package as URL: %w", err)
 	}
+	if asURL.Scheme == "http" && !a.allowInsecureHTTP {
+		return nil, fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
+	}
 
 	switch asURL.Scheme {
 	case "file":
-		f, err := os.Open(u)
+		f, err := os.Open(localPath(u))
 		if err != nil {
 			return nil, fmt.Errorf("failed to read repository package apk %s: %w", u, err)
 		}
 		return f, nil
-	case "https":
+	case "https", "http":
 		client := a.client
 		if client == nil {
 			client = retryablehttp.NewClient().StandardClient()
 		}
+		if a.cache != nil && !a.cache.offline {
+			// Download to the cache, so that an interrupted download can be resumed.
+			cacheFile, err := cachePathFromURL(a.cache.dir, *asURL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cache path based on URL: %w", err)
+			}
+			rc, err := a.downloadPackage(ctx, client, pkg, u, cacheFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to get package apk at %s: %w", u, err)
+			}
+			return rc, nil
+		}
 		if a.cache != nil {
 			client = a.cache.client(client, false)
 		}
@@ -1040,7 +1583,17 @@ func (a *APK) FetchPackage(ctx context.Context, pkg InstallablePackage) (io.Read
 			res.Body.Close()
 			return nil, fmt.Errorf("unable to get package apk at %s: %v", u, res.Status)
 		}
-		return res.Body, nil
+		if a.cache != nil {
+			// offline, so this is read from the cache
+			return res.Body, nil
+		}
+		return newProgressReader(res.Body, a.progress, pkg), nil
+	case ociScheme:
+		rc, err := a.oci.Fetch(ctx, u)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get package apk at %s: %w", u, err)
+		}
+		return newProgressReader(rc, a.progress, pkg), nil
 	default:
 		return nil, fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
 	}
@@ -1057,27 +1610,27 @@ func packageInfo(exp *expandapk.APKExpanded) (*Package, error) {
 	}
 	defer f.Close()
 
-	cfg, err := ini.ShadowLoad(f)
+	pkg, err := parsePkgInfo(f)
 	if err != nil {
-		return nil, fmt.Errorf("ini.ShadowLoad(): %w", err)
-	}
-
-	pkg := new(Package)
-	if err = cfg.MapTo(pkg); err != nil {
-		return nil, fmt.Errorf("cfg.MapTo(): %w", err)
+		return nil, err
 	}
-	pkg.BuildTime = time.Unix(pkg.BuildDate, 0).UTC()
-	pkg.InstalledSize = pkg.Size
 	pkg.Size = uint64(exp.Size)
 	pkg.Checksum = exp.ControlHash
 
 	return pkg, nil
 }
 
-// installPackage installs a single package and updates installed db.
-func (a *APK) installPackage(ctx context.Context, pkg *Package, expanded *expandapk.APKExpanded, sourceDateEpoch *time.Time) ([]tar.Header, error) {
+// installPackage installs a single package and updates installed db, as an upgrade of old
+// if it is not nil.
+func (a *APK) installPackage(ctx context.Context, pkg *Package, expanded *expandapk.APKExpanded, sourceDateEpoch *time.Time, old *InstalledPackage) ([]tar.Header, error) {
 	log := clog.FromContext(ctx)
-	log.Debugf("installing %s (%s)", pkg.Name, pkg.Version)
+	preScript, postScript := scriptPreInstall, scriptPostInstall
+	if old != nil {
+		log.Debugf("upgrading %s (%s -> %s)", pkg.Name, old.Version, pkg.Version)
+		preScript, postScript = scriptPreUpgrade, scriptPostUpgrade
+	} else {
+		log.Debugf("installing %s (%s)", pkg.Name, pkg.Version)
+	}
 
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "installPackage", trace.WithAttributes(attribute.String("package", pkg.Name)))
 	defer span.End()
@@ -1089,6 +1642,17 @@ func (a *APK) installPackage(ctx context.Context, pkg *Package, expanded *expand
 		installedFiles []tar.Header
 	)
 
+	if err := a.runScript(ctx, pkg, expanded, preScript); err != nil {
+		return nil, err
+	}
+
+	if old != nil {
+		if err := a.prepareUpgrade(ctx, old); err != nil {
+			return nil, fmt.Errorf("unable to upgrade %s: %w", pkg.Name, err)
+		}
+		defer func() { a.preservedFiles = nil }()
+	}
+
 	if wh, ok := a.fs.(WriteHeaderer); ok {
 		installedFiles, err = a.lazilyInstallAPKFiles(ctx, wh, expanded.TarFS, pkg)
 		if err != nil {
@@ -1126,20 +1690,30 @@ func (a *APK) installPackage(ctx context.Context, pkg *Package, expanded *expand
 		return nil, fmt.Errorf("unable to update triggers for pkg %s: %w", pkg.Name, err)
 	}
 
+	if old != nil {
+		if err := a.finishUpgrade(ctx, old, pkg, installedFiles); err != nil {
+			return nil, fmt.Errorf("unable to upgrade %s: %w", pkg.Name, err)
+		}
+	}
+
+	if err := a.runScript(ctx, pkg, expanded, postScript); err != nil {
+		return nil, err
+	}
+
 	return installedFiles, nil
 }
 
 func (a *APK) datahash(controlTarGz io.Reader) (string, error) {
-	values, err := a.controlValue(controlTarGz, "datahash")
+	info, err := a.controlPkgInfo(controlTarGz)
 	if err != nil {
 		return "", fmt.Errorf("reading datahash from control: %w", err)
 	}
 
-	if len(values) != 1 {
-		return "", fmt.Errorf("saw %d datahash values", len(values))
+	if info.DataHash == "" {
+		return "", errors.New("control has no datahash")
 	}
 
-	return values[0], nil
+	return info.DataHash, nil
 }
 
 func packageRefs(pkgs []*RepositoryPackage) []string {
@@ -15,9 +15,11 @@
 package apk
 
 import (
-	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -25,87 +27,243 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"regexp"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/klauspost/compress/gzip"
-
-	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+	"github.com/chainguard-dev/clog"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/go-retryablehttp"
 	"go.lsp.dev/uri"
 	"go.opentelemetry.io/otel"
+	"golang.org/x/exp/maps"
+	"golang.org/x/sync/errgroup"
 )
 
-var signatureFileRegex = regexp.MustCompile(`^\.SIGN\.RSA\.(.*\.rsa\.pub)$`)
-
 // This is terrible but simpler than plumbing around a cache for now.
 // We just hold the parsed index in memory rather than re-parsing it every time,
 // which requires gunzipping, which is (somewhat) expensive.
-var globalIndexCache = &indexCache{
-	modtimes: map[string]time.Time{},
-}
+//
+// It is only used when no IndexCache is provided, see WithIndexCache.
+var globalIndexCache = NewIndexCache()
 
 type indexResult struct {
 	idx *APKIndex
 	err error
 }
 
-type indexCache struct {
-	// For remote indexes.
-	onces sync.Map
+// indexCacheKey identifies a fetched index. The same URL fetched for a different
+// arch, or verified against different keys, must not alias.
+type indexCacheKey struct {
+	url  string
+	arch string
+	// keyring is a digest of the keys used for verification,
+	// or empty if signatures were not verified.
+	keyring string
+}
+
+func newIndexCacheKey(u string, keys map[string][]byte, arch string, opts *indexOpts) indexCacheKey {
+	key := indexCacheKey{url: u, arch: arch}
+	if !opts.ignoreSignatures {
+		names := maps.Keys(keys)
+		sort.Strings(names)
+		h := sha256.New()
+		for _, name := range names {
+			fmt.Fprintf(h, "%s\x00%x\x00", name, sha256.Sum256(keys[name]))
+		}
+		key.keyring = hex.EncodeToString(h.Sum(nil))
+	}
+	return key
+}
+
+// IndexCache holds parsed repository indexes in memory. Remote indexes are
+// fetched once per cache, while local indexes are re-read whenever they change.
+type IndexCache struct {
+	// For remote indexes, indexCacheKey -> *remoteIndex.
+	remotes sync.Map
 
 	// For local indexes.
 	sync.Mutex
-	modtimes map[string]time.Time
+	locals map[indexCacheKey]localIndex
+}
+
+// remoteIndex is fetched at most once, until it is flushed, expires or is
+// replaced by a fresh fetch.
+type remoteIndex struct {
+	once sync.Once
+	indexResult
+	fetched time.Time
+	done    atomic.Bool
 
-	// repoBase -> indexResult
-	indexes sync.Map
+	// previous is the entry this one replaced, to fall back on if we cannot refresh it.
+	previous *remoteIndex
 }
 
-func (i *indexCache) get(ctx context.Context, u string, keys map[string][]byte, arch string, opts *indexOpts) (*APKIndex, error) {
-	if strings.HasPrefix(u, "https://") {
-		// We don't want remote indexes to change while we're running.
-		once, _ := i.onces.LoadOrStore(u, &sync.Once{})
-		once.(*sync.Once).Do(func() {
-			idx, err := getRepositoryIndex(ctx, u, keys, arch, opts)
-			i.indexes.Store(u, indexResult{
-				idx: idx,
-				err: err,
-			})
+func (r *remoteIndex) expired(ttl time.Duration) bool {
+	return ttl > 0 && r.done.Load() && time.Since(r.fetched) > ttl
+}
+
+func (r *remoteIndex) fetch(u string, fetch func() (*APKIndex, error)) {
+	r.once.Do(func() {
+		idx, err := fetch()
+		r.indexResult = indexResult{
+			idx: idx,
+			err: err,
+		}
+		r.fetched = time.Now()
+		if p := r.previous; err != nil && p != nil && p.done.Load() && p.idx != nil {
+			// Keep serving what we had, and try again next time.
+			r.indexResult = indexResult{
+				idx: p.idx,
+				err: &StaleIndexError{URL: u, FetchedAt: p.fetched, Err: err},
+			}
+			r.fetched = p.fetched
+		}
+		r.previous = nil
+		r.done.Store(true)
+	})
+}
+
+type localIndex struct {
+	mod     time.Time
+	fetched time.Time
+	indexResult
+}
+
+// NewIndexCache returns an empty IndexCache.
+func NewIndexCache() *IndexCache {
+	return &IndexCache{
+		locals: map[indexCacheKey]localIndex{},
+	}
+}
+
+func (i *IndexCache) get(ctx context.Context, u string, keys map[string][]byte, arch string, opts *indexOpts) (*APKIndex, error) {
+	key := newIndexCacheKey(u, keys, arch, opts)
+	if isRemoteURL(u) || opts.fetcher(u) != nil {
+		// We don't want remote indexes to change while we're running,
+		// unless they expired or we were explicitly asked for a fresh copy.
+		refresh := opts.noCache
+		var entry *remoteIndex
+		for {
+			v, _ := i.remotes.LoadOrStore(key, &remoteIndex{})
+			entry = v.(*remoteIndex)
+			if !refresh && !entry.expired(opts.indexCacheTTL) {
+				break
+			}
+			// Only one caller gets to replace the entry, everyone else waits on its fetch.
+			fresh := &remoteIndex{previous: entry}
+			if i.remotes.CompareAndSwap(key, entry, fresh) {
+				entry = fresh
+				break
+			}
+			refresh = false
+		}
+		entry.fetch(u, func() (*APKIndex, error) {
+			return getRepositoryIndex(ctx, u, keys, arch, opts)
 		})
-	} else {
-		i.Lock()
-		defer i.Unlock()
+		if entry.err != nil && ctx.Err() != nil {
+			// Don't remember a fetch that failed only because it was cancelled.
+			i.remotes.CompareAndDelete(key, entry)
+		}
+		return entry.idx, entry.err
+	}
 
-		// We do expect local indexes to change, so we check modtimes.
-		stat, err := os.Stat(u)
-		if err != nil {
-			return nil, nil
+	i.Lock()
+	defer i.Unlock()
+
+	// We do expect local indexes to change, so we check modtimes.
+	var (
+		mod   time.Time
+		fetch = func() (*APKIndex, error) {
+			return getRepositoryIndex(ctx, u, keys, arch, opts)
+		}
+	)
+	if stat, err := os.Stat(u); err == nil {
+		mod = stat.ModTime()
+	} else if dirMod, ok := apkDirModTime(filepath.Dir(u)); ok {
+		// There is no index, but there are packages, so make one. There is nothing to verify.
+		mod = dirMod
+		fetch = func() (*APKIndex, error) {
+			return indexFromDirectory(ctx, filepath.Dir(u))
 		}
+	} else {
+		return nil, nil
+	}
 
-		mod := stat.ModTime()
-		before, ok := i.modtimes[u]
-		if !ok || mod.After(before) {
-			// If this is the first time or it has changed since the last time...
-			idx, err := getRepositoryIndex(ctx, u, keys, arch, opts)
-			i.indexes.Store(u, indexResult{
+	if i.locals == nil {
+		i.locals = map[indexCacheKey]localIndex{}
+	}
+	entry, ok := i.locals[key]
+	if opts.noCache || !ok || mod.After(entry.mod) {
+		// If this is the first time or it has changed since the last time...
+		idx, err := fetch()
+		if err != nil && ok && entry.idx != nil {
+			// Keep what we had, and try again next time.
+			return entry.idx, &StaleIndexError{URL: u, FetchedAt: entry.fetched, Err: err}
+		}
+		entry = localIndex{
+			mod:     mod,
+			fetched: time.Now(),
+			indexResult: indexResult{
 				idx: idx,
 				err: err,
-			})
-			i.modtimes[u] = mod
+			},
 		}
+		i.locals[key] = entry
 	}
+	return entry.idx, entry.err
+}
+
+// Flush drops the cached indexes of the repository at repoURL, for every arch,
+// so that they are fetched again the next time they are needed.
+func (i *IndexCache) Flush(repoURL string) {
+	i.flush(func(key indexCacheKey) bool {
+		return key.url == IndexURL(repoURL, key.arch) || key.url == adbIndexURL(repoURL, key.arch)
+	})
+}
+
+// FlushAll drops all cached indexes.
+func (i *IndexCache) FlushAll() {
+	i.flush(func(indexCacheKey) bool {
+		return true
+	})
+}
 
-	v, ok := i.indexes.Load(u)
-	if !ok {
-		panic(fmt.Errorf("did not see index %q after writing it", u))
+func (i *IndexCache) flush(match func(indexCacheKey) bool) {
+	// Callers already holding an entry keep using it; only later lookups miss.
+	i.remotes.Range(func(k, _ any) bool {
+		if match(k.(indexCacheKey)) {
+			i.remotes.Delete(k)
+		}
+		return true
+	})
+
+	i.Lock()
+	defer i.Unlock()
+	for k := range i.locals {
+		if match(k) {
+			delete(i.locals, k)
+		}
 	}
-	result := v.(indexResult)
+}
+
+// FlushIndexCache drops the indexes of the repository at repoURL from the
+// process-wide index cache.
+func FlushIndexCache(repoURL string) {
+	globalIndexCache.Flush(repoURL)
+}
 
-	return result.idx, result.err
+// FlushAllIndexCaches drops all indexes from the process-wide index cache.
+func FlushAllIndexCaches() {
+	globalIndexCache.FlushAll()
+}
+
+// isRemoteURL returns whether u refers to a repository that is fetched over http(s).
+func isRemoteURL(u string) bool {
+	return strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://")
 }
 
 // IndexURL full URL to the index file for the given repo and arch
@@ -113,55 +271,280 @@ func IndexURL(repo, arch string) string {
 	return fmt.Sprintf("%s/%s/%s", repo, arch, indexFilename)
 }
 
+// adbIndexURL is the URL of the APKv3 index of repo for arch, which is used when it
+// has no APKINDEX.tar.gz.
+func adbIndexURL(repo, arch string) string {
+	return fmt.Sprintf("%s/%s/%s", repo, arch, adbIndexFilename)
+}
+
 // GetRepositoryIndexes returns the indexes for the named repositories, keys and archs.
 // The signatures for each index are verified unless ignoreSignatures is set to true.
 // The key-value pairs in the map for `keys` are the name of the key and the contents of the key.
 // The name is just indicative. If it finds a match, it will use it. Else, it will try all keys.
+//
+// A repository that has no index for arch is tried with each of the architectures of
+// WithArchFallback in turn, until one has an index. WithMergedArchFallback also returns the
+// indexes of those architectures for repositories that do have one for arch.
+//
+// If an index could not be refreshed, the previous copy is returned along with
+// a StaleIndexError, unless WithStaleIndexOnError is set.
+//
+// Any other failure to get an index is returned as an IndexFetchError, for the architecture
+// that was tried. By default, the first one aborts the call; see WithPartialIndexResults.
+// A repository that has no index for arch or any of the fallback architectures fails with
+// the IndexFetchError of arch, except that local repositories that do not exist are skipped.
 func GetRepositoryIndexes(ctx context.Context, repos []string, keys map[string][]byte, arch string, options ...IndexOption) (indexes []NamedIndex, err error) {
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "GetRepositoryIndexes")
 	defer span.End()
 
-	opts := &indexOpts{}
-	for _, opt := range options {
-		opt(opts)
+	opts := newIndexOpts(options)
+
+	indexes, warnings, err := getRepositoryIndexes(ctx, repos, keys, arch, opts)
+	if err != nil {
+		return nil, err
 	}
+	return indexes, warnings
+}
 
-	for _, repo := range repos {
-		// does it start with a pin?
-		var (
-			repoName string
-			repoURL  = repo
-		)
-		if strings.HasPrefix(repo, "@") {
-			// it's a pinned repository, get the name
-			parts := strings.Fields(repo)
-			if len(parts) < 2 {
-				return nil, fmt.Errorf("invalid repository line: %q", repo)
+// GetRepositoryIndexesForArchs is like GetRepositoryIndexes, but fetches the indexes
+// for several architectures at once, and returns them grouped by architecture.
+func GetRepositoryIndexesForArchs(ctx context.Context, repos []string, keys map[string][]byte, archs []string, options ...IndexOption) (map[string][]NamedIndex, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "GetRepositoryIndexesForArchs")
+	defer span.End()
+
+	opts := newIndexOpts(options)
+
+	var (
+		results  = make([][]NamedIndex, len(archs))
+		warnings = make([]error, len(archs))
+	)
+	g, ctx := errgroup.WithContext(ctx)
+	for i, arch := range archs {
+		i, arch := i, arch
+		g.Go(func() error {
+			indexes, warning, err := getRepositoryIndexes(ctx, repos, keys, arch, opts)
+			if err != nil {
+				return err
 			}
-			repoName = parts[0][1:]
-			repoURL = parts[1]
-		}
+			results[i], warnings[i] = indexes, warning
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
 
-		u := IndexURL(repoURL, arch)
-		repoBase := fmt.Sprintf("%s/%s", repoURL, arch)
+	indexes := make(map[string][]NamedIndex, len(archs))
+	for i, arch := range archs {
+		indexes[arch] = append(indexes[arch], results[i]...)
+	}
+	return indexes, errors.Join(warnings...)
+}
 
-		index, err := globalIndexCache.get(ctx, u, keys, arch, opts)
+// getRepositoryIndexes returns the indexes of repos for arch. Errors that do not prevent
+// returning the indexes, such as stale indexes or partial results, are returned as warnings.
+func getRepositoryIndexes(ctx context.Context, repos []string, keys map[string][]byte, arch string, opts *indexOpts) (indexes []NamedIndex, warnings error, err error) {
+	var (
+		// Indexes are stored by position, since repository order matters to the resolver.
+		results = make([][]NamedIndex, len(repos))
+		errs    = make([]error, len(repos))
+	)
+	keys, err = opts.trustedKeys(keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	archs := append([]string{arch}, opts.archFallback...)
+	g, ctx := errgroup.WithContext(ctx)
+	if opts.maxConcurrency > 0 {
+		g.SetLimit(opts.maxConcurrency)
+	}
+	for i, repo := range repos {
+		// it may start with a pin
+		parsed, err := parseRepositoryLine(repo)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
+		repoName, repoURL := parsed.Name, parsed.URI
+		repoKeys := opts.keysFor(repoURL, keys)
+
+		i := i
+		g.Go(func() error {
+			var repoErrs []error
+			// report records err if we were asked for partial results, and otherwise fails,
+			// unless err is for a local repository that does not exist, which we ignore.
+			report := func(err error) error {
+				if opts.partialResults {
+					repoErrs = append(repoErrs, err)
+					return nil
+				}
+				var notFound *indexNotFoundError
+				if errors.As(err, &notFound) && notFound.local {
+					return nil
+				}
+				return err
+			}
+			defer func() {
+				errs[i] = errors.Join(repoErrs...)
+			}()
+
+			var notFound error
+			for j, indexArch := range archs {
+				fallback := j > 0
+				// Fallback architectures are only needed if nothing was found, unless we merge them.
+				if fallback && len(results[i]) > 0 && !opts.mergeArchFallback {
+					break
+				}
+				named, err := getNamedIndex(ctx, repoName, repoURL, repoKeys, indexArch, fallback, opts)
+				if named == nil {
+					if !errors.Is(err, fs.ErrNotExist) {
+						return report(err)
+					}
+					if !fallback {
+						notFound = err
+					}
+					continue
+				}
+				if err != nil {
+					if opts.staleOnError {
+						clog.FromContext(ctx).Warnf("using previously fetched repository index: %v", err)
+					} else {
+						repoErrs = append(repoErrs, err)
+					}
+				}
+				results[i] = append(results[i], named)
+			}
+			if len(results[i]) == 0 && notFound != nil {
+				return report(notFound)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, nil, err
+	}
 
-		// Can happen for fs.ErrNotExist in file scheme, we just ignore it.
-		if index == nil {
-			continue
+	for _, named := range results {
+		indexes = append(indexes, named...)
+	}
+	return indexes, errors.Join(errs...), nil
+}
+
+// getNamedIndex returns the index of repoURL for arch. If the index could not be
+// refreshed, the previously fetched one is returned along with a StaleIndexError.
+func getNamedIndex(ctx context.Context, repoName, repoURL string, keys map[string][]byte, arch string, fallback bool, opts *indexOpts) (*namedRepositoryWithIndex, error) {
+	u := IndexURL(repoURL, arch)
+	index, err := opts.cache().get(ctx, u, keys, arch, opts)
+	if index == nil && (err == nil || errors.Is(err, fs.ErrNotExist)) {
+		// Repositories of apk-tools 3 may only publish an APKv3 index.
+		adbURL := adbIndexURL(repoURL, arch)
+		adbIndex, adbErr := opts.cache().get(ctx, adbURL, keys, arch, opts)
+		if adbIndex != nil || (adbErr != nil && !errors.Is(adbErr, fs.ErrNotExist)) {
+			u, index, err = adbURL, adbIndex, adbErr
+		}
+	}
+	var staleErr *StaleIndexError
+	if err != nil && (index == nil || !errors.As(err, &staleErr)) {
+		return nil, &IndexFetchError{Repo: repoURL, Arch: arch, Err: err}
+	}
+	// Can happen for fs.ErrNotExist in file scheme.
+	if index == nil {
+		return nil, &IndexFetchError{Repo: repoURL, Arch: arch, Err: &indexNotFoundError{arch: arch, url: u, local: true}}
+	}
+	if opts.strictValidation {
+		if problems := ValidateIndex(index); len(problems) != 0 {
+			return nil, &IndexFetchError{Repo: repoURL, Arch: arch, Err: &IndexValidationError{URL: u, Problems: problems}}
 		}
+	}
 
-		repoRef := Repository{URI: repoBase}
-		indexes = append(indexes, NewNamedRepositoryWithIndex(repoName, repoRef.WithIndex(index)))
+	repoRef := Repository{URI: fmt.Sprintf("%s/%s", repoURL, arch)}
+	named := &namedRepositoryWithIndex{
+		name:         repoName,
+		repo:         repoRef.WithIndex(index),
+		arch:         arch,
+		archFallback: fallback,
 	}
-	return indexes, nil
+	if staleErr != nil {
+		named.staleSince = staleErr.FetchedAt
+		return named, err
+	}
+	return named, nil
 }
 
 func getRepositoryIndex(ctx context.Context, u string, keys map[string][]byte, arch string, opts *indexOpts) (*APKIndex, error) {
+	b, err := fetchRepositoryIndex(ctx, u, arch, opts)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	if isADB(b) {
+		return getADBIndex(u, b, keys, opts)
+	}
+
+	// validate the signature, remembering which key did
+	var (
+		signingKey string
+		signature  []byte
+	)
+	if !opts.ignoreSignatures {
+		signingKey, signature, err = verifyIndexSignature(b, keys)
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify signature of %s: %w", u, err)
+		}
+	}
+	// with a valid signature, convert it to an ApkIndex
+	index, err := IndexFromArchive(io.NopCloser(bytes.NewReader(b)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read convert repository index bytes to index struct at %s: %w", u, err)
+	}
+	if signingKey != "" {
+		index.SigningKeyName, index.Signature = signingKey, signature
+	}
+	sum := sha256.Sum256(b)
+	index.Checksum = sum[:]
+
+	return index, err
+}
+
+// getADBIndex verifies and parses the APKv3 index at u.
+func getADBIndex(u string, b []byte, keys map[string][]byte, opts *indexOpts) (*APKIndex, error) {
+	var (
+		signingKey string
+		signature  []byte
+		err        error
+	)
+	if !opts.ignoreSignatures {
+		signingKey, signature, err = verifyADBSignature(b, keys)
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify signature of %s: %w", u, err)
+		}
+	}
+	index, err := ParseADBIndex(b)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read APKv3 index at %s: %w", u, err)
+	}
+	if signingKey != "" {
+		index.SigningKeyName, index.Signature = signingKey, signature
+	}
+	sum := sha256.Sum256(b)
+	index.Checksum = sum[:]
+	return index, nil
+}
+
+// fetchRepositoryIndex returns the raw bytes of the index at u, or nil if it is
+// a local index that does not exist.
+func fetchRepositoryIndex(ctx context.Context, u string, arch string, opts *indexOpts) ([]byte, error) {
+	if f := opts.fetcher(u); f != nil {
+		rc, err := f.Fetch(ctx, u)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get repository index at %s: %w", u, err)
+		}
+		defer rc.Close()
+		b, err := io.ReadAll(rc)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read repository index at %s: %w", u, err)
+		}
+		return b, nil
+	}
+
 	// Normalize the repo as a URI, so that local paths
 	// are translated into file:// URLs, allowing them to be parsed
 	// into a url.URL{}.
@@ -170,7 +553,7 @@ func getRepositoryIndex(ctx context.Context, u string, keys map[string][]byte, a
 		asURL *url.URL
 		err   error
 	)
-	if strings.HasPrefix(u, "https://") {
+	if isRemoteURL(u) {
 		asURL, err = url.Parse(u)
 	} else {
 		// Attempt to parse non-https elements into URI's so they are translated into
@@ -181,6 +564,10 @@ func getRepositoryIndex(ctx context.Context, u string, keys map[string][]byte, a
 		return nil, fmt.Errorf("failed to parse repo as URI: %w", err)
 	}
 
+	if asURL.Scheme == "http" && !opts.allowInsecureHTTP {
+		return nil, fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
+	}
+
 	switch asURL.Scheme {
 	case "file":
 		b, err = os.ReadFile(u)
@@ -190,7 +577,7 @@ func getRepositoryIndex(ctx context.Context, u string, keys map[string][]byte, a
 			}
 			return nil, nil
 		}
-	case "https":
+	case "https", "http":
 		client := opts.httpClient
 		if client == nil {
 			rhttp := retryablehttp.NewClient()
@@ -208,109 +595,262 @@ func getRepositoryIndex(ctx context.Context, u string, keys map[string][]byte, a
 			req.SetBasicAuth(user, pass)
 		}
 
+		// If we have a copy of the index on disk, only ask for it if it changed.
+		var cached *diskIndex
+		if opts.indexCacheDir != "" {
+			cached = loadDiskIndex(opts.indexCacheDir, asURL)
+			if cached != nil {
+				if cached.ETag != "" {
+					req.Header.Set("If-None-Match", cached.ETag)
+				}
+				if cached.LastModified != "" {
+					req.Header.Set("If-Modified-Since", cached.LastModified)
+				}
+			}
+		}
+
 		// This will return a body that retries requests using Range requests if Read() hits an error.
 		rrt := newRangeRetryTransport(ctx, client)
 		res, err := rrt.RoundTrip(req)
 		if err != nil {
+			// The transport fails on any unexpected status, but a missing index is not transient.
+			if res != nil && res.StatusCode == http.StatusNotFound {
+				res.Body.Close()
+				return nil, &indexNotFoundError{arch: arch, url: u}
+			}
 			return nil, fmt.Errorf("unable to get repository index at %s: %w", u, err)
 		}
+		defer res.Body.Close()
 		switch res.StatusCode {
 		case http.StatusOK:
 			// this is fine
+		case http.StatusNotModified:
+			if cached == nil {
+				return nil, fmt.Errorf("unexpected status code %d when getting repository index for architecture %s at %s", res.StatusCode, arch, u)
+			}
 		case http.StatusNotFound:
-			return nil, fmt.Errorf("repository index not found for architecture %s at %s", arch, u)
+			return nil, &indexNotFoundError{arch: arch, url: u}
 		default:
 			return nil, fmt.Errorf("unexpected status code %d when getting repository index for architecture %s at %s", res.StatusCode, arch, u)
 		}
-		defer res.Body.Close()
-		buf := bytes.NewBuffer(nil)
-		if _, err := io.Copy(buf, res.Body); err != nil {
-			return nil, fmt.Errorf("unable to read repository index at %s: %w", u, err)
+		if res.StatusCode == http.StatusNotModified {
+			b = cached.data
+		} else {
+			buf := bytes.NewBuffer(nil)
+			if _, err := io.Copy(buf, res.Body); err != nil {
+				return nil, fmt.Errorf("unable to read repository index at %s: %w", u, err)
+			}
+			b = buf.Bytes()
+
+			if opts.indexCacheDir != "" {
+				d := &diskIndex{
+					ETag:         res.Header.Get("ETag"),
+					LastModified: res.Header.Get("Last-Modified"),
+					data:         b,
+				}
+				// A failure to cache is not a failure to fetch.
+				if err := d.save(opts.indexCacheDir, asURL); err != nil {
+					clog.FromContext(ctx).Warnf("unable to cache repository index %s: %v", u, err)
+				}
+			}
 		}
-		b = buf.Bytes()
 	default:
 		return nil, fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
 	}
 
-	// validate the signature
-	if !opts.ignoreSignatures {
-		buf := bytes.NewReader(b)
-		gzipReader, err := gzip.NewReader(buf)
-		if err != nil {
-			return nil, fmt.Errorf("unable to create gzip reader for repository index: %w", err)
-		}
-		// set multistream to false, so we can read each part separately;
-		// the first part is the signature, the second is the index, which should be
-		// verified.
-		gzipReader.Multistream(false)
-		defer gzipReader.Close()
+	return b, nil
+}
 
-		tarReader := tar.NewReader(gzipReader)
+// diskIndex is a raw index persisted by WithIndexCacheDir, along with the
+// validators needed to revalidate it.
+type diskIndex struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	// SHA256 of data, so that we never pair validators with the wrong bytes.
+	SHA256 string `json:"sha256"`
 
-		// read the signature
-		signatureFile, err := tarReader.Next()
-		if err != nil {
-			return nil, fmt.Errorf("failed to read signature from repository index: %w", err)
-		}
-		matches := signatureFileRegex.FindStringSubmatch(signatureFile.Name)
-		if len(matches) != 2 {
-			return nil, fmt.Errorf("failed to find key name in signature file name: %s", signatureFile.Name)
-		}
-		signature, err := io.ReadAll(tarReader)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read signature from repository index: %w", err)
-		}
-		// with multistream false, we should read the next one
-		if _, err := tarReader.Next(); err != nil && !errors.Is(err, io.EOF) {
-			return nil, fmt.Errorf("unexpected error reading from tgz: %w", err)
-		}
-		// we now have the signature bytes and name, get the contents of the rest;
-		// this should be everything else in the raw gzip file as is.
-		allBytes := len(b)
-		unreadBytes := buf.Len()
-		readBytes := allBytes - unreadBytes
-		indexData := b[readBytes:]
-
-		indexDigest, err := sign.HashData(indexData)
-		if err != nil {
-			return nil, err
-		}
-		// now we can check the signature
-		if keys == nil {
-			return nil, fmt.Errorf("no keys provided to verify signature")
-		}
-		var verified bool
-		keyData, ok := keys[matches[1]]
-		if ok {
-			if err := sign.RSAVerifySHA1Digest(indexDigest, signature, keyData); err != nil {
-				verified = false
-			}
-		}
-		if !verified {
-			for _, keyData := range keys {
-				if err := sign.RSAVerifySHA1Digest(indexDigest, signature, keyData); err == nil {
-					verified = true
-					break
-				}
-			}
-		}
-		if !verified {
-			return nil, fmt.Errorf("no key found to verify signature for keyfile %s; tried all other keys as well", matches[1])
-		}
+	data []byte
+}
+
+// diskIndexPath returns the path under dir where the index at u is stored.
+// u already includes the arch, and any credentials are dropped from the key.
+func diskIndexPath(dir string, u *url.URL) string {
+	key := *u
+	key.User = nil
+	return filepath.Join(dir, url.QueryEscape(key.String()))
+}
+
+// loadDiskIndex returns the index cached for u, or nil if there is none or it
+// cannot be trusted to match its validators.
+func loadDiskIndex(dir string, u *url.URL) *diskIndex {
+	p := diskIndexPath(dir, u)
+	meta, err := os.ReadFile(p + ".json")
+	if err != nil {
+		return nil
 	}
-	// with a valid signature, convert it to an ApkIndex
-	index, err := IndexFromArchive(io.NopCloser(bytes.NewReader(b)))
+	var d diskIndex
+	if err := json.Unmarshal(meta, &d); err != nil {
+		return nil
+	}
+	b, err := os.ReadFile(p)
 	if err != nil {
-		return nil, fmt.Errorf("unable to read convert repository index bytes to index struct at %s: %w", u, err)
+		return nil
+	}
+	sum := sha256.Sum256(b)
+	if hex.EncodeToString(sum[:]) != d.SHA256 {
+		return nil
 	}
+	d.data = b
+	return &d
+}
 
-	return index, err
+// save writes the index and its validators for u under dir. Each file is
+// written to a temporary file and renamed into place, so concurrent writers
+// sharing dir never observe partial files.
+func (d *diskIndex) save(dir string, u *url.URL) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(d.data)
+	d.SHA256 = hex.EncodeToString(sum[:])
+	meta, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	p := diskIndexPath(dir, u)
+	if err := writeFileAtomic(p, d.data); err != nil {
+		return err
+	}
+	return writeFileAtomic(p+".json", meta)
+}
+
+func writeFileAtomic(p string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
 }
 
 type indexOpts struct {
-	ignoreSignatures bool
-	httpClient       *http.Client
+	ignoreSignatures  bool
+	httpClient        *http.Client
+	indexCacheDir     string
+	indexCache        *IndexCache
+	noCache           bool
+	indexCacheTTL     time.Duration
+	maxConcurrency    int
+	staleOnError      bool
+	allowInsecureHTTP bool
+	fetchers          map[string]Fetcher
+	repositoryKeys    map[string]map[string][]byte
+	partialResults    bool
+	archFallback      []string
+	mergeArchFallback bool
+	keyDirs           []string
+	strictValidation  bool
+	// oci fetches oci:// repositories that have no Fetcher of WithFetcher.
+	oci *OCIFetcher
+}
+
+// newIndexOpts returns the indexOpts of options, with an OCIFetcher that is shared by all of
+// the indexes that are fetched with them, unless one is given.
+func newIndexOpts(options []IndexOption) *indexOpts {
+	opts := &indexOpts{}
+	for _, opt := range options {
+		opt(opts)
+	}
+	if opts.oci == nil {
+		opts.oci = NewOCIFetcher(opts.httpClient, nil)
+	}
+	return opts
+}
+
+// trustedKeys returns keys along with the keys in the directories of WithKeyDirectory,
+// keys winning for keys of the same name.
+func (o *indexOpts) trustedKeys(keys map[string][]byte) (map[string][]byte, error) {
+	if len(o.keyDirs) == 0 {
+		return keys, nil
+	}
+	merged := map[string][]byte{}
+	for _, dir := range o.keyDirs {
+		dirKeys, err := KeysFromFS(os.DirFS(dir), ".")
+		if err != nil {
+			return nil, fmt.Errorf("could not read keys in %s: %w", dir, err)
+		}
+		maps.Copy(merged, dirKeys)
+	}
+	maps.Copy(merged, keys)
+	return merged, nil
+}
+
+// indexNotFoundError is returned when a repository has no index for an architecture.
+type indexNotFoundError struct {
+	arch, url string
+	// local is set for repositories on the local filesystem.
+	local bool
+}
+
+func (e *indexNotFoundError) Error() string {
+	return fmt.Sprintf("repository index not found for architecture %s at %s", e.arch, e.url)
+}
+
+func (e *indexNotFoundError) Is(target error) bool {
+	return target == fs.ErrNotExist
+}
+
+// keysFor returns the keys to verify the index of repoURL with.
+func (o *indexOpts) keysFor(repoURL string, keys map[string][]byte) map[string][]byte {
+	if repoKeys, ok := o.repositoryKeys[strings.TrimSuffix(repoURL, "/")]; ok {
+		return repoKeys
+	}
+	return keys
+}
+
+// Fetcher retrieves indexes from URLs whose scheme is not natively supported,
+// such as object storage. See WithFetcher.
+type Fetcher interface {
+	Fetch(ctx context.Context, url string) (io.ReadCloser, error)
 }
+
+// fetcher returns the Fetcher registered for the scheme of u, if any.
+// Natively supported schemes cannot be overridden, except for oci://.
+func (o *indexOpts) fetcher(u string) Fetcher {
+	if !strings.Contains(u, "://") {
+		return nil
+	}
+	asURL, err := url.Parse(u)
+	if err != nil {
+		return nil
+	}
+	switch asURL.Scheme {
+	case "", "file", "https", "http":
+		return nil
+	}
+	if f, ok := o.fetchers[asURL.Scheme]; ok {
+		return f
+	}
+	if asURL.Scheme == ociScheme && o.oci != nil {
+		return o.oci
+	}
+	return nil
+}
+
+func (o *indexOpts) cache() *IndexCache {
+	if o.indexCache == nil {
+		return globalIndexCache
+	}
+	return o.indexCache
+}
+
 type IndexOption func(*indexOpts)
 
 func WithIgnoreSignatures(ignoreSignatures bool) IndexOption {
@@ -324,3 +864,136 @@ func WithHTTPClient(c *http.Client) IndexOption {
 		o.httpClient = c
 	}
 }
+
+// WithNoCache fetches indexes again rather than using what is already cached in
+// memory. The freshly fetched indexes replace the cached ones.
+func WithNoCache() IndexOption {
+	return func(o *indexOpts) {
+		o.noCache = true
+	}
+}
+
+// WithIndexCacheTTL re-fetches remote indexes that were fetched longer than ttl ago.
+// By default, a remote index is fetched only once.
+func WithIndexCacheTTL(ttl time.Duration) IndexOption {
+	return func(o *indexOpts) {
+		o.indexCacheTTL = ttl
+	}
+}
+
+// WithMaxIndexConcurrency limits how many indexes are fetched at the same time.
+// By default, all indexes are fetched concurrently.
+func WithMaxIndexConcurrency(n int) IndexOption {
+	return func(o *indexOpts) {
+		o.maxConcurrency = n
+	}
+}
+
+// WithStaleIndexOnError returns the previously fetched copy of an index, rather
+// than an error, when it cannot be refreshed. Indexes that were never fetched
+// successfully still return an error. See StaleNamedIndex to tell which indexes are stale.
+// The indexes of the architectures of WithArchFallback are returned stale the same way.
+func WithStaleIndexOnError() IndexOption {
+	return func(o *indexOpts) {
+		o.staleOnError = true
+	}
+}
+
+// WithIndexAllowInsecureHTTP allows fetching indexes from http:// repositories.
+// By default, only https:// and local repositories are supported.
+func WithIndexAllowInsecureHTTP() IndexOption {
+	return func(o *indexOpts) {
+		o.allowInsecureHTTP = true
+	}
+}
+
+// WithFetcher fetches indexes from repositories with the given scheme, e.g. "s3",
+// using f. The fetched indexes are verified and parsed exactly like any other.
+func WithFetcher(scheme string, f Fetcher) IndexOption {
+	return func(o *indexOpts) {
+		if o.fetchers == nil {
+			o.fetchers = map[string]Fetcher{}
+		}
+		o.fetchers[scheme] = f
+	}
+}
+
+// WithRepositoryKeys sets the keys to verify the index of each repository with, by
+// repository URL and then key name. Repositories without an entry are verified with
+// the keys passed to GetRepositoryIndexes.
+func WithRepositoryKeys(keys map[string]map[string][]byte) IndexOption {
+	return func(o *indexOpts) {
+		o.repositoryKeys = map[string]map[string][]byte{}
+		for repo, repoKeys := range keys {
+			o.repositoryKeys[strings.TrimSuffix(repo, "/")] = repoKeys
+		}
+	}
+}
+
+// WithPartialIndexResults returns the indexes that could be fetched, along with an
+// IndexFetchError for each repository whose index could not be, joined together.
+// That includes local repositories that do not exist, which are otherwise skipped.
+// A repository that has no index for the requested architecture or any of those of
+// WithArchFallback has the IndexFetchError of the requested one.
+func WithPartialIndexResults() IndexOption {
+	return func(o *indexOpts) {
+		o.partialResults = true
+	}
+}
+
+// WithKeyDirectory also trusts the *.rsa.pub keys in dir, like apk does for
+// /etc/apk/keys. Keys passed explicitly take precedence over keys of the same name.
+func WithKeyDirectory(dir string) IndexOption {
+	return func(o *indexOpts) {
+		o.keyDirs = append(o.keyDirs, dir)
+	}
+}
+
+// WithArchFallback tries the index of each of archs in turn, for repositories that
+// have no index for the requested architecture.
+func WithArchFallback(archs ...string) IndexOption {
+	return func(o *indexOpts) {
+		o.archFallback = append(o.archFallback, archs...)
+	}
+}
+
+// WithMergedArchFallback also returns the indexes of the architectures given to
+// WithArchFallback for repositories that do have an index for the requested one.
+// The resolver prefers packages from the requested architecture.
+func WithMergedArchFallback() IndexOption {
+	return func(o *indexOpts) {
+		o.mergeArchFallback = true
+	}
+}
+
+// WithStrictIndexValidation fails to get an index if ValidateIndex finds any problems with it,
+// with an IndexValidationError.
+func WithStrictIndexValidation() IndexOption {
+	return func(o *indexOpts) {
+		o.strictValidation = true
+	}
+}
+
+// withOCIFetcher sets the OCIFetcher of oci:// repositories, so that those of an APK
+// keep its keychain and the tokens and manifests it already fetched.
+func withOCIFetcher(f *OCIFetcher) IndexOption {
+	return func(o *indexOpts) {
+		o.oci = f
+	}
+}
+
+// withIndexCache sets the in-memory cache of parsed indexes to use, instead of
+// the process-wide default.
+func withIndexCache(c *IndexCache) IndexOption {
+	return func(o *indexOpts) {
+		o.indexCache = c
+	}
+}
+
+// WithIndexCacheDir persists remote indexes under dir and revalidates them with
+// conditional requests, so that unchanged indexes are not downloaded again.
+func WithIndexCacheDir(dir string) IndexOption {
+	return func(o *indexOpts) {
+		o.indexCacheDir = dir
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// IndexDiff is the difference between two indexes, from DiffIndexes. Each list is sorted by
+// name, then arch.
+type IndexDiff struct {
+	Added   []PackageChange `json:"added,omitempty"`
+	Removed []PackageChange `json:"removed,omitempty"`
+	// Changed are the packages with a different version, upgraded or downgraded.
+	Changed []PackageChange `json:"changed,omitempty"`
+}
+
+// PackageChange is a package that was added, removed or changed between two indexes.
+type PackageChange struct {
+	Name   string `json:"name"`
+	Origin string `json:"origin,omitempty"`
+	Arch   string `json:"arch,omitempty"`
+	// OldVersion is empty for an added package.
+	OldVersion string `json:"old_version,omitempty"`
+	// NewVersion is empty for a removed package.
+	NewVersion string `json:"new_version,omitempty"`
+	// Downgrade is set for a changed package with a lower version than before.
+	Downgrade bool `json:"downgrade,omitempty"`
+}
+
+// DiffIndexes compares the packages of index from to those of index to, by name and arch.
+// When an index has several versions of a package, only the highest, which apk would
+// prefer, is compared.
+func DiffIndexes(from, to *APKIndex) IndexDiff {
+	before, after := highestVersions(from), highestVersions(to)
+
+	var diff IndexDiff
+	for k, pkg := range after {
+		previous, ok := before[k]
+		if !ok {
+			diff.Added = append(diff.Added, PackageChange{Name: pkg.Name, Origin: pkg.Origin, Arch: pkg.Arch, NewVersion: pkg.Version})
+			continue
+		}
+		if c := compareIndexVersions(pkg.Version, previous.Version); c != 0 {
+			diff.Changed = append(diff.Changed, PackageChange{
+				Name:       pkg.Name,
+				Origin:     pkg.Origin,
+				Arch:       pkg.Arch,
+				OldVersion: previous.Version,
+				NewVersion: pkg.Version,
+				Downgrade:  c < 0,
+			})
+		}
+	}
+	for k, pkg := range before {
+		if _, ok := after[k]; !ok {
+			diff.Removed = append(diff.Removed, PackageChange{Name: pkg.Name, Origin: pkg.Origin, Arch: pkg.Arch, OldVersion: pkg.Version})
+		}
+	}
+	for _, changes := range [][]PackageChange{diff.Added, diff.Removed, diff.Changed} {
+		slices.SortFunc(changes, func(a, b PackageChange) int {
+			if c := cmp.Compare(a.Name, b.Name); c != 0 {
+				return c
+			}
+			return cmp.Compare(a.Arch, b.Arch)
+		})
+	}
+	return diff
+}
+
+type nameArch struct{ name, arch string }
+
+// highestVersions returns the highest version of each package in idx by name and arch.
+func highestVersions(idx *APKIndex) map[nameArch]*Package {
+	highest := map[nameArch]*Package{}
+	if idx == nil {
+		return highest
+	}
+	for _, pkg := range idx.Packages {
+		k := nameArch{pkg.Name, pkg.Arch}
+		if existing, ok := highest[k]; !ok || compareIndexVersions(pkg.Version, existing.Version) > 0 {
+			highest[k] = pkg
+		}
+	}
+	return highest
+}
+
+// Empty returns true if the indexes have the same packages.
+func (d IndexDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// ByOrigin splits the diff by the origin of the packages, so that the subpackages built from
+// the same origin can be reported together. Packages without an origin are their own origin.
+func (d IndexDiff) ByOrigin() map[string]IndexDiff {
+	origins := map[string]IndexDiff{}
+	origin := func(change PackageChange) string {
+		if change.Origin == "" {
+			return change.Name
+		}
+		return change.Origin
+	}
+	for _, change := range d.Added {
+		o := origins[origin(change)]
+		o.Added = append(o.Added, change)
+		origins[origin(change)] = o
+	}
+	for _, change := range d.Removed {
+		o := origins[origin(change)]
+		o.Removed = append(o.Removed, change)
+		origins[origin(change)] = o
+	}
+	for _, change := range d.Changed {
+		o := origins[origin(change)]
+		o.Changed = append(o.Changed, change)
+		origins[origin(change)] = o
+	}
+	return origins
+}
+
+// String returns the diff with one package on each line, like:
+//
+//	added app 1.0-r0 (x86_64)
+//	removed old-app 0.9-r0 (x86_64)
+//	upgraded busybox 1.36.1-r0 -> 1.36.1-r1 (x86_64)
+func (d IndexDiff) String() string {
+	var b strings.Builder
+	for _, change := range d.Added {
+		fmt.Fprintf(&b, "added %s %s (%s)\n", change.Name, change.NewVersion, change.Arch)
+	}
+	for _, change := range d.Removed {
+		fmt.Fprintf(&b, "removed %s %s (%s)\n", change.Name, change.OldVersion, change.Arch)
+	}
+	for _, change := range d.Changed {
+		verb := "upgraded"
+		if change.Downgrade {
+			verb = "downgraded"
+		}
+		fmt.Fprintf(&b, "%s %s %s -> %s (%s)\n", verb, change.Name, change.OldVersion, change.NewVersion, change.Arch)
+	}
+	return b.String()
+}
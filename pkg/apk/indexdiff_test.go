@@ -0,0 +1,63 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffIndexes(t *testing.T) {
+	old := &APKIndex{Packages: []*Package{
+		{Name: "busybox", Version: "1.36.1-r0", Arch: "x86_64", Origin: "busybox"},
+		{Name: "busybox-doc", Version: "1.36.1-r0", Arch: "x86_64", Origin: "busybox"},
+		{Name: "openssl", Version: "3.1.4-r0", Arch: "x86_64", Origin: "openssl"},
+		{Name: "openssl", Version: "3.1.3-r0", Arch: "x86_64", Origin: "openssl"},
+		{Name: "old-app", Version: "0.9-r0", Arch: "x86_64"},
+		{Name: "zlib", Version: "1.3-r1", Arch: "x86_64", Origin: "zlib"},
+	}}
+	current := &APKIndex{Packages: []*Package{
+		{Name: "busybox", Version: "1.36.1-r1", Arch: "x86_64", Origin: "busybox"},
+		{Name: "busybox-doc", Version: "1.36.1-r1", Arch: "x86_64", Origin: "busybox"},
+		// Only the highest version of each package is compared.
+		{Name: "openssl", Version: "3.1.3-r0", Arch: "x86_64", Origin: "openssl"},
+		{Name: "openssl", Version: "3.1.4-r0", Arch: "x86_64", Origin: "openssl"},
+		{Name: "app", Version: "1.0-r0", Arch: "x86_64"},
+		{Name: "zlib", Version: "1.3-r0", Arch: "x86_64", Origin: "zlib"},
+	}}
+
+	diff := DiffIndexes(old, current)
+	require.False(t, diff.Empty())
+	require.Equal(t, `added app 1.0-r0 (x86_64)
+removed old-app 0.9-r0 (x86_64)
+upgraded busybox 1.36.1-r0 -> 1.36.1-r1 (x86_64)
+upgraded busybox-doc 1.36.1-r0 -> 1.36.1-r1 (x86_64)
+downgraded zlib 1.3-r1 -> 1.3-r0 (x86_64)
+`, diff.String())
+
+	byOrigin := diff.ByOrigin()
+	require.Len(t, byOrigin, 4)
+	require.Len(t, byOrigin["busybox"].Changed, 2)
+	require.Len(t, byOrigin["old-app"].Removed, 1)
+
+	b, err := json.Marshal(diff.ByOrigin()["zlib"])
+	require.NoError(t, err)
+	require.JSONEq(t, `{"changed": [{"name": "zlib", "origin": "zlib", "arch": "x86_64", "old_version": "1.3-r1", "new_version": "1.3-r0", "downgrade": true}]}`, string(b))
+
+	require.True(t, DiffIndexes(old, old).Empty())
+	require.Len(t, DiffIndexes(nil, old).Added, 5)
+}
@@ -0,0 +1,126 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+)
+
+// MergeConflictPolicy decides what MergeIndexes does with a package that is in more than one
+// of the indexes it merges.
+type MergeConflictPolicy int
+
+const (
+	// MergeKeepFirst keeps the package of the same name, version and arch from the first index
+	// that has it.
+	MergeKeepFirst MergeConflictPolicy = iota
+	// MergeKeepHighestVersion keeps only the highest version of each name and arch, from the
+	// first index that has it.
+	MergeKeepHighestVersion
+	// MergeErrorOnConflict fails if packages of the same name, version and arch have different
+	// checksums. Identical copies are merged into one.
+	MergeErrorOnConflict
+)
+
+type mergeOpts struct {
+	policy      MergeConflictPolicy
+	description string
+}
+
+// MergeOption configures MergeIndexes.
+type MergeOption func(*mergeOpts)
+
+// WithMergeConflictPolicy sets the MergeConflictPolicy. Default is MergeKeepFirst.
+func WithMergeConflictPolicy(policy MergeConflictPolicy) MergeOption {
+	return func(o *mergeOpts) {
+		o.policy = policy
+	}
+}
+
+// WithMergedDescription sets the description of the merged index, which is empty by default.
+func WithMergedDescription(description string) MergeOption {
+	return func(o *mergeOpts) {
+		o.description = description
+	}
+}
+
+// MergeIndexes returns an unsigned index with the packages of all of idxs, which are earlier
+// the higher their precedence. The packages are sorted by name, then highest version first,
+// then arch, so merging the same packages always gives the same index. The packages are
+// shared with idxs, not copied.
+func MergeIndexes(idxs []*APKIndex, opts ...MergeOption) (*APKIndex, error) {
+	o := &mergeOpts{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	type key struct{ name, version, arch string }
+	// seen is the position in packages of each key
+	seen := map[key]int{}
+	var packages []*Package
+	for _, idx := range idxs {
+		for _, pkg := range idx.Packages {
+			k := key{pkg.Name, pkg.Version, pkg.Arch}
+			if o.policy == MergeKeepHighestVersion {
+				k.version = ""
+			}
+			i, ok := seen[k]
+			if !ok {
+				seen[k] = len(packages)
+				packages = append(packages, pkg)
+				continue
+			}
+			existing := packages[i]
+			switch {
+			case o.policy == MergeKeepHighestVersion:
+				if compareIndexVersions(pkg.Version, existing.Version) > 0 {
+					packages[i] = pkg
+				}
+			case o.policy == MergeErrorOnConflict && !pkg.Checksum.Equal(existing.Checksum):
+				return nil, fmt.Errorf("%s-%s (%s) is in more than one index with different checksums: %s and %s",
+					pkg.Name, pkg.Version, pkg.Arch, existing.ChecksumString(), pkg.ChecksumString())
+			}
+		}
+	}
+
+	slices.SortStableFunc(packages, func(a, b *Package) int {
+		if c := cmp.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		if c := compareIndexVersions(b.Version, a.Version); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Arch, b.Arch)
+	})
+	return &APKIndex{Description: o.description, Packages: packages}, nil
+}
+
+// compareIndexVersions compares two versions like Version.Compare, with versions that do not
+// parse lower than any that do, and compared as strings.
+func compareIndexVersions(a, b string) int {
+	av, aErr := ParseVersion(a)
+	bv, bErr := ParseVersion(b)
+	switch {
+	case aErr != nil && bErr != nil:
+		return cmp.Compare(a, b)
+	case aErr != nil:
+		return -1
+	case bErr != nil:
+		return 1
+	}
+	return av.Compare(bv)
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeIndexes(t *testing.T) {
+	upstream := &APKIndex{Packages: []*Package{
+		{Name: "zlib", Version: "1.3-r0", Arch: "x86_64", Checksum: []byte{1}},
+		{Name: "busybox", Version: "1.36.1-r0", Arch: "x86_64", Checksum: []byte{1}},
+		{Name: "busybox", Version: "1.36.1-r0", Arch: "aarch64", Checksum: []byte{1}},
+	}}
+	internal := &APKIndex{Packages: []*Package{
+		{Name: "busybox", Version: "1.36.1-r0", Arch: "x86_64", Checksum: []byte{2}},
+		{Name: "busybox", Version: "1.36.1-r10", Arch: "x86_64", Checksum: []byte{2}},
+		{Name: "app", Version: "1.0-r0", Arch: "x86_64", Checksum: []byte{2}},
+	}}
+	// names returns the packages of idx, along with which index each is from.
+	names := func(idx *APKIndex) []string {
+		var got []string
+		for _, pkg := range idx.Packages {
+			got = append(got, fmt.Sprintf("%s-%s %s %d", pkg.Name, pkg.Version, pkg.Arch, pkg.Checksum[0]))
+		}
+		return got
+	}
+
+	t.Run("keep first", func(t *testing.T) {
+		merged, err := MergeIndexes([]*APKIndex{upstream, internal}, WithMergedDescription("mirror"))
+		require.NoError(t, err)
+		require.Equal(t, "mirror", merged.Description)
+		require.Equal(t, []string{
+			"app-1.0-r0 x86_64 2",
+			"busybox-1.36.1-r10 x86_64 2",
+			"busybox-1.36.1-r0 aarch64 1",
+			"busybox-1.36.1-r0 x86_64 1",
+			"zlib-1.3-r0 x86_64 1",
+		}, names(merged))
+
+		again, err := MergeIndexes([]*APKIndex{upstream, internal}, WithMergedDescription("mirror"))
+		require.NoError(t, err)
+		require.Equal(t, merged, again)
+	})
+
+	t.Run("keep highest version", func(t *testing.T) {
+		merged, err := MergeIndexes([]*APKIndex{upstream, internal}, WithMergeConflictPolicy(MergeKeepHighestVersion))
+		require.NoError(t, err)
+		require.Equal(t, []string{
+			"app-1.0-r0 x86_64 2",
+			"busybox-1.36.1-r10 x86_64 2",
+			"busybox-1.36.1-r0 aarch64 1",
+			"zlib-1.3-r0 x86_64 1",
+		}, names(merged))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		_, err := MergeIndexes([]*APKIndex{upstream, internal}, WithMergeConflictPolicy(MergeErrorOnConflict))
+		require.ErrorContains(t, err, "busybox-1.36.1-r0 (x86_64) is in more than one index with different checksums")
+
+		// The same package in two indexes is not a conflict.
+		merged, err := MergeIndexes([]*APKIndex{upstream, upstream}, WithMergeConflictPolicy(MergeErrorOnConflict))
+		require.NoError(t, err)
+		require.Len(t, merged.Packages, 3)
+	})
+}
@@ -0,0 +1,120 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"sync"
+
+	"golang.org/x/exp/maps"
+)
+
+// indexQueries are the packages of an index by name and origin.
+type indexQueries struct {
+	// byName has the versions of each name, highest first.
+	byName   map[string][]*Package
+	byOrigin map[string][]*Package
+	// names are the keys of byName, sorted.
+	names []string
+}
+
+// queriesMuInit guards setting the queriesMu of every index.
+var queriesMuInit sync.Mutex
+
+// queriesLock returns the mutex of the queries of idx, creating it the first time.
+func (idx *APKIndex) queriesLock() *sync.Mutex {
+	queriesMuInit.Lock()
+	defer queriesMuInit.Unlock()
+	if idx.queriesMu == nil {
+		idx.queriesMu = &sync.Mutex{}
+	}
+	return idx.queriesMu
+}
+
+// lookup returns the maps for the queries, building them if this is the first query since
+// the index was created or invalidated.
+func (idx *APKIndex) lookup() *indexQueries {
+	mu := idx.queriesLock()
+	mu.Lock()
+	defer mu.Unlock()
+	if idx.queries != nil {
+		return idx.queries
+	}
+
+	q := &indexQueries{byName: map[string][]*Package{}, byOrigin: map[string][]*Package{}}
+	for _, pkg := range idx.Packages {
+		q.byName[pkg.Name] = append(q.byName[pkg.Name], pkg)
+		if pkg.Origin != "" {
+			q.byOrigin[pkg.Origin] = append(q.byOrigin[pkg.Origin], pkg)
+		}
+	}
+	for _, versions := range q.byName {
+		slices.SortStableFunc(versions, func(a, b *Package) int {
+			return compareIndexVersions(b.Version, a.Version)
+		})
+	}
+	q.names = maps.Keys(q.byName)
+	slices.Sort(q.names)
+	idx.queries = q
+	return q
+}
+
+// Invalidate drops what the queries like ByName have built from Packages, which must be done
+// after changing Packages for them to see the change.
+func (idx *APKIndex) Invalidate() {
+	mu := idx.queriesLock()
+	mu.Lock()
+	defer mu.Unlock()
+	idx.queries = nil
+}
+
+// Select returns the packages for which keep returns true, in index order.
+func (idx *APKIndex) Select(keep func(*Package) bool) []*Package {
+	var pkgs []*Package
+	for _, pkg := range idx.Packages {
+		if keep(pkg) {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs
+}
+
+// ByName returns the versions of the package named name, highest first.
+func (idx *APKIndex) ByName(name string) []*Package {
+	return slices.Clone(idx.lookup().byName[name])
+}
+
+// ByOrigin returns the packages built from origin, in index order.
+func (idx *APKIndex) ByOrigin(origin string) []*Package {
+	return slices.Clone(idx.lookup().byOrigin[origin])
+}
+
+// Match returns the packages with names that match the glob pattern, in the syntax of
+// path.Match, sorted by name and then highest version first.
+func (idx *APKIndex) Match(pattern string) ([]*Package, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	q := idx.lookup()
+	var pkgs []*Package
+	for _, name := range q.names {
+		if ok, _ := path.Match(pattern, name); ok {
+			pkgs = append(pkgs, q.byName[name]...)
+		}
+	}
+	return pkgs, nil
+}
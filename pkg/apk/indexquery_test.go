@@ -0,0 +1,74 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexQueries(t *testing.T) {
+	idx := &APKIndex{Packages: []*Package{
+		{Name: "openssl", Version: "3.1.3-r0", Origin: "openssl"},
+		{Name: "libcrypto3", Version: "3.1.4-r0", Origin: "openssl"},
+		{Name: "openssl", Version: "3.1.4-r0", Origin: "openssl"},
+		{Name: "openssl", Version: "3.1.4-r1", Origin: "openssl"},
+		{Name: "busybox", Version: "1.36.1-r0", Origin: "busybox"},
+		{Name: "libssl3", Version: "3.1.4-r0", Origin: "openssl"},
+	}}
+	refs := func(pkgs []*Package) []string {
+		got := []string{}
+		for _, pkg := range pkgs {
+			got = append(got, pkg.Filename())
+		}
+		return got
+	}
+
+	require.Equal(t, []string{"openssl-3.1.4-r1.apk", "openssl-3.1.4-r0.apk", "openssl-3.1.3-r0.apk"}, refs(idx.ByName("openssl")))
+	require.Empty(t, idx.ByName("missing"))
+	require.Equal(t, []string{
+		"openssl-3.1.3-r0.apk", "libcrypto3-3.1.4-r0.apk", "openssl-3.1.4-r0.apk", "openssl-3.1.4-r1.apk", "libssl3-3.1.4-r0.apk",
+	}, refs(idx.ByOrigin("openssl")))
+	require.Equal(t, []string{"busybox-1.36.1-r0.apk"}, refs(idx.Select(func(pkg *Package) bool {
+		return pkg.Origin != "openssl"
+	})))
+
+	libs, err := idx.Match("lib*3")
+	require.NoError(t, err)
+	require.Equal(t, []string{"libcrypto3-3.1.4-r0.apk", "libssl3-3.1.4-r0.apk"}, refs(libs))
+	_, err = idx.Match("[")
+	require.ErrorContains(t, err, "invalid pattern")
+
+	// Changes to the packages are only seen once the index is invalidated.
+	idx.Packages = append(idx.Packages, &Package{Name: "busybox", Version: "1.36.1-r1", Origin: "busybox"})
+	require.Len(t, idx.ByName("busybox"), 1)
+	idx.Invalidate()
+	require.Equal(t, []string{"busybox-1.36.1-r1.apk", "busybox-1.36.1-r0.apk"}, refs(idx.ByName("busybox")))
+
+	// An index can be copied, by value too, and queried concurrently.
+	copied := *idx
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Len(t, copied.ByName("openssl"), 3)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"fmt"
+	"strings"
+)
+
+// IndexProblem is something wrong with a package in an index, found by ValidateIndex.
+type IndexProblem struct {
+	// Package is the name of the package, which may be empty if that is the problem.
+	Package string
+	Version string
+	// Position is the position of the package in the index, counting from 0.
+	Position int
+	// Field is the field with the problem, as it is named in .PKGINFO, like "pkgver".
+	Field   string
+	Problem string
+}
+
+func (p IndexProblem) String() string {
+	return fmt.Sprintf("package %d (%s-%s): %s: %s", p.Position, p.Package, p.Version, p.Field, p.Problem)
+}
+
+// ValidateIndex checks the packages of idx for missing or invalid fields, dependencies that
+// cannot be parsed and duplicate versions. It returns nil if it finds no problems.
+func ValidateIndex(idx *APKIndex) []IndexProblem {
+	var problems []IndexProblem
+	type nameVersion struct{ name, version, arch string }
+	seen := map[nameVersion]int{}
+	for i, pkg := range idx.Packages {
+		problem := func(field, format string, args ...any) {
+			problems = append(problems, IndexProblem{
+				Package:  pkg.Name,
+				Version:  pkg.Version,
+				Position: i,
+				Field:    field,
+				Problem:  fmt.Sprintf(format, args...),
+			})
+		}
+
+		if pkg.Name == "" {
+			problem("pkgname", "missing")
+		}
+		if pkg.Version == "" {
+			problem("pkgver", "missing")
+		} else if _, err := ParseVersion(pkg.Version); err != nil {
+			problem("pkgver", "%v", err)
+		}
+		if pkg.Arch == "" {
+			problem("arch", "missing")
+		}
+		if len(pkg.Checksum) == 0 {
+			problem("checksum", "missing")
+		}
+		if pkg.Size == 0 {
+			problem("size", "missing")
+		}
+		for _, dep := range pkg.Dependencies {
+			if _, err := ParseDependency(dep); err != nil {
+				problem("depend", "%v", err)
+			}
+		}
+		for _, dep := range pkg.InstallIf {
+			if _, err := ParseDependency(dep); err != nil {
+				problem("install_if", "%v", err)
+			}
+		}
+
+		k := nameVersion{pkg.Name, pkg.Version, pkg.Arch}
+		if first, ok := seen[k]; ok && pkg.Name != "" && pkg.Version != "" {
+			problem("pkgver", "duplicate of package %d", first)
+		} else if !ok {
+			seen[k] = i
+		}
+	}
+	return problems
+}
+
+// IndexValidationError is returned for an index that WithStrictIndexValidation rejects.
+type IndexValidationError struct {
+	URL      string
+	Problems []IndexProblem
+}
+
+func (e *IndexValidationError) Error() string {
+	lines := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		lines = append(lines, "  "+p.String())
+	}
+	return fmt.Sprintf("index %s has %d problems:\n%s", e.URL, len(e.Problems), strings.Join(lines, "\n"))
+}
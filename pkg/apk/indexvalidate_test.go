@@ -0,0 +1,88 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateIndex(t *testing.T) {
+	valid := func(name, version string) *Package {
+		return &Package{Name: name, Version: version, Arch: "x86_64", Checksum: []byte{1}, Size: 1}
+	}
+	broken := valid("broken", "1.0-r0")
+	broken.Dependencies = []string{"so:libc.so.6", "foo>=", "bar>=1.0"}
+	broken.InstallIf = []string{"baz=x"}
+	truncated := &Package{Name: "truncated", Version: "2.0-r0"}
+
+	problems := ValidateIndex(&APKIndex{Packages: []*Package{
+		valid("foo", "1.0-r0"),
+		valid("bad-version", "v1"),
+		broken,
+		valid("foo", "1.0-r0"),
+		truncated,
+	}})
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.Package+" "+p.Field)
+	}
+	require.Equal(t, []string{
+		"bad-version pkgver",
+		"broken depend",
+		"broken install_if",
+		"foo pkgver",
+		"truncated arch",
+		"truncated checksum",
+		"truncated size",
+	}, got)
+	require.Equal(t, "package 3 (foo-1.0-r0): pkgver: duplicate of package 0", problems[3].String())
+
+	require.Nil(t, ValidateIndex(&APKIndex{Packages: []*Package{valid("foo", "1.0-r0"), valid("foo", "1.1-r0")}}))
+}
+
+func TestStrictIndexValidation(t *testing.T) {
+	ctx := context.Background()
+	index, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, indexFilename))
+	require.NoError(t, err)
+	good := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(good, testArch), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(good, testArch, indexFilename), index, 0o644))
+
+	indexes, err := GetRepositoryIndexes(ctx, []string{good}, testIndexKeys(), testArch,
+		withIndexCache(NewIndexCache()), WithStrictIndexValidation())
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+
+	// An index that was cut off in the middle of its last package.
+	bad := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(bad, testArch), 0o755))
+	pkg := &Package{Name: "foo", Version: "1.0-r0", Arch: testArch, Checksum: []byte{1}, Size: 1}
+	require.NoError(t, WriteArchiveToFile(&APKIndex{Packages: []*Package{pkg, {Name: "bar"}}}, filepath.Join(bad, testArch, indexFilename)))
+
+	_, err = GetRepositoryIndexes(ctx, []string{bad}, nil, testArch, withIndexCache(NewIndexCache()), WithIgnoreSignatures(true))
+	require.NoError(t, err)
+	_, err = GetRepositoryIndexes(ctx, []string{bad}, nil, testArch, withIndexCache(NewIndexCache()), WithIgnoreSignatures(true),
+		WithStrictIndexValidation())
+	var validationErr *IndexValidationError
+	require.ErrorAs(t, err, &validationErr)
+	require.Equal(t, "bar", validationErr.Problems[0].Package)
+	require.True(t, strings.HasPrefix(validationErr.Error(), "index "+IndexURL(bad, testArch)+" has 4 problems:"), validationErr.Error())
+}
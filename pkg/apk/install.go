@@ -19,17 +19,20 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha1" //nolint:gosec // this is what apk tools is using
-	"encoding/base64"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
 
+	"github.com/chainguard-dev/clog"
 	"go.opentelemetry.io/otel"
 
 	"github.com/chainguard-dev/go-apk/internal/tarfs"
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
 )
 
 // writeOneFile writes one file from the APK given the tar header and tar reader.
@@ -68,25 +71,35 @@ func (a *APK) writeOneFile(header *tar.Header, r io.Reader, allowOverwrite bool)
 }
 
 // installRegularFile handles the various error modes of writing a regular file
-func (a *APK) installRegularFile(header *tar.Header, tr *tar.Reader, tmpDir string, pkg *Package) (bool, error) {
+func (a *APK) installRegularFile(ctx context.Context, header *tar.Header, tr *tar.Reader, tmpDir string, pkg *Package) (bool, error) {
 	checksum, err := checksumFromHeader(header)
 	if err != nil {
 		return false, err
 	}
 
-	replaceMap := map[string]struct{}{}
-	for _, r := range pkg.Replaces {
-		replaceMap[r] = struct{}{}
-	}
+	// the digest of what is written, to compare against the checksum header
+	w := sha1.New() //nolint:gosec // this is what apk tools is using
+	var r io.Reader = io.TeeReader(tr, w)
 
-	var r io.Reader = tr
+	if a.preservedFiles[header.Name] {
+		// The package owns the file, but the locally modified one is kept, see WithProtectedPaths.
+		sum, err := a.installNewVersion(ctx, header, tr, pkg)
+		if err != nil {
+			return false, err
+		}
+		if checksum == nil {
+			checksum = sum
+		}
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string)
+		}
+		header.PAXRecords[paxRecordsChecksumKey] = checksum.String()
+		return true, nil
+	}
 
 	if checksum == nil {
 		// There was no checksum header, which is unexpected, but we can just recalculate it.
 
-		w := sha1.New() //nolint:gosec // this is what apk tools is using
-		tee := io.TeeReader(tr, w)
-
 		// we need to calculate the checksum of the file, and then pass it to the writeOneFile,
 		// so we save it to a tempdir and then remove it
 		f, err := os.CreateTemp(tmpDir, "apk-file")
@@ -94,7 +107,7 @@ func (a *APK) installRegularFile(header *tar.Header, tr *tar.Reader, tmpDir stri
 			return false, fmt.Errorf("error creating temporary file: %w", err)
 		}
 
-		if _, err := io.Copy(f, tee); err != nil {
+		if _, err := io.Copy(f, r); err != nil {
 			return false, fmt.Errorf("error copying file %s: %w", header.Name, err)
 		}
 		offset, err := f.Seek(0, io.SeekStart)
@@ -112,7 +125,7 @@ func (a *APK) installRegularFile(header *tar.Header, tr *tar.Reader, tmpDir stri
 	if err := a.writeOneFile(header, r, false); err != nil {
 		// If the error is something other than the file exists, return the error.
 		var fileExistsError FileExistsError
-		if !errors.As(err, &fileExistsError) || pkg.Origin == "" {
+		if !errors.As(err, &fileExistsError) {
 			return false, err
 		}
 
@@ -122,26 +135,9 @@ func (a *APK) installRegularFile(header *tar.Header, tr *tar.Reader, tmpDir stri
 			return false, nil
 		}
 
-		// If the files are not identical, then we can overwrite the file in two situations:
-		// 1. One of the packages replaces the other.
-		// 2. The packages are in the same origin.
-
-		// If the existing file's package replaces the package we want to install, we don't need to write this file.
-		pk, ok := a.installedFiles[header.Name]
-		if !ok {
-			return false, fmt.Errorf("found existing file we did not install (this should never happen): %s", header.Name)
-		}
-
-		for _, rep := range pk.Replaces {
-			if pkg.Name == rep {
-				return false, nil
-			}
-		}
-
-		// Otherwise, we can only overwrite the file if it's in the same origin or if it replaces the existing package.
-		_, isReplaced := replaceMap[pk.Name]
-		if pk.Origin != pkg.Origin && !isReplaced {
-			return false, fmt.Errorf("unable to install file over existing one, different contents: %s", header.Name)
+		overwrite, err := a.overwriteExistingFile(ctx, pkg, fileExistsError, checksum)
+		if err != nil || !overwrite {
+			return false, err
 		}
 
 		if err := a.writeOneFile(header, r, true); err != nil {
@@ -149,6 +145,14 @@ func (a *APK) installRegularFile(header *tar.Header, tr *tar.Reader, tmpDir stri
 		}
 	}
 
+	// the file was written, make sure it is what the package says it is
+	if actual := w.Sum(nil); !bytes.Equal(actual, checksum) {
+		if err := a.fs.Remove(header.Name); err != nil {
+			return false, fmt.Errorf("unable to remove corrupted file %s: %w", header.Name, err)
+		}
+		return false, &FileChecksumError{Path: header.Name, Package: pkg.Name, Expected: checksum, Actual: actual}
+	}
+
 	// we need to save this somewhere. The output expects []tar.Header, so we need to override that.
 	// Reusing a field should be good enough, provided that we know it is not getting in the way of
 	// anything downstream. Since we know it is not, this is good enough.
@@ -156,7 +160,7 @@ func (a *APK) installRegularFile(header *tar.Header, tr *tar.Reader, tmpDir stri
 		header.PAXRecords = make(map[string]string)
 	}
 	// apk installed db uses this format
-	header.PAXRecords[paxRecordsChecksumKey] = fmt.Sprintf("Q1%s", base64.StdEncoding.EncodeToString(checksum))
+	header.PAXRecords[paxRecordsChecksumKey] = checksum.String()
 
 	// xattrs
 	for k, v := range header.PAXRecords {
@@ -171,14 +175,298 @@ func (a *APK) installRegularFile(header *tar.Header, tr *tar.Reader, tmpDir stri
 	return true, nil
 }
 
+// overwriteExistingFile decides whether pkg replaces the existing file, which has different
+// contents than the checksum pkg has for it. exists is returned if no package installed it.
+func (a *APK) overwriteExistingFile(ctx context.Context, pkg *Package, exists FileExistsError, checksum Checksum) (bool, error) {
+	name := exists.Path
+	pk, ok := a.fileOwner(name)
+	if !ok {
+		if pkg.Origin == "" {
+			return false, exists
+		}
+		return false, fmt.Errorf("found existing file we did not install (this should never happen): %s", name)
+	}
+	// the installed version of the package, which pkg upgrades
+	if pk.Name == pkg.Name {
+		return true, nil
+	}
+
+	// If the files are not identical, then one of the packages must replace the other, or
+	// they must be in the same origin.
+	overwrite, allowed := resolveFileConflict(pk, pkg)
+	if !allowed {
+		err := &FileConflictError{Path: name, Owner: pk.Name, OwnerChecksum: exists.Sha1, Package: pkg.Name, Checksum: checksum}
+		if !a.warnOnFileConflicts {
+			return false, err
+		}
+		// the last package to write the file has it
+		clog.FromContext(ctx).Warnf("overwriting: %v", err)
+		return true, nil
+	}
+	return overwrite, nil
+}
+
+// replaceMismatchedEntry removes what is at the path of header if it is of another type, such
+// as a symlink where pkg has a directory, so that header is installed there rather than through
+// it. That is only done if it is pkg's or a package's that pkg replaces, or if it is an empty
+// directory that no other package has. It returns false if the existing entry is kept instead,
+// which is a symlink to a directory of another package or of the base system, as with a merged
+// /usr.
+func (a *APK) replaceMismatchedEntry(ctx context.Context, header *tar.Header, pkg *Package) (bool, error) {
+	fi, err := a.fs.Lstat(header.Name)
+	if err != nil {
+		return true, nil
+	}
+	existing, incoming := fi.Mode().Type(), header.FileInfo().Mode().Type()
+	if existing == incoming {
+		return true, nil
+	}
+
+	// the package that the existing entry is kept for, if any
+	var owner *Package
+	keep := true
+	if fi.IsDir() {
+		if owner, err = a.directoryKeptBy(header.Name, pkg); err != nil {
+			return false, err
+		}
+		keep = owner != nil
+	} else if o, ok := a.fileOwner(header.Name); ok {
+		owner, keep = o, !mayReplace(o, pkg)
+	}
+	if keep {
+		if existing == os.ModeSymlink && incoming == os.ModeDir {
+			if target, err := a.fs.Stat(header.Name); err == nil && target.IsDir() {
+				return false, nil
+			}
+		}
+		if owner == nil {
+			return false, FileExistsError{Path: header.Name}
+		}
+		conflict := &FileConflictError{Path: header.Name, Owner: owner.Name, Package: pkg.Name}
+		if !a.warnOnFileConflicts {
+			return false, conflict
+		}
+		clog.FromContext(ctx).Warnf("overwriting: %v", conflict)
+	}
+
+	if fi.IsDir() {
+		entries, err := a.fs.ReadDir(header.Name)
+		if err != nil {
+			return false, fmt.Errorf("unable to read directory %s: %w", header.Name, err)
+		}
+		if len(entries) != 0 {
+			emptied, err := a.emptyUpgradedDirectory(path.Clean(header.Name), pkg)
+			if err != nil {
+				return false, err
+			}
+			if !emptied {
+				return false, fmt.Errorf("unable to replace directory %s with a file of %s: directory is not empty", header.Name, pkg.Name)
+			}
+		}
+	}
+	clog.FromContext(ctx).Debugf("replacing %s with the one of %s, which is of another type", header.Name, pkg.Name)
+	if err := a.fs.Remove(header.Name); err != nil {
+		return false, fmt.Errorf("unable to remove existing %s: %w", header.Name, err)
+	}
+	return true, nil
+}
+
+// emptyUpgradedDirectory removes what is in the directory dir if it all is of the installed
+// version of pkg, which pkg has a file instead of, so that it can be replaced. It returns false
+// if anything else is in it.
+func (a *APK) emptyUpgradedDirectory(dir string, pkg *Package) (bool, error) {
+	var (
+		paths []string
+		other bool
+	)
+	err := fs.WalkDir(a.fs, dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == dir {
+			return nil
+		}
+		if !d.IsDir() {
+			if owner, ok := a.fileOwner(name); !ok || owner.Name != pkg.Name {
+				other = true
+				return fs.SkipAll
+			}
+		}
+		paths = append(paths, name)
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("unable to read directory %s: %w", dir, err)
+	}
+	if other {
+		return false, nil
+	}
+	// the entries of a directory are after it
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := a.fs.Remove(paths[i]); err != nil {
+			return false, fmt.Errorf("unable to remove %s: %w", paths[i], err)
+		}
+	}
+	return true, nil
+}
+
+// replaceUpgradedSymlink removes the symlink at the path of header if the installed version of
+// pkg has it, as it points elsewhere than the one of pkg.
+func (a *APK) replaceUpgradedSymlink(header *tar.Header, pkg *Package) error {
+	fi, err := a.fs.Lstat(header.Name)
+	if err != nil || fi.Mode().Type() != os.ModeSymlink {
+		return nil
+	}
+	if owner, ok := a.fileOwner(header.Name); !ok || owner.Name != pkg.Name {
+		return nil
+	}
+	if err := a.fs.Remove(header.Name); err != nil {
+		return fmt.Errorf("unable to remove existing symlink %s: %w", header.Name, err)
+	}
+	return nil
+}
+
+// directoryKeptBy returns an installed package that has the directory name and that pkg
+// neither is nor replaces, or nil if there is none.
+func (a *APK) directoryKeptBy(name string, pkg *Package) (*Package, error) {
+	q, err := a.lookupInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read installed packages: %w", err)
+	}
+	for _, owner := range q.dirs[filepath.Clean(name)] {
+		if !mayReplace(&owner.Package, pkg) {
+			return &owner.Package, nil
+		}
+	}
+	return nil, nil
+}
+
+// mayReplace returns whether pkg may replace what owner installed, which it may if it is the
+// same package or replaces it.
+func mayReplace(owner, pkg *Package) bool {
+	overwrite, allowed := resolveFileConflict(owner, pkg)
+	return owner.Name == pkg.Name || (allowed && overwrite)
+}
+
+// installHardlink links header.Name to header.Linkname, which must already exist, whether it
+// was installed earlier in the same package or by another package. checksums are those of the
+// files installed so far from the package, keyed by name.
+func (a *APK) installHardlink(ctx context.Context, header *tar.Header, pkg *Package, checksums map[string]Checksum) (bool, error) {
+	if _, err := a.replaceMismatchedEntry(ctx, header, pkg); err != nil {
+		return false, err
+	}
+	checksum, ok := checksums[header.Linkname]
+	if !ok {
+		sum, err := a.fileChecksum(header.Linkname)
+		if err != nil {
+			return false, fmt.Errorf("unable to read hardlink target %s: %w", header.Linkname, err)
+		}
+		checksum = sum
+	}
+
+	// The installed db lists a hardlink with the checksum of its target, even if it is kept.
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+	header.PAXRecords[paxRecordsChecksumKey] = checksum.String()
+
+	existing, err := a.fileChecksum(header.Name)
+	switch {
+	case err == nil:
+		// Either it is already linked or the same file, so it is kept, as for regular files.
+		if bytes.Equal(existing, checksum) {
+			return false, nil
+		}
+		overwrite, err := a.overwriteExistingFile(ctx, pkg, FileExistsError{Path: header.Name, Sha1: existing}, checksum)
+		if err != nil || !overwrite {
+			return false, err
+		}
+		if err := a.fs.Remove(header.Name); err != nil {
+			return false, fmt.Errorf("unable to remove existing file %s: %w", header.Name, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return false, err
+	}
+
+	if err := a.fs.Link(header.Linkname, header.Name); err != nil {
+		return false, fmt.Errorf("unable to install hardlink from %s -> %s: %w", header.Name, header.Linkname, err)
+	}
+	return true, nil
+}
+
+// linkChecksum returns the checksum of a symlink to target, the SHA1 of target, which is what
+// apk lists for it in the installed db.
+func linkChecksum(target string) Checksum {
+	sum := sha1.Sum([]byte(target)) //nolint:gosec // this is what apk tools is using
+	return sum[:]
+}
+
+// fileChecksum returns the SHA1 of the contents of the file at name.
+func (a *APK) fileChecksum(name string) (Checksum, error) {
+	f, err := a.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	w := sha1.New() //nolint:gosec // this is what apk tools is using
+	if _, err := io.Copy(w, f); err != nil {
+		return nil, fmt.Errorf("unable to calculate sum of %s: %w", name, err)
+	}
+	return w.Sum(nil), nil
+}
+
+// resolveFileConflict decides which of two packages with different contents for the same file
+// keeps it. overwrite is true if pkg, which is being installed, takes the file from owner, and
+// allowed is false if neither package may have it.
+func resolveFileConflict(owner, pkg *Package) (overwrite, allowed bool) {
+	pkgReplaces, ownerReplaces := replacesPackage(pkg, owner), replacesPackage(owner, pkg)
+	switch {
+	case pkgReplaces && ownerReplaces:
+		// the higher replaces_priority wins, and the new package if they are the same
+		return pkg.ReplacesPriority >= owner.ReplacesPriority, true
+	case ownerReplaces:
+		return false, true
+	case pkgReplaces:
+		return true, true
+	case pkg.Origin != "" && pkg.Origin == owner.Origin:
+		return true, true
+	}
+	return false, false
+}
+
+// replacesPackage returns true if one of the replaces entries of pkg is other, including its
+// version if the entry has a version constraint.
+func replacesPackage(pkg, other *Package) bool {
+	for _, r := range pkg.Replaces {
+		dep, err := ParseDependency(r)
+		if err != nil || dep.Conflict || dep.Name != other.Name {
+			continue
+		}
+		if dep.Operator == "" {
+			return true
+		}
+		if version, err := ParseVersion(other.Version); err == nil && dep.Satisfies(version) {
+			return true
+		}
+	}
+	return false
+}
+
 // installAPKFiles install the files from the APK and return the list of installed files
 // and their permissions. Returns a tar.Header because it is a convenient existing
 // struct that has all of the fields we need.
 func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) ([]tar.Header, error) {
-	_, span := otel.Tracer("go-apk").Start(ctx, "installAPKFiles")
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "installAPKFiles")
 	defer span.End()
 
-	var files []tar.Header
+	var (
+		files     []tar.Header
+		checksums = map[string]Checksum{}
+		// hardlinks whose target comes later in the package
+		pendingLinks []*tar.Header
+		// directories, whose metadata is set once nothing more is written to them
+		dirs []*tar.Header
+	)
 	tmpDir, err := os.MkdirTemp("", "apk-install")
 	if err != nil {
 		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
@@ -211,14 +499,14 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) (
 		switch header.Typeflag {
 		case tar.TypeDir:
 			// special case, if the target already exists, and it is a symlink to a directory, we can accept it as is
-			// otherwise, we need to create the directory.
-			if fi, err := a.fs.Stat(header.Name); err == nil && fi.Mode()&os.ModeSymlink != 0 {
-				if target, err := a.fs.Readlink(header.Name); err == nil {
-					if fi, err = a.fs.Stat(target); err == nil && fi.IsDir() {
-						// "break" rather than "continue", so that any handling outside of this switch statement is processed
-						break
-					}
-				}
+			// otherwise, we need to create the directory, replacing what is there if it is the package's.
+			create, err := a.replaceMismatchedEntry(ctx, header, pkg)
+			if err != nil {
+				return nil, err
+			}
+			if !create {
+				// "break" rather than "continue", so that any handling outside of this switch statement is processed
+				break
 			}
 			if err := a.fs.MkdirAll(header.Name, header.FileInfo().Mode().Perm()); err != nil {
 				return nil, fmt.Errorf("error creating directory %s: %w", header.Name, err)
@@ -233,31 +521,98 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) (
 					return nil, fmt.Errorf("error setting xattr %s on %s: %w", attrName, header.Name, err)
 				}
 			}
+			dirs = append(dirs, header)
 
 		case tar.TypeReg:
-			installed, err := a.installRegularFile(header, tr, tmpDir, pkg)
+			if _, err := a.replaceMismatchedEntry(ctx, header, pkg); err != nil {
+				return nil, err
+			}
+			installed, err := a.installRegularFile(ctx, header, tr, tmpDir, pkg)
 			if err != nil {
 				return nil, err
 			}
 
 			if installed {
 				a.installedFiles[header.Name] = pkg
+				if checksum, err := ParseChecksum(header.PAXRecords[paxRecordsChecksumKey]); err == nil {
+					checksums[header.Name] = checksum
+				}
+				if !a.preservedFiles[header.Name] {
+					if err := a.setMetadata(header); err != nil {
+						return nil, err
+					}
+				}
 			}
 
 		case tar.TypeSymlink:
+			// the installed db lists a symlink with the checksum of its target, like apk, which
+			// packages not built by abuild do not have
+			if header.PAXRecords[paxRecordsChecksumKey] == "" {
+				if header.PAXRecords == nil {
+					header.PAXRecords = make(map[string]string)
+				}
+				header.PAXRecords[paxRecordsChecksumKey] = linkChecksum(header.Linkname).String()
+			}
 			// some underlying filesystems and some memfs that we use in tests do not support symlinks.
 			// attempt it, and if it fails, just copy it.
-			// if it already exists, pointing to the same target, we can ignore it
+			// if it already exists, pointing to the same target, it is kept, but it is still
+			// the package's, so that an upgrade does not remove it
 			if target, err := a.fs.Readlink(header.Name); err == nil && target == header.Linkname {
+				if owner := a.installedFiles[header.Name]; owner == nil || owner.Name == pkg.Name {
+					a.installedFiles[header.Name] = pkg
+				}
+				files = append(files, *header)
 				continue
 			}
+			if _, err := a.replaceMismatchedEntry(ctx, header, pkg); err != nil {
+				return nil, err
+			}
+			if err := a.replaceUpgradedSymlink(header, pkg); err != nil {
+				return nil, err
+			}
 			if err := a.fs.Symlink(header.Linkname, header.Name); err != nil {
 				return nil, fmt.Errorf("unable to install symlink from %s -> %s: %w", header.Name, header.Linkname, err)
 			}
+			a.installedFiles[header.Name] = pkg
+			if err := a.setMetadata(header); err != nil {
+				return nil, err
+			}
+			if err := a.setSymlinkXattrs(header); err != nil {
+				return nil, err
+			}
 		case tar.TypeLink:
-			if err := a.fs.Link(header.Linkname, header.Name); err != nil {
+			if _, err := a.fs.Stat(header.Linkname); errors.Is(err, os.ErrNotExist) {
+				pendingLinks = append(pendingLinks, header)
+				continue
+			}
+			installed, err := a.installHardlink(ctx, header, pkg, checksums)
+			if err != nil {
+				return nil, err
+			}
+			// a kept link stays of the package that has it, unless that is an earlier attempt
+			// at installing this one
+			if owner := a.installedFiles[header.Name]; installed || owner == nil || owner.Name == pkg.Name {
+				a.installedFiles[header.Name] = pkg
+			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			result, err := a.installDeviceNode(ctx, header, pkg)
+			if err != nil {
 				return nil, err
 			}
+			switch result {
+			case deviceNodeSkipped:
+				continue
+			case deviceNodeKept:
+				// still the package's, so that an upgrade does not remove it
+				if owner := a.installedFiles[header.Name]; owner == nil || owner.Name == pkg.Name {
+					a.installedFiles[header.Name] = pkg
+				}
+			case deviceNodeInstalled:
+				a.installedFiles[header.Name] = pkg
+				if err := a.setMetadata(header); err != nil {
+					return nil, err
+				}
+			}
 		default:
 			return nil, fmt.Errorf("unsupported file type %s %v", header.Name, header.Typeflag)
 		}
@@ -265,36 +620,100 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) (
 		files = append(files, *header)
 	}
 
+	for _, header := range pendingLinks {
+		installed, err := a.installHardlink(ctx, header, pkg, checksums)
+		if err != nil {
+			return nil, err
+		}
+		if owner := a.installedFiles[header.Name]; installed || owner == nil || owner.Name == pkg.Name {
+			a.installedFiles[header.Name] = pkg
+		}
+		files = append(files, *header)
+	}
+
+	for _, header := range dirs {
+		if err := a.setMetadata(header); err != nil {
+			return nil, err
+		}
+	}
+
 	return files, nil
 }
 
-func checksumFromHeader(header *tar.Header) ([]byte, error) {
-	pax := header.PAXRecords
-	if pax == nil {
-		return nil, nil
+// lazilyInstallNewVersion is installNewVersion for a file of tf.
+func (a *APK) lazilyInstallNewVersion(ctx context.Context, header *tar.Header, tf *tarfs.FS, pkg *Package) error {
+	if header.Typeflag != tar.TypeReg {
+		return nil
 	}
+	f, err := tf.Open(header.Name)
+	if err != nil {
+		return fmt.Errorf("unable to open %s of %s: %w", header.Name, pkg.Name, err)
+	}
+	defer f.Close()
+	_, err = a.installNewVersion(ctx, header, f, pkg)
+	return err
+}
 
-	hexsum, ok := pax[paxRecordsChecksumKey]
+// setSymlinkXattrs sets the xattrs of header on the symlink installed for it, if the filesystem
+// is an apkfs.LxattrFS; SetXattr would set them on its target instead.
+func (a *APK) setSymlinkXattrs(header *tar.Header) error {
+	lfs, ok := a.fs.(apkfs.LxattrFS)
 	if !ok {
-		return nil, nil
+		return nil
 	}
+	for k, v := range header.PAXRecords {
+		if !strings.HasPrefix(k, xattrTarPAXRecordsPrefix) {
+			continue
+		}
+		attrName := strings.TrimPrefix(k, xattrTarPAXRecordsPrefix)
+		if err := lfs.LSetXattr(header.Name, attrName, []byte(v)); err != nil {
+			return fmt.Errorf("error setting xattr %s on %s: %w", attrName, header.Name, err)
+		}
+	}
+	return nil
+}
 
-	if strings.HasPrefix(hexsum, "Q1") {
-		// This is nonstandard but something we did at one point, handle it.
-		// In other contexts, this Q1 prefix means "this is sha1 not md5".
-		b64 := strings.TrimPrefix(hexsum, "Q1")
-
-		checksum, err := base64.StdEncoding.DecodeString(b64)
-		if err != nil {
-			return nil, fmt.Errorf("decoding base64 checksum from header for %q: %w", header.Name, err)
+// setMetadata sets the owner and mode of header on what was installed for it, if the
+// filesystem is an apkfs.MetadataFS, and its access and modification times if it is an
+// apkfs.ChtimesFS; others keep what they were created with. The owner is set first, as
+// changing it clears the setuid and setgid bits.
+func (a *APK) setMetadata(header *tar.Header) error {
+	if mfs, ok := a.fs.(apkfs.MetadataFS); ok {
+		if err := mfs.Lchown(header.Name, header.Uid, header.Gid); err != nil {
+			return fmt.Errorf("unable to set owner of %s: %w", header.Name, err)
+		}
+		// symlinks have no mode of their own, chmod would change their target
+		if header.Typeflag != tar.TypeSymlink {
+			if err := mfs.Chmod(header.Name, header.FileInfo().Mode()); err != nil {
+				return fmt.Errorf("unable to set mode of %s: %w", header.Name, err)
+			}
 		}
+	}
+	cfs, ok := a.fs.(apkfs.ChtimesFS)
+	if !ok || header.ModTime.IsZero() {
+		return nil
+	}
+	atime := header.AccessTime
+	if atime.IsZero() {
+		atime = header.ModTime
+	}
+	if err := cfs.Lchtimes(header.Name, atime, header.ModTime); err != nil {
+		return fmt.Errorf("unable to set modification time of %s: %w", header.Name, err)
+	}
+	return nil
+}
 
-		return checksum, nil
+func checksumFromHeader(header *tar.Header) (Checksum, error) {
+	hexsum, ok := header.PAXRecords[paxRecordsChecksumKey]
+	if !ok {
+		return nil, nil
 	}
 
-	checksum, err := hex.DecodeString(hexsum)
+	// The record is hex, but we have written it with a Q1 prefix and base64 at one point,
+	// so that is handled as well.
+	checksum, err := ParseChecksum(hexsum)
 	if err != nil {
-		return nil, fmt.Errorf("decoding hex checksum from header for %q: %w", header.Name, err)
+		return nil, fmt.Errorf("checksum from header for %q: %w", header.Name, err)
 	}
 
 	return checksum, nil
@@ -323,12 +742,21 @@ func (a *APK) lazilyInstallAPKFiles(ctx context.Context, wh WriteHeaderer, tf *t
 		// whatever it is now, it is in the data section
 		startedDataSection = true
 
+		if a.preservedFiles[file.Header.Name] {
+			if err := a.lazilyInstallNewVersion(ctx, &file.Header, tf, pkg); err != nil {
+				return nil, err
+			}
+			a.installedFiles[file.Header.Name] = pkg
+			files = append(files, file.Header)
+			continue
+		}
+
 		installed, err := wh.WriteHeader(file.Header, tf, pkg)
 		if err != nil {
 			return nil, err
 		}
 
-		if installed && file.Header.Typeflag == tar.TypeReg {
+		if installed && (file.Header.Typeflag == tar.TypeReg || file.Header.Typeflag == tar.TypeLink) {
 			a.installedFiles[file.Header.Name] = pkg
 		}
 
@@ -22,14 +22,24 @@ import (
 	"crypto/sha1" //nolint:gosec // this is what apk tools is using
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"text/template"
+	"time"
 
 	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+	"github.com/chainguard-dev/go-apk/pkg/tarball"
 )
 
 type testDirEntry struct {
@@ -41,8 +51,12 @@ type testDirEntry struct {
 }
 
 func TestInstallAPKFiles(t *testing.T) {
+	testEachBackend(t, testInstallAPKFiles)
+}
+
+func testInstallAPKFiles(t *testing.T, newAPK func() (*APK, apkfs.FullFS, error)) {
 	t.Run("basic", func(t *testing.T) {
-		apk, src, err := testGetTestAPK()
+		apk, src, err := newAPK()
 		require.NoErrorf(t, err, "failed to get test APK")
 
 		// create a tgz stream with our files
@@ -106,7 +120,7 @@ func TestInstallAPKFiles(t *testing.T) {
 	})
 
 	t.Run("xattrs", func(t *testing.T) {
-		apk, src, err := testGetTestAPK()
+		apk, src, err := newAPK()
 		require.NoErrorf(t, err, "failed to get test APK")
 
 		// create a tgz stream with our files
@@ -150,9 +164,74 @@ func TestInstallAPKFiles(t *testing.T) {
 		}
 	})
 
+	t.Run("symlink xattrs", func(t *testing.T) {
+		apk, src, err := newAPK()
+		require.NoErrorf(t, err, "failed to get test APK")
+
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, writeFiles(tw, []testDirEntry{
+			{"etc", 0o755, true, nil, nil},
+			{"etc/foo", 0o644, false, []byte("hello world"), map[string][]byte{"user.file": []byte("file")}},
+		}))
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag:   tar.TypeSymlink,
+			Name:       "etc/link",
+			Linkname:   "foo",
+			Mode:       0o777,
+			PAXRecords: map[string]string{xattrTarPAXRecordsPrefix + "security.selinux": "system_u:object_r:etc_t:s0"},
+		}))
+		require.NoError(t, tw.Close())
+		_, err = apk.installAPKFiles(context.Background(), &buf, &Package{})
+		require.NoError(t, err)
+
+		xattrs, err := src.(apkfs.LxattrFS).LListXattrs("etc/link")
+		require.NoError(t, err)
+		require.Equal(t, map[string][]byte{"security.selinux": []byte("system_u:object_r:etc_t:s0")}, xattrs)
+		xattrs, err = src.ListXattrs("etc/link")
+		require.NoError(t, err)
+		require.Equal(t, map[string][]byte{"user.file": []byte("file")}, xattrs, "the target should keep its own xattrs")
+	})
+
+	t.Run("checksums", func(t *testing.T) {
+		install := func(t *testing.T, content []byte, checksum string) ([]tar.Header, error) {
+			apk, _, err := newAPK()
+			require.NoErrorf(t, err, "failed to get test APK")
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: "etc", Typeflag: tar.TypeDir, Mode: 0o755}))
+			require.NoError(t, tw.WriteHeader(&tar.Header{
+				Name:       "etc/checked",
+				Typeflag:   tar.TypeReg,
+				Mode:       0o644,
+				Size:       int64(len(content)),
+				Format:     tar.FormatPAX,
+				PAXRecords: map[string]string{paxRecordsChecksumKey: checksum},
+			}))
+			_, err = tw.Write(content)
+			require.NoError(t, err)
+			require.NoError(t, tw.Close())
+			return apk.installAPKFiles(context.Background(), &buf, &Package{Name: "checked"})
+		}
+		content := []byte("hello world")
+		sum := sha1.Sum(content) //nolint:gosec // this is what apk tools is using
+
+		headers, err := install(t, content, hex.EncodeToString(sum[:]))
+		require.NoError(t, err)
+		require.Len(t, headers, 2)
+		require.Equal(t, "Q1"+base64.StdEncoding.EncodeToString(sum[:]), headers[1].PAXRecords[paxRecordsChecksumKey])
+
+		_, err = install(t, []byte("hello wOrld"), hex.EncodeToString(sum[:]))
+		var checksumErr *FileChecksumError
+		require.ErrorAs(t, err, &checksumErr)
+		require.Equal(t, "etc/checked", checksumErr.Path)
+		require.Equal(t, "checked", checksumErr.Package)
+		require.Equal(t, sum[:], checksumErr.Expected)
+	})
+
 	t.Run("overlapping files", func(t *testing.T) {
 		t.Run("different origin and content", func(t *testing.T) {
-			apk, src, err := testGetTestAPK()
+			apk, src, err := newAPK()
 			require.NoErrorf(t, err, "failed to get test APK")
 			// install a file in a known location
 			originalContent := []byte("hello world")
@@ -180,8 +259,59 @@ func TestInstallAPKFiles(t *testing.T) {
 
 			checkDuplicateIDBEntries(t, apk)
 		})
+		t.Run("different origin and content, conflict error", func(t *testing.T) {
+			apk, _, err := newAPK()
+			require.NoErrorf(t, err, "failed to get test APK")
+			overwriteFilename := "etc/doublewrite"
+
+			fp1 := fakePackage(t, &Package{Name: "first", Origin: "first"}, []testDirEntry{
+				{"etc", 0o755, true, nil, nil},
+				{overwriteFilename, 0o755, false, []byte("hello world"), nil},
+			})
+			fp2 := fakePackage(t, &Package{Name: "second", Origin: "second"}, []testDirEntry{
+				{"etc", 0o755, true, nil, nil},
+				{overwriteFilename, 0o755, false, []byte("extra long I am here"), nil},
+			})
+
+			err = apk.InstallPackages(context.Background(), nil, []InstallablePackage{fp1, fp2})
+			var conflict *FileConflictError
+			require.ErrorAs(t, err, &conflict)
+			first, second := sha1.Sum([]byte("hello world")), sha1.Sum([]byte("extra long I am here")) //nolint:gosec
+			require.Equal(t, &FileConflictError{
+				Path:          overwriteFilename,
+				Owner:         "first",
+				OwnerChecksum: first[:],
+				Package:       "second",
+				Checksum:      second[:],
+			}, conflict)
+			require.ErrorContains(t, err, "Q1"+base64.StdEncoding.EncodeToString(first[:])+" in first")
+		})
+		t.Run("different origin and content, as a warning", func(t *testing.T) {
+			_, src, err := newAPK()
+			require.NoErrorf(t, err, "failed to get test APK")
+			apk, err := New(WithFS(src), WithIgnoreMknodErrors(ignoreMknodErrors), WithAllowUnsignedLocalPackages(), WithWarnOnFileConflicts(true))
+			require.NoError(t, err)
+			overwriteFilename := "etc/doublewrite"
+
+			fp1 := fakePackage(t, &Package{Name: "first", Origin: "first"}, []testDirEntry{
+				{"etc", 0o755, true, nil, nil},
+				{overwriteFilename, 0o755, false, []byte("hello world"), nil},
+			})
+			fp2 := fakePackage(t, &Package{Name: "second", Origin: "second"}, []testDirEntry{
+				{"etc", 0o755, true, nil, nil},
+				{overwriteFilename, 0o755, false, []byte("extra long I am here"), nil},
+			})
+
+			require.NoError(t, apk.InstallPackages(context.Background(), nil, []InstallablePackage{fp1, fp2}))
+			actual, err := src.ReadFile(overwriteFilename)
+			require.NoError(t, err, "error reading %s", overwriteFilename)
+			require.Equal(t, "extra long I am here", string(actual))
+			require.Equal(t, "second", apk.installedFiles[overwriteFilename].Name)
+
+			checkDuplicateIDBEntries(t, apk)
+		})
 		t.Run("different origin and content, but with replaces", func(t *testing.T) {
-			apk, src, err := testGetTestAPK()
+			apk, src, err := newAPK()
 			require.NoErrorf(t, err, "failed to get test APK")
 			// install a file in a known location
 			originalContent := []byte("hello world")
@@ -210,7 +340,7 @@ func TestInstallAPKFiles(t *testing.T) {
 			checkDuplicateIDBEntries(t, apk)
 		})
 		t.Run("same origin", func(t *testing.T) {
-			apk, src, err := testGetTestAPK()
+			apk, src, err := newAPK()
 			require.NoErrorf(t, err, "failed to get test APK")
 			// install a file in a known location
 			originalContent := []byte("hello world")
@@ -239,7 +369,7 @@ func TestInstallAPKFiles(t *testing.T) {
 			checkDuplicateIDBEntries(t, apk)
 		})
 		t.Run("different origin with same content", func(t *testing.T) {
-			apk, src, err := testGetTestAPK()
+			apk, src, err := newAPK()
 			require.NoErrorf(t, err, "failed to get test APK")
 			// install a file in a known location
 			originalContent := []byte("hello world")
@@ -267,7 +397,7 @@ func TestInstallAPKFiles(t *testing.T) {
 			checkDuplicateIDBEntries(t, apk)
 		})
 		t.Run("different origin and content, but is replaced", func(t *testing.T) {
-			apk, src, err := testGetTestAPK()
+			apk, src, err := newAPK()
 			require.NoErrorf(t, err, "failed to get test APK")
 			// install a file in a known location
 			originalContent := []byte("hello world")
@@ -295,6 +425,104 @@ func TestInstallAPKFiles(t *testing.T) {
 
 			checkDuplicateIDBEntries(t, apk)
 		})
+		t.Run("replace each other", func(t *testing.T) {
+			for _, tt := range []struct {
+				name                    string
+				firstPriority, priority uint64
+				want                    string
+			}{
+				{"higher priority", 10, 20, "second"},
+				{"lower priority", 20, 10, "first"},
+				{"same priority", 0, 0, "second"},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					apk, src, err := newAPK()
+					require.NoErrorf(t, err, "failed to get test APK")
+					overwriteFilename := "etc/doublewrite"
+
+					pkg := &Package{Name: "first", Origin: "first", Replaces: []string{"second"}, ReplacesPriority: tt.firstPriority}
+					fp1 := fakePackage(t, pkg, []testDirEntry{
+						{"etc", 0o755, true, nil, nil},
+						{overwriteFilename, 0o755, false, []byte("first"), nil},
+					})
+
+					pkg2 := &Package{Name: "second", Origin: "second", Replaces: []string{"first"}, ReplacesPriority: tt.priority}
+					fp2 := fakePackage(t, pkg2, []testDirEntry{
+						{"etc", 0o755, true, nil, nil},
+						{overwriteFilename, 0o755, false, []byte("second"), nil},
+					})
+
+					require.NoError(t, apk.InstallPackages(context.Background(), nil, []InstallablePackage{fp1, fp2}))
+
+					actual, err := src.ReadFile(overwriteFilename)
+					require.NoError(t, err, "error reading %s", overwriteFilename)
+					require.Equal(t, tt.want, string(actual))
+
+					checkDuplicateIDBEntries(t, apk)
+				})
+			}
+		})
+		t.Run("replaces a different version", func(t *testing.T) {
+			apk, _, err := newAPK()
+			require.NoErrorf(t, err, "failed to get test APK")
+			overwriteFilename := "etc/doublewrite"
+
+			pkg := &Package{Name: "first", Version: "2.0-r0", Origin: "first"}
+			fp1 := fakePackage(t, pkg, []testDirEntry{
+				{"etc", 0o755, true, nil, nil},
+				{overwriteFilename, 0o755, false, []byte("hello world"), nil},
+			})
+
+			pkg2 := &Package{Name: "second", Origin: "second", Replaces: []string{"first<2"}}
+			fp2 := fakePackage(t, pkg2, []testDirEntry{
+				{"etc", 0o755, true, nil, nil},
+				{overwriteFilename, 0o755, false, []byte("extra long I am here"), nil},
+			})
+
+			err = apk.InstallPackages(context.Background(), nil, []InstallablePackage{fp1, fp2})
+			require.ErrorContains(t, err, "different contents: etc/doublewrite (owned by first)")
+		})
+		t.Run("replaces a previously installed package", func(t *testing.T) {
+			first, src, err := newAPK()
+			require.NoErrorf(t, err, "failed to get test APK")
+			overwriteFilename := "etc/doublewrite"
+
+			pkg := &Package{Name: "libfoo1", Origin: "foo1"}
+			fp1 := fakePackage(t, pkg, []testDirEntry{
+				{"etc", 0o755, true, nil, nil},
+				{overwriteFilename, 0o755, false, []byte("hello world"), nil},
+				{"etc/kept", 0o644, false, []byte("kept"), nil},
+			})
+			require.NoError(t, first.InstallPackages(context.Background(), nil, []InstallablePackage{fp1}))
+
+			// A later run only knows about the first package from the installed database.
+			second, err := New(WithFS(src), WithIgnoreMknodErrors(ignoreMknodErrors), WithAllowUnsignedLocalPackages())
+			require.NoError(t, err)
+			pkg2 := &Package{Name: "libfoo2", Origin: "foo", Replaces: []string{"libfoo1"}}
+			fp2 := fakePackage(t, pkg2, []testDirEntry{
+				{"etc", 0o755, true, nil, nil},
+				{overwriteFilename, 0o755, false, []byte("extra long I am here"), nil},
+			})
+			require.NoError(t, second.InstallPackages(context.Background(), nil, []InstallablePackage{fp2}))
+
+			actual, err := src.ReadFile(overwriteFilename)
+			require.NoError(t, err, "error reading %s", overwriteFilename)
+			require.Equal(t, "extra long I am here", string(actual))
+
+			checkDuplicateIDBEntries(t, second)
+			installed, err := second.GetInstalled()
+			require.NoError(t, err)
+			owners := map[string]string{}
+			for _, pkg := range installed {
+				for _, f := range pkg.Files {
+					if f.Typeflag != tar.TypeDir {
+						owners[f.Name] = pkg.Name
+					}
+				}
+			}
+			require.Equal(t, "libfoo2", owners[overwriteFilename])
+			require.Equal(t, "libfoo1", owners["etc/kept"])
+		})
 	})
 }
 
@@ -325,12 +553,256 @@ func checkDuplicateIDBEntries(t *testing.T, apk *APK) {
 	}
 
 	if errored {
-		b, err := apk.fs.ReadFile(installedFilePath)
+		b, err := apk.fs.ReadFile(apk.installedFilePath())
 		require.NoError(t, err)
 		t.Logf("idb contents:\n%s", b)
 	}
 }
 
+// testCreateTarWithLinks is testCreateTarForPackage, adding a hardlink to its target after
+// the entries, or before them with first.
+func testCreateTarWithLinks(entries []testDirEntry, links map[string]string, first bool) io.Reader {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	writeLinks := func() {
+		for name, target := range links {
+			if err := tw.WriteHeader(&tar.Header{Name: name, Linkname: target, Typeflag: tar.TypeLink, Mode: 0o755}); err != nil {
+				panic(err)
+			}
+		}
+	}
+	if first {
+		writeLinks()
+	}
+	if err := writeFiles(tw, entries); err != nil {
+		panic(err)
+	}
+	if !first {
+		writeLinks()
+	}
+
+	tw.Close()
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestInstallAPKFilesHardlinks(t *testing.T) {
+	testEachBackend(t, testInstallAPKFilesHardlinks)
+}
+
+func testInstallAPKFilesHardlinks(t *testing.T, newAPK func() (*APK, apkfs.FullFS, error)) {
+	entries := []testDirEntry{
+		{"usr", 0o755, true, nil, nil},
+		{"usr/bin", 0o755, true, nil, nil},
+		{"usr/bin/coreutils", 0o755, false, []byte("coreutils"), nil},
+	}
+	sum := sha1.Sum([]byte("coreutils")) //nolint:gosec
+	links := map[string]string{"usr/bin/ls": "usr/bin/coreutils", "usr/bin/cat": "usr/bin/coreutils"}
+
+	check := func(t *testing.T, apk *APK, headers []tar.Header, pkg *Package) {
+		t.Helper()
+		headerMap := map[string]tar.Header{}
+		for _, h := range headers {
+			headerMap[h.Name] = h
+		}
+		for name := range links {
+			h, ok := headerMap[name]
+			require.True(t, ok, "hardlink %s not found in headers", name)
+			require.Equal(t, tar.TypeLink, rune(h.Typeflag))
+			require.Equal(t, Checksum(sum[:]).String(), h.PAXRecords[paxRecordsChecksumKey])
+			actual, err := apk.fs.ReadFile(name)
+			require.NoError(t, err)
+			require.Equal(t, []byte("coreutils"), actual)
+			require.Equal(t, pkg, apk.installedFiles[name])
+		}
+	}
+
+	for _, first := range []bool{false, true} {
+		t.Run(fmt.Sprintf("same package, links first %v", first), func(t *testing.T) {
+			apk, _, err := newAPK()
+			require.NoError(t, err)
+			pkg := &Package{Name: "coreutils"}
+			headers, err := apk.installAPKFiles(context.Background(), testCreateTarWithLinks(entries, links, first), pkg)
+			require.NoError(t, err)
+			require.Len(t, headers, len(entries)+len(links))
+			check(t, apk, headers, pkg)
+
+			// The link shares its target, rather than being a copy of it.
+			require.NoError(t, apk.fs.WriteFile("usr/bin/coreutils", []byte("changed"), 0o755))
+			actual, err := apk.fs.ReadFile("usr/bin/ls")
+			require.NoError(t, err)
+			require.Equal(t, []byte("changed"), actual)
+		})
+	}
+
+	t.Run("target in another package", func(t *testing.T) {
+		apk, _, err := newAPK()
+		require.NoError(t, err)
+		_, err = apk.installAPKFiles(context.Background(), testCreateTarForPackage(entries), &Package{Name: "coreutils"})
+		require.NoError(t, err)
+
+		pkg := &Package{Name: "coreutils-links"}
+		headers, err := apk.installAPKFiles(context.Background(), testCreateTarWithLinks(nil, links, false), pkg)
+		require.NoError(t, err)
+		require.Len(t, headers, len(links))
+		check(t, apk, headers, pkg)
+
+		// Installing the same links again keeps them.
+		headers, err = apk.installAPKFiles(context.Background(), testCreateTarWithLinks(nil, links, false), &Package{Name: "other"})
+		require.NoError(t, err)
+		require.Len(t, headers, len(links))
+		require.Equal(t, pkg, apk.installedFiles["usr/bin/ls"])
+	})
+
+	t.Run("conflicting file", func(t *testing.T) {
+		apk, _, err := newAPK()
+		require.NoError(t, err)
+		_, err = apk.installAPKFiles(context.Background(), testCreateTarForPackage(append(entries,
+			testDirEntry{"usr/bin/ls", 0o755, false, []byte("ls"), nil})), &Package{Name: "busybox"})
+		require.NoError(t, err)
+
+		_, err = apk.installAPKFiles(context.Background(), testCreateTarWithLinks(nil, links, false), &Package{Name: "coreutils"})
+		require.ErrorContains(t, err, "owned by busybox")
+
+		pkg := &Package{Name: "coreutils", Replaces: []string{"busybox"}}
+		headers, err := apk.installAPKFiles(context.Background(), testCreateTarWithLinks(nil, links, false), pkg)
+		require.NoError(t, err)
+		check(t, apk, headers, pkg)
+	})
+
+	t.Run("missing target", func(t *testing.T) {
+		apk, _, err := newAPK()
+		require.NoError(t, err)
+		_, err = apk.installAPKFiles(context.Background(), testCreateTarWithLinks(entries[:2], links, false), &Package{Name: "coreutils"})
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("installed db", func(t *testing.T) {
+		apk, _, err := newAPK()
+		require.NoError(t, err)
+		pkg := &Package{Name: "coreutils", Version: "1.0-r0"}
+		headers, err := apk.installAPKFiles(context.Background(), testCreateTarWithLinks(entries, links, true), pkg)
+		require.NoError(t, err)
+		require.NoError(t, apk.addInstalledPackage(pkg, headers))
+
+		installed, err := apk.GetInstalled()
+		require.NoError(t, err)
+		last := installed[len(installed)-1]
+		require.Equal(t, "coreutils", last.Name)
+		names := map[string]string{}
+		for _, f := range last.Files {
+			names[f.Name] = f.PAXRecords[paxRecordsChecksumKey]
+		}
+		for name := range links {
+			require.Contains(t, names, name)
+			require.Equal(t, names["usr/bin/coreutils"], names[name])
+		}
+	})
+}
+
+func TestInstallPackagesConcurrency(t *testing.T) {
+	// serve serves the fake packages from a server that holds each request for a while,
+	// recording how many it held at the same time, and fails the request for broken.
+	serve := func(t *testing.T, pkgs []InstallablePackage, broken string) (served []InstallablePackage, maxInFlight func() int) {
+		var (
+			mu            sync.Mutex
+			inFlight, max int
+		)
+		files := map[string]string{}
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			inFlight++
+			if inFlight > max {
+				max = inFlight
+			}
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+			}()
+
+			name := filepath.Base(r.URL.Path)
+			if name == broken {
+				http.Error(w, "broken", http.StatusInternalServerError)
+				return
+			}
+			if broken != "" {
+				// Wait to be cancelled by the failure of broken.
+				select {
+				case <-r.Context().Done():
+				case <-time.After(10 * time.Second):
+					t.Errorf("fetching %s was not cancelled", name)
+				}
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+			http.ServeFile(w, r, files[name])
+		}))
+		t.Cleanup(ts.Close)
+
+		for _, pkg := range pkgs {
+			tp := pkg.(*testPackage)
+			files[tp.pkg.Name] = tp.file
+			served = append(served, &testPackage{pkg: tp.pkg, file: ts.URL + "/repo/" + tp.pkg.Name, checksum: tp.checksum})
+		}
+		return served, func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return max
+		}
+	}
+	fakePackages := func(t *testing.T) []InstallablePackage {
+		var pkgs []InstallablePackage
+		for i := 0; i < 6; i++ {
+			// Each package overwrites the file of the one before, so the last one wins if
+			// they are installed in order.
+			pkgs = append(pkgs, fakePackage(t, &Package{Name: fmt.Sprintf("pkg%d", i), Origin: "same"}, []testDirEntry{
+				{"etc", 0o755, true, nil, nil},
+				{"etc/shared", 0o644, false, []byte(fmt.Sprintf("from pkg%d", i)), nil},
+			}))
+		}
+		return pkgs
+	}
+
+	t.Run("limit", func(t *testing.T) {
+		a, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		a.ignoreSignatures = true
+		a.allowInsecureHTTP = true
+		a.maxPackageConcurrency = 2
+		pkgs, maxInFlight := serve(t, fakePackages(t), "")
+		a.SetClient(&http.Client{})
+
+		require.NoError(t, a.InstallPackages(context.Background(), nil, pkgs))
+		require.Equal(t, 2, maxInFlight())
+		b, err := src.ReadFile("etc/shared")
+		require.NoError(t, err)
+		require.Equal(t, "from pkg5", string(b))
+	})
+
+	t.Run("failure cancels the others", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		a.ignoreSignatures = true
+		a.allowInsecureHTTP = true
+		pkgs, _ := serve(t, fakePackages(t), "pkg1")
+		a.SetClient(&http.Client{})
+
+		err = a.InstallPackages(context.Background(), nil, pkgs)
+		require.ErrorContains(t, err, "pkg1")
+	})
+
+	t.Run("option", func(t *testing.T) {
+		_, err := New(WithMaxPackageConcurrency(0))
+		require.Error(t, err)
+		a, err := New(WithMaxPackageConcurrency(8))
+		require.NoError(t, err)
+		require.Equal(t, 8, a.packageConcurrency())
+		require.Equal(t, defaultMaxPackageConcurrency, (&APK{}).packageConcurrency())
+	})
+}
+
 type testPackage struct {
 	file     string
 	pkg      *Package
@@ -416,7 +888,7 @@ func fakePackage(t *testing.T, pkg *Package, entries []testDirEntry) Installable
 	return &testPackage{
 		pkg:      pkg,
 		file:     f.Name(),
-		checksum: base64.StdEncoding.EncodeToString(h.Sum(nil)),
+		checksum: "Q1" + base64.StdEncoding.EncodeToString(h.Sum(nil)),
 	}
 }
 
@@ -497,5 +969,172 @@ replaces = {{ $dep }}
 {{- if .ProviderPriority }}
 provider_priority = {{ .Dependencies.ProviderPriority }}
 {{- end }}
+{{- if .ReplacesPriority }}
+replaces_priority = {{ .ReplacesPriority }}
+{{- end }}
 datahash = {{.DataHash}}
 `
+
+func TestInstallTimesAndXattrs(t *testing.T) {
+	mtime := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	src := apkfs.NewMemFS()
+	require.NoError(t, src.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, src.WriteFile("usr/bin/ping", []byte("ping"), 0o755))
+	require.NoError(t, src.SetXattr("usr/bin/ping", "security.capability", []byte("cap_net_raw")))
+	builder := &APKBuilder{
+		Info:            &PkgInfo{Name: "ping", Version: "1.0-r0", Arch: "x86_64"},
+		Source:          src,
+		SourceDateEpoch: mtime,
+	}
+	var buf bytes.Buffer
+	pkg, err := builder.Build(context.Background(), &buf)
+	require.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "ping.apk")
+	require.NoError(t, os.WriteFile(file, buf.Bytes(), 0o644))
+
+	a, dst, err := testGetTestAPK()
+	require.NoError(t, err)
+	a.ignoreSignatures = true
+	require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{
+		&testPackage{pkg: pkg, file: file, checksum: "Q1" + base64.StdEncoding.EncodeToString(pkg.Checksum)},
+	}))
+
+	for _, name := range []string{"usr/bin", "usr/bin/ping"} {
+		fi, err := dst.Stat(name)
+		require.NoError(t, err)
+		require.True(t, fi.ModTime().Equal(mtime), "%s should have mtime %s, has %s", name, mtime, fi.ModTime())
+	}
+	capability, err := dst.GetXattr("usr/bin/ping", "security.capability")
+	require.NoError(t, err)
+	require.Equal(t, "cap_net_raw", string(capability))
+
+	// and back out into a layer
+	tctx, err := tarball.NewContext(tarball.WithPreserveTimes(true))
+	require.NoError(t, err)
+	var layer bytes.Buffer
+	require.NoError(t, tctx.WriteTar(context.Background(), &layer, dst, dst))
+	tr := tar.NewReader(&layer)
+	var found bool
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		if hdr.Name != "usr/bin/ping" {
+			continue
+		}
+		found = true
+		require.True(t, hdr.ModTime.Equal(mtime), "layer should have mtime %s, has %s", mtime, hdr.ModTime)
+		require.Equal(t, "cap_net_raw", hdr.PAXRecords["SCHILY.xattr.security.capability"])
+	}
+	require.True(t, found, "usr/bin/ping should be in the layer")
+}
+
+func TestInstallMismatchedEntries(t *testing.T) {
+	ctx := context.Background()
+	// pkg builds a package of the files of build, which can have symlinks unlike fstest.MapFS
+	pkg := func(t *testing.T, info *PkgInfo, build func(apkfs.FullFS)) InstallablePackage {
+		info.Arch = "x86_64"
+		src := apkfs.NewMemFS()
+		build(src)
+		return triggerPackage(t, info, src, nil)
+	}
+	install := func(t *testing.T, a *APK, pkgs ...InstallablePackage) error {
+		return a.InstallPackages(ctx, nil, pkgs)
+	}
+	mode := func(t *testing.T, a *APK, name string) fs.FileMode {
+		fi, err := a.fs.Lstat(name)
+		require.NoError(t, err, "error statting %s", name)
+		return fi.Mode().Type()
+	}
+	withLink := func(dir bool) func(apkfs.FullFS) {
+		return func(f apkfs.FullFS) {
+			require.NoError(t, f.MkdirAll("usr/lib/data", 0o755))
+			require.NoError(t, f.WriteFile("usr/lib/data/a", []byte("a"), 0o644))
+			if dir {
+				require.NoError(t, f.MkdirAll("usr/lib/foo", 0o755))
+				require.NoError(t, f.WriteFile("usr/lib/foo/b", []byte("b"), 0o644))
+			} else {
+				require.NoError(t, f.Symlink("data", "usr/lib/foo"))
+			}
+		}
+	}
+
+	t.Run("replaced symlink becomes a directory", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		require.NoError(t, install(t, a, pkg(t, &PkgInfo{Name: "foo-compat", Version: "1.0-r0"}, withLink(false))))
+		require.Equal(t, os.ModeSymlink, mode(t, a, "usr/lib/foo"))
+
+		foo := pkg(t, &PkgInfo{Name: "foo", Version: "1.0-r0", Replaces: []string{"foo-compat"}}, func(f apkfs.FullFS) {
+			require.NoError(t, f.MkdirAll("usr/lib/foo", 0o755))
+			require.NoError(t, f.WriteFile("usr/lib/foo/b", []byte("b"), 0o644))
+		})
+		require.NoError(t, install(t, a, foo))
+		require.Equal(t, os.ModeDir, mode(t, a, "usr/lib/foo"))
+		require.Equal(t, fs.FileMode(0), mode(t, a, "usr/lib/foo/b"))
+		_, err = a.fs.Lstat("usr/lib/data/b")
+		require.ErrorIs(t, err, os.ErrNotExist, "file should not be written through the old symlink")
+	})
+
+	t.Run("upgraded symlink becomes a directory", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		require.NoError(t, install(t, a, pkg(t, &PkgInfo{Name: "foo", Version: "1.0-r0"}, withLink(false))))
+		require.NoError(t, install(t, a, pkg(t, &PkgInfo{Name: "foo", Version: "2.0-r0"}, withLink(true))))
+		require.Equal(t, os.ModeDir, mode(t, a, "usr/lib/foo"))
+		_, err = a.fs.Lstat("usr/lib/data/b")
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("upgraded directory becomes a symlink", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		require.NoError(t, install(t, a, pkg(t, &PkgInfo{Name: "foo", Version: "1.0-r0"}, withLink(true))))
+		require.NoError(t, install(t, a, pkg(t, &PkgInfo{Name: "foo", Version: "2.0-r0"}, withLink(false))))
+		require.Equal(t, os.ModeSymlink, mode(t, a, "usr/lib/foo"))
+		target, err := a.fs.Readlink("usr/lib/foo")
+		require.NoError(t, err)
+		require.Equal(t, "data", target)
+	})
+
+	t.Run("replaced directory that is not empty", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		require.NoError(t, install(t, a, pkg(t, &PkgInfo{Name: "foo", Version: "1.0-r0"}, withLink(true))))
+		compat := pkg(t, &PkgInfo{Name: "foo-compat", Version: "1.0-r0", Replaces: []string{"foo"}}, withLink(false))
+		require.ErrorContains(t, install(t, a, compat), "directory is not empty")
+	})
+
+	t.Run("merged usr symlink is kept", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		require.NoError(t, install(t, a, pkg(t, &PkgInfo{Name: "baselayout", Version: "1.0-r0"}, func(f apkfs.FullFS) {
+			require.NoError(t, f.MkdirAll("usr/lib", 0o755))
+			require.NoError(t, f.Symlink("usr/lib", "lib32"))
+		})))
+		require.NoError(t, install(t, a, pkg(t, &PkgInfo{Name: "libc", Version: "1.0-r0"}, func(f apkfs.FullFS) {
+			require.NoError(t, f.MkdirAll("lib32", 0o755))
+			require.NoError(t, f.WriteFile("lib32/libc.so", []byte("libc"), 0o755))
+		})))
+		require.Equal(t, os.ModeSymlink, mode(t, a, "lib32"))
+		b, err := a.fs.ReadFile("usr/lib/libc.so")
+		require.NoError(t, err)
+		require.Equal(t, "libc", string(b))
+	})
+
+	t.Run("symlink of another package", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		require.NoError(t, install(t, a, pkg(t, &PkgInfo{Name: "foo", Version: "1.0-r0"}, withLink(false))))
+		bar := pkg(t, &PkgInfo{Name: "bar", Version: "1.0-r0"}, func(f apkfs.FullFS) {
+			require.NoError(t, f.MkdirAll("usr/lib", 0o755))
+			require.NoError(t, f.WriteFile("usr/lib/foo", []byte("foo"), 0o644))
+		})
+		var conflict *FileConflictError
+		require.ErrorAs(t, install(t, a, bar), &conflict)
+		require.Equal(t, "foo", conflict.Owner)
+		require.Equal(t, os.ModeSymlink, mode(t, a, "usr/lib/foo"))
+	})
+}
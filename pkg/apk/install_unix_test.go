@@ -0,0 +1,88 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+	"github.com/chainguard-dev/go-apk/pkg/tarball"
+)
+
+func TestInstallRootFS(t *testing.T) {
+	dir := t.TempDir()
+	rfs, err := apkfs.RootFS(dir)
+	require.NoError(t, err)
+	a, err := New(WithFS(rfs), WithIgnoreMknodErrors(true), WithIgnoreSignatureVerification(true))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(context.Background()))
+	require.NoError(t, a.SetWorld(context.Background(), []string{"rootfs"}))
+
+	mtime := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	builder := &APKBuilder{
+		Info: &PkgInfo{Name: "rootfs", Version: "1.0-r0", Arch: "x86_64"},
+		Source: fstest.MapFS{
+			"usr":          {Mode: 0o755 | fs.ModeDir},
+			"usr/bin":      {Mode: 0o755 | fs.ModeDir},
+			"usr/bin/suid": {Mode: 0o755 | fs.ModeSetuid, Data: []byte("suid")},
+			"var":          {Mode: 0o755 | fs.ModeDir},
+			"var/tmp":      {Mode: 0o777 | fs.ModeDir | fs.ModeSticky},
+		},
+		SourceDateEpoch: mtime,
+		DataOptions:     []tarball.Option{tarball.WithOverrideUIDGID(1000, 1001)},
+	}
+	var buf bytes.Buffer
+	pkg, err := builder.Build(context.Background(), &buf)
+	require.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "rootfs.apk")
+	require.NoError(t, os.WriteFile(file, buf.Bytes(), 0o644))
+	require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{
+		&testPackage{pkg: pkg, file: file, checksum: "Q1" + base64.StdEncoding.EncodeToString(pkg.Checksum)},
+	}))
+
+	for name, mode := range map[string]fs.FileMode{
+		"usr/bin/suid": 0o755 | fs.ModeSetuid,
+		"usr/bin":      0o755 | fs.ModeDir,
+		"var/tmp":      0o777 | fs.ModeDir | fs.ModeSticky,
+	} {
+		fi, err := os.Lstat(filepath.Join(dir, name))
+		require.NoError(t, err)
+		require.Equal(t, mode, fi.Mode(), "mode of %s", name)
+		require.True(t, fi.ModTime().Equal(mtime), "%s should have mtime %s, has %s", name, mtime, fi.ModTime())
+		if os.Getuid() == 0 {
+			st := fi.Sys().(*syscall.Stat_t)
+			require.Equal(t, uint32(1000), st.Uid, "owner of %s", name)
+			require.Equal(t, uint32(1001), st.Gid, "group of %s", name)
+		}
+	}
+
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Len(t, installed, 1)
+	require.Equal(t, "rootfs", installed[0].Name)
+}
@@ -17,13 +17,13 @@ package apk
 import (
 	"archive/tar"
 	"bufio"
-	"encoding/base64"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -35,67 +35,199 @@ import (
 type InstalledPackage struct {
 	Package
 	Files []*tar.Header
+	// FileFields are what the installed database keeps of the entries of Files that their
+	// headers do not, by name. Entries with nothing more are not in it.
+	FileFields map[string]*InstalledFileFields
+}
+
+// InstalledFileFields are the fields of a file or directory in the installed database that
+// are not in its tar header.
+type InstalledFileFields struct {
+	// XattrsChecksum is the checksum of the xattrs of the entry, the last part of its a: or M:
+	// line.
+	XattrsChecksum string
+	// ExtraFields are the lines after the entry that are not known, in the order they were
+	// read. They are written back after it.
+	ExtraFields []IndexField
 }
 
 // getInstalledPackages get list of installed packages
 func (a *APK) GetInstalled() ([]*InstalledPackage, error) {
-	installedFile, err := a.fs.Open(installedFilePath)
+	installedFile, err := a.fs.Open(a.installedFilePath())
 	if err != nil {
-		return nil, fmt.Errorf("could not open installed file in %s at %s: %w", a.fs, installedFilePath, err)
+		return nil, fmt.Errorf("could not open installed file in %s at %s: %w", a.fs, a.installedFilePath(), err)
 	}
 	defer installedFile.Close()
 	return parseInstalled(installedFile)
 }
 
-// addInstalledPackage add a package to the list of installed packages
+// addInstalledPackage add a package to the list of installed packages, see addInstalledPackages.
 func (a *APK) addInstalledPackage(pkg *Package, files []tar.Header) error {
-	// be sure to open the file in append mode so we add to the end
-	installedFile, err := a.fs.OpenFile(installedFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("could not open installed file at %s: %w", installedFilePath, err)
+	return a.addInstalledPackages([]*InstalledPackage{newInstalledPackage(pkg, files)})
+}
+
+// addInstalledPackages adds pkgs to the list of installed packages, each in place of the
+// installed version of it, if any, and disowns the files that the packages already installed
+// have lost to them, so that an install only changes the installed database once.
+func (a *APK) addInstalledPackages(pkgs []*InstalledPackage) error {
+	installed, err := a.GetInstalled()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("could not read installed file at %s: %w", a.installedFilePath(), err)
 	}
-	defer installedFile.Close()
+	// before the new entries are added, which own their files
+	if !a.disownReplacedFiles(installed) && len(pkgs) == 0 {
+		return nil
+	}
+	// the packages are added to the end, and the whole file replaced at once
+	for _, pkg := range pkgs {
+		installed = slices.DeleteFunc(installed, func(p *InstalledPackage) bool { return p.Name == pkg.Name })
+	}
+	return a.writeInstalledFile(append(installed, pkgs...))
+}
+
+// newInstalledPackage returns the installed database entry of pkg, installed with files.
+func newInstalledPackage(pkg *Package, files []tar.Header) *InstalledPackage {
+	entry := &InstalledPackage{Package: *pkg}
+	for i := range files {
+		entry.Files = append(entry.Files, &files[i])
+	}
+	return entry
+}
+
+// writeInstalled returns the installed database of pkgs, as parseInstalled reads it.
+func writeInstalled(pkgs []*InstalledPackage) ([]byte, error) {
+	var b []byte
+	for _, pkg := range pkgs {
+		lines, err := installedEntry(pkg)
+		if err != nil {
+			return nil, fmt.Errorf("unable to write installed entry of %s: %w", pkg.Name, err)
+		}
+		b = append(b, []byte(strings.Join(lines, "\n")+"\n\n")...)
+	}
+	return b, nil
+}
 
+// installedEntry returns the lines of the entry of pkg in the installed database, with its
+// files sorted by directory.
+func installedEntry(pkg *InstalledPackage) ([]string, error) {
+	files := make([]tar.Header, 0, len(pkg.Files))
+	for _, f := range pkg.Files {
+		files = append(files, *f)
+	}
 	// sort the files by directory
 	sortedFiles := sortTarHeaders(files)
 	// package lines
-	pkgLines := PackageToInstalled(pkg)
+	pkgLines := PackageToInstalled(&pkg.Package)
 	// file lines
 	for _, f := range sortedFiles {
-		perm := f.Mode & 0777
+		perm := f.Mode & 0o7777
 		user := f.Uid
 		group := f.Gid
+		fields := pkg.FileFields[f.Name]
+		if fields == nil {
+			fields = &InstalledFileFields{}
+		}
+		xattrsChecksum := fields.XattrsChecksum
+		if xattrsChecksum != "" {
+			xattrsChecksum = ":" + xattrsChecksum
+		}
 
 		if f.Typeflag == tar.TypeDir {
 			dirName := strings.TrimSuffix(f.Name, fmt.Sprintf("%c", filepath.Separator))
 			pkgLines = append(pkgLines, fmt.Sprintf("F:%s", dirName))
-			if perm != 0o755 || user != 0 || group != 0 {
-				pkgLines = append(pkgLines, fmt.Sprintf("M:%d:%d:%04o", user, group, perm))
+			if perm != 0o755 || user != 0 || group != 0 || xattrsChecksum != "" {
+				pkgLines = append(pkgLines, fmt.Sprintf("M:%d:%d:%o%s", user, group, perm, xattrsChecksum))
 			}
 		} else {
 			pkgLines = append(pkgLines, fmt.Sprintf("R:%s", filepath.Base(f.Name)))
-			if perm != 0o644 || user != 0 || group != 0 {
-				pkgLines = append(pkgLines, fmt.Sprintf("a:%d:%d:%04o", user, group, perm))
+			if perm != 0o644 || user != 0 || group != 0 || xattrsChecksum != "" {
+				pkgLines = append(pkgLines, fmt.Sprintf("a:%d:%d:%o%s", user, group, perm, xattrsChecksum))
 			}
-			if f.PAXRecords != nil {
-				if checksum := f.PAXRecords[paxRecordsChecksumKey]; checksum != "" {
-					if !strings.HasPrefix(checksum, "Q1") {
-						hexsum, err := hex.DecodeString(checksum)
-						if err != nil {
-							return err
-						}
-						checksum = "Q1" + base64.StdEncoding.EncodeToString(hexsum)
-					}
-					pkgLines = append(pkgLines, fmt.Sprintf("Z:%s", checksum))
+			if checksum := f.PAXRecords[paxRecordsChecksumKey]; checksum != "" {
+				sum, err := ParseChecksum(checksum)
+				if err != nil {
+					return nil, err
 				}
+				pkgLines = append(pkgLines, fmt.Sprintf("Z:%s", sum))
 			}
 		}
+		for _, field := range fields.ExtraFields {
+			pkgLines = append(pkgLines, fmt.Sprintf("%s:%s", field.Key, field.Value))
+		}
 	}
-	// write to installed file
-	b := []byte(strings.Join(pkgLines, "\n") + "\n\n")
-	if _, err := installedFile.Write(b); err != nil {
+	return pkgLines, nil
+}
+
+// fileOwner returns the package that owns the file at path, whether it was installed by a or
+// was already in the installed database.
+func (a *APK) fileOwner(path string) (*Package, bool) {
+	if pkg, ok := a.installedFiles[path]; ok {
+		return pkg, true
+	}
+	if a.previousOwners != nil {
+		return nil, false
+	}
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, false
+	}
+	a.previousOwners = map[string]*Package{}
+	for _, pkg := range installed {
+		for _, f := range pkg.Files {
+			if _, ok := a.installedFiles[f.Name]; f.Typeflag == tar.TypeDir || ok {
+				continue
+			}
+			a.installedFiles[f.Name] = &pkg.Package
+			a.previousOwners[f.Name] = &pkg.Package
+		}
+	}
+	pkg, ok := a.installedFiles[path]
+	return pkg, ok
+}
+
+// disownReplacedFiles removes the files that packages of installed have lost to newly
+// installed packages from their entries, so that each file has a single owner. It returns
+// whether any were removed.
+func (a *APK) disownReplacedFiles(installed []*InstalledPackage) bool {
+	disowned := map[string]map[string]bool{}
+	for path, previous := range a.previousOwners {
+		if a.installedFiles[path] == previous {
+			continue
+		}
+		if disowned[previous.Name] == nil {
+			disowned[previous.Name] = map[string]bool{}
+		}
+		disowned[previous.Name][path] = true
+		delete(a.previousOwners, path)
+	}
+	if len(disowned) == 0 {
+		return false
+	}
+
+	for _, pkg := range installed {
+		files := disowned[pkg.Name]
+		if files == nil {
+			continue
+		}
+		pkg.Files = slices.DeleteFunc(pkg.Files, func(f *tar.Header) bool {
+			return f.Typeflag != tar.TypeDir && files[f.Name]
+		})
+		for path := range files {
+			delete(pkg.FileFields, path)
+		}
+	}
+	return true
+}
+
+// writeInstalledFile replaces the installed database with the entries of pkgs.
+func (a *APK) writeInstalledFile(pkgs []*InstalledPackage) error {
+	b, err := writeInstalled(pkgs)
+	if err != nil {
 		return err
 	}
+	if err := a.replaceFile(a.installedFilePath(), b, 0o644); err != nil {
+		return fmt.Errorf("could not write installed file at %s: %w", a.installedFilePath(), err)
+	}
 	return nil
 }
 
@@ -113,7 +245,9 @@ func (a *APK) isInstalledPackage(pkg string) (bool, error) {
 	return false, nil
 }
 
-// updateScriptsTar insert the scripts into the tarball
+// updateScriptsTar adds the scripts of the control section of pkg to scripts.tar, as apk does:
+// only those apk knows, in its order, named like scriptsTarName. The mtime of each is
+// sourceDateEpoch if it is set.
 func (a *APK) updateScriptsTar(pkg *Package, controlTarGz io.Reader, sourceDateEpoch *time.Time) error {
 	gz, err := gzip.NewReader(controlTarGz)
 	if err != nil {
@@ -121,25 +255,8 @@ func (a *APK) updateScriptsTar(pkg *Package, controlTarGz io.Reader, sourceDateE
 	}
 	defer gz.Close()
 	tr := tar.NewReader(gz)
-	fi, err := a.fs.Stat(scriptsFilePath)
-	if err != nil {
-		return fmt.Errorf("unable to stat scripts file: %w", err)
-	}
-	scripts, err := a.fs.OpenFile(scriptsFilePath, os.O_RDWR, 0)
-	if err != nil {
-		return fmt.Errorf("unable to open scripts file %s: %w", scriptsFilePath, err)
-	}
-	defer scripts.Close()
-
-	// only need to rewind if the file has tar in it
-	if fi.Size() >= 1024 {
-		if _, err = scripts.Seek(-1024, io.SeekEnd); err != nil {
-			return fmt.Errorf("could not seek to end of tar file: %w", err)
-		}
-	}
 
-	tw := tar.NewWriter(scripts)
-	defer tw.Close()
+	scripts := map[string]scriptsTarEntry{}
 	for {
 		header, err := tr.Next()
 		if errors.Is(err, io.EOF) {
@@ -148,76 +265,64 @@ func (a *APK) updateScriptsTar(pkg *Package, controlTarGz io.Reader, sourceDateE
 		if err != nil {
 			return err
 		}
-
-		// ignore .PKGINFO as it is not a script
-		if header.Name == ".PKGINFO" { //nolint:goconst
+		// .PKGINFO, and anything else apk does not run, is not a script
+		if !slices.Contains(scriptTypes, header.Name) {
 			continue
 		}
-
-		origName := header.Name
-		header.Name = fmt.Sprintf("%s-%s.Q1%s%s", pkg.Name, pkg.Version, base64.StdEncoding.EncodeToString(pkg.Checksum), origName)
-
-		// zero out timestamps for reproducibility
-		if sourceDateEpoch != nil {
-			header.ModTime = *sourceDateEpoch
-			// we do not use AccessTime or ChangeTime because these are incompatible with USTar, which is required for apk.
-			// See https://pkg.go.dev/archive/tar#Format for the capabilities of each format.
-			// Setting them to time.Time{} or the epoch will cause them to be ignored.
-			header.AccessTime = time.Time{}
-			header.ChangeTime = time.Time{}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("unable to read script %s: %w", header.Name, err)
 		}
-
-		if err := tw.WriteHeader(header); err != nil {
-			return fmt.Errorf("unable to write scripts header for %s: %w", header.Name, err)
+		mtime := header.ModTime
+		if sourceDateEpoch != nil {
+			mtime = *sourceDateEpoch
 		}
-		if _, err := io.CopyN(tw, tr, header.Size); err != nil {
-			return fmt.Errorf("unable to write content for %s: %w", header.Name, err)
+		scripts[header.Name] = scriptsTarEntry{name: scriptsTarName(pkg, header.Name), data: data, mtime: mtime}
+	}
+	entries := make([]scriptsTarEntry, 0, len(scripts))
+	for _, name := range scriptTypes {
+		if e, ok := scripts[name]; ok {
+			entries = append(entries, e)
 		}
 	}
-	return nil
+	if len(entries) == 0 {
+		return nil
+	}
+	return a.appendScriptsTar(entries)
 }
 
 // readScriptsTar returns a reader for the current scripts.tar. It is up to the caller to close it.
 func (a *APK) readScriptsTar() (io.ReadCloser, error) {
-	return a.fs.Open(scriptsFilePath)
+	return a.fs.Open(a.scriptsFilePath())
 }
 
 // TODO: We should probably parse control section on the first pass and reuse it.
-func (a *APK) controlValue(controlTarGz io.Reader, want string) ([]string, error) {
+func (a *APK) controlPkgInfo(controlTarGz io.Reader) (*PkgInfo, error) {
 	gz, err := gzip.NewReader(controlTarGz)
 	if err != nil {
 		return nil, fmt.Errorf("unable to gunzip control tar file: %w", err)
 	}
 	defer gz.Close()
 
-	mapping, err := controlValue(gz, want)
-	if err != nil {
-		return nil, err
-	}
-
-	values, ok := mapping[want]
-	if !ok {
-		return []string{}, nil
-	}
-	return values, nil
+	return pkgInfoFromControl(gz)
 }
 
 // updateTriggers insert the triggers into the triggers file
 func (a *APK) updateTriggers(pkg *Package, controlTarGz io.Reader) error {
-	triggers, err := a.fs.OpenFile(triggersFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0)
+	triggers, err := a.fs.OpenFile(a.triggersFilePath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0)
 	if err != nil {
-		return fmt.Errorf("unable to open triggers file %s: %w", triggersFilePath, err)
+		return fmt.Errorf("unable to open triggers file %s: %w", a.triggersFilePath(), err)
 	}
 	defer triggers.Close()
 
-	values, err := a.controlValue(controlTarGz, "triggers")
+	info, err := a.controlPkgInfo(controlTarGz)
 	if err != nil {
 		return fmt.Errorf("updating triggers for %s: %w", pkg.Name, err)
 	}
 
-	for _, value := range values {
-		if _, err := triggers.Write([]byte(fmt.Sprintf("%s %s\n", base64.StdEncoding.EncodeToString(pkg.Checksum), value))); err != nil {
-			return fmt.Errorf("unable to write triggers file %s: %w", triggersFilePath, err)
+	if len(info.Triggers) != 0 {
+		if _, err := triggers.Write([]byte(fmt.Sprintf("%s %s\n", pkg.Checksum.Base64(), strings.Join(info.Triggers, " ")))); err != nil {
+			return fmt.Errorf("unable to write triggers file %s: %w", a.triggersFilePath(), err)
 		}
 	}
 
@@ -226,7 +331,7 @@ func (a *APK) updateTriggers(pkg *Package, controlTarGz io.Reader) error {
 
 // readTriggers returns a reader for the current triggers. It is up to the caller to close it.
 func (a *APK) readTriggers() (io.ReadCloser, error) {
-	return a.fs.Open(triggersFilePath)
+	return a.fs.Open(a.triggersFilePath())
 }
 
 // parseInstalled parses an installed file. It returns the installed packages.
@@ -242,6 +347,18 @@ func parseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 	pkg := &InstalledPackage{}
 	linenr := 1
 	var lastDir, lastFile *tar.Header
+	// fileFields returns the fields of the entry that the line is about
+	fileFields := func(header *tar.Header) *InstalledFileFields {
+		if pkg.FileFields == nil {
+			pkg.FileFields = map[string]*InstalledFileFields{}
+		}
+		fields, ok := pkg.FileFields[header.Name]
+		if !ok {
+			fields = &InstalledFileFields{}
+			pkg.FileFields[header.Name] = fields
+		}
+		return fields
+	}
 
 	for indexScanner.Scan() {
 		line := indexScanner.Text()
@@ -285,6 +402,12 @@ func parseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 			pkg.Provides = strings.Split(val, " ")
 		case "r":
 			pkg.Replaces = strings.Split(val, " ")
+		case "q":
+			priority, err := strconv.ParseUint(val, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse replaces priority field %s: %w", val, err)
+			}
+			pkg.ReplacesPriority = priority
 		case "c":
 			pkg.RepoCommit = val
 		case "t":
@@ -315,14 +438,11 @@ func parseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 			}
 			pkg.ProviderPriority = priority
 		case "C":
-			// Handle SHA1 checksums:
-			if strings.HasPrefix(val, "Q1") {
-				checksum, err := base64.StdEncoding.DecodeString(val[2:])
-				if err != nil {
-					return nil, err
-				}
-				pkg.Checksum = checksum
+			checksum, err := ParseChecksum(val)
+			if err != nil {
+				return nil, err
 			}
+			pkg.Checksum = checksum
 		case "F":
 			lastDir = &tar.Header{
 				Name:     val,
@@ -338,13 +458,16 @@ func parseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 			if lastDir == nil {
 				return nil, fmt.Errorf("cannot parse line %d: no directory specified when setting permissions", linenr)
 			}
-			uid, gid, perms, err := parseInstalledPerms(val)
+			uid, gid, perms, xattrsChecksum, err := parseInstalledPerms(val)
 			if err != nil {
 				return nil, fmt.Errorf("cannot parse line %d: %w", linenr, err)
 			}
 			lastDir.Uid = uid
 			lastDir.Gid = gid
 			lastDir.Mode = perms
+			if xattrsChecksum != "" {
+				fileFields(lastDir).XattrsChecksum = xattrsChecksum
+			}
 		case "R":
 			fullpath := val
 			if lastDir != nil {
@@ -362,13 +485,34 @@ func parseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 			if lastFile == nil {
 				return nil, fmt.Errorf("cannot parse line %d: no file specified when setting permissions", linenr)
 			}
-			uid, gid, perms, err := parseInstalledPerms(val)
+			uid, gid, perms, xattrsChecksum, err := parseInstalledPerms(val)
 			if err != nil {
 				return nil, fmt.Errorf("cannot parse line %d: %w", linenr, err)
 			}
 			lastFile.Uid = uid
 			lastFile.Gid = gid
 			lastFile.Mode = perms
+			if xattrsChecksum != "" {
+				fileFields(lastFile).XattrsChecksum = xattrsChecksum
+			}
+		case "Z":
+			if lastFile == nil {
+				return nil, fmt.Errorf("cannot parse line %d: no file specified when setting checksum", linenr)
+			}
+			lastFile.PAXRecords = map[string]string{paxRecordsChecksumKey: val}
+		default:
+			// fields that are not known are kept where they are, with the package if they come
+			// before its files, or else with the entry they follow
+			entry := lastFile
+			if entry == nil {
+				entry = lastDir
+			}
+			if entry == nil {
+				pkg.ExtraFields = append(pkg.ExtraFields, IndexField{Key: token, Value: val})
+				break
+			}
+			fields := fileFields(entry)
+			fields.ExtraFields = append(fields.ExtraFields, IndexField{Key: token, Value: val})
 		}
 
 		linenr++
@@ -377,22 +521,28 @@ func parseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 	return packages, nil
 }
 
-func parseInstalledPerms(permString string) (uid, gid int, perms int64, err error) {
+// parseInstalledPerms parses the value of an a: or M: line, uid:gid:mode, which apk follows
+// with :checksum if the entry has xattrs.
+func parseInstalledPerms(permString string) (uid, gid int, perms int64, xattrsChecksum string, err error) {
 	permParts := strings.Split(permString, ":")
-	if len(permParts) != 3 {
-		return 0, 0, 0, fmt.Errorf("invalid permission string did not have 3 parts separated by colon: %s", permString)
+	switch len(permParts) {
+	case 3:
+	case 4:
+		xattrsChecksum = permParts[3]
+	default:
+		return 0, 0, 0, "", fmt.Errorf("invalid permission string did not have 3 or 4 parts separated by colon: %s", permString)
 	}
 	uid, err = strconv.Atoi(permParts[0])
 	if err != nil {
-		return 0, 0, 0, fmt.Errorf("invalid permission string uid was not an integer %s", permString)
+		return 0, 0, 0, "", fmt.Errorf("invalid permission string uid was not an integer %s", permString)
 	}
 	gid, err = strconv.Atoi(permParts[1])
 	if err != nil {
-		return 0, 0, 0, fmt.Errorf("invalid permission string gid was not an integer %s", permString)
+		return 0, 0, 0, "", fmt.Errorf("invalid permission string gid was not an integer %s", permString)
 	}
 	perms, err = strconv.ParseInt(permParts[2], 8, 64)
 	if err != nil {
-		return 0, 0, 0, fmt.Errorf("invalid permission string perms was not an int64 %s", permString)
+		return 0, 0, 0, "", fmt.Errorf("invalid permission string perms was not an int64 %s", permString)
 	}
 	return
 }
@@ -402,82 +552,67 @@ func parseInstalledPerms(permString string) (uid, gid int, perms int64, err erro
 // support lib/apk/db/installed, which lists full paths for directories, but
 // only the basename for the files, so the last directory entry before a file
 // must be the parent in which it sits.
+// The order is that of apk for a package of sorted entries: each directory,
+// then the files in it, then its subdirectories in the same way. Like apk, a
+// directory that has entries but none of its own is added with the default
+// mode, and the files at the top level are under a directory named "".
 func sortTarHeaders(headers []tar.Header) []tar.Header {
 	var (
-		// Create a tree with everything in it, where keys are full directory paths,
-		// values are slice of full paths of children. (Every directory in the tree will
-		// have its own key in the map.)
-		directoryChildren = map[string][]string{}
-
-		all = map[string]tar.Header{}
+		// The headers of the directories, by cleaned name, nil for those that
+		// were not in headers.
+		dirs = map[string]*tar.Header{}
+		// The cleaned names of the subdirectories of each directory, "." being
+		// the top level.
+		subdirs = map[string][]string{}
+		// The headers of the other entries in each directory.
+		files = map[string][]tar.Header{}
 	)
+	var addDir func(name string)
+	addDir = func(name string) {
+		if _, ok := dirs[name]; ok || name == "." {
+			return
+		}
+		dirs[name] = nil
+		parent := filepath.Dir(name)
+		subdirs[parent] = append(subdirs[parent], name)
+		addDir(parent)
+	}
 
 	for _, header := range headers {
 		// Use a cleaned name for map keys to ensure consistency with lookups later.
 		cleanedName := filepath.Clean(header.Name)
-
-		dir := filepath.Dir(cleanedName)
-		directoryChildren[dir] = append(directoryChildren[dir], cleanedName)
-		all[cleanedName] = header
-	}
-
-	// Map the directory entries (the keys in "directoryChildren") to a slice (and
-	// sort them for determinism).
-	var dirEntries = make([]string, 0, len(directoryChildren))
-	for dir := range directoryChildren {
-		dirEntries = append(dirEntries, dir)
-	}
-	sort.Strings(dirEntries)
-
-	// We'll start with top-level directories, and then descend into their children
-	// recursively.
-	var topLevelDirs = make([]string, 0, len(dirEntries))
-	for _, dir := range dirEntries {
-		if filepath.Dir(dir) == "." {
-			topLevelDirs = append(topLevelDirs, dir)
-		}
-	}
-
-	sort.Strings(topLevelDirs)
-
-	sorted := sortChildrenTarHeaders(directoryChildren, all, topLevelDirs)
-	return sorted
-}
-
-func sortChildrenTarHeaders(directoryChildren map[string][]string, all map[string]tar.Header, children []string) []tar.Header {
-	sort.Strings(children)
-
-	// Non-directory type files need to be first.
-	var sorted = make([]tar.Header, 0, len(children))
-	for _, child := range children {
-		header, ok := all[child]
-		if !ok {
+		if header.Typeflag == tar.TypeDir {
+			addDir(cleanedName)
+			if cleanedName != "." {
+				header := header
+				dirs[cleanedName] = &header
+			}
 			continue
 		}
-		if header.Typeflag != tar.TypeDir {
-			sorted = append(sorted, header)
-		}
+		dir := filepath.Dir(cleanedName)
+		addDir(dir)
+		files[dir] = append(files[dir], header)
 	}
 
-	// Then directories.
-	for _, child := range children {
-		header, ok := all[child]
-		if !ok {
-			continue
+	sorted := make([]tar.Header, 0, len(headers))
+	var walk func(dir string)
+	walk = func(dir string) {
+		switch header := dirs[dir]; {
+		case header != nil:
+			sorted = append(sorted, *header)
+		case dir != ".":
+			sorted = append(sorted, tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0o755})
+		case len(files[dir]) != 0:
+			sorted = append(sorted, tar.Header{Name: "", Typeflag: tar.TypeDir, Mode: 0o755})
 		}
-		if header.Typeflag == tar.TypeDir {
-			sorted = append(sorted, header)
-
-			// And their children.
-			children, ok := directoryChildren[child]
-			if !ok || len(children) == 0 {
-				continue
-			}
-
-			sortedChildren := sortChildrenTarHeaders(directoryChildren, all, children)
-			sorted = append(sorted, sortedChildren...)
+		children := files[dir]
+		sort.SliceStable(children, func(i, j int) bool { return children[i].Name < children[j].Name })
+		sorted = append(sorted, children...)
+		sort.Strings(subdirs[dir])
+		for _, subdir := range subdirs[dir] {
+			walk(subdir)
 		}
 	}
-
+	walk(".")
 	return sorted
 }
@@ -24,10 +24,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"strings"
 	"testing"
 	"time"
 
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -68,10 +70,13 @@ func TestAddInstalledPackage(t *testing.T) {
 	a, _, err := testGetTestAPK()
 	require.NoErrorf(t, err, "unable to initialize APK implementation: %v", err)
 	newPkg := &Package{
-		Name:      "testpkg",
-		Version:   "1.0.0",
-		Arch:      "x86_64",
-		BuildTime: time.Now(),
+		Name:             "testpkg",
+		Version:          "1.0.0",
+		Arch:             "x86_64",
+		BuildTime:        time.Now(),
+		InstallIf:        []string{"foo", "bar=1.0"},
+		Replaces:         []string{"baz"},
+		ReplacesPriority: 10,
 	}
 	newFiles := []tar.Header{
 		{Name: "usr", Typeflag: tar.TypeDir, Mode: 0o755},                          // standard perms should not generate extra perms line
@@ -94,8 +99,11 @@ func TestAddInstalledPackage(t *testing.T) {
 	lastPkg := pkgs[len(pkgs)-1]
 	require.Equal(t, newPkg.Name, lastPkg.Name, "expected package name %s, got %s", newPkg.Name, lastPkg.Name)
 	require.Equal(t, newPkg.Version, lastPkg.Version, "expected package version %s, got %s", newPkg.Version, lastPkg.Version)
+	require.Equal(t, newPkg.InstallIf, lastPkg.InstallIf)
+	require.Equal(t, newPkg.Replaces, lastPkg.Replaces)
+	require.Equal(t, newPkg.ReplacesPriority, lastPkg.ReplacesPriority)
 
-	installedFile, err := a.fs.ReadFile(installedFilePath)
+	installedFile, err := a.fs.ReadFile(a.installedFilePath())
 	require.NoError(t, err)
 
 	// The same random checksum from before, converted to what we expect.
@@ -104,6 +112,126 @@ func TestAddInstalledPackage(t *testing.T) {
 	require.Contains(t, str, want)
 }
 
+// TestInstalledGolden writes the packages of an installed database again, which should give
+// the same bytes as were read: those of a database written by apk add, and of one with the
+// fields that it does not have, in the format apk writes them.
+func TestInstalledGolden(t *testing.T) {
+	for _, path := range []string{
+		"testdata/root/lib/apk/db/installed",
+		"testdata/installed/fields",
+	} {
+		t.Run(path, func(t *testing.T) {
+			golden, err := os.ReadFile(path)
+			require.NoError(t, err)
+			pkgs, err := parseInstalled(bytes.NewReader(golden))
+			require.NoError(t, err)
+
+			installed, err := writeInstalled(pkgs)
+			require.NoError(t, err)
+			require.Equal(t, string(golden), string(installed))
+		})
+	}
+}
+
+// TestAddInstalledPackageGolden adds the packages of the installed database written by apk one
+// by one, which should give the same bytes as apk wrote.
+func TestAddInstalledPackageGolden(t *testing.T) {
+	golden, err := os.ReadFile("testdata/root/lib/apk/db/installed")
+	require.NoError(t, err)
+	pkgs, err := parseInstalled(bytes.NewReader(golden))
+	require.NoError(t, err)
+
+	src := apkfs.NewMemFS()
+	require.NoError(t, src.MkdirAll("lib/apk/db", 0o755))
+	a, err := New(WithFS(src))
+	require.NoError(t, err)
+	for _, pkg := range pkgs {
+		files := make([]tar.Header, 0, len(pkg.Files))
+		for _, f := range pkg.Files {
+			files = append(files, *f)
+		}
+		require.NoError(t, a.addInstalledPackage(&pkg.Package, files))
+	}
+	installed, err := src.ReadFile(a.installedFilePath())
+	require.NoError(t, err)
+	require.Equal(t, string(golden), string(installed))
+}
+
+func TestInstalledFields(t *testing.T) {
+	f, err := os.Open("testdata/installed/fields")
+	require.NoError(t, err)
+	pkgs, err := parseInstalled(f)
+	require.NoError(t, err)
+	require.Len(t, pkgs, 2)
+
+	pkg := pkgs[0]
+	require.Equal(t, []string{"iputils-base=20221126-r1", "openrc"}, pkg.InstallIf)
+	require.Equal(t, []string{"iputils-ping"}, pkg.Replaces)
+	require.Equal(t, uint64(10), pkg.ReplacesPriority)
+	require.Equal(t, uint64(100), pkg.ProviderPriority)
+	require.Equal(t, []IndexField{{Key: "s", Value: "testing"}, {Key: "f", Value: "x"}}, pkg.ExtraFields)
+
+	require.Len(t, pkg.Files, 6)
+	require.Equal(t, int64(0o4755), pkg.Files[1].Mode)
+	ping := pkg.Files[2]
+	require.Equal(t, "bin/ping", ping.Name)
+	require.Equal(t, int64(0o755), ping.Mode)
+	require.Equal(t, map[string]string{paxRecordsChecksumKey: "Q1M5eqYrjx/3HbH1KXhuvfqMsPYHs="}, ping.PAXRecords)
+	require.Equal(t, &InstalledFileFields{
+		XattrsChecksum: "Q1vMJPKdBxpwEkIvfbsomff9bOyXI=",
+		ExtraFields:    []IndexField{{Key: "x", Value: "a field that is not known"}},
+	}, pkg.FileFields["bin/ping"])
+	dir := pkg.Files[5]
+	require.Equal(t, "var/lib/iputils", dir.Name)
+	require.Equal(t, 100, dir.Uid)
+	require.Equal(t, 101, dir.Gid)
+	require.Equal(t, int64(0o750), dir.Mode)
+	require.Nil(t, dir.PAXRecords)
+	require.Equal(t, &InstalledFileFields{
+		XattrsChecksum: "Q1HxuWiKmGwXpcavHFFctS0WIUn4s=",
+		ExtraFields:    []IndexField{{Key: "y", Value: "another one"}},
+	}, pkg.FileFields["var/lib/iputils"])
+	require.Len(t, pkg.FileFields, 2)
+}
+
+// TestRewriteInstalled removes files and packages from an installed database, which should keep
+// what the others have as it was.
+func TestRewriteInstalled(t *testing.T) {
+	golden, err := os.ReadFile("testdata/installed/fields")
+	require.NoError(t, err)
+	entries := strings.Split(string(golden), "\n\n")
+	newAPK := func(t *testing.T) *APK {
+		src := apkfs.NewMemFS()
+		require.NoError(t, src.MkdirAll("lib/apk/db", 0o755))
+		a, err := New(WithFS(src))
+		require.NoError(t, err)
+		require.NoError(t, src.WriteFile(a.installedFilePath(), golden, 0o644))
+		return a
+	}
+
+	t.Run("disowned files", func(t *testing.T) {
+		a := newAPK(t)
+		_, ok := a.fileOwner("bin/arping")
+		require.True(t, ok)
+		a.installedFiles["bin/arping"] = &Package{Name: "arping"}
+		require.NoError(t, a.addInstalledPackages(nil))
+
+		b, err := a.fs.ReadFile(a.installedFilePath())
+		require.NoError(t, err)
+		want := strings.Replace(string(golden), "R:arping\na:0:0:4755\nZ:Q1PkYkxVvu2JhmCwLMvrv2nC7s3Oc=\n", "", 1)
+		require.Equal(t, want, string(b))
+	})
+
+	t.Run("deleted packages", func(t *testing.T) {
+		a := newAPK(t)
+		require.NoError(t, a.deleteInstalledEntries(map[string]bool{"empty": true}))
+
+		b, err := a.fs.ReadFile(a.installedFilePath())
+		require.NoError(t, err)
+		require.Equal(t, entries[0]+"\n\n", string(b))
+	})
+}
+
 func TestIsInstalledPackage(t *testing.T) {
 	a, _, err := testGetTestAPK()
 	require.NoErrorf(t, err, "unable to initialize APK implementation: %v", err)
@@ -174,7 +302,7 @@ func TestUpdateScriptsTar(t *testing.T) {
 		if k == ".PKGINFO" {
 			continue
 		}
-		expected[fmt.Sprintf("%s-%s.Q1%s%s", pkg.Name, pkg.Version, base64.StdEncoding.EncodeToString(pkg.Checksum), k)] = v
+		expected[fmt.Sprintf("%s-%s.%s%s", pkg.Name, pkg.Version, pkg.Checksum, k)] = v
 	}
 
 	// successfully wrote it; not check that it was written correctly
@@ -312,7 +440,7 @@ func TestSortTarHeaders(t *testing.T) {
 			},
 		},
 		{
-			name: "intermediate dirs in the tree should be required to preserve children",
+			name: "missing intermediate dirs in the tree should be added to preserve children",
 			headers: []tar.Header{
 				{Name: "usr", Typeflag: tar.TypeDir},
 				{Name: "usr/bin", Typeflag: tar.TypeDir},
@@ -321,11 +449,32 @@ func TestSortTarHeaders(t *testing.T) {
 				{Name: "usr/bin/cmd", Typeflag: tar.TypeReg},
 			},
 			expected: []string{
+				"etc",
+				"etc/logrotate.d",
+				"etc/logrotate.d/file",
 				"usr",
 				"usr/bin",
 				"usr/bin/cmd",
 			},
 		},
+		{
+			name: "top-level files and empty dirs should be kept",
+			headers: []tar.Header{
+				{Name: "tmp", Typeflag: tar.TypeDir},
+				{Name: ".PKGINFO", Typeflag: tar.TypeReg},
+				{Name: "a", Typeflag: tar.TypeDir},
+				{Name: "a/b", Typeflag: tar.TypeDir},
+				{Name: "a/file", Typeflag: tar.TypeReg},
+			},
+			expected: []string{
+				"",
+				".PKGINFO",
+				"a",
+				"a/file",
+				"a/b",
+				"tmp",
+			},
+		},
 		{
 			name: "handle Alpine-style headers (with trailing slashes)",
 			headers: []tar.Header{
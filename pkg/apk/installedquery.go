@@ -0,0 +1,146 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// installedQueries are the installed packages by name, and the packages that own each file.
+type installedQueries struct {
+	byName map[string]*InstalledPackage
+	// owners has the package that owns each path that is not a directory, the last one in the
+	// installed database if there are several, like apk.
+	owners map[string]*InstalledPackage
+	// dirs has the packages that have each directory.
+	dirs map[string][]*InstalledPackage
+}
+
+// lookupInstalled returns the maps for the queries on the installed database, reading it if
+// this is the first query since it was read or changed.
+func (a *APK) lookupInstalled() (*installedQueries, error) {
+	a.installedQueriesMu.Lock()
+	defer a.installedQueriesMu.Unlock()
+	if a.installedQueries != nil {
+		return a.installedQueries, nil
+	}
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, err
+	}
+	q := &installedQueries{
+		byName: map[string]*InstalledPackage{},
+		owners: map[string]*InstalledPackage{},
+		dirs:   map[string][]*InstalledPackage{},
+	}
+	for _, pkg := range installed {
+		q.byName[pkg.Name] = pkg
+		for _, f := range pkg.Files {
+			name := filepath.Clean(f.Name)
+			if f.Typeflag == tar.TypeDir {
+				q.dirs[name] = append(q.dirs[name], pkg)
+			} else {
+				q.owners[name] = pkg
+			}
+		}
+	}
+	a.installedQueries = q
+	return q, nil
+}
+
+// invalidateInstalled drops what the queries have read of the installed database, which is
+// done whenever it is written. Changes by other processes are only seen by a new APK.
+func (a *APK) invalidateInstalled() {
+	a.installedQueriesMu.Lock()
+	defer a.installedQueriesMu.Unlock()
+	a.installedQueries = nil
+}
+
+// GetInstalledPackage returns the installed package named name, with its files. It fails
+// with ErrNotInstalled if there is none. The package is shared with the other queries until
+// the installed database changes, so it must not be modified.
+func (a *APK) GetInstalledPackage(name string) (*InstalledPackage, error) {
+	q, err := a.lookupInstalled()
+	if err != nil {
+		return nil, err
+	}
+	pkg, ok := q.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, ErrNotInstalled)
+	}
+	return pkg, nil
+}
+
+// InstalledFiles returns the files and directories of the installed package named name, in
+// installed database order, with their owners, modes and, for files, the checksums of their
+// contents in the PAX records. It fails with ErrNotInstalled if there is no such package.
+func (a *APK) InstalledFiles(name string) ([]tar.Header, error) {
+	pkg, err := a.GetInstalledPackage(name)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]tar.Header, 0, len(pkg.Files))
+	for _, f := range pkg.Files {
+		files = append(files, *f)
+	}
+	return files, nil
+}
+
+// WhoOwnsFile returns the installed package that owns the file at path, which is relative to
+// the root of the filesystem or absolute, like apk info --who-owns. Directories are not owned
+// by any one package. It fails with ErrNotOwned if no installed package has the file.
+func (a *APK) WhoOwnsFile(path string) (*InstalledPackage, error) {
+	q, err := a.lookupInstalled()
+	if err != nil {
+		return nil, err
+	}
+	pkg, ok := q.owners[filepath.Clean(strings.TrimPrefix(path, "/"))]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", path, ErrNotOwned)
+	}
+	return pkg, nil
+}
+
+// IsInstalled reports whether the package named name is installed, with a version that
+// satisfies constraint if it is not empty, like ">=1.2-r0" or "~1.2", compared like apk does.
+func (a *APK) IsInstalled(name, constraint string) (bool, error) {
+	dep, err := ParseDependency(name + constraint)
+	if err != nil {
+		return false, fmt.Errorf("invalid constraint %q for %s: %w", constraint, name, err)
+	}
+	if dep.Conflict || dep.Pin != "" || dep.Name != name {
+		return false, fmt.Errorf("invalid constraint %q for %s", constraint, name)
+	}
+	q, err := a.lookupInstalled()
+	if err != nil {
+		return false, err
+	}
+	pkg, ok := q.byName[name]
+	if !ok {
+		return false, nil
+	}
+	if dep.Operator == "" {
+		return true, nil
+	}
+	version, err := ParseVersion(pkg.Version)
+	if err != nil {
+		return false, fmt.Errorf("invalid version %s of installed package %s: %w", pkg.Version, name, err)
+	}
+	return dep.Satisfies(version), nil
+}
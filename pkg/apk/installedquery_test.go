@@ -0,0 +1,97 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstalledQueries(t *testing.T) {
+	a, _, err := testGetTestAPK()
+	require.NoError(t, err)
+
+	pkg, err := a.GetInstalledPackage("busybox")
+	require.NoError(t, err)
+	require.Equal(t, "1.35.0-r17", pkg.Version)
+	_, err = a.GetInstalledPackage("missing")
+	require.ErrorIs(t, err, ErrNotInstalled)
+
+	files, err := a.InstalledFiles("busybox")
+	require.NoError(t, err)
+	require.Equal(t, "bin", files[0].Name)
+	require.Equal(t, "bin/busybox", files[1].Name)
+	require.Equal(t, int64(0o755), files[1].Mode)
+	require.Equal(t, "Q1z9q8GKcLmzboM90vMuZaj47yeOU=", files[1].PAXRecords[paxRecordsChecksumKey])
+	_, err = a.InstalledFiles("missing")
+	require.ErrorIs(t, err, ErrNotInstalled)
+
+	for _, path := range []string{"bin/busybox", "/bin/busybox", "/bin//busybox"} {
+		owner, err := a.WhoOwnsFile(path)
+		require.NoError(t, err, path)
+		require.Equal(t, "busybox", owner.Name, path)
+	}
+	_, err = a.WhoOwnsFile("bin")
+	require.ErrorIs(t, err, ErrNotOwned, "directories should not be owned")
+	_, err = a.WhoOwnsFile("bin/missing")
+	require.ErrorIs(t, err, ErrNotOwned)
+
+	for _, tt := range []struct {
+		name, constraint string
+		installed        bool
+	}{
+		{"busybox", "", true},
+		{"busybox", ">=1.35.0-r17", true},
+		{"busybox", ">1.35.0", true},
+		{"busybox", "<1.35.0-r17", false},
+		{"busybox", "~1.35", true},
+		{"busybox", "=1.36.0-r0", false},
+		{"missing", "", false},
+	} {
+		installed, err := a.IsInstalled(tt.name, tt.constraint)
+		require.NoError(t, err, "%s%s", tt.name, tt.constraint)
+		require.Equal(t, tt.installed, installed, "%s%s", tt.name, tt.constraint)
+	}
+	_, err = a.IsInstalled("busybox", ">=not a version")
+	require.Error(t, err)
+	_, err = a.IsInstalled("busybox", "@edge")
+	require.Error(t, err)
+
+	// installing changes what the queries see
+	pkg1 := triggerPackage(t,
+		&PkgInfo{Name: "queried", Version: "1.0-r0", Arch: "x86_64"},
+		fstest.MapFS{
+			"opt":         {Mode: 0o755 | fs.ModeDir},
+			"opt/queried": {Mode: 0o644, Data: []byte("queried")},
+		}, nil)
+	require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{pkg1}))
+	owner, err := a.WhoOwnsFile("opt/queried")
+	require.NoError(t, err)
+	require.Equal(t, "queried", owner.Name)
+	installed, err := a.IsInstalled("queried", "=1.0-r0")
+	require.NoError(t, err)
+	require.True(t, installed)
+
+	require.NoError(t, a.DeletePackages(context.Background(), "queried"))
+	_, err = a.WhoOwnsFile("opt/queried")
+	require.ErrorIs(t, err, ErrNotOwned)
+	installed, err = a.IsInstalled("queried", "")
+	require.NoError(t, err)
+	require.False(t, installed)
+}
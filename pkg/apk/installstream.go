@@ -0,0 +1,197 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	"go.opentelemetry.io/otel"
+)
+
+// InstallPackageStream installs pkg from its .apk read from source as it is read, without
+// writing it to the cache or to temporary files first, and adds it to the installed database.
+// It returns the package, as it is in the installed database.
+//
+// Like InstallPackages, the signature of the package and the checksum of its control section
+// are verified before anything is installed. Files are installed as the data section is read,
+// and only once all of it is read is it checked against the datahash of the package, and its
+// size against that of pkg in its index. If either does not match, the files that were
+// installed are removed again and the package is not added to the installed database. Like
+// InstallPackages, it does not change world.
+func (a *APK) InstallPackageStream(ctx context.Context, pkg InstallablePackage, source io.Reader, sourceDateEpoch *time.Time, opts ...expandapk.Option) (*Package, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "InstallPackageStream")
+	defer span.End()
+
+	unlock, err := a.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	stream, err := expandapk.ExpandApkStreaming(ctx, source, "", opts...)
+	if err != nil {
+		return nil, fmt.Errorf("expanding package: %w", err)
+	}
+	defer stream.Close()
+
+	if err := a.verifyIntegrity(pkg, stream.ControlHash, 0, 0); err != nil {
+		return nil, err
+	}
+	if err := a.verifySignature(pkg, stream.Signed, func(keys map[string][]byte) (string, error) {
+		return verifyStreamSignature(stream, keys)
+	}); err != nil {
+		return nil, err
+	}
+
+	info, err := streamPackageInfo(stream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .PKGINFO: %w", err)
+	}
+
+	old, err := a.installedPackage(info.Name)
+	if err != nil {
+		return nil, fmt.Errorf("error checking if package %s is installed: %w", info.Name, err)
+	}
+	if old != nil && !isUpgrade(old, info) {
+		clog.FromContext(ctx).Debugf("%s is already installed", info.Name)
+		return info, nil
+	}
+
+	if old != nil {
+		clog.FromContext(ctx).Debugf("upgrading %s (%s -> %s)", info.Name, old.Version, info.Version)
+		if err := a.prepareUpgrade(ctx, old); err != nil {
+			return nil, fmt.Errorf("unable to upgrade %s: %w", info.Name, err)
+		}
+		defer func() { a.preservedFiles = nil }()
+	} else {
+		clog.FromContext(ctx).Debugf("installing %s (%s)", info.Name, info.Version)
+	}
+	files, err := a.installAPKFiles(ctx, stream.Data(), info)
+	if err == nil {
+		// Read the rest of the data section, which checks it against the datahash.
+		if _, err = io.Copy(io.Discard, stream.Data()); err != nil {
+			err = fmt.Errorf("reading data section of %s: %w", info.Name, err)
+		}
+	} else {
+		err = fmt.Errorf("unable to install files for pkg %s: %w", info.Name, err)
+	}
+	if err == nil {
+		err = a.verifyIntegrity(pkg, stream.ControlHash, stream.Size, packageSize(pkg))
+	}
+	if err != nil {
+		if rollbackErr := a.removeStreamedFiles(info); rollbackErr != nil {
+			return nil, errors.Join(err, fmt.Errorf("removing files of %s: %w", info.Name, rollbackErr))
+		}
+		return nil, err
+	}
+	info.Size = uint64(stream.Size)
+
+	controlData, err := stream.Control()
+	if err != nil {
+		return nil, fmt.Errorf("opening control section of %s: %w", info.Name, err)
+	}
+	defer controlData.Close()
+	if err := a.updateScriptsTar(info, controlData, sourceDateEpoch); err != nil {
+		return nil, fmt.Errorf("unable to update scripts.tar for pkg %s: %w", info.Name, err)
+	}
+
+	controlData, err = stream.Control()
+	if err != nil {
+		return nil, fmt.Errorf("opening control section of %s: %w", info.Name, err)
+	}
+	defer controlData.Close()
+	if err := a.updateTriggers(info, controlData); err != nil {
+		return nil, fmt.Errorf("unable to update triggers for pkg %s: %w", info.Name, err)
+	}
+	if old != nil {
+		if err := a.finishUpgrade(ctx, old, info, files); err != nil {
+			return nil, fmt.Errorf("unable to upgrade %s: %w", info.Name, err)
+		}
+	}
+
+	// Remove any files that were kept from another package.
+	files = slices.DeleteFunc(files, func(hdr tar.Header) bool {
+		owner, ok := a.installedFiles[hdr.Name]
+		return ok && owner != info
+	})
+	if err := a.addInstalledPackage(info, files); err != nil {
+		return nil, fmt.Errorf("unable to update installed file for pkg %s: %w", info.Name, err)
+	}
+
+	return info, nil
+}
+
+// removeStreamedFiles removes what was installed for pkg before its data section turned out
+// not to be the one that was verified: the files it owns, or the .apk-new files next to locally
+// modified ones. Directories are left. The files of other packages that it replaced are
+// removed too, as what they had is gone, but they stay theirs in the installed database.
+func (a *APK) removeStreamedFiles(pkg *Package) error {
+	var errs []error
+	for name, owner := range a.installedFiles {
+		if owner != pkg {
+			continue
+		}
+		if previous, ok := a.previousOwners[name]; ok {
+			a.installedFiles[name] = previous
+		} else {
+			delete(a.installedFiles, name)
+		}
+		if a.preservedFiles[name] {
+			name += apkNewSuffix
+		}
+		if err := a.fs.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// streamPackageInfo returns the package of the .PKGINFO in the control section of stream.
+func streamPackageInfo(stream *expandapk.APKStream) (*Package, error) {
+	control, err := stream.ControlData()
+	if err != nil {
+		return nil, err
+	}
+	defer control.Close()
+
+	tr := tar.NewReader(control)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("package has no .PKGINFO")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name != ".PKGINFO" {
+			continue
+		}
+		pkg, err := parsePkgInfo(tr)
+		if err != nil {
+			return nil, err
+		}
+		pkg.Checksum = stream.ControlHash
+		return pkg, nil
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandApkStreaming(t *testing.T) {
+	b, err := os.ReadFile("testdata/hello-wolfi-2.12.1-r0.apk")
+	require.NoError(t, err)
+
+	exp, err := expandapk.ExpandApk(context.Background(), bytes.NewReader(b), t.TempDir())
+	require.NoError(t, err)
+	defer exp.Close()
+
+	// Spill the sections to files, which must not change anything.
+	for _, threshold := range []int64{1 << 20, 1} {
+		dir := t.TempDir()
+		stream, err := expandapk.ExpandApkStreaming(context.Background(), bytes.NewReader(b), dir, expandapk.WithSpillThreshold(threshold))
+		require.NoError(t, err)
+		require.True(t, stream.Signed)
+		require.Equal(t, exp.ControlHash, stream.ControlHash)
+
+		pkg, err := streamPackageInfo(stream)
+		require.NoError(t, err)
+		require.Equal(t, "hello-wolfi", pkg.Name)
+
+		var data bytes.Buffer
+		_, err = data.ReadFrom(stream.Data())
+		require.NoError(t, err)
+		want, err := os.ReadFile(exp.TarFile)
+		require.NoError(t, err)
+		require.Equal(t, want, data.Bytes())
+		require.Equal(t, exp.PackageHash, stream.PackageHash)
+		require.Equal(t, int64(len(b)), stream.Size)
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Equal(t, threshold == 1, len(entries) > 0, "spilled with threshold %d", threshold)
+		require.NoError(t, stream.Close())
+		entries, err = os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	}
+}
+
+func TestInstallPackageStream(t *testing.T) {
+	ctx := context.Background()
+	a, src, err := testGetTestAPK()
+	require.NoError(t, err)
+	// The key that signed it is not in the test data.
+	a.ignoreSignatures = true
+
+	want, err := PackageFromAPKFile("testdata/hello-wolfi-2.12.1-r0.apk")
+	require.NoError(t, err)
+	f, err := os.Open("testdata/hello-wolfi-2.12.1-r0.apk")
+	require.NoError(t, err)
+	defer f.Close()
+	pkg, err := a.InstallPackageStream(ctx, &testPackage{file: f.Name(), pkg: want, checksum: want.ChecksumString()}, f, nil)
+	require.NoError(t, err)
+	require.Equal(t, "hello-wolfi", pkg.Name)
+	require.Equal(t, want.Checksum, pkg.Checksum)
+	require.Equal(t, want.Size, pkg.Size)
+
+	_, err = src.Stat("usr/bin/hello")
+	require.NoError(t, err)
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Equal(t, "hello-wolfi", installed[len(installed)-1].Name)
+	require.Equal(t, want.ChecksumString(), installed[len(installed)-1].ChecksumString())
+
+	streamed := func(t *testing.T, name, datahash string) InstallablePackage {
+		return fakePackage(t, &Package{Name: name, DataHash: datahash}, []testDirEntry{
+			{path: "etc", dir: true, perms: 0o755},
+			{path: "etc/" + name, perms: 0o644, content: []byte("data")},
+		})
+	}
+	install := func(a *APK, pkg InstallablePackage) error {
+		f, err := os.Open(pkg.URL())
+		require.NoError(t, err)
+		defer f.Close()
+		_, err = a.InstallPackageStream(ctx, pkg, f, nil)
+		return err
+	}
+	requireNotInstalled := func(t *testing.T, a *APK, src apkfs.FullFS, name string) {
+		_, err := src.Stat("etc/" + name)
+		require.ErrorIs(t, err, os.ErrNotExist)
+		installed, err := a.isInstalledPackage(name)
+		require.NoError(t, err)
+		require.False(t, installed)
+	}
+
+	t.Run("signed", func(t *testing.T) {
+		key, pub := testEd25519Key(t)
+		signed := testSignPackage(t, streamed(t, "signed", ""), "test.ed25519.pub", key)
+
+		a, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		require.NoError(t, src.MkdirAll(keysDirPath, 0o755))
+		_, otherPub := testEd25519Key(t)
+		require.NoError(t, src.WriteFile(filepath.Join(keysDirPath, "test.ed25519.pub"), otherPub, 0o644))
+		var sigErr *PackageSignatureError
+		require.ErrorAs(t, install(a, signed), &sigErr)
+		requireNotInstalled(t, a, src, "signed")
+
+		require.NoError(t, src.WriteFile(filepath.Join(keysDirPath, "test.ed25519.pub"), pub, 0o644))
+		require.NoError(t, install(a, signed))
+		_, err = src.Stat("etc/signed")
+		require.NoError(t, err)
+	})
+
+	t.Run("unsigned remote", func(t *testing.T) {
+		a, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		unsigned := *streamed(t, "unsigned", "").(*testPackage)
+		f, err := os.Open(unsigned.file)
+		require.NoError(t, err)
+		defer f.Close()
+		unsigned.file = "https://example.com/unsigned.apk"
+		_, err = a.InstallPackageStream(ctx, &unsigned, f, nil)
+		require.ErrorIs(t, err, ErrUnsignedPackage)
+		requireNotInstalled(t, a, src, "unsigned")
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		a, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		wrong := *streamed(t, "wrongchecksum", "").(*testPackage)
+		wrong.checksum = "Q1AAAAAAAAAAAAAAAAAAAAAAAAAAA="
+		var integrityErr *PackageIntegrityError
+		require.ErrorAs(t, install(a, &wrong), &integrityErr)
+		require.Equal(t, "checksum", integrityErr.Field)
+		requireNotInstalled(t, a, src, "wrongchecksum")
+	})
+
+	t.Run("datahash mismatch", func(t *testing.T) {
+		a, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		var mismatch *expandapk.DataHashMismatchError
+		require.ErrorAs(t, install(a, streamed(t, "wrongdatahash", strings.Repeat("ab", 32))), &mismatch)
+		// The file was written before the mismatch was found, and is removed again.
+		requireNotInstalled(t, a, src, "wrongdatahash")
+	})
+}
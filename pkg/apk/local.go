@@ -0,0 +1,125 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	"go.lsp.dev/uri"
+	"go.opentelemetry.io/otel"
+)
+
+// AddLocalPackages adds the package files at paths to the world, like `apk add ./foo.apk`.
+// Each of paths is a path or a file:// URL. Each package is added as name=version from its
+// .PKGINFO, and its RepositoryPackage has the file:// URL of the file. It is always resolved
+// from the file rather than from any repository, while its dependencies are resolved from
+// the repositories as usual. Nothing is installed until the world is, with FixateWorld.
+//
+// The checksum of each file is taken from the file itself. Unless signatures are ignored, the
+// files must be signed, or allowed to be unsigned with WithAllowUnsignedLocalPackages.
+func (a *APK) AddLocalPackages(ctx context.Context, paths ...string) error {
+	log := clog.FromContext(ctx)
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "AddLocalPackages")
+	defer span.End()
+
+	unlock, err := a.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	pkgs := make([]*RepositoryPackage, 0, len(paths))
+	for _, path := range paths {
+		pkg, err := parseLocalPackage(ctx, path)
+		if err != nil {
+			return err
+		}
+		pkgs = append(pkgs, pkg)
+	}
+
+	world, err := a.GetWorld()
+	if err != nil {
+		return fmt.Errorf("error getting world packages: %w", err)
+	}
+	for _, pkg := range pkgs {
+		log.Debugf("adding local package %s (%s) from %s", pkg.Name, pkg.Version, pkg.location)
+		world = appendWorldEntry(world, pkg.Name, pkg.Name+"="+pkg.Version)
+	}
+	if err := a.setWorld(ctx, world); err != nil {
+		return err
+	}
+	a.localPackages = append(a.localPackages, pkgs...)
+	return nil
+}
+
+// parseLocalPackage reads the package file at path, a path or a file:// URL.
+func parseLocalPackage(ctx context.Context, path string) (*RepositoryPackage, error) {
+	abs, err := filepath.Abs(localPath(path))
+	if err != nil {
+		return nil, fmt.Errorf("resolving path of local package %s: %w", path, err)
+	}
+	f, err := os.Open(abs)
+	if err != nil {
+		return nil, fmt.Errorf("opening local package %s: %w", path, err)
+	}
+	defer f.Close()
+
+	pkg, err := ParsePackage(ctx, f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing local package %s: %w", path, err)
+	}
+	repo := &Repository{URI: string(uri.File(filepath.Dir(abs)))}
+	rp := NewRepositoryPackage(pkg, repo.WithIndex(&APKIndex{Packages: []*Package{pkg}}))
+	rp.location = string(uri.File(abs))
+	return rp, nil
+}
+
+// localPath returns the path of u, which is either a path or a file:// URL.
+func localPath(u string) string {
+	if strings.HasPrefix(u, "file://") {
+		if parsed, err := url.Parse(u); err == nil {
+			return filepath.FromSlash(parsed.Path)
+		}
+	}
+	return u
+}
+
+// appendWorldEntry returns world with entry in place of any existing entries for name.
+func appendWorldEntry(world []string, name, entry string) []string {
+	out := make([]string, 0, len(world)+1)
+	for _, existing := range world {
+		if worldEntryName(existing) != name {
+			out = append(out, existing)
+		}
+	}
+	return append(out, entry)
+}
+
+// localPackagesIndex is the index of the packages added with AddLocalPackages, or of virtual
+// packages.
+type localPackagesIndex struct {
+	pkgs []*RepositoryPackage
+}
+
+func (l *localPackagesIndex) Name() string                   { return "" }
+func (l *localPackagesIndex) Packages() []*RepositoryPackage { return l.pkgs }
+func (l *localPackagesIndex) Source() string                 { return "local packages" }
+func (l *localPackagesIndex) Count() int                     { return len(l.pkgs) }
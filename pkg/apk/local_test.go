@@ -0,0 +1,91 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddLocalPackages(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("resolve with repository dependencies", func(t *testing.T) {
+		local := fakePackage(t, &Package{Name: "hello", Version: "1.0-r0", Origin: "hello", Dependencies: []string{"busybox"}}, []testDirEntry{
+			{"etc", 0o755, true, nil, nil},
+			{"etc/hello", 0o644, false, []byte("hello"), nil},
+		})
+		a := newTestFetchAPK(t, nil, WithArch(testArch), WithIgnoreSignatureVerification(true))
+		require.NoError(t, a.SetRepositories(ctx, []string{testAlpineRepos}))
+		require.NoError(t, a.SetWorld(ctx, []string{"hello>2", "musl"}))
+		require.NoError(t, a.AddLocalPackages(ctx, "file://"+local.URL()))
+
+		world, err := a.GetWorld()
+		require.NoError(t, err)
+		require.Equal(t, []string{"hello=1.0-r0", "musl"}, world)
+
+		pkgs, _, err := a.ResolveWorld(ctx)
+		require.NoError(t, err)
+		urls := map[string]string{}
+		for _, pkg := range pkgs {
+			urls[pkg.Name] = pkg.URL()
+		}
+		require.Equal(t, "file://"+local.URL(), urls["hello"])
+		require.Equal(t, testAlpineRepos+"/"+testArch+"/busybox-1.35.0-r17.apk", urls["busybox"])
+	})
+
+	t.Run("install", func(t *testing.T) {
+		local := fakePackage(t, &Package{Name: "hello", Version: "1.0-r0", Origin: "hello-origin"}, []testDirEntry{
+			{"etc", 0o755, true, nil, nil},
+			{"etc/hello", 0o644, false, []byte("hello"), nil},
+		})
+		a := newTestFetchAPK(t, nil, WithArch(testArch), WithIgnoreSignatureVerification(true))
+		require.NoError(t, a.SetRepositories(ctx, []string{testAlpineRepos}))
+		require.NoError(t, a.AddLocalPackages(ctx, local.URL()))
+		require.NoError(t, a.FixateWorld(ctx, nil))
+
+		content, err := a.fs.ReadFile("etc/hello")
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(content))
+
+		installed, err := a.GetInstalled()
+		require.NoError(t, err)
+		last := installed[len(installed)-1]
+		require.Equal(t, "hello", last.Name)
+		require.Equal(t, "1.0-r0", last.Version)
+		require.Equal(t, "hello-origin", last.Origin)
+	})
+
+	t.Run("preferred over repositories", func(t *testing.T) {
+		local, err := parseLocalPackage(ctx, fakePackage(t, &Package{Name: "hello", Version: "1.0-r0"}, nil).URL())
+		require.NoError(t, err)
+		repo := Repository{URI: "main"}
+		// Even a later index, and a repository package with a provider priority.
+		resolver := NewPkgResolver(ctx, append(testNamedRepositoryFromIndexes([]*RepositoryWithIndex{
+			repo.WithIndex(&APKIndex{Packages: []*Package{{Name: "hello", Version: "1.0-r0", ProviderPriority: 100}}}),
+		}), &localPackagesIndex{pkgs: []*RepositoryPackage{local}}))
+		pkgs, err := resolver.ResolvePackage("hello=1.0-r0", map[*RepositoryPackage]string{})
+		require.NoError(t, err)
+		require.Len(t, pkgs, 2)
+		require.Equal(t, local, pkgs[0])
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		a := newTestFetchAPK(t, nil)
+		require.ErrorContains(t, a.AddLocalPackages(ctx, "does-not-exist.apk"), "opening local package does-not-exist.apk")
+	})
+}
@@ -0,0 +1,157 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// LockfileVersion is the version of the lockfile format written by this package.
+const LockfileVersion = 1
+
+// Lockfile is a fully pinned resolution of the world, to install exactly the same packages later.
+//
+// It is serialized as JSON like this, with the packages in install order:
+//
+//	{
+//	  "version": 1,
+//	  "packages": [
+//	    {
+//	      "name": "musl",
+//	      "version": "1.2.4-r2",
+//	      "arch": "x86_64",
+//	      "repository": "https://dl-cdn.alpinelinux.org/alpine/v3.18/main/x86_64",
+//	      "checksum": "Q1..."
+//	    }
+//	  ]
+//	}
+//
+// The checksum is of the control section of the package, in the Q1 form used by APKINDEX.
+type Lockfile struct {
+	Version  int             `json:"version"`
+	Packages []LockedPackage `json:"packages"`
+}
+
+// LockedPackage is a single package in a Lockfile.
+type LockedPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Arch    string `json:"arch"`
+	// Repository is the URI of the repository including the architecture, which the
+	// package file is fetched from.
+	Repository string `json:"repository"`
+	Checksum   string `json:"checksum"`
+}
+
+// NewLockfile returns a Lockfile for the given packages, which must have been resolved from
+// repository indexes so that their repository and checksum are known.
+func NewLockfile(pkgs []*RepositoryPackage) *Lockfile {
+	lock := &Lockfile{Version: LockfileVersion, Packages: make([]LockedPackage, 0, len(pkgs))}
+	for _, pkg := range pkgs {
+		lock.Packages = append(lock.Packages, lockedPackage(pkg))
+	}
+	return lock
+}
+
+func lockedPackage(pkg *RepositoryPackage) LockedPackage {
+	locked := LockedPackage{
+		Name:     pkg.Name,
+		Version:  pkg.Version,
+		Arch:     pkg.Arch,
+		Checksum: pkg.ChecksumString(),
+	}
+	if repo := pkg.Repository(); repo != nil {
+		locked.Repository = repo.URI
+	}
+	return locked
+}
+
+// ParseLockfile reads a Lockfile in the JSON format described on Lockfile.
+func ParseLockfile(r io.Reader) (*Lockfile, error) {
+	var lock Lockfile
+	if err := json.NewDecoder(r).Decode(&lock); err != nil {
+		return nil, fmt.Errorf("parsing lockfile: %w", err)
+	}
+	if lock.Version != LockfileVersion {
+		return nil, fmt.Errorf("unsupported lockfile version %d, expected %d", lock.Version, LockfileVersion)
+	}
+	for _, pkg := range lock.Packages {
+		if pkg.Name == "" || pkg.Version == "" || pkg.Repository == "" {
+			return nil, fmt.Errorf("lockfile entry %q is missing its name, version or repository", pkg.Name)
+		}
+		if _, err := pkg.checksum(); err != nil {
+			return nil, err
+		}
+	}
+	return &lock, nil
+}
+
+// LoadLockfile reads the Lockfile at path.
+func LoadLockfile(path string) (*Lockfile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening lockfile: %w", err)
+	}
+	defer f.Close()
+	return ParseLockfile(f)
+}
+
+// Write writes the lockfile as indented JSON.
+func (l *Lockfile) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(l)
+}
+
+func (p LockedPackage) checksum() (Checksum, error) {
+	if !strings.HasPrefix(p.Checksum, "Q") {
+		return nil, fmt.Errorf("lockfile entry %s has invalid checksum %q", p.Name, p.Checksum)
+	}
+	b, err := ParseChecksum(p.Checksum)
+	if err != nil {
+		return nil, fmt.Errorf("lockfile entry %s has invalid checksum %q: %w", p.Name, p.Checksum, err)
+	}
+	return b, nil
+}
+
+// repositoryPackages returns the locked packages, to be fetched from their repositories and
+// verified against their checksums like packages resolved from an index.
+func (l *Lockfile) repositoryPackages() ([]*RepositoryPackage, error) {
+	pkgs := make([]*RepositoryPackage, 0, len(l.Packages))
+	for _, locked := range l.Packages {
+		checksum, err := locked.checksum()
+		if err != nil {
+			return nil, err
+		}
+		repo := &Repository{URI: locked.Repository}
+		pkg := &Package{Name: locked.Name, Version: locked.Version, Arch: locked.Arch, Checksum: checksum}
+		pkgs = append(pkgs, NewRepositoryPackage(pkg, repo.WithIndex(&APKIndex{Packages: []*Package{pkg}})))
+	}
+	return pkgs, nil
+}
+
+// LockWorld resolves the world like ResolveWorld, and returns the result as a Lockfile.
+func (a *APK) LockWorld(ctx context.Context) (*Lockfile, error) {
+	pkgs, _, err := a.ResolveWorld(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewLockfile(pkgs), nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockfile(t *testing.T) {
+	ctx := context.Background()
+	epoch := time.Unix(1700000000, 0)
+
+	t.Run("resolve", func(t *testing.T) {
+		// The test transport serves the x86_64 index whatever the architecture.
+		a := newTestFetchAPK(t, nil, WithArch(testArch), WithIgnoreSignatureVerification(true))
+		require.NoError(t, a.SetRepositories(ctx, []string{testAlpineRepos}))
+		require.NoError(t, a.SetWorld(ctx, []string{"alpine-baselayout"}))
+		lock, err := a.LockWorld(ctx)
+		require.NoError(t, err)
+		require.Equal(t, LockfileVersion, lock.Version)
+		require.Contains(t, lock.Packages, LockedPackage{
+			Name:       "alpine-baselayout",
+			Version:    "3.2.0-r23",
+			Arch:       "x86_64",
+			Repository: testAlpineRepos + "/" + testArch,
+			Checksum:   "Q19UI7UxyiUywG6aew9c3lCBPshsE=",
+		})
+	})
+
+	// The package file in the test repository is not the one in its index, so lock testPkg.
+	repo := Repository{URI: testAlpineRepos + "/" + testArch}
+	pkg := NewRepositoryPackage(&testPkg, repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}}))
+	lock := NewLockfile([]*RepositoryPackage{pkg})
+
+	t.Run("round trip", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, lock.Write(&buf))
+		parsed, err := ParseLockfile(&buf)
+		require.NoError(t, err)
+		require.Equal(t, lock, parsed)
+
+		_, err = ParseLockfile(strings.NewReader(`{"version": 2, "packages": []}`))
+		require.ErrorContains(t, err, "unsupported lockfile version 2")
+	})
+
+	t.Run("install", func(t *testing.T) {
+		a := newTestFetchAPK(t, nil, WithArch(testArch), WithIgnoreSignatureVerification(true))
+		require.NoError(t, a.InstallPackages(ctx, &epoch, []InstallablePackage{pkg}))
+		want, err := a.fs.ReadFile(a.installedFilePath())
+		require.NoError(t, err)
+
+		locked := newTestFetchAPK(t, nil, WithArch(testArch), WithIgnoreSignatureVerification(true), WithLockfile(lock))
+		// The lockfile is used instead of resolving, so the repositories are never read.
+		require.NoError(t, locked.SetRepositories(ctx, []string{"https://example.invalid/alpine"}))
+		require.NoError(t, locked.FixateWorld(ctx, &epoch))
+		got, err := locked.fs.ReadFile(locked.installedFilePath())
+		require.NoError(t, err)
+		require.Equal(t, string(want), string(got))
+	})
+
+	t.Run("checksum changed", func(t *testing.T) {
+		changed := NewLockfile([]*RepositoryPackage{pkg})
+		changed.Packages[0].Checksum = "Q1AAAAAAAAAAAAAAAAAAAAAAAAAAA="
+		locked := newTestFetchAPK(t, nil, WithArch(testArch), WithIgnoreSignatureVerification(true), WithLockfile(changed))
+		err := locked.FixateWorld(ctx, &epoch)
+		var integrityErr *PackageIntegrityError
+		require.ErrorAs(t, err, &integrityErr)
+		require.Equal(t, "checksum", integrityErr.Field)
+	})
+
+	t.Run("package gone", func(t *testing.T) {
+		gone := NewLockfile([]*RepositoryPackage{pkg})
+		gone.Packages[0].Version = "3.2.0-r99"
+		locked := newTestFetchAPK(t, nil, WithArch(testArch), WithIgnoreSignatureVerification(true), WithLockfile(gone))
+		require.ErrorContains(t, locked.FixateWorld(ctx, &epoch), "alpine-baselayout-3.2.0-r99.apk")
+	})
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	"go.opentelemetry.io/otel"
+	"golang.org/x/sync/errgroup"
+)
+
+// ArchResolution is the world resolved for a single architecture.
+type ArchResolution struct {
+	Arch      string
+	Packages  []*RepositoryPackage
+	Conflicts []string
+}
+
+// ArchInconsistency is a package that does not resolve to the same version on every
+// architecture.
+type ArchInconsistency struct {
+	Name string
+	// Versions maps each architecture the package was resolved for to its version.
+	Versions map[string]string
+	// Missing are the architectures it was not resolved for at all.
+	Missing []string
+}
+
+// MultiArchResolution is the result of ResolveWorldForArchs.
+type MultiArchResolution struct {
+	// Archs are the resolutions in the order the architectures were given.
+	Archs []ArchResolution
+	// Inconsistencies are the packages that differ between architectures, sorted by name.
+	Inconsistencies []ArchInconsistency
+}
+
+// Consistent returns true if every package resolved to the same version on every architecture.
+func (r *MultiArchResolution) Consistent() bool {
+	return len(r.Inconsistencies) == 0
+}
+
+// String returns the inconsistencies one per line, like "busybox: aarch64=1.36.1-r0 x86_64=1.36.1-r1".
+func (r *MultiArchResolution) String() string {
+	var sb strings.Builder
+	for _, inc := range r.Inconsistencies {
+		sb.WriteString(inc.Name + ":")
+		for _, arch := range r.Archs {
+			if version, ok := inc.Versions[arch.Arch]; ok {
+				fmt.Fprintf(&sb, " %s=%s", arch.Arch, version)
+			} else {
+				fmt.Fprintf(&sb, " %s=missing", arch.Arch)
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// ResolveWorldForArchs resolves the world like ResolveWorld, for each of archs at once instead
+// of the architecture of the APK database. The indexes for all of them are fetched together
+// and the resolutions run concurrently. It does not install anything.
+func (a *APK) ResolveWorldForArchs(ctx context.Context, archs []string) (*MultiArchResolution, error) {
+	log := clog.FromContext(ctx)
+	log.Debugf("determining desired apk world for %s", strings.Join(archs, ", "))
+
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "ResolveWorldForArchs")
+	defer span.End()
+
+	if a.lockfile != nil {
+		return nil, errors.New("cannot resolve a lockfile for other architectures")
+	}
+
+	repos, err := a.GetRepositories()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := a.keyring()
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := GetRepositoryIndexesForArchs(ctx, repos, keys, archs, a.indexOptions(a.ignoreSignatures)...)
+	if err != nil {
+		return nil, fmt.Errorf("error getting repository indexes: %w", err)
+	}
+	world, err := a.GetWorld()
+	if err != nil {
+		return nil, fmt.Errorf("error getting world packages: %w", err)
+	}
+
+	result := &MultiArchResolution{Archs: make([]ArchResolution, len(archs))}
+	g, ctx := errgroup.WithContext(ctx)
+	for i, arch := range archs {
+		i, arch := i, arch
+		g.Go(func() error {
+			archIndexes := indexes[arch]
+			if local := a.localPackagesFor(arch); len(local) != 0 {
+				archIndexes = append([]NamedIndex{&localPackagesIndex{pkgs: local}}, archIndexes...)
+			}
+			pkgs, conflicts, err := a.resolve(ctx, archIndexes, world)
+			if err != nil {
+				return fmt.Errorf("resolving world for %s: %w", arch, err)
+			}
+			result.Archs[i] = ArchResolution{Arch: arch, Packages: pkgs, Conflicts: conflicts}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	result.Inconsistencies = archInconsistencies(result.Archs)
+	return result, nil
+}
+
+// localPackagesFor returns the packages added with AddLocalPackages that can be installed on arch.
+func (a *APK) localPackagesFor(arch string) []*RepositoryPackage {
+	var pkgs []*RepositoryPackage
+	for _, pkg := range a.localPackages {
+		if pkg.Arch == arch || pkg.Arch == "noarch" {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs
+}
+
+// archInconsistencies returns the packages that are missing from, or have different versions in,
+// some of the resolutions.
+func archInconsistencies(resolutions []ArchResolution) []ArchInconsistency {
+	versions := map[string]map[string]string{}
+	for _, r := range resolutions {
+		for _, pkg := range r.Packages {
+			if versions[pkg.Name] == nil {
+				versions[pkg.Name] = map[string]string{}
+			}
+			versions[pkg.Name][r.Arch] = pkg.Version
+		}
+	}
+
+	var inconsistencies []ArchInconsistency
+	for name, byArch := range versions {
+		inc := ArchInconsistency{Name: name, Versions: byArch}
+		distinct := map[string]bool{}
+		for _, r := range resolutions {
+			if version, ok := byArch[r.Arch]; ok {
+				distinct[version] = true
+			} else {
+				inc.Missing = append(inc.Missing, r.Arch)
+			}
+		}
+		if len(distinct) > 1 || len(inc.Missing) != 0 {
+			inconsistencies = append(inconsistencies, inc)
+		}
+	}
+	sort.Slice(inconsistencies, func(i, j int) bool {
+		return inconsistencies[i].Name < inconsistencies[j].Name
+	})
+	return inconsistencies
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveWorldForArchs(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("resolve", func(t *testing.T) {
+		// The test transport serves the x86_64 index whatever the architecture.
+		a := newTestFetchAPK(t, nil, WithArch(testArch), WithIgnoreSignatureVerification(true))
+		require.NoError(t, a.SetRepositories(ctx, []string{testAlpineRepos}))
+		require.NoError(t, a.SetWorld(ctx, []string{"busybox"}))
+		want, _, err := a.ResolveWorld(ctx)
+		require.NoError(t, err)
+
+		result, err := a.ResolveWorldForArchs(ctx, []string{"x86_64", "aarch64"})
+		require.NoError(t, err)
+		require.Len(t, result.Archs, 2)
+		require.Equal(t, "x86_64", result.Archs[0].Arch)
+		require.Equal(t, "aarch64", result.Archs[1].Arch)
+		require.Equal(t, packageRefs(want), packageRefs(result.Archs[1].Packages))
+		require.Equal(t, testAlpineRepos+"/x86_64/busybox-1.35.0-r17.apk", result.Archs[0].Packages[len(result.Archs[0].Packages)-1].URL())
+		require.True(t, result.Consistent())
+		require.Empty(t, result.String())
+	})
+
+	t.Run("inconsistencies", func(t *testing.T) {
+		pkg := func(name, version string) *RepositoryPackage {
+			return NewRepositoryPackage(&Package{Name: name, Version: version}, nil)
+		}
+		result := &MultiArchResolution{Archs: []ArchResolution{
+			{Arch: "x86_64", Packages: []*RepositoryPackage{pkg("musl", "1.2.4-r2"), pkg("busybox", "1.36.1-r1"), pkg("libucontext", "1.2-r0")}},
+			{Arch: "aarch64", Packages: []*RepositoryPackage{pkg("musl", "1.2.4-r2"), pkg("busybox", "1.36.1-r0")}},
+		}}
+		result.Inconsistencies = archInconsistencies(result.Archs)
+		require.False(t, result.Consistent())
+		require.Equal(t, []ArchInconsistency{
+			{Name: "busybox", Versions: map[string]string{"x86_64": "1.36.1-r1", "aarch64": "1.36.1-r0"}},
+			{Name: "libucontext", Versions: map[string]string{"x86_64": "1.2-r0"}, Missing: []string{"aarch64"}},
+		}, result.Inconsistencies)
+		require.Equal(t, "busybox: x86_64=1.36.1-r1 aarch64=1.36.1-r0\nlibucontext: x86_64=1.2-r0 aarch64=missing\n", result.String())
+	})
+}
@@ -0,0 +1,408 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// Repositories published as OCI artifacts are referenced as oci://<registry>/<repository>.
+// The files for each architecture are the layers of the artifact tagged with the
+// architecture, e.g. ghcr.io/org/repo:x86_64, named by their title annotation.
+const (
+	ociScheme          = "oci"
+	ociTitleAnnotation = "org.opencontainers.image.title"
+	ociManifestTypes   = "application/vnd.oci.image.manifest.v1+json, application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// OCICredentials are the credentials to use for a registry. If RegistryToken is set,
+// it is used as a bearer token as is.
+type OCICredentials struct {
+	Username      string
+	Password      string
+	RegistryToken string
+}
+
+// OCIKeychain resolves the credentials for a registry, e.g. "ghcr.io".
+// It mirrors authn.Keychain from go-containerregistry, so those are easily adapted.
+// Returning empty credentials means anonymous access.
+type OCIKeychain interface {
+	Resolve(registry string) (OCICredentials, error)
+}
+
+type dockerConfigKeychain struct {
+	path string
+}
+
+// DockerConfigKeychain returns an OCIKeychain that reads the static credentials in the
+// docker config.json at path. If path is empty, it uses $DOCKER_CONFIG/config.json,
+// or ~/.docker/config.json. Credential helpers are not supported.
+func DockerConfigKeychain(path string) OCIKeychain {
+	return &dockerConfigKeychain{path: path}
+}
+
+func (k *dockerConfigKeychain) Resolve(registry string) (OCICredentials, error) {
+	p := k.path
+	if p == "" {
+		dir := os.Getenv("DOCKER_CONFIG")
+		if dir == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return OCICredentials{}, nil
+			}
+			dir = filepath.Join(home, ".docker")
+		}
+		p = filepath.Join(dir, "config.json")
+	}
+	b, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return OCICredentials{}, nil
+	} else if err != nil {
+		return OCICredentials{}, fmt.Errorf("reading docker config %s: %w", p, err)
+	}
+
+	var cfg struct {
+		Auths map[string]struct {
+			Auth          string `json:"auth"`
+			Username      string `json:"username"`
+			Password      string `json:"password"`
+			IdentityToken string `json:"identitytoken"`
+			RegistryToken string `json:"registrytoken"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return OCICredentials{}, fmt.Errorf("parsing docker config %s: %w", p, err)
+	}
+	for host, auth := range cfg.Auths {
+		host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+		if strings.SplitN(host, "/", 2)[0] != registry {
+			continue
+		}
+		creds := OCICredentials{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			RegistryToken: auth.RegistryToken,
+		}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return OCICredentials{}, fmt.Errorf("decoding auth for %s: %w", registry, err)
+			}
+			creds.Username, creds.Password, _ = strings.Cut(string(decoded), ":")
+		}
+		return creds, nil
+	}
+	return OCICredentials{}, nil
+}
+
+// OCIFetcher is a Fetcher for oci:// repositories. It fetches the artifact manifest
+// for the architecture, and then the layer named like the requested file by digest.
+type OCIFetcher struct {
+	client   *http.Client
+	keychain OCIKeychain
+
+	// registry/repository -> bearer token
+	tokens sync.Map
+	// registry/repository:tag -> *ociManifest
+	manifests sync.Map
+}
+
+// NewOCIFetcher returns an OCIFetcher using client, or a retrying client if nil,
+// and keychain for credentials, or DockerConfigKeychain("") if nil.
+func NewOCIFetcher(client *http.Client, keychain OCIKeychain) *OCIFetcher {
+	if client == nil {
+		rhttp := retryablehttp.NewClient()
+		rhttp.Logger = hclog.Default()
+		client = rhttp.StandardClient()
+	}
+	if keychain == nil {
+		keychain = DockerConfigKeychain("")
+	}
+	return &OCIFetcher{
+		client:   client,
+		keychain: keychain,
+	}
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+// ociReference is an oci://<registry>/<repository>/<arch>/<filename> URL, split into its parts.
+type ociReference struct {
+	registry   string
+	repository string
+	tag        string
+	filename   string
+}
+
+func parseOCIReference(u string) (*ociReference, error) {
+	asURL, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	if asURL.Scheme != ociScheme {
+		return nil, fmt.Errorf("not an oci reference: %s", u)
+	}
+	p := strings.Trim(asURL.Path, "/")
+	filename := path.Base(p)
+	archDir := path.Dir(p)
+	repository := path.Dir(archDir)
+	if asURL.Host == "" || repository == "." || repository == "" {
+		return nil, fmt.Errorf("invalid oci reference %s, expected oci://<registry>/<repository>/<arch>/<file>", u)
+	}
+	return &ociReference{
+		registry:   asURL.Host,
+		repository: repository,
+		tag:        path.Base(archDir),
+		filename:   filename,
+	}, nil
+}
+
+// Fetch returns the contents of the file at u, an oci:// URL of an index or package.
+func (f *OCIFetcher) Fetch(ctx context.Context, u string) (io.ReadCloser, error) {
+	ref, err := parseOCIReference(u)
+	if err != nil {
+		return nil, err
+	}
+
+	// Always look at the latest manifest for the index, packages can use what the index came from.
+	manifest, err := f.manifest(ctx, ref, ref.filename == indexFilename)
+	if err != nil {
+		return nil, err
+	}
+	for _, layer := range manifest.Layers {
+		if layer.Annotations[ociTitleAnnotation] == ref.filename {
+			return f.blob(ctx, ref, layer)
+		}
+	}
+	return nil, fmt.Errorf("%s not found in %s/%s:%s", ref.filename, ref.registry, ref.repository, ref.tag)
+}
+
+func (f *OCIFetcher) manifest(ctx context.Context, ref *ociReference, refresh bool) (*ociManifest, error) {
+	key := fmt.Sprintf("%s/%s:%s", ref.registry, ref.repository, ref.tag)
+	if v, ok := f.manifests.Load(key); ok && !refresh {
+		return v.(*ociManifest), nil
+	}
+
+	u := fmt.Sprintf("https://%s/v2/%s/manifests/%s", ref.registry, ref.repository, ref.tag)
+	res, err := f.get(ctx, ref, u, ociManifestTypes)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var manifest ociManifest
+	if err := json.NewDecoder(res.Body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("parsing manifest %s: %w", key, err)
+	}
+	f.manifests.Store(key, &manifest)
+	return &manifest, nil
+}
+
+func (f *OCIFetcher) blob(ctx context.Context, ref *ociReference, desc ociDescriptor) (io.ReadCloser, error) {
+	algorithm, want, ok := strings.Cut(desc.Digest, ":")
+	if !ok || algorithm != "sha256" {
+		return nil, fmt.Errorf("unsupported digest %q for %s", desc.Digest, ref.filename)
+	}
+	u := fmt.Sprintf("https://%s/v2/%s/blobs/%s", ref.registry, ref.repository, desc.Digest)
+	res, err := f.get(ctx, ref, u, "")
+	if err != nil {
+		return nil, err
+	}
+	return &digestVerifyingReader{
+		ReadCloser: res.Body,
+		hash:       sha256.New(),
+		want:       want,
+	}, nil
+}
+
+// get performs a GET request against the registry of ref, authenticating when challenged.
+func (f *OCIFetcher) get(ctx context.Context, ref *ociReference, u, accept string) (*http.Response, error) {
+	scope := ref.registry + "/" + ref.repository
+	do := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if token, ok := f.tokens.Load(scope); ok {
+			req.Header.Set("Authorization", token.(string))
+		}
+		return f.client.Do(req)
+	}
+
+	res, err := do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get %s: %w", u, err)
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		challenge := res.Header.Get("WWW-Authenticate")
+		res.Body.Close()
+		if err := f.authenticate(ctx, ref, challenge); err != nil {
+			return nil, fmt.Errorf("authenticating to %s: %w", ref.registry, err)
+		}
+		if res, err = do(); err != nil {
+			return nil, fmt.Errorf("unable to get %s: %w", u, err)
+		}
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("unable to get %s: %v", u, res.Status)
+	}
+	return res, nil
+}
+
+// authenticate answers the WWW-Authenticate challenge of a registry, and remembers
+// the resulting Authorization header for the repository.
+func (f *OCIFetcher) authenticate(ctx context.Context, ref *ociReference, challenge string) error {
+	scope := ref.registry + "/" + ref.repository
+	creds, err := f.keychain.Resolve(ref.registry)
+	if err != nil {
+		return err
+	}
+
+	scheme, params := parseAuthChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if creds.Username == "" && creds.Password == "" {
+			return errors.New("registry requires credentials")
+		}
+		auth := base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Password))
+		f.tokens.Store(scope, "Basic "+auth)
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+
+	if creds.RegistryToken != "" {
+		f.tokens.Store(scope, "Bearer "+creds.RegistryToken)
+		return nil
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Scheme == "" {
+		return fmt.Errorf("invalid realm in challenge %q", challenge)
+	}
+	q := realm.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	q.Set("scope", fmt.Sprintf("repository:%s:pull", ref.repository))
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if creds.Username != "" || creds.Password != "" {
+		req.SetBasicAuth(creds.Username, creds.Password)
+	}
+	res, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("token request to %s: %v", realm.Host, res.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return fmt.Errorf("parsing token response: %w", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return errors.New("token response did not contain a token")
+	}
+	f.tokens.Store(scope, "Bearer "+token.Token)
+	return nil
+}
+
+// parseAuthChallenge splits a WWW-Authenticate header like
+// `Bearer realm="https://ghcr.io/token",service="ghcr.io"` into its scheme and parameters.
+func parseAuthChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := map[string]string{}
+	for rest != "" {
+		var key string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, ", "), "=")
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		if key != "" {
+			params[strings.ToLower(strings.TrimSpace(key))] = value
+		}
+	}
+	return scheme, params
+}
+
+// digestVerifyingReader fails the final Read if the content does not match its digest.
+type digestVerifyingReader struct {
+	io.ReadCloser
+	hash hash.Hash
+	want string
+}
+
+func (r *digestVerifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if errors.Is(err, io.EOF) {
+		if got := hex.EncodeToString(r.hash.Sum(nil)); got != r.want {
+			return n, fmt.Errorf("digest mismatch: expected sha256:%s, got sha256:%s", r.want, got)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,188 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// newTestRegistry serves the files in testPrimaryPkgDir as the layers of org/repo:<testArch>,
+// requiring a bearer token obtained with user:pass.
+func newTestRegistry(t *testing.T) *httptest.Server {
+	blobs := map[string][]byte{}
+	var layers []ociDescriptor
+	for _, name := range []string{indexFilename, "alpine-baselayout-3.2.0-r23.apk"} {
+		b, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, name))
+		require.NoError(t, err)
+		sum := sha256.Sum256(b)
+		digest := "sha256:" + hex.EncodeToString(sum[:])
+		blobs[digest] = b
+		layers = append(layers, ociDescriptor{
+			MediaType:   "application/octet-stream",
+			Digest:      digest,
+			Size:        int64(len(b)),
+			Annotations: map[string]string{ociTitleAnnotation: name},
+		})
+	}
+	manifest, err := json.Marshal(ociManifest{MediaType: "application/vnd.oci.image.manifest.v1+json", Layers: layers})
+	require.NoError(t, err)
+
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			require.Equal(t, "repository:org/repo:pull", r.URL.Query().Get("scope"))
+			fmt.Fprint(w, `{"token": "secret"}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.URL.Path == "/v2/org/repo/manifests/"+testArch:
+			_, _ = w.Write(manifest)
+		case strings.HasPrefix(r.URL.Path, "/v2/org/repo/blobs/"):
+			b, ok := blobs[strings.TrimPrefix(r.URL.Path, "/v2/org/repo/blobs/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write(b)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+type testKeychain map[string]OCICredentials
+
+func (k testKeychain) Resolve(registry string) (OCICredentials, error) {
+	return k[registry], nil
+}
+
+func TestOCIRepository(t *testing.T) {
+	srv := newTestRegistry(t)
+	registry := strings.TrimPrefix(srv.URL, "https://")
+	repo := fmt.Sprintf("oci://%s/org/repo", registry)
+	keychain := testKeychain{registry: {Username: "user", Password: "pass"}}
+
+	t.Run("index", func(t *testing.T) {
+		indexes, err := GetRepositoryIndexes(context.Background(), []string{repo}, testIndexKeys(), testArch,
+			withIndexCache(NewIndexCache()), WithFetcher(ociScheme, NewOCIFetcher(srv.Client(), keychain)))
+		require.NoError(t, err)
+		require.Len(t, indexes, 1)
+		require.Greater(t, indexes[0].Count(), 0)
+	})
+
+	t.Run("no credentials", func(t *testing.T) {
+		_, err := GetRepositoryIndexes(context.Background(), []string{repo}, testIndexKeys(), testArch,
+			withIndexCache(NewIndexCache()), WithFetcher(ociScheme, NewOCIFetcher(srv.Client(), testKeychain{})))
+		require.Error(t, err)
+	})
+
+	t.Run("index of an APK", func(t *testing.T) {
+		src := apkfs.NewMemFS()
+		require.NoError(t, src.MkdirAll(keysDirPath, 0o755))
+		require.NoError(t, src.WriteFile(archFilePath, []byte(testArch+"\n"), 0o644))
+		require.NoError(t, src.WriteFile(reposFilePath, []byte(repo+"\n"), 0o644))
+		a, err := New(WithFS(src), WithOCIKeychain(keychain))
+		require.NoError(t, err)
+		a.SetClient(srv.Client())
+
+		// the registry needs the credentials of the keychain of the APK
+		indexes, err := a.GetRepositoryIndexes(context.Background(), true)
+		require.NoError(t, err)
+		require.Len(t, indexes, 1)
+		require.Greater(t, indexes[0].Count(), 0)
+	})
+
+	t.Run("package", func(t *testing.T) {
+		a, err := New(WithFS(apkfs.NewMemFS()), WithOCIKeychain(keychain))
+		require.NoError(t, err)
+		a.SetClient(srv.Client())
+
+		repository := Repository{URI: fmt.Sprintf("%s/%s", repo, testArch)}
+		pkg := NewRepositoryPackage(&Package{Name: "alpine-baselayout", Version: "3.2.0-r23"}, repository.WithIndex(&APKIndex{}))
+		rc, err := a.FetchPackage(context.Background(), pkg)
+		require.NoError(t, err)
+		defer rc.Close()
+		got, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		want, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, "alpine-baselayout-3.2.0-r23.apk"))
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+
+		_, err = a.FetchPackage(context.Background(), NewRepositoryPackage(&Package{Name: "missing", Version: "1.0-r0"}, repository.WithIndex(&APKIndex{})))
+		require.ErrorContains(t, err, "missing-1.0-r0.apk not found")
+	})
+}
+
+func TestDockerConfigKeychain(t *testing.T) {
+	dir := t.TempDir()
+	cfg := filepath.Join(dir, "config.json")
+	require.NoError(t, os.WriteFile(cfg, []byte(`{"auths": {
+		"https://ghcr.io": {"auth": "dXNlcjpwYXNz"},
+		"registry.example.com": {"registrytoken": "token"}
+	}}`), 0o600))
+
+	k := DockerConfigKeychain(cfg)
+	creds, err := k.Resolve("ghcr.io")
+	require.NoError(t, err)
+	require.Equal(t, OCICredentials{Username: "user", Password: "pass"}, creds)
+
+	creds, err = k.Resolve("registry.example.com")
+	require.NoError(t, err)
+	require.Equal(t, OCICredentials{RegistryToken: "token"}, creds)
+
+	creds, err = k.Resolve("docker.io")
+	require.NoError(t, err)
+	require.Equal(t, OCICredentials{}, creds)
+
+	creds, err = DockerConfigKeychain(filepath.Join(dir, "missing.json")).Resolve("ghcr.io")
+	require.NoError(t, err)
+	require.Equal(t, OCICredentials{}, creds)
+}
+
+func TestParseAuthChallenge(t *testing.T) {
+	scheme, params := parseAuthChallenge(`Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:org/repo:pull,push"`)
+	require.Equal(t, "Bearer", scheme)
+	require.Equal(t, map[string]string{
+		"realm":   "https://ghcr.io/token",
+		"service": "ghcr.io",
+		"scope":   "repository:org/repo:pull,push",
+	}, params)
+}
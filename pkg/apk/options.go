@@ -15,25 +15,57 @@
 package apk
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"time"
 
 	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
 )
 
 type opts struct {
-	executor          Executor
-	arch              string
-	ignoreMknodErrors bool
-	fs                apkfs.FullFS
-	version           string
-	cache             *cache
+	executor              Executor
+	scriptRunner          ScriptRunner
+	arch                  string
+	archSet               bool
+	ignoreMknodErrors     bool
+	fs                    apkfs.FullFS
+	version               string
+	cache                 *cache
+	indexCache            *IndexCache
+	allowInsecureHTTP     bool
+	ociKeychain           OCIKeychain
+	ignoreSignatures      bool
+	allowUnsignedLocal    bool
+	allowMissingChecksums bool
+	keyPins               map[string]string
+	ignoreInstallIf       bool
+	lockfile              *Lockfile
+	plan                  *Plan
+	progress              ProgressReporter
+	resolverOptions       []ResolverOption
+	resolutionCache       ResolutionCache
+	downloadProgress      func(DownloadProgress)
+	maxPackageConcurrency int
+	packageCacheDir       string
+	packageCacheRehash    bool
+	deviceNodePolicy      DeviceNodePolicy
+	continueOnScriptError bool
+	warnOnFileConflicts   bool
+	protectedPaths        []string
+	lockTimeout           time.Duration
+	databaseDir           string
+	forceReinstall        bool
+	verifyInstalledFiles  int
 }
 
 type Option func(*opts) error
 
-// WithExecutor executor to use. Not currently used.
+// WithExecutor executor to use. Not currently used, see WithScripts to run scripts.
 func WithExecutor(executor Executor) Option {
 	return func(o *opts) error {
 		o.executor = executor
@@ -41,10 +73,31 @@ func WithExecutor(executor Executor) Option {
 	}
 }
 
+// WithScripts runs the .pre-install and .post-install scripts of packages with runner as
+// they are installed, .pre-upgrade and .post-upgrade when they are upgraded, and the .trigger
+// scripts of the PendingTriggers after. By default, scripts are only saved to the scripts
+// database.
+func WithScripts(runner ScriptRunner) Option {
+	return func(o *opts) error {
+		o.scriptRunner = runner
+		return nil
+	}
+}
+
+// WithContinueOnScriptError keeps installing packages when a script fails, logging the
+// failure, instead of failing the install. Default is false.
+func WithContinueOnScriptError(continueOnError bool) Option {
+	return func(o *opts) error {
+		o.continueOnScriptError = continueOnError
+		return nil
+	}
+}
+
 // WithArch sets the architecture to use. If not provided, will use the default runtime.GOARCH.
 func WithArch(arch string) Option {
 	return func(o *opts) error {
 		o.arch = arch
+		o.archSet = true
 		return nil
 	}
 }
@@ -66,6 +119,52 @@ func WithIgnoreMknodErrors(ignore bool) Option {
 	}
 }
 
+// WithDeviceNodePolicy sets what to do with the device nodes and FIFOs in packages, which is
+// to fail by default.
+func WithDeviceNodePolicy(policy DeviceNodePolicy) Option {
+	return func(o *opts) error {
+		switch policy {
+		case DeviceNodeError, DeviceNodeSkip, DeviceNodePlaceholder:
+		default:
+			return fmt.Errorf("unknown device node policy %d", policy)
+		}
+		o.deviceNodePolicy = policy
+		return nil
+	}
+}
+
+// WithWarnOnFileConflicts logs a FileConflictError as a warning, and lets the last package
+// installed have the file, instead of failing the install. Default is false.
+func WithWarnOnFileConflicts(warn bool) Option {
+	return func(o *opts) error {
+		o.warnOnFileConflicts = warn
+		return nil
+	}
+}
+
+// WithProtectedPaths keeps the files under the paths that match globs, like "etc" or
+// "usr/share/*/conf", when a package that has them is upgraded, if they were modified since
+// they were installed, like apk does. The new version of such a file is installed next to it,
+// with .apk-new added to its name. The globs are those of path.Match, and replace the default,
+// which is "etc"; with none, all files are replaced.
+func WithProtectedPaths(globs ...string) Option {
+	return func(o *opts) error {
+		paths := make([]string, 0, len(globs))
+		for _, p := range globs {
+			p = strings.Trim(p, "/")
+			if p == "" {
+				return errors.New("protected path must not be the root directory")
+			}
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid protected path %q: %w", p, err)
+			}
+			paths = append(paths, p)
+		}
+		o.protectedPaths = paths
+		return nil
+	}
+}
+
 // WithFS sets the filesystem to use. If not provided, will use the OS filesystem based at root /.
 func WithFS(fs apkfs.FullFS) Option {
 	return func(o *opts) error {
@@ -97,11 +196,253 @@ func WithCache(cacheDir string, offline bool) Option {
 	}
 }
 
+// WithIndexCache sets the in-memory cache of parsed repository indexes. Clients sharing
+// an IndexCache only fetch each remote index once. If not provided, a process-wide
+// cache is used.
+func WithIndexCache(c *IndexCache) Option {
+	return func(o *opts) error {
+		o.indexCache = c
+		return nil
+	}
+}
+
+// WithAllowInsecureHTTP allows fetching indexes, packages and keys from http:// URLs.
+// By default, only https:// and local repositories are supported.
+func WithAllowInsecureHTTP() Option {
+	return func(o *opts) error {
+		o.allowInsecureHTTP = true
+		return nil
+	}
+}
+
+// WithOCIKeychain sets the credentials to use for oci:// repositories.
+// If not provided, uses DockerConfigKeychain("").
+func WithOCIKeychain(keychain OCIKeychain) Option {
+	return func(o *opts) error {
+		o.ociKeychain = keychain
+		return nil
+	}
+}
+
+// WithIgnoreSignatureVerification sets whether to skip verifying the signatures of
+// repository indexes and packages. Default is false.
+func WithIgnoreSignatureVerification(ignore bool) Option {
+	return func(o *opts) error {
+		o.ignoreSignatures = ignore
+		return nil
+	}
+}
+
+// WithAllowUnsignedLocalPackages allows installing unsigned packages from local
+// repositories. Packages from remote repositories must always be signed.
+func WithAllowUnsignedLocalPackages() Option {
+	return func(o *opts) error {
+		o.allowUnsignedLocal = true
+		return nil
+	}
+}
+
+// WithAllowMissingChecksums allows installing packages whose index does not record
+// the checksum of their control section. Their size is still checked, if recorded.
+func WithAllowMissingChecksums() Option {
+	return func(o *opts) error {
+		o.allowMissingChecksums = true
+		return nil
+	}
+}
+
+// WithPinnedKeys sets the hex sha256 digests the keys at the given URLs or paths must
+// have. InitKeyring installs these keys, and fails if any of them does not match.
+func WithPinnedKeys(pins map[string]string) Option {
+	return func(o *opts) error {
+		if o.keyPins == nil {
+			o.keyPins = map[string]string{}
+		}
+		for location, digest := range pins {
+			o.keyPins[location] = digest
+		}
+		return nil
+	}
+}
+
+// WithIgnoreInstallIf sets whether to skip packages that would only be installed because
+// their install_if is satisfied. Default is false.
+func WithIgnoreInstallIf(ignore bool) Option {
+	return func(o *opts) error {
+		o.ignoreInstallIf = ignore
+		return nil
+	}
+}
+
+// WithLockfile installs exactly the packages in the lockfile, instead of resolving the world.
+// Each package is fetched from the repository it was locked from and must still match its
+// checksum.
+func WithLockfile(lock *Lockfile) Option {
+	return func(o *opts) error {
+		if lock == nil {
+			return errors.New("lockfile must not be nil")
+		}
+		o.lockfile = lock
+		return nil
+	}
+}
+
+// WithProgress sends reporter the ProgressEvents of resolving the world, fetching packages and
+// installing them. By default, there is no reporting.
+func WithProgress(reporter ProgressReporter) Option {
+	return func(o *opts) error {
+		if reporter == nil {
+			return errors.New("progress reporter must not be nil")
+		}
+		o.progress = reporter
+		return nil
+	}
+}
+
+// WithPlan makes FixateWorld execute plan, as returned by PlanWorld, instead of resolving the
+// world. It fails with a StalePlanError if the repository indexes or the installed packages
+// have changed since.
+func WithPlan(plan *Plan) Option {
+	return func(o *opts) error {
+		if plan == nil {
+			return errors.New("plan must not be nil")
+		}
+		o.plan = plan
+		return nil
+	}
+}
+
+// WithResolverOptions sets options for the resolver used to resolve the world, such as
+// WithExcludedPackages.
+func WithResolverOptions(options ...ResolverOption) Option {
+	return func(o *opts) error {
+		o.resolverOptions = append(o.resolverOptions, options...)
+		return nil
+	}
+}
+
+// WithResolutionCache reuses resolutions of the world from cache, as long as the repository
+// indexes, the world and the resolver options are unchanged. See ResolutionCache.
+func WithResolutionCache(cache ResolutionCache) Option {
+	return func(o *opts) error {
+		if cache == nil {
+			return errors.New("resolution cache must not be nil")
+		}
+		o.resolutionCache = cache
+		return nil
+	}
+}
+
+// WithDownloadProgress calls fn with the download events of packages, before they are
+// passed to the ProgressReporter set with WithProgress. It is called from the goroutines
+// downloading packages, so it may be called concurrently. With WithCache, an interrupted
+// download is resumed where it stopped the next time the package is fetched.
+//
+// Deprecated: use WithProgress, whose ProgressDownloadStarted, ProgressDownloadBytes and
+// ProgressDownloadFinished events have the same fields.
+func WithDownloadProgress(fn func(DownloadProgress)) Option {
+	return func(o *opts) error {
+		o.downloadProgress = fn
+		return nil
+	}
+}
+
+// WithMaxPackageConcurrency sets how many packages are fetched and expanded at the same time
+// when installing. They are installed one at a time in order regardless. The default is
+// defaultMaxPackageConcurrency.
+func WithMaxPackageConcurrency(n int) Option {
+	return func(o *opts) error {
+		if n < 1 {
+			return fmt.Errorf("package concurrency must be at least 1, got %d", n)
+		}
+		o.maxPackageConcurrency = n
+		return nil
+	}
+}
+
+// WithPackageCacheDir keeps the .apk files that are fetched in dir, named by the checksum of
+// their control section, and uses them instead of fetching them again, like apk's
+// --cache-dir. Any number of builds, including concurrent ones, can share dir. A cached
+// package is only used if it has the size it was cached with, unless WithPackageCacheRehash
+// is also set. See CleanPackageCache to keep its size in check.
+func WithPackageCacheDir(dir string) Option {
+	return func(o *opts) error {
+		if dir == "" {
+			return errors.New("package cache directory must not be empty")
+		}
+		o.packageCacheDir = dir
+		return nil
+	}
+}
+
+// WithPackageCacheRehash checks the SHA256 of all of each package found in the directory set
+// with WithPackageCacheDir before using it, instead of only its size.
+func WithPackageCacheRehash(rehash bool) Option {
+	return func(o *opts) error {
+		o.packageCacheRehash = rehash
+		return nil
+	}
+}
+
+// WithLockTimeout waits up to timeout for the lock of the database, lib/apk/db/lock, when
+// another process holds it, like apk's --wait. By default, the lock is not waited for.
+func WithLockTimeout(timeout time.Duration) Option {
+	return func(o *opts) error {
+		if timeout < 0 {
+			return errors.New("lock timeout must not be negative")
+		}
+		o.lockTimeout = timeout
+		return nil
+	}
+}
+
+// WithForceReinstall installs packages again even if they are already installed in the same
+// version, instead of skipping them, as an escape hatch for a root that was changed other than
+// with apk.
+func WithForceReinstall(force bool) Option {
+	return func(o *opts) error {
+		o.forceReinstall = force
+		return nil
+	}
+}
+
+// WithVerifyInstalledFiles checks up to sample files of each package that FixateWorld skips
+// because it is already installed, like Audit, and installs the package again if any of them is
+// missing or has changed. Files under the paths set with WithProtectedPaths are not checked,
+// as they are expected to be modified. By default, no files are checked.
+func WithVerifyInstalledFiles(sample int) Option {
+	return func(o *opts) error {
+		if sample < 0 {
+			return fmt.Errorf("sample of installed files must not be negative, got %d", sample)
+		}
+		o.verifyInstalledFiles = sample
+		return nil
+	}
+}
+
+// WithDatabaseDir sets the directory of the installed database, scripts.tar, triggers and the
+// lock file, relative to the root, for distributions that do not keep them in lib/apk/db, such
+// as usr/lib/apk/db. InitDB creates it.
+func WithDatabaseDir(dir string) Option {
+	return func(o *opts) error {
+		dir = path.Clean(strings.TrimPrefix(dir, "/"))
+		if dir == "." || dir == ".." || strings.HasPrefix(dir, "../") {
+			return fmt.Errorf("invalid database directory %q", dir)
+		}
+		o.databaseDir = dir
+		return nil
+	}
+}
+
 func defaultOpts() *opts {
 	fs := apkfs.DirFS("/")
 	return &opts{
-		arch:              ArchToAPK(runtime.GOARCH),
-		ignoreMknodErrors: false,
-		fs:                fs,
+		arch:                  ArchToAPK(runtime.GOARCH),
+		ignoreMknodErrors:     false,
+		fs:                    fs,
+		maxPackageConcurrency: defaultMaxPackageConcurrency,
+		progress:              NopProgressReporter{},
+		protectedPaths:        []string{defaultProtectedPath},
+		databaseDir:           defaultDatabaseDir,
 	}
 }
@@ -16,40 +16,72 @@ package apk
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
-	"encoding/base64"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/chainguard-dev/go-apk/pkg/expandapk"
-	"gopkg.in/ini.v1"
 )
 
 // PackageToInstalled takes a Package and returns it as the string representation of lines in a /lib/apk/db/installed file.
 func PackageToInstalled(pkg *Package) (out []string) {
+	// the fields and their order are those of apk, which leaves out most optional ones when empty
+	if len(pkg.Checksum) > 0 {
+		out = append(out, fmt.Sprintf("C:%s", pkg.ChecksumString()))
+	}
 	out = append(out, fmt.Sprintf("P:%s", pkg.Name))
 	out = append(out, fmt.Sprintf("V:%s", pkg.Version))
-	out = append(out, fmt.Sprintf("A:%s", pkg.Arch))
-	out = append(out, fmt.Sprintf("L:%s", pkg.License))
+	if pkg.Arch != "" {
+		out = append(out, fmt.Sprintf("A:%s", pkg.Arch))
+	}
+	out = append(out, fmt.Sprintf("S:%d", pkg.Size))
+	out = append(out, fmt.Sprintf("I:%d", pkg.InstalledSize))
 	out = append(out, fmt.Sprintf("T:%s", pkg.Description))
-	out = append(out, fmt.Sprintf("o:%s", pkg.Origin))
-	out = append(out, fmt.Sprintf("m:%s", pkg.Maintainer))
 	out = append(out, fmt.Sprintf("U:%s", pkg.URL))
-	out = append(out, fmt.Sprintf("D:%s", strings.Join(pkg.Dependencies, " ")))
-	out = append(out, fmt.Sprintf("p:%s", strings.Join(pkg.Provides, " ")))
+	out = append(out, fmt.Sprintf("L:%s", pkg.License))
+	if pkg.Origin != "" {
+		out = append(out, fmt.Sprintf("o:%s", pkg.Origin))
+	}
+	if pkg.Maintainer != "" {
+		out = append(out, fmt.Sprintf("m:%s", pkg.Maintainer))
+	}
+	if !pkg.BuildTime.IsZero() && pkg.BuildTime.Unix() != 0 {
+		out = append(out, fmt.Sprintf("t:%d", pkg.BuildTime.Unix()))
+	}
+	if pkg.RepoCommit != "" {
+		out = append(out, fmt.Sprintf("c:%s", pkg.RepoCommit))
+	}
+	if pkg.ProviderPriority != 0 {
+		out = append(out, fmt.Sprintf("k:%d", pkg.ProviderPriority))
+	}
+	if len(pkg.Dependencies) != 0 {
+		out = append(out, fmt.Sprintf("D:%s", strings.Join(pkg.Dependencies, " ")))
+	}
+	if len(pkg.Provides) != 0 {
+		out = append(out, fmt.Sprintf("p:%s", strings.Join(pkg.Provides, " ")))
+	}
+	if len(pkg.InstallIf) != 0 {
+		out = append(out, fmt.Sprintf("i:%s", strings.Join(pkg.InstallIf, " ")))
+	}
 	if len(pkg.Replaces) != 0 {
 		out = append(out, fmt.Sprintf("r:%s", strings.Join(pkg.Replaces, " ")))
 	}
-	out = append(out, fmt.Sprintf("c:%s", pkg.RepoCommit))
-	out = append(out, fmt.Sprintf("i:%s", pkg.InstallIf))
-	out = append(out, fmt.Sprintf("t:%d", pkg.BuildTime.Unix()))
-	out = append(out, fmt.Sprintf("S:%d", pkg.Size))
-	out = append(out, fmt.Sprintf("I:%d", pkg.InstalledSize))
-	out = append(out, fmt.Sprintf("k:%d", pkg.ProviderPriority))
-	if len(pkg.Checksum) > 0 {
-		out = append(out, fmt.Sprintf("C:%s", pkg.ChecksumString()))
+	if pkg.ReplacesPriority != 0 {
+		out = append(out, fmt.Sprintf("q:%d", pkg.ReplacesPriority))
+	}
+	for _, field := range pkg.ExtraFields {
+		out = append(out, fmt.Sprintf("%s:%s", field.Key, field.Value))
 	}
 
 	return
@@ -65,15 +97,16 @@ type InstallablePackage interface {
 // Package represents a single package with the information present in an
 // APKINDEX.
 type Package struct {
-	Name             string `ini:"pkgname"`
-	Version          string `ini:"pkgver"`
-	Arch             string `ini:"arch"`
-	Description      string `ini:"pkgdesc"`
-	License          string `ini:"license"`
-	Origin           string `ini:"origin"`
-	Maintainer       string `ini:"maintainer"`
-	URL              string `ini:"url"`
-	Checksum         []byte
+	Name        string `ini:"pkgname"`
+	Version     string `ini:"pkgver"`
+	Arch        string `ini:"arch"`
+	Description string `ini:"pkgdesc"`
+	License     string `ini:"license"`
+	Origin      string `ini:"origin"`
+	Maintainer  string `ini:"maintainer"`
+	URL         string `ini:"url"`
+	// Checksum is the checksum of the control section of the package, C: in an index.
+	Checksum         Checksum
 	Dependencies     []string `ini:"depend,,allowshadow"`
 	Provides         []string `ini:"provides,,allowshadow"`
 	InstallIf        []string
@@ -81,10 +114,24 @@ type Package struct {
 	InstalledSize    uint64
 	ProviderPriority uint64 `ini:"provider_priority"`
 	BuildTime        time.Time
-	BuildDate        int64    `ini:"builddate"`
-	RepoCommit       string   `ini:"commit"`
-	Replaces         []string `ini:"replaces,,allowshadow"`
-	DataHash         string   `ini:"datahash"`
+	BuildDate        int64 `ini:"builddate"`
+	// RepoCommit is the commit of the packaging repository the package was built from,
+	// c: in an index.
+	RepoCommit string   `ini:"commit"`
+	Replaces   []string `ini:"replaces,,allowshadow"`
+	// ReplacesPriority decides which of two packages that replace each other keeps a file
+	// they both contain: the higher one does.
+	ReplacesPriority uint64 `ini:"replaces_priority"`
+	DataHash         string `ini:"datahash"`
+	// ExtraFields are the fields of the package in an index or the installed database that
+	// are not known, in the order they were read. They are written back after the known fields.
+	ExtraFields []IndexField `ini:"-"`
+}
+
+// IndexField is a field of a package in an index, like the "x" and "1" of "x:1".
+type IndexField struct {
+	Key   string
+	Value string
 }
 
 func (p *Package) String() string {
@@ -98,9 +145,13 @@ func (p *Package) Filename() string {
 	return p.Name + "-" + p.Version + ".apk"
 }
 
-// ChecksumString returns a human-readable version of the control section checksum.
+// ChecksumString returns a human-readable version of the control section checksum. It is
+// Checksum.String, except that it is "Q1" for a package without a checksum.
 func (p *Package) ChecksumString() string {
-	return "Q1" + base64.StdEncoding.EncodeToString(p.Checksum)
+	if len(p.Checksum) == 0 {
+		return "Q1"
+	}
+	return p.Checksum.String()
 }
 
 // ParsePackage parses a .apk file and returns a Package struct
@@ -121,19 +172,120 @@ func ParsePackage(ctx context.Context, apkPackage io.Reader) (*Package, error) {
 		return nil, fmt.Errorf("tarRead.Next(): %v", err)
 	}
 
-	cfg, err := ini.ShadowLoad(tarRead)
+	pkg, err := parsePkgInfo(tarRead)
 	if err != nil {
-		return nil, fmt.Errorf("ini.ShadowLoad(): %w", err)
+		return nil, err
 	}
-
-	pkg := new(Package)
-	if err = cfg.MapTo(pkg); err != nil {
-		return nil, fmt.Errorf("cfg.MapTo(): %w", err)
-	}
-	pkg.BuildTime = time.Unix(pkg.BuildDate, 0).UTC()
-	pkg.InstalledSize = pkg.Size
 	pkg.Size = uint64(expanded.Size)
 	pkg.Checksum = expanded.ControlHash
 
 	return pkg, nil
 }
+
+// parsePkgInfo parses a .PKGINFO file into a Package, with PkgInfo.Package.
+func parsePkgInfo(r io.Reader) (*Package, error) {
+	info, err := ParsePkgInfo(r)
+	if err != nil {
+		return nil, err
+	}
+	return PackageFromPkgInfo(info), nil
+}
+
+// PackageFromAPK reads a .apk file and returns its index entry, like apk index does: the
+// fields of its .PKGINFO, the size of the file and the checksum of its control section.
+// Unlike ParsePackage, it reads the file in a single pass without keeping any of it, and
+// does not check the contents of the data section other than against the datahash.
+func PackageFromAPK(r io.Reader) (*Package, error) {
+	cr := &hashingByteReader{r: bufio.NewReader(r)}
+	zr := new(gzip.Reader)
+
+	var pkg *Package
+	for pkg == nil {
+		// Each section is a gzip stream, and the control section is the one with .PKGINFO.
+		h := sha1.New() //nolint:gosec // this is what apk tools is using
+		cr.h = h
+		if err := zr.Reset(cr); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, errors.New("package has no .PKGINFO")
+			}
+			return nil, fmt.Errorf("reading package section: %w", err)
+		}
+		zr.Multistream(false)
+
+		tr := tar.NewReader(zr)
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("reading package section: %w", err)
+			}
+			if hdr.Name != ".PKGINFO" {
+				continue
+			}
+			if pkg, err = parsePkgInfo(tr); err != nil {
+				return nil, fmt.Errorf("parsing .PKGINFO: %w", err)
+			}
+		}
+		// Read the rest of the stream, so that all of it is in the checksum.
+		if _, err := io.Copy(io.Discard, zr); err != nil {
+			return nil, fmt.Errorf("reading package section: %w", err)
+		}
+		if pkg != nil {
+			pkg.Checksum = h.Sum(nil)
+		}
+	}
+
+	// The rest is the data section.
+	h := sha256.New()
+	cr.h = h
+	if _, err := io.Copy(io.Discard, cr); err != nil {
+		return nil, fmt.Errorf("reading data section: %w", err)
+	}
+	if pkg.DataHash != "" {
+		if want, err := hex.DecodeString(pkg.DataHash); err == nil && !bytes.Equal(want, h.Sum(nil)) {
+			return nil, &expandapk.DataHashMismatchError{Expected: want, Actual: h.Sum(nil)}
+		}
+	}
+	pkg.Size = uint64(cr.n)
+	return pkg, nil
+}
+
+// PackageFromAPKFile is PackageFromAPK for the .apk file at path.
+func PackageFromAPKFile(path string) (*Package, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	pkg, err := PackageFromAPK(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return pkg, nil
+}
+
+// hashingByteReader hashes and counts the bytes read through it. It is an io.ByteReader, so
+// that a gzip.Reader reading from it does not read past the end of its stream.
+type hashingByteReader struct {
+	r *bufio.Reader
+	h hash.Hash
+	n int64
+}
+
+func (r *hashingByteReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *hashingByteReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.h.Write([]byte{b})
+		r.n++
+	}
+	return b, err
+}
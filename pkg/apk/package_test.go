@@ -1,12 +1,24 @@
 package apk
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+	"github.com/chainguard-dev/go-apk/pkg/tarball"
 )
 
 func TestParsePackage(t *testing.T) {
@@ -80,6 +92,183 @@ func TestParsePackage(t *testing.T) {
 			if d := cmp.Diff(c.want, got); d != "" {
 				t.Errorf("ParsePackage() mismatch (-want  got):\n%s", d)
 			}
+
+			got, err = PackageFromAPKFile("testdata/" + c.apk)
+			if err != nil {
+				t.Fatalf("PackageFromAPKFile(): %v", err)
+			}
+			if d := cmp.Diff(c.want, got); d != "" {
+				t.Errorf("PackageFromAPKFile() mismatch (-want  got):\n%s", d)
+			}
 		})
 	}
 }
+
+func TestPackageFromAPK(t *testing.T) {
+	b, err := os.ReadFile("testdata/hello-0.1.0-r0.apk")
+	if err != nil {
+		t.Fatalf("reading apk: %v", err)
+	}
+
+	t.Run("index entry", func(t *testing.T) {
+		pkg, err := PackageFromAPK(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("PackageFromAPK(): %v", err)
+		}
+		var entry bytes.Buffer
+		if err := apkIndexTemplate.Execute(&entry, pkg); err != nil {
+			t.Fatalf("executing template: %v", err)
+		}
+		want := "C:Q1DNWZeWkviN7MJedLpYM8yBvmnGM=\nP:hello\nV:0.1.0-r0\nA:x86_64\nS:499\nI:4117\nT:just a test package\nL:Apache-2.0\nt:0\nD:busybox\n\n"
+		if d := cmp.Diff(want, entry.String()); d != "" {
+			t.Errorf("index entry mismatch (-want  got):\n%s", d)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		if _, err := PackageFromAPK(bytes.NewReader(b[:len(b)/2])); err == nil {
+			t.Errorf("PackageFromAPK() of a truncated package succeeded")
+		}
+	})
+
+	t.Run("no control section", func(t *testing.T) {
+		if _, err := PackageFromAPK(bytes.NewReader(nil)); err == nil || !strings.Contains(err.Error(), "no .PKGINFO") {
+			t.Errorf("PackageFromAPK() of an empty file: %v", err)
+		}
+	})
+}
+
+func TestExpandApkDataHash(t *testing.T) {
+	expand := func(t *testing.T, pkg InstallablePackage) (missing bool, err error) {
+		f, err := os.Open(pkg.URL())
+		if err != nil {
+			t.Fatalf("opening apk: %v", err)
+		}
+		defer f.Close()
+		exp, err := expandapk.ExpandApk(context.Background(), f, t.TempDir(), expandapk.WithMissingDataHashHook(func(context.Context) {
+			missing = true
+		}))
+		if err == nil {
+			exp.Close()
+		}
+		return missing, err
+	}
+
+	missing, err := expand(t, &testPackage{file: "testdata/hello-wolfi-2.12.1-r0.apk"})
+	if err != nil || missing {
+		t.Errorf("ExpandApk() = %v, missing datahash %t; want verified", err, missing)
+	}
+
+	missing, err = expand(t, fakePackage(t, &Package{Name: "nodatahash"}, nil))
+	if err != nil || !missing {
+		t.Errorf("ExpandApk() = %v, missing datahash %t; want missing", err, missing)
+	}
+
+	_, err = expand(t, fakePackage(t, &Package{Name: "wrongdatahash", DataHash: strings.Repeat("ab", 32)}, nil))
+	var mismatch *expandapk.DataHashMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("ExpandApk() = %v, want DataHashMismatchError", err)
+	}
+	if got := hex.EncodeToString(mismatch.Expected); got != strings.Repeat("ab", 32) {
+		t.Errorf("DataHashMismatchError.Expected = %s", got)
+	}
+}
+
+// zstdPackage returns an unsigned package with a gzip control section and a zstd data section,
+// like apk-tools writes.
+func zstdPackage(t *testing.T) []byte {
+	t.Helper()
+
+	m := apkfs.NewMemFS()
+	if err := m.MkdirAll("usr/bin", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteFile("usr/bin/hi", []byte("#!/bin/sh\necho hi\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	tc, err := tarball.NewContext(tarball.WithCompression(tarball.CompressionZstd), tarball.WithUseChecksums(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data bytes.Buffer
+	if err := tc.WriteTargz(context.Background(), &data, m, m); err != nil {
+		t.Fatal(err)
+	}
+	datahash := sha256.Sum256(data.Bytes())
+
+	var control bytes.Buffer
+	zw := gzip.NewWriter(&control)
+	tw := tar.NewWriter(zw)
+	pkginfo := "pkgname = hi\npkgver = 1.0-r0\narch = x86_64\ndatahash = " + hex.EncodeToString(datahash[:]) + "\n"
+	if err := tw.WriteHeader(&tar.Header{Name: ".PKGINFO", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(pkginfo))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(pkginfo)); err != nil {
+		t.Fatal(err)
+	}
+	// The control section is a tar segment, without the end of the archive.
+	if err := tw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return append(control.Bytes(), data.Bytes()...)
+}
+
+func TestExpandZstdPackage(t *testing.T) {
+	b := zstdPackage(t)
+
+	exp, err := expandapk.ExpandApk(context.Background(), bytes.NewReader(b), t.TempDir())
+	if err != nil {
+		t.Fatalf("ExpandApk(): %v", err)
+	}
+	defer exp.Close()
+	if exp.DataCompression != expandapk.CompressionZstd {
+		t.Errorf("DataCompression = %q, want zstd", exp.DataCompression)
+	}
+	if _, err := exp.TarFS.Stat("usr/bin/hi"); err != nil {
+		t.Errorf("TarFS.Stat(): %v", err)
+	}
+
+	// Without the uncompressed tar, PackageData decompresses the data section again.
+	if err := os.Remove(exp.TarFile); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := exp.PackageData()
+	if err != nil {
+		t.Fatalf("PackageData(): %v", err)
+	}
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading package data: %v", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if d := cmp.Diff([]string{"usr", "usr/bin", "usr/bin/hi"}, names); d != "" {
+		t.Errorf("PackageData() mismatch (-want +got):\n%s", d)
+	}
+
+	stream, err := expandapk.ExpandApkStreaming(context.Background(), bytes.NewReader(b), "")
+	if err != nil {
+		t.Fatalf("ExpandApkStreaming(): %v", err)
+	}
+	defer stream.Close()
+	if stream.DataCompression != expandapk.CompressionZstd {
+		t.Errorf("streaming DataCompression = %q, want zstd", stream.DataCompression)
+	}
+	if _, err := io.Copy(io.Discard, stream.Data()); err != nil {
+		t.Fatalf("reading streaming data: %v", err)
+	}
+	if !stream.PackageHash.Equal(exp.PackageHash) {
+		t.Errorf("streaming PackageHash = %x, want %x", stream.PackageHash, exp.PackageHash)
+	}
+}
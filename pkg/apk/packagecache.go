@@ -0,0 +1,310 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// packageCache is a directory of .apk files named by the hex checksum of their control
+// section, like apk's --cache-dir, which any number of builds can share. Each .apk has a
+// .json file next to it with its size and SHA256, written after it, so that a package is
+// only in the cache once both are there.
+type packageCache struct {
+	dir string
+	// rehash checks the SHA256 of a cached package each time it is used, instead of only
+	// its size.
+	rehash bool
+}
+
+// packageCacheDigest is the .json file of a cached package.
+type packageCacheDigest struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func (c *packageCache) path(checksum Checksum) string {
+	return filepath.Join(c.dir, checksum.Hex()+".apk")
+}
+
+// digestPath returns the path of the .json file of the cached package at p.
+func digestPath(p string) string {
+	return strings.TrimSuffix(p, ".apk") + ".json"
+}
+
+// removeCachedPackage removes the cached package at p and its digest.
+func removeCachedPackage(p string) error {
+	// The digest first, so that the package is out of the cache before it is gone.
+	if err := os.Remove(digestPath(p)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.Remove(p)
+}
+
+// open returns the cached package with checksum, if it is in the cache and matches its
+// digest, and marks it as used.
+func (c *packageCache) open(checksum Checksum) (*os.File, error) {
+	p := c.path(checksum)
+	b, err := os.ReadFile(digestPath(p))
+	if err != nil {
+		return nil, err
+	}
+	var digest packageCacheDigest
+	if err := json.Unmarshal(b, &digest); err != nil {
+		return nil, fmt.Errorf("parsing digest of %s: %w", p, err)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.Size() != digest.Size {
+		f.Close()
+		return nil, fmt.Errorf("%s is %d bytes, expected %d", p, fi.Size(), digest.Size)
+	}
+	if c.rehash {
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != digest.SHA256 {
+			f.Close()
+			return nil, fmt.Errorf("%s has sha256 %s, expected %s", p, actual, digest.SHA256)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	// The modification time is when the package was last used, for CleanPackageCache.
+	now := time.Now()
+	_ = os.Chtimes(p, now, now)
+	return f, nil
+}
+
+// remove removes the package with checksum from the cache.
+func (c *packageCache) remove(checksum Checksum) error {
+	return removeCachedPackage(c.path(checksum))
+}
+
+// create returns a packageCacheEntry to write the package with checksum to, which is only
+// added to the cache when it is committed.
+func (c *packageCache) create(checksum Checksum) (*packageCacheEntry, error) {
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create package cache directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(c.dir, checksum.Hex()+"-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary package file: %w", err)
+	}
+	return &packageCacheEntry{cache: c, checksum: checksum, tmp: tmp, h: sha256.New()}, nil
+}
+
+// packageCacheEntry is a package in a packageCache: one that was found in it, or one being
+// written to it as it is fetched.
+type packageCacheEntry struct {
+	cache    *packageCache
+	checksum Checksum
+	// tmp is where a package that was not in the cache is written, nil if it was.
+	tmp  *os.File
+	h    hash.Hash
+	size int64
+	err  error
+}
+
+// Write writes to the temporary file of the package. Errors are kept for done, so that
+// failing to cache a package does not fail fetching it.
+func (e *packageCacheEntry) Write(p []byte) (int, error) {
+	if e.tmp == nil || e.err != nil {
+		return len(p), nil
+	}
+	if _, err := e.tmp.Write(p); err != nil {
+		e.err = err
+		return len(p), nil
+	}
+	e.h.Write(p)
+	e.size += int64(len(p))
+	return len(p), nil
+}
+
+// done finishes with the entry once the package has been verified, or not if ok is false.
+// A package that was written is added to the cache if it is ok, and a package found in the
+// cache is removed from it if it is not, in case it was corrupted.
+func (e *packageCacheEntry) done(ctx context.Context, ok bool) {
+	log := clog.FromContext(ctx)
+	if e.tmp == nil {
+		if !ok {
+			if err := e.cache.remove(e.checksum); err != nil {
+				log.Warnf("unable to remove %s from package cache: %v", e.cache.path(e.checksum), err)
+			}
+		}
+		return
+	}
+	defer os.Remove(e.tmp.Name())
+	err := errors.Join(e.err, e.tmp.Sync(), e.tmp.Close())
+	if !ok {
+		return
+	}
+	if err == nil {
+		err = e.commit()
+	}
+	if err != nil {
+		log.Warnf("unable to add %s to package cache: %v", e.cache.path(e.checksum), err)
+	}
+}
+
+// commit moves the package into place, and then writes its digest. Both are renamed into
+// place, so that concurrent builds caching the same package only ever see all of it.
+func (e *packageCacheEntry) commit() error {
+	p := e.cache.path(e.checksum)
+	if err := os.Rename(e.tmp.Name(), p); err != nil {
+		return err
+	}
+	b, err := json.Marshal(packageCacheDigest{Size: e.size, SHA256: hex.EncodeToString(e.h.Sum(nil))})
+	if err != nil {
+		return err
+	}
+	digest := digestPath(p)
+	tmp := digest + "." + filepath.Base(e.tmp.Name())
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, digest)
+}
+
+// fetchPackageCached is FetchPackage through the package cache, when there is one and pkg
+// has a checksum. The entry returned with the package must be written everything read from
+// it, and be done with once the package has been verified.
+func (a *APK) fetchPackageCached(ctx context.Context, pkg InstallablePackage) (io.ReadCloser, *packageCacheEntry, error) {
+	log := clog.FromContext(ctx)
+	if a.packageCache == nil {
+		rc, err := a.FetchPackage(ctx, pkg)
+		return rc, nil, err
+	}
+	checksum, err := ParseChecksum(pkg.ChecksumString())
+	if err != nil || len(checksum) == 0 {
+		rc, err := a.FetchPackage(ctx, pkg)
+		return rc, nil, err
+	}
+
+	f, err := a.packageCache.open(checksum)
+	if err == nil {
+		log.Debugf("package cache hit (%s)", pkg.PackageName())
+		return f, &packageCacheEntry{cache: a.packageCache, checksum: checksum}, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		log.Warnf("ignoring %s in package cache: %v", a.packageCache.path(checksum), err)
+	}
+
+	rc, err := a.FetchPackage(ctx, pkg)
+	if err != nil {
+		return nil, nil, err
+	}
+	entry, err := a.packageCache.create(checksum)
+	if err != nil {
+		log.Warnf("not caching %s: %v", pkg.PackageName(), err)
+		return rc, nil, nil
+	}
+	return rc, entry, nil
+}
+
+// CleanPackageCache removes packages from the directory set with WithPackageCacheDir, first
+// those that have not been used for maxAge, then those used least recently until there are
+// at most maxSize bytes of packages. Either is not a limit if it is 0. It also removes the
+// files of packages which were never finished, after maxAge.
+func (a *APK) CleanPackageCache(ctx context.Context, maxSize int64, maxAge time.Duration) error {
+	log := clog.FromContext(ctx)
+	if a.packageCache == nil {
+		return errors.New("no package cache directory set")
+	}
+	dir := a.packageCache.dir
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("unable to read package cache: %w", err)
+	}
+
+	type cached struct {
+		path    string
+		size    int64
+		lastUse time.Time
+	}
+	var (
+		packages []cached
+		total    int64
+		errs     []error
+	)
+	now := time.Now()
+	for _, de := range des {
+		info, err := de.Info()
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		p := filepath.Join(dir, de.Name())
+		old := maxAge > 0 && now.Sub(info.ModTime()) > maxAge
+		switch {
+		case strings.HasSuffix(de.Name(), ".tmp"):
+			if old {
+				errs = append(errs, os.Remove(p))
+			}
+		case strings.HasSuffix(de.Name(), ".apk"):
+			packages = append(packages, cached{path: p, size: info.Size(), lastUse: info.ModTime()})
+			total += info.Size()
+		}
+	}
+
+	// Oldest first.
+	sort.Slice(packages, func(i, j int) bool { return packages[i].lastUse.Before(packages[j].lastUse) })
+	for _, pkg := range packages {
+		old := maxAge > 0 && now.Sub(pkg.lastUse) > maxAge
+		if !old && (maxSize <= 0 || total <= maxSize) {
+			break
+		}
+		log.Debugf("removing %s from package cache", pkg.path)
+		if err := removeCachedPackage(pkg.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+			continue
+		}
+		total -= pkg.size
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("unable to clean package cache: %w", err)
+	}
+	return nil
+}
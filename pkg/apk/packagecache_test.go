@@ -0,0 +1,173 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testPackageCache(t *testing.T, rehash bool) (*APK, *testPackage, string) {
+	a, _, err := testGetTestAPK()
+	require.NoError(t, err)
+	dir := t.TempDir()
+	a.packageCache = &packageCache{dir: dir, rehash: rehash}
+
+	pkg := fakePackage(t, &Package{Name: "cached", Version: "1.0-r0"}, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+		{"etc/cached", 0o644, false, []byte("cached"), nil},
+	}).(*testPackage)
+	return a, pkg, dir
+}
+
+func cacheEntries(t *testing.T, dir string) []string {
+	des, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, de := range des {
+		names = append(names, de.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestPackageCache(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("reuses packages", func(t *testing.T) {
+		a, pkg, dir := testPackageCache(t, false)
+		exp, err := a.expandPackage(ctx, pkg)
+		require.NoError(t, err)
+		require.NoError(t, exp.Close())
+
+		checksum, err := ParseChecksum(pkg.checksum)
+		require.NoError(t, err)
+		require.Equal(t, []string{checksum.Hex() + ".apk", checksum.Hex() + ".json"}, cacheEntries(t, dir))
+		want, err := os.ReadFile(pkg.file)
+		require.NoError(t, err)
+		got, err := os.ReadFile(filepath.Join(dir, checksum.Hex()+".apk"))
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+
+		// The package is not fetched again.
+		require.NoError(t, os.Remove(pkg.file))
+		exp, err = a.expandPackage(ctx, pkg)
+		require.NoError(t, err)
+		require.NoError(t, exp.Close())
+	})
+
+	t.Run("ignores truncated packages", func(t *testing.T) {
+		a, pkg, dir := testPackageCache(t, false)
+		exp, err := a.expandPackage(ctx, pkg)
+		require.NoError(t, err)
+		require.NoError(t, exp.Close())
+
+		checksum, err := ParseChecksum(pkg.checksum)
+		require.NoError(t, err)
+		cached := filepath.Join(dir, checksum.Hex()+".apk")
+		require.NoError(t, os.Truncate(cached, 10))
+		exp, err = a.expandPackage(ctx, pkg)
+		require.NoError(t, err)
+		require.NoError(t, exp.Close())
+
+		// It was fetched and cached again.
+		fi, err := os.Stat(cached)
+		require.NoError(t, err)
+		require.Greater(t, fi.Size(), int64(10))
+	})
+
+	t.Run("rehash", func(t *testing.T) {
+		for _, rehash := range []bool{false, true} {
+			a, pkg, dir := testPackageCache(t, rehash)
+			exp, err := a.expandPackage(ctx, pkg)
+			require.NoError(t, err)
+			require.NoError(t, exp.Close())
+
+			// Corrupt the package without changing its size, and remove the original, so
+			// that only the corrupted package is left.
+			checksum, err := ParseChecksum(pkg.checksum)
+			require.NoError(t, err)
+			cached := filepath.Join(dir, checksum.Hex()+".apk")
+			b, err := os.ReadFile(cached)
+			require.NoError(t, err)
+			b[len(b)/2] ^= 0xff
+			require.NoError(t, os.WriteFile(cached, b, 0o644))
+			require.NoError(t, os.Remove(pkg.file))
+
+			_, err = a.expandPackage(ctx, pkg)
+			require.Error(t, err)
+			if rehash {
+				// It was not used, so it is still there.
+				require.Len(t, cacheEntries(t, dir), 2)
+			} else {
+				// It was used and failed, so it was removed.
+				require.Empty(t, cacheEntries(t, dir))
+			}
+		}
+	})
+
+	t.Run("does not cache unverified packages", func(t *testing.T) {
+		a, pkg, dir := testPackageCache(t, false)
+		pkg.checksum = "Q1" + "AAAAAAAAAAAAAAAAAAAAAAAAAAA="
+		_, err := a.expandPackage(ctx, pkg)
+		require.Error(t, err)
+		require.Empty(t, cacheEntries(t, dir))
+	})
+}
+
+func TestCleanPackageCache(t *testing.T) {
+	ctx := context.Background()
+	a, _, dir := testPackageCache(t, false)
+
+	now := time.Now()
+	write := func(name string, size int, age time.Duration) {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(p, make([]byte, size), 0o644))
+		require.NoError(t, os.Chtimes(p, now.Add(-age), now.Add(-age)))
+	}
+	write("old.apk", 10, 48*time.Hour)
+	write("old.json", 1, 48*time.Hour)
+	write("lru.apk", 100, 2*time.Hour)
+	write("lru.json", 1, time.Hour)
+	write("new.apk", 100, time.Minute)
+	write("new.json", 1, time.Minute)
+	write("abandoned-1.tmp", 5, 48*time.Hour)
+	write("writing-1.tmp", 5, time.Minute)
+
+	require.NoError(t, a.CleanPackageCache(ctx, 0, 0))
+	require.Len(t, cacheEntries(t, dir), 8)
+
+	require.NoError(t, a.CleanPackageCache(ctx, 0, 24*time.Hour))
+	require.Equal(t, []string{"lru.apk", "lru.json", "new.apk", "new.json", "writing-1.tmp"}, cacheEntries(t, dir))
+
+	require.NoError(t, a.CleanPackageCache(ctx, 150, 24*time.Hour))
+	require.Equal(t, []string{"new.apk", "new.json", "writing-1.tmp"}, cacheEntries(t, dir))
+
+	b, err := New(WithPackageCacheRehash(true))
+	require.NoError(t, err)
+	require.Error(t, b.CleanPackageCache(ctx, 0, 0), "no package cache directory")
+
+	_, err = New(WithPackageCacheDir(""))
+	require.Error(t, err)
+	b, err = New(WithPackageCacheDir(dir), WithPackageCacheRehash(true))
+	require.NoError(t, err)
+	require.Equal(t, &packageCache{dir: dir, rehash: true}, b.packageCache)
+}
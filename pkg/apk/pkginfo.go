@@ -0,0 +1,61 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"io"
+	"time"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+// PkgInfo is the .PKGINFO file of the control section of a package, see expandapk.PkgInfo.
+type PkgInfo = expandapk.PkgInfo
+
+// ParsePkgInfo parses a .PKGINFO file. Comments, blank lines and unknown keys are skipped.
+func ParsePkgInfo(r io.Reader) (*PkgInfo, error) {
+	return expandapk.ParsePkgInfo(r)
+}
+
+// WritePkgInfo writes info as a .PKGINFO file, in the order abuild writes the keys.
+func WritePkgInfo(w io.Writer, info *PkgInfo) error {
+	return expandapk.WritePkgInfo(w, info)
+}
+
+// PackageFromPkgInfo returns the package described by info. The size of a .PKGINFO is the
+// installed size, so it is InstalledSize, leaving Size and Checksum to the caller.
+func PackageFromPkgInfo(info *PkgInfo) *Package {
+	return &Package{
+		Name:             info.Name,
+		Version:          info.Version,
+		Arch:             info.Arch,
+		Description:      info.Description,
+		License:          info.License,
+		Origin:           info.Origin,
+		Maintainer:       info.Maintainer,
+		URL:              info.URL,
+		Dependencies:     info.Depends,
+		Provides:         info.Provides,
+		InstallIf:        info.InstallIf,
+		InstalledSize:    info.Size,
+		ProviderPriority: info.ProviderPriority,
+		BuildTime:        time.Unix(info.BuildDate, 0).UTC(),
+		BuildDate:        info.BuildDate,
+		RepoCommit:       info.Commit,
+		Replaces:         info.Replaces,
+		ReplacesPriority: info.ReplacesPriority,
+		DataHash:         info.DataHash,
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePkgInfo(t *testing.T) {
+	for _, tt := range []struct {
+		file string
+		want *PkgInfo
+	}{{
+		// Built by abuild, with a comment between the depend keys.
+		file: "alpine-baselayout-3.2.0-r23.PKGINFO",
+		want: &PkgInfo{
+			Name:        "alpine-baselayout",
+			Version:     "3.2.0-r23",
+			Description: "Alpine base dir structure and init scripts",
+			URL:         "https://git.alpinelinux.org/cgit/aports/tree/main/alpine-baselayout",
+			BuildDate:   1662926906,
+			Packager:    "Buildozer <alpine-devel@lists.alpinelinux.org>",
+			Size:        339968,
+			Arch:        "aarch64",
+			Origin:      "alpine-baselayout",
+			Commit:      "348653a9ba0701e8e968b3344e72313a9ef334e4",
+			Maintainer:  "Natanael Copa <ncopa@alpinelinux.org>",
+			License:     "GPL-2.0-only",
+			Depends:     []string{"alpine-baselayout-data=3.2.0-r23", "/bin/sh", "so:libc.musl-aarch64.so.1"},
+			Provides:    []string{"cmd:mkmntdirs=3.2.0-r23"},
+			DataHash:    "1a3a8e47d2287da6d505d973412cee1ad64bcc17bc5995069e4e932055ecb0c4",
+		},
+	}, {
+		// Built by melange.
+		file: "hello-wolfi-2.12.1-r0.PKGINFO",
+		want: &PkgInfo{
+			Name:        "hello-wolfi",
+			Version:     "2.12.1-r0",
+			Arch:        "x86_64",
+			Size:        640091,
+			Origin:      "hello-wolfi",
+			Description: "the GNU hello world program",
+			BuildDate:   12345678,
+			License:     "GPL-3.0-or-later",
+			Depends:     []string{"so:ld-linux-x86-64.so.2", "so:libc.so.6"},
+			Provides:    []string{"cmd:hello=2.12.1-r0"},
+			DataHash:    "3a6c21f20a07bebf261162b5ab13cb041d7c1cc3e1edc644aaa99f109f87d887",
+		},
+	}, {
+		file: "replaces-0.0.1-r0.PKGINFO",
+		want: &PkgInfo{
+			Name:        "replaces",
+			Version:     "0.0.1-r0",
+			Arch:        "aarch64",
+			Size:        2532,
+			Origin:      "replaces",
+			Description: "testdata with multiple replaces",
+			Replaces:    []string{"foo", "bar"},
+			DataHash:    "71b14cc95cf71f4f6c1666cb1699b3bc4f52d17f5575c893324c8f62bb19d9b3",
+		},
+	}} {
+		t.Run(tt.file, func(t *testing.T) {
+			f, err := os.Open("testdata/pkginfo/" + tt.file)
+			require.NoError(t, err)
+			defer f.Close()
+
+			info, err := ParsePkgInfo(f)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, info)
+
+			// What is written is read back the same.
+			var buf bytes.Buffer
+			require.NoError(t, WritePkgInfo(&buf, info))
+			again, err := ParsePkgInfo(&buf)
+			require.NoError(t, err)
+			require.Equal(t, info, again)
+		})
+	}
+
+	t.Run("install_if and triggers", func(t *testing.T) {
+		info, err := ParsePkgInfo(strings.NewReader(`pkgname = font-config
+pkgver = 1.0-r0
+install_if = fontconfig fonts=1.0-r0
+triggers = /usr/share/fonts/* /etc/fonts
+provider_priority = 10
+`))
+		require.NoError(t, err)
+		require.Equal(t, []string{"fontconfig", "fonts=1.0-r0"}, info.InstallIf)
+		require.Equal(t, []string{"/usr/share/fonts/*", "/etc/fonts"}, info.Triggers)
+		require.EqualValues(t, 10, info.ProviderPriority)
+
+		var buf bytes.Buffer
+		require.NoError(t, WritePkgInfo(&buf, info))
+		require.Equal(t, `pkgname = font-config
+pkgver = 1.0-r0
+size = 0
+arch = 
+provider_priority = 10
+install_if = fontconfig fonts=1.0-r0
+triggers = /usr/share/fonts/* /etc/fonts
+`, buf.String())
+
+		pkg := PackageFromPkgInfo(info)
+		require.Equal(t, "font-config", pkg.Name)
+		require.Equal(t, info.InstallIf, pkg.InstallIf)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ParsePkgInfo(strings.NewReader("pkgname = x\nsize = big\n"))
+		require.ErrorContains(t, err, "line 2 of .PKGINFO has invalid size")
+		_, err = ParsePkgInfo(strings.NewReader("pkgname\n"))
+		require.ErrorContains(t, err, "line 1 of .PKGINFO has no value")
+	})
+}
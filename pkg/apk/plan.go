@@ -0,0 +1,364 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/klauspost/compress/gzip"
+	"go.opentelemetry.io/otel"
+)
+
+// PlanVersion is the version of the plan format written by this package.
+const PlanVersion = 1
+
+// PlanAction is what a Plan does with a package.
+type PlanAction string
+
+const (
+	// PlanInstall installs a package that is not installed.
+	PlanInstall PlanAction = "install"
+	// PlanUpgrade replaces the installed version of a package, which may also be a downgrade.
+	PlanUpgrade PlanAction = "upgrade"
+	// PlanKeep leaves a package that is already installed as it is.
+	PlanKeep PlanAction = "keep"
+	// PlanRemove deletes an installed package that nothing needs anymore, see Autoremove.
+	PlanRemove PlanAction = "remove"
+)
+
+// Plan is what FixateWorld would do, as returned by PlanWorld, and can be serialized as JSON to
+// be reviewed before it is executed with WithPlan.
+type Plan struct {
+	Version int `json:"version"`
+	// Indexes are the repository indexes the plan was resolved from.
+	Indexes []PlannedIndex `json:"indexes,omitempty"`
+	// Packages are the packages of the world in install order, then those to remove.
+	Packages []PlannedPackage `json:"packages"`
+	// DownloadSize is the size of the packages that have to be downloaded.
+	DownloadSize uint64 `json:"download_size"`
+	// InstalledSizeDelta is how much the installed size of the packages changes.
+	InstalledSizeDelta int64 `json:"installed_size_delta"`
+}
+
+// PlannedIndex is a repository index of a Plan.
+type PlannedIndex struct {
+	Source string `json:"source"`
+	// SHA256 is the hex sha256 of the index archive, empty if it is not known, which makes the
+	// plan stale.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// PlannedPackage is a single package of a Plan. Removed packages have the Name, Version and
+// Arch of the installed package.
+type PlannedPackage struct {
+	LockedPackage
+	Action PlanAction `json:"action"`
+	// InstalledVersion is the version that is upgraded or removed.
+	InstalledVersion string `json:"installed_version,omitempty"`
+	Size             uint64 `json:"size,omitempty"`
+	InstalledSize    uint64 `json:"installed_size,omitempty"`
+	// Download is set if the package is not in a cache or a local file.
+	Download bool `json:"download,omitempty"`
+	// Scripts are the scripts of the package that run when it is installed or upgraded with
+	// WithScripts. They are only known for packages that are in the cache set with WithCache.
+	Scripts []string `json:"scripts,omitempty"`
+}
+
+// ReadPlan reads a Plan in JSON.
+func ReadPlan(r io.Reader) (*Plan, error) {
+	var plan Plan
+	if err := json.NewDecoder(r).Decode(&plan); err != nil {
+		return nil, fmt.Errorf("parsing plan: %w", err)
+	}
+	if plan.Version != PlanVersion {
+		return nil, fmt.Errorf("unsupported plan version %d, expected %d", plan.Version, PlanVersion)
+	}
+	return &plan, nil
+}
+
+// Write writes the plan as indented JSON.
+func (p *Plan) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// PlanWorld resolves the world like FixateWorld, and returns what it would install, upgrade and
+// keep, and what would be left for Autoremove after, without fetching any package or changing
+// anything.
+func (a *APK) PlanWorld(ctx context.Context) (*Plan, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "PlanWorld")
+	defer span.End()
+
+	pkgs, conflicts, indexes, err := a.resolveWorld(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting package dependencies: %w", err)
+	}
+	for _, name := range conflicts {
+		old, err := a.installedPackage(name)
+		if err != nil {
+			return nil, fmt.Errorf("error checking if package %s is installed: %w", name, err)
+		}
+		if old != nil {
+			return nil, fmt.Errorf("cannot install due to conflict with %s", name)
+		}
+	}
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read installed packages: %w", err)
+	}
+	byName := map[string]*InstalledPackage{}
+	for _, pkg := range installed {
+		byName[pkg.Name] = pkg
+	}
+
+	plan := &Plan{Version: PlanVersion}
+	for _, index := range indexes {
+		planned := PlannedIndex{Source: index.Source()}
+		if ci, ok := index.(ChecksumNamedIndex); ok && len(ci.Checksum()) != 0 {
+			planned.SHA256 = hex.EncodeToString(ci.Checksum())
+		}
+		plan.Indexes = append(plan.Indexes, planned)
+	}
+
+	// what is installed after, to find what is left over
+	after := map[string]*InstalledPackage{}
+	for _, pkg := range installed {
+		after[pkg.Name] = pkg
+	}
+	for _, pkg := range pkgs {
+		planned := PlannedPackage{
+			LockedPackage: lockedPackage(pkg),
+			Action:        PlanInstall,
+			Size:          pkg.Size,
+			InstalledSize: pkg.InstalledSize,
+		}
+		if old := byName[pkg.Name]; old != nil {
+			planned.InstalledVersion = old.Version
+			planned.Action = PlanUpgrade
+			if !isUpgrade(old, pkg.Package) {
+				planned.Action = PlanKeep
+			}
+		}
+		if planned.Action != PlanKeep {
+			planned.Download = !a.isPackageLocal(pkg)
+			planned.Scripts = a.plannedScripts(ctx, pkg, planned.Action)
+			if planned.Download {
+				plan.DownloadSize += pkg.Size
+			}
+			plan.InstalledSizeDelta += int64(pkg.InstalledSize)
+			if old := byName[pkg.Name]; old != nil {
+				plan.InstalledSizeDelta -= int64(old.InstalledSize)
+			}
+			after[pkg.Name] = &InstalledPackage{Package: *pkg.Package}
+		}
+		plan.Packages = append(plan.Packages, planned)
+	}
+
+	var remaining []*InstalledPackage
+	for _, pkg := range installed {
+		remaining = append(remaining, after[pkg.Name])
+	}
+	for _, pkg := range pkgs {
+		if byName[pkg.Name] == nil {
+			remaining = append(remaining, after[pkg.Name])
+		}
+	}
+	world, err := a.GetWorld()
+	if err != nil {
+		return nil, fmt.Errorf("error getting world packages: %w", err)
+	}
+	for _, pkg := range orphanedPackages(remaining, world) {
+		plan.Packages = append(plan.Packages, PlannedPackage{
+			LockedPackage:    LockedPackage{Name: pkg.Name, Version: pkg.Version, Arch: pkg.Arch},
+			Action:           PlanRemove,
+			InstalledVersion: pkg.Version,
+			InstalledSize:    pkg.InstalledSize,
+		})
+		plan.InstalledSizeDelta -= int64(pkg.InstalledSize)
+	}
+	return plan, nil
+}
+
+// isPackageLocal returns whether pkg can be installed without downloading it.
+func (a *APK) isPackageLocal(pkg *RepositoryPackage) bool {
+	u, err := packageAsURL(pkg)
+	if err == nil && u.Scheme == "file" {
+		return true
+	}
+	checksum, err := ParseChecksum(pkg.ChecksumString())
+	if err != nil || len(checksum) == 0 {
+		return false
+	}
+	if a.packageCache != nil {
+		if _, err := os.Stat(digestPath(a.packageCache.path(checksum))); err == nil {
+			return true
+		}
+	}
+	if a.cache != nil {
+		if dir, err := cacheDirForPackage(a.cache.dir, pkg); err == nil {
+			if _, err := os.Stat(filepath.Join(dir, checksum.Hex()+".ctl.tar.gz")); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// plannedScripts returns the scripts of pkg that run for action, if its control section is in
+// the cache.
+func (a *APK) plannedScripts(ctx context.Context, pkg *RepositoryPackage, action PlanAction) []string {
+	if a.cache == nil {
+		return nil
+	}
+	checksum, err := ParseChecksum(pkg.ChecksumString())
+	if err != nil || len(checksum) == 0 {
+		return nil
+	}
+	dir, err := cacheDirForPackage(a.cache.dir, pkg)
+	if err != nil {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(dir, checksum.Hex()+".ctl.tar.gz"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	run := map[string]bool{scriptPreInstall: true, scriptPostInstall: true}
+	if action == PlanUpgrade {
+		run = map[string]bool{scriptPreUpgrade: true, scriptPostUpgrade: true}
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		clog.FromContext(ctx).Debugf("unable to read cached control section of %s: %v", pkg.Name, err)
+		return nil
+	}
+	defer gz.Close()
+	var scripts []string
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				clog.FromContext(ctx).Debugf("unable to read cached control section of %s: %v", pkg.Name, err)
+			}
+			return scripts
+		}
+		if run[hdr.Name] {
+			scripts = append(scripts, hdr.Name)
+		}
+	}
+}
+
+// checkPlan returns a StalePlanError if the repository indexes or the installed packages have
+// changed since plan was made.
+func (a *APK) checkPlan(ctx context.Context, plan *Plan) error {
+	if len(plan.Indexes) != 0 {
+		indexes, err := a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
+		if err != nil {
+			return fmt.Errorf("error getting repository indexes: %w", err)
+		}
+		current := map[string]string{}
+		for _, index := range indexes {
+			var sum string
+			if ci, ok := index.(ChecksumNamedIndex); ok && len(ci.Checksum()) != 0 {
+				sum = hex.EncodeToString(ci.Checksum())
+			}
+			current[index.Source()] = sum
+		}
+		for _, index := range plan.Indexes {
+			sum, ok := current[index.Source]
+			if !ok {
+				return &StalePlanError{Reason: fmt.Sprintf("repository index %s is gone", index.Source)}
+			}
+			// an index that cannot be compared may have changed too
+			if sum == "" || index.SHA256 == "" {
+				return &StalePlanError{Reason: fmt.Sprintf("checksum of repository index %s is not known", index.Source)}
+			}
+			if sum != index.SHA256 {
+				return &StalePlanError{Reason: fmt.Sprintf("repository index %s has changed", index.Source)}
+			}
+		}
+	}
+
+	for _, planned := range plan.Packages {
+		old, err := a.installedPackage(planned.Name)
+		if err != nil {
+			return fmt.Errorf("error checking if package %s is installed: %w", planned.Name, err)
+		}
+		var version string
+		if old != nil {
+			version = old.Version
+		}
+		if version != planned.InstalledVersion {
+			return &StalePlanError{Reason: fmt.Sprintf("%s is installed in version %q, not %q", planned.Name, version, planned.InstalledVersion)}
+		}
+	}
+	return nil
+}
+
+// executePlan installs and removes the packages of plan, after checking it is not stale, and
+// returns what it did.
+func (a *APK) executePlan(ctx context.Context, sourceDateEpoch *time.Time, plan *Plan) (*FixateWorldSummary, error) {
+	if err := a.checkPlan(ctx, plan); err != nil {
+		return nil, err
+	}
+	summary := &FixateWorldSummary{}
+	lock := &Lockfile{Version: LockfileVersion}
+	for _, planned := range plan.Packages {
+		switch planned.Action {
+		case PlanInstall, PlanUpgrade:
+			lock.Packages = append(lock.Packages, planned.LockedPackage)
+			summary.Installed = append(summary.Installed, planned.Name)
+		case PlanKeep:
+			lock.Packages = append(lock.Packages, planned.LockedPackage)
+			summary.Skipped = append(summary.Skipped, planned.Name)
+		case PlanRemove:
+			summary.Removed = append(summary.Removed, planned.Name)
+		default:
+			return nil, fmt.Errorf("unknown action %q for %s in plan", planned.Action, planned.Name)
+		}
+	}
+	pkgs, err := lock.repositoryPackages()
+	if err != nil {
+		return nil, err
+	}
+	allInstPkgs := make([]InstallablePackage, len(pkgs))
+	for i, pkg := range pkgs {
+		allInstPkgs[i] = pkg
+	}
+	if err := a.installPackages(ctx, sourceDateEpoch, allInstPkgs, false, nil); err != nil {
+		return nil, err
+	}
+	if len(summary.Removed) == 0 {
+		return summary, nil
+	}
+	if err := a.deletePackages(ctx, false, summary.Removed); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanWorld(t *testing.T) {
+	ctx := context.Background()
+	epoch := time.Unix(1700000000, 0)
+	newAPK := func(t *testing.T, options ...Option) *APK {
+		a := newTestFetchAPK(t, nil, append([]Option{WithArch(testArch), WithIgnoreSignatureVerification(true)}, options...)...)
+		require.NoError(t, a.SetRepositories(ctx, []string{testAlpineRepos}))
+		require.NoError(t, a.SetWorld(ctx, []string{"alpine-baselayout"}))
+		return a
+	}
+
+	t.Run("plan", func(t *testing.T) {
+		a := newAPK(t)
+		require.NoError(t, a.addInstalledPackage(&Package{Name: "leftover", Version: "1.0-r0", InstalledSize: 10}, nil))
+		before, err := a.fs.ReadFile(a.installedFilePath())
+		require.NoError(t, err)
+
+		plan, err := a.PlanWorld(ctx)
+		require.NoError(t, err)
+		require.Equal(t, PlanVersion, plan.Version)
+		require.Len(t, plan.Indexes, 1)
+		require.Equal(t, testAlpineRepos+"/"+testArch+"/APKINDEX.tar.gz", plan.Indexes[0].Source)
+		require.NotEmpty(t, plan.Indexes[0].SHA256)
+
+		var download, installed uint64
+		actions := map[string]PlanAction{}
+		for _, pkg := range plan.Packages {
+			actions[pkg.Name] = pkg.Action
+			if pkg.Action == PlanInstall {
+				require.True(t, pkg.Download, pkg.Name)
+				download += pkg.Size
+				installed += pkg.InstalledSize
+			}
+		}
+		require.Equal(t, PlanInstall, actions["alpine-baselayout"])
+		require.Equal(t, PlanRemove, actions["leftover"])
+		last := plan.Packages[len(plan.Packages)-1]
+		require.Equal(t, "leftover", last.Name)
+		require.Equal(t, "1.0-r0", last.InstalledVersion)
+		require.Equal(t, download, plan.DownloadSize)
+		require.Equal(t, int64(installed)-10, plan.InstalledSizeDelta)
+
+		// nothing changed
+		after, err := a.fs.ReadFile(a.installedFilePath())
+		require.NoError(t, err)
+		require.Equal(t, before, after)
+
+		var buf bytes.Buffer
+		require.NoError(t, plan.Write(&buf))
+		read, err := ReadPlan(&buf)
+		require.NoError(t, err)
+		require.Equal(t, plan, read)
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		plan, err := newAPK(t).PlanWorld(ctx)
+		require.NoError(t, err)
+
+		changed := *plan
+		changed.Indexes = []PlannedIndex{{Source: plan.Indexes[0].Source, SHA256: "00"}}
+		var stale *StalePlanError
+		require.ErrorAs(t, newAPK(t, WithPlan(&changed)).FixateWorld(ctx, &epoch), &stale)
+		require.Contains(t, stale.Reason, "has changed")
+
+		unknown := *plan
+		unknown.Indexes = []PlannedIndex{{Source: plan.Indexes[0].Source}}
+		require.ErrorAs(t, newAPK(t, WithPlan(&unknown)).FixateWorld(ctx, &epoch), &stale)
+		require.Contains(t, stale.Reason, "not known")
+
+		a := newAPK(t, WithPlan(plan))
+		require.NoError(t, a.addInstalledPackage(&Package{Name: "alpine-baselayout", Version: "1.0-r0"}, nil))
+		require.ErrorAs(t, a.FixateWorld(ctx, &epoch), &stale)
+		require.Contains(t, stale.Reason, "alpine-baselayout")
+	})
+
+	t.Run("execute", func(t *testing.T) {
+		// The package file in the test repository is not the one in its index, so plan testPkg.
+		repo := Repository{URI: testAlpineRepos + "/" + testArch}
+		pkg := NewRepositoryPackage(&testPkg, repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}}))
+		plan := &Plan{Version: PlanVersion, Packages: []PlannedPackage{
+			{LockedPackage: lockedPackage(pkg), Action: PlanInstall},
+			{LockedPackage: LockedPackage{Name: "leftover", Version: "1.0-r0"}, Action: PlanRemove, InstalledVersion: "1.0-r0"},
+		}}
+		a := newAPK(t, WithPlan(plan))
+		require.NoError(t, a.addInstalledPackage(&Package{Name: "leftover", Version: "1.0-r0"}, nil))
+		require.NoError(t, a.FixateWorld(ctx, &epoch))
+		require.Equal(t, []string{testPkg.Name}, installedNames(t, a))
+	})
+}
@@ -0,0 +1,147 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"errors"
+	"io"
+)
+
+// ProgressKind is what a ProgressEvent is about.
+type ProgressKind string
+
+const (
+	// ProgressResolveStarted is sent when the world starts to be resolved.
+	ProgressResolveStarted ProgressKind = "resolve-started"
+	// ProgressResolveFinished is sent with the number of Packages the world resolved to.
+	ProgressResolveFinished ProgressKind = "resolve-finished"
+	// ProgressDownloadStarted is sent when a package starts to be fetched, with its Total
+	// size if it is known.
+	ProgressDownloadStarted ProgressKind = "download-started"
+	// ProgressDownloadBytes is sent as a package is fetched, with the bytes Done so far.
+	ProgressDownloadBytes ProgressKind = "download-bytes"
+	// ProgressDownloadFinished is sent when all of a package was fetched.
+	ProgressDownloadFinished ProgressKind = "download-finished"
+	// ProgressInstallStarted is sent when a package starts to be installed.
+	ProgressInstallStarted ProgressKind = "install-started"
+	// ProgressInstallFinished is sent when a package was installed, with its number of Files.
+	ProgressInstallFinished ProgressKind = "install-finished"
+	// ProgressDone is sent when all of the Packages were installed.
+	ProgressDone ProgressKind = "done"
+)
+
+// ProgressEvent is a step of resolving, fetching and installing packages, see WithProgress.
+type ProgressEvent struct {
+	Kind ProgressKind
+	// Package, Version and Repository identify the package of download and install events.
+	Package    string
+	Version    string
+	Repository string
+	// URL is where the package of download events is fetched from.
+	URL string
+	// Done and Total are bytes of download events. Total is 0 if it is not known.
+	Done  int64
+	Total int64
+	// Resumed is set for the download events of a download that continues an earlier one,
+	// whose bytes are in Done.
+	Resumed bool
+	// Files is the number of files and directories installed, for ProgressInstallFinished.
+	Files int
+	// Packages is the number of packages, for ProgressResolveFinished and ProgressDone.
+	Packages int
+}
+
+// ProgressReporter receives the ProgressEvents of an APK. Packages are fetched concurrently,
+// so Report must be safe to call from several goroutines.
+type ProgressReporter interface {
+	Report(event ProgressEvent)
+}
+
+// NopProgressReporter is the ProgressReporter used without WithProgress, which ignores all
+// events.
+type NopProgressReporter struct{}
+
+func (NopProgressReporter) Report(ProgressEvent) {}
+
+// progressEventEvery is how many bytes of a download are read between ProgressDownloadBytes.
+const progressEventEvery = 256 << 10
+
+// packageProgressEvent returns an event of kind for pkg.
+func packageProgressEvent(kind ProgressKind, pkg InstallablePackage) ProgressEvent {
+	event := ProgressEvent{Kind: kind, Package: pkg.PackageName(), Repository: pkg.URL()}
+	if rp, ok := pkg.(*RepositoryPackage); ok && rp.Package != nil {
+		event.Version = rp.Version
+		if repo := rp.Repository(); repo != nil {
+			event.Repository = repo.URI
+		}
+	}
+	return event
+}
+
+// progressReader reports the bytes of a package as they are read from the network, for
+// downloads that do not go through a downloader.
+type progressReader struct {
+	io.ReadCloser
+	reporter ProgressReporter
+	event    ProgressEvent
+	reported int64
+	finished bool
+}
+
+func newProgressReader(rc io.ReadCloser, reporter ProgressReporter, pkg InstallablePackage) *progressReader {
+	event := packageProgressEvent(ProgressDownloadStarted, pkg)
+	event.URL = pkg.URL()
+	event.Total = packageSize(pkg)
+	reporter.Report(event)
+	return &progressReader{ReadCloser: rc, reporter: reporter, event: event}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	p.event.Done += int64(n)
+	if p.event.Done-p.reported >= progressEventEvery {
+		p.event.Kind = ProgressDownloadBytes
+		p.reported = p.event.Done
+		p.reporter.Report(p.event)
+	}
+	// all of the package was fetched
+	if errors.Is(err, io.EOF) && !p.finished {
+		p.finished = true
+		p.event.Kind = ProgressDownloadFinished
+		p.reporter.Report(p.event)
+	}
+	return n, err
+}
+
+// downloadProgressReporter calls the function set with WithDownloadProgress with the download
+// events, and passes all events on to the ProgressReporter.
+type downloadProgressReporter struct {
+	ProgressReporter
+	fn func(DownloadProgress)
+}
+
+func (r *downloadProgressReporter) Report(event ProgressEvent) {
+	switch event.Kind {
+	case ProgressDownloadStarted, ProgressDownloadBytes, ProgressDownloadFinished:
+		r.fn(DownloadProgress{
+			Package: event.Package,
+			URL:     event.URL,
+			Done:    event.Done,
+			Total:   event.Total,
+			Resumed: event.Resumed,
+		})
+	}
+	r.ProgressReporter.Report(event)
+}
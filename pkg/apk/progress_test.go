@@ -0,0 +1,114 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testProgressReporter struct {
+	mu     sync.Mutex
+	events []ProgressEvent
+}
+
+func (r *testProgressReporter) Report(event ProgressEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *testProgressReporter) kinds() []ProgressKind {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var kinds []ProgressKind
+	for _, event := range r.events {
+		if event.Kind != ProgressDownloadBytes {
+			kinds = append(kinds, event.Kind)
+		}
+	}
+	return kinds
+}
+
+func TestProgress(t *testing.T) {
+	ctx := context.Background()
+	epoch := time.Unix(1700000000, 0)
+	reporter := &testProgressReporter{}
+	a := newTestFetchAPK(t, nil, WithArch(testArch), WithIgnoreSignatureVerification(true), WithProgress(reporter))
+
+	require.NoError(t, a.SetRepositories(ctx, []string{testAlpineRepos}))
+	require.NoError(t, a.SetWorld(ctx, []string{"alpine-baselayout"}))
+	pkgs, _, err := a.ResolveWorld(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []ProgressKind{ProgressResolveStarted, ProgressResolveFinished}, reporter.kinds())
+	require.Equal(t, len(pkgs), reporter.events[1].Packages)
+
+	reporter.events = nil
+	repo := Repository{URI: testAlpineRepos + "/" + testArch}
+	pkg := NewRepositoryPackage(&testPkg, repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}}))
+	require.NoError(t, a.InstallPackages(ctx, &epoch, []InstallablePackage{pkg}))
+	require.Equal(t, []ProgressKind{
+		ProgressDownloadStarted,
+		ProgressDownloadFinished,
+		ProgressInstallStarted,
+		ProgressInstallFinished,
+		ProgressDone,
+	}, reporter.kinds())
+
+	for _, event := range reporter.events[:len(reporter.events)-1] {
+		require.Equal(t, testPkg.Name, event.Package)
+		require.Equal(t, testPkg.Version, event.Version)
+		require.Equal(t, repo.URI, event.Repository)
+	}
+	started, finished := reporter.events[0], reporter.events[1]
+	require.Equal(t, packageSize(pkg), started.Total)
+	require.Positive(t, finished.Done)
+	require.Positive(t, reporter.events[3].Files)
+	require.Equal(t, 1, reporter.events[4].Packages)
+
+	_, err = New(WithProgress(nil))
+	require.Error(t, err)
+}
+
+func TestDownloadProgressEvents(t *testing.T) {
+	ctx := context.Background()
+	reporter := &testProgressReporter{}
+	var downloads []DownloadProgress
+	a := newTestFetchAPK(t, nil, WithArch(testArch), WithIgnoreSignatureVerification(true),
+		WithCache(t.TempDir(), false), WithProgress(reporter),
+		WithDownloadProgress(func(p DownloadProgress) { downloads = append(downloads, p) }))
+	repo := Repository{URI: testAlpineRepos + "/" + testArch}
+	pkg := NewRepositoryPackage(&testPkg, repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}}))
+
+	_, err := expandPackage(ctx, a, pkg)
+	require.NoError(t, err)
+	require.Equal(t, []ProgressKind{ProgressDownloadStarted, ProgressDownloadFinished}, reporter.kinds())
+	finished := reporter.events[len(reporter.events)-1]
+	require.Equal(t, pkg.URL(), finished.URL)
+	require.Positive(t, finished.Done)
+	require.Len(t, downloads, len(reporter.events))
+	require.Equal(t, finished.Done, downloads[len(downloads)-1].Done)
+
+	// found in the cache, so nothing is downloaded
+	reporter.events, downloads = nil, nil
+	_, err = expandPackage(ctx, a, pkg)
+	require.NoError(t, err)
+	require.Empty(t, reporter.events)
+	require.Empty(t, downloads)
+}
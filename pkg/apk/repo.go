@@ -15,14 +15,17 @@
 package apk
 
 import (
-	"bufio"
+	"bytes"
 	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/chainguard-dev/clog"
 	"github.com/hashicorp/go-hclog"
@@ -42,6 +45,46 @@ type NamedIndex interface {
 	Count() int
 }
 
+// StaleNamedIndex is a NamedIndex that knows whether it is a stale copy of its
+// repository. The indexes returned by GetRepositoryIndexes implement it.
+type StaleNamedIndex interface {
+	NamedIndex
+	// Stale returns whether the index could not be refreshed, and if so, when it
+	// was last fetched.
+	Stale() (fetched time.Time, stale bool)
+}
+
+// ChecksumNamedIndex is a NamedIndex that knows the checksum of the archive it was read from.
+// The indexes returned by GetRepositoryIndexes implement it.
+type ChecksumNamedIndex interface {
+	NamedIndex
+	// Checksum returns the sha256 of the index archive, or nil if it is not known.
+	Checksum() []byte
+}
+
+// ArchNamedIndex is a NamedIndex that knows which architecture it was fetched for.
+// The indexes returned by GetRepositoryIndexes implement it.
+type ArchNamedIndex interface {
+	NamedIndex
+	// Arch returns the architecture directory the index was fetched from.
+	Arch() string
+	// ArchFallback returns whether Arch is a fallback rather than the requested architecture.
+	ArchFallback() bool
+}
+
+// VerifiedNamedIndex is a NamedIndex that knows how its signature was verified.
+// The indexes returned by GetRepositoryIndexes implement it.
+type VerifiedNamedIndex interface {
+	NamedIndex
+	// SigningKeyName returns the name of the key that verified the index, if any.
+	SigningKeyName() string
+	// Verified returns whether the signature of the index was verified,
+	// which it is not with WithIgnoreSignatures.
+	Verified() bool
+	// Signature returns the raw signature of the index.
+	Signature() []byte
+}
+
 func indexNames(indexes []NamedIndex) []string {
 	names := make([]string, len(indexes))
 	for i, idx := range indexes {
@@ -53,6 +96,12 @@ func indexNames(indexes []NamedIndex) []string {
 type namedRepositoryWithIndex struct {
 	name string
 	repo *RepositoryWithIndex
+	// staleSince is when the index was fetched, if it could not be refreshed.
+	staleSince time.Time
+	// arch is the architecture directory the index was fetched from.
+	arch string
+	// archFallback is set when arch is not the architecture that was asked for.
+	archFallback bool
 }
 
 func NewNamedRepositoryWithIndex(name string, repo *RepositoryWithIndex) NamedIndex {
@@ -79,6 +128,43 @@ func (n *namedRepositoryWithIndex) Packages() []*RepositoryPackage {
 	}
 	return n.repo.Packages()
 }
+func (n *namedRepositoryWithIndex) Stale() (time.Time, bool) {
+	return n.staleSince, !n.staleSince.IsZero()
+}
+
+func (n *namedRepositoryWithIndex) Arch() string {
+	return n.arch
+}
+
+func (n *namedRepositoryWithIndex) ArchFallback() bool {
+	return n.archFallback
+}
+
+func (n *namedRepositoryWithIndex) SigningKeyName() string {
+	if n.repo == nil || n.repo.index == nil {
+		return ""
+	}
+	return n.repo.index.SigningKeyName
+}
+
+func (n *namedRepositoryWithIndex) Verified() bool {
+	return n.SigningKeyName() != ""
+}
+
+func (n *namedRepositoryWithIndex) Signature() []byte {
+	if n.repo == nil || n.repo.index == nil {
+		return nil
+	}
+	return n.repo.index.Signature
+}
+
+func (n *namedRepositoryWithIndex) Checksum() []byte {
+	if n.repo == nil || n.repo.index == nil {
+		return nil
+	}
+	return n.repo.index.Checksum
+}
+
 func (n *namedRepositoryWithIndex) Source() string {
 	if n.repo == nil || n.repo.IndexURI() == "" {
 		return ""
@@ -92,6 +178,10 @@ func (n *namedRepositoryWithIndex) Source() string {
 type repositoryPackage struct {
 	*RepositoryPackage
 	pinnedName string
+	// archFallback is set for packages from an index of a fallback architecture.
+	archFallback bool
+	// repoOrder is the position of the index of the package in the list passed to NewPkgResolver.
+	repoOrder int
 }
 
 // SetRepositories sets the contents of /etc/apk/repositories file.
@@ -104,17 +194,29 @@ func (a *APK) SetRepositories(ctx context.Context, repos []string) error {
 		return fmt.Errorf("must provide at least one repository")
 	}
 
-	data := strings.Join(repos, "\n") + "\n"
+	parsed := make([]Repository, 0, len(repos))
+	for _, repo := range repos {
+		r, err := parseRepositoryLine(repo)
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, r)
+	}
+	var data bytes.Buffer
+	if err := WriteRepositoriesFile(&data, parsed); err != nil {
+		return fmt.Errorf("failed to write apk repositories list: %w", err)
+	}
 
 	// #nosec G306 -- apk repositories must be publicly readable
 	if err := a.fs.WriteFile(filepath.Join("etc", "apk", "repositories"),
-		[]byte(data), 0o644); err != nil {
+		data.Bytes(), 0o644); err != nil {
 		return fmt.Errorf("failed to write apk repositories list: %w", err)
 	}
 
 	return nil
 }
 
+// GetRepositories returns the repositories in /etc/apk/repositories, pinned ones as `@name url`.
 func (a *APK) GetRepositories() (repos []string, err error) {
 	// get the repository URLs
 	reposFile, err := a.fs.Open(reposFilePath)
@@ -122,15 +224,29 @@ func (a *APK) GetRepositories() (repos []string, err error) {
 		return nil, fmt.Errorf("could not open repositories file in %s at %s: %w", a.fs, reposFilePath, err)
 	}
 	defer reposFile.Close()
-	scanner := bufio.NewScanner(reposFile)
-	for scanner.Scan() {
-		repos = append(repos, scanner.Text())
+	parsed, err := ParseRepositoriesFile(reposFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse repositories file in %s at %s: %w", a.fs, reposFilePath, err)
 	}
-	return
+	for _, repo := range parsed {
+		repos = append(repos, repo.String())
+	}
+	return repos, nil
+}
+
+// keyring returns the keys in /etc/apk/keys, by name.
+func (a *APK) keyring() (map[string][]byte, error) {
+	keys, err := KeysFromFS(a.fs, keysDirPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read keyring in %s: %w", a.fs, err)
+	}
+	return keys, nil
 }
 
 // GetRepositoryIndexes returns the indexes for the repositories in the specified root.
 // The signatures for each index are verified unless ignoreSignatures is set to true.
+// The indexes are for the architecture in etc/apk/arch, and errors are reported like those
+// of the package-level GetRepositoryIndexes.
 func (a *APK) GetRepositoryIndexes(ctx context.Context, ignoreSignatures bool) ([]NamedIndex, error) {
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "getRepositoryIndexes")
 	defer span.End()
@@ -155,22 +271,15 @@ func (a *APK) GetRepositoryIndexes(ctx context.Context, ignoreSignatures bool) (
 	arch := strings.TrimSuffix(string(archB), "\n")
 
 	// create the list of keys
-	keys := make(map[string][]byte)
-	dir, err := a.fs.ReadDir(keysDirPath)
+	keys, err := a.keyring()
 	if err != nil {
-		return nil, fmt.Errorf("could not read keys directory in %s at %s: %w", a.fs, keysDirPath, err)
-	}
-	for _, d := range dir {
-		if d.IsDir() {
-			continue
-		}
-		fullPath := filepath.Join(keysDirPath, d.Name())
-		b, err := a.fs.ReadFile(fullPath)
-		if err != nil {
-			return nil, fmt.Errorf("could not read key file at %s: %w", fullPath, err)
-		}
-		keys[d.Name()] = b
+		return nil, err
 	}
+	return GetRepositoryIndexes(ctx, repos, keys, arch, a.indexOptions(ignoreSignatures)...)
+}
+
+// indexOptions returns the options to fetch indexes with the client, cache and fetchers of a.
+func (a *APK) indexOptions(ignoreSignatures bool) []IndexOption {
 	httpClient := a.client
 	if httpClient == nil {
 		rhttp := retryablehttp.NewClient()
@@ -180,7 +289,11 @@ func (a *APK) GetRepositoryIndexes(ctx context.Context, ignoreSignatures bool) (
 	if a.cache != nil {
 		httpClient = a.cache.client(httpClient, true)
 	}
-	return GetRepositoryIndexes(ctx, repos, keys, arch, WithIgnoreSignatures(ignoreSignatures), WithHTTPClient(httpClient))
+	opts := []IndexOption{WithIgnoreSignatures(ignoreSignatures), WithHTTPClient(httpClient), withIndexCache(a.indexCache), withOCIFetcher(a.oci)}
+	if a.allowInsecureHTTP {
+		opts = append(opts, WithIndexAllowInsecureHTTP())
+	}
+	return opts
 }
 
 // PkgResolver resolves packages from a list of indexes.
@@ -197,13 +310,113 @@ type PkgResolver struct {
 	nameMap      map[string][]*repositoryPackage
 	installIfMap map[string][]*repositoryPackage // contains any package that should be installed if the named package is installed
 
-	parsedVersions map[string]packageVersion
+	parsedVersions map[string]Version
 	depForVersion  map[string]parsedConstraint
+
+	ignoreInstallIf bool
+	excluded        []string
+	ignoredDeps     []string
+	filters         []func(*RepositoryPackage) error
+	vetoes          map[*RepositoryPackage]string
+	ambiguous       map[string]AmbiguousProvider
+	last            *resolution
+
+	reverseOnce sync.Once
+	reverse     *reverseIndex
+}
+
+// ResolverOption configures a PkgResolver.
+type ResolverOption func(*PkgResolver)
+
+// WithResolverIgnoreInstallIf sets whether to skip adding packages whose install_if
+// is satisfied by the resolved packages, for results that depend only on what was asked for.
+func WithResolverIgnoreInstallIf(ignore bool) ResolverOption {
+	return func(p *PkgResolver) {
+		p.ignoreInstallIf = ignore
+	}
+}
+
+// WithExcludedPackages masks the packages with names matching any of the patterns, in the
+// syntax of path.Match. A masked package is never selected, including as the provider of a
+// virtual or because of its install_if, so resolving anything that requires one fails.
+func WithExcludedPackages(patterns ...string) ResolverOption {
+	return func(p *PkgResolver) {
+		p.excluded = append(p.excluded, patterns...)
+	}
+}
+
+// WithIgnoredDependencies drops any dependency of a package on a name matching any of the
+// patterns, in the syntax of path.Match, as if the package did not declare it. World entries
+// are not affected.
+func WithIgnoredDependencies(patterns ...string) ResolverOption {
+	return func(p *PkgResolver) {
+		p.ignoredDeps = append(p.ignoredDeps, patterns...)
+	}
+}
+
+// WithCandidateFilter adds a filter that is called for every candidate package before it
+// can be selected, whether for the world, as a dependency, as the provider of a virtual or
+// because of its install_if. A candidate for which it returns an error is never selected, and
+// the error is the reason given for it in the resolution report and in resolution errors.
+// Each filter is called at most once for each package.
+func WithCandidateFilter(filter func(*RepositoryPackage) error) ResolverOption {
+	return func(p *PkgResolver) {
+		p.filters = append(p.filters, filter)
+	}
+}
+
+// veto returns the reason pkg may never be selected, because it is excluded with
+// WithExcludedPackages or rejected by a filter from WithCandidateFilter, if it may not.
+func (p *PkgResolver) veto(pkg *RepositoryPackage) (string, bool) {
+	if pattern, excluded := matchesAny(p.excluded, pkg.Name); excluded {
+		return fmt.Sprintf("it is excluded by %q", pattern), true
+	}
+	if len(p.filters) == 0 {
+		return "", false
+	}
+	if reason, ok := p.vetoes[pkg]; ok {
+		return reason, reason != ""
+	}
+	var reason string
+	for _, filter := range p.filters {
+		if err := filter(pkg); err != nil {
+			reason = fmt.Sprintf("it is vetoed: %v", err)
+			break
+		}
+	}
+	p.vetoes[pkg] = reason
+	return reason, reason != ""
+}
+
+// matchesAny returns the first of patterns that name matches, if any. A malformed pattern
+// only matches itself.
+func matchesAny(patterns []string, name string) (string, bool) {
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, name); ok || (err != nil && pattern == name) {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// dependencies returns the dependencies of pkg, without those dropped by WithIgnoredDependencies.
+func (p *PkgResolver) dependencies(pkg *RepositoryPackage) []string {
+	if len(p.ignoredDeps) == 0 {
+		return slices.Clone(pkg.Dependencies)
+	}
+	deps := make([]string, 0, len(pkg.Dependencies))
+	for _, dep := range pkg.Dependencies {
+		name := p.resolvePackageNameVersionPin(strings.TrimPrefix(dep, "!")).name
+		if _, ignored := matchesAny(p.ignoredDeps, name); !ignored {
+			deps = append(deps, dep)
+		}
+	}
+	return deps
 }
 
 // NewPkgResolver creates a new pkgResolver from a list of indexes.
 // The indexes are anything that implements NamedIndex.
-func NewPkgResolver(_ context.Context, indexes []NamedIndex) *PkgResolver {
+func NewPkgResolver(_ context.Context, indexes []NamedIndex, opts ...ResolverOption) *PkgResolver {
 	numPackages := 0
 	for _, index := range indexes {
 		numPackages += index.Count()
@@ -212,20 +425,31 @@ func NewPkgResolver(_ context.Context, indexes []NamedIndex) *PkgResolver {
 	var (
 		pkgNameMap   = make(map[string][]*repositoryPackage, numPackages)
 		installIfMap = map[string][]*repositoryPackage{}
+		allPkgs      = make([]*repositoryPackage, 0, numPackages)
 	)
 	p := &PkgResolver{
 		indexes:        indexes,
-		parsedVersions: map[string]packageVersion{},
+		parsedVersions: map[string]Version{},
 		depForVersion:  map[string]parsedConstraint{},
+		ambiguous:      map[string]AmbiguousProvider{},
+		vetoes:         map[*RepositoryPackage]string{},
 	}
 
 	// create a map of every package by name and version to its RepositoryPackage
-	for _, index := range indexes {
+	for i, index := range indexes {
+		var archFallback bool
+		if archIndex, ok := index.(ArchNamedIndex); ok {
+			archFallback = archIndex.ArchFallback()
+		}
 		for _, pkg := range index.Packages() {
-			pkgNameMap[pkg.Name] = append(pkgNameMap[pkg.Name], &repositoryPackage{
+			rp := &repositoryPackage{
 				RepositoryPackage: pkg,
 				pinnedName:        index.Name(),
-			})
+				archFallback:      archFallback,
+				repoOrder:         i,
+			}
+			pkgNameMap[pkg.Name] = append(pkgNameMap[pkg.Name], rp)
+			allPkgs = append(allPkgs, rp)
 			for _, dep := range pkg.InstallIf {
 				if _, ok := installIfMap[dep]; !ok {
 					installIfMap[dep] = []*repositoryPackage{}
@@ -233,25 +457,24 @@ func NewPkgResolver(_ context.Context, indexes []NamedIndex) *PkgResolver {
 				installIfMap[dep] = append(installIfMap[dep], &repositoryPackage{
 					RepositoryPackage: pkg,
 					pinnedName:        index.Name(),
+					archFallback:      archFallback,
+					repoOrder:         i,
 				})
 			}
 		}
 	}
-	// create a map of every provided file to its package
-	allPkgs := make([][]*repositoryPackage, 0, len(pkgNameMap))
-	for _, pkgVersions := range pkgNameMap {
-		allPkgs = append(allPkgs, pkgVersions)
-	}
-	for _, pkgVersions := range allPkgs {
-		for _, pkg := range pkgVersions {
-			for _, provide := range pkg.Provides {
-				name := p.resolvePackageNameVersionPin(provide).name
-				pkgNameMap[name] = append(pkgNameMap[name], pkg)
-			}
+	// create a map of every provided file to its package, in index order
+	for _, pkg := range allPkgs {
+		for _, provide := range pkg.Provides {
+			name := p.resolvePackageNameVersionPin(provide).name
+			pkgNameMap[name] = append(pkgNameMap[name], pkg)
 		}
 	}
 	p.nameMap = pkgNameMap
 	p.installIfMap = installIfMap
+	for _, opt := range opts {
+		opt(p)
+	}
 	return p
 }
 
@@ -285,15 +508,16 @@ func (p *PkgResolver) nextPackage(packages []string, dq map[*RepositoryPackage]s
 	return next, nil
 }
 
-// Disqualify anything that provides "constraint". This is used for !foo style constraints.
-func (p *PkgResolver) disqualifyProviders(constraint string, dq map[*RepositoryPackage]string) {
+// Disqualify anything that provides "constraint". This is used for !foo style constraints,
+// where source names whatever declared the constraint.
+func (p *PkgResolver) disqualifyProviders(constraint, source string, dq map[*RepositoryPackage]string) {
 	parsed := p.resolvePackageNameVersionPin(constraint)
 	providers, ok := p.nameMap[parsed.name]
 	if !ok {
 		return
 	}
 
-	conflicting := p.filterPackages(providers, dq, withVersion(parsed.version, parsed.dep), withPreferPin(parsed.pin))
+	conflicting := p.filterPackages(providers, dq, withName(parsed.name), withVersion(parsed.version, parsed.dep), withPreferPin(parsed.pin))
 
 	for _, conflict := range conflicting {
 		if _, dqed := dq[conflict.RepositoryPackage]; dqed {
@@ -301,7 +525,7 @@ func (p *PkgResolver) disqualifyProviders(constraint string, dq map[*RepositoryP
 			continue
 		}
 
-		p.disqualify(dq, conflict.RepositoryPackage, "excluded by !"+constraint)
+		p.disqualify(dq, conflict.RepositoryPackage, "excluded by !"+constraint+" in "+source)
 	}
 }
 
@@ -337,10 +561,11 @@ func (p *PkgResolver) disqualify(dq map[*RepositoryPackage]string, pkg *Reposito
 
 // constrain looks through a list of constraints and disqualifies anything that would
 // conflict with any constraints that have a version selector (i.e. not versionAny).
-func (p *PkgResolver) constrain(constraints []string, dq map[*RepositoryPackage]string) error {
+// The source names whatever declared the constraints, for the disqualification reason.
+func (p *PkgResolver) constrain(constraints []string, source string, dq map[*RepositoryPackage]string) error {
 	for _, constraint := range constraints {
 		if strings.HasPrefix(constraint, "!") {
-			p.disqualifyProviders(constraint[1:], dq)
+			p.disqualifyProviders(constraint[1:], source, dq)
 			continue
 		}
 
@@ -403,19 +628,32 @@ func (p *PkgResolver) GetPackagesWithDependencies(ctx context.Context, packages
 
 	// Tracks all the packages we have disqualified and the reason we disqualified them.
 	dq := map[*RepositoryPackage]string{}
-
-	// We're going to mutate this as our set of input packages to install, so make a copy.
-	constraints := slices.Clone(packages)
+	// Reported even if the resolution fails, with what was selected until then.
+	last := &resolution{world: packages, dq: dq}
+	p.last = last
 
 	var (
 		dependenciesMap = make(map[string]*RepositoryPackage, len(packages))
 		installTracked  = map[string]*RepositoryPackage{}
 	)
 
-	if err := p.constrain(constraints, dq); err != nil {
+	if err := p.constrain(packages, "world", dq); err != nil {
 		return nil, nil, fmt.Errorf("constraining initial packages: %w", err)
 	}
 
+	// A !foo entry only excludes foo, which constrain has done, so there is nothing to resolve for it.
+	var wanted []string
+	for _, pkgName := range packages {
+		if name, ok := strings.CutPrefix(pkgName, "!"); ok {
+			conflicts = append(conflicts, name)
+			continue
+		}
+		wanted = append(wanted, pkgName)
+	}
+
+	// We're going to mutate this as our set of input packages to install, so make a copy.
+	constraints := slices.Clone(wanted)
+
 	for len(constraints) != 0 {
 		next, err := p.nextPackage(constraints, dq)
 		if err != nil {
@@ -439,35 +677,140 @@ func (p *PkgResolver) GetPackagesWithDependencies(ctx context.Context, packages
 	}
 
 	// now get the dependencies for each package
-	for _, pkgName := range packages {
+	for _, pkgName := range wanted {
 		pkg, deps, confs, err := p.GetPackageWithDependencies(pkgName, dependenciesMap, dq)
 		if err != nil {
+			last.selected = toInstall
 			return toInstall, nil, &ConstraintError{pkgName, err}
 		}
-		for _, dep := range deps {
+		for _, dep := range append(deps, pkg) {
 			if _, ok := installTracked[dep.Name]; !ok {
 				toInstall = append(toInstall, dep)
 				installTracked[dep.Name] = dep
+			} else {
+				replaceDisqualified(toInstall, installTracked, dep, dq)
 			}
 			if _, ok := dependenciesMap[dep.Name]; !ok {
 				dependenciesMap[dep.Name] = dep
+			} else {
+				replaceDisqualified(nil, dependenciesMap, dep, dq)
 			}
 		}
-		if _, ok := installTracked[pkg.Name]; !ok {
-			toInstall = append(toInstall, pkg)
-			installTracked[pkg.Name] = pkg
-		}
-		if _, ok := dependenciesMap[pkg.Name]; !ok {
-			dependenciesMap[pkg.Name] = pkg
-		}
 		conflicts = append(conflicts, confs...)
 	}
 
+	last.selected = toInstall
+	installIfDeps, confs, err := p.installIf(toInstall, dependenciesMap, dq)
+	if err != nil {
+		return nil, nil, err
+	}
+	toInstall = append(toInstall, installIfDeps...)
+	conflicts = append(conflicts, confs...)
+	last.selected = toInstall
+
 	conflicts = uniqify(conflicts)
 
+	if err := p.checkConflicts(wanted, toInstall); err != nil {
+		return nil, nil, err
+	}
+
 	return toInstall, conflicts, nil
 }
 
+// checkConflicts returns a ConflictError if any of the selected packages has a !foo dependency
+// that another selected package satisfies. This catches conflicts declared by a package that
+// was selected after the one it conflicts with.
+func (p *PkgResolver) checkConflicts(world []string, selected []*RepositoryPackage) error {
+	for _, pkg := range selected {
+		for _, dep := range pkg.Dependencies {
+			name, ok := strings.CutPrefix(dep, "!")
+			if !ok {
+				continue
+			}
+			constraint := p.resolvePackageNameVersionPin(name)
+			for _, other := range selected {
+				if other == pkg || !p.providesConstraint(other, constraint) {
+					continue
+				}
+				chains := p.requiredBy(world, selected)
+				return &ConflictError{
+					Package:       pkg,
+					Conflict:      other,
+					Constraint:    dep,
+					PackageChain:  chains[pkg],
+					ConflictChain: chains[other],
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// providesConstraint returns true if pkg is, or provides, the name in the constraint
+// at a version that satisfies it.
+func (p *PkgResolver) providesConstraint(pkg *RepositoryPackage, constraint parsedConstraint) bool {
+	versions := []string{}
+	if pkg.Name == constraint.name {
+		versions = append(versions, pkg.Version)
+	}
+	for _, prov := range pkg.Provides {
+		if provided := p.resolvePackageNameVersionPin(prov); provided.name == constraint.name {
+			versions = append(versions, provided.version)
+		}
+	}
+	for _, version := range versions {
+		if constraint.dep == versionAny {
+			return true
+		}
+		required, err := p.parseVersion(constraint.version)
+		if err != nil {
+			return false
+		}
+		if actual, err := p.parseVersion(version); err == nil && constraint.dep.satisfies(actual, required) {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredBy returns, for each selected package, the chain of package names that pulled it in,
+// starting from "world". Where several chains lead to a package, the shortest is used.
+func (p *PkgResolver) requiredBy(world []string, selected []*RepositoryPackage) map[*RepositoryPackage][]string {
+	byName := map[string][]*RepositoryPackage{}
+	for _, pkg := range selected {
+		byName[pkg.Name] = append(byName[pkg.Name], pkg)
+		for _, prov := range pkg.Provides {
+			name := p.resolvePackageNameVersionPin(prov).name
+			byName[name] = append(byName[name], pkg)
+		}
+	}
+
+	chains := map[*RepositoryPackage][]string{}
+	var queue []*RepositoryPackage
+	visit := func(names []string, chain []string) {
+		for _, name := range names {
+			if strings.HasPrefix(name, "!") {
+				continue
+			}
+			for _, pkg := range byName[p.resolvePackageNameVersionPin(name).name] {
+				if _, ok := chains[pkg]; ok {
+					continue
+				}
+				chains[pkg] = chain
+				queue = append(queue, pkg)
+			}
+		}
+	}
+
+	visit(world, []string{"world"})
+	for len(queue) != 0 {
+		pkg := queue[0]
+		queue = queue[1:]
+		visit(pkg.Dependencies, append(slices.Clone(chains[pkg]), pkg.Name))
+	}
+	return chains
+}
+
 // GetPackageWithDependencies get all of the dependencies for a single package as well as looking
 // up the package itself and resolving its version, based on the indexes.
 // Requires the existing set because the logic for resolving dependencies between competing
@@ -501,73 +844,169 @@ func (p *PkgResolver) GetPackageWithDependencies(pkgName string, existing map[st
 		if _, ok := added[dep.Name]; !ok {
 			dependencies = append(dependencies, dep)
 			added[dep.Name] = dep
+		} else {
+			replaceDisqualified(dependencies, added, dep, dq)
 		}
 	}
 	// are there any installIf dependencies?
-	for dep, depPkg := range added {
-		depPkgList, ok := p.installIfMap[dep]
-		if !ok {
-			depPkgList, ok = p.installIfMap[fmt.Sprintf("%s=%s", dep, depPkg.Version)]
-		}
-		if !ok {
-			continue
+	installIfDeps, confs, err := p.installIf(dependencies, localExisting, dq)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	dependencies = append(dependencies, installIfDeps...)
+	conflicts = append(conflicts, confs...)
+	return pkg, dependencies, conflicts, nil
+}
+
+// installIf repeatedly adds the best package whose install_if is satisfied by the selected
+// packages, after its own dependencies, until there are no more to add. It returns only
+// the added packages.
+func (p *PkgResolver) installIf(selected []*RepositoryPackage, existing map[string]*RepositoryPackage, dq map[*RepositoryPackage]string) (added []*RepositoryPackage, conflicts []string, err error) {
+	if p.ignoreInstallIf {
+		return nil, nil, nil
+	}
+
+	all := slices.Clone(selected)
+	localExisting := make(map[string]*RepositoryPackage, len(existing)+len(all))
+	existingOrigins := map[string]bool{}
+	for k, v := range existing {
+		localExisting[k] = v
+	}
+	for _, pkg := range all {
+		localExisting[pkg.Name] = pkg
+	}
+	for _, v := range localExisting {
+		if v != nil && v.Origin != "" {
+			existingOrigins[v.Origin] = true
 		}
-		// this package "dep" can trigger an installIf. It might not be enough, so check it
-		for _, installIfPkg := range depPkgList {
-			var matchCount int
-			for _, subDep := range installIfPkg.InstallIf {
-				// two possibilities: package name, or name=version
-				constraint := p.resolvePackageNameVersionPin(subDep)
-				name, version := constraint.name, constraint.version
-				// precise match of whatever it is, take it and continue
-				if _, ok := added[subDep]; ok {
-					matchCount++
-					continue
-				}
-				// didn't get a precise match, so check if the name and version match
-				if addedPkg, ok := added[name]; ok && addedPkg.Version == version {
-					matchCount++
-					continue
-				}
+	}
+
+	for {
+		var candidates []*repositoryPackage
+		seen := map[*RepositoryPackage]bool{}
+		for _, pkg := range all {
+			triggers := []string{pkg.Name, pkg.Name + "=" + pkg.Version}
+			for _, prov := range pkg.Provides {
+				triggers = append(triggers, prov, p.resolvePackageNameVersionPin(prov).name)
 			}
-			if matchCount == len(installIfPkg.InstallIf) {
-				// all dependencies are met, so add it
-				if _, ok := added[installIfPkg.Name]; !ok {
-					dependencies = append(dependencies, installIfPkg.RepositoryPackage)
-					added[installIfPkg.Name] = installIfPkg.RepositoryPackage
+			for _, trigger := range triggers {
+				for _, candidate := range p.installIfMap[trigger] {
+					// Packages from tagged repositories are only installed when asked for.
+					if seen[candidate.RepositoryPackage] || candidate.pinnedName != "" {
+						continue
+					}
+					seen[candidate.RepositoryPackage] = true
+					if _, ok := localExisting[candidate.Name]; ok {
+						continue
+					}
+					if _, dqed := dq[candidate.RepositoryPackage]; dqed {
+						continue
+					}
+					if reason, vetoed := p.veto(candidate.RepositoryPackage); vetoed {
+						p.disqualify(dq, candidate.RepositoryPackage, reason)
+						continue
+					}
+					if p.installIfSatisfied(candidate.RepositoryPackage, all) {
+						candidates = append(candidates, candidate)
+					}
 				}
 			}
 		}
+		if len(candidates) == 0 {
+			return added, conflicts, nil
+		}
+
+		name := candidates[0].Name
+		candidates = slices.DeleteFunc(candidates, func(c *repositoryPackage) bool {
+			return c.Name != name
+		})
+		pkg := p.bestPackage(candidates, nil, name, localExisting, existingOrigins, "").RepositoryPackage
+
+		deps, confs, err := p.getPackageDependencies(pkg, "", true, map[string]bool{}, maps.Clone(localExisting), maps.Clone(existingOrigins), dq)
+		if err != nil {
+			return nil, nil, &DepError{pkg, err}
+		}
+		for _, dep := range append(deps, pkg) {
+			if _, ok := localExisting[dep.Name]; ok && dep != pkg {
+				continue
+			}
+			added = append(added, dep)
+			all = append(all, dep)
+			localExisting[dep.Name] = dep
+			existingOrigins[dep.Origin] = true
+		}
+		conflicts = append(conflicts, confs...)
+	}
+}
+
+// installIfSatisfied returns true if every entry of the install_if of pkg is provided by one of
+// the selected packages, or for a !foo entry, by none of them.
+func (p *PkgResolver) installIfSatisfied(pkg *RepositoryPackage, selected []*RepositoryPackage) bool {
+	for _, entry := range pkg.InstallIf {
+		name, negated := strings.CutPrefix(entry, "!")
+		constraint := p.resolvePackageNameVersionPin(name)
+		provided := slices.ContainsFunc(selected, func(s *RepositoryPackage) bool {
+			return p.providesConstraint(s, constraint)
+		})
+		if provided == negated {
+			return false
+		}
+	}
+	return true
+}
+
+// replaceDisqualified swaps pkg in for the package of the same name in tracked and pkgs, if the
+// one chosen earlier has since been disqualified and pkg has not. That happens when a later
+// dependent narrows the constraints on a name, so pkg satisfies all of them and the earlier
+// choice does not.
+func replaceDisqualified(pkgs []*RepositoryPackage, tracked map[string]*RepositoryPackage, pkg *RepositoryPackage, dq map[*RepositoryPackage]string) {
+	prev := tracked[pkg.Name]
+	if prev == pkg {
+		return
+	}
+	if _, dqed := dq[prev]; !dqed {
+		return
+	}
+	if _, dqed := dq[pkg]; dqed {
+		return
+	}
+	tracked[pkg.Name] = pkg
+	if i := slices.Index(pkgs, prev); i >= 0 {
+		pkgs[i] = pkg
 	}
-	return pkg, dependencies, conflicts, nil
 }
 
 // ResolvePackage given a single package name and optional version constraints, resolve to a list of packages
-// that satisfy the constraint. The list will be sorted by version number, with the highest version first
-// and decreasing from there. In general, the first one in the list is the best match. This function
+// that satisfy the constraint. The list will be sorted like SortPackages does, by repository and then with
+// the highest version first. In general, the first one in the list is the best match. This function
 // returns multiple in case you need to see all potential matches.
 func (p *PkgResolver) ResolvePackage(pkgName string, dq map[*RepositoryPackage]string) ([]*RepositoryPackage, error) {
 	constraint := p.resolvePackageNameVersionPin(pkgName)
 	name, version, compare, pin := constraint.name, constraint.version, constraint.dep, constraint.pin
 	pkgsWithVersions, ok := p.nameMap[name]
 	if !ok {
-		return nil, fmt.Errorf("could not find package that provides %s in indexes", pkgName)
+		return nil, p.unsatisfiableError(pkgName, nil, dq)
 	}
 
 	// pkgsWithVersions contains a map of all versions of the package
 	// get the one that most matches what was requested
-	packages := p.filterPackages(pkgsWithVersions, dq, withVersion(version, compare), withPreferPin(pin))
+	packages := p.filterPackages(pkgsWithVersions, dq, withName(name), withVersion(version, compare), withPreferPin(pin), withRequirePin(pin))
 	if len(packages) == 0 {
-		return nil, maybedqerror(pkgName, pkgsWithVersions, dq)
+		return nil, p.pinError(pkgName, pin, pkgsWithVersions, dq)
 	}
 	p.sortPackages(packages, nil, name, nil, nil, pin)
+	candidates := make([]*repositoryPackage, 0, len(packages))
 	pkgs := make([]*RepositoryPackage, 0, len(packages))
 	for _, pkg := range packages {
 		if _, dqed := dq[pkg.RepositoryPackage]; dqed {
 			continue
 		}
+		candidates = append(candidates, pkg)
 		pkgs = append(pkgs, pkg.RepositoryPackage)
 	}
+	if len(candidates) > 0 {
+		p.noteAmbiguity(candidates, name, candidates[0])
+	}
 	return pkgs, nil
 }
 
@@ -578,14 +1017,14 @@ func (p *PkgResolver) resolvePackage(pkgName string, dq map[*RepositoryPackage]s
 
 	pkgsWithVersions, ok := p.nameMap[name]
 	if !ok {
-		return nil, fmt.Errorf("could not find package, alias or a package that provides %s in indexes", pkgName)
+		return nil, p.unsatisfiableError(pkgName, nil, dq)
 	}
 
 	// pkgsWithVersions contains a map of all versions of the package
 	// get the one that most matches what was requested
-	packages := p.filterPackages(pkgsWithVersions, dq, withVersion(version, compare), withPreferPin(pin))
+	packages := p.filterPackages(pkgsWithVersions, dq, withName(name), withVersion(version, compare), withPreferPin(pin), withRequirePin(pin))
 	if len(packages) == 0 {
-		return nil, maybedqerror(pkgName, pkgsWithVersions, dq)
+		return nil, p.pinError(pkgName, pin, pkgsWithVersions, dq)
 	}
 	return p.bestPackage(packages, nil, name, nil, nil, pin).RepositoryPackage, nil
 }
@@ -631,9 +1070,9 @@ func (p *PkgResolver) getPackageDependencies(pkg *RepositoryPackage, allowPin st
 		myProvides[name] = true
 	}
 
-	constraints := slices.Clone(pkg.Dependencies)
+	constraints := p.dependencies(pkg)
 
-	if err := p.constrain(constraints, dq); err != nil {
+	if err := p.constrain(constraints, pkg.Filename(), dq); err != nil {
 		return nil, nil, fmt.Errorf("constraining deps for %q: %w", pkg.Filename(), err)
 	}
 
@@ -663,7 +1102,7 @@ func (p *PkgResolver) getPackageDependencies(pkg *RepositoryPackage, allowPin st
 
 			if allowSelfFulfill && pkg.Name == name {
 				var (
-					actualVersion, requiredVersion packageVersion
+					actualVersion, requiredVersion Version
 					err1, err2                     error
 				)
 				actualVersion, err1 = p.parseVersion(pkg.Version)
@@ -682,18 +1121,19 @@ func (p *PkgResolver) getPackageDependencies(pkg *RepositoryPackage, allowPin st
 			// first see if it is a name of a package
 			depPkgWithVersions, ok := p.nameMap[name]
 			if !ok {
-				return nil, nil, fmt.Errorf("could not find package either named %s or that provides %s for %s", dep, dep, pkg.Name)
+				return nil, nil, &DepError{pkg, p.unsatisfiableError(dep, nil, dq)}
 			}
 			// pkgsWithVersions contains a map of all versions of the package
 			// get the one that most matches what was requested
 			pkgs := p.filterPackages(depPkgWithVersions,
 				dq,
+				withName(name),
 				withVersion(version, compare),
 				withAllowPin(allowPin),
 				withInstalledPackage(existing[name]),
 			)
 			if len(pkgs) == 0 {
-				return nil, nil, &DepError{pkg, maybedqerror(dep, depPkgWithVersions, dq)}
+				return nil, nil, &DepError{pkg, p.unsatisfiableError(dep, depPkgWithVersions, dq)}
 			}
 			options[dep] = pkgs
 		}
@@ -755,13 +1195,13 @@ func (p *PkgResolver) getPackageDependencies(pkg *RepositoryPackage, allowPin st
 	return dependencies, conflicts, nil
 }
 
-func (p *PkgResolver) parseVersion(version string) (packageVersion, error) {
+func (p *PkgResolver) parseVersion(version string) (Version, error) {
 	pkg, ok := p.parsedVersions[version]
 	if ok {
 		return pkg, nil
 	}
 
-	parsed, err := parseVersion(version)
+	parsed, err := ParseVersion(version)
 	if err != nil {
 		return parsed, err
 	}
@@ -797,6 +1237,13 @@ func (p *PkgResolver) sortPackages(pkgs []*repositoryPackage, compare *Repositor
 
 func (p *PkgResolver) comparePackages(compare *RepositoryPackage, name string, existing map[string]*RepositoryPackage, existingOrigins map[string]bool, pin string) func(a, b *repositoryPackage) int { //nolint:gocyclo
 	return func(a, b *repositoryPackage) int {
+		// package files added with AddLocalPackages are always preferred
+		if iLocal, jLocal := a.location != "", b.location != ""; iLocal != jLocal {
+			if iLocal {
+				return -1
+			}
+			return 1
+		}
 		// determine versions
 		iVersionStr := p.getDepVersionForName(a, name)
 		jVersionStr := p.getDepVersionForName(b, name)
@@ -863,39 +1310,83 @@ func (p *PkgResolver) comparePackages(compare *RepositoryPackage, name string, e
 			// a < b
 			return 1
 		}
-		// both matched or both did not, so just compare versions
-		// version priority
-		iVersion, err := p.parseVersion(iVersionStr)
-		if err != nil {
+		// prefer the native architecture
+		if a.archFallback != b.archFallback {
+			if b.archFallback {
+				return -1
+			}
 			return 1
 		}
-		jVersion, err := p.parseVersion(jVersionStr)
-		if err != nil {
-			// If j fails to parse, prefer i.
-			return -1
+		// then prefer the earlier repository
+		if a.repoOrder != b.repoOrder {
+			return cmp.Compare(a.repoOrder, b.repoOrder)
 		}
-		versions := compareVersions(iVersion, jVersion)
-		if versions != equal {
-			return -1 * int(versions)
+		// within a repository, compare versions
+		if versions := p.compareVersionStrings(iVersionStr, jVersionStr); versions != 0 {
+			return versions
 		}
 		// if versions are equal, they might not be the same as the package versions
 		if iVersionStr != a.Version || jVersionStr != b.Version {
-			iVersion, err := p.parseVersion(a.Version)
-			if err != nil {
-				return 1
-			}
-			jVersion, err := p.parseVersion(b.Version)
-			if err != nil {
-				// If j fails to parse, prefer i.
-				return -1
-			}
-			versions := compareVersions(iVersion, jVersion)
-			if versions != equal {
-				return -1 * int(versions)
+			if versions := p.compareVersionStrings(a.Version, b.Version); versions != 0 {
+				return versions
 			}
 		}
-		// if versions are equal, compare names
-		return cmp.Compare(a.Name, b.Name)
+		// then compare origins and names, and finally anything left that could differ, so
+		// that the order never depends on the order of the candidates.
+		if a.Origin != b.Origin {
+			return cmp.Compare(a.Origin, b.Origin)
+		}
+		if a.Name != b.Name {
+			return cmp.Compare(a.Name, b.Name)
+		}
+		if a.Version != b.Version {
+			return cmp.Compare(a.Version, b.Version)
+		}
+		return cmp.Compare(a.URL(), b.URL())
+	}
+}
+
+// compareVersionStrings returns -1 if a is the higher version, 1 if b is, and 0 if they are
+// equal. A version that parses is higher than one that does not, and two that do not parse
+// are equal.
+func (p *PkgResolver) compareVersionStrings(a, b string) int {
+	iVersion, iErr := p.parseVersion(a)
+	jVersion, jErr := p.parseVersion(b)
+	switch {
+	case iErr != nil && jErr != nil:
+		return 0
+	case iErr != nil:
+		return 1
+	case jErr != nil:
+		return -1
+	}
+	return -1 * int(compareVersions(iVersion, jVersion))
+}
+
+// SortPackages sorts pkgs in the order the resolver prefers them as candidates, when nothing
+// is installed yet: package files added with APK.AddLocalPackages first, then packages of
+// untagged repositories, then higher provider priority, then packages of the native
+// architecture, then the order of their repositories as given to NewPkgResolver, then
+// higher version, then by origin and name. Packages the resolver does not know of sort after
+// those from its indexes. The order does not depend on the order of pkgs.
+func (p *PkgResolver) SortPackages(pkgs []*RepositoryPackage) {
+	known := map[*RepositoryPackage]*repositoryPackage{}
+	for _, candidates := range p.nameMap {
+		for _, pkg := range candidates {
+			known[pkg.RepositoryPackage] = pkg
+		}
+	}
+	named := make([]*repositoryPackage, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		if rp, ok := known[pkg]; ok {
+			named = append(named, rp)
+		} else {
+			named = append(named, &repositoryPackage{RepositoryPackage: pkg, repoOrder: len(p.indexes)})
+		}
+	}
+	p.sortPackages(named, nil, "", nil, nil, "")
+	for i, pkg := range named {
+		pkgs[i] = pkg.RepositoryPackage
 	}
 }
 
@@ -903,7 +1394,9 @@ func (p *PkgResolver) bestPackage(pkgs []*repositoryPackage, compare *Repository
 	if len(pkgs) == 0 {
 		return nil
 	}
-	return slices.MinFunc(pkgs, p.comparePackages(compare, name, existing, existingOrigins, pin))
+	best := slices.MinFunc(pkgs, p.comparePackages(compare, name, existing, existingOrigins, pin))
+	p.noteAmbiguity(pkgs, name, best)
+	return best
 }
 
 // getDepVersionForName get the version of the package that provides the given name.
@@ -958,6 +1451,23 @@ func (e *DepError) Error() string {
 	return fmt.Sprintf("resolving %q deps:\n%s", e.Package.Filename(), e.Wrapped.Error())
 }
 
+// ConflictError is returned when Package has a !foo dependency, Constraint, that the also
+// selected Conflict satisfies. The chains list the names of the packages that pulled each
+// of them in, starting from "world".
+type ConflictError struct {
+	Package       *RepositoryPackage
+	Conflict      *RepositoryPackage
+	Constraint    string
+	PackageChain  []string
+	ConflictChain []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s (required by %s) conflicts with %s (required by %s) because of %q",
+		e.Package.Filename(), strings.Join(e.PackageChain, " -> "),
+		e.Conflict.Filename(), strings.Join(e.ConflictChain, " -> "), e.Constraint)
+}
+
 type DisqualifiedError struct {
 	Package *RepositoryPackage
 	Wrapped error
@@ -971,18 +1481,128 @@ func (e *DisqualifiedError) Unwrap() error {
 	return e.Wrapped
 }
 
-func maybedqerror(pkgName string, pkgs []*repositoryPackage, dq map[*RepositoryPackage]string) error {
-	errs := make([]error, 0, len(pkgs))
-	for _, pkg := range pkgs {
-		reason, ok := dq[pkg.RepositoryPackage]
-		if ok {
-			errs = append(errs, &DisqualifiedError{pkg.RepositoryPackage, errors.New(reason)})
+// pinError is like unsatisfiableError, but for a constraint tagged with pin it says when the
+// tagged repository does not exist or has no such package, in case the tag is a typo.
+func (p *PkgResolver) pinError(pkgName, pin string, pkgs []*repositoryPackage, dq map[*RepositoryPackage]string) error {
+	if pin == "" {
+		return p.unsatisfiableError(pkgName, pkgs, dq)
+	}
+	if !slices.ContainsFunc(p.indexes, func(index NamedIndex) bool { return index.Name() == pin }) {
+		return fmt.Errorf("could not find package %q: no repository is tagged @%s", pkgName, pin)
+	}
+	if !slices.ContainsFunc(pkgs, func(pkg *repositoryPackage) bool { return pkg.pinnedName == pin }) {
+		return fmt.Errorf("could not find package %q in the repository tagged @%s", pkgName, pin)
+	}
+	return p.unsatisfiableError(pkgName, pkgs, dq)
+}
+
+// maxNearMisses is the most versions or providers an UnsatisfiableError lists.
+const maxNearMisses = 10
+
+// UnsatisfiableError is returned when no package satisfies Constraint. It lists what the
+// indexes have instead, so that a typo or an outdated pin is easy to spot.
+type UnsatisfiableError struct {
+	Constraint string
+	// Repositories are the sources of the indexes that were searched.
+	Repositories []string
+	// Versions are the distinct versions of the packages with the name in the constraint,
+	// highest first, up to a limit. MoreVersions is how many were left out.
+	Versions     []string
+	MoreVersions int
+	// Providers are the packages that provide the name, as "name-version (provides entry)",
+	// if no package has the name itself, up to a limit. MoreProviders is how many were left out.
+	Providers     []string
+	MoreProviders int
+	// Disqualified are the candidates that were ruled out for other reasons, such as
+	// conflicts with packages that were already selected.
+	Disqualified []*DisqualifiedError
+}
+
+func (e *UnsatisfiableError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "could not find package %q in indexes", e.Constraint)
+	if len(e.Repositories) != 0 {
+		fmt.Fprintf(&sb, "\n  searched: %s", strings.Join(e.Repositories, ", "))
+	}
+	name := resolvePackageNameVersionPin(e.Constraint).name
+	switch {
+	case len(e.Versions) != 0:
+		fmt.Fprintf(&sb, "\n  available versions of %s: %s", name, strings.Join(e.Versions, ", "))
+		if e.MoreVersions != 0 {
+			fmt.Fprintf(&sb, " and %d more", e.MoreVersions)
+		}
+	case len(e.Providers) != 0:
+		fmt.Fprintf(&sb, "\n  no package is named %s, it is provided by: %s", name, strings.Join(e.Providers, ", "))
+		if e.MoreProviders != 0 {
+			fmt.Fprintf(&sb, " and %d more", e.MoreProviders)
 		}
+	default:
+		fmt.Fprintf(&sb, "\n  no package is named or provides %s", name)
+	}
+	shown, more := nearMisses(e.Disqualified)
+	for _, dq := range shown {
+		sb.WriteString("\n")
+		sb.WriteString(dq.Error())
+	}
+	if more != 0 {
+		fmt.Fprintf(&sb, "\n  and %d more disqualified", more)
 	}
+	return sb.String()
+}
+
+// Unwrap returns the reasons the disqualified candidates were ruled out.
+func (e *UnsatisfiableError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Disqualified))
+	for _, dq := range e.Disqualified {
+		errs = append(errs, dq)
+	}
+	return errs
+}
 
-	if len(errs) != 0 {
-		return errors.Join(errs...)
+// unsatisfiableError returns the error for a constraint that none of pkgs, the packages with
+// or providing its name, satisfy.
+func (p *PkgResolver) unsatisfiableError(constraint string, pkgs []*repositoryPackage, dq map[*RepositoryPackage]string) error {
+	e := &UnsatisfiableError{Constraint: constraint}
+	for _, index := range p.indexes {
+		if source := index.Source(); source != "" && !slices.Contains(e.Repositories, source) {
+			e.Repositories = append(e.Repositories, source)
+		}
+	}
+
+	name := p.resolvePackageNameVersionPin(strings.TrimPrefix(constraint, "!")).name
+	var versions []string
+	for _, pkg := range pkgs {
+		if reason, ok := dq[pkg.RepositoryPackage]; ok {
+			e.Disqualified = append(e.Disqualified, &DisqualifiedError{pkg.RepositoryPackage, errors.New(reason)})
+		}
+		if pkg.Name == name && !slices.Contains(versions, pkg.Version) {
+			versions = append(versions, pkg.Version)
+		}
+	}
+	slices.SortFunc(versions, p.compareVersionStrings)
+	e.Versions, e.MoreVersions = nearMisses(versions)
+
+	if len(versions) == 0 && len(pkgs) != 0 {
+		providers := slices.Clone(pkgs)
+		p.sortPackages(providers, nil, name, nil, nil, "")
+		names := make([]string, 0, len(providers))
+		for _, pkg := range providers {
+			for _, prov := range pkg.Provides {
+				if p.resolvePackageNameVersionPin(prov).name == name {
+					names = append(names, fmt.Sprintf("%s-%s (%s)", pkg.Name, pkg.Version, prov))
+					break
+				}
+			}
+		}
+		e.Providers, e.MoreProviders = nearMisses(names)
 	}
+	return e
+}
 
-	return fmt.Errorf("could not find package %q in indexes", pkgName)
+// nearMisses returns up to maxNearMisses of s, and how many were left out.
+func nearMisses[T any](s []T) ([]T, int) {
+	if len(s) <= maxNearMisses {
+		return s, 0
+	}
+	return s[:maxNearMisses], len(s) - maxNearMisses
 }
@@ -16,8 +16,10 @@ package apk
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/fs"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
@@ -29,6 +31,7 @@ import (
 
 	"github.com/stretchr/testify/require"
 	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 	"golang.org/x/sync/errgroup"
 
 	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
@@ -114,7 +117,7 @@ func TestGetRepositoryIndexes(t *testing.T) {
 	})
 	t.Run("cache miss no network", func(t *testing.T) {
 		// Reset etag cache so we have isolated tests.
-		globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{}
+		globalEtagCache, globalIndexCache = &etagCache{}, NewIndexCache()
 
 		// we use a transport that always returns a 404 so we know we're not hitting the network
 		// it should fail for a cache hit
@@ -128,7 +131,7 @@ func TestGetRepositoryIndexes(t *testing.T) {
 	})
 	t.Run("we can fetch, but do not cache indices without etag", func(t *testing.T) {
 		// Reset etag cache so we have isolated tests.
-		globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{}
+		globalEtagCache, globalIndexCache = &etagCache{}, NewIndexCache()
 
 		// we use a transport that can read from the network
 		// it should fail for a cache hit
@@ -151,7 +154,7 @@ func TestGetRepositoryIndexes(t *testing.T) {
 	})
 	t.Run("cache miss network should fill cache", func(t *testing.T) {
 		// Reset etag cache so we have isolated tests.
-		globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{}
+		globalEtagCache, globalIndexCache = &etagCache{}, NewIndexCache()
 
 		// we use a transport that can read from the network
 		// it should fail for a cache hit
@@ -234,7 +237,7 @@ func TestGetRepositoryIndexes(t *testing.T) {
 	})
 	t.Run("cache hit etag miss", func(t *testing.T) {
 		// Reset etag cache so we have isolated tests.
-		globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{}
+		globalEtagCache, globalIndexCache = &etagCache{}, NewIndexCache()
 
 		// it should succeed for a cache hit
 		tmpDir := t.TempDir()
@@ -261,7 +264,7 @@ func TestGetRepositoryIndexes(t *testing.T) {
 		})
 
 		// Reset etag cache.
-		globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{}
+		globalEtagCache, globalIndexCache = &etagCache{}, NewIndexCache()
 
 		indexes, err = a.GetRepositoryIndexes(context.TODO(), false)
 		require.NoErrorf(t, err, "unable to get indexes")
@@ -625,6 +628,25 @@ func TestResolvePackage(t *testing.T) {
 		// first version should be highest match
 		require.Equal(t, "2.0.0", pkgs[0].Version)
 	})
+	t.Run("fuzzy version", func(t *testing.T) {
+		_, index := testGetPackagesAndIndex()
+
+		resolver := NewPkgResolver(context.Background(), testNamedRepositoryFromIndexes(index))
+		pkgs, err := resolver.ResolvePackage("package5=~1.5", map[*RepositoryPackage]string{})
+		require.NoError(t, err)
+		require.Len(t, pkgs, 2)
+		require.Equal(t, "1.5.1", pkgs[0].Version)
+		require.Equal(t, "1.5.0", pkgs[1].Version)
+	})
+	t.Run("provided version", func(t *testing.T) {
+		_, index := testGetPackagesAndIndex()
+
+		resolver := NewPkgResolver(context.Background(), testNamedRepositoryFromIndexes(index))
+		pkgs, err := resolver.ResolvePackage("package7<1", map[*RepositoryPackage]string{})
+		require.NoError(t, err)
+		require.Len(t, pkgs, 1)
+		require.Equal(t, "package8", pkgs[0].Name)
+	})
 	t.Run("with provides", func(t *testing.T) {
 		// getPackageDependencies does not get the same dependencies twice.
 		_, index := testGetPackagesAndIndex()
@@ -904,3 +926,491 @@ func makeResolver(provs, deps map[string][]string) *PkgResolver {
 	})
 	return NewPkgResolver(context.Background(), testNamedRepositoryFromIndexes([]*RepositoryWithIndex{repoWithIndex}))
 }
+
+func TestIntersectingConstraints(t *testing.T) {
+	providers := map[string][]string{
+		"foo=1.0-r0": {},
+		"foo=2.0-r0": {},
+		"foo=4.0-r0": {},
+	}
+	dependers := map[string][]string{
+		"a=1.0-r0": {"foo>=2"},
+		"b=1.0-r0": {"foo<3"},
+	}
+
+	for _, world := range [][]string{
+		{"a", "b"},
+		{"b", "a"},
+		{"foo>=2", "b"},
+		{"foo>1", "foo<4"},
+	} {
+		t.Run(strings.Join(world, ","), func(t *testing.T) {
+			resolver := makeResolver(providers, dependers)
+			pkgs, _, err := resolver.GetPackagesWithDependencies(context.Background(), world)
+			require.NoError(t, err)
+
+			var got []string
+			for _, pkg := range pkgs {
+				if pkg.Name == "foo" {
+					got = append(got, pkg.Filename())
+				}
+			}
+			require.Equal(t, []string{"foo-2.0-r0.apk"}, got)
+		})
+	}
+}
+
+func TestConflictingDeps(t *testing.T) {
+	providers := map[string][]string{
+		"openssl-dev=3.1.4-r0": {"pc:openssl=3.1.4"},
+		"libressl=3.8.2-r0":    {},
+	}
+	dependers := map[string][]string{
+		"libressl-dev=3.8.2-r0": {"!openssl-dev", "libressl"},
+		"foo=1.0-r0":            {"libressl-dev"},
+		"bar=1.0-r0":            {"pc:openssl"},
+	}
+
+	t.Run("selected after", func(t *testing.T) {
+		resolver := makeResolver(providers, dependers)
+		_, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"openssl-dev", "foo"})
+		var conflictErr *ConflictError
+		require.ErrorAs(t, err, &conflictErr)
+		require.Equal(t, "libressl-dev-3.8.2-r0.apk", conflictErr.Package.Filename())
+		require.Equal(t, "openssl-dev-3.1.4-r0.apk", conflictErr.Conflict.Filename())
+		require.Equal(t, []string{"world", "foo"}, conflictErr.PackageChain)
+		require.Equal(t, []string{"world"}, conflictErr.ConflictChain)
+	})
+
+	t.Run("selected before", func(t *testing.T) {
+		resolver := makeResolver(providers, dependers)
+		_, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"foo", "bar"})
+		require.ErrorContains(t, err, "openssl-dev-3.1.4-r0.apk disqualfied because excluded by !openssl-dev in libressl-dev-3.8.2-r0.apk")
+	})
+
+	t.Run("excluded by world", func(t *testing.T) {
+		resolver := makeResolver(providers, dependers)
+		_, conflicts, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"!libressl-dev", "libressl"})
+		require.NoError(t, err)
+		require.Equal(t, []string{"libressl-dev"}, conflicts)
+
+		_, _, err = resolver.GetPackagesWithDependencies(context.Background(), []string{"!libressl-dev", "foo"})
+		require.ErrorContains(t, err, "excluded by !libressl-dev in world")
+	})
+}
+
+func TestInstallIf(t *testing.T) {
+	repo := Repository{}
+	index := repo.WithIndex(&APKIndex{
+		Packages: []*Package{
+			{Name: "ca-certificates", Version: "20230506-r0", Dependencies: []string{"openssl"}},
+			{Name: "openssl", Version: "3.1.4-r0"},
+			{Name: "curl", Version: "8.4.0-r0"},
+			{Name: "ca-certificates-bundle", Version: "20230506-r0", InstallIf: []string{"ca-certificates=20230506-r0", "openssl"}},
+			{Name: "curl-doc", Version: "8.4.0-r0", InstallIf: []string{"curl", "docs"}},
+			{Name: "docs", Version: "1.0-r0"},
+			{Name: "man-pages", Version: "6.05-r0"},
+			{Name: "curl-doc-man", Version: "8.4.0-r0", InstallIf: []string{"curl-doc", "!busybox"}, Dependencies: []string{"man-pages"}},
+			{Name: "busybox", Version: "1.36.1-r0"},
+		},
+	})
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{index})
+
+	tests := []struct {
+		world []string
+		opts  []ResolverOption
+		want  []string
+	}{
+		{[]string{"ca-certificates"}, nil, []string{"openssl", "ca-certificates", "ca-certificates-bundle"}},
+		{[]string{"curl"}, nil, []string{"curl"}},
+		// curl-doc-man is only triggered by curl-doc, which is itself only installed because of install_if.
+		{[]string{"curl", "docs"}, nil, []string{"curl", "docs", "curl-doc", "man-pages", "curl-doc-man"}},
+		{[]string{"curl", "docs", "busybox"}, nil, []string{"curl", "docs", "busybox", "curl-doc"}},
+		{[]string{"ca-certificates", "curl", "docs"}, []ResolverOption{WithResolverIgnoreInstallIf(true)}, []string{"openssl", "ca-certificates", "curl", "docs"}},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.world, ","), func(t *testing.T) {
+			resolver := NewPkgResolver(context.Background(), indexes, tt.opts...)
+			pkgs, _, err := resolver.GetPackagesWithDependencies(context.Background(), tt.world)
+			require.NoError(t, err)
+			got := make([]string, 0, len(pkgs))
+			for _, pkg := range pkgs {
+				got = append(got, pkg.Name)
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestProviderPriority(t *testing.T) {
+	first := Repository{URI: "first"}
+	second := Repository{URI: "second"}
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{
+		first.WithIndex(&APKIndex{Packages: []*Package{
+			{Name: "python3.12", Version: "3.12.0-r0", Provides: []string{"cmd:python3=3.12.0-r0"}},
+			{Name: "python3.11", Version: "3.11.6-r0", Provides: []string{"cmd:python3=3.11.6-r0"}, ProviderPriority: 10},
+			{Name: "zlib-ng", Version: "1.0-r0", Provides: []string{"so:libz.so.1"}},
+		}}),
+		second.WithIndex(&APKIndex{Packages: []*Package{
+			{Name: "zlib", Version: "1.0-r0", Provides: []string{"so:libz.so.1"}},
+			{Name: "app", Version: "1.0-r0", Dependencies: []string{"cmd:python3", "so:libz.so.1"}},
+		}}),
+	})
+
+	t.Run("priority beats version", func(t *testing.T) {
+		resolver := NewPkgResolver(context.Background(), indexes)
+		pkgs, err := resolver.ResolvePackage("cmd:python3", map[*RepositoryPackage]string{})
+		require.NoError(t, err)
+		require.Equal(t, "python3.11", pkgs[0].Name)
+		require.Equal(t, "python3.12", pkgs[1].Name)
+		require.Empty(t, resolver.Report().AmbiguousProviders)
+	})
+
+	t.Run("ambiguous providers", func(t *testing.T) {
+		resolver := NewPkgResolver(context.Background(), indexes)
+		pkgs, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"app"})
+		require.NoError(t, err)
+		names := make([]string, 0, len(pkgs))
+		for _, pkg := range pkgs {
+			names = append(names, pkg.Name)
+		}
+		// zlib-ng and zlib have the same version, so the one from the first repository wins.
+		require.ElementsMatch(t, []string{"python3.11", "zlib-ng", "app"}, names)
+
+		report := resolver.Report()
+		require.Len(t, report.AmbiguousProviders, 1)
+		require.Equal(t, "so:libz.so.1", report.AmbiguousProviders[0].Name)
+		require.Equal(t, []string{"zlib", "zlib-ng"}, report.AmbiguousProviders[0].Providers)
+		require.Equal(t, "zlib-ng", report.AmbiguousProviders[0].Chosen.Name)
+	})
+
+	t.Run("disqualified providers are not chosen", func(t *testing.T) {
+		indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{
+			first.WithIndex(&APKIndex{Packages: []*Package{
+				{Name: "zlib-ng", Version: "1.0-r0", Provides: []string{"so:libz.so.1"}},
+				{Name: "zlib-compat", Version: "1.0-r0", Provides: []string{"so:libz.so.1"}},
+				{Name: "zlib", Version: "1.0-r0", Provides: []string{"so:libz.so.1"}},
+			}}),
+		})
+		resolver := NewPkgResolver(context.Background(), indexes)
+		pkgs, err := resolver.ResolvePackage("so:libz.so.1", map[*RepositoryPackage]string{})
+		require.NoError(t, err)
+		dq := map[*RepositoryPackage]string{pkgs[0]: "conflicts"}
+
+		pkgs, err = resolver.ResolvePackage("so:libz.so.1", dq)
+		require.NoError(t, err)
+		report := resolver.Report()
+		require.Len(t, report.AmbiguousProviders, 1)
+		require.Equal(t, pkgs[0], report.AmbiguousProviders[0].Chosen)
+		require.NotContains(t, dq, report.AmbiguousProviders[0].Chosen)
+	})
+}
+
+func TestResolutionReport(t *testing.T) {
+	providers := map[string][]string{
+		"openssl=3.1.4-r0": {"so:libssl.so.3=3"},
+		"openssl=3.2.0-r0": {"so:libssl.so.3=3"},
+	}
+	dependers := map[string][]string{
+		"curl=8.4.0-r0":    {"libcurl"},
+		"libcurl=8.4.0-r0": {"so:libssl.so.3", "openssl<3.2"},
+	}
+
+	resolver := makeResolver(providers, dependers)
+	_, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"curl"})
+	require.NoError(t, err)
+
+	report := resolver.Report()
+	require.Len(t, report.Packages, 3)
+	openssl := report.Packages[0]
+	require.Equal(t, "openssl-3.1.4-r0.apk", openssl.Package.Filename())
+	require.Equal(t, []string{"world", "curl", "libcurl"}, openssl.RequiredBy)
+	require.Equal(t, []ConstraintReport{
+		{Constraint: "so:libssl.so.3", From: "libcurl"},
+		{Constraint: "openssl<3.2", From: "libcurl"},
+	}, openssl.Constraints)
+	require.Len(t, openssl.Candidates, 2)
+	for _, c := range openssl.Candidates {
+		if c.Package.Version == "3.2.0-r0" {
+			require.Contains(t, c.Rejected, `"3.2.0-r0" does not satisfy "openssl<3.2"`)
+		} else {
+			require.Empty(t, c.Rejected)
+		}
+	}
+
+	want := `world
+  curl-8.4.0-r0 [curl from world]
+    libcurl-8.4.0-r0 [libcurl from curl]
+      openssl-3.1.4-r0 [so:libssl.so.3 from libcurl, openssl<3.2 from libcurl]
+        x openssl-3.2.0-r0: "3.2.0-r0" does not satisfy "openssl<3.2"
+`
+	require.Equal(t, want, report.String())
+
+	// A failed resolution is reported rather than the previous one.
+	_, _, err = resolver.GetPackagesWithDependencies(context.Background(), []string{"curl", "missing"})
+	require.Error(t, err)
+	require.Empty(t, resolver.Report().Packages)
+}
+
+func TestPinnedWorld(t *testing.T) {
+	main := Repository{URI: "main"}
+	edge := Repository{URI: "edge"}
+	indexes := []NamedIndex{
+		NewNamedRepositoryWithIndex("", main.WithIndex(&APKIndex{Packages: []*Package{
+			{Name: "foo", Version: "1.0-r0", Dependencies: []string{"bar"}},
+			{Name: "bar", Version: "1.0-r0"},
+			{Name: "qux", Version: "1.0-r0"},
+		}})),
+		NewNamedRepositoryWithIndex("edge", edge.WithIndex(&APKIndex{Packages: []*Package{
+			{Name: "foo", Version: "2.0-r0", Dependencies: []string{"bar"}},
+			{Name: "bar", Version: "2.0-r0"},
+		}})),
+	}
+	resolver := NewPkgResolver(context.Background(), indexes)
+
+	pkgs, err := resolver.ResolvePackage("foo@edge", map[*RepositoryPackage]string{})
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+	require.Equal(t, "2.0-r0", pkgs[0].Version)
+
+	// The pinned package comes from edge, but its dependencies still prefer the untagged repository.
+	got, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"foo@edge"})
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	require.Equal(t, "main/bar-1.0-r0.apk", got[0].URL())
+	require.Equal(t, "edge/foo-2.0-r0.apk", got[1].URL())
+
+	_, _, err = resolver.GetPackagesWithDependencies(context.Background(), []string{"foo@egde"})
+	require.ErrorContains(t, err, "no repository is tagged @egde")
+
+	_, _, err = resolver.GetPackagesWithDependencies(context.Background(), []string{"qux@edge"})
+	require.ErrorContains(t, err, "in the repository tagged @edge")
+}
+
+func TestExcludedPackages(t *testing.T) {
+	repo := Repository{}
+	index := repo.WithIndex(&APKIndex{
+		Packages: []*Package{
+			{Name: "app", Version: "1.0-r0", Dependencies: []string{"libfoo", "so:libssl.so.3", "cmd:sh"}},
+			{Name: "libfoo", Version: "1.0-r0", Dependencies: []string{"libbar"}},
+			{Name: "libbar", Version: "1.0-r0"},
+			{Name: "openssl", Version: "3.1.4-r0", Provides: []string{"so:libssl.so.3=3"}},
+			{Name: "libressl", Version: "3.8.2-r0", Provides: []string{"so:libssl.so.3=3"}},
+			{Name: "busybox", Version: "1.36.1-r0", Provides: []string{"cmd:sh"}},
+			{Name: "app-doc", Version: "1.0-r0", InstallIf: []string{"app"}},
+		},
+	})
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{index})
+	resolve := func(t *testing.T, opts ...ResolverOption) ([]string, error) {
+		resolver := NewPkgResolver(context.Background(), indexes, opts...)
+		pkgs, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"app"})
+		got := make([]string, 0, len(pkgs))
+		for _, pkg := range pkgs {
+			got = append(got, pkg.Name)
+		}
+		return got, err
+	}
+
+	t.Run("masked dependency", func(t *testing.T) {
+		_, err := resolve(t, WithExcludedPackages("libbar"))
+		require.ErrorContains(t, err, `it is excluded by "libbar"`)
+		require.ErrorContains(t, err, "app-1.0-r0.apk")
+		require.ErrorContains(t, err, "libfoo-1.0-r0.apk")
+	})
+
+	t.Run("masked provider", func(t *testing.T) {
+		// libressl sorts first, so it is chosen unless it is masked.
+		got, err := resolve(t, WithExcludedPackages("libressl"))
+		require.NoError(t, err)
+		require.Contains(t, got, "openssl")
+		require.NotContains(t, got, "libressl")
+	})
+
+	t.Run("masked install_if", func(t *testing.T) {
+		got, err := resolve(t, WithExcludedPackages("*-doc"))
+		require.NoError(t, err)
+		require.NotContains(t, got, "app-doc")
+	})
+
+	t.Run("ignored dependencies", func(t *testing.T) {
+		got, err := resolve(t, WithIgnoredDependencies("cmd:*", "libba?"))
+		require.NoError(t, err)
+		require.Equal(t, []string{"libfoo", "libressl", "app", "app-doc"}, got)
+	})
+}
+
+func TestCandidateFilter(t *testing.T) {
+	repo := Repository{}
+	index := repo.WithIndex(&APKIndex{
+		Packages: []*Package{
+			{Name: "app", Version: "1.0-r0", Dependencies: []string{"libfoo", "so:libssl.so.3"}},
+			{Name: "app", Version: "2.0-r0", Dependencies: []string{"libfoo", "so:libssl.so.3"}},
+			{Name: "libfoo", Version: "1.0-r0", License: "MIT"},
+			{Name: "libfoo", Version: "1.1-r0", License: "GPL-3.0-only"},
+			{Name: "openssl", Version: "3.1.4-r0", License: "Apache-2.0", Provides: []string{"so:libssl.so.3=3"}},
+			{Name: "libressl", Version: "3.8.2-r0", License: "GPL-3.0-only", Provides: []string{"so:libssl.so.3=3"}},
+			{Name: "app-doc", Version: "1.0-r0", License: "GPL-3.0-only", InstallIf: []string{"app"}},
+		},
+	})
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{index})
+	noGPL := WithCandidateFilter(func(pkg *RepositoryPackage) error {
+		if strings.HasPrefix(pkg.License, "GPL") {
+			return fmt.Errorf("license %s is not allowed", pkg.License)
+		}
+		return nil
+	})
+	notVersion := func(name, version string) ResolverOption {
+		return WithCandidateFilter(func(pkg *RepositoryPackage) error {
+			if pkg.Name == name && pkg.Version == version {
+				return errors.New("it is known to be broken")
+			}
+			return nil
+		})
+	}
+
+	t.Run("transitive dependencies and providers", func(t *testing.T) {
+		resolver := NewPkgResolver(context.Background(), indexes, noGPL, notVersion("app", "2.0-r0"))
+		pkgs, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"app"})
+		require.NoError(t, err)
+		got := make([]string, 0, len(pkgs))
+		for _, pkg := range pkgs {
+			got = append(got, pkg.Name+"-"+pkg.Version)
+		}
+		require.Equal(t, []string{"libfoo-1.0-r0", "openssl-3.1.4-r0", "app-1.0-r0"}, got)
+
+		var rejected []string
+		for _, report := range resolver.Report().Packages {
+			for _, candidate := range report.Candidates {
+				if candidate.Rejected != "" {
+					rejected = append(rejected, candidate.Package.Filename()+": "+candidate.Rejected)
+				}
+			}
+		}
+		require.Contains(t, rejected, "app-2.0-r0.apk: it is vetoed: it is known to be broken")
+		require.Contains(t, rejected, "libfoo-1.1-r0.apk: it is vetoed: license GPL-3.0-only is not allowed")
+		require.Contains(t, rejected, "libressl-3.8.2-r0.apk: it is vetoed: license GPL-3.0-only is not allowed")
+	})
+
+	t.Run("all candidates vetoed", func(t *testing.T) {
+		resolver := NewPkgResolver(context.Background(), indexes, notVersion("app", "1.0-r0"), notVersion("app", "2.0-r0"))
+		_, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"app"})
+		var unsatisfiable *UnsatisfiableError
+		require.ErrorAs(t, err, &unsatisfiable)
+		require.Len(t, unsatisfiable.Disqualified, 2)
+		require.ErrorContains(t, err, "app-1.0-r0.apk disqualfied because it is vetoed: it is known to be broken")
+	})
+}
+
+func TestDeterministicResolution(t *testing.T) {
+	packages := func() ([]*Package, []*Package) {
+		return []*Package{
+			{Name: "foo", Version: "1.0-r0", Dependencies: []string{"bar", "so:libz.so.1", "cmd:sh"}},
+			{Name: "bar", Version: "1.0-r0"},
+			{Name: "zlib", Version: "1.3-r0", Origin: "zlib", Provides: []string{"so:libz.so.1=1"}},
+			{Name: "zlib-ng", Version: "1.3-r0", Origin: "zlib-ng", Provides: []string{"so:libz.so.1=1"}},
+			{Name: "busybox", Version: "1.36.1-r0", Provides: []string{"cmd:sh"}},
+		}, []*Package{
+			{Name: "foo", Version: "1.0-r0", Dependencies: []string{"bar", "so:libz.so.1", "cmd:sh"}},
+			// main comes first, so its bar is chosen over this higher version
+			{Name: "bar", Version: "2.0-r0"},
+			{Name: "dash", Version: "0.5.12-r0", Provides: []string{"cmd:sh"}},
+			{Name: "zlib", Version: "1.3-r0", Origin: "zlib", Provides: []string{"so:libz.so.1=1"}},
+		}
+	}
+	resolve := func(shuffle *rand.Rand) ([]string, []string) {
+		main, community := packages()
+		if shuffle != nil {
+			shuffle.Shuffle(len(main), func(i, j int) { main[i], main[j] = main[j], main[i] })
+			shuffle.Shuffle(len(community), func(i, j int) { community[i], community[j] = community[j], community[i] })
+		}
+		mainRepo := Repository{URI: "main"}
+		communityRepo := Repository{URI: "community"}
+		resolver := NewPkgResolver(context.Background(), testNamedRepositoryFromIndexes([]*RepositoryWithIndex{
+			mainRepo.WithIndex(&APKIndex{Packages: main}),
+			communityRepo.WithIndex(&APKIndex{Packages: community}),
+		}))
+		pkgs, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"foo"})
+		require.NoError(t, err)
+		var got []string
+		for _, pkg := range pkgs {
+			got = append(got, pkg.URL())
+		}
+
+		candidates, err := resolver.ResolvePackage("cmd:sh", map[*RepositoryPackage]string{})
+		require.NoError(t, err)
+		shuffled := slices.Clone(candidates)
+		if shuffle != nil {
+			shuffle.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		}
+		resolver.SortPackages(shuffled)
+		var sorted []string
+		for _, pkg := range shuffled {
+			sorted = append(sorted, pkg.URL())
+		}
+		return got, sorted
+	}
+
+	want, wantSorted := resolve(nil)
+	require.Equal(t, []string{
+		"main/bar-1.0-r0.apk",
+		"main/busybox-1.36.1-r0.apk",
+		"main/zlib-1.3-r0.apk",
+		"main/foo-1.0-r0.apk",
+	}, want)
+	require.Equal(t, []string{"main/busybox-1.36.1-r0.apk", "community/dash-0.5.12-r0.apk"}, wantSorted)
+	for seed := int64(0); seed < 50; seed++ {
+		got, sorted := resolve(rand.New(rand.NewSource(seed))) //nolint:gosec // not for security
+		require.Equal(t, want, got, "seed %d", seed)
+		require.Equal(t, wantSorted, sorted, "seed %d", seed)
+	}
+}
+
+func TestUnsatisfiableError(t *testing.T) {
+	main := Repository{URI: "https://example.com/main/x86_64"}
+	index := main.WithIndex(&APKIndex{Packages: []*Package{
+		{Name: "go", Version: "1.21.9-r0"},
+		{Name: "go", Version: "1.22.3-r0"},
+		{Name: "go", Version: "1.22.2-r0"},
+		{Name: "busybox", Version: "1.36.1-r0", Provides: []string{"cmd:sh"}},
+		{Name: "dash", Version: "0.5.12-r0", Provides: []string{"cmd:sh=0.5.12"}},
+		{Name: "app", Version: "1.0-r0", Dependencies: []string{"go=1.22.1-r0"}},
+	}})
+	resolver := NewPkgResolver(context.Background(), testNamedRepositoryFromIndexes([]*RepositoryWithIndex{index}))
+
+	_, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"go=1.22.1-r0"})
+	var unsat *UnsatisfiableError
+	require.ErrorAs(t, err, &unsat)
+	require.Equal(t, []string{"https://example.com/main/x86_64/APKINDEX.tar.gz"}, unsat.Repositories)
+	require.Equal(t, []string{"1.22.3-r0", "1.22.2-r0", "1.21.9-r0"}, unsat.Versions)
+	require.Equal(t, `could not find package "go=1.22.1-r0" in indexes
+  searched: https://example.com/main/x86_64/APKINDEX.tar.gz
+  available versions of go: 1.22.3-r0, 1.22.2-r0, 1.21.9-r0
+  go-1.21.9-r0.apk disqualfied because "1.21.9-r0" does not satisfy "go=1.22.1-r0"
+  go-1.22.3-r0.apk disqualfied because "1.22.3-r0" does not satisfy "go=1.22.1-r0"
+  go-1.22.2-r0.apk disqualfied because "1.22.2-r0" does not satisfy "go=1.22.1-r0"`, unsat.Error())
+
+	// through a dependency
+	_, _, err = resolver.GetPackagesWithDependencies(context.Background(), []string{"app"})
+	require.ErrorAs(t, err, &unsat)
+	require.Equal(t, "go=1.22.1-r0", unsat.Constraint)
+
+	_, _, err = resolver.GetPackagesWithDependencies(context.Background(), []string{"cmd:sh>1"})
+	require.ErrorAs(t, err, &unsat)
+	require.Empty(t, unsat.Versions)
+	require.Equal(t, []string{"busybox-1.36.1-r0 (cmd:sh)", "dash-0.5.12-r0 (cmd:sh=0.5.12)"}, unsat.Providers)
+
+	_, _, err = resolver.GetPackagesWithDependencies(context.Background(), []string{"golang"})
+	require.ErrorAs(t, err, &unsat)
+	require.ErrorContains(t, err, "no package is named or provides golang")
+
+	many := make([]*Package, 0, maxNearMisses+2)
+	for i := 0; i < maxNearMisses+2; i++ {
+		many = append(many, &Package{Name: "foo", Version: fmt.Sprintf("1.%d-r0", i)})
+	}
+	resolver = NewPkgResolver(context.Background(), testNamedRepositoryFromIndexes([]*RepositoryWithIndex{main.WithIndex(&APKIndex{Packages: many})}))
+	_, err = resolver.ResolvePackage("foo>2", map[*RepositoryPackage]string{})
+	require.ErrorAs(t, err, &unsat)
+	require.Len(t, unsat.Versions, maxNearMisses)
+	require.Equal(t, "1.11-r0", unsat.Versions[0])
+	require.ErrorContains(t, err, "and 2 more")
+}
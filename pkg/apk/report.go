@@ -0,0 +1,260 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/exp/maps"
+)
+
+// AmbiguousProvider is a virtual name, like cmd:python3, that several packages provide
+// with no provider_priority to choose between them. The resolver picked Chosen by version
+// and repository order alone.
+type AmbiguousProvider struct {
+	Name string
+	// Providers are the names of the packages that provide Name, sorted.
+	Providers []string
+	Chosen    *RepositoryPackage
+}
+
+// ResolutionReport describes choices made while resolving that callers may want to check.
+type ResolutionReport struct {
+	AmbiguousProviders []AmbiguousProvider
+	// Packages explains each package selected by the latest call to GetPackagesWithDependencies,
+	// in install order.
+	Packages []PackageReport
+}
+
+// PackageReport explains why Package was selected.
+type PackageReport struct {
+	Package *RepositoryPackage
+	// RequiredBy is the chain of package names that pulled Package in, starting from "world".
+	// It is empty for a package added because its install_if was satisfied.
+	RequiredBy []string
+	// Constraints are the world entries and dependencies that Package satisfies.
+	Constraints []ConstraintReport
+	// Candidates are all of the packages that could have satisfied the constraints,
+	// including Package itself.
+	Candidates []CandidateReport
+}
+
+// ConstraintReport is a world entry or dependency, and the package it came from.
+type ConstraintReport struct {
+	Constraint string
+	// From is the name of the package with the dependency, or "world".
+	From string
+}
+
+// CandidateReport is a package that was considered, and if it was not selected, why not.
+type CandidateReport struct {
+	Package *RepositoryPackage
+	// Rejected is why the package was not selected, or empty if it was.
+	Rejected string
+}
+
+// resolution is what the latest call to GetPackagesWithDependencies selected, kept to explain it.
+type resolution struct {
+	world    []string
+	selected []*RepositoryPackage
+	dq       map[*RepositoryPackage]string
+}
+
+// noteAmbiguity records name as an AmbiguousProvider if it is a virtual that several of pkgs
+// provide, none of them with a provider_priority.
+func (p *PkgResolver) noteAmbiguity(pkgs []*repositoryPackage, name string, chosen *repositoryPackage) {
+	if name == "" {
+		return
+	}
+	var providers []string
+	for _, pkg := range pkgs {
+		if pkg.Name == name || pkg.ProviderPriority != 0 {
+			return
+		}
+		if !slices.Contains(providers, pkg.Name) {
+			providers = append(providers, pkg.Name)
+		}
+	}
+	if len(providers) < 2 {
+		return
+	}
+	slices.Sort(providers)
+	p.ambiguous[name] = AmbiguousProvider{Name: name, Providers: providers, Chosen: chosen.RepositoryPackage}
+}
+
+// Report returns the ambiguities found by every resolution done with this resolver so far,
+// sorted by name, where for a name resolved more than once the latest choice is reported.
+// It also explains each package selected by the latest call to GetPackagesWithDependencies,
+// which if it failed are those it selected before it did.
+func (p *PkgResolver) Report() *ResolutionReport {
+	report := &ResolutionReport{Packages: p.explain()}
+	for _, name := range maps.Keys(p.ambiguous) {
+		report.AmbiguousProviders = append(report.AmbiguousProviders, p.ambiguous[name])
+	}
+	slices.SortFunc(report.AmbiguousProviders, func(a, b AmbiguousProvider) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return report
+}
+
+func (p *PkgResolver) explain() []PackageReport {
+	if p.last == nil {
+		return nil
+	}
+	world, selected, dq := p.last.world, p.last.selected, p.last.dq
+	chains := p.requiredBy(world, selected)
+
+	reports := make([]PackageReport, 0, len(selected))
+	for _, pkg := range selected {
+		report := PackageReport{Package: pkg, RequiredBy: chains[pkg]}
+		names := []string{}
+		addConstraints := func(deps []string, from string) {
+			for _, dep := range deps {
+				if strings.HasPrefix(dep, "!") {
+					continue
+				}
+				constraint := p.resolvePackageNameVersionPin(dep)
+				if !p.providesConstraint(pkg, constraint) {
+					continue
+				}
+				report.Constraints = append(report.Constraints, ConstraintReport{Constraint: dep, From: from})
+				if !slices.Contains(names, constraint.name) {
+					names = append(names, constraint.name)
+				}
+			}
+		}
+		addConstraints(world, "world")
+		for _, other := range selected {
+			if other != pkg {
+				addConstraints(other.Dependencies, other.Name)
+			}
+		}
+		if len(names) == 0 {
+			names = append(names, pkg.Name)
+		}
+
+		seen := map[*RepositoryPackage]bool{}
+		for _, name := range names {
+			for _, candidate := range p.nameMap[name] {
+				if seen[candidate.RepositoryPackage] {
+					continue
+				}
+				seen[candidate.RepositoryPackage] = true
+				report.Candidates = append(report.Candidates, CandidateReport{
+					Package:  candidate.RepositoryPackage,
+					Rejected: p.rejection(candidate, pkg, report.Constraints, dq),
+				})
+			}
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// rejection returns why candidate was not selected instead of chosen, or an empty string if
+// it was chosen.
+func (p *PkgResolver) rejection(candidate *repositoryPackage, chosen *RepositoryPackage, constraints []ConstraintReport, dq map[*RepositoryPackage]string) string {
+	if candidate.RepositoryPackage == chosen {
+		return ""
+	}
+	if reason, ok := dq[candidate.RepositoryPackage]; ok {
+		return reason
+	}
+
+	pinned := candidate.pinnedName == ""
+	for _, c := range constraints {
+		constraint := p.resolvePackageNameVersionPin(c.Constraint)
+		if constraint.pin == candidate.pinnedName {
+			pinned = true
+		}
+		if !p.providesConstraint(candidate.RepositoryPackage, parsedConstraint{name: constraint.name, dep: versionAny}) {
+			continue
+		}
+		if !p.providesConstraint(candidate.RepositoryPackage, constraint) {
+			return fmt.Sprintf("does not satisfy %q from %s", c.Constraint, c.From)
+		}
+	}
+	if !pinned {
+		return fmt.Sprintf("in the repository tagged @%s, which was not asked for", candidate.pinnedName)
+	}
+
+	if candidate.ProviderPriority < chosen.ProviderPriority {
+		return fmt.Sprintf("lower provider priority than %s", chosen.Filename())
+	}
+	cv, err := p.parseVersion(candidate.Version)
+	if err != nil {
+		return fmt.Sprintf("invalid version %q", candidate.Version)
+	}
+	if v, err := p.parseVersion(chosen.Version); err == nil && candidate.Name == chosen.Name && compareVersions(cv, v) == less {
+		return fmt.Sprintf("lower version than %s", chosen.Filename())
+	}
+	return fmt.Sprintf("%s was preferred", chosen.Filename())
+}
+
+// String renders the report as a tree of the selected packages under world, each with
+// the constraints it satisfies and the candidates that were rejected for it.
+func (r *ResolutionReport) String() string {
+	var sb strings.Builder
+	children := map[string][]PackageReport{}
+	var orphans []PackageReport
+	for _, pkg := range r.Packages {
+		if len(pkg.RequiredBy) == 0 {
+			orphans = append(orphans, pkg)
+			continue
+		}
+		parent := pkg.RequiredBy[len(pkg.RequiredBy)-1]
+		children[parent] = append(children[parent], pkg)
+	}
+
+	var write func(pkg PackageReport, depth int)
+	write = func(pkg PackageReport, depth int) {
+		indent := strings.Repeat("  ", depth)
+		constraints := make([]string, 0, len(pkg.Constraints))
+		for _, c := range pkg.Constraints {
+			constraints = append(constraints, c.Constraint+" from "+c.From)
+		}
+		fmt.Fprintf(&sb, "%s%s-%s", indent, pkg.Package.Name, pkg.Package.Version)
+		if len(constraints) != 0 {
+			fmt.Fprintf(&sb, " [%s]", strings.Join(constraints, ", "))
+		}
+		sb.WriteString("\n")
+		for _, c := range pkg.Candidates {
+			if c.Rejected != "" {
+				fmt.Fprintf(&sb, "%s  x %s-%s: %s\n", indent, c.Package.Name, c.Package.Version, c.Rejected)
+			}
+		}
+		// A name provided by several selected packages only appears under the first.
+		kids := children[pkg.Package.Name]
+		delete(children, pkg.Package.Name)
+		for _, child := range kids {
+			write(child, depth+1)
+		}
+	}
+
+	sb.WriteString("world\n")
+	for _, pkg := range children["world"] {
+		write(pkg, 1)
+	}
+	for _, pkg := range orphans {
+		fmt.Fprintf(&sb, "install_if %s-%s\n", pkg.Package.Name, pkg.Package.Version)
+	}
+	for _, a := range r.AmbiguousProviders {
+		fmt.Fprintf(&sb, "ambiguous %s: provided by %s, chose %s\n", a.Name, strings.Join(a.Providers, ", "), a.Chosen.Filename())
+	}
+	return sb.String()
+}
@@ -1,12 +1,76 @@
 package apk
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"strings"
 )
 
 type Repository struct {
 	URI string
+	// Name is the tag the repository is pinned to, i.e. the @name of its line in
+	// /etc/apk/repositories, if any.
+	Name string
+}
+
+// ParseRepositoriesFile parses repositories in the format of /etc/apk/repositories.
+// Blank lines and comments are skipped, and a repository may be pinned with a
+// leading @name.
+func ParseRepositoriesFile(r io.Reader) ([]Repository, error) {
+	var repos []Repository
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		repo, err := parseRepositoryLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		repos = append(repos, repo)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read repositories: %w", err)
+	}
+	return repos, nil
+}
+
+// WriteRepositoriesFile writes repos in the format of /etc/apk/repositories.
+func WriteRepositoriesFile(w io.Writer, repos []Repository) error {
+	for _, repo := range repos {
+		if _, err := fmt.Fprintln(w, repo.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseRepositoryLine parses a single `[@name] url` repository line.
+func parseRepositoryLine(line string) (Repository, error) {
+	var repo Repository
+	fields := strings.Fields(line)
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+		repo.Name = fields[0][1:]
+		fields = fields[1:]
+		if repo.Name == "" {
+			return Repository{}, fmt.Errorf("invalid repository line %q: empty pin name", line)
+		}
+	}
+	if len(fields) != 1 {
+		return Repository{}, fmt.Errorf("invalid repository line: %q", line)
+	}
+	repo.URI = fields[0]
+	return repo, nil
+}
+
+// String returns the repository as a line of /etc/apk/repositories.
+func (r *Repository) String() string {
+	if r.Name == "" {
+		return r.URI
+	}
+	return fmt.Sprintf("@%s %s", r.Name, r.URI)
 }
 
 // NewRepositoryFromComponents creates a new Repository with the uri constructed
@@ -70,6 +134,11 @@ func (r *RepositoryWithIndex) RepoAbbr() string {
 type RepositoryPackage struct {
 	*Package
 	repository *RepositoryWithIndex
+	// location is the path of a package file added with AddLocalPackages, which need not
+	// be named like a package in a repository.
+	location string
+	// virtual is set for a package of AddVirtualPackage, which has no package file.
+	virtual bool
 }
 
 func NewRepositoryPackage(pkg *Package, repo *RepositoryWithIndex) *RepositoryPackage {
@@ -80,6 +149,9 @@ func NewRepositoryPackage(pkg *Package, repo *RepositoryWithIndex) *RepositoryPa
 }
 
 func (rp *RepositoryPackage) URL() string {
+	if rp.location != "" {
+		return rp.location
+	}
 	return fmt.Sprintf("%s/%s", rp.repository.URI, rp.Filename())
 }
 
@@ -1,9 +1,12 @@
 package apk
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewRepositoryFromComponentsBuildsCorrectUri(t *testing.T) {
@@ -32,3 +35,30 @@ func TestRepositoryPackageReturnsCorrectUrl(t *testing.T) {
 
 	assert.Equal(t, "https://dl-cdn.alpinelinux.org/alpine/edge/main/x86_64/test-package-1.2.3-r0.apk", pkg.URL())
 }
+
+func TestParseRepositoriesFile(t *testing.T) {
+	repos, err := ParseRepositoriesFile(strings.NewReader(`# main repositories
+https://dl-cdn.alpinelinux.org/alpine/edge/main
+
+@testing https://dl-cdn.alpinelinux.org/alpine/edge/testing  
+  /home/user/packages
+`))
+	require.NoError(t, err)
+	require.Equal(t, []Repository{
+		{URI: "https://dl-cdn.alpinelinux.org/alpine/edge/main"},
+		{URI: "https://dl-cdn.alpinelinux.org/alpine/edge/testing", Name: "testing"},
+		{URI: "/home/user/packages"},
+	}, repos)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteRepositoriesFile(&buf, repos))
+	require.Equal(t, `https://dl-cdn.alpinelinux.org/alpine/edge/main
+@testing https://dl-cdn.alpinelinux.org/alpine/edge/testing
+/home/user/packages
+`, buf.String())
+
+	for _, invalid := range []string{"@testing", "@ https://example.com", "https://example.com extra"} {
+		_, err = ParseRepositoriesFile(strings.NewReader("https://example.com\n" + invalid + "\n"))
+		require.ErrorContains(t, err, "line 2:", invalid)
+	}
+}
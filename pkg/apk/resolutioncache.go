@@ -0,0 +1,192 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// ResolutionCache holds resolutions of the world by fingerprint, for WithResolutionCache.
+// Implementations must be safe for concurrent use. A CachedResolution is plain data that
+// can be serialized, so an implementation may persist it.
+type ResolutionCache interface {
+	// Get returns the resolution stored for key, if there is one.
+	Get(key string) (*CachedResolution, bool)
+	// Put stores the resolution for key.
+	Put(key string, resolution *CachedResolution)
+}
+
+// CachedResolution is a resolution of the world kept in a ResolutionCache.
+type CachedResolution struct {
+	// Packages are the resolved packages in install order.
+	Packages  []LockedPackage `json:"packages"`
+	Conflicts []string        `json:"conflicts,omitempty"`
+}
+
+// ResolutionCacheStats counts how often a ResolutionCache was used.
+type ResolutionCacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+type resolutionCounters struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// ResolutionCacheStats returns how many resolutions were found in the cache set with
+// WithResolutionCache, and how many were not and had to be resolved.
+func (a *APK) ResolutionCacheStats() ResolutionCacheStats {
+	return ResolutionCacheStats{Hits: a.resolutionStats.hits.Load(), Misses: a.resolutionStats.misses.Load()}
+}
+
+// memoryResolutionCache is the ResolutionCache returned by NewResolutionCache.
+type memoryResolutionCache struct {
+	sync.Mutex
+	max     int
+	entries map[string]*CachedResolution
+	// keys are in the order they were added, to evict the oldest first
+	keys []string
+}
+
+// NewResolutionCache returns a ResolutionCache that holds up to maxEntries resolutions in
+// memory, evicting the oldest when it is full. There is no limit if maxEntries is 0.
+func NewResolutionCache(maxEntries int) ResolutionCache {
+	return &memoryResolutionCache{max: maxEntries, entries: map[string]*CachedResolution{}}
+}
+
+func (c *memoryResolutionCache) Get(key string) (*CachedResolution, bool) {
+	c.Lock()
+	defer c.Unlock()
+	resolution, ok := c.entries[key]
+	return resolution, ok
+}
+
+func (c *memoryResolutionCache) Put(key string, resolution *CachedResolution) {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.keys = append(c.keys, key)
+	}
+	c.entries[key] = resolution
+	for c.max > 0 && len(c.keys) > c.max {
+		delete(c.entries, c.keys[0])
+		c.keys = c.keys[1:]
+	}
+}
+
+// resolve resolves world against indexes with the resolver options of a, using the
+// resolution cache if there is one.
+func (a *APK) resolve(ctx context.Context, indexes []NamedIndex, world []string) ([]*RepositoryPackage, []string, error) {
+	if a.resolutionCache == nil {
+		return a.newResolver(ctx, indexes).GetPackagesWithDependencies(ctx, world)
+	}
+	log := clog.FromContext(ctx)
+
+	key, ok := a.resolutionFingerprint(indexes, world)
+	if !ok {
+		log.Debug("not caching resolution, candidate filters are in use")
+		return a.newResolver(ctx, indexes).GetPackagesWithDependencies(ctx, world)
+	}
+	if cached, ok := a.resolutionCache.Get(key); ok {
+		if pkgs, ok := cached.packages(indexes); ok {
+			log.Debugf("using cached resolution %s", key)
+			a.resolutionStats.hits.Add(1)
+			return pkgs, cached.Conflicts, nil
+		}
+	}
+	a.resolutionStats.misses.Add(1)
+
+	pkgs, conflicts, err := a.newResolver(ctx, indexes).GetPackagesWithDependencies(ctx, world)
+	if err != nil {
+		return nil, nil, err
+	}
+	a.resolutionCache.Put(key, &CachedResolution{Packages: NewLockfile(pkgs).Packages, Conflicts: conflicts})
+	return pkgs, conflicts, nil
+}
+
+// resolutionFingerprint returns a key for everything the resolution of world depends on: the
+// indexes, identified by their archive checksums or otherwise their packages, the world and
+// the resolver options. It returns false if the resolution cannot be cached because candidate
+// filters, which cannot be compared, are in use.
+func (a *APK) resolutionFingerprint(indexes []NamedIndex, world []string) (string, bool) {
+	resolver := &PkgResolver{}
+	WithResolverIgnoreInstallIf(a.ignoreInstallIf)(resolver)
+	for _, opt := range a.resolverOptions {
+		opt(resolver)
+	}
+	if len(resolver.filters) != 0 {
+		return "", false
+	}
+
+	h := sha256.New()
+	for _, index := range indexes {
+		fmt.Fprintf(h, "index\x00%s\x00%s\x00", index.Name(), index.Source())
+		if checksummed, ok := index.(ChecksumNamedIndex); ok && checksummed.Checksum() != nil {
+			fmt.Fprintf(h, "%x\x00", checksummed.Checksum())
+			continue
+		}
+		for _, pkg := range index.Packages() {
+			writeFingerprintFields(h, pkg.Name, pkg.Version, pkg.ChecksumString(), pkg.URL())
+		}
+	}
+	writeFingerprintFields(h, "world")
+	writeFingerprintFields(h, world...)
+	writeFingerprintFields(h, "excluded")
+	writeFingerprintFields(h, resolver.excluded...)
+	writeFingerprintFields(h, "ignored")
+	writeFingerprintFields(h, resolver.ignoredDeps...)
+	fmt.Fprintf(h, "install_if\x00%t\x00", resolver.ignoreInstallIf)
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+func writeFingerprintFields(w io.Writer, fields ...string) {
+	for _, field := range fields {
+		fmt.Fprintf(w, "%s\x00", field)
+	}
+}
+
+// packages returns the packages of the cached resolution from indexes, or false if any of
+// them is no longer there.
+func (c *CachedResolution) packages(indexes []NamedIndex) ([]*RepositoryPackage, bool) {
+	type ref struct{ repository, name, version, checksum string }
+	wanted := make(map[ref]int, len(c.Packages))
+	for i, locked := range c.Packages {
+		wanted[ref{locked.Repository, locked.Name, locked.Version, locked.Checksum}] = i
+	}
+	pkgs := make([]*RepositoryPackage, len(c.Packages))
+	found := 0
+	for _, index := range indexes {
+		for _, pkg := range index.Packages() {
+			key := ref{name: pkg.Name, version: pkg.Version, checksum: pkg.ChecksumString()}
+			if repo := pkg.Repository(); repo != nil {
+				key.repository = repo.URI
+			}
+			if i, ok := wanted[key]; ok && pkgs[i] == nil {
+				pkgs[i] = pkg
+				found++
+			}
+		}
+	}
+	return pkgs, found == len(pkgs)
+}
@@ -0,0 +1,118 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// jsonResolutionCache stores resolutions serialized, like a cache that persists them would.
+type jsonResolutionCache struct {
+	sync.Mutex
+	entries map[string][]byte
+}
+
+func (c *jsonResolutionCache) Get(key string) (*CachedResolution, bool) {
+	c.Lock()
+	defer c.Unlock()
+	b, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	var resolution CachedResolution
+	if err := json.Unmarshal(b, &resolution); err != nil {
+		return nil, false
+	}
+	return &resolution, true
+}
+
+func (c *jsonResolutionCache) Put(key string, resolution *CachedResolution) {
+	c.Lock()
+	defer c.Unlock()
+	b, err := json.Marshal(resolution)
+	if err != nil {
+		return
+	}
+	c.entries[key] = b
+}
+
+func TestResolutionCache(t *testing.T) {
+	ctx := context.Background()
+	cache := &jsonResolutionCache{entries: map[string][]byte{}}
+	a := newTestFetchAPK(t, nil, WithArch(testArch), WithIgnoreSignatureVerification(true), WithResolutionCache(cache))
+	require.NoError(t, a.SetRepositories(ctx, []string{testAlpineRepos}))
+	require.NoError(t, a.SetWorld(ctx, []string{"busybox"}))
+
+	want, _, err := a.ResolveWorld(ctx)
+	require.NoError(t, err)
+	require.Equal(t, ResolutionCacheStats{Misses: 1}, a.ResolutionCacheStats())
+
+	got, _, err := a.ResolveWorld(ctx)
+	require.NoError(t, err)
+	require.Equal(t, ResolutionCacheStats{Hits: 1, Misses: 1}, a.ResolutionCacheStats())
+	require.Equal(t, packageRefs(want), packageRefs(got))
+	require.Equal(t, want[0].Repository().URI, got[0].Repository().URI)
+
+	require.NoError(t, a.SetWorld(ctx, []string{"busybox", "alpine-baselayout"}))
+	_, _, err = a.ResolveWorld(ctx)
+	require.NoError(t, err)
+	require.Equal(t, ResolutionCacheStats{Hits: 1, Misses: 2}, a.ResolutionCacheStats())
+	require.Len(t, cache.entries, 2)
+}
+
+func TestResolutionFingerprint(t *testing.T) {
+	index := func(checksum string) []NamedIndex {
+		repo := Repository{URI: "https://example.com/main/x86_64"}
+		return []NamedIndex{NewNamedRepositoryWithIndex("main", repo.WithIndex(&APKIndex{
+			Packages: []*Package{{Name: "foo", Version: "1.0-r0"}},
+			Checksum: []byte(checksum),
+		}))}
+	}
+	a := &APK{}
+	key, ok := a.resolutionFingerprint(index("a"), []string{"foo"})
+	require.True(t, ok)
+
+	same, _ := a.resolutionFingerprint(index("a"), []string{"foo"})
+	require.Equal(t, key, same)
+	changed, _ := a.resolutionFingerprint(index("b"), []string{"foo"})
+	require.NotEqual(t, key, changed, "a changed index must not match")
+	world, _ := a.resolutionFingerprint(index("a"), []string{"foo=1.0-r0"})
+	require.NotEqual(t, key, world, "a changed world must not match")
+
+	a.resolverOptions = []ResolverOption{WithExcludedPackages("bar")}
+	excluded, _ := a.resolutionFingerprint(index("a"), []string{"foo"})
+	require.NotEqual(t, key, excluded, "changed resolver options must not match")
+
+	a.resolverOptions = []ResolverOption{WithCandidateFilter(func(*RepositoryPackage) error { return nil })}
+	_, ok = a.resolutionFingerprint(index("a"), []string{"foo"})
+	require.False(t, ok, "candidate filters cannot be cached")
+}
+
+func TestNewResolutionCache(t *testing.T) {
+	cache := NewResolutionCache(2)
+	for _, key := range []string{"a", "b", "c"} {
+		cache.Put(key, &CachedResolution{Conflicts: []string{key}})
+	}
+	_, ok := cache.Get("a")
+	require.False(t, ok, "the oldest entry is evicted")
+	got, ok := cache.Get("c")
+	require.True(t, ok)
+	require.Equal(t, []string{"c"}, got.Conflicts)
+}
@@ -6,10 +6,10 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
-	"strconv"
 	"strings"
 
 	"github.com/klauspost/compress/gzip"
@@ -113,26 +113,16 @@ func ResolveApk(ctx context.Context, source io.Reader) (*APKResolved, error) {
 				signed = true
 			}
 		} else if controlIdx == streamId {
-			mapping, err := controlValue(gzi, "datahash", "size")
+			info, err := pkgInfoFromControl(gzi)
 			if err != nil {
 				return nil, fmt.Errorf("reading datahash and size from control: %w", err)
 			}
 
-			if sizes, ok := mapping["size"]; !ok {
-				return nil, fmt.Errorf("reading size from control: %w", err)
-			} else if len(sizes) != 1 {
-				return nil, fmt.Errorf("saw %d size values", len(sizes))
-			} else if size, err := strconv.Atoi(sizes[0]); err != nil {
-				return nil, fmt.Errorf("parsing size from  control: %w", err)
-			} else {
-				gzipStreamSizes[maxStreams-1] = size
-			}
+			gzipStreamSizes[maxStreams-1] = int(info.Size)
 
-			if datahashes, ok := mapping["datahash"]; !ok {
-				return nil, fmt.Errorf("reading datahash from control: %w", err)
-			} else if len(datahashes) != 1 {
-				return nil, fmt.Errorf("saw %d datahash values", len(datahashes))
-			} else if hash, err := hex.DecodeString(datahashes[0]); err != nil {
+			if info.DataHash == "" {
+				return nil, errors.New("reading datahash from control: no datahash")
+			} else if hash, err := hex.DecodeString(info.DataHash); err != nil {
 				return nil, fmt.Errorf("reading datahash from control: %w", err)
 			} else {
 				hashes[maxStreams-1] = hash
@@ -0,0 +1,147 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"cmp"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// reverseIndex maps each name in the dependencies of the packages in the indexes to the
+// packages that depend on it.
+type reverseIndex struct {
+	dependants map[string][]reverseDependency
+	// order is the position of each package in the indexes, to return results in index order.
+	order map[*RepositoryPackage]int
+}
+
+type reverseDependency struct {
+	pkg        *RepositoryPackage
+	constraint parsedConstraint
+}
+
+// reverseIndex builds the reverse index on first use, since most resolvers never need it.
+func (p *PkgResolver) reverseIndex() *reverseIndex {
+	p.reverseOnce.Do(func() {
+		r := &reverseIndex{
+			dependants: map[string][]reverseDependency{},
+			order:      map[*RepositoryPackage]int{},
+		}
+		for _, index := range p.indexes {
+			for _, pkg := range index.Packages() {
+				r.order[pkg] = len(r.order)
+				for _, dep := range p.dependencies(pkg) {
+					if strings.HasPrefix(dep, "!") {
+						continue
+					}
+					constraint := p.resolvePackageNameVersionPin(dep)
+					r.dependants[constraint.name] = append(r.dependants[constraint.name], reverseDependency{pkg: pkg, constraint: constraint})
+				}
+			}
+		}
+		p.reverse = r
+	})
+	return p.reverse
+}
+
+// ReverseDependencies returns the packages in the indexes that depend on a package named name,
+// either by name or on something it provides, in index order. A dependency only counts if some
+// version of name satisfies its constraint. If no package is named name, it is taken to be a
+// virtual, and the packages that depend on it directly are returned.
+// Dependencies dropped with WithIgnoredDependencies are not included.
+func (p *PkgResolver) ReverseDependencies(name string) []*RepositoryPackage {
+	r := p.reverseIndex()
+	found := map[*RepositoryPackage]bool{}
+	for _, provider := range p.providersOf(name) {
+		// a virtual only has the packages that depend on it, not on the rest of its providers
+		names := []string{name}
+		if provider.Name == name {
+			for _, prov := range provider.Provides {
+				names = append(names, p.resolvePackageNameVersionPin(prov).name)
+			}
+		}
+		for _, n := range names {
+			for _, dependant := range r.dependants[n] {
+				if dependant.pkg.Name == name || found[dependant.pkg] {
+					continue
+				}
+				if p.providesConstraint(provider.RepositoryPackage, dependant.constraint) {
+					found[dependant.pkg] = true
+				}
+			}
+		}
+	}
+	pkgs := make([]*RepositoryPackage, 0, len(found))
+	for pkg := range found {
+		pkgs = append(pkgs, pkg)
+	}
+	slices.SortFunc(pkgs, func(a, b *RepositoryPackage) int {
+		return cmp.Compare(r.order[a], r.order[b])
+	})
+	return pkgs
+}
+
+// TransitiveReverseDependencies returns the packages that depend on name, as for
+// ReverseDependencies, then those that depend on them, and so on, up to depth levels away.
+// A depth of zero or less has no limit. Each package is returned once, nearest levels first and
+// in index order within a level.
+func (p *PkgResolver) TransitiveReverseDependencies(name string, depth int) []*RepositoryPackage {
+	var (
+		pkgs  []*RepositoryPackage
+		seen  = map[*RepositoryPackage]bool{}
+		names = map[string]bool{name: true}
+		queue = []string{name}
+	)
+	order := p.reverseIndex().order
+	for level := 1; len(queue) > 0 && (depth <= 0 || level <= depth); level++ {
+		var found []*RepositoryPackage
+		for _, n := range queue {
+			for _, pkg := range p.ReverseDependencies(n) {
+				if !seen[pkg] {
+					seen[pkg] = true
+					found = append(found, pkg)
+				}
+			}
+		}
+		slices.SortFunc(found, func(a, b *RepositoryPackage) int {
+			return cmp.Compare(order[a], order[b])
+		})
+		queue = nil
+		for _, pkg := range found {
+			if !names[pkg.Name] {
+				names[pkg.Name] = true
+				queue = append(queue, pkg.Name)
+			}
+		}
+		pkgs = append(pkgs, found...)
+	}
+	return pkgs
+}
+
+// providersOf returns the packages named name, or if there are none, those that provide it.
+func (p *PkgResolver) providersOf(name string) []*repositoryPackage {
+	var named []*repositoryPackage
+	for _, pkg := range p.nameMap[name] {
+		if pkg.Name == name {
+			named = append(named, pkg)
+		}
+	}
+	if len(named) == 0 {
+		return p.nameMap[name]
+	}
+	return named
+}
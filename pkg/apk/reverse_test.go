@@ -0,0 +1,59 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReverseDependencies(t *testing.T) {
+	repo := Repository{}
+	index := repo.WithIndex(&APKIndex{
+		Packages: []*Package{
+			{Name: "openssl", Version: "3.1.4-r0", Provides: []string{"so:libssl.so.3=3", "so:libcrypto.so.3=3"}},
+			{Name: "curl", Version: "8.4.0-r0", Dependencies: []string{"so:libssl.so.3", "so:libz.so.1"}},
+			{Name: "git", Version: "2.42.0-r0", Dependencies: []string{"curl", "so:libcrypto.so.3"}},
+			{Name: "git-lfs", Version: "3.4.0-r0", Dependencies: []string{"git"}},
+			{Name: "old-tool", Version: "1.0-r0", Dependencies: []string{"openssl<3"}},
+			{Name: "libressl-user", Version: "1.0-r0", Dependencies: []string{"!openssl", "so:libz.so.1"}},
+			{Name: "zlib", Version: "1.3-r0", Provides: []string{"so:libz.so.1=1.3"}},
+		},
+	})
+	resolver := NewPkgResolver(context.Background(), testNamedRepositoryFromIndexes([]*RepositoryWithIndex{index}))
+	names := func(pkgs []*RepositoryPackage) []string {
+		got := []string{}
+		for _, pkg := range pkgs {
+			got = append(got, pkg.Name)
+		}
+		return got
+	}
+
+	// old-tool wants a version of openssl that does not exist, and libressl-user conflicts with it.
+	require.Equal(t, []string{"curl", "git"}, names(resolver.ReverseDependencies("openssl")))
+	require.Equal(t, []string{"curl", "libressl-user"}, names(resolver.ReverseDependencies("so:libz.so.1")))
+	// git depends on another virtual of openssl, not on this one
+	require.Equal(t, []string{"curl"}, names(resolver.ReverseDependencies("so:libssl.so.3")))
+	require.Equal(t, []string{}, names(resolver.ReverseDependencies("git-lfs")))
+
+	require.Equal(t, []string{"curl", "git", "git-lfs"}, names(resolver.TransitiveReverseDependencies("openssl", 0)))
+	require.Equal(t, []string{"curl", "git"}, names(resolver.TransitiveReverseDependencies("openssl", 1)))
+	require.Equal(t, []string{"curl", "libressl-user", "git"}, names(resolver.TransitiveReverseDependencies("zlib", 2)))
+
+	ignoring := NewPkgResolver(context.Background(), testNamedRepositoryFromIndexes([]*RepositoryWithIndex{index}), WithIgnoredDependencies("so:libcrypto.so.3"))
+	require.Equal(t, []string{"curl"}, names(ignoring.ReverseDependencies("openssl")))
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/chainguard-dev/clog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+const (
+	scriptPreInstall  = ".pre-install"
+	scriptPostInstall = ".post-install"
+)
+
+// runScript runs the script of the package, if it has one and there is a script runner. Its
+// environment has APK_PACKAGE, APK_VERSION and APK_SCRIPT, the name of the script.
+func (a *APK) runScript(ctx context.Context, pkg *Package, expanded *expandapk.APKExpanded, script string) error {
+	if a.scriptRunner == nil {
+		return nil
+	}
+	b, err := fs.ReadFile(expanded.ControlFS, script)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read %s script of package %s: %w", script, pkg.Name, err)
+	}
+
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "runScript", trace.WithAttributes(
+		attribute.String("package", pkg.Name), attribute.String("script", script)))
+	defer span.End()
+
+	log := clog.FromContext(ctx)
+	log.Debugf("running %s script of %s (%s)", script, pkg.Name, pkg.Version)
+	env := map[string]string{
+		"APK_PACKAGE": pkg.Name,
+		"APK_VERSION": pkg.Version,
+		"APK_SCRIPT":  script,
+	}
+	if err := a.scriptRunner.Run(ctx, b, env); err != nil {
+		serr := &ScriptError{Package: pkg.Name, Script: script, Err: err}
+		if !a.continueOnScriptError {
+			return serr
+		}
+		log.Warnf("continuing: %v", serr)
+	}
+	return nil
+}
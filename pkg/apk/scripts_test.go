@@ -0,0 +1,147 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testScriptRunner records the scripts it runs, and whether the file of the package was there.
+type testScriptRunner struct {
+	a    *APK
+	runs []testRun
+	err  error
+}
+
+type testRun struct {
+	script    string
+	env       map[string]string
+	installed bool
+}
+
+func (e *testScriptRunner) Run(_ context.Context, script []byte, env map[string]string) error {
+	_, err := e.a.fs.Stat("usr/bin/hello")
+	e.runs = append(e.runs, testRun{script: string(script), env: env, installed: err == nil})
+	return e.err
+}
+
+// scriptPackage returns a package with scripts, built with APKBuilder.
+func scriptPackage(t *testing.T, scripts map[string][]byte) InstallablePackage {
+	builder, _ := testAPKBuilder(t)
+	builder.Signer = nil
+	builder.Scripts = scripts
+	var buf bytes.Buffer
+	pkg, err := builder.Build(context.Background(), &buf)
+	require.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "hello.apk")
+	require.NoError(t, os.WriteFile(file, buf.Bytes(), 0o644))
+	return &testPackage{pkg: pkg, file: file, checksum: "Q1" + base64.StdEncoding.EncodeToString(pkg.Checksum)}
+}
+
+func TestInstallScripts(t *testing.T) {
+	scripts := map[string][]byte{
+		".pre-install":  []byte("#!/bin/sh\necho pre\n"),
+		".post-install": []byte("#!/bin/sh\necho post\n"),
+	}
+
+	t.Run("not run by default", func(t *testing.T) {
+		a, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{scriptPackage(t, scripts)}))
+		_, err = src.Stat("usr/bin/hello")
+		require.NoError(t, err)
+	})
+
+	t.Run("runs scripts in order", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		e := &testScriptRunner{a: a}
+		a.scriptRunner = e
+		require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{scriptPackage(t, scripts)}))
+		require.Equal(t, []testRun{{
+			script:    "#!/bin/sh\necho pre\n",
+			env:       map[string]string{"APK_PACKAGE": "hello", "APK_VERSION": "1.0-r0", "APK_SCRIPT": ".pre-install"},
+			installed: false,
+		}, {
+			script:    "#!/bin/sh\necho post\n",
+			env:       map[string]string{"APK_PACKAGE": "hello", "APK_VERSION": "1.0-r0", "APK_SCRIPT": ".post-install"},
+			installed: true,
+		}}, e.runs)
+	})
+
+	t.Run("only the scripts a package has", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		e := &testScriptRunner{a: a}
+		a.scriptRunner = e
+		pkg := scriptPackage(t, map[string][]byte{".post-install": scripts[".post-install"]})
+		require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{pkg}))
+		require.Len(t, e.runs, 1)
+		require.Equal(t, ".post-install", e.runs[0].env["APK_SCRIPT"])
+	})
+
+	t.Run("failure aborts", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		failed := errors.New("exit status 1")
+		e := &testScriptRunner{a: a, err: failed}
+		a.scriptRunner = e
+		err = a.InstallPackages(context.Background(), nil, []InstallablePackage{scriptPackage(t, scripts)})
+		var serr *ScriptError
+		require.ErrorAs(t, err, &serr)
+		require.Equal(t, &ScriptError{Package: "hello", Script: ".pre-install", Err: failed}, serr)
+		require.Len(t, e.runs, 1)
+	})
+
+	t.Run("failure continues", func(t *testing.T) {
+		a, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		e := &testScriptRunner{a: a, err: errors.New("exit status 1")}
+		a.scriptRunner = e
+		a.continueOnScriptError = true
+		require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{scriptPackage(t, scripts)}))
+		require.Len(t, e.runs, 2)
+		_, err = src.Stat("usr/bin/hello")
+		require.NoError(t, err)
+	})
+
+	t.Run("options", func(t *testing.T) {
+		e := &testScriptRunner{}
+		a, err := New(WithScripts(e), WithContinueOnScriptError(true))
+		require.NoError(t, err)
+		require.Equal(t, e, a.scriptRunner)
+		require.True(t, a.continueOnScriptError)
+		require.Nil(t, a.executor)
+	})
+
+	t.Run("an executor does not run scripts", func(t *testing.T) {
+		a, err := New(WithExecutor(testCommandExecutor{}))
+		require.NoError(t, err)
+		require.Equal(t, testCommandExecutor{}, a.executor)
+		require.Nil(t, a.scriptRunner)
+	})
+}
+
+type testCommandExecutor struct{}
+
+func (testCommandExecutor) Execute(string, ...string) error { return nil }
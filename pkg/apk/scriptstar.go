@@ -0,0 +1,164 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// scriptTypes are the scripts that apk keeps in scripts.tar, in the order it writes them.
+var scriptTypes = []string{
+	scriptPreInstall,
+	scriptPostInstall,
+	".pre-deinstall",
+	".post-deinstall",
+	".pre-upgrade",
+	".post-upgrade",
+	".trigger",
+}
+
+// scriptsTarTrailerSize is the size of the end of archive blocks, which apk writes too.
+const scriptsTarTrailerSize = 2 * tarBlockSize
+
+// scriptsTarName returns the name of the script of pkg in scripts.tar, which apk recognizes as
+// <name>-<version>.<checksum>.<script>, with script like ".post-install".
+func scriptsTarName(pkg *Package, script string) string {
+	return fmt.Sprintf("%s-%s.%s%s", pkg.Name, pkg.Version, pkg.ChecksumString(), script)
+}
+
+// scriptsTarEntry is a script to write to scripts.tar, as apk does with writeAPKTarEntry.
+type scriptsTarEntry struct {
+	name  string
+	data  []byte
+	mtime time.Time
+}
+
+// appendScriptsTar writes entries at the end of scripts.tar, in place of its end of archive
+// blocks, so that installing a package does not rewrite all of the scripts of the others. The
+// entries are synced before new end of archive blocks are written after them, and if that
+// fails, the old ones are put back. An empty file is a scripts.tar with no scripts.
+func (a *APK) appendScriptsTar(entries []scriptsTarEntry) error {
+	f, err := a.fs.OpenFile(a.scriptsFilePath(), os.O_RDWR|os.O_CREATE, scriptsTarPerms)
+	if err != nil {
+		return fmt.Errorf("unable to open scripts file %s: %w", a.scriptsFilePath(), err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to stat scripts file %s: %w", a.scriptsFilePath(), err)
+	}
+
+	var offset int64
+	if size := fi.Size(); size != 0 {
+		offset = size - scriptsTarTrailerSize
+		trailer := make([]byte, scriptsTarTrailerSize)
+		if offset < 0 || size%tarBlockSize != 0 {
+			return fmt.Errorf("scripts file %s is not a tar archive", a.scriptsFilePath())
+		}
+		if _, err := f.ReadAt(trailer, offset); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("unable to read scripts file %s: %w", a.scriptsFilePath(), err)
+		}
+		if !bytes.Equal(trailer, make([]byte, scriptsTarTrailerSize)) {
+			return fmt.Errorf("scripts file %s does not end like a tar archive", a.scriptsFilePath())
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, e := range entries {
+		if err := writeAPKTarEntry(&buf, e.name, e.data, 0o755, e.mtime.Unix()); err != nil {
+			return fmt.Errorf("unable to write script %s: %w", e.name, err)
+		}
+	}
+	if err := writeScriptsTarAt(f, offset, buf.Bytes()); err != nil {
+		return fmt.Errorf("unable to write scripts file %s: %w", a.scriptsFilePath(), errors.Join(err, restoreScriptsTar(f, offset)))
+	}
+	if err := writeScriptsTarAt(f, offset+int64(buf.Len()), make([]byte, scriptsTarTrailerSize)); err != nil {
+		return fmt.Errorf("unable to write scripts file %s: %w", a.scriptsFilePath(), errors.Join(err, restoreScriptsTar(f, offset)))
+	}
+	return f.Close()
+}
+
+// writeScriptsTarAt writes b to scripts.tar at offset, and syncs it.
+func writeScriptsTarAt(f apkfs.File, offset int64, b []byte) error {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+	return syncFile(f)
+}
+
+// restoreScriptsTar puts the end of archive blocks back at offset, where they were before
+// entries were written there, and drops what was written after them if the file can be
+// truncated.
+func restoreScriptsTar(f apkfs.File, offset int64) error {
+	if t, ok := f.(interface{ Truncate(size int64) error }); ok {
+		if err := t.Truncate(offset + scriptsTarTrailerSize); err != nil {
+			return err
+		}
+	}
+	return writeScriptsTarAt(f, offset, make([]byte, scriptsTarTrailerSize))
+}
+
+// GetInstalledScripts returns the scripts of the installed package called name, as they are
+// in scripts.tar, by name like ".post-install". It fails with ErrNotInstalled if the package
+// is not installed.
+func (a *APK) GetInstalledScripts(name string) (map[string][]byte, error) {
+	pkg, err := a.GetInstalledPackage(name)
+	if err != nil {
+		return nil, err
+	}
+	prefix := scriptsTarName(&pkg.Package, "")
+	f, err := a.readScriptsTar()
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string][]byte{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open scripts file %s: %w", a.scriptsFilePath(), err)
+	}
+	defer f.Close()
+
+	scripts := map[string][]byte{}
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read scripts file %s: %w", a.scriptsFilePath(), err)
+		}
+		script, ok := strings.CutPrefix(header.Name, prefix)
+		if !ok {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read script %s: %w", header.Name, err)
+		}
+		scripts[script] = b
+	}
+	return scripts, nil
+}
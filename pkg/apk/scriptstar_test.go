@@ -0,0 +1,204 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// testControlTarGz returns a control section with the scripts, by name like ".post-install".
+func testControlTarGz(t *testing.T, names []string, scripts map[string][]byte) io.Reader {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, name := range names {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(scripts[name]))}))
+		_, err := tw.Write(scripts[name])
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return &buf
+}
+
+func TestScriptsTarGolden(t *testing.T) {
+	// scripts.tar of the test root filesystem was written by apk-tools
+	golden, err := os.ReadFile("testdata/root/lib/apk/db/scripts.tar")
+	require.NoError(t, err)
+	a, _, err := testGetTestAPK()
+	require.NoError(t, err)
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+
+	var (
+		pkgs    []*Package
+		scripts = map[string]map[string][]byte{}
+		mtime   time.Time
+	)
+	tr := tar.NewReader(bytes.NewReader(golden))
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		var pkg *Package
+		for _, p := range installed {
+			if strings.HasPrefix(header.Name, scriptsTarName(&p.Package, ".")) {
+				pkg = &p.Package
+			}
+		}
+		require.NotNil(t, pkg, "no installed package for %s", header.Name)
+		if scripts[pkg.Name] == nil {
+			pkgs = append(pkgs, pkg)
+			scripts[pkg.Name] = map[string][]byte{}
+		}
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		scripts[pkg.Name][strings.TrimPrefix(header.Name, scriptsTarName(pkg, ""))] = b
+		mtime = header.ModTime
+	}
+	require.Len(t, pkgs, 2)
+
+	require.NoError(t, a.fs.WriteFile(a.scriptsFilePath(), nil, scriptsTarPerms))
+	for _, pkg := range pkgs {
+		// in the order abuild writes them, which is not that of apk
+		names := []string{".PKGINFO"}
+		for name := range scripts[pkg.Name] {
+			names = append(names, name)
+		}
+		scripts[pkg.Name][".PKGINFO"] = []byte("pkgname = " + pkg.Name)
+		require.NoError(t, a.updateScriptsTar(pkg, testControlTarGz(t, names, scripts[pkg.Name]), &mtime))
+	}
+	b, err := a.fs.ReadFile(a.scriptsFilePath())
+	require.NoError(t, err)
+	require.Equal(t, golden, b, "scripts.tar should be written as apk writes it")
+}
+
+func TestGetInstalledScripts(t *testing.T) {
+	a, _, err := testGetTestAPK()
+	require.NoError(t, err)
+	scripts, err := a.GetInstalledScripts("busybox")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{".post-install", ".post-upgrade", ".trigger"}, keysOf(scripts))
+	require.True(t, bytes.HasPrefix(scripts[".post-install"], []byte("#!/bin/sh\n")))
+	_, err = a.GetInstalledScripts("missing")
+	require.ErrorIs(t, err, ErrNotInstalled)
+
+	// a new package is appended, without rewriting the scripts of the others
+	before, err := a.fs.ReadFile(a.scriptsFilePath())
+	require.NoError(t, err)
+	pkg := &Package{Name: "appended", Version: "1.0-r0", Checksum: []byte("01234567890123456789")}
+	require.NoError(t, a.updateScriptsTar(pkg, testControlTarGz(t, []string{".post-install", ".unknown"}, map[string][]byte{
+		".post-install": []byte("#!/bin/sh\necho appended\n"),
+		".unknown":      []byte("not a script"),
+	}), nil))
+	require.NoError(t, a.addInstalledPackage(pkg, nil))
+	after, err := a.fs.ReadFile(a.scriptsFilePath())
+	require.NoError(t, err)
+	require.Equal(t, before[:len(before)-scriptsTarTrailerSize], after[:len(before)-scriptsTarTrailerSize])
+	scripts, err = a.GetInstalledScripts("appended")
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{".post-install": []byte("#!/bin/sh\necho appended\n")}, scripts)
+
+	require.NoError(t, a.fs.WriteFile(a.scriptsFilePath(), []byte("not a tar archive"), scriptsTarPerms))
+	require.ErrorContains(t, a.updateScriptsTar(pkg, testControlTarGz(t, []string{".post-install"}, map[string][]byte{
+		".post-install": []byte("#!/bin/sh\n"),
+	}), nil), "is not a tar archive")
+}
+
+// failingWriteFS is a filesystem on disk whose files fail a write once the writes before it
+// are done, unless writes is negative.
+type failingWriteFS struct {
+	apkfs.FullFS
+	writes int
+}
+
+func (f *failingWriteFS) OpenFile(name string, flag int, perm fs.FileMode) (apkfs.File, error) {
+	file, err := f.FullFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &failingWriteFile{File: file, fs: f}, nil
+}
+
+type failingWriteFile struct {
+	apkfs.File
+	fs *failingWriteFS
+}
+
+func (f *failingWriteFile) Write(b []byte) (int, error) {
+	f.fs.writes--
+	if f.fs.writes == -1 {
+		return 0, errors.New("no space left on device")
+	}
+	return f.File.Write(b)
+}
+
+func (f *failingWriteFile) Truncate(size int64) error {
+	return f.File.(*os.File).Truncate(size)
+}
+
+func TestAppendScriptsTarFailure(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "lib", "apk", "db"), 0o755))
+	rfs, err := apkfs.RootFS(dir)
+	require.NoError(t, err)
+	ffs := &failingWriteFS{FullFS: rfs, writes: -1}
+	a, err := New(WithFS(ffs))
+	require.NoError(t, err)
+	entry := func(name string) []scriptsTarEntry {
+		return []scriptsTarEntry{{name: name + "-1.0-r0.Q1.post-install", data: []byte("#!/bin/sh\n")}}
+	}
+	require.NoError(t, a.appendScriptsTar(entry("first")))
+	before, err := os.ReadFile(filepath.Join(dir, a.scriptsFilePath()))
+	require.NoError(t, err)
+
+	for _, writes := range []int{0, 1} {
+		// the entries, or the end of archive blocks after them, fail to be written
+		ffs.writes = writes
+		require.ErrorContains(t, a.appendScriptsTar(entry("second")), "no space left on device")
+		ffs.writes = -1
+		after, err := os.ReadFile(filepath.Join(dir, a.scriptsFilePath()))
+		require.NoError(t, err)
+		require.Equal(t, before, after, "a failed write should leave scripts.tar as it was")
+	}
+	require.NoError(t, a.appendScriptsTar(entry("second")))
+	after, err := os.ReadFile(filepath.Join(dir, a.scriptsFilePath()))
+	require.NoError(t, err)
+	require.Len(t, after, len(before)+2*tarBlockSize)
+}
+
+func keysOf(m map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,359 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"go.opentelemetry.io/otel"
+	"golang.org/x/exp/maps"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+var signatureFileRegex = regexp.MustCompile(`^\.SIGN\.(RSA|RSA256|RSA512|Ed25519)\.(.*\.pub)$`)
+
+// apkSignature is one of the signatures of a repository index or package.
+type apkSignature struct {
+	keyName string
+	algo    crypto.Hash
+	ed25519 bool
+	data    []byte
+}
+
+// parseSignatureFileName returns the key name and hash algorithm of a signature file,
+// named .SIGN.RSA.<key> for RSA-SHA1, .SIGN.RSA256.<key> and .SIGN.RSA512.<key>, or
+// .SIGN.Ed25519.<key> for Ed25519ph, which is over the SHA512 digest.
+func parseSignatureFileName(name string) (apkSignature, error) {
+	matches := signatureFileRegex.FindStringSubmatch(name)
+	if len(matches) != 3 {
+		return apkSignature{}, fmt.Errorf("failed to find key name in signature file name: %s", name)
+	}
+	sig := apkSignature{keyName: matches[2], algo: crypto.SHA1}
+	switch matches[1] {
+	case "RSA256":
+		sig.algo = crypto.SHA256
+	case "RSA512":
+		sig.algo = crypto.SHA512
+	case "Ed25519":
+		sig.algo, sig.ed25519 = crypto.SHA512, true
+	}
+	return sig, nil
+}
+
+func (s apkSignature) String() string {
+	if s.ed25519 {
+		return fmt.Sprintf("%s (Ed25519)", s.keyName)
+	}
+	return fmt.Sprintf("%s (%s)", s.keyName, s.algo)
+}
+
+// VerifyIndexSignature verifies the signature of indexBytes, an APKINDEX.tar.gz,
+// against keys, returning the name of the key that verified it.
+func VerifyIndexSignature(indexBytes []byte, keys map[string][]byte) (keyName string, err error) {
+	keyName, _, err = verifyIndexSignature(indexBytes, keys)
+	return keyName, err
+}
+
+// verifyIndexSignature is VerifyIndexSignature, also returning the signature that verified.
+func verifyIndexSignature(indexBytes []byte, keys map[string][]byte) (string, []byte, error) {
+	buf := bytes.NewReader(indexBytes)
+	gzipReader, err := gzip.NewReader(buf)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to create gzip reader for repository index: %w", err)
+	}
+	// set multistream to false, so we can read each part separately;
+	// the first part is the signature, the second is the index, which should be
+	// verified.
+	gzipReader.Multistream(false)
+	defer gzipReader.Close()
+
+	// read the signatures, there may be one per algorithm or key
+	signatures, err := readSignatures(tar.NewReader(gzipReader))
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: failed to read signature from repository index: %w", ErrMalformedSignature, err)
+	}
+	// we now have the signature bytes and names, get the contents of the rest;
+	// this should be everything else in the raw gzip file as is.
+	indexData := indexBytes[len(indexBytes)-buf.Len():]
+
+	// now we can check the signatures
+	if len(keys) == 0 {
+		return "", nil, fmt.Errorf("%w to verify signature for keyfile %s", ErrNoTrustedKeys, describeSignatures(signatures))
+	}
+	keyName, signature, err := verifySignatures(signatures, keys, func(algo crypto.Hash) ([]byte, error) {
+		return sign.HashDataWith(indexData, algo)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if keyName == "" {
+		return "", nil, signatureMismatch(signatures, keys)
+	}
+	return keyName, signature, nil
+}
+
+// KeysFromFS returns the public keys in dir of fsys by name, i.e. its *.pub, *.pem and
+// *.der files, like the keys apk trusts in /etc/apk/keys.
+func KeysFromFS(fsys fs.FS, dir string) (map[string][]byte, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read keys directory %s: %w", dir, err)
+	}
+	keys := make(map[string][]byte)
+	for _, e := range entries {
+		if e.IsDir() || !isKeyFile(e.Name()) {
+			continue
+		}
+		p := path.Join(dir, e.Name())
+		b, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return nil, fmt.Errorf("could not read key file at %s: %w", p, err)
+		}
+		keys[e.Name()] = b
+	}
+	return keys, nil
+}
+
+// isKeyFile returns whether name is that of a public key file, PEM or DER encoded.
+func isKeyFile(name string) bool {
+	switch path.Ext(name) {
+	case ".pub", ".pem", ".der":
+		return true
+	}
+	return false
+}
+
+// SignIndex signs indexTarGz, an unsigned APKINDEX.tar.gz, with signer, returning the
+// signed index. keyName is the name of the public key that verifies it, e.g.
+// "packager.rsa.pub", which must be named the same in the keyring of its users.
+//
+// The signature is made by signature.SignatureSection, as with signature.SignIndexWithSigner
+// for index files. An RSA index is signed with RSA-SHA1, which all versions of apk-tools
+// verify, unless signer also implements crypto.SignerOpts and its HashFunc is SHA256 or
+// SHA512. An Ed25519 index is signed with Ed25519ph.
+func SignIndex(ctx context.Context, indexTarGz []byte, keyName string, signer crypto.Signer) ([]byte, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "SignIndex")
+	defer span.End()
+
+	if signed, err := isSignedIndex(indexTarGz); err != nil {
+		return nil, err
+	} else if signed {
+		return nil, errors.New("unable to sign index: index is already signed")
+	}
+
+	sig, err := signatureSection(indexTarGz, keyName, signer)
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign index: %w", err)
+	}
+	return append(sig, indexTarGz...), nil
+}
+
+// signatureSection signs data with signer, returning the signature section that
+// precedes it in a signed index or package. The hash is chosen as documented on SignIndex.
+func signatureSection(data []byte, keyName string, signer crypto.Signer) ([]byte, error) {
+	algo := crypto.SHA1
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		if o, ok := signer.(crypto.SignerOpts); ok && (o.HashFunc() == crypto.SHA256 || o.HashFunc() == crypto.SHA512) {
+			algo = o.HashFunc()
+		}
+	case ed25519.PublicKey:
+		algo = crypto.SHA512
+	}
+	return sign.SignatureSection(data, keyName, algo, signer)
+}
+
+// isSignedIndex returns whether the first entry of the index is a signature.
+func isSignedIndex(indexTarGz []byte) (bool, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(indexTarGz))
+	if err != nil {
+		return false, fmt.Errorf("unable to read index: %w", err)
+	}
+	defer zr.Close()
+	hdr, err := tar.NewReader(zr).Next()
+	if err != nil {
+		return false, fmt.Errorf("unable to read index: %w", err)
+	}
+	return strings.HasPrefix(hdr.Name, ".SIGN."), nil
+}
+
+// readSignatures reads the signatures in the signature section of an index or package,
+// which must have at least one.
+func readSignatures(tr *tar.Reader) ([]apkSignature, error) {
+	var signatures []apkSignature
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) && len(signatures) > 0 {
+			return signatures, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		sig, err := parseSignatureFileName(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		if sig.data, err = io.ReadAll(tr); err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, sig)
+	}
+}
+
+// verifySignatures returns the name of the key that verified one of signatures, and
+// that signature, or an empty name if none did. digest returns the digest of the
+// signed data for a hash algorithm. The keys the signatures name are tried first.
+func verifySignatures(signatures []apkSignature, keys map[string][]byte, digest func(crypto.Hash) ([]byte, error)) (string, []byte, error) {
+	digests := map[crypto.Hash][]byte{}
+	verify := func(sig apkSignature, keyData []byte) (bool, error) {
+		d, ok := digests[sig.algo]
+		if !ok {
+			var err error
+			if d, err = digest(sig.algo); err != nil {
+				return false, err
+			}
+			digests[sig.algo] = d
+		}
+		return sign.VerifyDigest(d, sig.algo, sig.data, keyData) == nil, nil
+	}
+
+	for _, sig := range signatures {
+		if keyData, ok := keys[sig.keyName]; ok {
+			verified, err := verify(sig, keyData)
+			if err != nil {
+				return "", nil, err
+			}
+			if verified {
+				return sig.keyName, sig.data, nil
+			}
+		}
+	}
+	names := maps.Keys(keys)
+	sort.Strings(names)
+	for _, sig := range signatures {
+		for _, name := range names {
+			verified, err := verify(sig, keys[name])
+			if err != nil {
+				return "", nil, err
+			}
+			if verified {
+				return name, sig.data, nil
+			}
+		}
+	}
+	return "", nil, nil
+}
+
+// describeSignatures lists the key names and algorithms of signatures, for errors.
+func describeSignatures(signatures []apkSignature) string {
+	keyfiles := make([]string, 0, len(signatures))
+	for _, sig := range signatures {
+		keyfiles = append(keyfiles, sig.String())
+	}
+	return strings.Join(keyfiles, ", ")
+}
+
+// signatureMismatch returns the error for signatures that none of keys verify.
+func signatureMismatch(signatures []apkSignature, keys map[string][]byte) error {
+	err := &SignatureMismatchError{KeyNamesTried: maps.Keys(keys)}
+	sort.Strings(err.KeyNamesTried)
+	for _, sig := range signatures {
+		err.Signatures = append(err.Signatures, sig.String())
+	}
+	return err
+}
+
+// verifyPackageSignature verifies the signature of the control section of exp
+// against keys, returning the name of the key that verified it.
+func verifyPackageSignature(exp *expandapk.APKExpanded, keys map[string][]byte) (string, error) {
+	f, err := os.Open(exp.SignatureFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to open signature: %w", err)
+	}
+	defer f.Close()
+	return verifyControlSignature(f, exp.ControlHash, func() (io.ReadCloser, error) {
+		return os.Open(exp.ControlFile)
+	}, keys)
+}
+
+// verifyStreamSignature is verifyPackageSignature for a package that is expanded as it is read.
+func verifyStreamSignature(stream *expandapk.APKStream, keys map[string][]byte) (string, error) {
+	rc, err := stream.Signature()
+	if err != nil {
+		return "", fmt.Errorf("failed to open signature: %w", err)
+	}
+	defer rc.Close()
+	return verifyControlSignature(rc, stream.ControlHash, stream.Control, keys)
+}
+
+// verifyControlSignature verifies the gzipped signature section read from sig against keys. It
+// is over the control section, whose SHA1 is controlHash and which is read from control for any
+// other algorithm.
+func verifyControlSignature(sig io.Reader, controlHash expandapk.Checksum, control func() (io.ReadCloser, error), keys map[string][]byte) (string, error) {
+	zr, err := gzip.NewReader(sig)
+	if err != nil {
+		return "", fmt.Errorf("%w: failed to read signature: %w", ErrMalformedSignature, err)
+	}
+	defer zr.Close()
+	signatures, err := readSignatures(tar.NewReader(zr))
+	if err != nil {
+		return "", fmt.Errorf("%w: failed to read signature: %w", ErrMalformedSignature, err)
+	}
+	if len(keys) == 0 {
+		return "", fmt.Errorf("%w to verify signature for keyfile %s", ErrNoTrustedKeys, describeSignatures(signatures))
+	}
+
+	signingKey, _, err := verifySignatures(signatures, keys, func(algo crypto.Hash) ([]byte, error) {
+		// The control section is already hashed with SHA1 when expanding.
+		if algo == crypto.SHA1 && len(controlHash) == algo.Size() {
+			return controlHash, nil
+		}
+		// The signature is over the compressed control section.
+		rc, err := control()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		h := algo.New()
+		if _, err := io.Copy(h, rc); err != nil {
+			return nil, fmt.Errorf("unable to hash control section: %w", err)
+		}
+		return h.Sum(nil), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if signingKey == "" {
+		return "", signatureMismatch(signatures, keys)
+	}
+	return signingKey, nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+func TestSplitAPK(t *testing.T) {
+	signed, err := os.ReadFile("testdata/hello-wolfi-2.12.1-r0.apk")
+	require.NoError(t, err)
+
+	builder, _ := testAPKBuilder(t)
+	builder.Signer = nil
+	var unsigned bytes.Buffer
+	_, err = builder.Build(context.Background(), &unsigned)
+	require.NoError(t, err)
+
+	for name, b := range map[string][]byte{"signed": signed, "unsigned": unsigned.Bytes()} {
+		t.Run(name, func(t *testing.T) {
+			exp, err := expandapk.ExpandApk(context.Background(), bytes.NewReader(b), t.TempDir())
+			require.NoError(t, err)
+			defer exp.Close()
+
+			signature, control, data, err := expandapk.SplitAPK(bytes.NewReader(b))
+			require.NoError(t, err)
+			require.Equal(t, exp.Signed, signature != nil)
+
+			var sections [][]byte
+			for _, section := range []io.ReadCloser{signature, control, data} {
+				if section == nil {
+					continue
+				}
+				b, err := io.ReadAll(section)
+				require.NoError(t, err)
+				require.NoError(t, section.Close())
+				sections = append(sections, b)
+			}
+			require.Equal(t, b, bytes.Join(sections, nil))
+
+			// The control section is the one hashed for the checksum of the package.
+			h := sha1.Sum(sections[len(sections)-2]) //nolint:gosec // this is what apk tools is using
+			require.Equal(t, exp.ControlHash, expandapk.Checksum(h[:]))
+		})
+	}
+}
+
+func TestSplitAPKNotAPackage(t *testing.T) {
+	_, _, _, err := expandapk.SplitAPK(strings.NewReader("not a package"))
+	require.Error(t, err)
+}
@@ -0,0 +1,109 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	"go.opentelemetry.io/otel"
+)
+
+// SystemConfig is the configuration of an existing root, as read by LoadSystemConfig.
+type SystemConfig struct {
+	// Arch is the architecture in /etc/apk/arch.
+	Arch string
+	// Repositories are those in /etc/apk/repositories, pinned ones as `@name url`.
+	Repositories []string
+	// World is the entries of /etc/apk/world.
+	World []string
+}
+
+// LoadSystemConfig reads /etc/apk/arch, /etc/apk/repositories and /etc/apk/world of the root,
+// so that an existing Alpine or Wolfi root can be changed without passing its configuration
+// again. The APK then uses the architecture of the root. It returns a *SystemConfigError if
+// any of the files is missing or invalid, if the architecture is not the one set with
+// WithArch, or if a world entry is pinned to a tag that no repository has.
+func (a *APK) LoadSystemConfig(ctx context.Context) (*SystemConfig, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "LoadSystemConfig")
+	defer span.End()
+
+	arch, err := a.systemArch()
+	if err != nil {
+		return nil, err
+	}
+
+	repos, err := a.GetRepositories()
+	if err != nil {
+		return nil, systemConfigFileError(reposFilePath, err)
+	}
+	tags := map[string]bool{}
+	for _, repo := range repos {
+		if r, err := parseRepositoryLine(repo); err == nil && r.Name != "" {
+			tags[r.Name] = true
+		}
+	}
+
+	world, err := a.GetWorld()
+	if err != nil {
+		return nil, systemConfigFileError(worldFilePath, err)
+	}
+	for _, entry := range world {
+		dep, err := ParseDependency(entry)
+		if err != nil {
+			return nil, &SystemConfigError{Path: worldFilePath, Reason: "invalid entry", Err: err}
+		}
+		if dep.Pin != "" && !tags[dep.Pin] {
+			return nil, &SystemConfigError{
+				Path:   worldFilePath,
+				Reason: fmt.Sprintf("entry %s is pinned to @%s, which no repository in %s is tagged with", entry, dep.Pin, reposFilePath),
+			}
+		}
+	}
+
+	a.arch = arch
+	clog.FromContext(ctx).Debugf("loaded system config of %s: arch %s, %d repositories, %d world entries", a.fs, arch, len(repos), len(world))
+	return &SystemConfig{Arch: arch, Repositories: repos, World: world}, nil
+}
+
+// systemArch returns the architecture in /etc/apk/arch, which must be that set with WithArch,
+// if it was.
+func (a *APK) systemArch() (string, error) {
+	b, err := a.fs.ReadFile(archFilePath)
+	if err != nil {
+		return "", systemConfigFileError(archFilePath, err)
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != 1 {
+		return "", &SystemConfigError{Path: archFilePath, Reason: fmt.Sprintf("expected one architecture, found %d", len(fields))}
+	}
+	arch := fields[0]
+	if a.archSet && arch != a.arch {
+		return "", &SystemConfigError{Path: archFilePath, Reason: fmt.Sprintf("architecture is %s, but %s was set with WithArch", arch, a.arch)}
+	}
+	return arch, nil
+}
+
+// systemConfigFileError returns the error of LoadSystemConfig for failing to read path.
+func systemConfigFileError(path string, err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return &SystemConfigError{Path: path, Reason: "not found, the root must be an initialized apk root", Err: err}
+	}
+	return &SystemConfigError{Path: path, Reason: "unable to read", Err: err}
+}
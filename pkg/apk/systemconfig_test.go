@@ -0,0 +1,119 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestLoadSystemConfig(t *testing.T) {
+	ctx := context.Background()
+	root := func(t *testing.T, files map[string]string) apkfs.FullFS {
+		src := apkfs.NewMemFS()
+		require.NoError(t, src.MkdirAll("etc/apk", 0o755))
+		for name, data := range files {
+			require.NoError(t, src.WriteFile(name, []byte(data), 0o644))
+		}
+		return src
+	}
+	alpine := map[string]string{
+		archFilePath:  "aarch64\n",
+		reposFilePath: "https://dl-cdn.alpinelinux.org/alpine/v3.18/main\n# comment\n@edge https://dl-cdn.alpinelinux.org/alpine/edge/main\n",
+		worldFilePath: "alpine-base\nbusybox>=1.36\ncurl@edge\n!sudo\n",
+	}
+
+	t.Run("alpine root", func(t *testing.T) {
+		a, err := New(WithFS(root(t, alpine)))
+		require.NoError(t, err)
+		config, err := a.LoadSystemConfig(ctx)
+		require.NoError(t, err)
+		require.Equal(t, &SystemConfig{
+			Arch: "aarch64",
+			Repositories: []string{
+				"https://dl-cdn.alpinelinux.org/alpine/v3.18/main",
+				"@edge https://dl-cdn.alpinelinux.org/alpine/edge/main",
+			},
+			World: []string{"alpine-base", "busybox>=1.36", "curl@edge", "!sudo"},
+		}, config)
+		require.Equal(t, "aarch64", a.arch, "the APK should use the architecture of the root")
+	})
+
+	t.Run("arch set with WithArch", func(t *testing.T) {
+		a, err := New(WithFS(root(t, alpine)), WithArch("aarch64"))
+		require.NoError(t, err)
+		_, err = a.LoadSystemConfig(ctx)
+		require.NoError(t, err)
+
+		a, err = New(WithFS(root(t, alpine)), WithArch("x86_64"))
+		require.NoError(t, err)
+		_, err = a.LoadSystemConfig(ctx)
+		var configErr *SystemConfigError
+		require.ErrorAs(t, err, &configErr)
+		require.Equal(t, archFilePath, configErr.Path)
+		require.Contains(t, err.Error(), "x86_64 was set with WithArch")
+		require.Equal(t, "x86_64", a.arch)
+	})
+
+	for name, tt := range map[string]struct {
+		files   map[string]string
+		path    string
+		missing bool
+	}{
+		"no arch": {
+			files:   map[string]string{reposFilePath: alpine[reposFilePath], worldFilePath: alpine[worldFilePath]},
+			path:    archFilePath,
+			missing: true,
+		},
+		"no repositories": {
+			files:   map[string]string{archFilePath: alpine[archFilePath], worldFilePath: alpine[worldFilePath]},
+			path:    reposFilePath,
+			missing: true,
+		},
+		"no world": {
+			files:   map[string]string{archFilePath: alpine[archFilePath], reposFilePath: alpine[reposFilePath]},
+			path:    worldFilePath,
+			missing: true,
+		},
+		"empty arch": {
+			files: map[string]string{archFilePath: "\n", reposFilePath: alpine[reposFilePath], worldFilePath: alpine[worldFilePath]},
+			path:  archFilePath,
+		},
+		"invalid world entry": {
+			files: map[string]string{archFilePath: alpine[archFilePath], reposFilePath: alpine[reposFilePath], worldFilePath: "busybox>=not-a-version\n"},
+			path:  worldFilePath,
+		},
+		"unknown pin": {
+			files: map[string]string{archFilePath: alpine[archFilePath], reposFilePath: alpine[reposFilePath], worldFilePath: "curl@testing\n"},
+			path:  worldFilePath,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			a, err := New(WithFS(root(t, tt.files)))
+			require.NoError(t, err)
+			_, err = a.LoadSystemConfig(ctx)
+			var configErr *SystemConfigError
+			require.ErrorAs(t, err, &configErr)
+			require.Equal(t, tt.path, configErr.Path)
+			require.Equal(t, tt.missing, errors.Is(err, os.ErrNotExist))
+		})
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	"go.opentelemetry.io/otel"
+)
+
+const scriptTrigger = ".trigger"
+
+// PendingTrigger is a trigger of an installed package that fired, because files were
+// installed in directories that match it.
+type PendingTrigger struct {
+	Package *Package
+	// Triggers are the globs of the package, like /usr/share/fonts/*, which directories are
+	// matched against.
+	Triggers []string
+	// Directories are the directories that fired the trigger, sorted, with a leading /.
+	Directories []string
+}
+
+// parseTriggers parses the triggers file, which has a line for each installed package with
+// triggers: the base64 checksum of the package, then its triggers.
+func parseTriggers(r io.Reader) (map[string][]string, error) {
+	triggers := map[string][]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		triggers[fields[0]] = fields[1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read triggers file: %w", err)
+	}
+	return triggers, nil
+}
+
+// touchedDirectories returns the directories of the files installed by a, with a leading /.
+func (a *APK) touchedDirectories() map[string]bool {
+	dirs := map[string]bool{}
+	for name, owner := range a.installedFiles {
+		// files that were already installed, loaded to resolve conflicts
+		if previous, ok := a.previousOwners[name]; ok && previous == owner {
+			continue
+		}
+		// files whose triggers already ran
+		if triggered, ok := a.triggeredFiles[name]; ok && triggered == owner {
+			continue
+		}
+		dirs[path.Join("/", path.Dir(name))] = true
+	}
+	return dirs
+}
+
+// PendingTriggers returns the triggers of the installed packages that the files installed
+// by a fire, in the order of the installed database. Triggers run with WithScripts are no
+// longer pending. A trigger is a glob that fires when a
+// directory it matches has files installed in it, as for apk.
+func (a *APK) PendingTriggers() ([]PendingTrigger, error) {
+	f, err := a.readTriggers()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open triggers file %s: %w", a.triggersFilePath(), err)
+	}
+	defer f.Close()
+	triggers, err := parseTriggers(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(triggers) == 0 {
+		return nil, nil
+	}
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read installed packages: %w", err)
+	}
+	dirs := a.touchedDirectories()
+
+	var pending []PendingTrigger
+	for _, pkg := range installed {
+		globs, ok := triggers[pkg.Checksum.Base64()]
+		if !ok {
+			continue
+		}
+		var matched []string
+		for dir := range dirs {
+			for _, glob := range globs {
+				if ok, err := path.Match(glob, dir); err == nil && ok {
+					matched = append(matched, dir)
+					break
+				}
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		sort.Strings(matched)
+		pending = append(pending, PendingTrigger{Package: &pkg.Package, Triggers: globs, Directories: matched})
+	}
+	return pending, nil
+}
+
+// runTriggers runs the .trigger scripts of the pending triggers with the script runner, with the
+// directories that fired them in APK_TRIGGER_DIRECTORIES, separated by spaces. Once they
+// ran, the files installed so far no longer fire them.
+func (a *APK) runTriggers(ctx context.Context) error {
+	if a.scriptRunner == nil {
+		return nil
+	}
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "runTriggers")
+	defer span.End()
+
+	pending, err := a.PendingTriggers()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	scripts, err := a.triggerScripts()
+	if err != nil {
+		return err
+	}
+
+	log := clog.FromContext(ctx)
+	for _, trigger := range pending {
+		pkg := trigger.Package
+		script, ok := scripts[fmt.Sprintf("%s-%s.%s%s", pkg.Name, pkg.Version, pkg.ChecksumString(), scriptTrigger)]
+		if !ok {
+			log.Warnf("package %s has triggers but no %s script", pkg.Name, scriptTrigger)
+			continue
+		}
+		log.Debugf("running %s script of %s (%s) for %v", scriptTrigger, pkg.Name, pkg.Version, trigger.Directories)
+		env := map[string]string{
+			"APK_PACKAGE":             pkg.Name,
+			"APK_VERSION":             pkg.Version,
+			"APK_SCRIPT":              scriptTrigger,
+			"APK_TRIGGER_DIRECTORIES": strings.Join(trigger.Directories, " "),
+		}
+		if err := a.scriptRunner.Run(ctx, script, env); err != nil {
+			serr := &ScriptError{Package: pkg.Name, Script: scriptTrigger, Err: err}
+			if !a.continueOnScriptError {
+				return serr
+			}
+			log.Warnf("continuing: %v", serr)
+		}
+	}
+	a.markTriggered()
+	return nil
+}
+
+// markTriggered marks the triggers fired by the files installed so far as run.
+func (a *APK) markTriggered() {
+	if a.triggeredFiles == nil {
+		a.triggeredFiles = map[string]*Package{}
+	}
+	for name, owner := range a.installedFiles {
+		a.triggeredFiles[name] = owner
+	}
+}
+
+// triggerScripts returns the .trigger scripts in scripts.tar, by their name in it.
+func (a *APK) triggerScripts() (map[string][]byte, error) {
+	f, err := a.readScriptsTar()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open scripts file %s: %w", a.scriptsFilePath(), err)
+	}
+	defer f.Close()
+
+	scripts := map[string][]byte{}
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read scripts file %s: %w", a.scriptsFilePath(), err)
+		}
+		if !strings.HasSuffix(header.Name, scriptTrigger) {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s from scripts file: %w", header.Name, err)
+		}
+		scripts[header.Name] = b
+	}
+	return scripts, nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+// triggerPackage returns a package built with APKBuilder with the files of source.
+func triggerPackage(t *testing.T, info *PkgInfo, source fs.FS, scripts map[string][]byte) InstallablePackage {
+	builder := &APKBuilder{Info: info, Source: source, Scripts: scripts}
+	var buf bytes.Buffer
+	pkg, err := builder.Build(context.Background(), &buf)
+	require.NoError(t, err)
+	file := filepath.Join(t.TempDir(), info.Name+".apk")
+	require.NoError(t, os.WriteFile(file, buf.Bytes(), 0o644))
+	return &testPackage{pkg: pkg, file: file, checksum: "Q1" + base64.StdEncoding.EncodeToString(pkg.Checksum)}
+}
+
+func TestParseTriggers(t *testing.T) {
+	triggers, err := parseTriggers(strings.NewReader("abc= /usr/share/fonts/* /etc/fonts\n\nxyz=\ndef= /usr/lib/gdk-pixbuf-2.0/*/loaders\n"))
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{
+		"abc=": {"/usr/share/fonts/*", "/etc/fonts"},
+		"def=": {"/usr/lib/gdk-pixbuf-2.0/*/loaders"},
+	}, triggers)
+}
+
+func TestPendingTriggers(t *testing.T) {
+	fontconfig := triggerPackage(t,
+		&PkgInfo{Name: "fontconfig", Version: "1.0-r0", Arch: "x86_64", Triggers: []string{"/usr/share/fonts/*"}},
+		fstest.MapFS{
+			"usr":             {Mode: 0o755 | fs.ModeDir},
+			"usr/bin":         {Mode: 0o755 | fs.ModeDir},
+			"usr/bin/fc-list": {Mode: 0o755, Data: []byte("fc-list")},
+		},
+		map[string][]byte{".trigger": []byte("#!/bin/sh\nfc-cache\n")})
+	font := triggerPackage(t,
+		&PkgInfo{Name: "font-misc", Version: "1.0-r0", Arch: "x86_64"},
+		fstest.MapFS{
+			"usr":                          {Mode: 0o755 | fs.ModeDir},
+			"usr/share":                    {Mode: 0o755 | fs.ModeDir},
+			"usr/share/fonts":              {Mode: 0o755 | fs.ModeDir},
+			"usr/share/fonts/misc":         {Mode: 0o755 | fs.ModeDir},
+			"usr/share/fonts/misc/a.pcf":   {Mode: 0o644, Data: []byte("a")},
+			"usr/share/fonts/misc/b.pcf":   {Mode: 0o644, Data: []byte("b")},
+			"usr/share/fonts/75dpi":        {Mode: 0o755 | fs.ModeDir},
+			"usr/share/fonts/75dpi/c.pcf":  {Mode: 0o644, Data: []byte("c")},
+			"usr/share/fonts/README":       {Mode: 0o644, Data: []byte("fonts")},
+			"usr/share/fonts/misc/x/d.pcf": {Mode: 0o644, Data: []byte("d")},
+		}, nil)
+	other := triggerPackage(t,
+		&PkgInfo{Name: "other", Version: "1.0-r0", Arch: "x86_64"},
+		fstest.MapFS{"usr/bin/other": {Mode: 0o755, Data: []byte("other")}}, nil)
+	moreFonts := triggerPackage(t,
+		&PkgInfo{Name: "font-100dpi", Version: "1.0-r0", Arch: "x86_64"},
+		fstest.MapFS{"usr/share/fonts/100dpi/e.pcf": {Mode: 0o644, Data: []byte("e")}}, nil)
+
+	t.Run("nothing fired", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{fontconfig}))
+		pending, err := a.PendingTriggers()
+		require.NoError(t, err)
+		require.Empty(t, pending)
+
+		b, err := a.fs.ReadFile(a.triggersFilePath())
+		require.NoError(t, err)
+		require.Contains(t, string(b), " /usr/share/fonts/*\n")
+	})
+
+	t.Run("fired", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{fontconfig, font}))
+
+		pending, err := a.PendingTriggers()
+		require.NoError(t, err)
+		require.Len(t, pending, 1)
+		require.Equal(t, "fontconfig", pending[0].Package.Name)
+		require.Equal(t, []string{"/usr/share/fonts/*"}, pending[0].Triggers)
+		require.Equal(t, []string{"/usr/share/fonts/75dpi", "/usr/share/fonts/misc"}, pending[0].Directories)
+	})
+
+	t.Run("run", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		e := &testScriptRunner{a: a}
+		a.scriptRunner = e
+		require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{fontconfig, font}))
+
+		require.Len(t, e.runs, 1)
+		require.Equal(t, "#!/bin/sh\nfc-cache\n", e.runs[0].script)
+		require.Equal(t, map[string]string{
+			"APK_PACKAGE":             "fontconfig",
+			"APK_VERSION":             "1.0-r0",
+			"APK_SCRIPT":              ".trigger",
+			"APK_TRIGGER_DIRECTORIES": "/usr/share/fonts/75dpi /usr/share/fonts/misc",
+		}, e.runs[0].env)
+
+		pending, err := a.PendingTriggers()
+		require.NoError(t, err)
+		require.Empty(t, pending)
+
+		// the next install does not fire them again, unless it installs fonts too
+		require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{other}))
+		require.Len(t, e.runs, 1)
+		require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{moreFonts}))
+		require.Len(t, e.runs, 2)
+		require.Equal(t, "/usr/share/fonts/100dpi", e.runs[1].env["APK_TRIGGER_DIRECTORIES"])
+	})
+
+	t.Run("fired by a later install", func(t *testing.T) {
+		first, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		require.NoError(t, first.InstallPackages(context.Background(), nil, []InstallablePackage{fontconfig}))
+
+		second, err := New(WithFS(src), WithIgnoreMknodErrors(ignoreMknodErrors), WithAllowUnsignedLocalPackages())
+		require.NoError(t, err)
+		require.NoError(t, second.InstallPackages(context.Background(), nil, []InstallablePackage{font}))
+		pending, err := second.PendingTriggers()
+		require.NoError(t, err)
+		require.Len(t, pending, 1)
+		require.Equal(t, "fontconfig", pending[0].Package.Name)
+	})
+}
@@ -0,0 +1,360 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/chainguard-dev/clog"
+	"go.opentelemetry.io/otel"
+)
+
+// Upgrade is an installed package and the package from the indexes that would replace it.
+type Upgrade struct {
+	Installed *Package
+	Candidate *RepositoryPackage
+	// Downgrade is set if Candidate has a lower version than Installed.
+	Downgrade bool
+}
+
+// UpgradeSet is the result of ResolveUpgrade.
+type UpgradeSet struct {
+	// Changes are the installed packages that would change, in installed database order.
+	Changes []Upgrade
+	// Missing are the installed packages that no repository has any version of.
+	Missing []*Package
+}
+
+// Empty returns true if nothing would change.
+func (u *UpgradeSet) Empty() bool {
+	return len(u.Changes) == 0
+}
+
+type upgradeOpts struct {
+	allowDowngrade bool
+}
+
+// UpgradeOption configures ResolveUpgrade.
+type UpgradeOption func(*upgradeOpts)
+
+// WithAllowDowngrade sets whether to include installed packages for which the indexes only
+// have lower versions. Default is false, which leaves them out of the changes.
+func WithAllowDowngrade(allow bool) UpgradeOption {
+	return func(o *upgradeOpts) {
+		o.allowDowngrade = allow
+	}
+}
+
+// ResolveUpgrade compares each package in the installed database with the best candidate of
+// the same name in the configured repositories, and returns the ones that would change.
+// Constraints in the world file apply, so a package pinned with = in /etc/apk/world is not
+// upgraded past the pin, and one with no candidate satisfying its constraint is left as it is.
+// It does not change anything.
+func (a *APK) ResolveUpgrade(ctx context.Context, opts ...UpgradeOption) (*UpgradeSet, error) {
+	log := clog.FromContext(ctx)
+	log.Debug("determining upgrades for installed packages")
+
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "ResolveUpgrade")
+	defer span.End()
+
+	o := &upgradeOpts{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("error getting installed packages: %w", err)
+	}
+	indexes, err := a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
+	if err != nil {
+		return nil, fmt.Errorf("error getting repository indexes: %w", err)
+	}
+	world, err := a.GetWorld()
+	if err != nil {
+		return nil, fmt.Errorf("error getting world packages: %w", err)
+	}
+
+	resolver := a.newResolver(ctx, indexes)
+	constraints := make(map[string]string, len(world))
+	for _, entry := range world {
+		if constraint := resolver.resolvePackageNameVersionPin(entry); constraint.name != entry {
+			constraints[constraint.name] = entry
+		}
+	}
+
+	set := &UpgradeSet{}
+	for _, pkg := range installed {
+		current, err := resolver.parseVersion(pkg.Version)
+		if err != nil {
+			return nil, fmt.Errorf("parsing version of installed package %s: %w", pkg.Name, err)
+		}
+
+		candidate := upgradeCandidate(resolver, pkg.Name, constraints[pkg.Name])
+		if candidate == nil {
+			if upgradeCandidate(resolver, pkg.Name, "") == nil {
+				set.Missing = append(set.Missing, &pkg.Package)
+			}
+			continue
+		}
+		version, err := resolver.parseVersion(candidate.Version)
+		if err != nil {
+			continue
+		}
+
+		switch compareVersions(version, current) {
+		case equal:
+			continue
+		case less:
+			if !o.allowDowngrade {
+				log.Debugf("not downgrading %s from %s to %s", pkg.Name, pkg.Version, candidate.Version)
+				continue
+			}
+			set.Changes = append(set.Changes, Upgrade{Installed: &pkg.Package, Candidate: candidate, Downgrade: true})
+		default:
+			set.Changes = append(set.Changes, Upgrade{Installed: &pkg.Package, Candidate: candidate})
+		}
+	}
+	return set, nil
+}
+
+// upgradeCandidate returns the best package named name that satisfies the world constraint,
+// or any version if there is no constraint, or nil if there is none.
+func upgradeCandidate(resolver *PkgResolver, name, constraint string) *RepositoryPackage {
+	if constraint == "" {
+		constraint = name
+	}
+	pkgs, err := resolver.ResolvePackage(constraint, map[*RepositoryPackage]string{})
+	if err != nil {
+		return nil
+	}
+	// Only a package of the same name replaces an installed one, not something that provides it.
+	for _, pkg := range pkgs {
+		if pkg.Name == name {
+			return pkg
+		}
+	}
+	return nil
+}
+
+const (
+	scriptPreUpgrade  = ".pre-upgrade"
+	scriptPostUpgrade = ".post-upgrade"
+)
+
+// installedPackage returns the installed package with name, or nil if there is none.
+func (a *APK) installedPackage(name string) (*InstalledPackage, error) {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range installed {
+		if pkg.Name == name {
+			return pkg, nil
+		}
+	}
+	return nil, nil
+}
+
+// isUpgrade returns whether pkg replaces the installed package old, which it does unless it
+// is the same version and build.
+func isUpgrade(old *InstalledPackage, pkg *Package) bool {
+	if old.Version != pkg.Version {
+		return true
+	}
+	return len(old.Checksum) != 0 && len(pkg.Checksum) != 0 && !bytes.Equal(old.Checksum, pkg.Checksum)
+}
+
+// prepareUpgrade readies the upgrade of old, the installed version of a package that is about
+// to be installed again. Its locally modified files under the paths set with WithProtectedPaths,
+// except those which other installed packages also have, are kept, with the new version
+// installed next to them. Nothing is removed until the new version is installed, see
+// finishUpgrade.
+func (a *APK) prepareUpgrade(ctx context.Context, old *InstalledPackage) error {
+	log := clog.FromContext(ctx)
+	keptPaths, err := a.otherPackagesPaths(old.Name)
+	if err != nil {
+		return err
+	}
+
+	a.preservedFiles = map[string]bool{}
+	for _, f := range old.Files {
+		if f.Typeflag == tar.TypeDir || keptPaths[f.Name] || !a.isProtectedPath(f.Name) {
+			continue
+		}
+		modified, err := a.isModified(f)
+		if err != nil {
+			return err
+		}
+		if modified {
+			log.Debugf("keeping locally modified %s of %s", f.Name, old.Name)
+			a.preservedFiles[f.Name] = true
+		}
+	}
+	return nil
+}
+
+// finishUpgrade removes what is left of old once pkg, its new version, is installed with files:
+// the files of old that pkg does not have, except those which other installed packages also
+// have and the locally modified ones, its directories that are then empty, and its entries in
+// scripts.tar and triggers, which pkg has its own of. Its entry in the installed database is
+// replaced with that of pkg when it is added, see addInstalledPackage.
+func (a *APK) finishUpgrade(ctx context.Context, old *InstalledPackage, pkg *Package, files []tar.Header) error {
+	_, span := otel.Tracer("go-apk").Start(ctx, "finishUpgrade")
+	defer span.End()
+
+	keptPaths, err := a.otherPackagesPaths(old.Name)
+	if err != nil {
+		return err
+	}
+	for name := range a.preservedFiles {
+		keptPaths[name] = true
+	}
+	shipped := make(map[string]bool, len(files))
+	for _, f := range files {
+		shipped[path.Clean(f.Name)] = true
+	}
+	for _, f := range old.Files {
+		if shipped[path.Clean(f.Name)] {
+			keptPaths[f.Name] = true
+			continue
+		}
+		// installed by another package since
+		if owner, ok := a.installedFiles[f.Name]; ok && owner.Name != old.Name {
+			keptPaths[f.Name] = true
+		}
+	}
+
+	if err := a.deletePackageFiles(old, keptPaths); err != nil {
+		return fmt.Errorf("unable to delete files of %s: %w", old.Name, err)
+	}
+	if err := a.deleteScripts([]*InstalledPackage{old}); err != nil {
+		return err
+	}
+	if err := a.deleteTriggers([]*InstalledPackage{old}); err != nil {
+		return err
+	}
+
+	// The files of old are pkg's now if it has them, and its entry is not the one to disown them
+	// from, as pkg's replaces it.
+	for path, owner := range a.installedFiles {
+		if owner.Name != old.Name || owner == pkg {
+			continue
+		}
+		if shipped[path] {
+			a.installedFiles[path] = pkg
+		} else {
+			delete(a.installedFiles, path)
+		}
+	}
+	for path, owner := range a.previousOwners {
+		if owner.Name == old.Name {
+			delete(a.previousOwners, path)
+		}
+	}
+	return nil
+}
+
+// otherPackagesPaths returns the paths of the files and directories that installed packages
+// other than the one named name have.
+func (a *APK) otherPackagesPaths(name string) (map[string]bool, error) {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read installed packages: %w", err)
+	}
+	paths := map[string]bool{}
+	for _, pkg := range installed {
+		if pkg.Name == name {
+			continue
+		}
+		for _, f := range pkg.Files {
+			paths[f.Name] = true
+		}
+	}
+	return paths, nil
+}
+
+// isProtectedPath returns whether name, or one of the directories it is in, matches one of the
+// globs set with WithProtectedPaths.
+func (a *APK) isProtectedPath(name string) bool {
+	for _, p := range a.protectedPaths {
+		for dir := path.Clean(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if ok, _ := path.Match(p, dir); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// installNewVersion writes r, the version in pkg of the locally modified file of header,
+// next to it with apkNewSuffix added to its name, as apk does, unless the modified file is the
+// same. It returns the checksum of the new version, which must be that of header, if it has
+// one.
+func (a *APK) installNewVersion(ctx context.Context, header *tar.Header, r io.Reader, pkg *Package) (Checksum, error) {
+	expected, err := checksumFromHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	newHeader := *header
+	newHeader.Name = header.Name + apkNewSuffix
+	w := sha1.New() //nolint:gosec // this is what apk tools is using
+	if err := a.writeOneFile(&newHeader, io.TeeReader(r, w), true); err != nil {
+		return nil, err
+	}
+	checksum := Checksum(w.Sum(nil))
+	if expected != nil && !bytes.Equal(expected, checksum) {
+		if err := a.fs.Remove(newHeader.Name); err != nil {
+			return nil, fmt.Errorf("unable to remove corrupted file %s: %w", newHeader.Name, err)
+		}
+		return nil, &FileChecksumError{Path: header.Name, Package: pkg.Name, Expected: expected, Actual: checksum}
+	}
+	if existing, err := a.fileChecksum(header.Name); err == nil && bytes.Equal(existing, checksum) {
+		if err := a.fs.Remove(newHeader.Name); err != nil {
+			return nil, fmt.Errorf("unable to remove %s: %w", newHeader.Name, err)
+		}
+		return checksum, nil
+	}
+	if err := a.setMetadata(&newHeader); err != nil {
+		return nil, err
+	}
+	clog.FromContext(ctx).Warnf("keeping locally modified %s, the one in %s (%s) is installed as %s", header.Name, pkg.Name, pkg.Version, newHeader.Name)
+	return checksum, nil
+}
+
+// isModified returns whether the file f of the installed database is not what was installed,
+// by its checksum there. Files without a checksum are not modified.
+func (a *APK) isModified(f *tar.Header) (bool, error) {
+	expected, err := checksumFromHeader(f)
+	if err != nil || len(expected) == 0 {
+		return false, err
+	}
+	actual, err := a.fileChecksum(f.Name)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(expected, actual), nil
+}
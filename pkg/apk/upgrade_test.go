@@ -0,0 +1,328 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestResolveUpgrade(t *testing.T) {
+	ctx := context.Background()
+	newAPK := func(t *testing.T, world []string) *APK {
+		a := newTestFetchAPK(t, nil, WithArch(testArch), WithIgnoreSignatureVerification(true))
+		require.NoError(t, a.SetRepositories(ctx, []string{testAlpineRepos}))
+		require.NoError(t, a.SetWorld(ctx, world))
+		for _, pkg := range []*Package{
+			{Name: "musl", Version: "1.2.3-r0"},
+			{Name: "busybox", Version: "1.35.0-r17"},
+			{Name: "libcrypto1.1", Version: "1.1.1q-r0"},
+			{Name: "alpine-conf", Version: "99.0-r0"},
+			{Name: "not-in-any-repo", Version: "1.0-r0"},
+		} {
+			require.NoError(t, a.addInstalledPackage(pkg, nil))
+		}
+		return a
+	}
+	changes := func(set *UpgradeSet) []string {
+		var got []string
+		for _, c := range set.Changes {
+			got = append(got, fmt.Sprintf("%s %s->%s %v", c.Installed.Name, c.Installed.Version, c.Candidate.Version, c.Downgrade))
+		}
+		return got
+	}
+
+	t.Run("upgrades", func(t *testing.T) {
+		set, err := newAPK(t, []string{"busybox"}).ResolveUpgrade(ctx)
+		require.NoError(t, err)
+		require.False(t, set.Empty())
+		require.Equal(t, []string{
+			"musl 1.2.3-r0->1.2.3-r2 false",
+			"libcrypto1.1 1.1.1q-r0->1.1.1s-r0 false",
+		}, changes(set))
+		require.Len(t, set.Missing, 1)
+		require.Equal(t, "not-in-any-repo", set.Missing[0].Name)
+	})
+
+	t.Run("downgrades", func(t *testing.T) {
+		set, err := newAPK(t, []string{"busybox"}).ResolveUpgrade(ctx, WithAllowDowngrade(true))
+		require.NoError(t, err)
+		require.Contains(t, changes(set), "alpine-conf 99.0-r0->3.14.6-r1 true")
+	})
+
+	t.Run("world pin", func(t *testing.T) {
+		set, err := newAPK(t, []string{"musl=1.2.3-r0", "libcrypto1.1<1.1.1s"}).ResolveUpgrade(ctx)
+		require.NoError(t, err)
+		require.Empty(t, changes(set))
+	})
+}
+
+func TestInstallUpgrade(t *testing.T) {
+	ctx := context.Background()
+	v1 := triggerPackage(t,
+		&PkgInfo{Name: "foo", Version: "1.0-r0", Arch: "x86_64", Triggers: []string{"/opt/foo/plugins"}},
+		fstest.MapFS{
+			"opt":              {Mode: 0o755 | fs.ModeDir},
+			"opt/foo":          {Mode: 0o755 | fs.ModeDir},
+			"opt/foo/a":        {Mode: 0o644, Data: []byte("a1")},
+			"opt/foo/b":        {Mode: 0o644, Data: []byte("b1")},
+			"opt/foo/old":      {Mode: 0o755 | fs.ModeDir},
+			"opt/foo/old/x":    {Mode: 0o644, Data: []byte("x1")},
+			"opt/foo/etc":      {Mode: 0o755 | fs.ModeDir},
+			"opt/foo/etc/conf": {Mode: 0o644, Data: []byte("conf1")},
+		},
+		map[string][]byte{".post-install": []byte("install")})
+	v2 := triggerPackage(t,
+		&PkgInfo{Name: "foo", Version: "2.0-r0", Arch: "x86_64", Triggers: []string{"/opt/foo/plugins2"}},
+		fstest.MapFS{
+			"opt":              {Mode: 0o755 | fs.ModeDir},
+			"opt/foo":          {Mode: 0o755 | fs.ModeDir},
+			"opt/foo/a":        {Mode: 0o644, Data: []byte("a2")},
+			"opt/foo/c":        {Mode: 0o644, Data: []byte("c2")},
+			"opt/foo/etc":      {Mode: 0o755 | fs.ModeDir},
+			"opt/foo/etc/conf": {Mode: 0o644, Data: []byte("conf2")},
+			"opt/foo/etc/new":  {Mode: 0o644, Data: []byte("new2")},
+		},
+		map[string][]byte{".post-upgrade": []byte("upgrade")})
+
+	install := func(t *testing.T, conf string) (*APK, *testScriptRunner) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		a.protectedPaths = []string{"opt/*/etc"}
+		e := &testScriptRunner{a: a}
+		a.scriptRunner = e
+		require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{v1}))
+		if conf != "" {
+			require.NoError(t, a.fs.WriteFile("opt/foo/etc/conf", []byte(conf), 0o644))
+		}
+		require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{v2}))
+		return a, e
+	}
+
+	t.Run("replaces the installed version", func(t *testing.T) {
+		a, e := install(t, "")
+		for name, want := range map[string]string{"opt/foo/a": "a2", "opt/foo/c": "c2", "opt/foo/etc/conf": "conf2", "opt/foo/etc/new": "new2"} {
+			b, err := a.fs.ReadFile(name)
+			require.NoError(t, err)
+			require.Equal(t, want, string(b), name)
+		}
+		for _, name := range []string{"opt/foo/b", "opt/foo/old/x", "opt/foo/old", "opt/foo/etc/conf.apk-new", "opt/foo/etc/new.apk-new"} {
+			_, err := a.fs.Stat(name)
+			require.ErrorIs(t, err, fs.ErrNotExist, name)
+		}
+
+		installed, err := a.GetInstalled()
+		require.NoError(t, err)
+		var foos []*InstalledPackage
+		for _, pkg := range installed {
+			if pkg.Name == "foo" {
+				foos = append(foos, pkg)
+			}
+		}
+		require.Len(t, foos, 1)
+		require.Equal(t, "2.0-r0", foos[0].Version)
+		var files []string
+		for _, f := range foos[0].Files {
+			files = append(files, f.Name)
+		}
+		require.ElementsMatch(t, []string{"opt", "opt/foo", "opt/foo/a", "opt/foo/c", "opt/foo/etc", "opt/foo/etc/conf", "opt/foo/etc/new"}, files)
+
+		require.Equal(t, []string{"foo"}, scriptNames(t, a), "only the scripts of the new version")
+		triggers, err := a.fs.ReadFile(a.triggersFilePath())
+		require.NoError(t, err)
+		require.NotContains(t, string(triggers), "/opt/foo/plugins\n")
+		require.Contains(t, string(triggers), "/opt/foo/plugins2")
+
+		var scripts []string
+		for _, run := range e.runs {
+			scripts = append(scripts, run.script)
+		}
+		require.Equal(t, []string{"install", "upgrade"}, scripts)
+	})
+
+	t.Run("by another APK", func(t *testing.T) {
+		first, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		require.NoError(t, first.InstallPackages(ctx, nil, []InstallablePackage{v1}))
+		a, err := New(WithFS(src), WithIgnoreMknodErrors(ignoreMknodErrors), WithAllowUnsignedLocalPackages())
+		require.NoError(t, err)
+		require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{v2}))
+
+		for _, name := range []string{"opt/foo/b", "opt/foo/old"} {
+			_, err := a.fs.Stat(name)
+			require.ErrorIs(t, err, fs.ErrNotExist, name)
+		}
+		files, err := a.InstalledFiles("foo")
+		require.NoError(t, err)
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name)
+		}
+		require.ElementsMatch(t, []string{"opt", "opt/foo", "opt/foo/a", "opt/foo/c", "opt/foo/etc", "opt/foo/etc/conf", "opt/foo/etc/new"}, names)
+	})
+
+	t.Run("failed upgrade keeps the installed version", func(t *testing.T) {
+		bar := triggerPackage(t,
+			&PkgInfo{Name: "bar", Version: "1.0-r0", Arch: "x86_64"},
+			fstest.MapFS{"opt/foo/z": {Mode: 0o644, Data: []byte("bar")}}, nil)
+		conflicting := triggerPackage(t,
+			&PkgInfo{Name: "foo", Version: "3.0-r0", Arch: "x86_64"},
+			fstest.MapFS{
+				"opt/foo/a": {Mode: 0o644, Data: []byte("a3")},
+				"opt/foo/z": {Mode: 0o644, Data: []byte("z3")},
+			}, nil)
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{v1, bar}))
+		var conflict *FileConflictError
+		require.ErrorAs(t, a.InstallPackages(ctx, nil, []InstallablePackage{conflicting}), &conflict)
+
+		// the files that the new version does not have are still there, and the rest is that
+		// of the installed version
+		for _, name := range []string{"opt/foo/b", "opt/foo/old/x", "opt/foo/etc/conf"} {
+			_, err := a.fs.Stat(name)
+			require.NoError(t, err, name)
+		}
+		installed, err := a.installedPackage("foo")
+		require.NoError(t, err)
+		require.Equal(t, "1.0-r0", installed.Version)
+		names := installedNames(t, a)
+		require.Equal(t, []string{"foo", "bar"}, names[len(names)-2:])
+		require.Contains(t, scriptNames(t, a), "foo")
+		triggers, err := a.fs.ReadFile(a.triggersFilePath())
+		require.NoError(t, err)
+		require.Contains(t, string(triggers), "/opt/foo/plugins\n")
+	})
+
+	t.Run("keeps modified protected files", func(t *testing.T) {
+		a, _ := install(t, "local")
+		for name, want := range map[string]string{"opt/foo/etc/conf": "local", "opt/foo/etc/conf.apk-new": "conf2", "opt/foo/a": "a2"} {
+			b, err := a.fs.ReadFile(name)
+			require.NoError(t, err)
+			require.Equal(t, want, string(b), name)
+		}
+		// the installed database has the new version, which is not that of the modified file
+		files, err := a.InstalledFiles("foo")
+		require.NoError(t, err)
+		sum := sha1.Sum([]byte("conf2")) //nolint:gosec
+		for _, f := range files {
+			if f.Name == "opt/foo/etc/conf" {
+				require.Equal(t, Checksum(sum[:]).String(), f.PAXRecords[paxRecordsChecksumKey])
+			}
+		}
+		_, err = a.WhoOwnsFile("opt/foo/etc/conf.apk-new")
+		require.ErrorIs(t, err, ErrNotOwned)
+	})
+
+	t.Run("no new version of a file modified like it", func(t *testing.T) {
+		a, _ := install(t, "conf2")
+		_, err := a.fs.Stat("opt/foo/etc/conf.apk-new")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("corrupted new version", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		require.NoError(t, a.fs.MkdirAll("etc", 0o755))
+		require.NoError(t, a.fs.WriteFile("etc/conf", []byte("local"), 0o644))
+		sum := sha1.Sum([]byte("conf2")) //nolint:gosec
+		header := &tar.Header{
+			Name:       "etc/conf",
+			Typeflag:   tar.TypeReg,
+			Mode:       0o644,
+			Size:       5,
+			PAXRecords: map[string]string{paxRecordsChecksumKey: Checksum(sum[:]).String()},
+		}
+		_, err = a.installNewVersion(ctx, header, strings.NewReader("conf3"), &Package{Name: "foo"})
+		var checksumErr *FileChecksumError
+		require.ErrorAs(t, err, &checksumErr)
+		require.Equal(t, "etc/conf", checksumErr.Path)
+		require.Equal(t, sum[:], []byte(checksumErr.Expected))
+		_, err = a.fs.Stat("etc/conf.apk-new")
+		require.ErrorIs(t, err, fs.ErrNotExist, "the corrupted new version should be removed")
+	})
+
+	t.Run("same version is skipped", func(t *testing.T) {
+		a, _ := install(t, "")
+		require.NoError(t, a.fs.WriteFile("opt/foo/a", []byte("local"), 0o644))
+		require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{v2}))
+		b, err := a.fs.ReadFile("opt/foo/a")
+		require.NoError(t, err)
+		require.Equal(t, "local", string(b))
+	})
+}
+
+func TestIsProtectedPath(t *testing.T) {
+	a, err := New()
+	require.NoError(t, err)
+	require.True(t, a.isProtectedPath("etc/passwd"), "etc should be protected by default")
+	require.False(t, a.isProtectedPath("usr/bin/sh"))
+
+	a, err = New(WithProtectedPaths("/etc/ssl/", "usr/share/*/conf", "opt/*.conf"))
+	require.NoError(t, err)
+	for name, protected := range map[string]bool{
+		"etc/passwd":                  false,
+		"etc/ssl":                     true,
+		"etc/ssl/certs/ca.pem":        true,
+		"usr/share/foo/conf":          true,
+		"usr/share/foo/conf/a/b":      true,
+		"usr/share/foo/other":         false,
+		"opt/app.conf":                true,
+		"opt/dir/app.conf":            false,
+		"etc/ssl-not-under-etc-ssl/x": false,
+	} {
+		require.Equal(t, protected, a.isProtectedPath(name), name)
+	}
+
+	a, err = New(WithProtectedPaths())
+	require.NoError(t, err)
+	require.False(t, a.isProtectedPath("etc/passwd"))
+	_, err = New(WithProtectedPaths("/"))
+	require.Error(t, err)
+	_, err = New(WithProtectedPaths("etc/["))
+	require.Error(t, err)
+}
+
+func TestUpgradeKeepsUnchangedSymlink(t *testing.T) {
+	ctx := context.Background()
+	foo := func(version string) InstallablePackage {
+		src := apkfs.NewMemFS()
+		require.NoError(t, src.MkdirAll("usr/bin", 0o755))
+		require.NoError(t, src.WriteFile("usr/bin/foo", []byte("foo "+version), 0o755))
+		require.NoError(t, src.Symlink("foo", "usr/bin/bar"))
+		return triggerPackage(t, &PkgInfo{Name: "foo", Version: version, Arch: "x86_64"}, src, nil)
+	}
+	a, _, err := testGetTestAPK()
+	require.NoError(t, err)
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{foo("1.0-r0")}))
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{foo("2.0-r0")}))
+
+	target, err := a.fs.Readlink("usr/bin/bar")
+	require.NoError(t, err, "the unchanged symlink should be kept")
+	require.Equal(t, "foo", target)
+	owner, err := a.WhoOwnsFile("usr/bin/bar")
+	require.NoError(t, err)
+	require.Equal(t, "2.0-r0", owner.Version)
+}
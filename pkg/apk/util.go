@@ -17,11 +17,7 @@ package apk
 import (
 	"archive/tar"
 	"errors"
-	"fmt"
 	"io"
-	"strings"
-
-	"golang.org/x/exp/slices"
 )
 
 func uniqify[T comparable](s []T) []T {
@@ -39,50 +35,21 @@ func uniqify[T comparable](s []T) []T {
 	return uniq
 }
 
-func controlValue(controlTar io.Reader, want ...string) (map[string][]string, error) {
+// pkgInfoFromControl returns the .PKGINFO of the control section tar controlTar, or an empty
+// one if it has none.
+func pkgInfoFromControl(controlTar io.Reader) (*PkgInfo, error) {
 	tr := tar.NewReader(controlTar)
-	mapping := map[string][]string{}
 	for {
 		header, err := tr.Next()
 		if errors.Is(err, io.EOF) {
-			break
+			return &PkgInfo{}, nil
 		}
 		if err != nil {
 			return nil, err
 		}
 
-		// ignore .PKGINFO as it is not a script
-		if header.Name != ".PKGINFO" {
-			continue
-		}
-
-		b, err := io.ReadAll(tr)
-		if err != nil {
-			return nil, fmt.Errorf("unable to read .PKGINFO from control tar.gz file: %w", err)
-		}
-		lines := strings.Split(string(b), "\n")
-		for _, line := range lines {
-			parts := strings.Split(line, "=")
-			if len(parts) != 2 {
-				continue
-			}
-			key := strings.TrimSpace(parts[0])
-			if !slices.Contains(want, key) {
-				continue
-			}
-
-			values, ok := mapping[key]
-			if !ok {
-				values = []string{}
-			}
-
-			value := strings.TrimSpace(parts[1])
-			values = append(values, value)
-
-			mapping[key] = values
+		if header.Name == ".PKGINFO" {
+			return ParsePkgInfo(tr)
 		}
-
-		break
 	}
-	return mapping, nil
 }
@@ -17,169 +17,203 @@ package apk
 import (
 	"fmt"
 	"regexp"
-	"strconv"
 	"strings"
 )
 
-// versionRegex how to parse versions.
-// see https://github.com/alpinelinux/apk-tools/blob/50ab589e9a5a84592ee4c0ac5a49506bb6c552fc/src/version.c#
+// packageNameRegex how to parse package names with a version constraint and pin.
 // for information on pinning, see https://wiki.alpinelinux.org/wiki/Alpine_Package_Keeper#Repository_pinning
 // To quote:
 //
-//   After which you can "pin" dependencies to these tags using:
+//	After which you can "pin" dependencies to these tags using:
 //
-//      apk add stableapp newapp@edge bleedingapp@testing
-//   Apk will now by default only use the untagged repositories, but adding a tag to specific package:
+//	   apk add stableapp newapp@edge bleedingapp@testing
+//	Apk will now by default only use the untagged repositories, but adding a tag to specific package:
 //
-//   1. will prefer the repository with that tag for the named package, even if a later version of the package is available in another repository
+//	1. will prefer the repository with that tag for the named package, even if a later version of the package is available in another repository
 //
-//   2. allows pulling in dependencies for the tagged package from the tagged repository (though it prefers to use untagged repositories to satisfy dependencies if possible)
-
-var (
-	versionRegex     = regexp.MustCompile(`^([0-9]+)((\.[0-9]+)*)([a-z]?)((_alpha|_beta|_pre|_rc)([0-9]*))?((_cvs|_svn|_git|_hg|_p)([0-9]*))?((-r)([0-9]+))?$`)
-	packageNameRegex = regexp.MustCompile(`^([^@=><~]+)(([=><~]+)([^@]+))?(@([a-zA-Z0-9]+))?$`)
-)
+//	2. allows pulling in dependencies for the tagged package from the tagged repository (though it prefers to use untagged repositories to satisfy dependencies if possible)
+var packageNameRegex = regexp.MustCompile(`^([^@=><~]+)(([=><~]+)([^@]+))?(@([a-zA-Z0-9]+))?$`)
 
 func init() {
-	versionRegex.Longest()
 	packageNameRegex.Longest()
 }
 
-type packageVersionPreModifier int
-type packageVersionPostModifier int
+// Version is a package version, e.g. 1.2.3_rc1-r0, ordered like apk-tools orders them.
+// see https://github.com/alpinelinux/apk-tools/blob/50ab589e9a5a84592ee4c0ac5a49506bb6c552fc/src/version.c
+type Version struct {
+	version string
+}
+
+// ParseVersion parses version, returning an error if apk would not accept it.
+func ParseVersion(version string) (Version, error) {
+	if version == "" || !isVersionDigit(version[0]) {
+		return Version{}, fmt.Errorf("invalid version %s, must start with a number", version)
+	}
+	t := versionTokenizer{s: version, typ: tokenDigit}
+	for t.typ != tokenEnd && t.typ != tokenInvalid {
+		t.next()
+	}
+	if t.typ == tokenInvalid {
+		return Version{}, fmt.Errorf("invalid version %s, could not parse", version)
+	}
+	return Version{version: version}, nil
+}
+
+// Compare returns -1, 0 or 1 if v is less than, equal to or greater than other.
+func (v Version) Compare(other Version) int {
+	return int(compareVersions(v, other))
+}
+
+func (v Version) String() string {
+	return v.version
+}
+
+// versionToken is the type of a token of a version; tokens may only follow
+// tokens of a lower type, with a few exceptions.
+type versionToken int
 
-// the order of these matters!
 const (
-	packageVersionPreModifierNone  packageVersionPreModifier = 0
-	packageVersionPreModifierAlpha packageVersionPreModifier = 1
-	packageVersionPreModifierBeta  packageVersionPreModifier = 2
-	packageVersionPreModifierPre   packageVersionPreModifier = 3
-	packageVersionPreModifierRC    packageVersionPreModifier = 4
-	packageVersionPreModifierMax   packageVersionPreModifier = 1000
+	tokenInvalid versionToken = iota - 1
+	tokenDigitOrZero
+	tokenDigit
+	tokenLetter
+	tokenSuffix
+	tokenSuffixNumber
+	tokenRevisionNumber
+	tokenEnd
 )
-const (
-	packageVersionPostModifierNone packageVersionPostModifier = 0
-	packageVersionPostModifierCVS  packageVersionPostModifier = 1
-	packageVersionPostModifierSVN  packageVersionPostModifier = 2
-	packageVersionPostModifierGit  packageVersionPostModifier = 3
-	packageVersionPostModifierHG   packageVersionPostModifier = 4
-	packageVersionPostModifierP    packageVersionPostModifier = 5
-	packageVersionPostModifierMax  packageVersionPostModifier = 1000
+
+var (
+	// pre-release suffixes sort before the release, in this order
+	versionPreSuffixes = []string{"alpha", "beta", "pre", "rc"}
+	// post-release suffixes sort after it, in this order
+	versionPostSuffixes = []string{"cvs", "svn", "git", "hg", "p"}
 )
 
-type packageVersion struct {
-	numbers          []int
-	letter           rune
-	preSuffix        packageVersionPreModifier
-	preSuffixNumber  int
-	postSuffix       packageVersionPostModifier
-	postSuffixNumber int
-	revision         int
+// versionTokenizer splits what is left of a version into tokens, typ being the
+// type of the next one.
+type versionTokenizer struct {
+	s   string
+	typ versionToken
 }
 
-func parseVersion(version string) (packageVersion, error) {
-	parts := versionRegex.FindAllStringSubmatch(version, -1)
-	if len(parts) == 0 {
-		return packageVersion{}, fmt.Errorf("invalid version %s, could not parse", version)
-	}
-	actuals := parts[0]
-	numbers := make([]int, 0, 10)
-	if len(actuals) != 14 {
-		return packageVersion{}, fmt.Errorf("invalid version %s, could not find enough components", version)
-	}
-
-	// get the first version number
-	num, err := strconv.Atoi(actuals[1])
-	if err != nil {
-		return packageVersion{}, fmt.Errorf("invalid version %s, first part is not number: %w", version, err)
-	}
-	numbers = append(numbers, num)
+func isVersionDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
 
-	// get any other version numbers
-	if actuals[2] != "" {
-		subparts := strings.Split(actuals[2], ".")
-		for i, s := range subparts {
-			if s == "" {
-				continue
-			}
-			num, err := strconv.Atoi(s)
-			if err != nil {
-				return packageVersion{}, fmt.Errorf("invalid version %s, part %d is not number: %w", version, i, err)
+// nextType consumes the separator of the next token, if any, and sets its type.
+func (t *versionTokenizer) nextType() {
+	n := tokenInvalid
+	switch {
+	case len(t.s) == 0:
+		n = tokenEnd
+	case (t.typ == tokenDigit || t.typ == tokenDigitOrZero) && t.s[0] >= 'a' && t.s[0] <= 'z':
+		n = tokenLetter
+	case t.typ == tokenLetter && isVersionDigit(t.s[0]):
+		n = tokenDigit
+	case t.typ == tokenSuffix && isVersionDigit(t.s[0]):
+		n = tokenSuffixNumber
+	default:
+		switch t.s[0] {
+		case '.':
+			n = tokenDigitOrZero
+		case '_':
+			n = tokenSuffix
+		case '-':
+			if len(t.s) > 1 && t.s[1] == 'r' {
+				n = tokenRevisionNumber
+				t.s = t.s[1:]
 			}
-			numbers = append(numbers, num)
+		}
+		t.s = t.s[1:]
+		if len(t.s) == 0 && n != tokenInvalid {
+			// a separator must be followed by a token, e.g. 1.0. and 1.0-r are invalid
+			n = tokenInvalid
 		}
 	}
-	var letter rune
-	if len(actuals[4]) > 0 {
-		letter = rune(actuals[4][0])
-	}
-	var preSuffix packageVersionPreModifier
-	switch actuals[6] {
-	case "_alpha":
-		preSuffix = packageVersionPreModifierAlpha
-	case "_beta":
-		preSuffix = packageVersionPreModifierBeta
-	case "_pre":
-		preSuffix = packageVersionPreModifierPre
-	case "_rc":
-		preSuffix = packageVersionPreModifierRC
-	case "":
-		preSuffix = packageVersionPreModifierNone
-	default:
-		return packageVersion{}, fmt.Errorf("invalid version %s, pre-suffix %s is not valid", version, actuals[6])
-	}
-	var preSuffixNumber int
-	if actuals[7] != "" {
-		num, err := strconv.Atoi(actuals[7])
-		if err != nil {
-			return packageVersion{}, fmt.Errorf("invalid version %s, suffix %s number %s is not number: %w", version, actuals[6], actuals[7], err)
+	if n < t.typ {
+		if !((n == tokenDigitOrZero && t.typ == tokenDigit) ||
+			(n == tokenSuffix && t.typ == tokenSuffixNumber) ||
+			(n == tokenDigit && t.typ == tokenLetter)) {
+			n = tokenInvalid
 		}
-		preSuffixNumber = num
-	}
-
-	var postSuffix packageVersionPostModifier
-	switch actuals[9] {
-	case "_cvs":
-		postSuffix = packageVersionPostModifierCVS
-	case "_svn":
-		postSuffix = packageVersionPostModifierSVN
-	case "_git":
-		postSuffix = packageVersionPostModifierGit
-	case "_hg":
-		postSuffix = packageVersionPostModifierHG
-	case "_p":
-		postSuffix = packageVersionPostModifierP
-	case "":
-		postSuffix = packageVersionPostModifierNone
-	default:
-		return packageVersion{}, fmt.Errorf("invalid version %s, suffix %s is not valid", version, actuals[9])
 	}
-	var postSuffixNumber int
-	if actuals[10] != "" {
-		num, err := strconv.Atoi(actuals[10])
-		if err != nil {
-			return packageVersion{}, fmt.Errorf("invalid version %s, post-suffix %s number %s is not number: %w", version, actuals[9], actuals[10], err)
+	t.typ = n
+}
+
+// next consumes the next token, returning its value.
+func (t *versionTokenizer) next() int {
+	if len(t.s) == 0 {
+		t.typ = tokenEnd
+		return 0
+	}
+
+	v, i, nt := 0, 0, tokenInvalid
+	switch t.typ {
+	case tokenDigitOrZero:
+		// leading zeros are a token of their own, followed by the rest of the number,
+		// so that they sort as fractions, i.e. 1.01 < 1.1
+		if t.s[0] == '0' {
+			for i < len(t.s) && t.s[i] == '0' {
+				i++
+			}
+			nt = tokenDigit
+			v = -i
+			break
 		}
-		postSuffixNumber = num
+		fallthrough
+	case tokenDigit, tokenSuffixNumber, tokenRevisionNumber:
+		for i < len(t.s) && isVersionDigit(t.s[i]) {
+			v = v*10 + int(t.s[i]-'0')
+			i++
+		}
+		if i == 0 && (t.typ == tokenDigitOrZero || t.typ == tokenRevisionNumber) {
+			// a number must follow . and -r, e.g. 1..0 is invalid
+			t.typ = tokenInvalid
+			return -1
+		}
+	case tokenLetter:
+		v = int(t.s[0])
+		i = 1
+	case tokenSuffix:
+		if idx, n := versionSuffix(t.s, versionPreSuffixes); idx >= 0 {
+			v, i, nt = idx-len(versionPreSuffixes), n, tokenSuffixNumber
+		} else if idx, n := versionSuffix(t.s, versionPostSuffixes); idx >= 0 {
+			v, i, nt = idx, n, tokenSuffixNumber
+		} else {
+			// unknown suffixes make the version invalid
+			t.typ = tokenInvalid
+			return -1
+		}
+	default:
+		t.typ = tokenInvalid
+		return -1
+	}
+
+	t.s = t.s[i:]
+	switch {
+	case nt == tokenDigit:
+		// the rest of the number after leading zeros, which may be empty; it must
+		// always be read, so that 1.0 and 1.0_rc1 both have it
+		t.typ = nt
+	case len(t.s) == 0:
+		t.typ = tokenEnd
+	case nt != tokenInvalid:
+		t.typ = nt
+	default:
+		t.nextType()
 	}
+	return v
+}
 
-	var revision int
-	if actuals[13] != "" {
-		num, err := strconv.Atoi(actuals[13])
-		if err != nil {
-			return packageVersion{}, fmt.Errorf("invalid version %s, revision %s is not number: %w", version, actuals[13], err)
+// versionSuffix returns the index of the suffix of suffixes s starts with, and its length.
+func versionSuffix(s string, suffixes []string) (int, int) {
+	for i, suffix := range suffixes {
+		if strings.HasPrefix(s, suffix) {
+			return i, len(suffix)
 		}
-		revision = num
-	}
-	return packageVersion{
-		numbers:          numbers,
-		letter:           letter,
-		preSuffix:        preSuffix,
-		preSuffixNumber:  preSuffixNumber,
-		postSuffix:       postSuffix,
-		postSuffixNumber: postSuffixNumber,
-		revision:         revision,
-	}, nil
+	}
+	return -1, 0
 }
 
 type versionCompare int
@@ -203,129 +237,60 @@ func (vc versionCompare) String() string {
 	}
 }
 
-// compare versions based on https://dev.gentoo.org/~ulm/pms/head/pms.html#x1-250003.2
-func compareVersions(actual, required packageVersion) versionCompare {
-	for i := 0; i < len(actual.numbers) && i < len(required.numbers); i++ {
-		if actual.numbers[i] > required.numbers[i] {
-			return greater
-		}
-		if actual.numbers[i] < required.numbers[i] {
-			return less
-		}
-	}
-	// if we made it here, the parts that were the same size are equal
-	if len(actual.numbers) > len(required.numbers) {
-		return greater
-	}
-	if len(actual.numbers) < len(required.numbers) {
-		return less
-	}
-	// same length of numbers, same numbers
-	// compare letters
-	if actual.letter > required.letter {
-		return greater
-	}
-	if actual.letter < required.letter {
-		return less
-	}
-	// same letters
-	// compare pre-suffixes
-	// because None is 0 but the lowest priority to make it easy to have a sane default,
-	// but lowest priority, we need some extra logic to handle
-	actualPreSuffix, requiredPreSuffix := actual.preSuffix, required.preSuffix
-	if actualPreSuffix == packageVersionPreModifierNone {
-		actualPreSuffix = packageVersionPreModifierMax
-	}
-	if requiredPreSuffix == packageVersionPreModifierNone {
-		requiredPreSuffix = packageVersionPreModifierMax
-	}
-	if actualPreSuffix > requiredPreSuffix {
-		return greater
+// compareVersions compares versions token by token like apk-tools does.
+func compareVersions(actual, required Version) versionCompare {
+	return compareVersionsFuzzy(actual, required, false)
+}
+
+// compareVersionsFuzzy compares versions, considering them equal if fuzzy and all
+// the tokens of required match the start of actual.
+func compareVersionsFuzzy(actual, required Version, fuzzy bool) versionCompare {
+	a := versionTokenizer{s: actual.version, typ: tokenDigit}
+	b := versionTokenizer{s: required.version, typ: tokenDigit}
+	var av, bv int
+	for a.typ == b.typ && a.typ != tokenEnd && a.typ != tokenInvalid && av == bv {
+		av = a.next()
+		bv = b.next()
 	}
-	if actualPreSuffix < requiredPreSuffix {
+
+	// value of this token differs?
+	if av < bv {
 		return less
 	}
-	// same pre-suffixes, compare pre-suffix numbers
-	if actual.preSuffixNumber > required.preSuffixNumber {
+	if av > bv {
 		return greater
 	}
-	if actual.preSuffixNumber < required.preSuffixNumber {
-		return less
-	}
-	// same pre-suffix numbers
-	// compare post-suffixes
-	//
-	// Note that whereas we do a None -> Max transformation for pre-suffixes, we intentionally
-	// leave post-suffixes alone, because they do not indicate a pre-release and should sort
-	// greater than a version lacking a post-suffix.
-	if actual.postSuffix > required.postSuffix {
-		return greater
+
+	// both have ended or are invalid, or required is a prefix of actual
+	if a.typ == b.typ || (fuzzy && b.typ == tokenEnd) {
+		return equal
 	}
-	if actual.postSuffix < required.postSuffix {
-		return less
+
+	// leading version components and their values are equal, now the
+	// non-terminating version is greater unless it is a pre-release suffix
+	if a.typ == tokenSuffix {
+		if t := a; t.next() < 0 {
+			return less
+		}
 	}
-	// same post-suffixes, compare post-suffix numbers
-	if actual.postSuffixNumber > required.postSuffixNumber {
-		return greater
+	if b.typ == tokenSuffix {
+		if t := b; t.next() < 0 {
+			return greater
+		}
 	}
-	if actual.postSuffixNumber < required.postSuffixNumber {
+	if a.typ > b.typ {
 		return less
 	}
-	// same post-suffix numbers
-	// compare revisions
-	if actual.revision > required.revision {
+	if b.typ > a.typ {
 		return greater
 	}
-	if actual.revision < required.revision {
-		return less
-	}
 	return equal
 }
 
-// includesVersion returns true if the actual version is a strict subset of the required version
-func includesVersion(actual, required packageVersion) bool {
-	// if more required numbers than actual numbers, than require is more specific,
-	// so no match
-	if len(actual.numbers) < len(required.numbers) {
-		return false
-	}
-	for i := 0; i < len(required.numbers); i++ {
-		if actual.numbers[i] != required.numbers[i] {
-			return false
-		}
-	}
-	// if length is the same, check the rest of it; if actual is longer, it's ok
-	if len(actual.numbers) > len(required.numbers) {
-		return true
-	}
-	// was there a required letter?
-	if required.letter != 0 && actual.letter != required.letter {
-		return false
-	}
-
-	// was there pre-suffix
-	if required.preSuffix != packageVersionPreModifierNone && actual.preSuffix != required.preSuffix {
-		return false
-	}
-
-	// was there pre-suffix number
-	if required.preSuffixNumber != 0 && actual.preSuffixNumber != required.preSuffixNumber {
-		return false
-	}
-
-	// was there post-suffix
-	if required.postSuffix != packageVersionPostModifierNone && actual.postSuffix != required.postSuffix {
-		return false
-	}
-	if required.postSuffixNumber != 0 && actual.postSuffixNumber != required.postSuffixNumber {
-		return false
-	}
-
-	// compare revisions
-	if required.revision != 0 && actual.revision != required.revision {
-		return false
-	}
-	return true
+// includesVersion returns true if the actual version starts with all the components
+// of the required version, e.g. 1.2.3-r0 includes 1.2.
+func includesVersion(actual, required Version) bool {
+	return compareVersionsFuzzy(actual, required, true) == equal
 }
 
 type versionDependency int
@@ -340,14 +305,15 @@ const (
 	versionTilde
 )
 
-func (v versionDependency) satisfies(actualVersion, requiredVersion packageVersion) bool {
-	if v == versionTilde {
+func (v versionDependency) satisfies(actualVersion, requiredVersion Version) bool {
+	switch v {
+	case versionAny:
+		return true
+	case versionTilde:
 		return includesVersion(actualVersion, requiredVersion)
 	}
 	c := compareVersions(actualVersion, requiredVersion)
 	switch v {
-	case versionAny:
-		return true
 	case versionEqual:
 		return c == equal
 	case versionGreater:
@@ -363,6 +329,19 @@ func (v versionDependency) satisfies(actualVersion, requiredVersion packageVersi
 	}
 }
 
+// versionOperators maps each dependency operator to the comparison it performs.
+// "~" and "=~" are fuzzy matches on the leading version components, so "~1.2"
+// matches 1.2, 1.2.3 and 1.2.3-r4 but not 1.20.
+var versionOperators = map[string]versionDependency{
+	"=":  versionEqual,
+	">":  versionGreater,
+	"<":  versionLess,
+	">=": versionGreaterEqual,
+	"<=": versionLessEqual,
+	"~":  versionTilde,
+	"=~": versionTilde,
+}
+
 type parsedConstraint struct {
 	name    string
 	version string
@@ -371,12 +350,19 @@ type parsedConstraint struct {
 }
 
 func resolvePackageNameVersionPin(pkgName string) parsedConstraint {
+	p, _ := parseConstraint(pkgName)
+	return p
+}
+
+// parseConstraint parses a name with an optional version constraint and pin. On error, it still
+// returns its best effort at a constraint, which treats an unknown operator as versionAny.
+func parseConstraint(pkgName string) (parsedConstraint, error) {
 	parts := packageNameRegex.FindAllStringSubmatch(pkgName, -1)
 	if len(parts) == 0 || len(parts[0]) < 2 {
 		return parsedConstraint{
 			name: pkgName,
 			dep:  versionAny,
-		}
+		}, fmt.Errorf("invalid dependency %q", pkgName)
 	}
 	// layout: [full match, name, =version, =|>|<, version, @pin, pin]
 	p := parsedConstraint{
@@ -387,34 +373,92 @@ func resolvePackageNameVersionPin(pkgName string) parsedConstraint {
 	}
 
 	matcher := parts[0][3]
-	if matcher != "" {
-		// we have an equal
-		switch matcher {
-		case "=":
-			p.dep = versionEqual
-		case ">":
-			p.dep = versionGreater
-		case "<":
-			p.dep = versionLess
-		case ">=":
-			p.dep = versionGreaterEqual
-		case "<=":
-			p.dep = versionLessEqual
-		case "~":
-			p.dep = versionTilde
-		default:
-			p.dep = versionAny
-		}
+	if matcher == "" {
+		return p, nil
 	}
-	return p
+	dep, ok := versionOperators[matcher]
+	if !ok {
+		return p, fmt.Errorf("invalid operator %q in dependency %q", matcher, pkgName)
+	}
+	p.dep = dep
+	return p, nil
+}
+
+// Dependency is a single parsed dependency, as found in the world file or in the D: field
+// of a package, e.g. "busybox>1.36", "so:libcrypto.so.3>=3.0" or "!musl".
+type Dependency struct {
+	// Name is the package name, or the name of something a package provides.
+	Name string
+	// Operator is one of =, <, >, <=, >=, ~ or =~, or empty if any version is acceptable.
+	Operator string
+	// Version is the version the operator compares against.
+	Version string
+	// Pin is the repository tag after the @, if any.
+	Pin string
+	// Conflict is true for a "!name" dependency, which forbids installing Name.
+	Conflict bool
+
+	dep     versionDependency
+	version Version
+}
+
+// ParseDependency parses and validates a dependency. It returns an error if the operator is not
+// known or the version is not a valid apk version.
+func ParseDependency(s string) (Dependency, error) {
+	var d Dependency
+	constraint := strings.TrimPrefix(s, "!")
+	d.Conflict = constraint != s
+	if constraint == "" {
+		return d, fmt.Errorf("invalid dependency %q: missing name", s)
+	}
+
+	parsed, err := parseConstraint(constraint)
+	if err != nil {
+		return d, err
+	}
+	d.Name, d.Version, d.Pin, d.dep = parsed.name, parsed.version, parsed.pin, parsed.dep
+	if parsed.dep == versionAny {
+		return d, nil
+	}
+	d.Operator = packageNameRegex.FindStringSubmatch(constraint)[3]
+	if d.version, err = ParseVersion(parsed.version); err != nil {
+		return d, fmt.Errorf("invalid dependency %q: %w", s, err)
+	}
+	return d, nil
+}
+
+// Satisfies reports whether the given version meets the version constraint of the dependency.
+// It does not take Conflict into account.
+func (d Dependency) Satisfies(v Version) bool {
+	return d.dep.satisfies(v, d.version)
+}
+
+// String returns the dependency in the form it was parsed from.
+func (d Dependency) String() string {
+	var sb strings.Builder
+	if d.Conflict {
+		sb.WriteString("!")
+	}
+	sb.WriteString(d.Name)
+	if d.Operator != "" {
+		sb.WriteString(d.Operator)
+		sb.WriteString(d.Version)
+	}
+	if d.Pin != "" {
+		sb.WriteString("@")
+		sb.WriteString(d.Pin)
+	}
+	return sb.String()
 }
 
 type filterOptions struct {
-	allowPin  string
-	preferPin string
-	version   string
-	installed *RepositoryPackage
-	compare   versionDependency
+	name       string
+	allowPin   string
+	preferPin  string
+	requirePin string
+	version    string
+	installed  *RepositoryPackage
+	compare    versionDependency
 }
 
 type filterOption func(*filterOptions)
@@ -424,11 +468,28 @@ func withAllowPin(pin string) filterOption {
 		o.allowPin = pin
 	}
 }
+
+// withRequirePin only allows packages from the repository tagged with pin, if it is set.
+func withRequirePin(pin string) filterOption {
+	return func(o *filterOptions) {
+		o.requirePin = pin
+	}
+}
+
 func withPreferPin(pin string) filterOption {
 	return func(o *filterOptions) {
 		o.preferPin = pin
 	}
 }
+
+// withName sets the name that was asked for, so that only the matching provides of a
+// package are compared against the required version.
+func withName(name string) filterOption {
+	return func(o *filterOptions) {
+		o.name = name
+	}
+}
+
 func withVersion(version string, compare versionDependency) filterOption {
 	return func(o *filterOptions) {
 		o.version = version
@@ -462,10 +523,17 @@ func (p *PkgResolver) filterPackages(pkgs []*repositoryPackage, dq map[*Reposito
 		if _, dqed := dq[pkg.RepositoryPackage]; dqed {
 			continue
 		}
+		if reason, vetoed := p.veto(pkg.RepositoryPackage); vetoed {
+			p.disqualify(dq, pkg.RepositoryPackage, reason)
+			continue
+		}
 		// do we allow this package?
 
 		// if it has a pinned name, and it is not preferred or allowed, we reject it immediately
 		// unless it already was allowed installed from elsewhere
+		if o.requirePin != "" && pkg.pinnedName != o.requirePin {
+			continue
+		}
 		if (pkg.pinnedName != "" && pkg.pinnedName != o.allowPin && pkg.pinnedName != o.preferPin) && (o.installed == nil || installedURL != pkg.URL()) {
 			continue
 		}
@@ -493,10 +561,11 @@ func (p *PkgResolver) filterPackages(pkgs []*repositoryPackage, dq map[*Reposito
 		}
 
 		for _, prov := range pkg.Provides {
-			version := p.resolvePackageNameVersionPin(prov).version
-			if version == "" {
+			provided := p.resolvePackageNameVersionPin(prov)
+			if provided.version == "" || (o.name != "" && provided.name != o.name) {
 				continue
 			}
+			version := provided.version
 
 			actualVersion, err = p.parseVersion(version)
 			// again, we skip invalid ones
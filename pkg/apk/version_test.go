@@ -24,70 +24,80 @@ import (
 
 func TestParseVersion(t *testing.T) {
 	t.Run("valid", func(t *testing.T) {
-		tests := []struct {
-			version  string
-			expected packageVersion
-		}{
+		tests := []string{
 			// various legitimate ones
-			{"1", packageVersion{numbers: []int{1}, preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1", packageVersion{numbers: []int{1, 1}, preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1.1", packageVersion{numbers: []int{1, 1, 1}, preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1a", packageVersion{numbers: []int{1}, letter: 'a', preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1a", packageVersion{numbers: []int{1, 1}, letter: 'a', preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1.1a", packageVersion{numbers: []int{1, 1, 1}, letter: 'a', preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1_alpha", packageVersion{numbers: []int{1}, preSuffix: packageVersionPreModifierAlpha, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1_beta", packageVersion{numbers: []int{1}, preSuffix: packageVersionPreModifierBeta, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1_alpha1", packageVersion{numbers: []int{1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 1, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1_alpha2", packageVersion{numbers: []int{1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 2, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1_alpha", packageVersion{numbers: []int{1, 1}, preSuffix: packageVersionPreModifierAlpha, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1.1_alpha", packageVersion{numbers: []int{1, 1, 1}, preSuffix: packageVersionPreModifierAlpha, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1_alpha1", packageVersion{numbers: []int{1, 1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 1, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1a_alpha1", packageVersion{numbers: []int{1}, letter: 'a', preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 1, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1a_alpha2", packageVersion{numbers: []int{1}, letter: 'a', preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 2, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1b_alpha", packageVersion{numbers: []int{1, 1}, letter: 'b', preSuffix: packageVersionPreModifierAlpha, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1.1c_alpha", packageVersion{numbers: []int{1, 1, 1}, letter: 'c', preSuffix: packageVersionPreModifierAlpha, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1r_alpha1", packageVersion{numbers: []int{1, 1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 1, letter: 'r', postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1.1s_alpha2", packageVersion{numbers: []int{1, 1, 1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 2, letter: 's', postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1-r2", packageVersion{numbers: []int{1}, preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1-r2", packageVersion{numbers: []int{1, 1}, preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1.1-r2", packageVersion{numbers: []int{1, 1, 1}, preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1a-r2", packageVersion{numbers: []int{1}, letter: 'a', preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1a-r2", packageVersion{numbers: []int{1, 1}, letter: 'a', preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1.1a-r2", packageVersion{numbers: []int{1, 1, 1}, letter: 'a', preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1_alpha-r2", packageVersion{numbers: []int{1}, preSuffix: packageVersionPreModifierAlpha, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1_beta-r2", packageVersion{numbers: []int{1}, preSuffix: packageVersionPreModifierBeta, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1_alpha1-r2", packageVersion{numbers: []int{1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 1, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1_alpha2-r2", packageVersion{numbers: []int{1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 2, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1_alpha-r2", packageVersion{numbers: []int{1, 1}, preSuffix: packageVersionPreModifierAlpha, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1.1_alpha-r2", packageVersion{numbers: []int{1, 1, 1}, preSuffix: packageVersionPreModifierAlpha, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1_alpha1-r2", packageVersion{numbers: []int{1, 1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 1, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1.1_alpha2-r2", packageVersion{numbers: []int{1, 1, 1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 2, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1a_alpha1-r2", packageVersion{numbers: []int{1}, letter: 'a', preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 1, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1a_alpha2-r2", packageVersion{numbers: []int{1}, letter: 'a', preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 2, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1b_alpha-r2", packageVersion{numbers: []int{1, 1}, letter: 'b', preSuffix: packageVersionPreModifierAlpha, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1.1c_alpha-r2", packageVersion{numbers: []int{1, 1, 1}, letter: 'c', preSuffix: packageVersionPreModifierAlpha, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1r_alpha1-r2", packageVersion{numbers: []int{1, 1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 1, letter: 'r', postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1.1s_alpha2-r2", packageVersion{numbers: []int{1, 1, 1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 2, letter: 's', postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1.1-r2", packageVersion{numbers: []int{1, 1, 1}, preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1.1-r29", packageVersion{numbers: []int{1, 1, 1}, preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 29}},
+			"1",
+			"1.1",
+			"1.1.1",
+			"1a",
+			"1.1a",
+			"1.1.1a",
+			"1_alpha",
+			"1_beta",
+			"1_alpha1",
+			"1_alpha2",
+			"1.1_alpha",
+			"1.1.1_alpha",
+			"1.1_alpha1",
+			"1a_alpha1",
+			"1a_alpha2",
+			"1.1b_alpha",
+			"1.1.1c_alpha",
+			"1.1r_alpha1",
+			"1.1.1s_alpha2",
+			"1-r2",
+			"1.1-r2",
+			"1.1.1-r2",
+			"1a-r2",
+			"1.1a-r2",
+			"1.1.1a-r2",
+			"1_alpha-r2",
+			"1_beta-r2",
+			"1_alpha1-r2",
+			"1_alpha2-r2",
+			"1.1_alpha-r2",
+			"1.1.1_alpha-r2",
+			"1.1_alpha1-r2",
+			"1.1.1_alpha2-r2",
+			"1a_alpha1-r2",
+			"1a_alpha2-r2",
+			"1.1b_alpha-r2",
+			"1.1.1c_alpha-r2",
+			"1.1r_alpha1-r2",
+			"1.1.1s_alpha2-r2",
+			"1.1.1-r2",
+			"1.1.1-r29",
+			"1.0_alpha_pre2",
+			"1.0_git20230331_p2",
+			"1.01",
+			"1.0_rc",
 		}
-		for _, tt := range tests {
-			actual, err := parseVersion(tt.version)
-			require.NoError(t, err, "%q unexpected error", tt.version)
-			require.Equal(t, tt.expected, actual, "%q expected %v, got %v", tt.version, tt.expected, actual)
+		for _, version := range tests {
+			actual, err := ParseVersion(version)
+			require.NoError(t, err, "%q unexpected error", version)
+			require.Equal(t, version, actual.String())
 		}
 	})
 	t.Run("invalid", func(t *testing.T) {
 		tests := []string{
 			// various illegitimate ones
+			"",
+			"a",
 			"a.1.2",
 			"1.a.2",
 			"1_illegal",
 			"1_illegal",
 			"1.1.1-rQ",
+			"1.0-1",
+			"1a.2",
+			"1.0-r1_alpha",
+			"1..0",
+			"1.0.",
+			"1.0-r",
+			"1.0_",
 		}
 		for _, version := range tests {
-			_, err := parseVersion(version)
+			_, err := ParseVersion(version)
 			require.Error(t, err, "%q mismatched error", version)
 		}
 	})
@@ -833,17 +843,46 @@ func TestCompareVersion(t *testing.T) {
 		{"0.0_git20230331", less, "0.0_git20230508"},
 		{"2.0.0", less, "2.0.6-r0"},
 		{"6.4_p20231125-r0", greater, "6.4-r2"},
+		// pre-releases sort before the release, post-releases after
+		{"1.2.0_rc1", less, "1.2.0"},
+		{"1.2.0_rc1-r5", less, "1.2.0-r0"},
+		{"1.0_alpha", less, "1.0_beta"},
+		{"1.0_beta", less, "1.0_pre"},
+		{"1.0_pre", less, "1.0_rc"},
+		{"1.0_rc", less, "1.0"},
+		{"1.0", less, "1.0_cvs"},
+		{"1.0_cvs", less, "1.0_svn"},
+		{"1.0_svn", less, "1.0_git"},
+		{"1.0_git", less, "1.0_hg"},
+		{"1.0_hg", less, "1.0_p"},
+		{"1.0_rc9", less, "1.0_rc10"},
+		{"1.0_p1", less, "1.0.1"},
+		{"1.0_rc1", less, "1.0-r1"},
+		// letters sort after the plain version
+		{"1.0", less, "1.0a"},
+		{"1.0a", less, "1.0b"},
+		{"1.0z", less, "1.0.1"},
+		// leading zeros sort as fractions
+		{"1.01", less, "1.1"},
+		{"1.001", less, "1.01"},
+		{"2.010", greater, "2.01"},
+		// revisions
+		{"1.0", less, "1.0-r1"},
+		{"1.0", less, "1.0-r0"},
+		{"1.0-r9", less, "1.0-r10"},
+		{"1.0-r100", less, "1.0.1"},
 	}
 	for _, tt := range tests {
 		t.Run(fmt.Sprintf("compare %s %s %s", tt.versionA, tt.expected, tt.versionB), func(t *testing.T) {
-			verA, err := parseVersion(tt.versionA)
+			verA, err := ParseVersion(tt.versionA)
 			require.NoError(t, err, "%q unexpected error", err)
 
-			verB, err := parseVersion(tt.versionB)
+			verB, err := ParseVersion(tt.versionB)
 			require.NoError(t, err, "%q unexpected error", err)
 
 			result := compareVersions(verA, verB)
 			require.Equalf(t, tt.expected, result, "comparison (%s %s %s) must be correct", tt.versionA, tt.expected, tt.versionB)
+			require.Equal(t, -int(tt.expected), verB.Compare(verA))
 		})
 	}
 }
@@ -907,6 +946,24 @@ func TestResolveVersion(t *testing.T) {
 	}
 }
 
+func TestResolvePreRelease(t *testing.T) {
+	pkgs := []*repositoryPackage{
+		testNamedPackageFromVersionAndPin("1.2.0_rc1-r0", ""),
+		testNamedPackageFromVersionAndPin("1.2.0-r0", ""),
+		testNamedPackageFromVersionAndPin("1.2.0_rc2-r3", ""),
+	}
+	pr := NewPkgResolver(context.Background(), []NamedIndex{})
+	found := pr.filterPackages(pkgs, map[*RepositoryPackage]string{})
+	pkg := pr.bestPackage(found, nil, "", nil, nil, "")
+	require.NotNil(t, pkg)
+	require.Equal(t, "1.2.0-r0", pkg.Version)
+
+	found = pr.filterPackages(pkgs, map[*RepositoryPackage]string{}, withVersion("1.2.0", versionLess))
+	pkg = pr.bestPackage(found, nil, "", nil, nil, "")
+	require.NotNil(t, pkg)
+	require.Equal(t, "1.2.0_rc2-r3", pkg.Version)
+}
+
 func TestResolverPackageNameVersionPin(t *testing.T) {
 	tests := []struct {
 		input   string
@@ -923,6 +980,9 @@ func TestResolverPackageNameVersionPin(t *testing.T) {
 		{"name<1.2.3", "name", "1.2.3", versionLess, ""},
 		{"name>=1.2.3", "name", "1.2.3", versionGreaterEqual, ""},
 		{"name<=1.2.3", "name", "1.2.3", versionLessEqual, ""},
+		{"name~1.2", "name", "1.2", versionTilde, ""},
+		{"name=~1.2", "name", "1.2", versionTilde, ""},
+		{"so:libcrypto.so.3>=3.0", "so:libcrypto.so.3", "3.0", versionGreaterEqual, ""},
 		{"name@edge=1.2.3", "name@edge=1.2.3", "", versionAny, ""}, // wrong order, so just returns the whole thing
 		{"name=1.2.3@community", "name", "1.2.3", versionEqual, "community"},
 	}
@@ -937,3 +997,61 @@ func TestResolverPackageNameVersionPin(t *testing.T) {
 		})
 	}
 }
+
+func TestParseDependency(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Dependency
+	}{
+		{"busybox", Dependency{Name: "busybox"}},
+		{"busybox>1.36", Dependency{Name: "busybox", Operator: ">", Version: "1.36"}},
+		{"so:libcrypto.so.3>=3.0", Dependency{Name: "so:libcrypto.so.3", Operator: ">=", Version: "3.0"}},
+		{"name=~1.2@edge", Dependency{Name: "name", Operator: "=~", Version: "1.2", Pin: "edge"}},
+		{"!musl<1.2", Dependency{Name: "musl", Operator: "<", Version: "1.2", Conflict: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			dep, err := ParseDependency(tt.input)
+			require.NoError(t, err)
+			require.Equal(t, tt.want.Name, dep.Name)
+			require.Equal(t, tt.want.Operator, dep.Operator)
+			require.Equal(t, tt.want.Version, dep.Version)
+			require.Equal(t, tt.want.Pin, dep.Pin)
+			require.Equal(t, tt.want.Conflict, dep.Conflict)
+			require.Equal(t, tt.input, dep.String())
+		})
+	}
+
+	for _, input := range []string{"", "!", "name>>1.2", "name=~", "name>=abc", "name@edge=1.2.3"} {
+		t.Run("invalid "+input, func(t *testing.T) {
+			_, err := ParseDependency(input)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestDependencySatisfies(t *testing.T) {
+	tests := []struct {
+		dep     string
+		version string
+		want    bool
+	}{
+		{"foo", "1.0-r0", true},
+		{"foo>1.36", "1.36.1-r0", true},
+		{"foo>1.36", "1.36", false},
+		{"foo<=1.36", "1.36", true},
+		{"foo~1.2", "1.2.3-r4", true},
+		{"foo~1.2", "1.20", false},
+		{"foo=~1.2", "1.2", true},
+		{"foo=~1.2", "1.3", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dep+" "+tt.version, func(t *testing.T) {
+			dep, err := ParseDependency(tt.dep)
+			require.NoError(t, err)
+			v, err := ParseVersion(tt.version)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, dep.Satisfies(v))
+		})
+	}
+}
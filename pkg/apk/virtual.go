@@ -0,0 +1,166 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	// virtualPackageDescription and virtualPackageArch are those apk gives virtual packages.
+	virtualPackageDescription = "virtual meta package"
+	virtualPackageArch        = "noarch"
+	// virtualPackageVersionLayout is how apk makes the version of a virtual package from the
+	// time it is added.
+	virtualPackageVersionLayout = "20060102.150405"
+)
+
+// AddVirtualPackage adds a virtual package called name that depends on deps, like
+// `apk add --virtual name deps...`: it has no files, and is installed in the installed database
+// as apk does, with deps installed for it, resolved from the repositories. world gets an entry
+// name=version, with a version from sourceDateEpoch, or the current time if it is nil. deps
+// are not added to world, so that once name is removed from it, with RemoveFromWorld,
+// Autoremove removes the virtual package and all that was installed only for it.
+//
+// Adding a virtual package that is already installed replaces it. name cannot be that of an
+// installed package that is not virtual.
+func (a *APK) AddVirtualPackage(ctx context.Context, sourceDateEpoch *time.Time, name string, deps ...string) error {
+	log := clog.FromContext(ctx)
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "AddVirtualPackage")
+	defer span.End()
+
+	if dep, err := ParseDependency(name); err != nil || dep.Name != name || dep.Conflict {
+		return fmt.Errorf("invalid virtual package name %q", name)
+	}
+	for _, dep := range deps {
+		if _, err := ParseDependency(dep); err != nil {
+			return fmt.Errorf("invalid dependency %q of virtual package %s: %w", dep, name, err)
+		}
+	}
+
+	unlock, err := a.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	old, err := a.installedPackage(name)
+	if err != nil {
+		return fmt.Errorf("error checking if package %s is installed: %w", name, err)
+	}
+	if old != nil && !isVirtualPackage(old) {
+		return fmt.Errorf("cannot add virtual package %s: a package %s-%s is installed", name, name, old.Version)
+	}
+
+	when := time.Now()
+	if sourceDateEpoch != nil {
+		when = *sourceDateEpoch
+	}
+	pkg := newVirtualPackage(name, when.UTC().Format(virtualPackageVersionLayout), deps)
+	entry := pkg.Name + "=" + pkg.Version
+
+	indexes, err := a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
+	if err != nil {
+		return fmt.Errorf("error getting repository indexes: %w", err)
+	}
+	if len(a.localPackages) != 0 {
+		indexes = append([]NamedIndex{&localPackagesIndex{pkgs: a.localPackages}}, indexes...)
+	}
+	indexes = append([]NamedIndex{&localPackagesIndex{pkgs: []*RepositoryPackage{pkg}}}, indexes...)
+	resolved, conflicts, err := a.resolve(ctx, indexes, []string{entry})
+	if err != nil {
+		return fmt.Errorf("error resolving virtual package %s: %w", name, err)
+	}
+	for _, c := range conflicts {
+		isInstalled, err := a.isInstalledPackage(c)
+		if err != nil {
+			return fmt.Errorf("error checking if package %s is installed: %w", c, err)
+		}
+		if isInstalled {
+			return fmt.Errorf("cannot install due to conflict with %s", c)
+		}
+	}
+	toInstall := make([]InstallablePackage, 0, len(resolved))
+	for _, rp := range resolved {
+		if !rp.virtual {
+			toInstall = append(toInstall, rp)
+		}
+	}
+	log.Debugf("adding virtual package %s (%s) with %d packages", name, pkg.Version, len(toInstall))
+	// These are for the virtual package, so Autoremove removes them once nothing needs them.
+	if err := a.installPackages(ctx, sourceDateEpoch, toInstall, false, nil); err != nil {
+		return err
+	}
+
+	if err := a.addInstalledPackage(pkg.Package, nil); err != nil {
+		return fmt.Errorf("unable to update installed file for virtual package %s: %w", name, err)
+	}
+
+	world, err := a.GetWorld()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return a.setWorld(ctx, appendWorldEntry(world, name, entry))
+}
+
+// newVirtualPackage returns a virtual package like apk makes them, whose checksum is that of
+// its name.
+func newVirtualPackage(name, version string, deps []string) *RepositoryPackage {
+	sum := sha1.Sum([]byte(name)) //nolint:gosec // this is what apk tools is using
+	pkg := &Package{
+		Name:         name,
+		Version:      version,
+		Arch:         virtualPackageArch,
+		Description:  virtualPackageDescription,
+		Checksum:     sum[:],
+		Dependencies: slices.Clone(deps),
+	}
+	rp := NewRepositoryPackage(pkg, (&Repository{}).WithIndex(&APKIndex{Packages: []*Package{pkg}}))
+	rp.virtual = true
+	return rp
+}
+
+// isVirtualPackage returns whether pkg is a virtual package, with no files.
+func isVirtualPackage(pkg *InstalledPackage) bool {
+	return pkg.Description == virtualPackageDescription && pkg.Arch == virtualPackageArch && len(pkg.Files) == 0
+}
+
+// installedVirtualPackages returns the virtual packages in the installed database, for world
+// to be resolved with them, as apk does.
+func (a *APK) installedVirtualPackages() ([]*RepositoryPackage, error) {
+	installed, err := a.GetInstalled()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read installed packages: %w", err)
+	}
+	var virtual []*RepositoryPackage
+	for _, pkg := range installed {
+		if isVirtualPackage(pkg) {
+			virtual = append(virtual, newVirtualPackage(pkg.Name, pkg.Version, pkg.Dependencies))
+		}
+	}
+	return virtual, nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestAddVirtualPackage(t *testing.T) {
+	ctx := context.Background()
+	a, err := New(WithFS(apkfs.NewMemFS()), WithIgnoreMknodErrors(true), WithIgnoreSignatureVerification(true))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+	require.NoError(t, a.SetWorld(ctx, []string{"app"}))
+	for _, pkg := range []*Package{
+		{Name: "app", Version: "1.0-r0"},
+		{Name: "gcc", Version: "12.0-r0", Dependencies: []string{"libgcc"}},
+		{Name: "libgcc", Version: "12.0-r0"},
+		{Name: "make", Version: "4.4-r0"},
+	} {
+		local := fakePackage(t, pkg, []testDirEntry{
+			{"opt", 0o755, true, nil, nil},
+			{"opt/" + pkg.Name, 0o644, false, []byte(pkg.Name), nil},
+		})
+		rp, err := parseLocalPackage(ctx, local.URL())
+		require.NoError(t, err)
+		a.localPackages = append(a.localPackages, rp)
+	}
+	require.NoError(t, a.FixateWorld(ctx, nil))
+
+	epoch := time.Date(2023, 10, 14, 12, 34, 56, 0, time.UTC)
+	require.Error(t, a.AddVirtualPackage(ctx, &epoch, "app", "make"), "an installed package should not be replaced")
+	require.Error(t, a.AddVirtualPackage(ctx, &epoch, ".build-deps>1", "make"))
+	require.NoError(t, a.AddVirtualPackage(ctx, &epoch, ".build-deps", "gcc", "make"))
+
+	b, err := a.fs.ReadFile(a.installedFilePath())
+	require.NoError(t, err)
+	stanzas := strings.Split(strings.TrimSuffix(string(b), "\n\n"), "\n\n")
+	// as apk writes it
+	require.Equal(t, strings.Join([]string{
+		"C:Q13WGbp0jffzS9a21ZfwiibofdxUQ=",
+		"P:.build-deps",
+		"V:20231014.123456",
+		"A:noarch",
+		"S:0",
+		"I:0",
+		"T:virtual meta package",
+		"U:",
+		"L:",
+		"D:gcc make",
+	}, "\n"), stanzas[len(stanzas)-1])
+	world, err := a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, []string{".build-deps=20231014.123456", "app"}, world)
+	for _, name := range []string{"gcc", "libgcc", "make"} {
+		_, err := a.fs.Stat("opt/" + name)
+		require.NoError(t, err, name)
+	}
+
+	// the world still resolves with the virtual package, which is not fetched
+	pkgs, _, err := a.ResolveWorld(ctx)
+	require.NoError(t, err)
+	require.Len(t, pkgs, 4)
+	require.NoError(t, a.FixateWorld(ctx, nil))
+
+	// adding it again replaces it
+	later := epoch.Add(time.Hour)
+	require.NoError(t, a.AddVirtualPackage(ctx, &later, ".build-deps", "gcc"))
+	virtual, err := a.GetInstalledPackage(".build-deps")
+	require.NoError(t, err)
+	require.Equal(t, "20231014.133456", virtual.Version)
+	require.Equal(t, []string{"gcc"}, virtual.Dependencies)
+	require.Len(t, installedOf(t, a), 5)
+	world, err = a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, []string{".build-deps=20231014.133456", "app"}, world)
+
+	require.NoError(t, a.RemoveFromWorld(ctx, ".build-deps"))
+	removed, err := a.Autoremove(ctx)
+	require.NoError(t, err)
+	var names []string
+	for _, pkg := range removed {
+		names = append(names, pkg.Name)
+	}
+	require.ElementsMatch(t, []string{".build-deps", "gcc", "libgcc", "make"}, names)
+	_, err = a.fs.Stat("opt/gcc")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = a.fs.Stat("opt/app")
+	require.NoError(t, err)
+}
@@ -16,13 +16,16 @@ package apk
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"path/filepath"
+	"os"
+	"path"
 	"sort"
 	"strings"
 
 	"github.com/chainguard-dev/clog"
+	"go.opentelemetry.io/otel"
 )
 
 // GetWorld -  get list of packages that should be installed, according to /etc/apk/world
@@ -42,6 +45,16 @@ func (a *APK) GetWorld() ([]string, error) {
 // SetWorld sets the list of world packages intended to be installed.
 // The base directory of /etc/apk must already exist, i.e. this only works on an initialized APK database.
 func (a *APK) SetWorld(ctx context.Context, packages []string) error {
+	unlock, err := a.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return a.setWorld(ctx, packages)
+}
+
+// setWorld is SetWorld, with the database already locked.
+func (a *APK) setWorld(ctx context.Context, packages []string) error {
 	log := clog.FromContext(ctx)
 	log.Debug("setting apk world")
 
@@ -53,10 +66,168 @@ func (a *APK) SetWorld(ctx context.Context, packages []string) error {
 	data := strings.Join(copied, "\n") + "\n"
 
 	// #nosec G306 -- apk world must be publicly readable
-	if err := a.fs.WriteFile(filepath.Join("etc", "apk", "world"),
-		[]byte(data), 0o644); err != nil {
+	if err := a.replaceFile(worldFilePath, []byte(data), 0o644); err != nil {
 		return fmt.Errorf("failed to write apk world: %w", err)
 	}
 
 	return nil
 }
+
+// worldEntryName returns the name of the package of a world entry, without the "!" of a
+// conflict, the version constraint or the pin. world has one entry for each name.
+func worldEntryName(entry string) string {
+	return resolvePackageNameVersionPin(strings.TrimPrefix(entry, "!")).name
+}
+
+// AddToWorld adds entries to world, like apk add: each is a package name with an optional
+// version constraint and pin, like "foo", "foo>=1.2-r0" or "foo@edge", or a conflict like
+// "!foo". An entry replaces any entry already in world with the same name, so that the
+// constraint and pin are those last asked for. Nothing is installed until the world is, with
+// FixateWorld.
+func (a *APK) AddToWorld(ctx context.Context, entries ...string) error {
+	for _, entry := range entries {
+		if _, err := ParseDependency(entry); err != nil {
+			return fmt.Errorf("invalid world entry %q: %w", entry, err)
+		}
+	}
+	unlock, err := a.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	world, err := a.GetWorld()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, entry := range entries {
+		world = appendWorldEntry(world, worldEntryName(entry), entry)
+	}
+	return a.setWorld(ctx, world)
+}
+
+// addWorldNames adds the packages named names that are not in world to it, with no constraint,
+// with the database already locked.
+func (a *APK) addWorldNames(ctx context.Context, names []string) error {
+	world, err := a.GetWorld()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	inWorld := map[string]bool{}
+	for _, entry := range world {
+		inWorld[worldEntryName(entry)] = true
+	}
+	added := false
+	for _, name := range names {
+		if !inWorld[name] {
+			inWorld[name] = true
+			world = append(world, name)
+			added = true
+		}
+	}
+	if !added {
+		return nil
+	}
+	// as InitDB creates it, for roots that only have the installed database
+	if err := a.fs.MkdirAll(path.Dir(worldFilePath), 0o755); err != nil {
+		return fmt.Errorf("unable to create directory of %s: %w", worldFilePath, err)
+	}
+	return a.setWorld(ctx, world)
+}
+
+// RemoveFromWorld removes the entries for the named packages from world, like apk del,
+// whatever their constraint or pin. Removing a name that is not in world does nothing.
+// Nothing is deleted: see ReconcileWorld for the installed packages that are then not needed.
+func (a *APK) RemoveFromWorld(ctx context.Context, names ...string) error {
+	unlock, err := a.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	world, err := a.GetWorld()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	removing := map[string]bool{}
+	for _, name := range names {
+		removing[name] = true
+	}
+	kept := make([]string, 0, len(world))
+	for _, entry := range world {
+		if removing[worldEntryName(entry)] {
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	if len(kept) == len(world) {
+		clog.FromContext(ctx).Debugf("none of %s are in world", strings.Join(names, ", "))
+	}
+	return a.setWorld(ctx, kept)
+}
+
+// WorldReconciliation is how the installed packages differ from world, see ReconcileWorld.
+type WorldReconciliation struct {
+	// Unrequired are the installed packages that world does not need, directly or through
+	// other packages, in installed database order, which are the Orphans.
+	Unrequired []*InstalledPackage
+	// Unsatisfied are the entries of world, in world order, that no installed package
+	// satisfies, or for a conflict, that an installed package violates.
+	Unsatisfied []string
+}
+
+// ReconcileWorld compares the installed packages with world, to find what FixateWorld would
+// install and what is installed without world asking for it. It does not change anything.
+func (a *APK) ReconcileWorld(ctx context.Context) (*WorldReconciliation, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "ReconcileWorld")
+	defer span.End()
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read installed packages: %w", err)
+	}
+	world, err := a.GetWorld()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	r := &WorldReconciliation{Unrequired: orphanedPackages(installed, world)}
+	for _, entry := range world {
+		dep, err := ParseDependency(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid world entry %q: %w", entry, err)
+		}
+		if installedSatisfies(installed, dep) == dep.Conflict {
+			r.Unsatisfied = append(r.Unsatisfied, entry)
+		}
+	}
+	return r, nil
+}
+
+// installedSatisfies returns whether an installed package, or something one provides,
+// satisfies the name and version constraint of dep. The pin is not taken into account, as the
+// installed database does not record the repository of a package.
+func installedSatisfies(installed []*InstalledPackage, dep Dependency) bool {
+	satisfies := func(version string) bool {
+		if dep.Operator == "" {
+			return true
+		}
+		v, err := ParseVersion(version)
+		return err == nil && dep.Satisfies(v)
+	}
+	for _, pkg := range installed {
+		if pkg.Name == dep.Name && satisfies(pkg.Version) {
+			return true
+		}
+		for _, p := range pkg.Provides {
+			provided, err := ParseDependency(p)
+			if err != nil || provided.Name != dep.Name {
+				continue
+			}
+			// a provided name without a version only satisfies a dependency without one
+			if (provided.Version == "" && dep.Operator == "") || (provided.Version != "" && satisfies(provided.Version)) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -15,8 +15,10 @@
 package apk
 
 import (
+	"context"
 	"strings"
 	"testing"
+	"testing/fstest"
 
 	"github.com/stretchr/testify/require"
 
@@ -36,3 +38,80 @@ func TestGetWorld(t *testing.T) {
 	require.NoError(t, err, "unable to get world packages")
 	require.Equal(t, strings.Join(packages, " "), strings.Join(pkgs, " "), "expected packages %v, got %v", packages, pkgs)
 }
+
+func TestAddToAndRemoveFromWorld(t *testing.T) {
+	ctx := context.Background()
+	src := apkfs.NewMemFS()
+	require.NoError(t, src.MkdirAll("etc/apk", 0o755))
+	a, err := New(WithFS(src), WithIgnoreMknodErrors(ignoreMknodErrors))
+	require.NoError(t, err)
+
+	require.NoError(t, a.AddToWorld(ctx, "foo", "bar>=1.2-r0", "baz@edge"))
+	require.NoError(t, a.AddToWorld(ctx, "foo=2.0-r0", "!qux", "bar>=1.2-r0"))
+	b, err := src.ReadFile(worldFilePath)
+	require.NoError(t, err)
+	require.Equal(t, "!qux\nbar>=1.2-r0\nbaz@edge\nfoo=2.0-r0\n", string(b), "entries should replace those with the same name")
+
+	require.Error(t, a.AddToWorld(ctx, "foo>=not a version"))
+	require.NoError(t, a.AddToWorld(ctx, "qux"))
+	require.NoError(t, a.RemoveFromWorld(ctx, "baz", "foo", "missing"))
+	world, err := a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, []string{"bar>=1.2-r0", "qux"}, world)
+}
+
+func TestInstallPackagesLeavesWorld(t *testing.T) {
+	ctx := context.Background()
+	a, err := New(WithFS(apkfs.NewMemFS()), WithIgnoreMknodErrors(true), WithIgnoreSignatureVerification(true))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+	require.NoError(t, a.SetWorld(ctx, []string{"bar>=1.2-r0"}))
+
+	foo := triggerPackage(t, &PkgInfo{Name: "foo", Version: "1.0-r0", Arch: "x86_64"}, fstest.MapFS{
+		"foo": {Mode: 0o644, Data: []byte("foo")},
+	}, nil)
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{foo}))
+	world, err := a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, []string{"bar>=1.2-r0"}, world)
+
+	tool := triggerPackage(t, &PkgInfo{Name: "tool", Version: "1.0-r0", Arch: "x86_64"}, fstest.MapFS{
+		"tool": {Mode: 0o644, Data: []byte("tool")},
+	}, nil)
+	require.NoError(t, a.AddPackages(ctx, nil, []InstallablePackage{tool}))
+	world, err = a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, []string{"bar>=1.2-r0", "tool"}, world)
+}
+
+func TestReconcileWorld(t *testing.T) {
+	ctx := context.Background()
+	a, err := New(WithFS(apkfs.NewMemFS()), WithIgnoreMknodErrors(true), WithIgnoreSignatureVerification(true))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+
+	lib := triggerPackage(t, &PkgInfo{Name: "lib", Version: "1.0-r0", Arch: "x86_64", Provides: []string{"so:lib.so.1=1"}}, fstest.MapFS{}, nil)
+	app := triggerPackage(t, &PkgInfo{Name: "app", Version: "2.0-r0", Arch: "x86_64", Depends: []string{"so:lib.so.1"}}, fstest.MapFS{
+		"app": {Mode: 0o644, Data: []byte("app")},
+	}, nil)
+	tool := triggerPackage(t, &PkgInfo{Name: "tool", Version: "1.0-r0", Arch: "x86_64"}, fstest.MapFS{
+		"tool": {Mode: 0o644, Data: []byte("tool")},
+	}, nil)
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{lib, app, tool}))
+	require.NoError(t, a.AddToWorld(ctx, "app>=2.0-r0", "so:lib.so.1>=1", "!tool", "missing", "lib<1.0"))
+
+	r, err := a.ReconcileWorld(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"!tool", "lib<1.0", "missing"}, r.Unsatisfied)
+	require.Len(t, r.Unrequired, 1)
+	require.Equal(t, "tool", r.Unrequired[0].Name, "explicitly installed packages should not be required by world")
+
+	require.NoError(t, a.RemoveFromWorld(ctx, "app"))
+	r, err = a.ReconcileWorld(ctx)
+	require.NoError(t, err)
+	var unrequired []string
+	for _, pkg := range r.Unrequired {
+		unrequired = append(unrequired, pkg.Name)
+	}
+	require.Equal(t, []string{"app", "tool"}, unrequired)
+}
@@ -0,0 +1,104 @@
+package expandapk
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Checksum is a checksum as apk uses them, of the control section of a package or of a file.
+// Its algorithm is known from its length, as in apk-tools.
+type Checksum []byte
+
+// ChecksumAlgorithm is the hash algorithm of a Checksum.
+type ChecksumAlgorithm string
+
+const (
+	ChecksumMD5    ChecksumAlgorithm = "md5"
+	ChecksumSHA1   ChecksumAlgorithm = "sha1"
+	ChecksumSHA256 ChecksumAlgorithm = "sha256"
+)
+
+// ParseChecksum parses a checksum in the forms apk writes: base64 SHA1 with a Q1 prefix,
+// base64 SHA256 with a Q2 prefix, or hex, as in the checksum PAX records of a package. An
+// empty string is no checksum. The length is not checked against the prefix.
+func ParseChecksum(s string) (Checksum, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(s, "Q") && len(s) >= 2 {
+		prefix, b64 := s[:2], s[2:]
+		if prefix != "Q1" && prefix != "Q2" {
+			return nil, fmt.Errorf("checksum %q has unknown prefix %q", s, prefix)
+		}
+		if b64 == "" {
+			return nil, nil
+		}
+		b, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, fmt.Errorf("decoding base64 checksum %q: %w", s, err)
+		}
+		return b, nil
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("decoding hex checksum %q: %w", s, err)
+	}
+	return b, nil
+}
+
+// Algorithm returns the hash algorithm of c, or "" if its length is not that of one apk uses.
+func (c Checksum) Algorithm() ChecksumAlgorithm {
+	switch len(c) {
+	case md5.Size:
+		return ChecksumMD5
+	case sha1.Size:
+		return ChecksumSHA1
+	case sha256.Size:
+		return ChecksumSHA256
+	}
+	return ""
+}
+
+// String returns c as apk writes it in an index: Q2 and base64 for SHA256, otherwise Q1
+// and base64. It is empty for no checksum.
+func (c Checksum) String() string {
+	if len(c) == 0 {
+		return ""
+	}
+	if c.Algorithm() == ChecksumSHA256 {
+		return "Q2" + c.Base64()
+	}
+	return "Q1" + c.Base64()
+}
+
+// Hex returns c in hex, as apk names cached packages and writes PAX checksum records.
+func (c Checksum) Hex() string {
+	return hex.EncodeToString(c)
+}
+
+// Base64 returns c in base64, without a prefix.
+func (c Checksum) Base64() string {
+	return base64.StdEncoding.EncodeToString(c)
+}
+
+// Equal returns true if c and o are the same checksum.
+func (c Checksum) Equal(o Checksum) bool {
+	return bytes.Equal(c, o)
+}
+
+// Format formats c as bytes for the %x and %X verbs, as it did when it was a []byte, and as
+// String for the others.
+func (c Checksum) Format(f fmt.State, verb rune) {
+	switch verb {
+	case 'x', 'X':
+		fmt.Fprintf(f, fmt.FormatString(f, verb), []byte(c))
+	default:
+		fmt.Fprintf(f, fmt.FormatString(f, verb), c.String())
+	}
+}
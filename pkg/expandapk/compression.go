@@ -0,0 +1,40 @@
+package expandapk
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the compression of the data section of a package.
+type Compression string
+
+const (
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+// zstdMagic starts a zstd frame.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// dataSectionReader returns a reader of the decompressed data section of a package read from
+// r, which can be compressed with gzip or zstd, and its compression. As the data section is
+// the last one, it can read past the end of it.
+func dataSectionReader(r io.Reader) (io.ReadCloser, Compression, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(zstdMagic)); err == nil && bytes.Equal(magic, zstdMagic) {
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, "", err
+		}
+		return zr.IOReadCloser(), CompressionZstd, nil
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, "", err
+	}
+	return zr, CompressionGzip, nil
+}
@@ -22,6 +22,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/chainguard-dev/clog"
 	"github.com/chainguard-dev/go-apk/internal/tarfs"
 	"github.com/klauspost/compress/gzip"
 
@@ -59,8 +60,14 @@ type APKExpanded struct {
 	// Exposes TarFile as an indexed FS implementation.
 	TarFS *tarfs.FS
 
-	ControlHash []byte
-	PackageHash []byte
+	// ControlHash is the SHA1 of the control section, the package checksum in an index.
+	ControlHash Checksum
+	// PackageHash is the SHA256 of the data section, the datahash in .PKGINFO.
+	PackageHash Checksum
+
+	// DataCompression is the compression of the data section. The signature and control
+	// sections are always gzip.
+	DataCompression Compression
 
 	sync.Mutex
 	controlData []byte
@@ -122,10 +129,11 @@ func (a *APKExpanded) PackageData() (io.ReadSeekCloser, error) {
 	defer f.Close()
 
 	br := bufio.NewReaderSize(f, bufSize)
-	zr, err := gzip.NewReader(br)
+	zr, _, err := dataSectionReader(br)
 	if err != nil {
 		return nil, fmt.Errorf("parsing %q: %w", a.PackageFile, err)
 	}
+	defer zr.Close()
 
 	uf, err = os.Create(a.TarFile)
 	if err != nil {
@@ -317,6 +325,33 @@ func (r *expandApkReader) EnableFastRead() {
 	r.fast = true
 }
 
+// DataHashMismatchError is returned when the data section of a package does not
+// match the datahash recorded in its .PKGINFO.
+type DataHashMismatchError struct {
+	Expected []byte
+	Actual   []byte
+}
+
+func (e *DataHashMismatchError) Error() string {
+	return fmt.Sprintf("data section hash mismatch: .PKGINFO datahash is %x, computed %x", e.Expected, e.Actual)
+}
+
+// Option configures ExpandApk.
+type Option func(*options)
+
+type options struct {
+	missingDataHash func(ctx context.Context)
+	spillThreshold  int64
+}
+
+// WithMissingDataHashHook sets a hook called for packages without a datahash in their
+// .PKGINFO, whose data section can not be verified. By default a warning is logged.
+func WithMissingDataHashHook(hook func(ctx context.Context)) Option {
+	return func(o *options) {
+		o.missingDataHash = hook
+	}
+}
+
 // ExpandAPK given a ready to an apk stream, normally a tar stream with gzip compression,
 // expand it into its components.
 //
@@ -328,12 +363,23 @@ func (r *expandApkReader) EnableFastRead() {
 //	own gzip stream (3 streams total). These streams contain the package signature,
 //	control data, and package data"
 //
+// The data section is checked against the datahash in the control section, if there is one.
+//
 // Returns an APKExpanded struct containing references to the file. You *must* call APKExpanded.Close()
 // when finished to clean up the various files.
-func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpanded, error) {
+func ExpandApk(ctx context.Context, source io.Reader, cacheDir string, opts ...Option) (*APKExpanded, error) {
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "ExpandApk")
 	defer span.End()
 
+	o := options{
+		missingDataHash: func(ctx context.Context) {
+			clog.FromContext(ctx).Warnf("package has no datahash, not verifying its data section")
+		},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	dir, err := os.MkdirTemp(cacheDir, "expand-apk")
 	if err != nil {
 		return nil, err
@@ -349,6 +395,7 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 	gzipStreams := []string{}
 	hashes := [][]byte{}
 	maxStreamsReached := false
+	var dataCompression Compression
 	for {
 		// Control section uses sha1.
 		var h hash.Hash = sha1.New() //nolint:gosec // this is what apk tools is using
@@ -367,28 +414,16 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 
 		hr := io.TeeReader(tr, h)
 
-		if gzi == nil {
-			gzi, err = gzip.NewReader(hr)
-		} else {
-			err = gzi.Reset(hr)
-		}
-
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, fmt.Errorf("creating gzip reader: %w", err)
-		}
-
-		if !maxStreamsReached {
-			gzi.Multistream(false)
-
-			if _, err := io.Copy(io.Discard, gzi); err != nil {
-				return nil, fmt.Errorf("expandApk error 3: %w", err)
+		if maxStreamsReached {
+			// The data section is compressed with gzip like the others, or with zstd.
+			dr, compression, err := dataSectionReader(hr)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("creating data section reader: %w", err)
 			}
+			dataCompression = compression
 
-			hashes = append(hashes, h.Sum(nil))
-			gzipStreams = append(gzipStreams, sw.CurrentName())
-		} else {
 			// While we verify checksums, also tee the tar to a separate file.
 			tarfilename := strings.TrimSuffix(sw.CurrentName(), ".gz")
 			tarfile, err := os.Create(tarfilename)
@@ -396,7 +431,7 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 				return nil, fmt.Errorf("opening tar file: %w", err)
 			}
 			bw := bufio.NewWriterSize(tarfile, 1<<20)
-			tr := io.TeeReader(gzi, bw)
+			tr := io.TeeReader(dr, bw)
 
 			if err := checkSums(ctx, tr); err != nil {
 				return nil, fmt.Errorf("checking sums: %w", err)
@@ -404,6 +439,9 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 			if _, err := io.Copy(io.Discard, tr); err != nil {
 				return nil, fmt.Errorf("expandApk error 3: %w", err)
 			}
+			if err := dr.Close(); err != nil {
+				return nil, fmt.Errorf("closing data section reader: %w", err)
+			}
 
 			if err := bw.Flush(); err != nil {
 				return nil, fmt.Errorf("flushing tarfile: %w", err)
@@ -416,10 +454,33 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 			hashes = append(hashes, h.Sum(nil))
 			break
 		}
+
+		if gzi == nil {
+			gzi, err = gzip.NewReader(hr)
+		} else {
+			err = gzi.Reset(hr)
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("creating gzip reader: %w", err)
+		}
+
+		gzi.Multistream(false)
+
+		if _, err := io.Copy(io.Discard, gzi); err != nil {
+			return nil, fmt.Errorf("expandApk error 3: %w", err)
+		}
+
+		hashes = append(hashes, h.Sum(nil))
+		gzipStreams = append(gzipStreams, sw.CurrentName())
 	}
 
-	if err := gzi.Close(); err != nil {
-		return nil, fmt.Errorf("expandApk error 6: %w", err)
+	if gzi != nil {
+		if err := gzi.Close(); err != nil {
+			return nil, fmt.Errorf("expandApk error 6: %w", err)
+		}
 	}
 	if err := sw.CloseFile(); err != nil {
 		return nil, fmt.Errorf("expandApk error 7: %w", err)
@@ -450,18 +511,29 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 	}
 
 	expanded := APKExpanded{
-		tempDir:     dir,
-		Signed:      signed,
-		Size:        totalSize,
-		ControlFile: gzipStreams[controlDataIndex],
-		ControlHash: hashes[controlDataIndex],
-		PackageFile: gzipStreams[controlDataIndex+1],
-		PackageHash: hashes[controlDataIndex+1],
+		tempDir:         dir,
+		Signed:          signed,
+		Size:            totalSize,
+		ControlFile:     gzipStreams[controlDataIndex],
+		ControlHash:     hashes[controlDataIndex],
+		PackageFile:     gzipStreams[controlDataIndex+1],
+		PackageHash:     hashes[controlDataIndex+1],
+		DataCompression: dataCompression,
 	}
 	if signed {
 		expanded.SignatureFile = gzipStreams[0]
 	}
 
+	datahash, err := dataHashFromControl(expanded.ControlFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading datahash from %q: %w", expanded.ControlFile, err)
+	}
+	if datahash == nil {
+		o.missingDataHash(ctx)
+	} else if !bytes.Equal(datahash, expanded.PackageHash) {
+		return nil, &DataHashMismatchError{Expected: datahash, Actual: expanded.PackageHash}
+	}
+
 	expanded.ControlFS, err = tarfs.New(expanded.ControlData)
 	if err != nil {
 		return nil, fmt.Errorf("indexing %q: %w", expanded.ControlFile, err)
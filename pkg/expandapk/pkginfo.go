@@ -0,0 +1,151 @@
+package expandapk
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// PkgInfo is the .PKGINFO file of the control section of a package. The lists are each from
+// a repeated key, except InstallIf and Triggers, which abuild writes as a single value
+// separated by spaces.
+type PkgInfo struct {
+	Name        string // pkgname
+	Version     string // pkgver
+	Description string // pkgdesc
+	URL         string // url
+	BuildDate   int64  // builddate
+	Packager    string // packager
+	// Size is the installed size of the package.
+	Size             uint64   // size
+	Arch             string   // arch
+	Origin           string   // origin
+	Commit           string   // commit
+	Maintainer       string   // maintainer
+	License          string   // license
+	ProviderPriority uint64   // provider_priority
+	ReplacesPriority uint64   // replaces_priority
+	Replaces         []string // replaces
+	Depends          []string // depend
+	Provides         []string // provides
+	InstallIf        []string // install_if
+	Triggers         []string // triggers
+	DataHash         string   // datahash
+}
+
+// ParsePkgInfo parses a .PKGINFO file. Comments, blank lines and unknown keys are skipped.
+func ParsePkgInfo(r io.Reader) (*PkgInfo, error) {
+	info := &PkgInfo{}
+	scanner := bufio.NewScanner(r)
+	for linenr := 1; scanner.Scan(); linenr++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d of .PKGINFO has no value: %q", linenr, line)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		var err error
+		switch key {
+		case "pkgname":
+			info.Name = value
+		case "pkgver":
+			info.Version = value
+		case "pkgdesc":
+			info.Description = value
+		case "url":
+			info.URL = value
+		case "builddate":
+			info.BuildDate, err = strconv.ParseInt(value, 10, 64)
+		case "packager":
+			info.Packager = value
+		case "size":
+			info.Size, err = strconv.ParseUint(value, 10, 64)
+		case "arch":
+			info.Arch = value
+		case "origin":
+			info.Origin = value
+		case "commit":
+			info.Commit = value
+		case "maintainer":
+			info.Maintainer = value
+		case "license":
+			info.License = value
+		case "provider_priority":
+			info.ProviderPriority, err = strconv.ParseUint(value, 10, 64)
+		case "replaces_priority":
+			info.ReplacesPriority, err = strconv.ParseUint(value, 10, 64)
+		case "replaces":
+			info.Replaces = append(info.Replaces, value)
+		case "depend":
+			info.Depends = append(info.Depends, value)
+		case "provides":
+			info.Provides = append(info.Provides, value)
+		case "install_if":
+			info.InstallIf = append(info.InstallIf, strings.Fields(value)...)
+		case "triggers":
+			info.Triggers = append(info.Triggers, strings.Fields(value)...)
+		case "datahash":
+			info.DataHash = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d of .PKGINFO has invalid %s: %w", linenr, key, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading .PKGINFO: %w", err)
+	}
+	return info, nil
+}
+
+// WritePkgInfo writes info as a .PKGINFO file, in the order abuild writes the keys. Empty
+// values are left out, except for pkgname, pkgver, size and arch.
+func WritePkgInfo(w io.Writer, info *PkgInfo) error {
+	bw := bufio.NewWriter(w)
+	write := func(key, value string, always bool) {
+		if value != "" || always {
+			fmt.Fprintf(bw, "%s = %s\n", key, value)
+		}
+	}
+	writeUint := func(key string, value uint64, always bool) {
+		if value != 0 || always {
+			write(key, strconv.FormatUint(value, 10), true)
+		}
+	}
+
+	write("pkgname", info.Name, true)
+	write("pkgver", info.Version, true)
+	write("pkgdesc", info.Description, false)
+	write("url", info.URL, false)
+	if info.BuildDate != 0 {
+		write("builddate", strconv.FormatInt(info.BuildDate, 10), true)
+	}
+	write("packager", info.Packager, false)
+	writeUint("size", info.Size, true)
+	write("arch", info.Arch, true)
+	write("origin", info.Origin, false)
+	write("commit", info.Commit, false)
+	write("maintainer", info.Maintainer, false)
+	writeUint("replaces_priority", info.ReplacesPriority, false)
+	writeUint("provider_priority", info.ProviderPriority, false)
+	write("license", info.License, false)
+	for _, replaces := range info.Replaces {
+		write("replaces", replaces, true)
+	}
+	for _, dep := range info.Depends {
+		write("depend", dep, true)
+	}
+	for _, provides := range info.Provides {
+		write("provides", provides, true)
+	}
+	write("install_if", strings.Join(info.InstallIf, " "), false)
+	write("triggers", strings.Join(info.Triggers, " "), false)
+	write("datahash", info.DataHash, false)
+
+	return bw.Flush()
+}
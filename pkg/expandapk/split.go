@@ -0,0 +1,39 @@
+package expandapk
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// SplitAPK splits a v2 package into its sections, each as it is in the package: the gzip
+// streams of the signature and control sections, and the data section. The signature is nil
+// if the package is not signed. The signature and control sections are read into memory to
+// find where they end, the same way as ExpandApkStreaming does, and the data section is the
+// rest of r, read as it is needed and not decompressed. Concatenating the sections gives the
+// package back. Closing the data section does not close r.
+func SplitAPK(r io.Reader) (signature, control, data io.ReadCloser, err error) {
+	sr := &sectionReader{r: bufio.NewReaderSize(r, 64*1024)}
+	zr := new(gzip.Reader)
+
+	var first, second bytes.Buffer
+	sr.reset(nil, &first)
+	name, _, err := readSection(zr, sr)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("reading first section: %w", err)
+	}
+	if !strings.HasPrefix(name, ".SIGN.") {
+		// What was read is the control section.
+		return nil, io.NopCloser(&first), io.NopCloser(sr.r), nil
+	}
+
+	sr.reset(nil, &second)
+	if _, _, err := readSection(zr, sr); err != nil {
+		return nil, nil, nil, fmt.Errorf("reading control section: %w", err)
+	}
+	return io.NopCloser(&first), io.NopCloser(&second), io.NopCloser(sr.r), nil
+}
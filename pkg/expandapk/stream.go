@@ -0,0 +1,324 @@
+package expandapk
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/klauspost/compress/gzip"
+	"go.opentelemetry.io/otel"
+)
+
+// defaultSpillThreshold is how much of the signature and control sections of a package
+// ExpandApkStreaming keeps in memory by default.
+const defaultSpillThreshold = 8 * meg
+
+// WithSpillThreshold sets how many bytes of each of the signature and control sections of a
+// package ExpandApkStreaming keeps in memory. A bigger section is written to a temporary
+// file instead. It does not change ExpandApk, which always writes the sections to files.
+func WithSpillThreshold(n int64) Option {
+	return func(o *options) {
+		o.spillThreshold = n
+	}
+}
+
+// APKStream is a package expanded as it is read, by ExpandApkStreaming. Its signature and
+// control sections have been read when it is returned, and its data section is read through
+// Data. You *must* call APKStream.Close() when finished with it.
+type APKStream struct {
+	// Whether or not the apk contains a signature
+	Signed bool
+
+	// ControlHash is the SHA1 of the control section, the package checksum in an index.
+	ControlHash Checksum
+	// PackageHash is the SHA256 of the data section. It is set when Data has been read to
+	// the end.
+	PackageHash Checksum
+	// The size in bytes of the entire apk. It is set when Data has been read to the end.
+	Size int64
+
+	// DataCompression is the compression of the data section.
+	DataCompression Compression
+
+	signature *spillBuffer
+	control   *spillBuffer
+	data      *streamData
+}
+
+// Signature returns the signature section of the package, as a gzip stream.
+func (s *APKStream) Signature() (io.ReadCloser, error) {
+	if !s.Signed {
+		return nil, errors.New("package is not signed")
+	}
+	return s.signature.Open()
+}
+
+// Control returns the control section of the package, as a gzip stream.
+func (s *APKStream) Control() (io.ReadCloser, error) {
+	return s.control.Open()
+}
+
+// ControlData returns the control section of the package as a tar stream.
+func (s *APKStream) ControlData() (io.ReadCloser, error) {
+	rc, err := s.control.Open()
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return &multiReadCloser{r: zr, closers: []io.Closer{zr, rc}}, nil
+}
+
+// Data returns the data section of the package as a tar stream, decompressed as it is
+// read from the source of the package. It can only be read once. Reading it to the end
+// checks it against the datahash of the control section, and returns a
+// *DataHashMismatchError instead of io.EOF if it does not match, so anything done with the
+// data before then must be undone by the caller if it is an error.
+func (s *APKStream) Data() io.Reader {
+	return s.data
+}
+
+// Close removes the temporary files of the stream, if any. It does not close the source.
+func (s *APKStream) Close() error {
+	var dataErr error
+	if s.data != nil {
+		dataErr = s.data.r.Close()
+	}
+	return errors.Join(s.signature.Close(), s.control.Close(), dataErr)
+}
+
+// ExpandApkStreaming is ExpandApk for a package that is expanded as it is read from source,
+// without writing its sections to files. The signature and control sections are read before
+// it returns, and kept in memory unless they are bigger than WithSpillThreshold, in which case
+// they are written to a temporary file in tempDir. The data section is read through
+// APKStream.Data as it is needed, and hashed as it is read.
+func ExpandApkStreaming(ctx context.Context, source io.Reader, tempDir string, opts ...Option) (*APKStream, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "ExpandApkStreaming")
+	defer span.End()
+
+	o := options{
+		missingDataHash: func(ctx context.Context) {
+			clog.FromContext(ctx).Warnf("package has no datahash, not verifying its data section")
+		},
+		spillThreshold: defaultSpillThreshold,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	sr := &sectionReader{r: bufio.NewReaderSize(source, 64*1024)}
+	zr := new(gzip.Reader)
+	s := &APKStream{
+		signature: &spillBuffer{dir: tempDir, threshold: o.spillThreshold},
+		control:   &spillBuffer{dir: tempDir, threshold: o.spillThreshold},
+	}
+
+	// The first section is the signature if its first file is a .SIGN. file, and the
+	// control section otherwise.
+	sr.reset(sha1.New(), s.signature) //nolint:gosec // this is what apk tools is using
+	first, datahash, err := readSection(zr, sr)
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("reading first section: %w", err)
+	}
+	if strings.HasPrefix(first, ".SIGN.") {
+		s.Signed = true
+		sr.reset(sha1.New(), s.control) //nolint:gosec // this is what apk tools is using
+		if _, datahash, err = readSection(zr, sr); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("reading control section: %w", err)
+		}
+	} else {
+		// What was read is the control section.
+		s.signature, s.control = s.control, s.signature
+	}
+	s.ControlHash = sr.h.Sum(nil)
+
+	sr.reset(sha256.New(), nil)
+	dr, compression, err := dataSectionReader(sr)
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("reading data section: %w", err)
+	}
+	s.DataCompression = compression
+	s.data = &streamData{ctx: ctx, stream: s, r: dr, sr: sr, datahash: datahash, missingDataHash: o.missingDataHash}
+
+	return s, nil
+}
+
+// readSection reads a gzip stream of a package from sr, returning the name of its first file
+// and the datahash of its .PKGINFO, if it has one.
+func readSection(zr *gzip.Reader, sr *sectionReader) (string, []byte, error) {
+	if err := zr.Reset(sr); err != nil {
+		return "", nil, err
+	}
+	zr.Multistream(false)
+
+	var (
+		first    string
+		datahash []byte
+	)
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if first == "" {
+			first = hdr.Name
+		}
+		if hdr.Name != ".PKGINFO" {
+			continue
+		}
+		if datahash, err = pkgInfoDataHash(tr); err != nil {
+			return "", nil, err
+		}
+	}
+	// Read the rest of the stream, so that all of it is in the checksum.
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		return "", nil, err
+	}
+	if sr.err != nil {
+		return "", nil, sr.err
+	}
+	return first, datahash, nil
+}
+
+// streamData is the data section of an APKStream.
+type streamData struct {
+	ctx             context.Context
+	stream          *APKStream
+	r               io.ReadCloser
+	sr              *sectionReader
+	datahash        []byte
+	missingDataHash func(ctx context.Context)
+	err             error
+}
+
+func (d *streamData) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	n, err := d.r.Read(p)
+	if errors.Is(err, io.EOF) {
+		err = d.finish()
+	}
+	if err != nil {
+		d.err = err
+	}
+	return n, err
+}
+
+// finish reads the rest of the package, and checks the data section against its datahash.
+func (d *streamData) finish() error {
+	if _, err := io.Copy(io.Discard, d.sr); err != nil {
+		return fmt.Errorf("reading data section: %w", err)
+	}
+	d.stream.PackageHash = d.sr.h.Sum(nil)
+	d.stream.Size = d.sr.n
+	if d.datahash == nil {
+		d.missingDataHash(d.ctx)
+	} else if !bytes.Equal(d.datahash, d.stream.PackageHash) {
+		return &DataHashMismatchError{Expected: d.datahash, Actual: d.stream.PackageHash}
+	}
+	return io.EOF
+}
+
+// sectionReader hashes the bytes read through it with h, and copies them to w, if each is
+// set. It is an io.ByteReader, so that a gzip.Reader reading from it does not read past the
+// end of its stream, into the next section.
+type sectionReader struct {
+	r   *bufio.Reader
+	h   hash.Hash
+	w   io.Writer
+	n   int64
+	err error
+}
+
+// reset starts a new section, hashed with h and copied to w.
+func (r *sectionReader) reset(h hash.Hash, w io.Writer) {
+	r.h, r.w = h, w
+}
+
+func (r *sectionReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.consume(p[:n])
+	return n, err
+}
+
+func (r *sectionReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.consume([]byte{b})
+	}
+	return b, err
+}
+
+func (r *sectionReader) consume(p []byte) {
+	if r.h != nil {
+		r.h.Write(p)
+	}
+	r.n += int64(len(p))
+	if r.w != nil && r.err == nil {
+		_, r.err = r.w.Write(p)
+	}
+}
+
+// spillBuffer keeps what is written to it in memory until it is more than threshold bytes,
+// and in a temporary file in dir after that.
+type spillBuffer struct {
+	dir       string
+	threshold int64
+	buf       bytes.Buffer
+	f         *os.File
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.f == nil && int64(b.buf.Len()+len(p)) > b.threshold {
+		f, err := os.CreateTemp(b.dir, "expand-apk-*.tar.gz")
+		if err != nil {
+			return 0, err
+		}
+		b.f = f
+		if _, err := f.Write(b.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		b.buf = bytes.Buffer{}
+	}
+	if b.f != nil {
+		return b.f.Write(p)
+	}
+	return b.buf.Write(p)
+}
+
+// Open returns what was written to b.
+func (b *spillBuffer) Open() (io.ReadCloser, error) {
+	if b.f == nil {
+		return io.NopCloser(bytes.NewReader(b.buf.Bytes())), nil
+	}
+	return os.Open(b.f.Name())
+}
+
+// Close removes the temporary file of b, if it has one.
+func (b *spillBuffer) Close() error {
+	if b.f == nil {
+		return nil
+	}
+	return errors.Join(b.f.Close(), os.Remove(b.f.Name()))
+}
@@ -2,40 +2,75 @@ package expandapk
 
 import (
 	"archive/tar"
-	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"strings"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/gzip"
 )
 
-func checksumFromHeader(header *tar.Header) ([]byte, error) {
-	pax := header.PAXRecords
-	if pax == nil {
+func checksumFromHeader(header *tar.Header) (Checksum, error) {
+	hexsum, ok := header.PAXRecords[paxRecordsChecksumKey]
+	if !ok {
 		return nil, nil
 	}
 
-	hexsum, ok := pax[paxRecordsChecksumKey]
-	if !ok {
-		return nil, nil
+	// The record is hex, but we have written it with a Q1 prefix and base64 at one point,
+	// so that is handled as well.
+	checksum, err := ParseChecksum(hexsum)
+	if err != nil {
+		return nil, fmt.Errorf("checksum from header for %q: %w", header.Name, err)
+	}
+
+	return checksum, nil
+}
+
+// dataHashFromControl returns the datahash in the .PKGINFO of the control section
+// controlTarGz, or nil if it has none.
+func dataHashFromControl(controlTarGz string) ([]byte, error) {
+	f, err := os.Open(controlTarGz)
+	if err != nil {
+		return nil, err
 	}
+	defer f.Close()
 
-	if strings.HasPrefix(hexsum, "Q1") {
-		// This is nonstandard but something we did at one point, handle it.
-		// In other contexts, this Q1 prefix means "this is sha1 not md5".
-		b64 := strings.TrimPrefix(hexsum, "Q1")
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
 
-		checksum, err := base64.StdEncoding.DecodeString(b64)
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
 		if err != nil {
-			return nil, fmt.Errorf("decoding base64 checksum from header for %q: %w", header.Name, err)
+			return nil, err
+		}
+		if header.Name != ".PKGINFO" {
+			continue
 		}
 
-		return checksum, nil
+		return pkgInfoDataHash(tr)
 	}
+}
 
-	checksum, err := hex.DecodeString(hexsum)
+// pkgInfoDataHash returns the datahash of the .PKGINFO read from r, or nil if it has none.
+func pkgInfoDataHash(r io.Reader) ([]byte, error) {
+	info, err := ParsePkgInfo(r)
 	if err != nil {
-		return nil, fmt.Errorf("decoding hex checksum from header for %q: %w", header.Name, err)
+		return nil, err
 	}
-
-	return checksum, nil
+	if info.DataHash == "" {
+		return nil, nil
+	}
+	datahash, err := hex.DecodeString(info.DataHash)
+	if err != nil {
+		return nil, fmt.Errorf("parsing datahash: %w", err)
+	}
+	return datahash, nil
 }
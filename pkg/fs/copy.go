@@ -0,0 +1,179 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WritableFS is a filesystem that files of every type can be created in, with their owner and
+// xattrs, such as the destination of CopyTree. Every FullFS is one.
+type WritableFS interface {
+	fs.FS
+	Mkdir(path string, perm fs.FileMode) error
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	Mknod(path string, mode uint32, dev int) error
+	Symlink(oldname, newname string) error
+	Link(oldname, newname string) error
+	Chown(path string, uid int, gid int) error
+	SetXattr(path string, attr string, data []byte) error
+}
+
+// CopyTree copies what is at root in src, and all that is under it, to the same paths in dst,
+// which is "." to copy all of src. The directories above root are created like those of src,
+// if they are not in dst yet, and those that are already there are copied into. Like cp -a,
+// everything keeps its type, mode, owner, xattrs and modification time, as far as dst
+// supports them, and the names of a file are hardlinks if src keeps track of them.
+func CopyTree(dst WritableFS, src fs.FS, root string) error {
+	if !fs.ValidPath(root) {
+		return &fs.PathError{Op: "copytree", Path: root, Err: fs.ErrInvalid}
+	}
+	if root != "." {
+		var parent string
+		for _, part := range strings.Split(filepath.Dir(root), "/") {
+			if part == "." {
+				break
+			}
+			parent = filepath.Join(parent, part)
+			if _, err := fs.Stat(dst, parent); err == nil {
+				continue
+			}
+			fi, err := fs.Stat(src, parent)
+			if err != nil {
+				return err
+			}
+			if err := copyEntry(dst, src, parent, fi); err != nil {
+				return err
+			}
+		}
+	}
+
+	links := map[uint64]string{}
+	return fs.WalkDir(src, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// the root of dst is already there
+		if p == "." {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if hi, ok := fi.(HardlinkInfo); ok && !fi.IsDir() && hi.Nlink() > 1 {
+			if first, ok := links[hi.Ino()]; ok {
+				return dst.Link(first, p)
+			}
+			links[hi.Ino()] = p
+		}
+		return copyEntry(dst, src, p, fi)
+	})
+}
+
+// copyEntry copies what is at p in src, which fi is the info of, to p in dst, with its metadata.
+// The directory it is in must already be in dst.
+func copyEntry(dst WritableFS, src fs.FS, p string, fi fs.FileInfo) error {
+	mode := fi.Mode()
+	perm := mode & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+	var err error
+	switch {
+	case mode.IsDir():
+		if err = dst.Mkdir(p, perm); errors.Is(err, fs.ErrExist) {
+			err = nil
+		}
+	case mode&fs.ModeSymlink != 0:
+		rfs, ok := src.(ReadLinkFS)
+		if !ok {
+			return fmt.Errorf("readlink not supported by the source: %s", p)
+		}
+		var target string
+		if target, err = rfs.Readlink(p); err == nil {
+			err = dst.Symlink(target, p)
+		}
+	case mode&fs.ModeDevice != 0:
+		rfs, ok := src.(ReadnodFS)
+		if !ok {
+			return fmt.Errorf("read device not supported by the source: %s", p)
+		}
+		var dev int
+		if dev, err = rfs.Readnod(p); err == nil {
+			err = dst.Mknod(p, MknodMode(mode), dev)
+		}
+	case mode&fs.ModeNamedPipe != 0:
+		err = dst.Mknod(p, MknodMode(mode), 0)
+	case mode.IsRegular():
+		err = copyFile(dst, src, p, perm)
+	default:
+		return fmt.Errorf("unable to copy %s of type %s", p, mode.Type())
+	}
+	if err != nil {
+		return fmt.Errorf("unable to copy %s: %w", p, err)
+	}
+
+	if mode&fs.ModeSymlink == 0 {
+		if uid, gid, ok := fileOwner(fi); ok {
+			if err := dst.Chown(p, uid, gid); err != nil {
+				return err
+			}
+		}
+		if xfs, ok := src.(XattrFS); ok {
+			xattrs, _ := xfs.ListXattrs(p)
+			for attr, data := range xattrs {
+				if err := dst.SetXattr(p, attr, data); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if cfs, ok := dst.(ChtimesFS); ok {
+		if err := cfs.Lchtimes(p, fi.ModTime(), fi.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(dst WritableFS, src fs.FS, p string, perm fs.FileMode) error {
+	in, err := src.Open(p)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := dst.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// fileOwner returns the owner of fi, if it is known.
+func fileOwner(fi fs.FileInfo) (uid, gid int, ok bool) {
+	if h, ok := fi.Sys().(*tar.Header); ok {
+		return h.Uid, h.Gid, true
+	}
+	return statOwner(fi.Sys())
+}
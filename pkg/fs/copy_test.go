@@ -0,0 +1,85 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyTree(t *testing.T) {
+	var (
+		src   = NewMemFS()
+		mtime = time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	)
+	require.NoError(t, src.MkdirAll("usr/lib/apk/db", 0o755))
+	require.NoError(t, src.Chmod("usr/lib", 0o700))
+	require.NoError(t, src.MkdirAll("etc", 0o755))
+	require.NoError(t, src.WriteFile("etc/os-release", []byte("ID=test\n"), 0o644))
+	require.NoError(t, src.WriteFile("usr/lib/apk/db/installed", []byte("P:busybox\n"), 0o640))
+	require.NoError(t, src.Chown("usr/lib/apk/db/installed", 0, 42))
+	require.NoError(t, src.SetXattr("usr/lib/apk/db/installed", "user.comment", []byte("db")))
+	require.NoError(t, src.(ChtimesFS).Lchtimes("usr/lib/apk/db/installed", mtime, mtime))
+	require.NoError(t, src.Link("usr/lib/apk/db/installed", "usr/lib/apk/db/installed.link"))
+	require.NoError(t, src.Symlink("installed", "usr/lib/apk/db/current"))
+	require.NoError(t, src.Mknod("usr/lib/apk/db/fifo", modeFIFO|0o600, 0))
+	require.NoError(t, src.Mknod("usr/lib/apk/db/null", modeChar|0o666, int(Mkdev(1, 3))))
+
+	dst := NewMemFS()
+	require.NoError(t, CopyTree(dst, src, "usr/lib/apk"))
+	_, err := dst.Stat("etc")
+	require.ErrorIs(t, err, fs.ErrNotExist, "only the tree at root should be copied")
+	fi, err := dst.Stat("usr/lib")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeDir|0o700, fi.Mode(), "the directories above root should be like those of src")
+
+	b, err := dst.ReadFile("usr/lib/apk/db/installed")
+	require.NoError(t, err)
+	require.Equal(t, "P:busybox\n", string(b))
+	fi, err = dst.Stat("usr/lib/apk/db/installed")
+	require.NoError(t, err)
+	require.Equal(t, fs.FileMode(0o640), fi.Mode())
+	require.True(t, fi.ModTime().Equal(mtime))
+	uid, gid, ok := fileOwner(fi)
+	require.True(t, ok)
+	require.Equal(t, []int{0, 42}, []int{uid, gid})
+	require.Equal(t, uint64(2), fi.(HardlinkInfo).Nlink(), "the names of a file should be hardlinks")
+	value, err := dst.GetXattr("usr/lib/apk/db/installed", "user.comment")
+	require.NoError(t, err)
+	require.Equal(t, "db", string(value))
+
+	target, err := dst.Readlink("usr/lib/apk/db/current")
+	require.NoError(t, err)
+	require.Equal(t, "installed", target)
+	fi, err = dst.Lstat("usr/lib/apk/db/fifo")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeNamedPipe|0o600, fi.Mode())
+	dev, err := dst.Readnod("usr/lib/apk/db/null")
+	require.NoError(t, err)
+	require.Equal(t, int(Mkdev(1, 3)), dev)
+
+	// a subtree is copied to the root of dst
+	etc, err := Sub(src, "etc")
+	require.NoError(t, err)
+	require.NoError(t, CopyTree(dst, etc, "."))
+	b, err = dst.ReadFile("os-release")
+	require.NoError(t, err)
+	require.Equal(t, "ID=test\n", string(b))
+
+	require.ErrorIs(t, CopyTree(dst, src, "/etc"), fs.ErrInvalid)
+}
@@ -14,10 +14,15 @@
 package fs
 
 import (
+	"errors"
 	"io"
 	"io/fs"
+	"time"
 )
 
+// ErrLocked is returned by TryLock when the lock is held by someone else.
+var ErrLocked = errors.New("locked by another process")
+
 // FullFS is a filesystem that supports all filesystem operations.
 type FullFS interface {
 	Mkdir(path string, perm fs.FileMode) error
@@ -45,6 +50,34 @@ type FullFS interface {
 	ListXattrs(path string) (map[string][]byte, error)
 }
 
+// ChtimesFS is a filesystem that sets the access and modification times of a path itself,
+// rather than of what it links to. The installer sets those of the package on it.
+type ChtimesFS interface {
+	Lchtimes(path string, atime time.Time, mtime time.Time) error
+}
+
+// RenameFS is a filesystem that moves a path to another one in a single step, replacing what
+// was there. The installed database is written to a temporary file that is renamed over it.
+type RenameFS interface {
+	Rename(oldpath, newpath string) error
+}
+
+// LockFS is a filesystem on which an advisory lock on a file is seen by other processes, such
+// as one that is on disk.
+type LockFS interface {
+	// TryLock takes the exclusive lock of the file at path, creating the file if needed, and
+	// returns the func that releases it. If the lock is held, it returns ErrLocked.
+	TryLock(path string) (unlock func() error, err error)
+}
+
+// MetadataFS is a FullFS that also sets the owner and times of a path itself rather than of
+// what it links to, such as RootFS. The installer applies those of the package to it.
+type MetadataFS interface {
+	FullFS
+	ChtimesFS
+	Lchown(path string, uid int, gid int) error
+}
+
 // File is an interface for a file. It includes Read, Write, Close.
 // This wouldn't be necessary if os.File were an interface, or if fs.File
 // were read/write.
@@ -87,3 +120,22 @@ type XattrFS interface {
 	RemoveXattr(path string, attr string) error
 	ListXattrs(path string) (map[string][]byte, error)
 }
+
+// LxattrFS is a filesystem whose symlinks have xattrs of their own, such as security labels,
+// like lsetxattr(2). These are those of path itself rather than of what it links to, which
+// only differ if it is a symlink.
+type LxattrFS interface {
+	LSetXattr(path string, attr string, data []byte) error
+	LGetXattr(path string, attr string) ([]byte, error)
+	LRemoveXattr(path string, attr string) error
+	LListXattrs(path string) (map[string][]byte, error)
+}
+
+// HardlinkInfo is implemented by the fs.FileInfo of filesystems that keep track of the names
+// of a file themselves, rather than with a *syscall.Stat_t as Sys.
+type HardlinkInfo interface {
+	// Ino identifies the file, and is the same for all of its names.
+	Ino() uint64
+	// Nlink is the number of names of the file.
+	Nlink() uint64
+}
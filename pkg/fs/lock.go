@@ -0,0 +1,41 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"io/fs"
+	"os"
+)
+
+// lockFile takes the exclusive flock of the file at p on disk, creating it like apk does, and
+// returns the func that releases it. The lock is held by the open file, so it is released
+// when the process exits, and it is also exclusive between opens within the same process.
+func lockFile(name, p string) (func() error, error) {
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := flock(f); err != nil {
+		_ = f.Close()
+		return nil, &fs.PathError{Op: "lock", Path: name, Err: err}
+	}
+	return f.Close, nil
+}
+
+// TryLockFile takes the exclusive flock of the open file f, or returns ErrLocked if another
+// open file holds it. The lock is released when f is closed.
+func TryLockFile(f *os.File) error {
+	return flock(f)
+}
@@ -26,9 +26,9 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
-
-	"golang.org/x/sys/unix"
 )
 
 const (
@@ -40,10 +40,18 @@ const (
 
 type memFS struct {
 	tree *node
+
+	spillDir       string
+	spillThreshold int64
+	spillMu        sync.Mutex
+	spilled        map[*os.File]bool
 }
 
-func NewMemFS() FullFS {
-	return &memFS{
+// NewMemFS returns a filesystem that is held in memory. With WithSpillDir or
+// WithSpillThreshold, the content of large files is kept on disk instead, and the filesystem
+// is an io.Closer that frees it.
+func NewMemFS(opts ...MemFSOption) FullFS {
+	m := &memFS{
 		tree: &node{
 			dir:      true,
 			children: map[string]*node{},
@@ -52,65 +60,87 @@ func NewMemFS() FullFS {
 			mode:     fs.ModeDir | 0o755,
 		},
 	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
 }
 
-// getNode returns the node for the given path. If the path is not found, it
-// returns an error.
+// getNode returns the node for the given path, following all of its symlinks. If the path is
+// not found, it returns an error.
 func (m *memFS) getNode(path string) (*node, error) {
-	return m.getNodeCountLinks(path, 0)
-}
-func (m *memFS) getNodeCountLinks(path string, linkDepth int) (*node, error) {
-	if path == "/" || path == "." {
-		return m.tree, nil
-	}
-	parts := strings.Split(path, pathSep)
-	node := m.tree
-	traversed := make([]string, 0)
-	for _, part := range parts {
-		if part == "" {
+	n, _, err := m.resolve(path, true)
+	return n, err
+}
+
+// getNodeNoFollow returns the node for the given path like getNode, except that if the
+// last element of the path is a symlink, it returns the symlink itself.
+func (m *memFS) getNodeNoFollow(path string) (*node, error) {
+	n, _, err := m.resolve(path, false)
+	return n, err
+}
+
+// resolve returns the node at path, and the path to it without any symlinks, like path
+// resolution on Linux: relative symlinks are followed from the directory they are in, and
+// absolute ones from the root of the memFS, ".." is the parent of where the path so far led,
+// and at most maxLinks symlinks are followed. The last element is only followed if followLast.
+func (m *memFS) resolve(path string, followLast bool) (*node, string, error) {
+	var (
+		pending = splitPath(path)
+		nodes   = []*node{m.tree}
+		names   []string
+		links   int
+	)
+	for len(pending) != 0 {
+		part := pending[0]
+		pending = pending[1:]
+		if part == ".." {
+			if len(names) != 0 {
+				nodes, names = nodes[:len(nodes)-1], names[:len(names)-1]
+			}
 			continue
 		}
-		if node.children == nil {
-			return nil, os.ErrNotExist
+		current := nodes[len(nodes)-1]
+		if !current.dir {
+			return nil, "", os.ErrNotExist
 		}
-		var ok bool
-		node.mu.Lock()
-		childNode, ok := node.children[part]
 		// immediately unlock, no need to wait for defer. This is *really* important in the
 		// case of symlinks below
-		node.mu.Unlock()
+		current.mu.Lock()
+		child, ok := current.children[part]
+		current.mu.Unlock()
 		if !ok {
-			return nil, os.ErrNotExist
+			return nil, "", os.ErrNotExist
 		}
-		// what if it is a symlink?
-		if childNode.mode&os.ModeSymlink != 0 {
-			newDepth := linkDepth + 1
-			if newDepth > maxLinks {
-				return nil, fmt.Errorf("maximum symlink depth exceeded")
+		if child.mode&os.ModeSymlink != 0 && (followLast || len(pending) != 0) {
+			if links++; links > maxLinks {
+				return nil, "", &fs.PathError{Op: "resolve", Path: path, Err: syscall.ELOOP}
 			}
-			// getNode requires working on the absolute path, so we just resolve the path to an absolute path,
-			// rather than struggling to clean up the path.
-			// But, we have to make sure that we set it relative to where we are currently, rather than the parent of the path.
-			// For example, /usr/lib64/foo/bar when /usr/lib64 -> lib, we want to resolve to /usr/lib rather than /usr/lib64/foo/lib
-			linkTarget := childNode.linkTarget
-			if !filepath.IsAbs(linkTarget) {
-				linkTarget = filepath.Join(strings.Join(traversed, pathSep), linkTarget)
+			if child.linkTarget == "" {
+				return nil, "", os.ErrNotExist
 			}
-			// now we have the absolute path, we can get the node
-			// but that absolute path can cause us to try and hit something that is already locked
-			// and since we are recursing, it will not get freed until we return
-			// leading to a deadlock race condition
-			targetNode, err := m.getNodeCountLinks(linkTarget, newDepth)
-			if err != nil {
-				return nil, err
+			if filepath.IsAbs(child.linkTarget) {
+				nodes, names = nodes[:1], nil
 			}
-			childNode = targetNode
+			pending = append(splitPath(child.linkTarget), pending...)
+			continue
 		}
-		node = childNode
-		traversed = append(traversed, part)
+		nodes, names = append(nodes, child), append(names, part)
 	}
-	return node, nil
+	return nodes[len(nodes)-1], pathSep + strings.Join(names, pathSep), nil
 }
+
+// splitPath returns the elements of path, without the empty ones and ".".
+func splitPath(path string) []string {
+	var parts []string
+	for _, part := range strings.Split(path, pathSep) {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
 func (m *memFS) Mkdir(path string, perms fs.FileMode) error {
 	// first see if the parent exists
 	parent := filepath.Dir(path)
@@ -145,69 +175,45 @@ func (m *memFS) Stat(path string) (fs.FileInfo, error) {
 	if err != nil {
 		return nil, err
 	}
-	if node.mode&fs.ModeSymlink != 0 {
-		targetNode, err := m.getNode(node.linkTarget)
-		if err != nil {
-			return nil, err
-		}
-		node = targetNode
-	}
 	return node.fileInfo(path), nil
 }
 
 func (m *memFS) Lstat(path string) (fs.FileInfo, error) {
-	node, err := m.getNode(path)
+	node, err := m.getNodeNoFollow(path)
 	if err != nil {
 		return nil, err
 	}
 	return node.fileInfo(path), nil
 }
 
+// MkdirAll creates the directories of path that are missing, following symlinks like os.MkdirAll,
+// so that those of a symlink to a directory are created where it links to.
 func (m *memFS) MkdirAll(path string, perm fs.FileMode) error {
-	parts := strings.Split(path, pathSep)
-	traversed := make([]string, 0)
-	anode := m.tree
-	for _, part := range parts {
-		if part == "" {
+	resolved := pathSep
+	for _, part := range splitPath(path) {
+		if part == ".." {
+			resolved = filepath.Dir(resolved)
 			continue
 		}
-		if anode.children == nil {
-			anode.children = map[string]*node{}
-		}
-		var ok bool
-		anode.mu.Lock()
-		newnode, ok := anode.children[part]
-		if !ok {
-			newnode = &node{
-				name:       part,
-				mode:       fs.ModeDir | perm,
-				dir:        true,
-				modTime:    time.Now(),
-				createTime: time.Now(),
-				children:   map[string]*node{},
-				xattrs:     map[string][]byte{},
-			}
-			anode.children[part] = newnode
+		next := filepath.Join(resolved, part)
+		anode, real, err := m.resolve(next, true)
+		switch {
+		case err == nil && !anode.dir:
+			return fmt.Errorf("path is not a directory")
+		case err == nil:
+			resolved = real
+			continue
+		case !errors.Is(err, os.ErrNotExist):
+			return err
 		}
-		anode.mu.Unlock()
-		// what if it is a symlink?
-		if newnode.mode&os.ModeSymlink != 0 {
-			linkTarget := newnode.linkTarget
-			if !filepath.IsAbs(linkTarget) {
-				linkTarget = filepath.Join(strings.Join(traversed, pathSep), linkTarget)
-			}
-
-			targetNode, err := m.getNode(linkTarget)
-			if err != nil {
-				return err
-			}
-			newnode = targetNode
+		// a dangling symlink is not replaced by a directory
+		if _, lerr := m.getNodeNoFollow(next); lerr == nil {
+			return err
 		}
-		if !newnode.dir {
-			return fmt.Errorf("path is not a directory")
+		if err := m.Mkdir(next, perm); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
 		}
-		anode = newnode
-		traversed = append(traversed, part)
+		resolved = next
 	}
 	return nil
 }
@@ -222,10 +228,13 @@ func (m *memFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error)
 func (m *memFS) openFile(name string, flag int, perm fs.FileMode, linkCount int) (File, error) {
 	parent := filepath.Dir(name)
 	base := filepath.Base(name)
-	parentAnode, err := m.getNode(parent)
+	parentAnode, parentPath, err := m.resolve(parent, true)
 	if err != nil {
 		return nil, err
 	}
+	if base == "." || base == ".." || name == pathSep {
+		return nil, fmt.Errorf("is a directory")
+	}
 	if !parentAnode.dir {
 		return nil, fmt.Errorf("parent is not a directory")
 	}
@@ -259,11 +268,11 @@ func (m *memFS) openFile(name string, flag int, perm fs.FileMode, linkCount int)
 	if anode.mode&os.ModeSymlink != 0 {
 		localCount := linkCount + 1
 		if localCount > maxLinks {
-			return nil, fmt.Errorf("too many links")
+			return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.ELOOP}
 		}
 		linkTarget := anode.linkTarget
 		if !filepath.IsAbs(linkTarget) {
-			linkTarget = filepath.Join(parent, linkTarget)
+			linkTarget = filepath.Join(parentPath, linkTarget)
 		}
 		return m.openFile(linkTarget, flag, perm, localCount)
 	}
@@ -296,6 +305,11 @@ func (m *memFS) WriteFile(name string, b []byte, mode fs.FileMode) error {
 	return nil
 }
 
+// Sub returns the subtree at dir, like Sub does without options.
+func (m *memFS) Sub(dir string) (fs.FS, error) {
+	return Sub(m, dir)
+}
+
 func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
 	anode, err := m.getNode(name)
 	if err != nil {
@@ -333,11 +347,11 @@ func (m *memFS) Mknod(path string, mode uint32, dev int) error {
 	}
 	anode.children[base] = &node{
 		name:       base,
-		mode:       fs.FileMode(mode) | os.ModeCharDevice | os.ModeDevice,
+		mode:       mknodPerm(mode) | mknodType(mode),
 		modTime:    time.Now(),
 		createTime: time.Now(),
-		major:      unix.Major(uint64(dev)),
-		minor:      unix.Minor(uint64(dev)),
+		major:      Major(dev),
+		minor:      Minor(dev),
 		xattrs:     map[string][]byte{},
 	}
 
@@ -357,10 +371,40 @@ func (m *memFS) Readnod(path string) (dev int, err error) {
 	if !ok {
 		return 0, os.ErrNotExist
 	}
-	if anode.mode&os.ModeDevice != os.ModeDevice || anode.mode&os.ModeCharDevice != os.ModeCharDevice {
+	if anode.mode&(os.ModeDevice|os.ModeNamedPipe|os.ModeSocket) == 0 {
 		return 0, fmt.Errorf("not a device")
 	}
-	return int(unix.Mkdev(anode.major, anode.minor)), nil
+	return Mkdev(anode.major, anode.minor), nil
+}
+
+// mknodType returns the type of the node that Mknod creates for mode, which is a character
+// device unless its S_IFMT bits are for a block device, FIFO or socket.
+// mknodPerm returns the permissions of mode, 0o7777 of it, as those of an fs.FileMode.
+func mknodPerm(mode uint32) fs.FileMode {
+	perm := fs.FileMode(mode & 0o777)
+	if mode&modeSetuid != 0 {
+		perm |= fs.ModeSetuid
+	}
+	if mode&modeSetgid != 0 {
+		perm |= fs.ModeSetgid
+	}
+	if mode&modeSticky != 0 {
+		perm |= fs.ModeSticky
+	}
+	return perm
+}
+
+func mknodType(mode uint32) fs.FileMode {
+	switch mode & modeTypeMask {
+	case modeBlock:
+		return os.ModeDevice
+	case modeFIFO:
+		return os.ModeNamedPipe
+	case modeSocket:
+		return os.ModeSocket
+	default:
+		return os.ModeDevice | os.ModeCharDevice
+	}
 }
 
 func (m *memFS) Chmod(path string, perm fs.FileMode) error {
@@ -382,6 +426,20 @@ func (m *memFS) Chown(path string, uid, gid int) error {
 	return nil
 }
 
+// Lchtimes sets the access and modification times of path, or of the symlink itself if it is
+// one.
+func (m *memFS) Lchtimes(path string, atime, mtime time.Time) error {
+	anode, err := m.getNodeNoFollow(path)
+	if err != nil {
+		return err
+	}
+	anode.mu.Lock()
+	defer anode.mu.Unlock()
+	anode.accessTime = atime
+	anode.modTime = mtime
+	return nil
+}
+
 func (m *memFS) Create(name string) (File, error) {
 	return m.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o666)
 }
@@ -419,13 +477,19 @@ func (m *memFS) Link(oldname, newname string) error {
 	if err != nil {
 		return os.ErrNotExist
 	}
+	// like link(2), directories cannot be hardlinked
+	if target.dir {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: fs.ErrPermission}
+	}
 	anode.mu.Lock()
 	defer anode.mu.Unlock()
 	if _, ok := anode.children[base]; ok {
 		return os.ErrExist
 	}
 	anode.children[base] = target
+	target.mu.Lock()
 	target.linkCount++
+	target.mu.Unlock()
 	return nil
 }
 
@@ -457,38 +521,108 @@ func (m *memFS) Remove(name string) error {
 	}
 	anode.mu.Lock()
 	defer anode.mu.Unlock()
-	if _, ok := anode.children[base]; !ok {
+	existing, ok := anode.children[base]
+	if !ok {
 		return os.ErrNotExist
 	}
-	if anode.children[base].linkCount > 0 {
-		anode.children[base].linkCount--
-	}
+	existing.unlink(m)
 	delete(anode.children, base)
 	return nil
 }
 
+func (m *memFS) Rename(oldpath, newpath string) error {
+	oldParent, err := m.getNode(filepath.Dir(oldpath))
+	if err != nil {
+		return err
+	}
+	newParent, err := m.getNode(filepath.Dir(newpath))
+	if err != nil {
+		return err
+	}
+	oldBase, newBase := filepath.Base(oldpath), filepath.Base(newpath)
+
+	// only one directory is locked at a time, so that renames between the same two
+	// directories in both directions cannot deadlock
+	oldParent.mu.Lock()
+	anode, ok := oldParent.children[oldBase]
+	if !ok {
+		oldParent.mu.Unlock()
+		return &fs.PathError{Op: "rename", Path: oldpath, Err: os.ErrNotExist}
+	}
+	if oldParent == newParent {
+		defer oldParent.mu.Unlock()
+		existing := oldParent.children[newBase]
+		if err := renameReplaces(anode, existing, newpath); err != nil {
+			return err
+		}
+		// like rename(2), nothing happens if both are names of the same file
+		if existing != anode {
+			if existing != nil {
+				existing.unlink(m)
+			}
+			oldParent.children[newBase] = anode
+			delete(oldParent.children, oldBase)
+		}
+		return nil
+	}
+	oldParent.mu.Unlock()
+
+	newParent.mu.Lock()
+	existing := newParent.children[newBase]
+	if err := renameReplaces(anode, existing, newpath); err != nil {
+		newParent.mu.Unlock()
+		return err
+	}
+	if existing == anode {
+		newParent.mu.Unlock()
+		return nil
+	}
+	if existing != nil {
+		existing.unlink(m)
+	}
+	newParent.children[newBase] = anode
+	newParent.mu.Unlock()
+
+	oldParent.mu.Lock()
+	defer oldParent.mu.Unlock()
+	if oldParent.children[oldBase] == anode {
+		delete(oldParent.children, oldBase)
+	}
+	return nil
+}
+
+// renameReplaces returns an error if anode may not be renamed over existing, which is nil if
+// nothing is there: like rename(2), a directory only replaces an empty directory, and a file
+// does not replace a directory.
+func renameReplaces(anode, existing *node, newpath string) error {
+	switch {
+	case existing == nil || existing == anode:
+		return nil
+	case existing.dir && !anode.dir:
+		return &fs.PathError{Op: "rename", Path: newpath, Err: syscall.EISDIR}
+	case !existing.dir && anode.dir:
+		return &fs.PathError{Op: "rename", Path: newpath, Err: syscall.ENOTDIR}
+	case existing.dir && len(existing.children) != 0:
+		return &fs.PathError{Op: "rename", Path: newpath, Err: syscall.ENOTEMPTY}
+	}
+	return nil
+}
+
 func (m *memFS) SetXattr(path string, attr string, data []byte) error {
 	node, err := m.getNode(path)
 	if err != nil {
 		return os.ErrNotExist
 	}
-	node.mu.Lock()
-	defer node.mu.Unlock()
-	node.xattrs[attr] = data
+	node.setXattr(attr, data)
 	return nil
 }
+
 func (m *memFS) GetXattr(path string, attr string) ([]byte, error) {
 	node, err := m.getNode(path)
 	if err != nil {
 		return nil, os.ErrNotExist
 	}
-	node.mu.Lock()
-	defer node.mu.Unlock()
-	data, ok := node.xattrs[attr]
-	if !ok {
-		return nil, os.ErrNotExist
-	}
-	return data, nil
+	return node.getXattr(attr)
 }
 
 func (m *memFS) RemoveXattr(path string, attr string) error {
@@ -496,31 +630,52 @@ func (m *memFS) RemoveXattr(path string, attr string) error {
 	if err != nil {
 		return os.ErrNotExist
 	}
-	node.mu.Lock()
-	defer node.mu.Unlock()
-	// RemoveXattr is meant to ensure it does not exist; if it does not exist already, that is fine
-	if _, ok := node.xattrs[attr]; !ok {
-		return nil
-	}
-	delete(node.xattrs, attr)
+	node.removeXattr(attr)
 	return nil
 }
+
 func (m *memFS) ListXattrs(path string) (map[string][]byte, error) {
 	node, err := m.getNode(path)
 	if err != nil {
 		return nil, os.ErrNotExist
 	}
-	node.mu.Lock()
-	defer node.mu.Unlock()
-	// do not return the original, as someone might change it by accident.
-	// Return a copy
-	ret := make(map[string][]byte)
-	for k, v := range node.xattrs {
-		dst := make([]byte, len(v))
-		copy(dst, v)
-		ret[k] = dst
+	return node.listXattrs(), nil
+}
+
+// The L variants are those of the node at path itself, which for a symlink has its own xattrs.
+
+func (m *memFS) LSetXattr(path string, attr string, data []byte) error {
+	node, err := m.getNodeNoFollow(path)
+	if err != nil {
+		return os.ErrNotExist
+	}
+	node.setXattr(attr, data)
+	return nil
+}
+
+func (m *memFS) LGetXattr(path string, attr string) ([]byte, error) {
+	node, err := m.getNodeNoFollow(path)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	return node.getXattr(attr)
+}
+
+func (m *memFS) LRemoveXattr(path string, attr string) error {
+	node, err := m.getNodeNoFollow(path)
+	if err != nil {
+		return os.ErrNotExist
+	}
+	node.removeXattr(attr)
+	return nil
+}
+
+func (m *memFS) LListXattrs(path string) (map[string][]byte, error) {
+	node, err := m.getNodeNoFollow(path)
+	if err != nil {
+		return nil, os.ErrNotExist
 	}
-	return ret, nil
+	return node.listXattrs(), nil
 }
 
 type memFile struct {
@@ -539,10 +694,10 @@ func newMemFile(node *node, name string, memfs *memFS, openMode int) *memFile {
 		openMode: openMode,
 	}
 	if openMode&os.O_APPEND != 0 {
-		m.offset = int64(len(node.data))
+		m.offset = node.size()
 	}
 	if openMode&os.O_TRUNC != 0 {
-		node.data = nil
+		node.truncate(memfs)
 	}
 	return m
 }
@@ -567,23 +722,16 @@ func (f *memFile) Read(b []byte) (int, error) {
 	if f.node == nil || f.fs == nil {
 		return 0, os.ErrClosed
 	}
-	if f.offset >= int64(len(f.node.data)) {
-		return 0, io.EOF
-	}
-	n := copy(b, f.node.data[f.offset:])
+	n, err := f.node.readAt(b, f.offset)
 	f.offset += int64(n)
-	return n, nil
+	return n, err
 }
 
 func (f *memFile) ReadAt(p []byte, off int64) (n int, err error) {
 	if f.node == nil || f.fs == nil {
 		return 0, os.ErrClosed
 	}
-	if off >= int64(len(f.node.data)) {
-		return 0, io.EOF
-	}
-	n = copy(p, f.node.data[off:])
-	return n, nil
+	return f.node.readAt(p, off)
 }
 func (f *memFile) Seek(offset int64, whence int) (int64, error) {
 	if f.node == nil || f.fs == nil {
@@ -595,7 +743,7 @@ func (f *memFile) Seek(offset int64, whence int) (int64, error) {
 	case io.SeekCurrent:
 		f.offset += offset
 	case io.SeekEnd:
-		f.offset = int64(len(f.node.data)) + offset
+		f.offset = f.node.size() + offset
 	default:
 		return 0, errors.New("invalid whence")
 	}
@@ -609,10 +757,8 @@ func (f *memFile) Write(p []byte) (n int, err error) {
 	if f.openMode&os.O_APPEND != 0 && f.openMode&os.O_RDWR != 0 && f.openMode&os.O_WRONLY != 0 {
 		return 0, errors.New("file not opened in write mode")
 	}
-	if f.offset+int64(len(p)) > int64(len(f.node.data)) {
-		f.node.data = append(f.node.data[:f.offset], p...)
-	} else {
-		copy(f.node.data[f.offset:], p)
+	if err := f.node.writeAt(f.fs, p, f.offset); err != nil {
+		return 0, err
 	}
 	f.offset += int64(len(p))
 	return len(p), nil
@@ -624,16 +770,88 @@ type node struct {
 	dir          bool
 	name         string
 	data         []byte
+	spill        *os.File // holds the content instead of data once it was spilled to disk
+	spillSize    int64
 	modTime      time.Time
+	accessTime   time.Time
 	createTime   time.Time
 	linkTarget   string
 	linkCount    int // extra links, so 0 means a single pointer. O-based, like most compuuter counting systems.
+	ino          uint64
 	major, minor uint32
 	children     map[string]*node
 	mu           sync.Mutex
 	xattrs       map[string][]byte
 }
 
+// lastInode is the inode number last given to a node.
+var lastInode atomic.Uint64
+
+// inode returns the inode number of n, which is given to it the first time it is asked for.
+func (n *node) inode() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ino == 0 {
+		n.ino = lastInode.Add(1)
+	}
+	return n.ino
+}
+
+// unlink is called when a name of n is removed. The data is kept for the other names until
+// there are none left, when n is no longer referred to at all, and what m spilled of it, or
+// of what is below it for a directory, is freed.
+func (n *node) unlink(m *memFS) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.linkCount > 0 {
+		n.linkCount--
+		return
+	}
+	if n.spill != nil {
+		m.unspill(n.spill)
+		n.spill, n.spillSize = nil, 0
+	}
+	for _, child := range n.children {
+		child.unlink(m)
+	}
+}
+
+// setXattr keeps a copy of data, so that the caller may change it.
+func (n *node) setXattr(attr string, data []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.xattrs[attr] = append([]byte(nil), data...)
+}
+
+func (n *node) getXattr(attr string) ([]byte, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	data, ok := n.xattrs[attr]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// removeXattr is meant to ensure it does not exist; if it does not exist already, that is fine
+func (n *node) removeXattr(attr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.xattrs, attr)
+}
+
+// listXattrs does not return the original, as someone might change it by accident.
+// It returns a copy.
+func (n *node) listXattrs() map[string][]byte {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ret := make(map[string][]byte, len(n.xattrs))
+	for k, v := range n.xattrs {
+		ret[k] = append([]byte(nil), v...)
+	}
+	return ret
+}
+
 func (n *node) fileInfo(name string) fs.FileInfo {
 	return &memFileInfo{
 		node: n,
@@ -650,7 +868,7 @@ func (m *memFileInfo) Name() string {
 	return m.name
 }
 func (m *memFileInfo) Size() int64 {
-	return int64(len(m.data))
+	return m.size()
 }
 func (m *memFileInfo) Mode() fs.FileMode {
 	return m.mode
@@ -661,10 +879,19 @@ func (m *memFileInfo) ModTime() time.Time {
 func (m *memFileInfo) IsDir() bool {
 	return m.dir
 }
+func (m *memFileInfo) Ino() uint64 {
+	return m.inode()
+}
+func (m *memFileInfo) Nlink() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return uint64(m.linkCount) + 1
+}
 func (m *memFileInfo) Sys() any {
 	return &tar.Header{
-		Mode: int64(m.mode),
-		Uid:  m.uid,
-		Gid:  m.gid,
+		Mode:       int64(m.mode),
+		Uid:        m.uid,
+		Gid:        m.gid,
+		AccessTime: m.accessTime,
 	}
 }
@@ -1,10 +1,14 @@
 package fs
 
 import (
+	"archive/tar"
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -206,7 +210,82 @@ func TestMemFSSymlink(t *testing.T) {
 	actualTarget, err := m.Readlink(link)
 	require.NoError(t, err, "error reading target of link file %s", link)
 	require.Equal(t, target, actualTarget, "target of %s should be %s", link, target)
+	// Lstat is of the link itself, Stat of its target
+	fi, err := m.Lstat(link)
+	require.NoError(t, err, "error lstatting %s", link)
+	require.Equal(t, os.ModeSymlink, fi.Mode().Type(), "%s should be a symlink", link)
+	fi, err = m.Stat(link)
+	require.NoError(t, err, "error statting %s", link)
+	require.True(t, fi.Mode().IsRegular(), "target of %s should be a regular file", link)
 }
+func TestMemFSLchtimes(t *testing.T) {
+	var (
+		m     = NewMemFS()
+		cfs   = m.(ChtimesFS)
+		atime = time.Date(2023, 5, 6, 7, 8, 9, 0, time.UTC)
+		mtime = time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	)
+	require.NoError(t, m.MkdirAll("a/b", 0o755))
+	require.NoError(t, m.WriteFile("a/b/c", []byte("hello"), 0o644))
+	require.NoError(t, m.Symlink("c", "a/b/d"))
+
+	require.NoError(t, cfs.Lchtimes("a/b/c", atime, mtime))
+	fi, err := m.Stat("a/b/c")
+	require.NoError(t, err)
+	require.True(t, fi.ModTime().Equal(mtime), "mtime should be %s, is %s", mtime, fi.ModTime())
+	require.True(t, fi.Sys().(*tar.Header).AccessTime.Equal(atime), "atime should be %s", atime)
+
+	require.NoError(t, cfs.Lchtimes("a/b/", mtime, mtime))
+	fi, err = m.Stat("a/b")
+	require.NoError(t, err)
+	require.True(t, fi.ModTime().Equal(mtime), "directory mtime should be %s, is %s", mtime, fi.ModTime())
+
+	// the symlink itself, not its target
+	later := mtime.Add(time.Hour)
+	require.NoError(t, cfs.Lchtimes("a/b/d", later, later))
+	fi, err = m.Stat("a/b/c")
+	require.NoError(t, err)
+	require.True(t, fi.ModTime().Equal(mtime), "target mtime should not change")
+
+	require.ErrorIs(t, cfs.Lchtimes("a/b/missing", mtime, mtime), os.ErrNotExist)
+}
+
+func TestMemFSRename(t *testing.T) {
+	var (
+		m   = NewMemFS()
+		rfs = m.(RenameFS)
+	)
+	require.NoError(t, m.MkdirAll("a/b", 0o755))
+	require.NoError(t, m.MkdirAll("c", 0o755))
+	require.NoError(t, m.WriteFile("a/b/new", []byte("new"), 0o600))
+	require.NoError(t, m.WriteFile("a/b/old", []byte("old"), 0o644))
+
+	// over a file in the same directory
+	require.NoError(t, rfs.Rename("a/b/new", "a/b/old"))
+	b, err := m.ReadFile("a/b/old")
+	require.NoError(t, err)
+	require.Equal(t, "new", string(b))
+	fi, err := m.Stat("a/b/old")
+	require.NoError(t, err)
+	require.Equal(t, fs.FileMode(0o600), fi.Mode().Perm(), "the mode should be that of the renamed file")
+	_, err = m.Stat("a/b/new")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// to another directory
+	require.NoError(t, rfs.Rename("a/b/old", "c/moved"))
+	b, err = m.ReadFile("c/moved")
+	require.NoError(t, err)
+	require.Equal(t, "new", string(b))
+	_, err = m.Stat("a/b/old")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	require.ErrorIs(t, rfs.Rename("a/b/missing", "c/x"), os.ErrNotExist)
+	require.Error(t, rfs.Rename("c/moved", "a"), "a file should not replace a directory")
+	require.NoError(t, rfs.Rename("a/b", "c/b"), "a directory should move with its children")
+	_, err = m.Stat("c/b")
+	require.NoError(t, err)
+}
+
 func TestMemFSHardlink(t *testing.T) {
 	var (
 		m           = NewMemFS()
@@ -242,6 +321,55 @@ func TestMemFSHardlink(t *testing.T) {
 		require.NoError(t, err, "error reading link file content %s", linkName)
 		require.Equal(t, originalContent, linkContent, "content of %s should be %s", linkName, originalContent)
 	})
+	t.Run("link to directory", func(t *testing.T) {
+		err = m.Link(base, filepath.Join(base, "g"))
+		require.ErrorIs(t, err, fs.ErrPermission, "hardlink to directory %s should fail", base)
+	})
+	t.Run("link to missing file", func(t *testing.T) {
+		err = m.Link(filepath.Join(base, "missing"), filepath.Join(base, "h"))
+		require.ErrorIs(t, err, fs.ErrNotExist, "hardlink to missing file should fail")
+	})
+}
+
+func TestMemFSHardlinkCount(t *testing.T) {
+	m := NewMemFS()
+	require.NoError(t, m.WriteFile("a", []byte("hello"), 0o644))
+	require.NoError(t, m.Link("a", "b"))
+	require.NoError(t, m.Link("b", "c"))
+
+	nlink := func(name string) uint64 {
+		fi, err := m.Stat(name)
+		require.NoError(t, err)
+		return fi.(HardlinkInfo).Nlink()
+	}
+	fa, err := m.Stat("a")
+	require.NoError(t, err)
+	fb, err := m.Stat("b")
+	require.NoError(t, err)
+	require.Equal(t, fa.(HardlinkInfo).Ino(), fb.(HardlinkInfo).Ino(), "the names of a file should share its inode")
+	require.Equal(t, uint64(3), nlink("a"))
+
+	require.NoError(t, m.WriteFile("b", []byte("changed"), 0o644))
+	b, err := m.ReadFile("a")
+	require.NoError(t, err)
+	require.Equal(t, "changed", string(b), "a write through one name should be seen through the others")
+
+	require.NoError(t, m.Remove("a"))
+	require.Equal(t, uint64(2), nlink("c"))
+	b, err = m.ReadFile("c")
+	require.NoError(t, err)
+	require.Equal(t, "changed", string(b), "the content should be kept while other names are left")
+
+	require.NoError(t, m.WriteFile("d", []byte("other"), 0o644))
+	require.NoError(t, m.(RenameFS).Rename("d", "b"))
+	require.Equal(t, uint64(1), nlink("c"), "a name replaced by a rename should be removed")
+	require.NoError(t, m.Link("c", "e"))
+	require.NoError(t, m.(RenameFS).Rename("c", "e"))
+	require.Equal(t, uint64(2), nlink("c"), "a rename between names of the same file should do nothing")
+
+	fo, err := m.Stat("b")
+	require.NoError(t, err)
+	require.NotEqual(t, fo.(HardlinkInfo).Ino(), fb.(HardlinkInfo).Ino())
 }
 
 func TestMemFSMidLevelSymlink(t *testing.T) {
@@ -350,6 +478,34 @@ func TestMemFSXattrs(t *testing.T) {
 	})
 }
 
+func TestMemFSSymlinkXattrs(t *testing.T) {
+	m := NewMemFS()
+	require.NoError(t, m.WriteFile("file", []byte("hello"), 0o644))
+	require.NoError(t, m.Symlink("file", "link"))
+	lfs, ok := m.(LxattrFS)
+	require.True(t, ok, "memfs should keep the xattrs of symlinks")
+
+	label := []byte("system_u:object_r:bin_t:s0")
+	require.NoError(t, lfs.LSetXattr("link", "security.selinux", label))
+	require.NoError(t, m.SetXattr("link", "user.target", []byte("target")))
+	label[0] = 'X'
+
+	xattrs, err := lfs.LListXattrs("link")
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"security.selinux": []byte("system_u:object_r:bin_t:s0")}, xattrs, "the value should be copied when set")
+	xattrs, err = m.ListXattrs("file")
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"user.target": []byte("target")}, xattrs, "SetXattr should follow the symlink")
+	val, err := lfs.LGetXattr("file", "user.target")
+	require.NoError(t, err)
+	require.Equal(t, []byte("target"), val, "a file that is not a symlink has the same xattrs")
+
+	require.NoError(t, lfs.LRemoveXattr("link", "security.selinux"))
+	_, err = lfs.LGetXattr("link", "security.selinux")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.ErrorIs(t, lfs.LSetXattr("missing", "user.foo", nil), os.ErrNotExist)
+}
+
 func TestMemFSSymlinkLoop(t *testing.T) {
 	var (
 		m   = NewMemFS()
@@ -394,6 +550,140 @@ func TestMemFSSymlinkCycle(t *testing.T) {
 	require.Error(t, err)
 }
 
+// testSymlinkLayout is a root laid out like busybox and alpine-baselayout do, with a merged /usr.
+func testSymlinkLayout(t *testing.T) FullFS {
+	m := NewMemFS()
+	for _, dir := range []string{"/usr/bin", "/usr/sbin", "/usr/lib", "/run", "/var/spool", "/var/mail", "/etc", "/proc"} {
+		require.NoError(t, m.MkdirAll(dir, 0o755))
+	}
+	for _, link := range [][2]string{
+		{"usr/bin", "/bin"},
+		{"usr/sbin", "/sbin"},
+		{"usr/lib", "/lib"},
+		{"lib", "/lib64"},
+		{"../run", "/var/run"},
+		{"../mail", "/var/spool/mail"},
+		{"../proc/mounts", "/etc/mtab"},
+	} {
+		require.NoError(t, m.Symlink(link[0], link[1]))
+	}
+	// created through the symlinked directories, like the packages that are installed into them
+	require.NoError(t, m.WriteFile("/bin/busybox", []byte("busybox"), 0o755))
+	require.NoError(t, m.Symlink("/bin/busybox", "/bin/sh"))
+	require.NoError(t, m.Symlink("busybox", "/bin/ls"))
+	require.NoError(t, m.Symlink("../bin/busybox", "/sbin/ip"))
+	require.NoError(t, m.WriteFile("/lib/ld-musl-x86_64.so.1", []byte("musl"), 0o755))
+	require.NoError(t, m.Symlink("ld-musl-x86_64.so.1", "/lib64/libc.musl-x86_64.so.1"))
+	return m
+}
+
+func TestMemFSSymlinkLayout(t *testing.T) {
+	m := testSymlinkLayout(t)
+
+	for name, want := range map[string]string{
+		"/usr/bin/busybox":                 "busybox",
+		"/bin/sh":                          "busybox",
+		"/usr/bin/ls":                      "busybox",
+		"/sbin/ip":                         "busybox",
+		"/usr/sbin/ip":                     "busybox",
+		"/lib/libc.musl-x86_64.so.1":       "musl",
+		"/lib64/libc.musl-x86_64.so.1":     "musl",
+		"/lib64/../bin/sh":                 "busybox",
+		"/sbin/../lib/ld-musl-x86_64.so.1": "musl",
+	} {
+		b, err := m.ReadFile(name)
+		require.NoError(t, err, name)
+		require.Equal(t, want, string(b), name)
+	}
+
+	// ".." is the parent of where a symlink leads, not of the symlink
+	fi, err := m.Stat("/var/run/../etc")
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+	_, err = m.Stat("/var/etc")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	// Stat follows the symlinks, Lstat does not
+	fi, err = m.Stat("/bin/sh")
+	require.NoError(t, err)
+	require.True(t, fi.Mode().IsRegular())
+	require.Equal(t, int64(len("busybox")), fi.Size())
+	fi, err = m.Lstat("/bin/sh")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+	fi, err = m.Lstat("/bin")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+	fi, err = m.Lstat("/bin/")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+	fi, err = m.Lstat("/bin/ls")
+	require.NoError(t, err, "Lstat should follow the symlinks of the parents")
+	require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+
+	// a dangling symlink can be read, but not followed
+	_, err = m.Stat("/etc/mtab")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = m.Lstat("/etc/mtab")
+	require.NoError(t, err)
+	target, err := m.Readlink("/etc/mtab")
+	require.NoError(t, err)
+	require.Equal(t, "../proc/mounts", target)
+	require.Error(t, m.MkdirAll("/etc/mtab/x", 0o755), "a dangling symlink should not be replaced by a directory")
+	require.NoError(t, m.WriteFile("/etc/mtab", []byte("proc /proc proc rw 0 0\n"), 0o644))
+	b, err := m.ReadFile("/proc/mounts")
+	require.NoError(t, err, "writing a dangling symlink should create what it links to")
+	require.Equal(t, "proc /proc proc rw 0 0\n", string(b))
+
+	// directories are created where a symlink leads to
+	require.NoError(t, m.MkdirAll("/var/run/user/1000", 0o700))
+	fi, err = m.Stat("/run/user/1000")
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+	require.NoError(t, m.WriteFile("/var/spool/mail/root", nil, 0o600))
+	_, err = m.Stat("/var/mail/root")
+	require.NoError(t, err)
+	entries, err := m.ReadDir("/var/spool")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "mail", entries[0].Name())
+}
+
+func TestMemFSSymlinkELOOP(t *testing.T) {
+	m := NewMemFS()
+	require.NoError(t, m.MkdirAll("/a", 0o755))
+	require.NoError(t, m.Symlink("/b", "/a/loop"))
+	require.NoError(t, m.Symlink("a/loop", "/b"))
+	require.NoError(t, m.Symlink("self", "/self"))
+
+	for _, name := range []string{"/b", "/a/loop", "/self", "/a/loop/x", "/self/x"} {
+		_, err := m.Stat(name)
+		require.ErrorIs(t, err, syscall.ELOOP, name)
+		_, err = m.ReadFile(name)
+		require.ErrorIs(t, err, syscall.ELOOP, name)
+	}
+	require.ErrorIs(t, m.MkdirAll("/self/x", 0o755), syscall.ELOOP)
+	_, err := m.Lstat("/self")
+	require.NoError(t, err, "Lstat should not follow the last symlink")
+
+	// a chain of maxLinks symlinks can be followed, but not one longer
+	require.NoError(t, m.WriteFile("/target", []byte("x"), 0o644))
+	prev := "target"
+	for i := 0; i < maxLinks; i++ {
+		link := fmt.Sprintf("link%d", i)
+		require.NoError(t, m.Symlink(prev, "/"+link))
+		prev = link
+	}
+	b, err := m.ReadFile("/" + prev)
+	require.NoError(t, err)
+	require.Equal(t, "x", string(b))
+	require.NoError(t, m.Symlink(prev, "/toolong"))
+	_, err = m.Stat("/toolong")
+	require.ErrorIs(t, err, syscall.ELOOP)
+	_, err = m.ReadFile("/toolong")
+	require.ErrorIs(t, err, syscall.ELOOP)
+}
+
 func TestMemFSConsistentOrdering(t *testing.T) {
 	var (
 		m = NewMemFS()
@@ -450,3 +740,32 @@ func TestMemFSConsistentOrdering(t *testing.T) {
 	}
 	// all results should be the same
 }
+
+func TestMemFSMknod(t *testing.T) {
+	m := NewMemFS()
+	for _, tt := range []struct {
+		name string
+		mode uint32
+		want fs.FileMode
+	}{
+		{"char", modeChar | 0o666, os.ModeDevice | os.ModeCharDevice | 0o666},
+		{"block", modeBlock | 0o660, os.ModeDevice | 0o660},
+		{"fifo", modeFIFO | 0o600, os.ModeNamedPipe | 0o600},
+		{"socket", modeSocket | 0o600, os.ModeSocket | 0o600},
+		{"setuid", modeChar | 0o4755, os.ModeDevice | os.ModeCharDevice | os.ModeSetuid | 0o755},
+		{"setgid sticky", modeFIFO | 0o3770, os.ModeNamedPipe | os.ModeSetgid | os.ModeSticky | 0o770},
+	} {
+		dev := Mkdev(8, 1)
+		require.NoError(t, m.Mknod(tt.name, tt.mode, dev), "error creating %s", tt.name)
+		fi, err := m.Lstat(tt.name)
+		require.NoError(t, err, "error statting %s", tt.name)
+		require.Equal(t, tt.want, fi.Mode(), "mode of %s", tt.name)
+		require.Equal(t, tt.mode, MknodMode(fi.Mode()), "mknod mode of %s", tt.name)
+		actual, err := m.Readnod(tt.name)
+		require.NoError(t, err, "error reading %s", tt.name)
+		require.Equal(t, dev, actual, "device of %s", tt.name)
+	}
+	require.NoError(t, m.WriteFile("file", nil, 0o644))
+	_, err := m.Readnod("file")
+	require.Error(t, err)
+}
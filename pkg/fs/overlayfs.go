@@ -0,0 +1,711 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LayerFS is a filesystem that keeps what was changed apart from a base that is not written
+// to, such as NewOverlayFS. A tarball of the changes is a layer that can be appended to an
+// image of the base.
+type LayerFS interface {
+	FullFS
+	// Upper returns the filesystem that holds what was written.
+	Upper() FullFS
+	// Whiteouts returns the paths of the base that were removed, sorted.
+	Whiteouts() []string
+	// OpaqueDirs returns the directories that were removed from the base and created again,
+	// sorted. Nothing that is under them in the base is seen.
+	OpaqueDirs() []string
+}
+
+// lstatFS is a filesystem that stats a symlink itself, which fs.Stat follows.
+type lstatFS interface {
+	Lstat(path string) (fs.FileInfo, error)
+}
+
+type overlayFS struct {
+	base  fs.FS
+	upper FullFS
+
+	mu        sync.Mutex
+	whiteouts map[string]bool
+	opaque    map[string]bool
+}
+
+// NewOverlayFS returns a filesystem that reads what is in upper, or else in base, and only
+// writes to upper, like overlayfs. Whatever of base is changed is copied to upper first, and
+// what is removed from base is recorded as a whiteout. Symlinks are followed through both.
+func NewOverlayFS(base fs.FS, upper FullFS) LayerFS {
+	return &overlayFS{
+		base:      base,
+		upper:     upper,
+		whiteouts: map[string]bool{},
+		opaque:    map[string]bool{},
+	}
+}
+
+func (o *overlayFS) Upper() FullFS {
+	return o.upper
+}
+
+func (o *overlayFS) Whiteouts() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return sortedKeys(o.whiteouts)
+}
+
+func (o *overlayFS) OpaqueDirs() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return sortedKeys(o.opaque)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// overlayPath returns name as a path of both layers, relative to their root.
+func overlayPath(name string) string {
+	p := strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// hidden returns whether what is at p in the base is not seen, because it or a directory
+// above it was removed, or it is under an opaque directory.
+func (o *overlayFS) hidden(p string) bool {
+	if p == "." {
+		return false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.whiteouts[p] {
+		return true
+	}
+	for dir := filepath.Dir(p); ; dir = filepath.Dir(dir) {
+		if o.whiteouts[dir] || o.opaque[dir] {
+			return true
+		}
+		if dir == "." {
+			return false
+		}
+	}
+}
+
+func (o *overlayFS) inUpper(p string) bool {
+	_, err := o.upper.Lstat(p)
+	return err == nil
+}
+
+// baseLstat returns what is at p in the base, without following a symlink at p.
+func (o *overlayFS) baseLstat(p string) (fs.FileInfo, error) {
+	if o.hidden(p) {
+		return nil, &fs.PathError{Op: "lstat", Path: p, Err: fs.ErrNotExist}
+	}
+	if lfs, ok := o.base.(lstatFS); ok {
+		return lfs.Lstat(p)
+	}
+	return fs.Stat(o.base, p)
+}
+
+// lstat returns what is at p, and whether that is in upper.
+func (o *overlayFS) lstat(p string) (fs.FileInfo, bool, error) {
+	if fi, err := o.upper.Lstat(p); err == nil {
+		return fi, true, nil
+	}
+	fi, err := o.baseLstat(p)
+	return fi, false, err
+}
+
+func (o *overlayFS) exists(p string) bool {
+	_, _, err := o.lstat(p)
+	return err == nil
+}
+
+// resolve returns the path of name with the symlinks of its directories, and of its last
+// element if follow, replaced by what they link to as seen through the overlay, so that it
+// means the same in both layers. What is missing is left as it is.
+func (o *overlayFS) resolve(name string, follow bool) (string, error) {
+	var (
+		parts    = strings.Split(overlayPath(name), "/")
+		resolved = "."
+		links    int
+	)
+	if parts[0] == "." {
+		return ".", nil
+	}
+	for i := 0; i < len(parts); i++ {
+		next := filepath.Join(resolved, parts[i])
+		if i == len(parts)-1 && !follow {
+			return next, nil
+		}
+		fi, _, err := o.lstat(next)
+		if err != nil {
+			return filepath.Join(append([]string{next}, parts[i+1:]...)...), nil
+		}
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > maxLinks {
+			return "", &fs.PathError{Op: "resolve", Path: name, Err: syscall.ELOOP}
+		}
+		target, err := o.readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(resolved, target)
+		}
+		rest := parts[i+1:]
+		if target = overlayPath(target); target != "." {
+			rest = append(strings.Split(target, "/"), rest...)
+		}
+		parts, resolved, i = rest, ".", -1
+	}
+	return resolved, nil
+}
+
+func (o *overlayFS) readlink(p string) (string, error) {
+	if o.inUpper(p) {
+		return o.upper.Readlink(p)
+	}
+	if _, err := o.baseLstat(p); err != nil {
+		return "", err
+	}
+	rfs, ok := o.base.(ReadLinkFS)
+	if !ok {
+		return "", fmt.Errorf("readlink not supported by the base: %s", p)
+	}
+	return rfs.Readlink(p)
+}
+
+// copyUpParents copies the directories above p into upper, if they are not there yet.
+func (o *overlayFS) copyUpParents(p string) error {
+	if p == "." {
+		return nil
+	}
+	dir := filepath.Dir(p)
+	if dir == "." || o.inUpper(dir) {
+		return nil
+	}
+	return o.copyUp(dir)
+}
+
+// copyUp copies what is at p in the base into upper, with its metadata, so that it can be
+// changed there, if it is not there yet.
+func (o *overlayFS) copyUp(p string) error {
+	if p == "." || o.inUpper(p) {
+		return nil
+	}
+	fi, err := o.baseLstat(p)
+	if err != nil {
+		return err
+	}
+	if err := o.copyUpParents(p); err != nil {
+		return err
+	}
+	return copyEntry(o.upper, o.base, p, fi)
+}
+
+// created is called when p was created in upper, as something that replaces what was
+// removed from the base there, if anything. A directory then hides all that is under it.
+func (o *overlayFS) created(p string, dir bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.whiteouts[p] {
+		delete(o.whiteouts, p)
+		if dir {
+			o.opaque[p] = true
+		}
+	}
+}
+
+// prepareCreate returns the path to create name at in upper, after checking that nothing is
+// there and copying its directories.
+func (o *overlayFS) prepareCreate(op, name string) (string, error) {
+	p, err := o.resolve(name, false)
+	if err != nil {
+		return "", err
+	}
+	if o.exists(p) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrExist}
+	}
+	return p, o.copyUpParents(p)
+}
+
+// prepareChange returns the path of name in upper, after copying what is there in the base.
+func (o *overlayFS) prepareChange(name string, follow bool) (string, error) {
+	p, err := o.resolve(name, follow)
+	if err != nil {
+		return "", err
+	}
+	return p, o.copyUp(p)
+}
+
+func (o *overlayFS) Mkdir(name string, perm fs.FileMode) error {
+	p, err := o.prepareCreate("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if err := o.upper.Mkdir(p, perm); err != nil {
+		return err
+	}
+	o.created(p, true)
+	return nil
+}
+
+func (o *overlayFS) MkdirAll(name string, perm fs.FileMode) error {
+	p, err := o.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	dir := "."
+	for _, part := range strings.Split(p, "/") {
+		dir = filepath.Join(dir, part)
+		fi, _, err := o.lstat(dir)
+		switch {
+		case err == nil && !fi.IsDir():
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		case err == nil:
+		case errors.Is(err, fs.ErrNotExist):
+			if err := o.Mkdir(dir, perm); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *overlayFS) Open(name string) (fs.File, error) {
+	return o.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (o *overlayFS) OpenReaderAt(name string) (File, error) {
+	return o.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (o *overlayFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	p, err := o.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+		if o.inUpper(p) {
+			return o.upper.OpenFile(p, flag, perm)
+		}
+		return o.openBase(p)
+	}
+	exists := o.exists(p)
+	switch {
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case exists:
+		err = o.copyUp(p)
+	case flag&os.O_CREATE != 0:
+		err = o.copyUpParents(p)
+	default:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if err != nil {
+		return nil, err
+	}
+	f, err := o.upper.OpenFile(p, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		o.created(p, false)
+	}
+	return f, nil
+}
+
+// openBase opens p in the base, which can only be read.
+func (o *overlayFS) openBase(p string) (File, error) {
+	if _, err := o.baseLstat(p); err != nil {
+		return nil, err
+	}
+	if rfs, ok := o.base.(OpenReaderAtFS); ok {
+		return rfs.OpenReaderAt(p)
+	}
+	f, err := o.base.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return &baseFile{File: f, name: p}, nil
+}
+
+// baseFile is a file of the base of an overlayFS, which is read-only.
+type baseFile struct {
+	fs.File
+	name string
+}
+
+func (f *baseFile) Write([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+}
+
+func (f *baseFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.File.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, &fs.PathError{Op: "seek", Path: f.name, Err: errors.ErrUnsupported}
+}
+
+func (f *baseFile) ReadAt(p []byte, off int64) (int, error) {
+	if r, ok := f.File.(io.ReaderAt); ok {
+		return r.ReadAt(p, off)
+	}
+	return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.ErrUnsupported}
+}
+
+func (o *overlayFS) ReadFile(name string) ([]byte, error) {
+	f, err := o.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (o *overlayFS) WriteFile(name string, b []byte, mode fs.FileMode) error {
+	f, err := o.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, bytes.NewReader(b)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (o *overlayFS) Create(name string) (File, error) {
+	return o.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o666)
+}
+
+// ReadDir returns what is in name in upper, and what is left of it in the base, sorted.
+func (o *overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := o.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	fi, inUpper, err := o.lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	entries := map[string]fs.DirEntry{}
+	o.mu.Lock()
+	opaque := o.opaque[p]
+	o.mu.Unlock()
+	if !opaque {
+		if bfi, err := o.baseLstat(p); err == nil && bfi.IsDir() {
+			base, err := fs.ReadDir(o.base, p)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range base {
+				if !o.hidden(filepath.Join(p, e.Name())) {
+					entries[e.Name()] = e
+				}
+			}
+		}
+	}
+	if inUpper {
+		upper, err := o.upper.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range upper {
+			entries[e.Name()] = e
+		}
+	}
+	result := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, e)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name() < result[j].Name() })
+	return result, nil
+}
+
+func (o *overlayFS) Mknod(name string, mode uint32, dev int) error {
+	p, err := o.prepareCreate("mknod", name)
+	if err != nil {
+		return err
+	}
+	if err := o.upper.Mknod(p, mode, dev); err != nil {
+		return err
+	}
+	o.created(p, false)
+	return nil
+}
+
+func (o *overlayFS) Readnod(name string) (int, error) {
+	p, err := o.resolve(name, true)
+	if err != nil {
+		return 0, err
+	}
+	if o.inUpper(p) {
+		return o.upper.Readnod(p)
+	}
+	if _, err := o.baseLstat(p); err != nil {
+		return 0, err
+	}
+	rfs, ok := o.base.(ReadnodFS)
+	if !ok {
+		return 0, fmt.Errorf("read device not supported by the base: %s", p)
+	}
+	return rfs.Readnod(p)
+}
+
+func (o *overlayFS) Symlink(oldname, newname string) error {
+	p, err := o.prepareCreate("symlink", newname)
+	if err != nil {
+		return err
+	}
+	if err := o.upper.Symlink(oldname, p); err != nil {
+		return err
+	}
+	o.created(p, false)
+	return nil
+}
+
+// Link copies oldname from the base, if it is there, as hardlinks cannot be between layers.
+func (o *overlayFS) Link(oldname, newname string) error {
+	oldp, err := o.prepareChange(oldname, true)
+	if err != nil {
+		return err
+	}
+	p, err := o.prepareCreate("link", newname)
+	if err != nil {
+		return err
+	}
+	if err := o.upper.Link(oldp, p); err != nil {
+		return err
+	}
+	o.created(p, false)
+	return nil
+}
+
+func (o *overlayFS) Readlink(name string) (string, error) {
+	p, err := o.resolve(name, false)
+	if err != nil {
+		return "", err
+	}
+	return o.readlink(p)
+}
+
+func (o *overlayFS) Stat(name string) (fs.FileInfo, error) {
+	p, err := o.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	fi, _, err := o.lstat(p)
+	return fi, err
+}
+
+func (o *overlayFS) Lstat(name string) (fs.FileInfo, error) {
+	p, err := o.resolve(name, false)
+	if err != nil {
+		return nil, err
+	}
+	fi, _, err := o.lstat(p)
+	return fi, err
+}
+
+// Remove removes name from upper, and records a whiteout for it if it is in the base.
+func (o *overlayFS) Remove(name string) error {
+	p, err := o.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	fi, inUpper, err := o.lstat(p)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		entries, err := o.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		if len(entries) != 0 {
+			return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	if inUpper {
+		if err := o.upper.Remove(p); err != nil {
+			return err
+		}
+	}
+	_, baseErr := o.baseLstat(p)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.opaque, p)
+	// the whiteout of the directory hides all that was under it
+	for w := range o.whiteouts {
+		if strings.HasPrefix(w, p+"/") {
+			delete(o.whiteouts, w)
+		}
+	}
+	if baseErr == nil {
+		o.whiteouts[p] = true
+	}
+	return nil
+}
+
+// Rename moves oldpath within upper, and records a whiteout for it if it is in the base. Like
+// overlayfs, a directory of the base cannot be renamed, as all of it would have to be copied.
+func (o *overlayFS) Rename(oldpath, newpath string) error {
+	rfs, ok := o.upper.(RenameFS)
+	if !ok {
+		return fmt.Errorf("rename not supported by the upper filesystem")
+	}
+	oldp, err := o.resolve(oldpath, false)
+	if err != nil {
+		return err
+	}
+	newp, err := o.resolve(newpath, false)
+	if err != nil {
+		return err
+	}
+	fi, _, err := o.lstat(oldp)
+	if err != nil {
+		return err
+	}
+	_, baseErr := o.baseLstat(oldp)
+	if fi.IsDir() && baseErr == nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	if err := o.copyUp(oldp); err != nil {
+		return err
+	}
+	if err := o.copyUpParents(newp); err != nil {
+		return err
+	}
+	if err := rfs.Rename(oldp, newp); err != nil {
+		return err
+	}
+	o.created(newp, fi.IsDir())
+	if baseErr == nil {
+		o.mu.Lock()
+		o.whiteouts[oldp] = true
+		o.mu.Unlock()
+	}
+	return nil
+}
+
+func (o *overlayFS) Chmod(name string, perm fs.FileMode) error {
+	p, err := o.prepareChange(name, true)
+	if err != nil {
+		return err
+	}
+	return o.upper.Chmod(p, perm)
+}
+
+func (o *overlayFS) Chown(name string, uid, gid int) error {
+	p, err := o.prepareChange(name, true)
+	if err != nil {
+		return err
+	}
+	return o.upper.Chown(p, uid, gid)
+}
+
+func (o *overlayFS) Lchtimes(name string, atime, mtime time.Time) error {
+	cfs, ok := o.upper.(ChtimesFS)
+	if !ok {
+		return fmt.Errorf("lchtimes not supported by the upper filesystem")
+	}
+	p, err := o.prepareChange(name, false)
+	if err != nil {
+		return err
+	}
+	return cfs.Lchtimes(p, atime, mtime)
+}
+
+func (o *overlayFS) SetXattr(name string, attr string, data []byte) error {
+	p, err := o.prepareChange(name, true)
+	if err != nil {
+		return err
+	}
+	return o.upper.SetXattr(p, attr, data)
+}
+
+func (o *overlayFS) GetXattr(name string, attr string) ([]byte, error) {
+	p, err := o.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	if o.inUpper(p) {
+		return o.upper.GetXattr(p, attr)
+	}
+	if _, err := o.baseLstat(p); err != nil {
+		return nil, err
+	}
+	if xfs, ok := o.base.(XattrFS); ok {
+		return xfs.GetXattr(p, attr)
+	}
+	return nil, os.ErrNotExist
+}
+
+func (o *overlayFS) RemoveXattr(name string, attr string) error {
+	p, err := o.prepareChange(name, true)
+	if err != nil {
+		return err
+	}
+	return o.upper.RemoveXattr(p, attr)
+}
+
+func (o *overlayFS) ListXattrs(name string) (map[string][]byte, error) {
+	p, err := o.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	if o.inUpper(p) {
+		return o.upper.ListXattrs(p)
+	}
+	if _, err := o.baseLstat(p); err != nil {
+		return nil, err
+	}
+	if xfs, ok := o.base.(XattrFS); ok {
+		return xfs.ListXattrs(p)
+	}
+	return map[string][]byte{}, nil
+}
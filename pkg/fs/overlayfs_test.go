@@ -0,0 +1,137 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testOverlayBase(t *testing.T) FullFS {
+	base := NewMemFS()
+	require.NoError(t, base.MkdirAll("etc/apk", 0o755))
+	require.NoError(t, base.WriteFile("etc/os-release", []byte("ID=base\n"), 0o644))
+	require.NoError(t, base.WriteFile("etc/apk/world", []byte("busybox\n"), 0o644))
+	require.NoError(t, base.MkdirAll("usr/lib", 0o755))
+	require.NoError(t, base.WriteFile("usr/lib/libc.so", []byte("libc"), 0o755))
+	require.NoError(t, base.Chown("usr/lib/libc.so", 0, 42))
+	require.NoError(t, base.Symlink("usr/lib", "lib"))
+	return base
+}
+
+func names(entries []fs.DirEntry) []string {
+	var result []string
+	for _, e := range entries {
+		result = append(result, e.Name())
+	}
+	return result
+}
+
+func TestOverlayFSCopyOnWrite(t *testing.T) {
+	base := testOverlayBase(t)
+	upper := NewMemFS()
+	o := NewOverlayFS(base, upper)
+
+	b, err := o.ReadFile("/etc/os-release")
+	require.NoError(t, err)
+	require.Equal(t, "ID=base\n", string(b), "reads should fall through to the base")
+
+	require.NoError(t, o.WriteFile("etc/os-release", []byte("ID=new\n"), 0o644))
+	b, err = o.ReadFile("etc/os-release")
+	require.NoError(t, err)
+	require.Equal(t, "ID=new\n", string(b))
+	b, err = base.ReadFile("etc/os-release")
+	require.NoError(t, err)
+	require.Equal(t, "ID=base\n", string(b), "the base should not be written to")
+	_, err = upper.Stat("etc/apk/world")
+	require.ErrorIs(t, err, fs.ErrNotExist, "what was not changed should not be copied")
+
+	f, err := o.OpenFile("etc/apk/world", os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("apk-tools\n"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	b, err = upper.ReadFile("etc/apk/world")
+	require.NoError(t, err)
+	require.Equal(t, "busybox\napk-tools\n", string(b), "a changed file should be copied up first")
+
+	// writes through a symlink of the base end up where it links to
+	require.NoError(t, o.WriteFile("lib/libz.so", []byte("libz"), 0o755))
+	b, err = upper.ReadFile("usr/lib/libz.so")
+	require.NoError(t, err)
+	require.Equal(t, "libz", string(b))
+	_, err = upper.Lstat("lib")
+	require.ErrorIs(t, err, fs.ErrNotExist, "the symlink itself should not be copied")
+
+	require.NoError(t, o.Chmod("lib/libc.so", 0o700))
+	fi, err := upper.Stat("usr/lib/libc.so")
+	require.NoError(t, err)
+	require.Equal(t, fs.FileMode(0o700), fi.Mode().Perm())
+	uid, gid, ok := fileOwner(fi)
+	require.True(t, ok)
+	require.Equal(t, []int{0, 42}, []int{uid, gid}, "the owner should be copied up")
+
+	entries, err := o.ReadDir("usr/lib")
+	require.NoError(t, err)
+	require.Equal(t, []string{"libc.so", "libz.so"}, names(entries))
+}
+
+func TestOverlayFSWhiteouts(t *testing.T) {
+	base := testOverlayBase(t)
+	o := NewOverlayFS(base, NewMemFS())
+
+	require.NoError(t, o.Remove("etc/os-release"))
+	_, err := o.Stat("etc/os-release")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	entries, err := o.ReadDir("etc")
+	require.NoError(t, err)
+	require.Equal(t, []string{"apk"}, names(entries))
+	require.Equal(t, []string{"etc/os-release"}, o.Whiteouts())
+	_, err = base.Stat("etc/os-release")
+	require.NoError(t, err, "the base should not be changed")
+
+	// a file that is created again replaces the whiteout
+	require.NoError(t, o.WriteFile("etc/os-release", []byte("ID=new\n"), 0o644))
+	require.Empty(t, o.Whiteouts())
+	require.NoError(t, o.Remove("etc/os-release"))
+	require.Equal(t, []string{"etc/os-release"}, o.Whiteouts())
+
+	require.Error(t, o.Remove("etc/apk"), "a directory that is not empty should not be removed")
+	require.NoError(t, o.Remove("etc/apk/world"))
+	require.NoError(t, o.Remove("etc/apk"))
+	require.Equal(t, []string{"etc/apk", "etc/os-release"}, o.Whiteouts(), "the whiteout of a directory covers what was in it")
+
+	require.NoError(t, o.MkdirAll("etc/apk", 0o755))
+	require.Equal(t, []string{"etc/apk"}, o.OpaqueDirs())
+	entries, err = o.ReadDir("etc/apk")
+	require.NoError(t, err)
+	require.Empty(t, entries, "what was in the base should not be seen in a directory that was created again")
+	_, err = o.Stat("etc/apk/world")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	err = o.(RenameFS).Rename("usr/lib", "usr/lib64")
+	require.True(t, errors.Is(err, syscall.EXDEV), "renaming a directory of the base should fail, got %v", err)
+	require.NoError(t, o.(RenameFS).Rename("usr/lib/libc.so", "usr/lib/libc.so.1"))
+	require.Contains(t, o.Whiteouts(), filepath.Join("usr", "lib", "libc.so"))
+	b, err := o.ReadFile("lib/libc.so.1")
+	require.NoError(t, err)
+	require.Equal(t, "libc", string(b))
+}
@@ -0,0 +1,78 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+type rootFSOpts struct {
+	skipChown bool
+	mkdir     bool
+}
+
+// RootFSOption is an option for RootFS
+type RootFSOption func(*rootFSOpts) error
+
+// RootFSWithoutChown makes Chown and Lchown do nothing, even as root. Without it, they only do
+// nothing when a user that is not root is not allowed to change the owner of files, which are
+// then owned by that user.
+func RootFSWithoutChown() RootFSOption {
+	return func(opts *rootFSOpts) error {
+		opts.skipChown = true
+		return nil
+	}
+}
+
+// RootFSWithCreateDir creates the directory of a RootFS if it does not exist.
+func RootFSWithCreateDir() RootFSOption {
+	return func(opts *rootFSOpts) error {
+		opts.mkdir = true
+		return nil
+	}
+}
+
+// RootFS returns a FullFS that is the directory dir on disk, for installing into a real root
+// filesystem. Unlike DirFS, nothing is kept in memory: owners, modes including the setuid,
+// setgid and sticky bits, device nodes, modification times and xattrs are all those of the
+// files on disk. Paths are resolved as if dir were the root, so neither ".." nor symlinks,
+// absolute or relative, lead outside of it.
+func RootFS(dir string, opts ...RootFSOption) (MetadataFS, error) {
+	var options rootFSOpts
+	for _, opt := range opts {
+		if err := opt(&options); err != nil {
+			return nil, err
+		}
+	}
+	base, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get absolute path of %s: %w", dir, err)
+	}
+	fi, err := os.Stat(base)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && options.mkdir:
+		if err := os.MkdirAll(base, 0o755); err != nil {
+			return nil, fmt.Errorf("unable to create root directory %s: %w", base, err)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("unable to use root directory %s: %w", base, err)
+	case !fi.IsDir():
+		return nil, fmt.Errorf("root directory %s is not a directory", base)
+	}
+	return newRootFS(base, options)
+}
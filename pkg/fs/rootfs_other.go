@@ -0,0 +1,29 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !unix
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// newRootFS fails, as the owners, modes and device nodes of a root cannot be kept on disk on
+// this platform. DirFS keeps them in memory instead.
+func newRootFS(base string, _ rootFSOpts) (MetadataFS, error) {
+	return nil, fmt.Errorf("unable to use root directory %s on %s: %w", base, runtime.GOOS, errors.ErrUnsupported)
+}
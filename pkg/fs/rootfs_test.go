@@ -0,0 +1,175 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package fs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestRootFSMissingDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "root")
+	_, err := RootFS(dir)
+	require.Error(t, err)
+
+	rfs, err := RootFS(dir, RootFSWithCreateDir())
+	require.NoError(t, err)
+	require.NoError(t, rfs.WriteFile("hello", []byte("world"), 0o644))
+	b, err := os.ReadFile(filepath.Join(dir, "hello"))
+	require.NoError(t, err)
+	require.Equal(t, "world", string(b))
+}
+
+func TestRootFSTraversal(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "root")
+	require.NoError(t, os.Mkdir(dir, 0o755))
+	rfs, err := RootFS(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, rfs.MkdirAll("etc", 0o755))
+	require.NoError(t, rfs.Symlink("/", "etc/abs"))
+	require.NoError(t, rfs.Symlink("../../..", "etc/rel"))
+	require.NoError(t, rfs.Symlink("loop", "loop"))
+
+	for _, name := range []string{
+		"../escaped",
+		"/../../escaped",
+		"etc/abs/escaped",
+		"etc/abs/../escaped",
+		"etc/rel/escaped",
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, rfs.WriteFile(name, []byte(name), 0o644))
+			b, err := os.ReadFile(filepath.Join(dir, "escaped"))
+			require.NoError(t, err, "file should be written in the root")
+			require.Equal(t, name, string(b))
+			_, err = os.Stat(filepath.Join(parent, "escaped"))
+			require.ErrorIs(t, err, os.ErrNotExist, "file should not be written outside of the root")
+			require.NoError(t, rfs.Remove("escaped"))
+		})
+	}
+
+	target, err := rfs.Readlink("etc/abs")
+	require.NoError(t, err)
+	require.Equal(t, "/", target, "symlink target should be kept as it is")
+
+	_, err = rfs.Stat("loop")
+	require.True(t, errors.Is(err, syscall.ELOOP), "expected ELOOP, got %v", err)
+}
+
+func TestRootFSMetadata(t *testing.T) {
+	dir := t.TempDir()
+	rfs, err := RootFS(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, rfs.WriteFile("suid", nil, 0o755))
+	require.NoError(t, rfs.Chmod("suid", 0o755|fs.ModeSetuid|fs.ModeSetgid))
+	require.NoError(t, rfs.Mkdir("tmp", 0o755))
+	require.NoError(t, rfs.Chmod("tmp", 0o777|fs.ModeDir|fs.ModeSticky))
+
+	fi, err := os.Stat(filepath.Join(dir, "suid"))
+	require.NoError(t, err)
+	require.Equal(t, 0o755|fs.ModeSetuid|fs.ModeSetgid, fi.Mode())
+	fi, err = rfs.Stat("tmp")
+	require.NoError(t, err)
+	require.Equal(t, 0o777|fs.ModeDir|fs.ModeSticky, fi.Mode())
+
+	mtime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, rfs.Symlink("suid", "link"))
+	require.NoError(t, rfs.Lchtimes("link", mtime, mtime))
+	fi, err = rfs.Lstat("link")
+	require.NoError(t, err)
+	require.True(t, fi.ModTime().Equal(mtime), "symlink should have mtime %s, has %s", mtime, fi.ModTime())
+	fi, err = rfs.Stat("link")
+	require.NoError(t, err)
+	require.False(t, fi.ModTime().Equal(mtime), "symlink target should keep its mtime")
+
+	// creating device nodes needs privileges
+	if err := rfs.Mknod("null", unix.S_IFCHR|0o666, int(unix.Mkdev(1, 3))); err == nil {
+		dev, err := rfs.Readnod("null")
+		require.NoError(t, err)
+		require.Equal(t, int(unix.Mkdev(1, 3)), dev)
+	}
+
+	_, err = rfs.(LxattrFS).LListXattrs("link")
+	require.NoError(t, err, "the xattrs of a symlink itself should be listed")
+
+	err = rfs.SetXattr("suid", "user.test", []byte("value"))
+	if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) {
+		t.Skipf("xattrs are not supported: %v", err)
+	}
+	require.NoError(t, err)
+	xattrs, err := rfs.ListXattrs("suid")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), xattrs["user.test"])
+	require.NoError(t, rfs.RemoveXattr("suid", "user.test"))
+	_, err = rfs.GetXattr("suid", "user.test")
+	require.Error(t, err)
+}
+
+func TestRootFSRenameAndLock(t *testing.T) {
+	dir := t.TempDir()
+	rfs, err := RootFS(dir)
+	require.NoError(t, err)
+	require.NoError(t, rfs.Symlink("/", "abs"))
+	require.NoError(t, rfs.WriteFile("installed.tmp", []byte("new"), 0o644))
+
+	require.NoError(t, rfs.(RenameFS).Rename("installed.tmp", "abs/installed"))
+	b, err := os.ReadFile(filepath.Join(dir, "installed"))
+	require.NoError(t, err, "the rename should stay in the root")
+	require.Equal(t, "new", string(b))
+
+	unlock, err := rfs.(LockFS).TryLock("lock")
+	require.NoError(t, err)
+	other, err := RootFS(dir)
+	require.NoError(t, err)
+	_, err = other.(LockFS).TryLock("lock")
+	require.ErrorIs(t, err, ErrLocked)
+	require.NoError(t, unlock())
+}
+
+func TestRootFSWithoutChown(t *testing.T) {
+	dir := t.TempDir()
+	rfs, err := RootFS(dir, RootFSWithoutChown())
+	require.NoError(t, err)
+	require.NoError(t, rfs.WriteFile("file", nil, 0o644))
+	require.NoError(t, rfs.Lchown("file", 1234, 1234))
+
+	var st unix.Stat_t
+	require.NoError(t, unix.Lstat(filepath.Join(dir, "file"), &st))
+	require.Equal(t, uint32(os.Getuid()), st.Uid, "owner should not change")
+}
+
+func TestRootFSChownWithoutRoot(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("the owner of files can be changed as root")
+	}
+	rfs, err := RootFS(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, rfs.WriteFile("file", nil, 0o644))
+	require.NoError(t, rfs.Chown("file", 1234, 1234), "changing the owner should be skipped when it is not allowed")
+	require.NoError(t, rfs.Lchown("file", 1234, 1234))
+}
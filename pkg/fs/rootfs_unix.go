@@ -0,0 +1,418 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSymlinks is how many symlinks are followed resolving one path, like the kernel's limit.
+const maxSymlinks = 255
+
+func newRootFS(base string, options rootFSOpts) (MetadataFS, error) {
+	return &rootFS{base: base, chown: !options.skipChown}, nil
+}
+
+type rootFS struct {
+	base  string
+	chown bool
+}
+
+// resolve returns the path on disk of name, following its symlinks within the root. If
+// followLast is false, the last element is not followed if it is a symlink, as for Lstat.
+func (f *rootFS) resolve(name string, followLast bool) (string, error) {
+	var (
+		resolved []string
+		links    int
+	)
+	pending := strings.Split(filepath.ToSlash(name), "/")
+	for len(pending) > 0 {
+		elem := pending[0]
+		pending = pending[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			// the parent of the root is the root
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+		resolved = append(resolved, elem)
+		if len(pending) == 0 && !followLast {
+			break
+		}
+		p := filepath.Join(append([]string{f.base}, resolved...)...)
+		fi, err := os.Lstat(p)
+		if err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+			// anything that does not exist yet is created where it is named
+			continue
+		}
+		links++
+		if links > maxSymlinks {
+			return "", &fs.PathError{Op: "resolve", Path: name, Err: syscall.ELOOP}
+		}
+		target, err := os.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+		resolved = resolved[:len(resolved)-1]
+		if filepath.IsAbs(target) {
+			resolved = nil
+		}
+		pending = append(strings.Split(filepath.ToSlash(target), "/"), pending...)
+	}
+	return filepath.Join(append([]string{f.base}, resolved...)...), nil
+}
+
+func (f *rootFS) Mkdir(name string, perm fs.FileMode) error {
+	p, err := f.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(p, perm)
+}
+
+func (f *rootFS) MkdirAll(name string, perm fs.FileMode) error {
+	p, err := f.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, perm)
+}
+
+func (f *rootFS) Open(name string) (fs.File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (f *rootFS) OpenReaderAt(name string) (File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (f *rootFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	p, err := f.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, flag, perm)
+}
+
+func (f *rootFS) Create(name string) (File, error) {
+	return f.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+}
+
+func (f *rootFS) ReadFile(name string) ([]byte, error) {
+	p, err := f.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
+func (f *rootFS) WriteFile(name string, b []byte, mode fs.FileMode) error {
+	p, err := f.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, b, mode)
+}
+
+func (f *rootFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := f.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(p)
+}
+
+func (f *rootFS) Mknod(name string, mode uint32, dev int) error {
+	p, err := f.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	if err := unix.Mknod(p, mode, mknodDev(dev)); err != nil {
+		return &fs.PathError{Op: "mknod", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (f *rootFS) Readnod(name string) (dev int, err error) {
+	p, err := f.resolve(name, false)
+	if err != nil {
+		return 0, err
+	}
+	var st unix.Stat_t
+	if err := unix.Lstat(p, &st); err != nil {
+		return 0, &fs.PathError{Op: "readnod", Path: name, Err: err}
+	}
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFCHR, unix.S_IFBLK, unix.S_IFIFO, unix.S_IFSOCK:
+		return int(st.Rdev), nil
+	}
+	return 0, fmt.Errorf("not a device")
+}
+
+func (f *rootFS) Symlink(oldname, newname string) error {
+	// The target is kept as it is, it is resolved within the root when it is followed.
+	p, err := f.resolve(newname, false)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(oldname, p)
+}
+
+func (f *rootFS) Link(oldname, newname string) error {
+	target, err := f.resolve(oldname, false)
+	if err != nil {
+		return err
+	}
+	p, err := f.resolve(newname, false)
+	if err != nil {
+		return err
+	}
+	return os.Link(target, p)
+}
+
+func (f *rootFS) Readlink(name string) (string, error) {
+	p, err := f.resolve(name, false)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(p)
+}
+
+func (f *rootFS) Stat(name string) (fs.FileInfo, error) {
+	p, err := f.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (f *rootFS) Lstat(name string) (fs.FileInfo, error) {
+	p, err := f.resolve(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(p)
+}
+
+func (f *rootFS) Remove(name string) error {
+	p, err := f.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (f *rootFS) Chmod(name string, perm fs.FileMode) error {
+	p, err := f.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(p, perm)
+}
+
+func (f *rootFS) Chown(name string, uid, gid int) error {
+	if !f.chown {
+		return nil
+	}
+	p, err := f.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	return chownError(os.Chown(p, uid, gid))
+}
+
+func (f *rootFS) Lchown(name string, uid, gid int) error {
+	if !f.chown {
+		return nil
+	}
+	p, err := f.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	return chownError(os.Lchown(p, uid, gid))
+}
+
+// chownError ignores that the owner could not be changed when not running as root, as only
+// root may give files to someone else. The files are then owned by the user, like they are
+// with RootFSWithoutChown.
+func chownError(err error) error {
+	if errors.Is(err, fs.ErrPermission) && os.Geteuid() != 0 {
+		return nil
+	}
+	return err
+}
+
+func (f *rootFS) Lchtimes(name string, atime, mtime time.Time) error {
+	p, err := f.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, p, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &fs.PathError{Op: "lchtimes", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (f *rootFS) Rename(oldpath, newpath string) error {
+	oldp, err := f.resolve(oldpath, false)
+	if err != nil {
+		return err
+	}
+	newp, err := f.resolve(newpath, false)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldp, newp)
+}
+
+func (f *rootFS) TryLock(path string) (func() error, error) {
+	p, err := f.resolve(path, true)
+	if err != nil {
+		return nil, err
+	}
+	return lockFile(path, p)
+}
+
+// The xattrs are those of the file that name resolves to, which is never a symlink, and for
+// the L variants those of name itself, which may be.
+
+func (f *rootFS) SetXattr(name string, attr string, data []byte) error {
+	return f.setXattr(name, true, attr, data)
+}
+
+func (f *rootFS) GetXattr(name string, attr string) ([]byte, error) {
+	return f.getXattr(name, true, attr)
+}
+
+func (f *rootFS) RemoveXattr(name string, attr string) error {
+	return f.removeXattr(name, true, attr)
+}
+
+func (f *rootFS) ListXattrs(name string) (map[string][]byte, error) {
+	return f.listXattrs(name, true)
+}
+
+func (f *rootFS) LSetXattr(name string, attr string, data []byte) error {
+	return f.setXattr(name, false, attr, data)
+}
+
+func (f *rootFS) LGetXattr(name string, attr string) ([]byte, error) {
+	return f.getXattr(name, false, attr)
+}
+
+func (f *rootFS) LRemoveXattr(name string, attr string) error {
+	return f.removeXattr(name, false, attr)
+}
+
+func (f *rootFS) LListXattrs(name string) (map[string][]byte, error) {
+	return f.listXattrs(name, false)
+}
+
+func (f *rootFS) setXattr(name string, followLast bool, attr string, data []byte) error {
+	p, err := f.resolve(name, followLast)
+	if err != nil {
+		return err
+	}
+	if err := unix.Lsetxattr(p, attr, data, 0); err != nil {
+		return &fs.PathError{Op: "setxattr", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (f *rootFS) getXattr(name string, followLast bool, attr string) ([]byte, error) {
+	p, err := f.resolve(name, followLast)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		size, err := unix.Lgetxattr(p, attr, nil)
+		if err != nil {
+			return nil, &fs.PathError{Op: "getxattr", Path: name, Err: err}
+		}
+		b := make([]byte, size)
+		n, err := unix.Lgetxattr(p, attr, b)
+		if errors.Is(err, unix.ERANGE) {
+			// it grew in between
+			continue
+		}
+		if err != nil {
+			return nil, &fs.PathError{Op: "getxattr", Path: name, Err: err}
+		}
+		return b[:n], nil
+	}
+}
+
+func (f *rootFS) removeXattr(name string, followLast bool, attr string) error {
+	p, err := f.resolve(name, followLast)
+	if err != nil {
+		return err
+	}
+	if err := unix.Lremovexattr(p, attr); err != nil {
+		return &fs.PathError{Op: "removexattr", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (f *rootFS) listXattrs(name string, followLast bool) (map[string][]byte, error) {
+	p, err := f.resolve(name, followLast)
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	for {
+		size, err := unix.Llistxattr(p, nil)
+		if err != nil {
+			return nil, &fs.PathError{Op: "listxattr", Path: name, Err: err}
+		}
+		b = make([]byte, size)
+		n, err := unix.Llistxattr(p, b)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, &fs.PathError{Op: "listxattr", Path: name, Err: err}
+		}
+		b = b[:n]
+		break
+	}
+	xattrs := map[string][]byte{}
+	for _, attr := range strings.Split(string(b), "\x00") {
+		if attr == "" {
+			continue
+		}
+		v, err := f.getXattr(name, followLast, attr)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[attr] = v
+	}
+	return xattrs, nil
+}
@@ -15,6 +15,7 @@
 package fs
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
@@ -22,10 +23,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
-
-	"golang.org/x/sys/unix"
 )
 
 type dirFSOpts struct {
@@ -144,20 +142,12 @@ func DirFS(dir string, opts ...DirFSOption) FullFS {
 			if err != nil {
 				err = f.overrides.Symlink(target, path)
 			}
-		case fs.ModeCharDevice:
-			var dev int
-			sys := fi.Sys()
-			st1, ok1 := sys.(*syscall.Stat_t)
-			st2, ok2 := sys.(*unix.Stat_t)
-			switch {
-			case ok1:
-				dev = int(st1.Rdev)
-			case ok2:
-				dev = int(st2.Rdev)
-			default:
-				return fmt.Errorf("unsupported type %T", sys)
+		case fs.ModeDevice | fs.ModeCharDevice, fs.ModeDevice, fs.ModeNamedPipe, fs.ModeSocket:
+			dev, ok := statRdev(fi.Sys())
+			if !ok {
+				return fmt.Errorf("unsupported type %T", fi.Sys())
 			}
-			err = f.overrides.Mknod(path, uint32(unix.S_IFCHR|mode), dev)
+			err = f.overrides.Mknod(path, MknodMode(mode), dev)
 		default:
 			var memFile File
 			memFile, err = f.overrides.OpenFile(path, os.O_CREATE, perm)
@@ -361,6 +351,11 @@ func (f *dirFS) Remove(name string) error {
 	return nil
 }
 
+// Sub returns the subtree at dir, like Sub does without options.
+func (f *dirFS) Sub(dir string) (fs.FS, error) {
+	return Sub(f, dir)
+}
+
 func (f *dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
 	// get those on disk
 	var (
@@ -503,9 +498,88 @@ func (f *dirFS) Chown(path string, uid, gid int) error {
 	return f.overrides.Chown(path, uid, gid)
 }
 
+func (f *dirFS) Lchtimes(path string, atime, mtime time.Time) error {
+	if f.caseSensitiveOnDisk(path) {
+		// ignore error, as we track it in memory anyways
+		_ = lchtimes(filepath.Join(f.base, path), atime, mtime)
+	}
+	if cfs, ok := f.overrides.(ChtimesFS); ok {
+		return cfs.Lchtimes(path, atime, mtime)
+	}
+	return nil
+}
+
+func (f *dirFS) Rename(oldpath, newpath string) error {
+	rfs, ok := f.overrides.(RenameFS)
+	if !ok {
+		return fmt.Errorf("unable to rename %s to %s: not supported", oldpath, newpath)
+	}
+	oldOnDisk := f.caseSensitiveOnDisk(oldpath)
+	newOnDisk := f.createOnDisk(newpath)
+	switch {
+	case oldOnDisk && newOnDisk:
+		if err := os.Rename(filepath.Join(f.base, oldpath), filepath.Join(f.base, newpath)); err != nil {
+			return err
+		}
+		f.removeOnDisk(oldpath)
+	case oldOnDisk:
+		// another variant of newpath is on disk, so the content moves to memory
+		b, err := os.ReadFile(filepath.Join(f.base, oldpath))
+		if err != nil {
+			return err
+		}
+		if err := writeContent(f.overrides, oldpath, b); err != nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(f.base, oldpath)); err != nil {
+			return err
+		}
+		f.removeOnDisk(oldpath)
+	case newOnDisk:
+		b, err := f.overrides.ReadFile(oldpath)
+		if err != nil {
+			return err
+		}
+		fi, err := f.overrides.Stat(oldpath)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(f.base, newpath), b, fi.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return rfs.Rename(oldpath, newpath)
+}
+
+// writeContent replaces the content of the file at name in fsys, keeping its mode.
+func writeContent(fsys FullFS, name string, b []byte) error {
+	file, err := fsys.OpenFile(name, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(b); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// TryLock locks the file on disk, which it also creates in memory so that it is listed like
+// the other files.
+func (f *dirFS) TryLock(path string) (func() error, error) {
+	if _, err := f.overrides.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		file, err := f.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		_ = file.Close()
+	}
+	return lockFile(path, filepath.Join(f.base, path))
+}
+
 func (f *dirFS) Mknod(name string, mode uint32, dev int) error {
 	if f.caseSensitiveOnDisk(name) {
-		err := unix.Mknod(filepath.Join(f.base, name), mode, dev)
+		err := mknod(filepath.Join(f.base, name), mode, dev)
 		// what if we could not create it? Just create a regular file there, and memory will override
 		if err != nil {
 			if err := os.WriteFile(filepath.Join(f.base, name), nil, 0); err != nil {
@@ -516,20 +590,77 @@ func (f *dirFS) Mknod(name string, mode uint32, dev int) error {
 	return f.overrides.Mknod(name, mode, dev)
 }
 
+// The setuid, setgid and sticky bits of the mode of Mknod, which are the same everywhere.
+const (
+	modeSetuid = 0o4000
+	modeSetgid = 0o2000
+	modeSticky = 0o1000
+)
+
+// MknodMode returns the mode to pass to Mknod for a node of the type and permissions of mode,
+// including its setuid, setgid and sticky bits.
+func MknodMode(mode fs.FileMode) uint32 {
+	perm := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		perm |= modeSetuid
+	}
+	if mode&fs.ModeSetgid != 0 {
+		perm |= modeSetgid
+	}
+	if mode&fs.ModeSticky != 0 {
+		perm |= modeSticky
+	}
+	switch {
+	case mode&fs.ModeCharDevice != 0:
+		return modeChar | perm
+	case mode&fs.ModeDevice != 0:
+		return modeBlock | perm
+	case mode&fs.ModeNamedPipe != 0:
+		return modeFIFO | perm
+	case mode&fs.ModeSocket != 0:
+		return modeSocket | perm
+	}
+	return perm
+}
+
 func (f *dirFS) SetXattr(path string, attr string, data []byte) error {
-	// the underlying filesystem might or might not support xattrs
+	// the underlying filesystem might or might not support xattrs, so ignore errors on disk,
 	// but we have info on every file in memory, so might as well store it there.
+	if f.caseSensitiveOnDisk(path) {
+		_ = lsetxattr(filepath.Join(f.base, path), attr, data)
+	}
 	return f.overrides.SetXattr(path, attr, data)
 }
 func (f *dirFS) GetXattr(path string, attr string) ([]byte, error) {
 	return f.overrides.GetXattr(path, attr)
 }
 func (f *dirFS) RemoveXattr(path string, attr string) error {
+	if f.caseSensitiveOnDisk(path) {
+		_ = lremovexattr(filepath.Join(f.base, path), attr)
+	}
 	return f.overrides.RemoveXattr(path, attr)
 }
 func (f *dirFS) ListXattrs(path string) (map[string][]byte, error) {
 	return f.overrides.ListXattrs(path)
 }
+func (f *dirFS) LSetXattr(path string, attr string, data []byte) error {
+	if f.caseSensitiveOnDisk(path) {
+		_ = lsetxattr(filepath.Join(f.base, path), attr, data)
+	}
+	return f.overrides.(LxattrFS).LSetXattr(path, attr, data)
+}
+func (f *dirFS) LGetXattr(path string, attr string) ([]byte, error) {
+	return f.overrides.(LxattrFS).LGetXattr(path, attr)
+}
+func (f *dirFS) LRemoveXattr(path string, attr string) error {
+	if f.caseSensitiveOnDisk(path) {
+		_ = lremovexattr(filepath.Join(f.base, path), attr)
+	}
+	return f.overrides.(LxattrFS).LRemoveXattr(path, attr)
+}
+func (f *dirFS) LListXattrs(path string) (map[string][]byte, error) {
+	return f.overrides.(LxattrFS).LListXattrs(path)
+}
 
 // sanitize ensures that we never go beyond the root of the filesystem
 func (f *dirFS) sanitizePath(p string) (v string, err error) {
@@ -635,6 +766,20 @@ func (f *fileInfo) Sys() interface{} {
 	return f.mem.Sys()
 }
 
+// Ino and Nlink are those of the file in memory, whose links are kept like those on disk.
+func (f *fileInfo) Ino() uint64 {
+	if hi, ok := f.mem.(HardlinkInfo); ok {
+		return hi.Ino()
+	}
+	return 0
+}
+func (f *fileInfo) Nlink() uint64 {
+	if hi, ok := f.mem.(HardlinkInfo); ok {
+		return hi.Nlink()
+	}
+	return 1
+}
+
 type dirEntry struct {
 	disk fs.DirEntry
 	mem  fs.DirEntry
@@ -15,6 +15,7 @@
 package fs
 
 import (
+	"archive/tar"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -195,3 +196,46 @@ func TestDirFSConsistentOrdering(t *testing.T) {
 	}
 	// all results should be the same
 }
+
+func TestDirFSRename(t *testing.T) {
+	dir := t.TempDir()
+	f := DirFS(dir)
+	rfs, ok := f.(RenameFS)
+	require.True(t, ok, "DirFS should rename")
+	require.NoError(t, f.MkdirAll("etc", 0o755))
+	require.NoError(t, f.WriteFile("etc/world", []byte("old"), 0o644))
+	require.NoError(t, f.WriteFile("etc/world.tmp", []byte("new"), 0o644))
+	require.NoError(t, f.Chown("etc/world.tmp", 1234, 1234))
+
+	require.NoError(t, rfs.Rename("etc/world.tmp", "etc/world"))
+	b, err := os.ReadFile(filepath.Join(dir, "etc", "world"))
+	require.NoError(t, err)
+	require.Equal(t, "new", string(b))
+	_, err = os.Stat(filepath.Join(dir, "etc", "world.tmp"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = f.Stat("etc/world.tmp")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	fi, err := f.Stat("etc/world")
+	require.NoError(t, err)
+	require.Equal(t, 1234, int(fi.Sys().(*tar.Header).Uid), "the owner in memory should move with the file")
+}
+
+func TestDirFSTryLock(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "lib", "apk", "db"), 0o755))
+	a, ok := DirFS(dir).(LockFS)
+	require.True(t, ok, "DirFS should lock")
+	b := DirFS(dir).(LockFS)
+
+	unlock, err := a.TryLock("lib/apk/db/lock")
+	require.NoError(t, err)
+	_, err = b.TryLock("lib/apk/db/lock")
+	require.ErrorIs(t, err, ErrLocked, "the lock should be held across filesystems")
+	require.NoError(t, unlock())
+
+	unlock, err = b.TryLock("lib/apk/db/lock")
+	require.NoError(t, err, "the lock should be released")
+	require.NoError(t, unlock())
+	_, err = os.Stat(filepath.Join(dir, "lib", "apk", "db", "lock"))
+	require.NoError(t, err, "the lock file should be kept, like apk does")
+}
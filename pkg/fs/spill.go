@@ -0,0 +1,163 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// defaultSpillThreshold is the size above which the content of a file is spilled to disk, when
+// only WithSpillDir is given.
+const defaultSpillThreshold = 8 << 20
+
+// MemFSOption is an option for NewMemFS.
+type MemFSOption func(*memFS)
+
+// WithSpillDir keeps the content of files that grow larger than the spill threshold in
+// temporary files under dir, rather than in memory. The files are removed as soon as they are
+// created, so that nothing is left behind, and their space is freed by Close.
+func WithSpillDir(dir string) MemFSOption {
+	return func(m *memFS) {
+		m.spillDir = dir
+		if m.spillThreshold == 0 {
+			m.spillThreshold = defaultSpillThreshold
+		}
+	}
+}
+
+// WithSpillThreshold sets the size in bytes above which the content of a file is spilled to
+// disk, in the directory of WithSpillDir or else the default directory for temporary files.
+// 0, the default, keeps all of it in memory unless WithSpillDir is given.
+func WithSpillThreshold(n int64) MemFSOption {
+	return func(m *memFS) {
+		m.spillThreshold = n
+	}
+}
+
+// Close frees the space of the content that was spilled to disk. The memFS must not be used
+// after it is closed.
+func (m *memFS) Close() error {
+	m.spillMu.Lock()
+	defer m.spillMu.Unlock()
+	var errs []error
+	for f := range m.spilled {
+		errs = append(errs, f.Close())
+	}
+	m.spilled = nil
+	return errors.Join(errs...)
+}
+
+// spill returns a temporary file that holds data, which is then kept until Close.
+func (m *memFS) spill(data []byte) (*os.File, error) {
+	f, err := os.CreateTemp(m.spillDir, "memfs-")
+	if err != nil {
+		return nil, err
+	}
+	// only the descriptor keeps it, so it is gone even if Close is never called
+	if err := os.Remove(f.Name()); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	m.spillMu.Lock()
+	defer m.spillMu.Unlock()
+	if m.spilled == nil {
+		m.spilled = map[*os.File]bool{}
+	}
+	m.spilled[f] = true
+	return f, nil
+}
+
+// unspill frees f, when the file it held the content of is truncated.
+func (m *memFS) unspill(f *os.File) {
+	m.spillMu.Lock()
+	defer m.spillMu.Unlock()
+	if m.spilled[f] {
+		delete(m.spilled, f)
+		_ = f.Close()
+	}
+}
+
+// size returns the size of the content of n.
+func (n *node) size() int64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.spill != nil {
+		return n.spillSize
+	}
+	return int64(len(n.data))
+}
+
+// readAt reads the content of n at off, from memory or from where it was spilled to.
+func (n *node) readAt(p []byte, off int64) (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.spill == nil {
+		if off >= int64(len(n.data)) {
+			return 0, io.EOF
+		}
+		return copy(p, n.data[off:]), nil
+	}
+	if off >= n.spillSize {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > n.spillSize-off {
+		p = p[:n.spillSize-off]
+	}
+	return n.spill.ReadAt(p, off)
+}
+
+// writeAt writes p to the content of n at off, which is spilled to disk by m once it grows
+// larger than the spill threshold.
+func (n *node) writeAt(m *memFS, p []byte, off int64) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	end := off + int64(len(p))
+	if n.spill == nil && m.spillThreshold > 0 && end > m.spillThreshold {
+		f, err := m.spill(n.data)
+		if err != nil {
+			return err
+		}
+		n.spill, n.spillSize, n.data = f, int64(len(n.data)), nil
+	}
+	if n.spill != nil {
+		if _, err := n.spill.WriteAt(p, off); err != nil {
+			return err
+		}
+		n.spillSize = max(n.spillSize, end)
+		return nil
+	}
+	if end > int64(len(n.data)) {
+		n.data = append(n.data[:off], p...)
+	} else {
+		copy(n.data[off:], p)
+	}
+	return nil
+}
+
+// truncate empties the content of n.
+func (n *node) truncate(m *memFS) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.spill != nil {
+		m.unspill(n.spill)
+	}
+	n.data, n.spill, n.spillSize = nil, nil, 0
+}
@@ -0,0 +1,134 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemFSSpill(t *testing.T) {
+	dir := t.TempDir()
+	m := NewMemFS(WithSpillDir(dir), WithSpillThreshold(16))
+	mfs := m.(*memFS)
+	big := strings.Repeat("0123456789", 10)
+
+	require.NoError(t, m.WriteFile("small", []byte("hello"), 0o644))
+	require.NoError(t, m.WriteFile("big", []byte(big), 0o644))
+	small, err := mfs.getNode("small")
+	require.NoError(t, err)
+	require.Nil(t, small.spill, "a file below the threshold should be kept in memory")
+	bigNode, err := mfs.getNode("big")
+	require.NoError(t, err)
+	require.NotNil(t, bigNode.spill, "a file above the threshold should be spilled to disk")
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries, "spilled files should not be left in the directory")
+
+	b, err := m.ReadFile("big")
+	require.NoError(t, err)
+	require.Equal(t, big, string(b))
+	fi, err := m.Stat("big")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(big)), fi.Size())
+	rf, err := m.Open("big")
+	require.NoError(t, err)
+	b, err = io.ReadAll(rf)
+	require.NoError(t, err)
+	require.Equal(t, big, string(b), "a spilled file should be read like any other")
+	require.NoError(t, rf.Close())
+
+	f, err := m.OpenReaderAt("big")
+	require.NoError(t, err)
+	p := make([]byte, 5)
+	n, err := f.ReadAt(p, 95)
+	require.NoError(t, err)
+	require.Equal(t, "56789", string(p[:n]))
+	require.NoError(t, f.Close())
+
+	// growing a file in memory spills it once it is above the threshold
+	f, err = m.OpenFile("small", os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte(big))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NotNil(t, small.spill)
+	b, err = m.ReadFile("small")
+	require.NoError(t, err)
+	require.Equal(t, "hello"+big, string(b))
+
+	require.NoError(t, m.Link("big", "link"))
+	require.NoError(t, m.WriteFile("link", []byte("short"), 0o644))
+	require.Nil(t, bigNode.spill, "a truncated file should be back in memory")
+	b, err = m.ReadFile("big")
+	require.NoError(t, err)
+	require.Equal(t, "short", string(b), "hardlinks should share the spilled content")
+
+	// the spilled content is freed with the last name of the file
+	require.NoError(t, m.WriteFile("big", []byte(big), 0o644))
+	require.NoError(t, m.Remove("link"))
+	require.NotNil(t, bigNode.spill, "the content should be kept for the other name")
+	require.NoError(t, m.Remove("big"))
+	require.Nil(t, bigNode.spill, "the content should be freed with the last name")
+	require.NoError(t, m.MkdirAll("dir/sub", 0o755))
+	require.NoError(t, m.WriteFile("dir/sub/big", []byte(big), 0o644))
+	require.NoError(t, mfs.Rename("small", "dir/small"))
+	require.NoError(t, m.Remove("dir"))
+	require.Empty(t, mfs.spilled, "what is below a removed directory should be freed")
+
+	require.NoError(t, m.WriteFile("big", []byte(big), 0o644))
+	require.NoError(t, m.(io.Closer).Close())
+	require.Empty(t, mfs.spilled)
+}
+
+// BenchmarkMemFSSpill writes 1GiB of files, and reports how much of the heap is in use after.
+// Without spilling, it is all of it.
+func BenchmarkMemFSSpill(b *testing.B) {
+	const (
+		files    = 16
+		fileSize = 64 << 20
+	)
+	chunk := bytes.Repeat([]byte{'x'}, 1<<20)
+	for i := 0; i < b.N; i++ {
+		m := NewMemFS(WithSpillDir(b.TempDir()))
+		for j := 0; j < files; j++ {
+			f, err := m.OpenFile(strings.Repeat("f", j+1), os.O_CREATE|os.O_WRONLY, 0o644)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for written := 0; written < fileSize; written += len(chunk) {
+				if _, err := f.Write(chunk); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := f.Close(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		runtime.GC()
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		b.ReportMetric(float64(stats.HeapInuse)/(1<<20), "heap-MiB")
+		if err := m.(io.Closer).Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
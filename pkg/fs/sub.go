@@ -0,0 +1,429 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrOutsideSubFS is what using a path of a filesystem of Sub with SubFSWithContainedSymlinks
+// fails with, when a symlink of it leads outside of the subtree.
+var ErrOutsideSubFS = errors.New("symlink leads outside of the sub filesystem")
+
+// SubFSOption is an option for Sub.
+type SubFSOption func(*subFS)
+
+// SubFSWithContainedSymlinks reports the symlinks that lead outside of the subtree with
+// ErrOutsideSubFS, rather than following them into the rest of the filesystem.
+func SubFSWithContainedSymlinks() SubFSOption {
+	return func(s *subFS) {
+		s.contained = true
+	}
+}
+
+// Sub returns the subtree at dir of fsys, like fs.Sub, as a FullFS that is written to like
+// fsys. "/" and ".." of the root of the subtree are dir itself. Its symlinks are followed like
+// those of fsys, so that those that are absolute or lead up out of dir resolve against all of
+// fsys, unless SubFSWithContainedSymlinks is given.
+func Sub(fsys FullFS, dir string, opts ...SubFSOption) (FullFS, error) {
+	if !fs.ValidPath(dir) {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: fs.ErrInvalid}
+	}
+	s := &subFS{fsys: fsys, dir: "."}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if dir == "." {
+		return fsys, nil
+	}
+	fi, err := fsys.Stat(dir)
+	if err != nil {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: err}
+	}
+	if !fi.IsDir() {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: syscall.ENOTDIR}
+	}
+	if s.contained {
+		// what is under it is compared with where it is, not with the symlinks that lead there
+		if dir, err = s.resolve(dir, true); err != nil {
+			return nil, err
+		}
+	}
+	s.dir = dir
+	return s, nil
+}
+
+// subFS is a subtree of a FullFS, the paths of which are those under dir.
+type subFS struct {
+	fsys      FullFS
+	dir       string
+	contained bool
+}
+
+// path returns the path in fsys of name.
+func (s *subFS) path(name string, followLast bool) (string, error) {
+	if s.contained {
+		return s.resolve(name, followLast)
+	}
+	return filepath.Join(s.dir, filepath.Join(pathSep, name)), nil
+}
+
+// resolve returns the path in fsys of name without any of the symlinks that lead to it, or
+// an error with ErrOutsideSubFS if they lead outside of dir. Those that are not there yet are
+// left for fsys to resolve, when it creates them. The last element is only followed if
+// followLast.
+func (s *subFS) resolve(name string, followLast bool) (string, error) {
+	var (
+		resolved = s.dir
+		pending  = splitPath(filepath.Join(pathSep, name))
+		links    int
+	)
+	for len(pending) != 0 {
+		part := pending[0]
+		pending = pending[1:]
+		if part == ".." {
+			switch {
+			case resolved == ".":
+			case resolved == s.dir:
+				return "", &fs.PathError{Op: "resolve", Path: name, Err: ErrOutsideSubFS}
+			default:
+				resolved = filepath.Dir(resolved)
+			}
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		fi, err := s.fsys.Lstat(next)
+		if err != nil {
+			return filepath.Join(append([]string{next}, pending...)...), nil
+		}
+		if fi.Mode()&fs.ModeSymlink == 0 || (!followLast && len(pending) == 0) {
+			resolved = next
+			continue
+		}
+		if links++; links > maxLinks {
+			return "", &fs.PathError{Op: "resolve", Path: name, Err: syscall.ELOOP}
+		}
+		target, err := s.fsys.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			rel := strings.TrimPrefix(filepath.Clean(target), pathSep)
+			switch {
+			case s.dir == ".":
+				resolved, target = s.dir, rel
+			case rel == s.dir || strings.HasPrefix(rel, s.dir+pathSep):
+				resolved, target = s.dir, strings.TrimPrefix(rel, s.dir)
+			default:
+				return "", &fs.PathError{Op: "resolve", Path: name, Err: ErrOutsideSubFS}
+			}
+		}
+		pending = append(splitPath(target), pending...)
+	}
+	return resolved, nil
+}
+
+// Sub returns the subtree at dir of the subtree, with the same options.
+func (s *subFS) Sub(dir string) (fs.FS, error) {
+	if !fs.ValidPath(dir) {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: fs.ErrInvalid}
+	}
+	p, err := s.path(dir, true)
+	if err != nil {
+		return nil, err
+	}
+	return Sub(s.fsys, p, func(sub *subFS) { sub.contained = s.contained })
+}
+
+func (s *subFS) Mkdir(name string, perm fs.FileMode) error {
+	p, err := s.path(name, false)
+	if err != nil {
+		return err
+	}
+	return s.fsys.Mkdir(p, perm)
+}
+
+func (s *subFS) MkdirAll(name string, perm fs.FileMode) error {
+	p, err := s.path(name, true)
+	if err != nil {
+		return err
+	}
+	return s.fsys.MkdirAll(p, perm)
+}
+
+func (s *subFS) Open(name string) (fs.File, error) {
+	p, err := s.path(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return s.fsys.Open(p)
+}
+
+func (s *subFS) OpenReaderAt(name string) (File, error) {
+	p, err := s.path(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return s.fsys.OpenReaderAt(p)
+}
+
+func (s *subFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	p, err := s.path(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return s.fsys.OpenFile(p, flag, perm)
+}
+
+func (s *subFS) ReadFile(name string) ([]byte, error) {
+	p, err := s.path(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return s.fsys.ReadFile(p)
+}
+
+func (s *subFS) WriteFile(name string, b []byte, mode fs.FileMode) error {
+	p, err := s.path(name, true)
+	if err != nil {
+		return err
+	}
+	return s.fsys.WriteFile(p, b, mode)
+}
+
+func (s *subFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := s.path(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return s.fsys.ReadDir(p)
+}
+
+func (s *subFS) Mknod(name string, mode uint32, dev int) error {
+	p, err := s.path(name, false)
+	if err != nil {
+		return err
+	}
+	return s.fsys.Mknod(p, mode, dev)
+}
+
+func (s *subFS) Readnod(name string) (int, error) {
+	p, err := s.path(name, false)
+	if err != nil {
+		return 0, err
+	}
+	return s.fsys.Readnod(p)
+}
+
+// Symlink creates newname, which links to oldname as it is. An absolute oldname is resolved
+// against all of the filesystem the subtree is of.
+func (s *subFS) Symlink(oldname, newname string) error {
+	p, err := s.path(newname, false)
+	if err != nil {
+		return err
+	}
+	return s.fsys.Symlink(oldname, p)
+}
+
+func (s *subFS) Link(oldname, newname string) error {
+	oldp, err := s.path(oldname, false)
+	if err != nil {
+		return err
+	}
+	newp, err := s.path(newname, false)
+	if err != nil {
+		return err
+	}
+	return s.fsys.Link(oldp, newp)
+}
+
+func (s *subFS) Readlink(name string) (string, error) {
+	p, err := s.path(name, false)
+	if err != nil {
+		return "", err
+	}
+	return s.fsys.Readlink(p)
+}
+
+func (s *subFS) Stat(name string) (fs.FileInfo, error) {
+	p, err := s.path(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return s.fsys.Stat(p)
+}
+
+func (s *subFS) Lstat(name string) (fs.FileInfo, error) {
+	p, err := s.path(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return s.fsys.Lstat(p)
+}
+
+func (s *subFS) Create(name string) (File, error) {
+	p, err := s.path(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return s.fsys.Create(p)
+}
+
+func (s *subFS) Remove(name string) error {
+	p, err := s.path(name, false)
+	if err != nil {
+		return err
+	}
+	return s.fsys.Remove(p)
+}
+
+func (s *subFS) Rename(oldpath, newpath string) error {
+	rfs, ok := s.fsys.(RenameFS)
+	if !ok {
+		return fmt.Errorf("rename not supported by this fs: %w", errors.ErrUnsupported)
+	}
+	oldp, err := s.path(oldpath, false)
+	if err != nil {
+		return err
+	}
+	newp, err := s.path(newpath, false)
+	if err != nil {
+		return err
+	}
+	return rfs.Rename(oldp, newp)
+}
+
+func (s *subFS) Chmod(name string, perm fs.FileMode) error {
+	p, err := s.path(name, true)
+	if err != nil {
+		return err
+	}
+	return s.fsys.Chmod(p, perm)
+}
+
+func (s *subFS) Chown(name string, uid int, gid int) error {
+	p, err := s.path(name, true)
+	if err != nil {
+		return err
+	}
+	return s.fsys.Chown(p, uid, gid)
+}
+
+func (s *subFS) Lchtimes(name string, atime, mtime time.Time) error {
+	cfs, ok := s.fsys.(ChtimesFS)
+	if !ok {
+		return fmt.Errorf("lchtimes not supported by this fs: %w", errors.ErrUnsupported)
+	}
+	p, err := s.path(name, false)
+	if err != nil {
+		return err
+	}
+	return cfs.Lchtimes(p, atime, mtime)
+}
+
+func (s *subFS) SetXattr(name string, attr string, data []byte) error {
+	p, err := s.path(name, true)
+	if err != nil {
+		return err
+	}
+	return s.fsys.SetXattr(p, attr, data)
+}
+
+func (s *subFS) GetXattr(name string, attr string) ([]byte, error) {
+	p, err := s.path(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return s.fsys.GetXattr(p, attr)
+}
+
+func (s *subFS) RemoveXattr(name string, attr string) error {
+	p, err := s.path(name, true)
+	if err != nil {
+		return err
+	}
+	return s.fsys.RemoveXattr(p, attr)
+}
+
+func (s *subFS) ListXattrs(name string) (map[string][]byte, error) {
+	p, err := s.path(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return s.fsys.ListXattrs(p)
+}
+
+// lxattrFS returns the LxattrFS of the filesystem the subtree is of.
+func (s *subFS) lxattrFS() (LxattrFS, error) {
+	lfs, ok := s.fsys.(LxattrFS)
+	if !ok {
+		return nil, fmt.Errorf("lxattrs not supported by this fs: %w", errors.ErrUnsupported)
+	}
+	return lfs, nil
+}
+
+func (s *subFS) LSetXattr(name string, attr string, data []byte) error {
+	lfs, err := s.lxattrFS()
+	if err != nil {
+		return err
+	}
+	p, err := s.path(name, false)
+	if err != nil {
+		return err
+	}
+	return lfs.LSetXattr(p, attr, data)
+}
+
+func (s *subFS) LGetXattr(name string, attr string) ([]byte, error) {
+	lfs, err := s.lxattrFS()
+	if err != nil {
+		return nil, err
+	}
+	p, err := s.path(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return lfs.LGetXattr(p, attr)
+}
+
+func (s *subFS) LRemoveXattr(name string, attr string) error {
+	lfs, err := s.lxattrFS()
+	if err != nil {
+		return err
+	}
+	p, err := s.path(name, false)
+	if err != nil {
+		return err
+	}
+	return lfs.LRemoveXattr(p, attr)
+}
+
+func (s *subFS) LListXattrs(name string) (map[string][]byte, error) {
+	lfs, err := s.lxattrFS()
+	if err != nil {
+		return nil, err
+	}
+	p, err := s.path(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return lfs.LListXattrs(p)
+}
@@ -0,0 +1,166 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testSubBase(t *testing.T) FullFS {
+	m := NewMemFS()
+	require.NoError(t, m.MkdirAll("etc/apk", 0o755))
+	require.NoError(t, m.MkdirAll("usr/lib/apk/db", 0o755))
+	require.NoError(t, m.MkdirAll("proc", 0o555))
+	require.NoError(t, m.WriteFile("etc/os-release", []byte("ID=test\n"), 0o644))
+	require.NoError(t, m.WriteFile("proc/mounts", []byte("proc /proc proc rw 0 0\n"), 0o444))
+	require.NoError(t, m.WriteFile("usr/lib/libc.so.1", []byte("libc"), 0o755))
+	require.NoError(t, m.Symlink("os-release", "etc/relative"))
+	require.NoError(t, m.Symlink("/etc/os-release", "etc/absolute"))
+	require.NoError(t, m.Symlink("../proc/mounts", "etc/mtab"))
+	require.NoError(t, m.Symlink("/usr/lib/libc.so.1", "etc/libc"))
+	require.NoError(t, m.Symlink("/usr/lib/libc.so.1", "usr/lib/libc.so"))
+	require.NoError(t, m.Symlink("usr/lib", "lib"))
+	return m
+}
+
+func TestSub(t *testing.T) {
+	base := testSubBase(t)
+	sfs, err := fs.Sub(base, "etc")
+	require.NoError(t, err)
+	sub, ok := sfs.(FullFS)
+	require.True(t, ok, "the sub filesystem should be writable, is %T", sfs)
+
+	b, err := sub.ReadFile("os-release")
+	require.NoError(t, err)
+	require.Equal(t, "ID=test\n", string(b))
+	for _, name := range []string{"/os-release", "../os-release", "apk/../../os-release"} {
+		_, err := sub.Stat(name)
+		require.NoError(t, err, "%s should not lead out of the root of the subtree", name)
+	}
+	entries, err := sub.ReadDir(".")
+	require.NoError(t, err)
+	require.Equal(t, []string{"absolute", "apk", "libc", "mtab", "os-release", "relative"}, names(entries))
+
+	// writes end up under the subtree
+	require.NoError(t, sub.WriteFile("apk/world", []byte("busybox\n"), 0o644))
+	b, err = base.ReadFile("etc/apk/world")
+	require.NoError(t, err)
+	require.Equal(t, "busybox\n", string(b))
+	require.NoError(t, sub.Symlink("apk/world", "world"))
+	require.NoError(t, sub.Chown("world", 0, 42))
+	require.NoError(t, sub.(RenameFS).Rename("world", "world.link"))
+	target, err := base.Readlink("etc/world.link")
+	require.NoError(t, err)
+	require.Equal(t, "apk/world", target)
+	mtime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, sub.(ChtimesFS).Lchtimes("world.link", mtime, mtime))
+	fi, err := base.Lstat("etc/world.link")
+	require.NoError(t, err)
+	require.True(t, fi.ModTime().Equal(mtime))
+	require.NoError(t, sub.(LxattrFS).LSetXattr("world.link", "security.selinux", []byte("label")))
+	value, err := base.(LxattrFS).LGetXattr("etc/world.link", "security.selinux")
+	require.NoError(t, err)
+	require.Equal(t, "label", string(value))
+	require.NoError(t, sub.Remove("world.link"))
+	_, err = base.Lstat("etc/world.link")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	// the symlinks that lead outside are resolved against all of the filesystem
+	b, err = sub.ReadFile("mtab")
+	require.NoError(t, err)
+	require.Equal(t, "proc /proc proc rw 0 0\n", string(b))
+	b, err = sub.ReadFile("libc")
+	require.NoError(t, err)
+	require.Equal(t, "libc", string(b))
+
+	_, err = Sub(base, "etc/os-release")
+	require.ErrorIs(t, err, syscall.ENOTDIR)
+	_, err = Sub(base, "missing")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = Sub(base, "../etc")
+	require.ErrorIs(t, err, fs.ErrInvalid)
+	same, err := Sub(base, ".")
+	require.NoError(t, err)
+	require.Equal(t, base, same)
+}
+
+func TestSubContainedSymlinks(t *testing.T) {
+	base := testSubBase(t)
+	sub, err := Sub(base, "etc", SubFSWithContainedSymlinks())
+	require.NoError(t, err)
+
+	for _, name := range []string{"relative", "absolute"} {
+		b, err := sub.ReadFile(name)
+		require.NoError(t, err, name)
+		require.Equal(t, "ID=test\n", string(b), name)
+	}
+	for _, name := range []string{"mtab", "libc"} {
+		_, err := sub.ReadFile(name)
+		require.ErrorIs(t, err, ErrOutsideSubFS, name)
+		_, err = sub.Stat(name)
+		require.ErrorIs(t, err, ErrOutsideSubFS, name)
+		require.ErrorIs(t, sub.WriteFile(name, nil, 0o644), ErrOutsideSubFS, name)
+
+		// the symlink itself is in the subtree
+		fi, err := sub.Lstat(name)
+		require.NoError(t, err, name)
+		require.Equal(t, fs.ModeSymlink, fi.Mode().Type(), name)
+		_, err = sub.Readlink(name)
+		require.NoError(t, err, name)
+	}
+	require.NoError(t, sub.WriteFile("absolute", []byte("ID=new\n"), 0o644))
+	b, err := base.ReadFile("etc/os-release")
+	require.NoError(t, err)
+	require.Equal(t, "ID=new\n", string(b), "writes through a symlink in the subtree should be allowed")
+
+	// a subtree that is reached through a symlink is compared with where it is
+	lib, err := Sub(base, "lib", SubFSWithContainedSymlinks())
+	require.NoError(t, err)
+	b, err = lib.ReadFile("libc.so")
+	require.NoError(t, err)
+	require.Equal(t, "libc", string(b))
+
+	nested, err := fs.Sub(lib, "apk")
+	require.NoError(t, err)
+	require.NoError(t, nested.(FullFS).Symlink("../../libc.so.1", "db/libc"))
+	_, err = nested.(FullFS).Stat("db/libc")
+	require.ErrorIs(t, err, ErrOutsideSubFS, "a nested subtree should keep the options")
+}
+
+func TestDirFSSub(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "usr", "lib", "apk", "db"), 0o755))
+	dfs := DirFS(dir)
+	require.NotNil(t, dfs)
+
+	sfs, err := fs.Sub(dfs, "usr/lib/apk/db")
+	require.NoError(t, err)
+	sub, ok := sfs.(FullFS)
+	require.True(t, ok, "the sub filesystem should be writable, is %T", sfs)
+	require.NoError(t, sub.WriteFile("installed", []byte("P:busybox\n"), 0o644))
+	b, err := os.ReadFile(filepath.Join(dir, "usr", "lib", "apk", "db", "installed"))
+	require.NoError(t, err)
+	require.Equal(t, "P:busybox\n", string(b))
+	entries, err := sub.ReadDir(".")
+	require.NoError(t, err)
+	require.Equal(t, []string{"installed"}, names(entries))
+}
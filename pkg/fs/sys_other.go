@@ -0,0 +1,80 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !unix
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+)
+
+// The type bits of the mode of Mknod, which are those of Linux, as the files are only kept in
+// memory on this platform.
+const (
+	modeTypeMask = 0o170000
+	modeBlock    = 0o060000
+	modeChar     = 0o020000
+	modeFIFO     = 0o010000
+	modeSocket   = 0o140000
+)
+
+// Mkdev, Major and Minor encode device numbers like Linux does, as there are none on disk on
+// this platform.
+func Mkdev(major, minor uint32) int {
+	return int(uint64(major&0xfff)<<8 | uint64(major&^0xfff)<<32 | uint64(minor&0xff) | uint64(minor&^0xff)<<12)
+}
+
+func Major(dev int) uint32 {
+	return uint32((uint64(dev)>>8)&0xfff | (uint64(dev)>>32)&0xfffff000)
+}
+
+func Minor(dev int) uint32 {
+	return uint32(uint64(dev)&0xff | (uint64(dev)>>12)&0xffffff00)
+}
+
+func statRdev(any) (int, bool) {
+	return 0, false
+}
+
+func statOwner(any) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// errUnsupported is returned for what cannot be done on disk on this platform.
+var errUnsupported = fmt.Errorf("not supported on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+
+func flock(*os.File) error {
+	return errUnsupported
+}
+
+func lchtimes(string, time.Time, time.Time) error {
+	return errUnsupported
+}
+
+func mknod(string, uint32, int) error {
+	return errUnsupported
+}
+
+func lsetxattr(string, string, []byte) error {
+	return errUnsupported
+}
+
+func lremovexattr(string, string) error {
+	return errUnsupported
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package fs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The type bits of the mode of Mknod, and of st_mode.
+const (
+	modeTypeMask = unix.S_IFMT
+	modeBlock    = unix.S_IFBLK
+	modeChar     = unix.S_IFCHR
+	modeFIFO     = unix.S_IFIFO
+	modeSocket   = unix.S_IFSOCK
+)
+
+// Mkdev returns the device number of major and minor, as Mknod takes and Readnod returns.
+func Mkdev(major, minor uint32) int {
+	return int(unix.Mkdev(major, minor))
+}
+
+// Major returns the major number of the device number dev.
+func Major(dev int) uint32 {
+	return unix.Major(uint64(dev))
+}
+
+// Minor returns the minor number of the device number dev.
+func Minor(dev int) uint32 {
+	return unix.Minor(uint64(dev))
+}
+
+// statRdev returns the device number of a file whose fs.FileInfo has sys as Sys.
+func statRdev(sys any) (int, bool) {
+	switch st := sys.(type) {
+	case *unix.Stat_t:
+		return int(st.Rdev), true
+	case *syscall.Stat_t:
+		return int(st.Rdev), true
+	}
+	return 0, false
+}
+
+// statOwner returns the owner of a file whose fs.FileInfo has sys as Sys.
+func statOwner(sys any) (uid, gid int, ok bool) {
+	switch st := sys.(type) {
+	case *unix.Stat_t:
+		return int(st.Uid), int(st.Gid), true
+	case *syscall.Stat_t:
+		return int(st.Uid), int(st.Gid), true
+	}
+	return 0, 0, false
+}
+
+// flock takes the exclusive flock of f, or returns ErrLocked if someone else holds it.
+func flock(f *os.File) error {
+	err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return ErrLocked
+	}
+	return err
+}
+
+func lchtimes(path string, atime, mtime time.Time) error {
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+func mknod(path string, mode uint32, dev int) error {
+	return unix.Mknod(path, mode, mknodDev(dev))
+}
+
+func lsetxattr(path string, attr string, data []byte) error {
+	return unix.Lsetxattr(path, attr, data, 0)
+}
+
+func lremovexattr(path string, attr string) error {
+	return unix.Lremovexattr(path, attr)
+}
@@ -0,0 +1,88 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signature
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+)
+
+var (
+	errDigestNotSHA512 = errors.New("digest is not a SHA512 hash")
+	errNoEd25519Key    = errors.New("key is not an Ed25519 key")
+)
+
+// Ed25519Sign signs the provided SHA512 message digest with Ed25519ph. The key
+// file must be a PKCS #8 private key in the PEM format.
+func Ed25519Sign(sha512Digest []byte, keyFile string) ([]byte, error) {
+	if len(sha512Digest) != sha512.Size {
+		return nil, errDigestNotSHA512
+	}
+
+	signer, err := LoadPrivateKey(keyFile, "")
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := signer.Public().(ed25519.PublicKey); !ok {
+		return nil, errNoEd25519Key
+	}
+
+	return SignDigest(sha512Digest, crypto.SHA512, signer)
+}
+
+// Ed25519Verify verifies an Ed25519ph signature over the provided SHA512 hash of
+// a message. The public key must be PEM or DER encoded.
+func Ed25519Verify(sha512Digest, signature []byte, publicKey []byte) error {
+	if len(sha512Digest) != sha512.Size {
+		return errDigestNotSHA512
+	}
+
+	pub, err := parsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	edPub, ok := pub.(ed25519.PublicKey)
+	if !ok {
+		return errNoEd25519Key
+	}
+
+	if err := ed25519.VerifyWithOptions(edPub, sha512Digest, signature, &ed25519.Options{Hash: crypto.SHA512}); err != nil {
+		return fmt.Errorf("verify Ed25519 signature: %w", err)
+	}
+
+	return nil
+}
+
+// VerifyDigest verifies a signature over the provided digest of a message, hashed
+// with algo, with an RSA or Ed25519 public key depending on the type of the key.
+// The public key must be PEM or DER encoded.
+func VerifyDigest(digest []byte, algo crypto.Hash, signature []byte, publicKey []byte) error {
+	pub, err := parsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	switch pub.(type) {
+	case ed25519.PublicKey:
+		if algo != crypto.SHA512 {
+			return errDigestNotSHA512
+		}
+		return Ed25519Verify(digest, signature, publicKey)
+	default:
+		return RSAVerifyDigest(digest, algo, signature, publicKey)
+	}
+}
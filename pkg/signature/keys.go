@@ -0,0 +1,86 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signature
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// parsePublicKey parses a public key, either DER or PEM encoded. A PEM file may hold
+// several blocks: the first PUBLIC KEY or RSA PUBLIC KEY block is used, or the key of
+// the first CERTIFICATE block if there is none.
+func parsePublicKey(publicKey []byte) (crypto.PublicKey, error) {
+	block, rest := pem.Decode(publicKey)
+	if block == nil {
+		pub, err := parseDERPublicKey(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("%w, and key is not DER encoded: %v", errNoPemBlock, err)
+		}
+		return pub, nil
+	}
+
+	var (
+		types []string
+		cert  *pem.Block
+	)
+	for ; block != nil; block, rest = pem.Decode(rest) {
+		types = append(types, block.Type)
+		switch block.Type {
+		case "PUBLIC KEY":
+			pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("parse PKIX public key: %w", err)
+			}
+			return pub, nil
+		case "RSA PUBLIC KEY":
+			pub, err := x509.ParsePKCS1PublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("parse PKCS1 public key: %w", err)
+			}
+			return pub, nil
+		case "CERTIFICATE":
+			if cert == nil {
+				cert = block
+			}
+		}
+	}
+	if cert != nil {
+		c, err := x509.ParseCertificate(cert.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse certificate: %w", err)
+		}
+		return c.PublicKey, nil
+	}
+	return nil, fmt.Errorf("no public key or certificate found in PEM blocks: %s", strings.Join(types, ", "))
+}
+
+// parseDERPublicKey parses a DER encoded PKIX or PKCS #1 public key, or certificate.
+func parseDERPublicKey(der []byte) (crypto.PublicKey, error) {
+	if pub, err := x509.ParsePKIXPublicKey(der); err == nil {
+		return pub, nil
+	}
+	if pub, err := x509.ParsePKCS1PublicKey(der); err == nil {
+		return pub, nil
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return c.PublicKey, nil
+}
@@ -5,19 +5,18 @@ package signature
 
 import (
 	"crypto"
-	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1" //nolint:gosec
-	"crypto/x509"
-	"encoding/pem"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
 	"errors"
 	"fmt"
-	"os"
 )
 
 var (
 	errNoPemBlock    = errors.New("no PEM block found")
 	errDigestNotSHA1 = errors.New("digest is not a SHA1 hash")
+	errDigestSize    = errors.New("digest does not match the size of its hash")
 	errNoPassphrase  = errors.New("key is encrypted but no passphrase was provided")
 	errNoRSAKey      = errors.New("key is not an RSA key")
 )
@@ -29,60 +28,36 @@ func RSASignSHA1Digest(sha1Digest []byte, keyFile, passphrase string) ([]byte, e
 		return nil, errDigestNotSHA1
 	}
 
-	keyFileContent, err := os.ReadFile(keyFile)
+	signer, err := LoadPrivateKey(keyFile, passphrase)
 	if err != nil {
-		return nil, fmt.Errorf("reading key file: %w", err)
+		return nil, err
 	}
-
-	block, _ := pem.Decode(keyFileContent)
-	if block == nil {
-		return nil, errNoPemBlock
+	if _, ok := signer.Public().(*rsa.PublicKey); !ok {
+		return nil, errNoRSAKey
 	}
 
-	blockData := block.Bytes
-	if x509.IsEncryptedPEMBlock(block) { //nolint:staticcheck
-		if passphrase == "" {
-			return nil, errNoPassphrase
-		}
-
-		var decryptedBlockData []byte
-
-		decryptedBlockData, err = x509.DecryptPEMBlock(block, []byte(passphrase)) //nolint:staticcheck
-		if err != nil {
-			return nil, fmt.Errorf("decrypt private key PEM block: %w", err)
-		}
-
-		blockData = decryptedBlockData
-	}
-
-	priv, err := x509.ParsePKCS1PrivateKey(blockData)
-	if err != nil {
-		return nil, fmt.Errorf("parse PKCS1 private key: %w", err)
-	}
-
-	signature, err := priv.Sign(rand.Reader, sha1Digest, crypto.SHA1)
-	if err != nil {
-		return nil, fmt.Errorf("signing: %w", err)
-	}
-
-	return signature, nil
+	return SignDigest(sha1Digest, crypto.SHA1, signer)
 }
 
 // RSAVerifySHA1Digest is exported for use in tests and verifies a signature over the
-// provided SHA1 hash of a message. The key file must be in the PEM format.
+// provided SHA1 hash of a message. The public key must be PEM or DER encoded.
 func RSAVerifySHA1Digest(sha1Digest, signature []byte, publicKey []byte) error {
 	if len(sha1Digest) != sha1.Size {
 		return errDigestNotSHA1
 	}
+	return RSAVerifyDigest(sha1Digest, crypto.SHA1, signature, publicKey)
+}
 
-	block, _ := pem.Decode(publicKey)
-	if block == nil {
-		return errNoPemBlock
+// RSAVerifyDigest verifies a signature over the provided digest of a message,
+// hashed with algo. The public key must be PEM or DER encoded.
+func RSAVerifyDigest(digest []byte, algo crypto.Hash, signature []byte, publicKey []byte) error {
+	if len(digest) != algo.Size() {
+		return errDigestSize
 	}
 
-	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	pub, err := parsePublicKey(publicKey)
 	if err != nil {
-		return fmt.Errorf("parse PKIX public key: %w", err)
+		return err
 	}
 
 	rsaPub, ok := pub.(*rsa.PublicKey)
@@ -90,7 +65,7 @@ func RSAVerifySHA1Digest(sha1Digest, signature []byte, publicKey []byte) error {
 		return errNoRSAKey
 	}
 
-	err = rsa.VerifyPKCS1v15(rsaPub, crypto.SHA1, sha1Digest, signature)
+	err = rsa.VerifyPKCS1v15(rsaPub, algo, digest, signature)
 	if err != nil {
 		return fmt.Errorf("verify PKCS1v15 signature: %w", err)
 	}
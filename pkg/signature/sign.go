@@ -18,7 +18,7 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
-	"crypto/sha1" //nolint:gosec
+	"crypto"
 	"errors"
 	"fmt"
 	"io"
@@ -28,13 +28,20 @@ import (
 	"strings"
 
 	"github.com/klauspost/compress/gzip"
-
-	"github.com/psanford/memfs"
-
-	"github.com/chainguard-dev/go-apk/pkg/tarball"
 )
 
 func SignIndex(ctx context.Context, signingKey string, indexFile string) error {
+	signer, err := LoadPrivateKey(signingKey, "")
+	if err != nil {
+		return fmt.Errorf("unable to load signing key: %w", err)
+	}
+	return SignIndexWithSigner(ctx, signer, crypto.SHA1, fmt.Sprintf("%s.pub", filepath.Base(signingKey)), indexFile)
+}
+
+// SignIndexWithSigner signs indexFile in place with signer, hashing it with algo.
+// keyName is the name of the public key that verifies it, which can not be derived
+// from signers such as KMS keys, e.g. "packager.rsa.pub".
+func SignIndexWithSigner(ctx context.Context, signer crypto.Signer, algo crypto.Hash, keyName string, indexFile string) error {
 	is, err := indexIsAlreadySigned(indexFile)
 	if err != nil {
 		return err
@@ -44,50 +51,27 @@ func SignIndex(ctx context.Context, signingKey string, indexFile string) error {
 		return nil
 	}
 
-	log.Printf("signing index %s with key %s", indexFile, signingKey)
+	log.Printf("signing index %s with key %s", indexFile, keyName)
 
-	indexData, indexDigest, err := ReadAndHashIndexFile(indexFile)
+	indexData, err := os.ReadFile(indexFile)
 	if err != nil {
-		return err
+		return fmt.Errorf("unable to read index for signing: %w", err)
 	}
 
-	sigData, err := RSASignSHA1Digest(indexDigest, signingKey, "")
+	sigData, err := SignatureSection(indexData, keyName, algo, signer)
 	if err != nil {
 		return fmt.Errorf("unable to sign index: %w", err)
 	}
 
-	log.Printf("appending signature to index %s", indexFile)
-
-	sigFS := memfs.New()
-	if err := sigFS.WriteFile(fmt.Sprintf(".SIGN.RSA.%s.pub", filepath.Base(signingKey)), sigData, 0644); err != nil {
-		return fmt.Errorf("unable to append signature: %w", err)
-	}
-
-	// prepare control.tar.gz
-	multitarctx, err := tarball.NewContext(
-		tarball.WithOverrideUIDGID(0, 0),
-		tarball.WithOverrideUname("root"),
-		tarball.WithOverrideGname("root"),
-		tarball.WithSkipClose(true),
-	)
-	if err != nil {
-		return fmt.Errorf("unable to build tarball context: %w", err)
-	}
-
 	log.Printf("writing signed index to %s", indexFile)
 
-	var sigBuffer bytes.Buffer
-	if err := multitarctx.WriteTargz(ctx, &sigBuffer, sigFS, sigFS); err != nil {
-		return fmt.Errorf("unable to write signature tarball: %w", err)
-	}
-
 	idx, err := os.Create(indexFile)
 	if err != nil {
 		return fmt.Errorf("unable to open index for writing: %w", err)
 	}
 	defer idx.Close()
 
-	if _, err := io.Copy(idx, &sigBuffer); err != nil {
+	if _, err := idx.Write(sigData); err != nil {
 		return fmt.Errorf("unable to write index signature: %w", err)
 	}
 
@@ -95,11 +79,59 @@ func SignIndex(ctx context.Context, signingKey string, indexFile string) error {
 		return fmt.Errorf("unable to write index data: %w", err)
 	}
 
-	log.Printf("signed index %s with key %s", indexFile, signingKey)
+	log.Printf("signed index %s with key %s", indexFile, keyName)
 
 	return nil
 }
 
+// SignatureSection signs data, the control section of a package or an unsigned index,
+// with signer, hashing it with algo. It returns the signature section that precedes
+// data in the signed package or index, for the public key keyName.
+func SignatureSection(data []byte, keyName string, algo crypto.Hash, signer crypto.Signer) ([]byte, error) {
+	name, err := SignatureFileName(keyName, algo, signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	digest, err := HashDataWith(data, algo)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := SignDigest(digest, algo, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	// The signature is a tar stream of its own gzip stream. It is not terminated,
+	// so that apk-tools reads it and what follows as one archive.
+	var out bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&out, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0o644,
+		Size:     int64(len(sig)),
+		Uname:    "root",
+		Gname:    "root",
+		Format:   tar.FormatUSTAR,
+	}); err != nil {
+		return nil, fmt.Errorf("unable to write signature: %w", err)
+	}
+	if _, err := tw.Write(sig); err != nil {
+		return nil, fmt.Errorf("unable to write signature: %w", err)
+	}
+	if err := tw.Flush(); err != nil {
+		return nil, fmt.Errorf("unable to write signature: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("unable to write signature: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
 func indexIsAlreadySigned(indexFile string) (bool, error) {
 	index, err := os.Open(indexFile)
 	if err != nil {
@@ -123,7 +155,7 @@ func indexIsAlreadySigned(indexFile string) (bool, error) {
 			return false, fmt.Errorf("cannot read tar index %s: %w", indexFile, err)
 		}
 
-		if strings.HasPrefix(hdr.Name, ".SIGN.RSA") {
+		if strings.HasPrefix(hdr.Name, ".SIGN.") {
 			return true, nil
 		}
 	}
@@ -143,7 +175,15 @@ func ReadAndHashIndexFile(indexFile string) ([]byte, []byte, error) {
 }
 
 func HashData(data []byte) ([]byte, error) {
-	digest := sha1.New() //nolint:gosec
+	return HashDataWith(data, crypto.SHA1)
+}
+
+// HashDataWith returns the digest of data with algo.
+func HashDataWith(data []byte, algo crypto.Hash) ([]byte, error) {
+	if !algo.Available() {
+		return nil, fmt.Errorf("unable to hash data: hash %s is not available", algo)
+	}
+	digest := algo.New()
 	if n, err := digest.Write(data); err != nil || n != len(data) {
 		return nil, fmt.Errorf("unable to hash data: %w", err)
 	}
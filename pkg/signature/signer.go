@@ -0,0 +1,123 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signature
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var errUnsupportedKey = errors.New("key is not an RSA or Ed25519 key")
+
+// SignDigest signs digest, the hash of a message with algo, with signer, which may
+// be backed by a KMS or HSM. RSA keys sign with PKCS #1 v1.5, Ed25519 keys with
+// Ed25519ph, which requires a SHA512 digest.
+func SignDigest(digest []byte, algo crypto.Hash, signer crypto.Signer) ([]byte, error) {
+	if len(digest) != algo.Size() {
+		return nil, errDigestSize
+	}
+
+	var opts crypto.SignerOpts = algo
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+	case ed25519.PublicKey:
+		if algo != crypto.SHA512 {
+			return nil, errDigestNotSHA512
+		}
+		opts = &ed25519.Options{Hash: crypto.SHA512}
+	default:
+		return nil, errUnsupportedKey
+	}
+
+	signature, err := signer.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+
+	return signature, nil
+}
+
+// SignatureFileName returns the name of the file holding a signature by the key
+// keyName, with public key pub, over a digest hashed with algo: .SIGN.RSA.<keyName>
+// for RSA-SHA1, .SIGN.RSA256.<keyName> and .SIGN.RSA512.<keyName>, or
+// .SIGN.Ed25519.<keyName>.
+func SignatureFileName(keyName string, algo crypto.Hash, pub crypto.PublicKey) (string, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		switch algo {
+		case crypto.SHA1:
+			return ".SIGN.RSA." + keyName, nil
+		case crypto.SHA256:
+			return ".SIGN.RSA256." + keyName, nil
+		case crypto.SHA512:
+			return ".SIGN.RSA512." + keyName, nil
+		}
+		return "", fmt.Errorf("unsupported hash for RSA signatures: %s", algo)
+	case ed25519.PublicKey:
+		if algo != crypto.SHA512 {
+			return "", errDigestNotSHA512
+		}
+		return ".SIGN.Ed25519." + keyName, nil
+	default:
+		return "", errUnsupportedKey
+	}
+}
+
+// LoadPrivateKey reads the RSA or Ed25519 private key in keyFile as a crypto.Signer.
+// The key file must be in the PEM format, either PKCS #1 or PKCS #8, and can be
+// encrypted with passphrase.
+func LoadPrivateKey(keyFile, passphrase string) (crypto.Signer, error) {
+	keyFileContent, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %w", err)
+	}
+
+	block, _ := pem.Decode(keyFileContent)
+	if block == nil {
+		return nil, errNoPemBlock
+	}
+
+	blockData := block.Bytes
+	if x509.IsEncryptedPEMBlock(block) { //nolint:staticcheck
+		if passphrase == "" {
+			return nil, errNoPassphrase
+		}
+
+		blockData, err = x509.DecryptPEMBlock(block, []byte(passphrase)) //nolint:staticcheck
+		if err != nil {
+			return nil, fmt.Errorf("decrypt private key PEM block: %w", err)
+		}
+	}
+
+	if priv, err := x509.ParsePKCS1PrivateKey(blockData); err == nil {
+		return priv, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(blockData)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errUnsupportedKey
+	}
+	return signer, nil
+}
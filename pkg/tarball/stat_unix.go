@@ -0,0 +1,29 @@
+// Copyright 2022, 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package tarball
+
+import "syscall"
+
+// statLinks returns the inode and number of links of a file on disk, whose fs.FileInfo has
+// sys as Sys.
+func statLinks(sys any) (ino, nlink uint64, ok bool) {
+	si, ok := sys.(*syscall.Stat_t)
+	if !ok || si == nil {
+		return 0, 0, false
+	}
+	return si.Ino, uint64(si.Nlink), true
+}
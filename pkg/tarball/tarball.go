@@ -16,6 +16,9 @@ package tarball
 
 import (
 	"archive/tar"
+	"fmt"
+	"os"
+	"strconv"
 	"time"
 )
 
@@ -28,13 +31,31 @@ type Context struct {
 	OverrideGname   string
 	SkipClose       bool
 	UseChecksums    bool
+	PreserveTimes   bool
+	Compression     Compression
 	remapUIDs       map[int]int
 	remapGIDs       map[int]int
 	overridePerms   map[string]tar.Header
+	// noHostNames is set by WriteTar, whose user and group names are only those of the
+	// filesystem, rather than those of the host that writes it.
+	noHostNames bool
 }
 
 type Option func(*Context) error
 
+// TarOption is an Option of WriteTar.
+type TarOption = Option
+
+// Compression is the compression WriteTargz uses.
+type Compression int
+
+const (
+	// CompressionGzip is gzip, which every section of an APKv2 package uses by default.
+	CompressionGzip Compression = iota
+	// CompressionZstd is zstd, which apk-tools can use for the data section of a package.
+	CompressionZstd
+)
+
 // Generates a new context from a set of options.
 func NewContext(opts ...Option) (*Context, error) {
 	ctx := Context{}
@@ -56,6 +77,23 @@ func WithSourceDateEpoch(t time.Time) Option {
 	}
 }
 
+// WithSourceDateEpochFromEnv sets SourceDateEpoch for Context to the SOURCE_DATE_EPOCH
+// environment variable, in seconds since the Unix epoch, if it is set.
+func WithSourceDateEpochFromEnv() Option {
+	return func(ctx *Context) error {
+		epoch := os.Getenv("SOURCE_DATE_EPOCH")
+		if epoch == "" {
+			return nil
+		}
+		sec, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return fmt.Errorf("parsing SOURCE_DATE_EPOCH %q: %w", epoch, err)
+		}
+		ctx.SourceDateEpoch = time.Unix(sec, 0).UTC()
+		return nil
+	}
+}
+
 // WithOverrideUIDGID sets the UID/GID to override with for all files for Context.
 func WithOverrideUIDGID(uid, gid int) Option {
 	return func(ctx *Context) error {
@@ -128,3 +166,23 @@ func WithUseChecksums(useChecksums bool) Option {
 		return nil
 	}
 }
+
+// WithPreserveTimes is used to determine whether the tar stream keeps
+// the access and modification times of the files, rather than setting
+// them all to SourceDateEpoch. Times later than SourceDateEpoch, if it
+// is set, are clamped to it, so the stream is still reproducible.
+func WithPreserveTimes(preserveTimes bool) Option {
+	return func(ctx *Context) error {
+		ctx.PreserveTimes = preserveTimes
+		return nil
+	}
+}
+
+// WithCompression sets the compression WriteTargz uses, gzip by default. Only the data
+// section of a package can be compressed with zstd.
+func WithCompression(compression Compression) Option {
+	return func(ctx *Context) error {
+		ctx.Compression = compression
+		return nil
+	}
+}
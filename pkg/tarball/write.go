@@ -24,10 +24,12 @@ import (
 	"io"
 	"io/fs"
 	"os"
-	"syscall"
+	"path/filepath"
+	"sort"
+	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"go.opentelemetry.io/otel"
-	"golang.org/x/sys/unix"
 
 	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
 	"github.com/chainguard-dev/go-apk/pkg/passwd"
@@ -36,44 +38,55 @@ import (
 const xattrTarPAXRecordsPrefix = "SCHILY.xattr."
 
 func hasHardlinks(fi fs.FileInfo) bool {
-	if stat := fi.Sys(); stat != nil {
-		si, ok := stat.(*syscall.Stat_t)
-		if !ok {
-			return false
-		}
-
-		// if we don't have inodes, we just assume the filesystem
-		// does not support hardlinks
-		if si == nil {
-			return false
-		}
+	if hi, ok := fi.(apkfs.HardlinkInfo); ok {
+		return hi.Nlink() > 1
+	}
+	// if we don't have inodes, we just assume the filesystem
+	// does not support hardlinks
+	_, nlink, ok := statLinks(fi.Sys())
+	return ok && nlink > 1
+}
 
-		return si.Nlink > 1
+func getInodeFromFileInfo(fi fs.FileInfo) (uint64, error) {
+	if hi, ok := fi.(apkfs.HardlinkInfo); ok {
+		return hi.Ino(), nil
+	}
+	ino, _, ok := statLinks(fi.Sys())
+	if !ok {
+		return 0, fmt.Errorf("unable to stat underlying file")
 	}
+	return ino, nil
+}
 
-	return false
+// sortedFS is an fs.FS the entries of each directory of which are walked sorted by name, like
+// those of tar --sort=name, whatever order its ReadDir returns them in.
+type sortedFS struct {
+	fs.FS
 }
 
-func getInodeFromFileInfo(fi fs.FileInfo) (uint64, error) {
-	if stat := fi.Sys(); stat != nil {
-		si, ok := stat.(*syscall.Stat_t)
-		if !ok {
-			return 0, fmt.Errorf("unable to stat underlying file")
-		}
+func (s sortedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(s.FS, name)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, err
+}
 
-		// if we don't have inodes, we just assume the filesystem
-		// does not support hardlinks
-		if si == nil {
-			return 0, fmt.Errorf("unable to stat underlying file")
-		}
+func (s sortedFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(s.FS, name)
+}
 
-		return si.Ino, nil
+// clampTime returns t, or SourceDateEpoch if it is set and t is later.
+func (c *Context) clampTime(t time.Time) time.Time {
+	if !c.SourceDateEpoch.IsZero() && t.After(c.SourceDateEpoch) {
+		return c.SourceDateEpoch
 	}
-
-	return 0, fmt.Errorf("unable to stat underlying file")
+	return t
 }
 
-func (c *Context) writeTar(ctx context.Context, tw *tar.Writer, fsys fs.FS, users, groups map[int]string) error { //nolint:gocyclo
+// writeTar writes the entries of fsys to tw. afterDir, if it is not nil, is called after the
+// header of each directory is written, to write what else goes in it.
+func (c *Context) writeTar(ctx context.Context, tw *tar.Writer, fsys fs.FS, users, groups map[int]string, afterDir func(path string) error) error { //nolint:gocyclo
 	if users == nil {
 		users = map[int]string{}
 	}
@@ -88,7 +101,7 @@ func (c *Context) writeTar(ctx context.Context, tw *tar.Writer, fsys fs.FS, user
 
 	buf := make([]byte, 1<<20)
 
-	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+	if err := fs.WalkDir(sortedFS{fsys}, ".", func(path string, d fs.DirEntry, err error) error {
 		if err := ctx.Err(); err != nil {
 			return err
 		}
@@ -106,10 +119,15 @@ func (c *Context) writeTar(ctx context.Context, tw *tar.Writer, fsys fs.FS, user
 			return err
 		}
 
+		// tar has no type for sockets, so like tar(1), they are left out
+		if info.Mode()&os.ModeSocket == os.ModeSocket {
+			return nil
+		}
+
 		var (
 			link         string
 			major, minor uint32
-			isCharDevice bool
+			isDevice     bool
 		)
 		if info.Mode()&os.ModeSymlink == os.ModeSymlink {
 			rlfs, ok := fsys.(apkfs.ReadLinkFS)
@@ -122,18 +140,18 @@ func (c *Context) writeTar(ctx context.Context, tw *tar.Writer, fsys fs.FS, user
 			}
 		}
 
-		if info.Mode()&os.ModeCharDevice == os.ModeCharDevice {
+		// character and block devices
+		if info.Mode()&os.ModeDevice == os.ModeDevice {
 			rlfs, ok := fsys.(apkfs.ReadnodFS)
 			if !ok {
-				return fmt.Errorf("read character device not supported by this fs: path (%s) %#v %#v", path, info, fsys)
+				return fmt.Errorf("read device not supported by this fs: path (%s) %#v %#v", path, info, fsys)
 			}
-			isCharDevice = true
+			isDevice = true
 			dev, err := rlfs.Readnod(path)
 			if err != nil {
 				return err
 			}
-			major = unix.Major(uint64(dev))
-			minor = unix.Minor(uint64(dev))
+			major, minor = apkfs.Major(dev), apkfs.Minor(dev)
 		}
 
 		header, err := tar.FileInfoHeader(info, link)
@@ -141,17 +159,32 @@ func (c *Context) writeTar(ctx context.Context, tw *tar.Writer, fsys fs.FS, user
 			return err
 		}
 		// devices
-		if isCharDevice {
+		if isDevice {
 			header.Devmajor = int64(major)
 			header.Devminor = int64(minor)
 		}
 		// work around some weirdness, without this we wind up with just the basename
 		header.Name = path
+		if c.noHostNames {
+			// the names are those of users, not of the host that happens to write it
+			header.Uname, header.Gname = "", ""
+		}
 
-		// zero out timestamps for reproducibility
-		header.AccessTime = c.SourceDateEpoch
-		header.ModTime = c.SourceDateEpoch
-		header.ChangeTime = c.SourceDateEpoch
+		// zero out timestamps for reproducibility, unless they are preserved
+		if c.PreserveTimes {
+			header.AccessTime = c.clampTime(header.AccessTime)
+			header.ModTime = c.clampTime(header.ModTime)
+			// the change time is when it was installed, which is not reproducible
+			header.ChangeTime = time.Time{}
+			if !header.AccessTime.IsZero() {
+				// the access time is only written in PAX headers when they are asked for
+				header.Format = tar.FormatPAX
+			}
+		} else {
+			header.AccessTime = c.SourceDateEpoch
+			header.ModTime = c.SourceDateEpoch
+			header.ChangeTime = c.SourceDateEpoch
+		}
 
 		if uid, ok := c.remapUIDs[header.Uid]; ok {
 			header.Uid = uid
@@ -240,23 +273,31 @@ func (c *Context) writeTar(ctx context.Context, tw *tar.Writer, fsys fs.FS, user
 			}
 		}
 
-		// only capture xattrs for real objects in the FS
-		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeDir {
-			xfs, ok := fsys.(apkfs.XattrFS)
-			if ok {
-				xattrs, err := xfs.ListXattrs(path)
+		// only capture xattrs for real objects in the FS, and symlinks that have their own
+		var xattrs map[string][]byte
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeDir:
+			if xfs, ok := fsys.(apkfs.XattrFS); ok {
 				// we can ignore errors
-				if err == nil && xattrs != nil {
-					for name, value := range xattrs {
-						header.PAXRecords[xattrTarPAXRecordsPrefix+name] = string(value)
-					}
-				}
+				xattrs, _ = xfs.ListXattrs(path)
+			}
+		case tar.TypeSymlink:
+			if lfs, ok := fsys.(apkfs.LxattrFS); ok {
+				xattrs, _ = lfs.LListXattrs(path)
 			}
 		}
+		for name, value := range xattrs {
+			header.PAXRecords[xattrTarPAXRecordsPrefix+name] = string(value)
+		}
 
 		if err := tw.WriteHeader(header); err != nil {
 			return err
 		}
+		if info.IsDir() && afterDir != nil {
+			if err := afterDir(path); err != nil {
+				return err
+			}
+		}
 
 		if info.Mode().IsRegular() && header.Size > 0 {
 			data, err := fsys.Open(path)
@@ -279,6 +320,19 @@ func (c *Context) writeTar(ctx context.Context, tw *tar.Writer, fsys fs.FS, user
 	return nil
 }
 
+// WriteTar writes a tarball of fsys to w, usually an installed filesystem with the user and
+// group names of its etc/passwd and etc/group, which is the same byte for byte for the same
+// content: the entries are in the order of tar --sort=name, hardlinks are written as links,
+// and the times are those of WithSourceDateEpoch unless WithPreserveTimes is given.
+func WriteTar(w io.Writer, fsys fs.FS, opts ...TarOption) error {
+	c, err := NewContext(opts...)
+	if err != nil {
+		return err
+	}
+	c.noHostNames = true
+	return c.WriteTar(context.Background(), w, fsys, fsys)
+}
+
 // WriteArchive writes a tarball to the provided io.Writer from the provided fs.FS.
 // To override permissions, set the OverridePerms when creating the Context.
 // If you need to get multiple filesystems, merge them prior to calling WriteArchive.
@@ -288,7 +342,8 @@ func (c *Context) WriteArchive(dst io.Writer, src fs.FS) error {
 	return c.WriteTargz(context.Background(), dst, src, src)
 }
 
-// WriteTargz writes a gzipped tarball to the provided io.Writer from the provided fs.FS.
+// WriteTargz writes a gzipped tarball to the provided io.Writer from the provided fs.FS,
+// or one compressed with zstd if the Context has WithCompression(CompressionZstd).
 // To override permissions, set the OverridePerms when creating the Context.
 // If you need to get multiple filesystems, merge them prior to calling WriteArchive.
 // userinfosrc should be a fs which can provide an optionally provide an etc/passwd and etc/group file.
@@ -297,6 +352,18 @@ func (c *Context) WriteTargz(ctx context.Context, dst io.Writer, src fs.FS, user
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "WriteTargz")
 	defer span.End()
 
+	if c.Compression == CompressionZstd {
+		zw, err := zstd.NewWriter(dst)
+		if err != nil {
+			return fmt.Errorf("creating zstd writer: %w", err)
+		}
+		if err := c.WriteTar(ctx, zw, src, userinfofs); err != nil {
+			zw.Close()
+			return err
+		}
+		return zw.Close()
+	}
+
 	gzw := gzip.NewWriter(dst)
 	defer gzw.Close()
 
@@ -319,20 +386,97 @@ func (c *Context) WriteTar(ctx context.Context, dst io.Writer, src fs.FS, userin
 		defer tw.Flush()
 	}
 
-	// get the uname and gname maps
+	users, groups := userInfo(userinfosrc)
+	if err := c.writeTar(ctx, tw, src, users, groups, nil); err != nil {
+		return fmt.Errorf("writing TAR archive failed: %w", err)
+	}
+
+	return nil
+}
+
+// userInfo returns the user and group names of userinfosrc by ID.
+func userInfo(userinfosrc fs.FS) (users, groups map[int]string) {
 	usersFile, _ := passwd.ReadUserFile(userinfosrc, "etc/passwd")
 	groupsFile, _ := passwd.ReadGroupFile(userinfosrc, "etc/group")
-	users := map[int]string{}
-	groups := map[int]string{}
+	users = map[int]string{}
+	groups = map[int]string{}
 	for _, u := range usersFile.Entries {
 		users[int(u.UID)] = u.UserName
 	}
 	for _, g := range groupsFile.Entries {
 		groups[int(g.GID)] = g.GroupName
 	}
-	if err := c.writeTar(ctx, tw, src, users, groups); err != nil {
+	return users, groups
+}
+
+const (
+	// whiteoutPrefix is the prefix of the name of an OCI whiteout, which removes the file of
+	// the rest of the name from the layers below.
+	whiteoutPrefix = ".wh."
+	// opaqueWhiteout hides all of the directory it is in from the layers below.
+	opaqueWhiteout = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// WriteLayer writes a tarball of only what changed in src on top of its base, as a layer of an
+// OCI image: the upper filesystem of src, and a whiteout for each path that was removed from
+// the base. userinfosrc is like that of WriteTar, and is usually src itself.
+func (c *Context) WriteLayer(ctx context.Context, dst io.Writer, src apkfs.LayerFS, userinfosrc fs.FS) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "WriteLayer")
+	defer span.End()
+
+	tw := tar.NewWriter(dst)
+	if !c.SkipClose {
+		defer tw.Close()
+	} else {
+		defer tw.Flush()
+	}
+
+	// the whiteouts by the directory they are in
+	whiteouts := map[string][]string{}
+	for _, p := range src.Whiteouts() {
+		dir := filepath.Dir(p)
+		whiteouts[dir] = append(whiteouts[dir], filepath.Join(dir, whiteoutPrefix+filepath.Base(p)))
+	}
+	for _, p := range src.OpaqueDirs() {
+		whiteouts[p] = append(whiteouts[p], filepath.Join(p, opaqueWhiteout))
+	}
+	writeWhiteouts := func(dir string) error {
+		names := whiteouts[dir]
+		delete(whiteouts, dir)
+		sort.Strings(names)
+		for _, name := range names {
+			if err := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     name,
+				Mode:     0o644,
+				ModTime:  c.SourceDateEpoch,
+			}); err != nil {
+				return fmt.Errorf("writing whiteout %s failed: %w", name, err)
+			}
+		}
+		return nil
+	}
+
+	// Each whiteout is written right after the directory it is in, like those of tar layers
+	// written by other tools, and those at the root first.
+	if err := writeWhiteouts("."); err != nil {
+		return err
+	}
+	users, groups := userInfo(userinfosrc)
+	if err := c.writeTar(ctx, tw, src.Upper(), users, groups, writeWhiteouts); err != nil {
 		return fmt.Errorf("writing TAR archive failed: %w", err)
 	}
+	// and those in directories that are only in the base, which are not in the layer
+	dirs := make([]string, 0, len(whiteouts))
+	for dir := range whiteouts {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		if err := writeWhiteouts(dir); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -4,9 +4,20 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/chainguard-dev/go-apk/pkg/fs"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/require"
 )
 
@@ -29,7 +40,7 @@ func TestWriteTar(t *testing.T) {
 	require.NoError(t, err, "error setting xattr on %s", file)
 	ctx := Context{}
 	tw := tar.NewWriter(&buf)
-	err = ctx.writeTar(context.TODO(), tw, m, nil, nil)
+	err = ctx.writeTar(context.TODO(), tw, m, nil, nil, nil)
 	require.NoError(t, err, "error writing tar")
 	err = tw.Close()
 	require.NoError(t, err, "error closing tar writer")
@@ -46,3 +57,351 @@ func TestWriteTar(t *testing.T) {
 	require.Equal(t, file, hdr.Name, "tar file header name mismatch")
 	require.Equal(t, "bar", hdr.PAXRecords[xattrTarPAXRecordsPrefix+"user.file"], "tar header for file xattr mismatch")
 }
+
+func TestWriteTarSymlinkXattrs(t *testing.T) {
+	m := fs.NewMemFS()
+	require.NoError(t, m.WriteFile("file", []byte("hello world"), 0o644))
+	require.NoError(t, m.Symlink("file", "link"))
+	require.NoError(t, m.SetXattr("file", "security.capability", []byte("cap")))
+	require.NoError(t, m.(fs.LxattrFS).LSetXattr("link", "security.selinux", []byte("label")))
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, (&Context{}).writeTar(context.TODO(), tw, m, nil, nil, nil))
+	require.NoError(t, tw.Close())
+
+	tr := tar.NewReader(&buf)
+	xattrs := map[string]map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		xattrs[hdr.Name] = map[string]string{}
+		for k, v := range hdr.PAXRecords {
+			xattrs[hdr.Name][k] = v
+		}
+	}
+	require.Equal(t, map[string]map[string]string{
+		"file": {xattrTarPAXRecordsPrefix + "security.capability": "cap"},
+		"link": {xattrTarPAXRecordsPrefix + "security.selinux": "label"},
+	}, xattrs, "a symlink should have its own xattrs, not those of its target")
+}
+
+func TestWriteTarHardlinks(t *testing.T) {
+	m := fs.NewMemFS()
+	require.NoError(t, m.WriteFile("a", []byte("hello world"), 0o755))
+	require.NoError(t, m.Link("a", "b"))
+	require.NoError(t, m.WriteFile("c", []byte("hello world"), 0o755))
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, (&Context{}).writeTar(context.TODO(), tw, m, nil, nil, nil))
+	require.NoError(t, tw.Close())
+
+	tr := tar.NewReader(&buf)
+	headers := map[string]*tar.Header{}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		headers[hdr.Name] = hdr
+	}
+	require.Equal(t, byte(tar.TypeReg), headers["a"].Typeflag)
+	require.Equal(t, int64(len("hello world")), headers["a"].Size)
+	require.Equal(t, byte(tar.TypeLink), headers["b"].Typeflag, "the second name of a file should be a hardlink")
+	require.Equal(t, "a", headers["b"].Linkname)
+	require.Zero(t, headers["b"].Size)
+	require.Equal(t, byte(tar.TypeReg), headers["c"].Typeflag, "a file with the same content is not a hardlink")
+}
+
+func TestWriteLayer(t *testing.T) {
+	base := fs.NewMemFS()
+	require.NoError(t, base.MkdirAll("etc/apk", 0o755))
+	require.NoError(t, base.WriteFile("etc/apk/world", []byte("busybox\n"), 0o644))
+	require.NoError(t, base.WriteFile("etc/motd", []byte("hello\n"), 0o644))
+	require.NoError(t, base.MkdirAll("var/cache", 0o755))
+	require.NoError(t, base.WriteFile("var/cache/old", nil, 0o644))
+	require.NoError(t, base.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, base.WriteFile("usr/bin/env", nil, 0o755))
+
+	layer := fs.NewOverlayFS(base, fs.NewMemFS())
+	require.NoError(t, layer.WriteFile("etc/apk/world", []byte("busybox\ncurl\n"), 0o644))
+	require.NoError(t, layer.Remove("etc/motd"))
+	require.NoError(t, layer.Remove("var/cache/old"))
+	require.NoError(t, layer.Remove("var/cache"))
+	require.NoError(t, layer.Mkdir("var/cache", 0o755))
+	// in a directory that is only in the base
+	require.NoError(t, layer.Remove("usr/bin/env"))
+
+	var buf bytes.Buffer
+	require.NoError(t, (&Context{}).WriteLayer(context.TODO(), &buf, layer, layer))
+
+	tr := tar.NewReader(&buf)
+	var entries []string
+	contents := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		entries = append(entries, hdr.Name)
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		contents[hdr.Name] = string(b)
+		if strings.Contains(hdr.Name, ".wh.") {
+			require.Equal(t, int64(0o644), hdr.Mode, hdr.Name)
+			require.Zero(t, hdr.Uid, hdr.Name)
+			require.Zero(t, hdr.Gid, hdr.Name)
+		}
+	}
+	require.Equal(t, []string{
+		"etc",
+		"etc/.wh.motd",
+		"etc/apk",
+		"etc/apk/world",
+		"var",
+		"var/cache",
+		"var/cache/.wh..wh..opq",
+		"usr/bin/.wh.env",
+	}, entries, "only the changes should be in the layer, with each whiteout after its directory")
+	require.Equal(t, "busybox\ncurl\n", contents["etc/apk/world"])
+}
+
+func TestWriteTargzZstd(t *testing.T) {
+	m := fs.NewMemFS()
+	require.NoError(t, m.WriteFile("hello", []byte("hello world"), 0o644))
+
+	ctx, err := NewContext(WithCompression(CompressionZstd))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, ctx.WriteTargz(context.TODO(), &buf, m, m))
+
+	zr, err := zstd.NewReader(&buf)
+	require.NoError(t, err)
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	require.Equal(t, "hello", hdr.Name)
+	b, err := io.ReadAll(tr)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(b))
+}
+
+func TestWriteTarDevices(t *testing.T) {
+	m := fs.NewMemFS()
+	require.NoError(t, m.Mknod("null", fs.MknodMode(iofs.ModeDevice|iofs.ModeCharDevice|0o666), fs.Mkdev(1, 3)))
+	require.NoError(t, m.Mknod("sda", fs.MknodMode(iofs.ModeDevice|0o660), fs.Mkdev(8, 0)))
+	require.NoError(t, m.Mknod("fifo", fs.MknodMode(iofs.ModeNamedPipe|0o600), 0))
+	require.NoError(t, m.Mknod("socket", fs.MknodMode(iofs.ModeSocket|0o600), 0))
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, (&Context{}).writeTar(context.TODO(), tw, m, nil, nil, nil))
+	require.NoError(t, tw.Close())
+
+	headers := map[string]*tar.Header{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		headers[hdr.Name] = hdr
+	}
+	// sockets are left out
+	require.Len(t, headers, 3)
+	require.Equal(t, byte(tar.TypeChar), headers["null"].Typeflag)
+	require.Equal(t, int64(1), headers["null"].Devmajor)
+	require.Equal(t, int64(3), headers["null"].Devminor)
+	require.Equal(t, int64(0o666), headers["null"].Mode)
+	require.Equal(t, byte(tar.TypeBlock), headers["sda"].Typeflag)
+	require.Equal(t, int64(8), headers["sda"].Devmajor)
+	require.Equal(t, byte(tar.TypeFifo), headers["fifo"].Typeflag)
+}
+
+func TestWriteTarPreserveTimes(t *testing.T) {
+	var (
+		m     = fs.NewMemFS()
+		mtime = time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+		sde   = time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	)
+	require.NoError(t, m.WriteFile("old", []byte("old"), 0o644))
+	require.NoError(t, m.WriteFile("new", []byte("new"), 0o644))
+	require.NoError(t, m.(fs.ChtimesFS).Lchtimes("old", mtime, mtime))
+	require.NoError(t, m.SetXattr("old", "security.capability", []byte("cap")))
+
+	ctx, err := NewContext(WithPreserveTimes(true), WithSourceDateEpoch(sde))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, ctx.writeTar(context.TODO(), tw, m, nil, nil, nil))
+	require.NoError(t, tw.Close())
+
+	headers := map[string]*tar.Header{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		headers[hdr.Name] = hdr
+	}
+	require.True(t, headers["old"].ModTime.Equal(mtime), "mtime of old should be kept, is %s", headers["old"].ModTime)
+	require.True(t, headers["old"].AccessTime.Equal(mtime), "atime of old should be kept, is %s", headers["old"].AccessTime)
+	require.Equal(t, "cap", headers["old"].PAXRecords[xattrTarPAXRecordsPrefix+"security.capability"])
+	// it was written now, which is later than SourceDateEpoch
+	require.True(t, headers["new"].ModTime.Equal(sde), "mtime of new should be clamped, is %s", headers["new"].ModTime)
+}
+
+// reversedFS returns the entries of each directory in reverse order, like a filesystem that
+// does not sort them.
+type reversedFS struct {
+	fs.FullFS
+}
+
+func (r reversedFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	entries, err := r.FullFS.ReadDir(name)
+	slices.Reverse(entries)
+	return entries, err
+}
+
+// testInstall lays out the same filesystem in the given order of its files, with their times
+// set to when they were written.
+func testInstall(t *testing.T, order []string, mtime time.Time) fs.FullFS {
+	m := fs.NewMemFS()
+	require.NoError(t, m.MkdirAll("etc", 0o755))
+	require.NoError(t, m.WriteFile("etc/passwd", []byte("root:x:0:0:root:/root:/bin/sh\nnobody:x:65534:65534:nobody:/:/sbin/nologin\n"), 0o644))
+	require.NoError(t, m.WriteFile("etc/group", []byte("root:x:0:root\nnogroup:x:65533:\n"), 0o644))
+	for _, name := range order {
+		switch name {
+		case "usr/bin/busybox":
+			require.NoError(t, m.MkdirAll("usr/bin", 0o755))
+			require.NoError(t, m.WriteFile(name, []byte("busybox"), 0o755))
+			require.NoError(t, m.SetXattr(name, "security.capability", []byte("cap")))
+			require.NoError(t, m.SetXattr(name, "user.comment", []byte("shell")))
+		case "usr/bin/sh":
+			require.NoError(t, m.MkdirAll("usr/bin", 0o755))
+			require.NoError(t, m.Symlink("busybox", name))
+		case "usr/bin/ls":
+			require.NoError(t, m.Link("usr/bin/busybox", name))
+		case "usr/lib-extra/so":
+			require.NoError(t, m.MkdirAll("usr/lib-extra", 0o755))
+			require.NoError(t, m.WriteFile(name, []byte("so"), 0o644))
+			require.NoError(t, m.Chown(name, 65534, 65533))
+		case "var/empty":
+			require.NoError(t, m.MkdirAll(name, 0o700))
+		}
+		require.NoError(t, m.(fs.ChtimesFS).Lchtimes(name, mtime, mtime))
+		mtime = mtime.Add(time.Hour)
+	}
+	return m
+}
+
+func TestWriteTarDeterministic(t *testing.T) {
+	sde := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	digest := func(fsys iofs.FS, opts ...TarOption) string {
+		var buf bytes.Buffer
+		require.NoError(t, WriteTar(&buf, fsys, opts...))
+		return fmt.Sprintf("%x", sha256.Sum256(buf.Bytes()))
+	}
+
+	order := []string{"usr/bin/busybox", "usr/bin/sh", "usr/bin/ls", "usr/lib-extra/so", "var/empty"}
+	// installed a year apart, both after sde, which preserved times are clamped to
+	first := testInstall(t, order, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	reversed := slices.Clone(order)
+	slices.Reverse(reversed[1:])
+	second := testInstall(t, reversed, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	for _, opts := range [][]TarOption{
+		{WithSourceDateEpoch(sde)},
+		{WithSourceDateEpoch(sde), WithPreserveTimes(true)},
+		{WithSourceDateEpoch(sde), WithOverrideUIDGID(1000, 1000)},
+		{WithUseChecksums(true)},
+	} {
+		require.Equal(t, digest(first, opts...), digest(second, opts...), "two identical installs should have the same tar")
+		require.Equal(t, digest(first, opts...), digest(reversedFS{second}, opts...), "the order of ReadDir should not matter")
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteTar(&buf, first, WithSourceDateEpoch(sde)))
+	var names []string
+	headers := map[string]*tar.Header{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+		headers[hdr.Name] = hdr
+	}
+	// like tar --sort=name, what is in a directory comes right after it
+	require.Equal(t, []string{
+		"etc", "etc/group", "etc/passwd",
+		"usr", "usr/bin", "usr/bin/busybox", "usr/bin/ls", "usr/bin/sh",
+		"usr/lib-extra", "usr/lib-extra/so",
+		"var", "var/empty",
+	}, names)
+	require.Equal(t, byte(tar.TypeLink), headers["usr/bin/ls"].Typeflag)
+	require.Equal(t, "usr/bin/busybox", headers["usr/bin/ls"].Linkname)
+	require.Equal(t, "shell", headers["usr/bin/busybox"].PAXRecords[xattrTarPAXRecordsPrefix+"user.comment"])
+	require.Equal(t, "root", headers["usr/bin/busybox"].Uname)
+	require.Equal(t, "nobody", headers["usr/lib-extra/so"].Uname)
+	require.Equal(t, "nogroup", headers["usr/lib-extra/so"].Gname)
+	for name, hdr := range headers {
+		require.True(t, hdr.ModTime.Equal(sde), "mtime of %s should be the SourceDateEpoch, is %s", name, hdr.ModTime)
+	}
+}
+
+func TestWriteTarHostNames(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0o644))
+	fi, err := os.Lstat(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	want, err := tar.FileInfoHeader(fi, "")
+	require.NoError(t, err)
+	if want.Uname == "" {
+		t.Skip("the names of the owner of files are not known on this host")
+	}
+	uname := func(write func(w io.Writer, fsys iofs.FS) error) string {
+		var buf bytes.Buffer
+		require.NoError(t, write(&buf, os.DirFS(dir)))
+		hdr, err := tar.NewReader(&buf).Next()
+		require.NoError(t, err)
+		return hdr.Uname
+	}
+
+	// the names of the host are kept, as they always were
+	require.Equal(t, want.Uname, uname(func(w io.Writer, fsys iofs.FS) error {
+		return (&Context{}).WriteTar(context.TODO(), w, fsys, fsys)
+	}))
+	// but not by WriteTar, which only has those of the filesystem
+	require.Empty(t, uname(func(w io.Writer, fsys iofs.FS) error {
+		return WriteTar(w, fsys)
+	}))
+}
+
+func TestWithSourceDateEpochFromEnv(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1685577600")
+	ctx, err := NewContext(WithSourceDateEpochFromEnv())
+	require.NoError(t, err)
+	require.True(t, ctx.SourceDateEpoch.Equal(time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)), "is %s", ctx.SourceDateEpoch)
+
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	ctx, err = NewContext(WithSourceDateEpochFromEnv())
+	require.NoError(t, err)
+	require.True(t, ctx.SourceDateEpoch.IsZero())
+
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	_, err = NewContext(WithSourceDateEpochFromEnv())
+	require.ErrorContains(t, err, "SOURCE_DATE_EPOCH")
+}